@@ -73,6 +73,7 @@ type PsiphonTunnel struct {
 	embeddedServerListWaitGroup sync.WaitGroup
 	controllerWaitGroup         sync.WaitGroup
 	stopController              context.CancelFunc
+	config                      *psiphon.Config
 
 	// The port on which the HTTP proxy is running
 	HTTPProxyPort int
@@ -228,12 +229,13 @@ func StartTunnel(
 	if err != nil {
 		return nil, errors.TraceMsg(err, "failed to open data store")
 	}
+	tunnel.config = config
 	// Make sure we close the datastore in case of error
 	defer func() {
 		if retErr != nil {
 			tunnel.controllerWaitGroup.Wait()
 			tunnel.embeddedServerListWaitGroup.Wait()
-			psiphon.CloseDataStore()
+			psiphon.CloseDataStore(config)
 		}
 	}()
 
@@ -267,7 +269,7 @@ func StartTunnel(
 			return
 		}
 	}()
-	if !psiphon.HasServerEntries() {
+	if !psiphon.HasServerEntries(config) {
 		psiphon.NoticeInfo("awaiting embedded server entry list import")
 		tunnel.embeddedServerListWaitGroup.Wait()
 	}
@@ -330,5 +332,5 @@ func (tunnel *PsiphonTunnel) Stop() {
 	tunnel.stopController()
 	tunnel.controllerWaitGroup.Wait()
 	tunnel.embeddedServerListWaitGroup.Wait()
-	psiphon.CloseDataStore()
+	psiphon.CloseDataStore(tunnel.config)
 }
@@ -0,0 +1,419 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	DATASTORE_COMMAND_SERVER_ENTRIES   = "serverEntries"
+	DATASTORE_COMMAND_DIAL_PARAMETERS  = "dialParameters"
+	DATASTORE_COMMAND_TACTICS          = "tactics"
+	DATASTORE_COMMAND_SLOKS            = "sloks"
+	DATASTORE_COMMAND_PERSISTENT_STATS = "persistentStats"
+	DATASTORE_COMMAND_KEY_VALUES       = "keyValues"
+	DATASTORE_COMMAND_EXPORT           = "export"
+	DATASTORE_COMMAND_IMPORT           = "import"
+	DATASTORE_COMMAND_BACKUP           = "backup"
+	DATASTORE_COMMAND_COMPACT          = "compact"
+)
+
+var datastoreCommands = []string{
+	DATASTORE_COMMAND_SERVER_ENTRIES,
+	DATASTORE_COMMAND_DIAL_PARAMETERS,
+	DATASTORE_COMMAND_TACTICS,
+	DATASTORE_COMMAND_SLOKS,
+	DATASTORE_COMMAND_PERSISTENT_STATS,
+	DATASTORE_COMMAND_KEY_VALUES,
+	DATASTORE_COMMAND_EXPORT,
+	DATASTORE_COMMAND_IMPORT,
+	DATASTORE_COMMAND_BACKUP,
+	DATASTORE_COMMAND_COMPACT,
+}
+
+// DatastoreWorker is the Worker protocol implementation used for datastore
+// mode, which inspects and maintains the datastore for debugging and
+// support purposes.
+//
+// The inspection commands emit JSON to stdout. The export command writes an
+// encoded server entry list to the specified file, or to stdout; the import
+// command reads an encoded server entry list from the specified file. The
+// backup command writes a copy of the datastore to the specified file.
+//
+// Datastore mode should not be run while a tunnel mode process is using the
+// same data directory; the compact command, in particular, rewrites the
+// datastore file.
+type DatastoreWorker struct {
+	config     *psiphon.Config
+	command    string
+	filename   string
+	region     string
+	source     string
+	protocol   string
+	capability string
+	networkID  string
+	replace    bool
+}
+
+// Init implements the Worker interface.
+func (d *DatastoreWorker) Init(ctx context.Context, config *psiphon.Config) error {
+
+	if !common.Contains(datastoreCommands, d.command) {
+		return errors.Tracef("invalid datastore command: %s", d.command)
+	}
+
+	if (d.command == DATASTORE_COMMAND_IMPORT || d.command == DATASTORE_COMMAND_BACKUP) &&
+		d.filename == "" {
+		return errors.Tracef("datastore command %s requires a file", d.command)
+	}
+
+	if d.protocol != "" && !common.Contains(protocol.SupportedTunnelProtocols, d.protocol) {
+		return errors.Tracef("invalid protocol: %s", d.protocol)
+	}
+
+	d.config = config
+
+	// The compact command requires the datastore to be closed.
+
+	if d.command != DATASTORE_COMMAND_COMPACT {
+		err := psiphon.OpenDataStoreWithoutRetry(config)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Run implements the Worker interface.
+func (d *DatastoreWorker) Run(ctx context.Context) error {
+
+	if d.command == DATASTORE_COMMAND_COMPACT {
+		err := psiphon.CompactDataStore(d.config)
+		if err != nil {
+			return errors.TraceMsg(err, "Datastore: compact failed")
+		}
+		psiphon.NoticeInfo("Datastore: compact succeeded")
+		return nil
+	}
+
+	defer psiphon.CloseDataStore(d.config)
+
+	var err error
+
+	switch d.command {
+	case DATASTORE_COMMAND_SERVER_ENTRIES:
+		err = d.listServerEntries()
+	case DATASTORE_COMMAND_DIAL_PARAMETERS:
+		err = d.listDialParameters()
+	case DATASTORE_COMMAND_TACTICS:
+		err = d.listTactics()
+	case DATASTORE_COMMAND_SLOKS:
+		err = d.listSLOKs()
+	case DATASTORE_COMMAND_PERSISTENT_STATS:
+		err = d.listPersistentStats()
+	case DATASTORE_COMMAND_KEY_VALUES:
+		err = d.listKeyValues()
+	case DATASTORE_COMMAND_EXPORT:
+		err = d.exportServerEntries()
+	case DATASTORE_COMMAND_IMPORT:
+		err = d.importServerEntries(ctx)
+	case DATASTORE_COMMAND_BACKUP:
+		err = psiphon.BackupDataStore(d.config, d.filename)
+		if err == nil {
+			psiphon.NoticeInfo("Datastore: backup succeeded")
+		}
+	}
+
+	if err != nil {
+		return errors.TraceMsg(err, fmt.Sprintf("Datastore: %s failed", d.command))
+	}
+
+	return nil
+}
+
+func (d *DatastoreWorker) importServerEntries(ctx context.Context) error {
+
+	file, err := os.Open(d.filename)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	count, err := psiphon.ImportServerEntries(ctx, d.config, file, d.replace)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	psiphon.NoticeInfo(
+		"Datastore: import succeeded: %d server entries stored, %d total",
+		count, psiphon.CountServerEntries(d.config))
+
+	return nil
+}
+
+func (d *DatastoreWorker) matchServerEntry(serverEntry *protocol.ServerEntry) bool {
+	if d.region != "" && serverEntry.Region != d.region {
+		return false
+	}
+	if d.source != "" && serverEntry.LocalSource != d.source {
+		return false
+	}
+	if d.protocol != "" && !serverEntry.SupportsProtocol(d.protocol) {
+		return false
+	}
+	if d.capability != "" && !common.Contains(serverEntry.Capabilities, d.capability) {
+		return false
+	}
+	return true
+}
+
+type datastoreServerEntry struct {
+	DiagnosticID         string   `json:"diagnosticID"`
+	IPAddress            string   `json:"ipAddress"`
+	Region               string   `json:"region"`
+	Source               string   `json:"source"`
+	Timestamp            string   `json:"timestamp"`
+	ConfigurationVersion int      `json:"configurationVersion"`
+	Protocols            []string `json:"protocols"`
+	Capabilities         []string `json:"capabilities"`
+	Signed               bool     `json:"signed"`
+}
+
+func (d *DatastoreWorker) listServerEntries() error {
+
+	var serverEntries []*datastoreServerEntry
+
+	err := psiphon.ScanServerEntries(d.config, func(serverEntry *protocol.ServerEntry) bool {
+
+		if !d.matchServerEntry(serverEntry) {
+			return true
+		}
+
+		var protocols []string
+		for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+			if serverEntry.SupportsProtocol(tunnelProtocol) {
+				protocols = append(protocols, tunnelProtocol)
+			}
+		}
+
+		serverEntries = append(serverEntries, &datastoreServerEntry{
+			DiagnosticID:         serverEntry.GetDiagnosticID(),
+			IPAddress:            serverEntry.IpAddress,
+			Region:               serverEntry.Region,
+			Source:               serverEntry.LocalSource,
+			Timestamp:            serverEntry.LocalTimestamp,
+			ConfigurationVersion: serverEntry.ConfigurationVersion,
+			Protocols:            protocols,
+			Capabilities:         serverEntry.Capabilities,
+			Signed:               serverEntry.HasSignature(),
+		})
+
+		return true
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return printDatastoreJSON(serverEntries)
+}
+
+type datastoreDialParameters struct {
+	ServerIPAddress string          `json:"serverIPAddress"`
+	NetworkID       string          `json:"networkID"`
+	DialParameters  json.RawMessage `json:"dialParameters"`
+}
+
+func (d *DatastoreWorker) listDialParameters() error {
+
+	var records []*datastoreDialParameters
+
+	err := psiphon.ScanDialParameters(
+		d.config,
+		func(serverIPAddress, networkID string, record []byte) bool {
+			if d.networkID != "" && networkID != d.networkID {
+				return true
+			}
+			records = append(records, &datastoreDialParameters{
+				ServerIPAddress: serverIPAddress,
+				NetworkID:       networkID,
+				DialParameters:  getDatastoreJSONValue(record),
+			})
+			return true
+		})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return printDatastoreJSON(records)
+}
+
+type datastoreTacticsRecord struct {
+	NetworkID string          `json:"networkID"`
+	Record    json.RawMessage `json:"record"`
+}
+
+func (d *DatastoreWorker) listTactics() error {
+
+	var records []*datastoreTacticsRecord
+
+	err := psiphon.ScanTacticsRecords(
+		d.config,
+		func(networkID string, record []byte) bool {
+			if d.networkID != "" && networkID != d.networkID {
+				return true
+			}
+			records = append(records, &datastoreTacticsRecord{
+				NetworkID: networkID,
+				Record:    getDatastoreJSONValue(record),
+			})
+			return true
+		})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return printDatastoreJSON(records)
+}
+
+func (d *DatastoreWorker) listSLOKs() error {
+
+	// Only SLOK IDs are listed; the SLOK key material is not output.
+
+	IDs, err := psiphon.GetSLOKIDs(d.config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	SLOKIDs := make([]string, len(IDs))
+	for i, ID := range IDs {
+		SLOKIDs[i] = hex.EncodeToString(ID)
+	}
+
+	return printDatastoreJSON(SLOKIDs)
+}
+
+type datastorePersistentStat struct {
+	Type      string          `json:"type"`
+	Reporting bool            `json:"reporting"`
+	Stat      json.RawMessage `json:"stat"`
+}
+
+func (d *DatastoreWorker) listPersistentStats() error {
+
+	var stats []*datastorePersistentStat
+
+	err := psiphon.ScanPersistentStats(
+		d.config,
+		func(statType string, stat []byte, reporting bool) bool {
+			stats = append(stats, &datastorePersistentStat{
+				Type:      statType,
+				Reporting: reporting,
+				Stat:      getDatastoreJSONValue(stat),
+			})
+			return true
+		})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return printDatastoreJSON(stats)
+}
+
+func (d *DatastoreWorker) listKeyValues() error {
+
+	// Binary values are output as hex strings.
+
+	keyValues := make(map[string]string)
+
+	err := psiphon.ScanKeyValues(
+		d.config,
+		func(key string, value []byte) bool {
+			if utf8.Valid(value) {
+				keyValues[key] = string(value)
+			} else {
+				keyValues[key] = hex.EncodeToString(value)
+			}
+			return true
+		})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return printDatastoreJSON(keyValues)
+}
+
+func (d *DatastoreWorker) exportServerEntries() error {
+
+	var writer io.Writer = os.Stdout
+
+	if d.filename != "" {
+		file, err := os.OpenFile(d.filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	count, err := psiphon.ExportServerEntries(d.config, writer, d.matchServerEntry)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	psiphon.NoticeInfo("Datastore: exported %d server entries", count)
+
+	return nil
+}
+
+// getDatastoreJSONValue returns value as a JSON value; a stored value that
+// is not valid JSON, which indicates corruption, is returned as a JSON
+// string.
+func getDatastoreJSONValue(value []byte) json.RawMessage {
+	if json.Valid(value) {
+		return value
+	}
+	str, _ := json.Marshal(string(value))
+	return str
+}
+
+func printDatastoreJSON(value interface{}) error {
+
+	output, err := json.MarshalIndent(value, "", "    ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Printf("%s\n", output)
+
+	return nil
+}
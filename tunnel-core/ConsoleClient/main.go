@@ -78,6 +78,49 @@ func main() {
 		"The path at which to upload the feedback package when the \"-feedbackUpload\"\n"+
 			"flag is provided. Must be provided by Psiphon Inc.")
 
+	var oslProgress bool
+	flag.BoolVar(&oslProgress, "oslProgress", false,
+		"Print OSL progress and exit. Progress is determined from the stored SLOKs\n"+
+			"and the cached OSL registry, and includes the key shares held for each OSL,\n"+
+			"which OSLs are unlocked, and the number of server entries imported from each\n"+
+			"OSL. The progress is written to stdout in JSON format.")
+
+	var oslProgressAll bool
+	flag.BoolVar(&oslProgressAll, "oslProgressAll", false,
+		"With \"-oslProgress\", include OSLs for which no SLOKs are held.")
+
+	var datastoreCommand string
+	flag.StringVar(&datastoreCommand, "datastore", "",
+		"Run a datastore command and exit. Commands are:\n"+
+			"\"serverEntries\": list server entries, filtered by \"-region\", \"-source\",\n"+
+			"\"-protocol\" and \"-capability\";\n"+
+			"\"dialParameters\", \"tactics\": list records, filtered by \"-networkID\";\n"+
+			"\"sloks\", \"persistentStats\", \"keyValues\": list records;\n"+
+			"\"export\": write filtered server entries, as an encoded server entry list, to\n"+
+			"\"-datastoreFile\" or stdout;\n"+
+			"\"import\": store server entries from the \"-datastoreFile\" encoded list, retaining\n"+
+			"each server entry's source, and replacing existing server entries with \"-replace\";\n"+
+			"\"backup\": write a copy of the datastore to \"-datastoreFile\";\n"+
+			"\"compact\": rewrite the datastore to reclaim unused space.\n"+
+			"Listings are written to stdout in JSON format. Do not run datastore commands\n"+
+			"while another process is using the same data directory.")
+
+	var datastoreFile string
+	flag.StringVar(&datastoreFile, "datastoreFile", "",
+		"The input or output file for the \"-datastore\" export, import and backup commands.")
+
+	var datastoreRegion, datastoreSource, datastoreProtocol, datastoreCapability string
+	flag.StringVar(&datastoreRegion, "region", "", "With \"-datastore\", filter server entries by region.")
+	flag.StringVar(&datastoreSource, "source", "", "With \"-datastore\", filter server entries by source.")
+	flag.StringVar(&datastoreProtocol, "protocol", "", "With \"-datastore\", filter server entries by supported tunnel protocol.")
+	flag.StringVar(&datastoreCapability, "capability", "", "With \"-datastore\", filter server entries by capability.")
+
+	var datastoreReplace bool
+	flag.BoolVar(&datastoreReplace, "replace", false, "With \"-datastore import\", replace existing server entries.")
+
+	var datastoreNetworkID string
+	flag.StringVar(&datastoreNetworkID, "networkID", "", "With \"-datastore\", filter records by network ID.")
+
 	var tunDevice, tunBindInterface, tunDNSServers string
 	if tun.IsSupported() {
 
@@ -241,6 +284,23 @@ func main() {
 		worker = &FeedbackWorker{
 			feedbackUploadPath: feedbackUploadPath,
 		}
+	} else if oslProgress {
+		// OSL progress mode
+		worker = &OSLProgressWorker{
+			includeUnseeded: oslProgressAll,
+		}
+	} else if datastoreCommand != "" {
+		// Datastore mode
+		worker = &DatastoreWorker{
+			command:    datastoreCommand,
+			filename:   datastoreFile,
+			region:     datastoreRegion,
+			source:     datastoreSource,
+			protocol:   datastoreProtocol,
+			capability: datastoreCapability,
+			networkID:  datastoreNetworkID,
+			replace:    datastoreReplace,
+		}
 	} else {
 		// Tunnel mode
 		worker = &TunnelWorker{
@@ -358,6 +418,7 @@ type Worker interface {
 type TunnelWorker struct {
 	embeddedServerEntryListFilename string
 	embeddedServerListWaitGroup     *sync.WaitGroup
+	config                          *psiphon.Config
 	controller                      *psiphon.Controller
 }
 
@@ -371,6 +432,7 @@ func (w *TunnelWorker) Init(ctx context.Context, config *psiphon.Config) error {
 		psiphon.NoticeError("error initializing datastore: %s", err)
 		os.Exit(1)
 	}
+	w.config = config
 
 	// If specified, the embedded server list is loaded and stored. When there
 	// are no server candidates at all, we wait for this import to complete
@@ -402,7 +464,7 @@ func (w *TunnelWorker) Init(ctx context.Context, config *psiphon.Config) error {
 			}
 		}()
 
-		if !psiphon.HasServerEntries() {
+		if !psiphon.HasServerEntries(w.config) {
 			psiphon.NoticeInfo("awaiting embedded server entry list import")
 			w.embeddedServerListWaitGroup.Wait()
 		}
@@ -420,7 +482,7 @@ func (w *TunnelWorker) Init(ctx context.Context, config *psiphon.Config) error {
 
 // Run implements the Worker interface.
 func (w *TunnelWorker) Run(ctx context.Context) error {
-	defer psiphon.CloseDataStore()
+	defer psiphon.CloseDataStore(w.config)
 	if w.embeddedServerListWaitGroup != nil {
 		defer w.embeddedServerListWaitGroup.Wait()
 	}
@@ -473,3 +535,42 @@ func (f *FeedbackWorker) Run(ctx context.Context) error {
 
 	return nil
 }
+
+// OSLProgressWorker is the Worker protocol implementation used for OSL
+// progress mode.
+type OSLProgressWorker struct {
+	config          *psiphon.Config
+	includeUnseeded bool
+}
+
+// Init implements the Worker interface.
+func (o *OSLProgressWorker) Init(ctx context.Context, config *psiphon.Config) error {
+
+	err := psiphon.OpenDataStore(config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	o.config = config
+
+	return nil
+}
+
+// Run implements the Worker interface.
+func (o *OSLProgressWorker) Run(ctx context.Context) error {
+	defer psiphon.CloseDataStore(o.config)
+
+	progress, err := psiphon.GetOSLProgress(o.config, o.includeUnseeded)
+	if err != nil {
+		return errors.TraceMsg(err, "OSLProgress: failed")
+	}
+
+	output, err := json.MarshalIndent(progress, "", "    ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Printf("%s\n", output)
+
+	return nil
+}
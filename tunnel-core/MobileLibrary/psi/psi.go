@@ -32,10 +32,12 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/buildinfo"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/exchange"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tun"
 )
 
@@ -68,6 +70,19 @@ type PsiphonProviderFeedbackHandler interface {
 	SendFeedbackCompleted(err error)
 }
 
+type PsiphonExchangeLANOfferConfirmer interface {
+	// ConfirmExchangeTransfer must prompt the user to allow a LAN exchange
+	// transfer to the peer, and return true when allowed. The call may
+	// block while the user responds.
+	ConfirmExchangeTransfer(peerIPAddress string) bool
+
+	// CancelExchangeTransferConfirmation is called, concurrently, when the
+	// confirmation times out or the offer is stopped. It must dismiss the
+	// prompt and cause a pending ConfirmExchangeTransfer to promptly return
+	// false.
+	CancelExchangeTransferConfirmation()
+}
+
 func NoticeUserLog(message string) {
 	psiphon.NoticeUserLog(message)
 }
@@ -117,6 +132,7 @@ func UpgradeDownloadFilePath(rootDataDirectoryPath string) string {
 var controllerMutex sync.Mutex
 var embeddedServerListWaitGroup *sync.WaitGroup
 var controller *psiphon.Controller
+var controllerConfig *psiphon.Config
 var controllerCtx context.Context
 var stopController context.CancelFunc
 var controllerWaitGroup *sync.WaitGroup
@@ -226,7 +242,7 @@ func Start(
 			return
 		}
 	}()
-	if !psiphon.HasServerEntries() {
+	if !psiphon.HasServerEntries(config) {
 		psiphon.NoticeInfo("awaiting embedded server entry list import")
 		embeddedServerListWaitGroup.Wait()
 	}
@@ -235,10 +251,12 @@ func Start(
 	if err != nil {
 		stopController()
 		embeddedServerListWaitGroup.Wait()
-		psiphon.CloseDataStore()
+		psiphon.CloseDataStore(config)
 		return fmt.Errorf("error initializing controller: %s", err)
 	}
 
+	controllerConfig = config
+
 	controllerWaitGroup = new(sync.WaitGroup)
 	controllerWaitGroup.Add(1)
 	go func() {
@@ -255,11 +273,13 @@ func Stop() {
 	defer controllerMutex.Unlock()
 
 	if controller != nil {
+		stopExchangeLANOffer()
 		stopController()
 		controllerWaitGroup.Wait()
 		embeddedServerListWaitGroup.Wait()
-		psiphon.CloseDataStore()
+		psiphon.CloseDataStore(controllerConfig)
 		controller = nil
+		controllerConfig = nil
 		controllerCtx = nil
 		stopController = nil
 		controllerWaitGroup = nil
@@ -341,6 +361,188 @@ func ImportExchangePayload(payload string) bool {
 	return controller.ImportExchangePayload(payload)
 }
 
+// ExportExchangePayloadQRFrames creates a payload for client-to-client
+// server connection info exchange, split into frames to be displayed as a
+// sequence of QR codes. The receiver scans the frames using an
+// ExchangeQRFrameAssembler.
+//
+// ExportExchangePayloadQRFrames will succeed only when Psiphon is running,
+// between Start and Stop.
+//
+// The return value is a newline-delimited list of frames; when "", the
+// export failed and a diagnostic has been logged.
+func ExportExchangePayloadQRFrames() string {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return ""
+	}
+
+	return strings.Join(controller.ExportExchangePayloadQRFrames(), "\n")
+}
+
+// ExchangeQRFrameAssembler reassembles an exchange payload from scanned QR
+// code frames. Frames may be added in any order and duplicates are ignored.
+type ExchangeQRFrameAssembler struct {
+	assembler *exchange.QRFrameAssembler
+}
+
+func NewExchangeQRFrameAssembler() *ExchangeQRFrameAssembler {
+	return &ExchangeQRFrameAssembler{
+		assembler: exchange.NewQRFrameAssembler(),
+	}
+}
+
+// AddFrame adds a scanned frame and returns true when all frames have been
+// received. An error indicates an invalid frame; scanning should continue.
+func (a *ExchangeQRFrameAssembler) AddFrame(frame string) (bool, error) {
+	return a.assembler.AddFrame(frame)
+}
+
+// GetReceivedFrameCount returns the number of distinct frames received.
+func (a *ExchangeQRFrameAssembler) GetReceivedFrameCount() int {
+	received, _ := a.assembler.Progress()
+	return received
+}
+
+// GetFrameCount returns the total number of frames in the payload, or 0
+// when no frame has been received.
+func (a *ExchangeQRFrameAssembler) GetFrameCount() int {
+	_, total := a.assembler.Progress()
+	return total
+}
+
+// GetPayload returns the reassembled payload, which may be passed to
+// ImportExchangePayload.
+func (a *ExchangeQRFrameAssembler) GetPayload() (string, error) {
+	return a.assembler.Payload()
+}
+
+var exchangeLANOfferMutex sync.Mutex
+var exchangeLANOffer *exchange.LANOffer
+
+// StartExchangeLANOffer starts offering exchange payloads to peers on the
+// local network, using mDNS discovery. Each transfer is first confirmed
+// with the user via confirmer. The returned offer code must be shown to the
+// receiving user, for example as a QR code, and is required by
+// DiscoverExchangeLANOffers and ReceiveExchangeLANOffer.
+//
+// Advertising an offer reveals the presence of a Psiphon client to other
+// devices on the local network. The offer should be started only at the
+// user's request and stopped, with StopExchangeLANOffer, once the exchange
+// is done. The offer is also stopped by Stop.
+//
+// StartExchangeLANOffer will succeed only when Psiphon is running, between
+// Start and Stop.
+func StartExchangeLANOffer(confirmer PsiphonExchangeLANOfferConfirmer) (string, error) {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return "", fmt.Errorf("not running")
+	}
+
+	exchangeLANOfferMutex.Lock()
+	defer exchangeLANOfferMutex.Unlock()
+
+	if exchangeLANOffer != nil {
+		return "", fmt.Errorf("already started")
+	}
+
+	offer, err := controller.StartExchangeLANOffer(
+		func(ctx context.Context, peerIPAddress string) bool {
+			confirmed := make(chan struct{})
+			defer close(confirmed)
+			go func() {
+				select {
+				case <-ctx.Done():
+					confirmer.CancelExchangeTransferConfirmation()
+				case <-confirmed:
+				}
+			}()
+			return confirmer.ConfirmExchangeTransfer(peerIPAddress)
+		})
+	if err != nil {
+		return "", fmt.Errorf("error starting offer: %s", err)
+	}
+
+	exchangeLANOffer = offer
+
+	return offer.Code(), nil
+}
+
+// StopExchangeLANOffer stops any running LAN offer.
+func StopExchangeLANOffer() {
+	stopExchangeLANOffer()
+}
+
+func stopExchangeLANOffer() {
+
+	exchangeLANOfferMutex.Lock()
+	defer exchangeLANOfferMutex.Unlock()
+
+	if exchangeLANOffer != nil {
+		exchangeLANOffer.Stop()
+		exchangeLANOffer = nil
+	}
+}
+
+// DiscoverExchangeLANOffers searches the local network for the exchange LAN
+// offer with the specified offer code for timeoutMilliseconds. The return
+// value is a newline-delimited list of offer addresses, which may be passed
+// to ReceiveExchangeLANOffer.
+func DiscoverExchangeLANOffers(offerCode string, timeoutMilliseconds int) (string, error) {
+
+	controllerMutex.Lock()
+	c := controller
+	controllerMutex.Unlock()
+
+	if c == nil {
+		return "", fmt.Errorf("not running")
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), time.Duration(timeoutMilliseconds)*time.Millisecond)
+	defer cancel()
+
+	addresses, err := c.DiscoverExchangeLANOffers(ctx, offerCode)
+	if err != nil {
+		return "", fmt.Errorf("error discovering offers: %s", err)
+	}
+
+	return strings.Join(addresses, "\n"), nil
+}
+
+// ReceiveExchangeLANOffer fetches an exchange payload from the LAN offer,
+// with the specified offer code, at address. The timeout should allow for
+// the offering user to confirm the transfer. The returned payload may be
+// passed to ImportExchangePayload.
+func ReceiveExchangeLANOffer(
+	offerCode, address string, timeoutMilliseconds int) (string, error) {
+
+	controllerMutex.Lock()
+	c := controller
+	controllerMutex.Unlock()
+
+	if c == nil {
+		return "", fmt.Errorf("not running")
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), time.Duration(timeoutMilliseconds)*time.Millisecond)
+	defer cancel()
+
+	payload, err := c.ReceiveExchangeLANOffer(ctx, offerCode, address)
+	if err != nil {
+		return "", fmt.Errorf("error receiving offer: %s", err)
+	}
+
+	return payload, nil
+}
+
 var sendFeedbackMutex sync.Mutex
 var sendFeedbackCtx context.Context
 var stopSendFeedback context.CancelFunc
@@ -24,6 +24,10 @@
 // message: "msg" field
 // metrics: "event_name" field
 // unknown: key graph
+//
+// Tunnel outcomes are also aggregated by tactics experiment arm: for each arm
+// reported in server_tunnel and failed_tunnel metrics, the tunnel success rate
+// and establishment durations are recorded.
 package analysis
 
 import (
@@ -35,6 +39,7 @@ import (
 	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 )
@@ -401,12 +406,152 @@ func (a *UnknownLogStats) Sort() []UnknownLogModelStats {
 	return s
 }
 
+// Tactics experiment arm stats
+// Aggregate tunnel outcomes by tactics experiment arm
+
+const (
+	SERVER_TUNNEL_EVENT_NAME       = "server_tunnel"
+	FAILED_TUNNEL_EVENT_NAME       = "failed_tunnel"
+	EXPERIMENT_ARMS_LOG_FIELD_NAME = "tactics_experiment_arms"
+)
+
+type ExperimentArmStats struct {
+	Arm                     string
+	Successes               uint
+	Failures                uint
+	EstablishmentDurationMs []int64
+}
+
+type ExperimentArmsStats struct {
+	armStats map[string]*ExperimentArmStats
+}
+
+// SuccessRate returns the fraction of tunnels, assigned to the arm, which
+// were established: server_tunnel events vs. failed_tunnel events.
+func (a *ExperimentArmStats) SuccessRate() float64 {
+	return safeDivide(float64(a.Successes), float64(a.Successes+a.Failures))
+}
+
+// MedianEstablishmentDurationMs returns the median establishment duration,
+// in milliseconds, of established tunnels assigned to the arm.
+func (a *ExperimentArmStats) MedianEstablishmentDurationMs() int64 {
+	n := len(a.EstablishmentDurationMs)
+	if n == 0 {
+		return 0
+	}
+
+	durations := make([]int64, n)
+	copy(durations, a.EstablishmentDurationMs)
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+
+	if n%2 == 1 {
+		return durations[n/2]
+	}
+	return (durations[n/2-1] + durations[n/2]) / 2
+}
+
+// MeanEstablishmentDurationMs returns the mean establishment duration, in
+// milliseconds, of established tunnels assigned to the arm.
+func (a *ExperimentArmStats) MeanEstablishmentDurationMs() float64 {
+	var sum int64
+	for _, d := range a.EstablishmentDurationMs {
+		sum += d
+	}
+	return safeDivide(float64(sum), float64(len(a.EstablishmentDurationMs)))
+}
+
+func (a *ExperimentArmStats) Print() {
+	fmt.Printf("ExperimentArm: %s\n", a.Arm)
+	fmt.Printf("Established: %d\n", a.Successes)
+	fmt.Printf("Failed: %d\n", a.Failures)
+	fmt.Printf("SuccessRate: %0.2f\n", a.SuccessRate())
+	fmt.Printf("EstablishmentDurationMs: median %d, mean %0.0f, samples %d\n",
+		a.MedianEstablishmentDurationMs(),
+		a.MeanEstablishmentDurationMs(),
+		len(a.EstablishmentDurationMs))
+	fmt.Printf("\n")
+}
+
+func (a *ExperimentArmsStats) Print() {
+	for _, v := range a.Sort() {
+		v.Print()
+	}
+}
+
+// Sort returns the arm stats ordered by arm, which groups the arms of each
+// experiment.
+func (a *ExperimentArmsStats) Sort() []ExperimentArmStats {
+	var s []ExperimentArmStats
+	for _, v := range a.armStats {
+		if v != nil {
+			s = append(s, *v)
+		}
+	}
+
+	sort.Slice(s, func(i, j int) bool {
+		return s[i].Arm < s[j].Arm
+	})
+	return s
+}
+
+// update records the outcome reported in a server_tunnel or failed_tunnel
+// log line for each experiment arm listed in the log line.
+func (a *ExperimentArmsStats) update(event MetricsLogEventName, log string) error {
+	if event != SERVER_TUNNEL_EVENT_NAME && event != FAILED_TUNNEL_EVENT_NAME {
+		return nil
+	}
+
+	// psiphond logs the server_tunnel establishment_duration, in
+	// milliseconds, as it's received from the client: an integer string.
+	var fields struct {
+		Arms                  []string `json:"tactics_experiment_arms"`
+		EstablishmentDuration *string  `json:"establishment_duration"`
+	}
+	err := json.Unmarshal([]byte(log), &fields)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s fields: %s", EXPERIMENT_ARMS_LOG_FIELD_NAME, err)
+	}
+
+	var establishmentDuration *int64
+	if fields.EstablishmentDuration != nil {
+		duration, err := strconv.ParseInt(*fields.EstablishmentDuration, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse establishment_duration: %s", err)
+		}
+		establishmentDuration = &duration
+	}
+
+	for _, arm := range fields.Arms {
+		armStats, ok := a.armStats[arm]
+		if !ok {
+			armStats = &ExperimentArmStats{Arm: arm}
+			a.armStats[arm] = armStats
+		}
+
+		if event == FAILED_TUNNEL_EVENT_NAME {
+			armStats.Failures += 1
+			continue
+		}
+
+		armStats.Successes += 1
+		if establishmentDuration != nil {
+			armStats.EstablishmentDurationMs = append(
+				armStats.EstablishmentDurationMs, *establishmentDuration)
+		}
+	}
+
+	return nil
+}
+
 // Log file stats
 
 type LogStats struct {
 	MessageLogModels MessageLogStats
 	MetricsLogModels MetricsLogStats
 	UnknownLogModels UnknownLogStats
+	ExperimentArms   ExperimentArmsStats
 }
 
 // NewLogStats initializes a new LogStats structure.
@@ -421,6 +566,9 @@ func NewLogStats() (l *LogStats) {
 		UnknownLogModels: UnknownLogStats{
 			modelStats: nil,
 		},
+		ExperimentArms: ExperimentArmsStats{
+			armStats: make(map[string]*ExperimentArmStats),
+		},
 	}
 
 	return l
@@ -490,6 +638,10 @@ func (l *LogStats) ParseLogLine(log string) error {
 		} else {
 			MetricsLogModels.modelStats[v.Event] = &MetricsLogModelStats{LogModelStats{1}, *v}
 		}
+		err := l.ExperimentArms.update(v.Event, log)
+		if err != nil {
+			return err
+		}
 	case *UnknownLogModel:
 		l.UnknownLogModels.Count += 1
 		found := false
@@ -99,6 +99,53 @@ func TestMessageLogsWithRedactedIpAddresses(t *testing.T) {
 	}
 }
 
+func TestExperimentArms(t *testing.T) {
+	logs := []LogLineWithExpectation{
+		metricsLogExpectation(`{"event_name":"server_tunnel", "tactics_experiment_arms":["E1:A1", "E2:A1"], "establishment_duration":"100"}`),
+		metricsLogExpectation(`{"event_name":"server_tunnel", "tactics_experiment_arms":["E1:A1", "E2:A1"], "establishment_duration":"300"}`),
+		metricsLogExpectation(`{"event_name":"server_tunnel", "tactics_experiment_arms":["E1:A2"]}`),
+		metricsLogExpectation(`{"event_name":"failed_tunnel", "tactics_experiment_arms":["E1:A1", "E2:A1"]}`),
+		metricsLogExpectation(`{"event_name":"failed_tunnel", "tactics_experiment_arms":["E1:A2"]}`),
+		metricsLogExpectation(`{"event_name":"failed_tunnel", "tactics_experiment_arms":["E1:A2"]}`),
+		metricsLogExpectation(`{"event_name":"failed_tunnel"}`),
+		metricsLogExpectation(`{"event_name":"connected", "tactics_experiment_arms":["E1:A2"]}`),
+		malformedLogExpectation(`{"event_name":"server_tunnel", "tactics_experiment_arms":"E1:A1"}`),
+		malformedLogExpectation(`{"event_name":"server_tunnel", "tactics_experiment_arms":["E1:A1"], "establishment_duration":"invalid"}`),
+	}
+
+	l := parseLogsAndTestExpectations(logs, t)
+
+	arms := l.ExperimentArms.Sort()
+	if len(arms) != 3 {
+		t.Fatalf("Expected 3 experiment arms but found %d\n", len(arms))
+	}
+
+	expectations := []struct {
+		arm              string
+		successes        uint
+		failures         uint
+		successRate      float64
+		medianDurationMs int64
+		numDurationsMs   int
+	}{
+		{"E1:A1", 2, 1, 2.0 / 3.0, 200, 2},
+		{"E1:A2", 1, 2, 1.0 / 3.0, 0, 0},
+		{"E2:A1", 2, 1, 2.0 / 3.0, 200, 2},
+	}
+
+	for i, expected := range expectations {
+		arm := arms[i]
+		if arm.Arm != expected.arm ||
+			arm.Successes != expected.successes ||
+			arm.Failures != expected.failures ||
+			arm.SuccessRate() != expected.successRate ||
+			arm.MedianEstablishmentDurationMs() != expected.medianDurationMs ||
+			len(arm.EstablishmentDurationMs) != expected.numDurationsMs {
+			t.Errorf("Unexpected experiment arm stats: %+v\n", arm)
+		}
+	}
+}
+
 // Helpers
 
 type LogLineWithExpectation struct {
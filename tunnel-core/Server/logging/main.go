@@ -47,6 +47,7 @@ func main() {
 	var printUnknowns bool
 	var printStructure bool
 	var printExample bool
+	var printExperiments bool
 
 	flag.Var(
 		&logFileList,
@@ -83,6 +84,12 @@ func main() {
 		false,
 		"print each log model with an example")
 
+	flag.BoolVar(
+		&printExperiments,
+		"experiments",
+		false,
+		"display tunnel success rate and establishment duration per tactics experiment arm")
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
 			"Usage:\n\n"+
@@ -107,6 +114,10 @@ func main() {
 
 	logFileStats.Print(printMessages, printMetrics, printUnknowns, printStructure, printExample)
 
+	if printExperiments {
+		logFileStats.ExperimentArms.Print()
+	}
+
 	fmt.Printf("Found %d messages, %d metrics and %d unknown logs with a total of %d distinct types of logs\n",
 		logFileStats.MessageLogModels.Count,
 		logFileStats.MetricsLogModels.Count,
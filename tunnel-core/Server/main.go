@@ -52,6 +52,9 @@ func main() {
 	var generateOSLConfigFilename string
 	var generateTacticsConfigFilename string
 	var generateServerEntryFilename string
+	var simulateGeoIPDatabaseFilenames stringListFlag
+	var simulateClientFilename string
+	var replayCacheFilename string
 
 	flag.StringVar(
 		&configFilename,
@@ -92,7 +95,7 @@ func main() {
 		&generateTrafficRulesConfigFilename,
 		"trafficRules",
 		server.SERVER_TRAFFIC_RULES_CONFIG_FILENAME,
-		"generate with this traffic rules config `filename`")
+		"generate or simulate with this traffic rules config `filename`")
 
 	flag.StringVar(
 		&generateOSLConfigFilename,
@@ -104,7 +107,7 @@ func main() {
 		&generateTacticsConfigFilename,
 		"tactics",
 		server.SERVER_TACTICS_CONFIG_FILENAME,
-		"generate with this tactics config `filename`")
+		"generate or simulate with this tactics config `filename`")
 
 	flag.StringVar(
 		&generateServerEntryFilename,
@@ -112,12 +115,32 @@ func main() {
 		server.SERVER_ENTRY_FILENAME,
 		"generate with this server entry `filename`")
 
+	flag.Var(
+		&simulateGeoIPDatabaseFilenames,
+		"geoIP",
+		"simulate with this GeoIP database `filename`; flag may be repeated to use multiple databases")
+
+	flag.StringVar(
+		&simulateClientFilename,
+		"client",
+		"",
+		"simulate the client described in this JSON `filename`")
+
+	flag.StringVar(
+		&replayCacheFilename,
+		"replayCache",
+		"",
+		"export or import replay cache with this `filename`")
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
 			"Usage:\n\n"+
-				"%s <flags> generate    generates configuration files\n"+
-				"%s <flags> run         runs configured services\n\n",
-			os.Args[0], os.Args[0])
+				"%s <flags> generate        generates configuration files\n"+
+				"%s <flags> run             runs configured services\n"+
+				"%s <flags> simulate        resolves traffic rules and tactics for a client\n"+
+				"%s <flags> export-replay   exports the configured replay cache file\n"+
+				"%s <flags> import-replay   imports into the configured replay cache file\n\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -207,6 +230,94 @@ func main() {
 			os.Exit(1)
 		}
 
+	} else if args[0] == "simulate" {
+
+		if simulateClientFilename == "" {
+			fmt.Printf("simulate failed: missing client filename\n")
+			os.Exit(1)
+		}
+
+		clientJSON, err := ioutil.ReadFile(simulateClientFilename)
+		if err != nil {
+			fmt.Printf("error loading client file: %s\n", err)
+			os.Exit(1)
+		}
+
+		var client server.SimulatedClient
+		err = json.Unmarshal(clientJSON, &client)
+		if err != nil {
+			fmt.Printf("error parsing client file: %s\n", err)
+			os.Exit(1)
+		}
+
+		// Suppress the debug level filter check logs emitted by the traffic
+		// rules component.
+		err = server.InitLogging(&server.Config{LogLevel: "error"})
+		if err != nil {
+			fmt.Printf("error initializing logging: %s\n", err)
+			os.Exit(1)
+		}
+
+		result, err := server.Simulate(
+			generateTrafficRulesConfigFilename,
+			generateTacticsConfigFilename,
+			simulateGeoIPDatabaseFilenames,
+			&client)
+		if err != nil {
+			fmt.Printf("simulate failed: %s\n", err)
+			os.Exit(1)
+		}
+
+		resultJSON, err := json.MarshalIndent(result, "", "    ")
+		if err != nil {
+			fmt.Printf("error serializing simulation result: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s\n", resultJSON)
+
+	} else if args[0] == "export-replay" || args[0] == "import-replay" {
+
+		// The replay cache file of the configured server is either the
+		// source, for export, or the destination, for import. Import should
+		// be run while the server is stopped, as a running server will
+		// overwrite its replay cache file.
+
+		if replayCacheFilename == "" {
+			fmt.Printf("%s failed: missing replay cache filename\n", args[0])
+			os.Exit(1)
+		}
+
+		configJSON, err := ioutil.ReadFile(configFilename)
+		if err != nil {
+			fmt.Printf("error loading configuration file: %s\n", err)
+			os.Exit(1)
+		}
+
+		config, err := server.LoadConfig(configJSON)
+		if err != nil {
+			fmt.Printf("error parsing configuration file: %s\n", err)
+			os.Exit(1)
+		}
+
+		if config.ReplayCacheFilename == "" {
+			fmt.Printf("%s failed: ReplayCacheFilename not configured\n", args[0])
+			os.Exit(1)
+		}
+
+		inputFilename, outputFilename := config.ReplayCacheFilename, replayCacheFilename
+		if args[0] == "import-replay" {
+			inputFilename, outputFilename = replayCacheFilename, config.ReplayCacheFilename
+		}
+
+		count, err := server.MergeReplayCacheFile(inputFilename, outputFilename)
+		if err != nil {
+			fmt.Printf("%s failed: %s\n", args[0], err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%d replay cache entries in %s\n", count, outputFilename)
+
 	} else if args[0] == "run" {
 
 		configJSON, err := ioutil.ReadFile(configFilename)
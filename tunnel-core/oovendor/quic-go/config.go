@@ -127,5 +127,7 @@ func populateConfig(config *Config) *Config {
 		VerifyClientHelloRandom:       config.VerifyClientHelloRandom,
 		ClientMaxPacketSizeAdjustment: config.ClientMaxPacketSizeAdjustment,
 		ServerMaxPacketSizeAdjustment: config.ServerMaxPacketSizeAdjustment,
+		ServerEnableActiveMigration:   config.ServerEnableActiveMigration,
+		ServerMigratedPath:            config.ServerMigratedPath,
 	}
 }
@@ -335,12 +335,38 @@ type Config struct {
 	// obfuscation overhead while remaining at or under the 1280 target
 	// packet size. Must be set only for QUIC server configs.
 	ServerMaxPacketSizeAdjustment func(net.Addr) int
+
+	// [Psiphon]
+	// ServerEnableActiveMigration indicates that the server accepts client
+	// connection migration. When set, the server doesn't send the
+	// disable_active_migration transport parameter and, when it receives a
+	// new largest 1-RTT packet from a different client address, sends all
+	// subsequent packets to the new address.
+	//
+	// Limitation: the new path is not validated with PATH_CHALLENGE frames.
+	// Only authenticated, non-duplicate packets that advance the largest
+	// received packet number can migrate the path, so an off-path attacker
+	// cannot redirect the connection. An on-path attacker that rewrites the
+	// source address can, so this should be enabled only by explicit
+	// configuration.
+	ServerEnableActiveMigration bool
+
+	// [Psiphon]
+	// ServerMigratedPath, when set, is called when the server migrates the
+	// connection to a new client address. Must be set only for QUIC server
+	// configs.
+	ServerMigratedPath func(oldAddr, newAddr net.Addr)
 }
 
 // ConnectionState records basic details about a QUIC connection
 type ConnectionState struct {
 	TLS               handshake.ConnectionState
 	SupportsDatagrams bool
+
+	// [Psiphon]
+	// SupportsActiveMigration indicates that the peer did not send the
+	// disable_active_migration transport parameter.
+	SupportsActiveMigration bool
 }
 
 // A Listener for incoming QUIC connections
@@ -351,6 +377,12 @@ type Listener interface {
 	Addr() net.Addr
 	// Accept returns new sessions. It should be called in a loop.
 	Accept(context.Context) (Session, error)
+
+	// [Psiphon]
+	// HasShortHeaderConnectionID indicates whether the destination
+	// connection ID of the short header packet data matches an existing
+	// session.
+	HasShortHeaderConnectionID(data []byte) bool
 }
 
 // An EarlyListener listens for incoming QUIC connections,
@@ -198,6 +198,27 @@ func (h *packetHandlerMap) Add(id protocol.ConnectionID, handler packetHandler)
 	return true
 }
 
+// [Psiphon]
+// HasShortHeaderConnectionID indicates whether the destination connection ID
+// of the short header packet data matches an existing session. Entries for
+// queued 0-RTT packets, whose connection IDs are chosen by the client, don't
+// match.
+func (h *packetHandlerMap) HasShortHeaderConnectionID(data []byte) bool {
+	if len(data) == 0 || data[0]&0x80 > 0 {
+		return false
+	}
+	connID, err := wire.ParseConnectionID(data, h.connIDLen)
+	if err != nil {
+		return false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	entry, ok := h.handlers[string(connID)]
+	return ok && !entry.is0RTTQueue
+}
+
 func (h *packetHandlerMap) AddWithConnID(clientDestConnID, newConnID protocol.ConnectionID, fn func() packetHandler) bool {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
@@ -2,6 +2,7 @@ package quic
 
 import (
 	"net"
+	"sync"
 )
 
 // A sendConn allows sending using a simple Write() on a non-connected packet conn.
@@ -12,15 +13,26 @@ type sendConn interface {
 	RemoteAddr() net.Addr
 }
 
+// [Psiphon]
+// A migratableSendConn is a sendConn whose remote address may be changed,
+// for connection migration.
+type migratableSendConn interface {
+	sendConn
+	SetRemoteAddr(net.Addr, *packetInfo)
+}
+
 type sconn struct {
 	connection
 
+	// [Psiphon]
+	mutex sync.Mutex
+
 	remoteAddr net.Addr
 	info       *packetInfo
 	oob        []byte
 }
 
-var _ sendConn = &sconn{}
+var _ migratableSendConn = &sconn{}
 
 func newSendConn(c connection, remote net.Addr, info *packetInfo) sendConn {
 	return &sconn{
@@ -32,26 +44,50 @@ func newSendConn(c connection, remote net.Addr, info *packetInfo) sendConn {
 }
 
 func (c *sconn) Write(p []byte) error {
-	_, err := c.WritePacket(p, c.remoteAddr, c.oob)
+	// [Psiphon]
+	c.mutex.Lock()
+	remoteAddr, oob := c.remoteAddr, c.oob
+	c.mutex.Unlock()
+
+	_, err := c.WritePacket(p, remoteAddr, oob)
 	return err
 }
 
 func (c *sconn) RemoteAddr() net.Addr {
+	// [Psiphon]
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	return c.remoteAddr
 }
 
 func (c *sconn) LocalAddr() net.Addr {
+	// [Psiphon]
+	c.mutex.Lock()
+	info := c.info
+	c.mutex.Unlock()
+
 	addr := c.connection.LocalAddr()
-	if c.info != nil {
+	if info != nil {
 		if udpAddr, ok := addr.(*net.UDPAddr); ok {
 			addrCopy := *udpAddr
-			addrCopy.IP = c.info.addr
+			addrCopy.IP = info.addr
 			addr = &addrCopy
 		}
 	}
 	return addr
 }
 
+// [Psiphon]
+func (c *sconn) SetRemoteAddr(remote net.Addr, info *packetInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remoteAddr = remote
+	c.info = info
+	c.oob = info.OOB()
+}
+
 type spconn struct {
 	net.PacketConn
 
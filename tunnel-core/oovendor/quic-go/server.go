@@ -318,6 +318,17 @@ func (s *baseServer) Addr() net.Addr {
 	return s.conn.LocalAddr()
 }
 
+// [Psiphon]
+// HasShortHeaderConnectionID indicates whether the destination connection ID
+// of the short header packet data matches an existing session.
+func (s *baseServer) HasShortHeaderConnectionID(data []byte) bool {
+	handlerMap, ok := s.sessionHandler.(*packetHandlerMap)
+	if !ok {
+		return false
+	}
+	return handlerMap.HasShortHeaderConnectionID(data)
+}
+
 func (s *baseServer) handlePacket(p *receivedPacket) {
 	select {
 	case s.receivedPackets <- p:
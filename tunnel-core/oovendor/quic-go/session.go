@@ -216,6 +216,11 @@ type session struct {
 
 	datagramQueue *datagramQueue
 
+	// [Psiphon]
+	// largestRcvd1RTTPacketNumber is used by the server to determine when
+	// a packet from a new client address may migrate the connection.
+	largestRcvd1RTTPacketNumber protocol.PacketNumber
+
 	logID  string
 	tracer logging.ConnectionTracer
 	logger utils.Logger
@@ -258,6 +263,9 @@ var newSession = func(
 		tracer:                tracer,
 		logger:                logger,
 		version:               v,
+
+		// [Psiphon]
+		largestRcvd1RTTPacketNumber: protocol.InvalidPacketNumber,
 	}
 	if origDestConnID != nil {
 		s.logID = origDestConnID.String()
@@ -311,7 +319,7 @@ var newSession = func(
 		MaxUniStreamNum:                 protocol.StreamNum(s.config.MaxIncomingUniStreams),
 		MaxAckDelay:                     protocol.MaxAckDelayInclGranularity,
 		AckDelayExponent:                protocol.AckDelayExponent,
-		DisableActiveMigration:          true,
+		DisableActiveMigration:          !s.config.ServerEnableActiveMigration, // [Psiphon]
 		StatelessResetToken:             &statelessResetToken,
 		OriginalDestinationConnectionID: origDestConnID,
 		ActiveConnectionIDLimit:         protocol.MaxActiveConnectionIDs,
@@ -748,6 +756,9 @@ func (s *session) ConnectionState() ConnectionState {
 	return ConnectionState{
 		TLS:               s.cryptoStreamHandler.ConnectionState(),
 		SupportsDatagrams: s.supportsDatagrams(),
+
+		// [Psiphon]
+		SupportsActiveMigration: !s.peerParams.DisableActiveMigration,
 	}
 }
 
@@ -1032,9 +1043,40 @@ func (s *session) handleSinglePacket(p *receivedPacket, hdr *wire.Header) bool /
 		s.closeLocal(err)
 		return false
 	}
+
+	// [Psiphon]
+	if s.perspective == protocol.PerspectiveServer &&
+		packet.encryptionLevel == protocol.Encryption1RTT &&
+		packet.packetNumber > s.largestRcvd1RTTPacketNumber {
+
+		s.largestRcvd1RTTPacketNumber = packet.packetNumber
+		if s.config.ServerEnableActiveMigration && s.handshakeConfirmed {
+			s.maybeMigratePath(p)
+		}
+	}
+
 	return true
 }
 
+// [Psiphon]
+// maybeMigratePath switches the server's send path to the address of the
+// received packet when the client has migrated to a new address.
+func (s *session) maybeMigratePath(p *receivedPacket) {
+	conn, ok := s.conn.(migratableSendConn)
+	if !ok || p.remoteAddr == nil {
+		return
+	}
+	oldAddr := conn.RemoteAddr()
+	if oldAddr.String() == p.remoteAddr.String() {
+		return
+	}
+	conn.SetRemoteAddr(p.remoteAddr, p.info)
+	s.logger.Debugf("Migrated path from %s to %s", oldAddr, p.remoteAddr)
+	if s.config.ServerMigratedPath != nil {
+		s.config.ServerMigratedPath(oldAddr, p.remoteAddr)
+	}
+}
+
 func (s *session) handleRetryPacket(hdr *wire.Header, data []byte) bool /* was this a valid Retry */ {
 	if s.perspective == protocol.PerspectiveServer {
 		if s.tracer != nil {
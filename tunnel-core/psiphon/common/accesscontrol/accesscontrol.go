@@ -52,7 +52,9 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	std_errors "errors"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
@@ -65,6 +67,12 @@ const (
 	authorizationIDLength    = 32
 )
 
+var (
+	errExpiredAuthorization = std_errors.New("expired authorization")
+	errKeyNotYetActive      = std_errors.New("verification key not yet active")
+	errKeyRetired           = std_errors.New("verification key retired")
+)
+
 // SigningKey is the private key used to sign newly issued
 // authorizations for the specified access type. The key ID
 // is included in authorizations and identifies the
@@ -83,10 +91,36 @@ type SigningKey struct {
 // VerificationKey is the public key used to verify signed
 // authentications issued for the specified access type. The
 // authorization references the expected public key by ID.
+//
+// NotBefore and NotAfter, when set, bound the period during
+// which the key is active; authorizations signed by the key are
+// rejected outside of that period. This allows for key rotation
+// without a hard cut-over: a new key may be deployed in advance
+// of its NotBefore time, and an old or compromised key retired
+// at its NotAfter time.
+//
+// GracePeriod, when set, extends the period, after NotAfter,
+// during which authorizations signed by the retired key are
+// still accepted, allowing clients time to obtain authorizations
+// signed by a new key. GracePeriod is a duration string, such
+// as "168h".
 type VerificationKey struct {
-	ID         []byte
-	AccessType string
-	PublicKey  []byte
+	ID          []byte
+	AccessType  string
+	PublicKey   []byte
+	NotBefore   time.Time
+	NotAfter    time.Time
+	GracePeriod string
+}
+
+// gracePeriod returns the parsed GracePeriod. The key must have
+// been checked with ValidateVerificationKeyRing.
+func (key *VerificationKey) gracePeriod() time.Duration {
+	if key.GracePeriod == "" {
+		return 0
+	}
+	gracePeriod, _ := time.ParseDuration(key.GracePeriod)
+	return gracePeriod
 }
 
 // NewKeyPair generates a new authorization signing key pair.
@@ -133,10 +167,19 @@ func NewKeyPair(
 // An Authorization is embedded within a digitally signed
 // object. This wrapping object adds a signature and a signing
 // key ID.
+//
+// SigningKeyID and InGracePeriod are not part of the signed
+// authorization. They are populated by VerifyAuthorization.
+// SigningKeyID identifies the key that signed the authorization,
+// which is used to check revocations. InGracePeriod indicates
+// that the signing key is retired and the authorization was
+// accepted during the key's grace period.
 type Authorization struct {
-	ID         []byte
-	AccessType string
-	Expires    time.Time
+	ID            []byte
+	AccessType    string
+	Expires       time.Time
+	SigningKeyID  []byte `json:"-"`
+	InGracePeriod bool   `json:"-"`
 }
 
 type signedAuthorization struct {
@@ -230,6 +273,19 @@ func ValidateVerificationKeyRing(keyRing *VerificationKeyRing) error {
 			len(key.PublicKey) != ed25519.PublicKeySize {
 			return errors.TraceNew("invalid verification key")
 		}
+		if !key.NotBefore.IsZero() && !key.NotAfter.IsZero() &&
+			!key.NotAfter.After(key.NotBefore) {
+			return errors.TraceNew("invalid verification key period")
+		}
+		if key.GracePeriod != "" {
+			gracePeriod, err := time.ParseDuration(key.GracePeriod)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if gracePeriod < 0 {
+				return errors.TraceNew("invalid verification key grace period")
+			}
+		}
 	}
 	return nil
 }
@@ -239,34 +295,50 @@ func ValidateVerificationKeyRing(keyRing *VerificationKeyRing) error {
 // access control information.
 //
 // The key ID in the signed authorization is used to select the
-// appropriate verification key from the key ring.
+// appropriate verification key from the key ring. Authorizations
+// are rejected when the verification key is not yet active, or
+// is retired and past its grace period.
 func VerifyAuthorization(
 	keyRing *VerificationKeyRing,
 	encodedSignedAuthorization string) (*Authorization, error) {
 
-	err := ValidateVerificationKeyRing(keyRing)
+	auth, _, err := verifyAuthorization(keyRing, encodedSignedAuthorization)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	return auth, nil
+}
+
+// verifyAuthorization implements VerifyAuthorization and also returns the
+// matching verification key, when found, including when verification fails.
+func verifyAuthorization(
+	keyRing *VerificationKeyRing,
+	encodedSignedAuthorization string) (*Authorization, *VerificationKey, error) {
+
+	err := ValidateVerificationKeyRing(keyRing)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
 	signedAuthorizationJSON, err := base64.StdEncoding.DecodeString(
 		encodedSignedAuthorization)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 
 	var signedAuth signedAuthorization
 	err = json.Unmarshal(signedAuthorizationJSON, &signedAuth)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 
 	if len(signedAuth.SigningKeyID) != keyIDLength {
-		return nil, errors.TraceNew("invalid key ID length")
+		return nil, nil, errors.TraceNew("invalid key ID length")
 	}
 
 	if len(signedAuth.Signature) != ed25519.SignatureSize {
-		return nil, errors.TraceNew("invalid signature length")
+		return nil, nil, errors.TraceNew("invalid signature length")
 	}
 
 	var verificationKey *VerificationKey
@@ -278,36 +350,157 @@ func VerifyAuthorization(
 	}
 
 	if verificationKey == nil {
-		return nil, errors.TraceNew("invalid key ID")
+		return nil, nil, errors.TraceNew("invalid key ID")
 	}
 
 	if !ed25519.Verify(
 		verificationKey.PublicKey, signedAuth.Authorization, signedAuth.Signature) {
-		return nil, errors.TraceNew("invalid signature")
+		return nil, nil, errors.TraceNew("invalid signature")
 	}
 
 	var auth Authorization
 
 	err = json.Unmarshal(signedAuth.Authorization, &auth)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, verificationKey, errors.Trace(err)
 	}
 
 	if len(auth.ID) == 0 {
-		return nil, errors.TraceNew("invalid authorization ID")
+		return nil, verificationKey, errors.TraceNew("invalid authorization ID")
 	}
 
 	if auth.AccessType != verificationKey.AccessType {
-		return nil, errors.TraceNew("invalid access type")
+		return nil, verificationKey, errors.TraceNew("invalid access type")
 	}
 
 	if auth.Expires.IsZero() {
-		return nil, errors.TraceNew("invalid expiry")
+		return nil, verificationKey, errors.TraceNew("invalid expiry")
 	}
 
-	if auth.Expires.Before(time.Now().UTC()) {
-		return nil, errors.TraceNew("expired authorization")
+	now := time.Now().UTC()
+
+	if auth.Expires.Before(now) {
+		return nil, verificationKey, errors.Trace(errExpiredAuthorization)
 	}
 
-	return &auth, nil
+	// Enforce the verification key active period. Checking after the
+	// signature is verified ensures that the key metrics recorded by
+	// Verifier aren't attributed to forged authorizations.
+
+	if !verificationKey.NotBefore.IsZero() && now.Before(verificationKey.NotBefore) {
+		return nil, verificationKey, errors.Trace(errKeyNotYetActive)
+	}
+
+	if !verificationKey.NotAfter.IsZero() && now.After(verificationKey.NotAfter) {
+		if now.After(verificationKey.NotAfter.Add(verificationKey.gracePeriod())) {
+			return nil, verificationKey, errors.Trace(errKeyRetired)
+		}
+		auth.InGracePeriod = true
+	}
+
+	auth.SigningKeyID = verificationKey.ID
+
+	return &auth, verificationKey, nil
+}
+
+// KeyMetrics are authorization verification counts for a single
+// verification key.
+//
+// Verified counts authorizations accepted, including InGracePeriod, which
+// counts authorizations accepted during the key's grace period. Expired
+// counts authorizations rejected because they're expired, regardless of the
+// key's state. Inactive counts unexpired authorizations rejected because the
+// key is not yet active or is retired. Rejected counts authorizations, with
+// valid signatures, rejected for any other reason.
+type KeyMetrics struct {
+	Verified      int64
+	InGracePeriod int64
+	Expired       int64
+	Inactive      int64
+	Rejected      int64
+}
+
+// Verifier verifies authorizations using a verification key ring and
+// records per-key metrics, allowing operators to see when keys are no
+// longer used, after a rotation, or are still used after retirement.
+//
+// Verifier is safe for concurrent use.
+type Verifier struct {
+	keyRing      *VerificationKeyRing
+	metricsMutex sync.Mutex
+	metrics      map[string]*KeyMetrics
+}
+
+// NewVerifier creates a new Verifier for the key ring. The key ring must not
+// be modified after NewVerifier is called.
+func NewVerifier(keyRing *VerificationKeyRing) (*Verifier, error) {
+
+	err := ValidateVerificationKeyRing(keyRing)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	verifier := &Verifier{keyRing: keyRing}
+	verifier.resetMetrics()
+
+	return verifier, nil
+}
+
+func (verifier *Verifier) resetMetrics() {
+	verifier.metrics = make(map[string]*KeyMetrics)
+	for _, key := range verifier.keyRing.Keys {
+		verifier.metrics[string(key.ID)] = &KeyMetrics{}
+	}
+}
+
+// VerifyAuthorization is VerifyAuthorization using the Verifier key ring.
+func (verifier *Verifier) VerifyAuthorization(
+	encodedSignedAuthorization string) (*Authorization, error) {
+
+	auth, verificationKey, err := verifyAuthorization(
+		verifier.keyRing, encodedSignedAuthorization)
+
+	if verificationKey != nil {
+
+		verifier.metricsMutex.Lock()
+		metrics := verifier.metrics[string(verificationKey.ID)]
+		if err == nil {
+			metrics.Verified += 1
+			if auth.InGracePeriod {
+				metrics.InGracePeriod += 1
+			}
+		} else if std_errors.Is(err, errExpiredAuthorization) {
+			metrics.Expired += 1
+		} else if std_errors.Is(err, errKeyNotYetActive) ||
+			std_errors.Is(err, errKeyRetired) {
+			metrics.Inactive += 1
+		} else {
+			metrics.Rejected += 1
+		}
+		verifier.metricsMutex.Unlock()
+	}
+
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return auth, nil
+}
+
+// GetMetrics returns the verification counts, keyed by base64-encoded key
+// ID, for all keys in the key ring, including keys with zero counts. The
+// counts are reset and each call returns the counts since the previous call.
+func (verifier *Verifier) GetMetrics() map[string]KeyMetrics {
+
+	verifier.metricsMutex.Lock()
+	defer verifier.metricsMutex.Unlock()
+
+	metrics := make(map[string]KeyMetrics)
+	for keyID, keyMetrics := range verifier.metrics {
+		metrics[base64.StdEncoding.EncodeToString([]byte(keyID))] = *keyMetrics
+	}
+
+	verifier.resetMetrics()
+
+	return metrics
 }
@@ -20,9 +20,12 @@
 package accesscontrol
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -227,3 +230,391 @@ func TestAuthorization(t *testing.T) {
 		t.Fatalf("VerifyAuthorization unexpected success")
 	}
 }
+
+func TestRevocationList(t *testing.T) {
+
+	signingKey, verificationKey, err := NewKeyPair("access1")
+	if err != nil {
+		t.Fatalf("NewKeyPair failed: %s", err)
+	}
+
+	otherSigningKey, otherVerificationKey, err := NewKeyPair("access2")
+	if err != nil {
+		t.Fatalf("NewKeyPair failed: %s", err)
+	}
+
+	invalidSigningKey, _, err := NewKeyPair("access1")
+	if err != nil {
+		t.Fatalf("NewKeyPair failed: %s", err)
+	}
+
+	keyRing := &VerificationKeyRing{
+		Keys: []*VerificationKey{verificationKey, otherVerificationKey},
+	}
+
+	expires := time.Now().Add(10 * time.Second)
+
+	auth1, ID1, err := IssueAuthorization(signingKey, []byte("1"), expires)
+	if err != nil {
+		t.Fatalf("IssueAuthorization failed: %s", err)
+	}
+
+	auth2, ID2, err := IssueAuthorization(signingKey, []byte("2"), expires)
+	if err != nil {
+		t.Fatalf("IssueAuthorization failed: %s", err)
+	}
+
+	otherAuth, otherID, err := IssueAuthorization(otherSigningKey, []byte("1"), expires)
+	if err != nil {
+		t.Fatalf("IssueAuthorization failed: %s", err)
+	}
+
+	verifyAuth := func(auth string) *Authorization {
+		verifiedAuth, err := VerifyAuthorization(keyRing, auth)
+		if err != nil {
+			t.Fatalf("VerifyAuthorization failed: %s", err)
+		}
+		return verifiedAuth
+	}
+
+	verifiedAuth1 := verifyAuth(auth1)
+	verifiedAuth2 := verifyAuth(auth2)
+	verifiedOtherAuth := verifyAuth(otherAuth)
+
+	issued := time.Now()
+
+	olderList, err := IssueRevocationList(
+		signingKey, [][]byte{ID1, ID2}, issued.Add(-1*time.Hour))
+	if err != nil {
+		t.Fatalf("IssueRevocationList failed: %s", err)
+	}
+
+	list, err := IssueRevocationList(signingKey, [][]byte{ID1}, issued)
+	if err != nil {
+		t.Fatalf("IssueRevocationList failed: %s", err)
+	}
+
+	// Test: the authorization ID is revoked only for the signing key that
+	// issued the revocation list
+
+	otherList, err := IssueRevocationList(otherSigningKey, [][]byte{ID2}, issued)
+	if err != nil {
+		t.Fatalf("IssueRevocationList failed: %s", err)
+	}
+
+	// Test: the most recently issued list for a signing key is used
+
+	revocations, err := NewRevocations(
+		keyRing, []string{list, olderList, otherList})
+	if err != nil {
+		t.Fatalf("NewRevocations failed: %s", err)
+	}
+
+	if !revocations.IsRevoked(verifiedAuth1) {
+		t.Fatalf("unexpected unrevoked authorization")
+	}
+
+	if revocations.IsRevoked(verifiedAuth2) {
+		t.Fatalf("unexpected revoked authorization")
+	}
+
+	if revocations.IsRevoked(verifiedOtherAuth) {
+		t.Fatalf("unexpected revoked authorization: %x", otherID)
+	}
+
+	if revocations.Count() != 2 {
+		t.Fatalf("unexpected revocation count: %d", revocations.Count())
+	}
+
+	// Test: nil revocations
+
+	var nilRevocations *Revocations
+	if nilRevocations.IsRevoked(verifiedAuth1) {
+		t.Fatalf("unexpected revoked authorization")
+	}
+
+	// Test: revocation list signed with key not in key ring
+
+	invalidList, err := IssueRevocationList(invalidSigningKey, [][]byte{ID1}, issued)
+	if err != nil {
+		t.Fatalf("IssueRevocationList failed: %s", err)
+	}
+
+	_, err = NewRevocations(keyRing, []string{list, invalidList})
+	if err == nil {
+		t.Fatalf("NewRevocations unexpected success")
+	}
+
+	// Test: tampered revocation list
+
+	decodedList, err := base64.StdEncoding.DecodeString(list)
+	if err != nil {
+		t.Fatalf("DecodeString failed: %s", err)
+	}
+
+	var hackSignedList signedRevocationList
+	err = json.Unmarshal(decodedList, &hackSignedList)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	hackList := RevocationList{
+		Issued:           issued,
+		AuthorizationIDs: [][]byte{ID2},
+	}
+
+	hackSignedList.RevocationList, err = json.Marshal(hackList)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	marshaledSignedList, err := json.Marshal(hackSignedList)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	_, err = VerifyRevocationList(
+		keyRing, base64.StdEncoding.EncodeToString(marshaledSignedList))
+	if err == nil {
+		t.Fatalf("VerifyRevocationList unexpected success")
+	}
+}
+
+func TestIssuer(t *testing.T) {
+
+	signingKey, verificationKey, err := NewKeyPair("access1")
+	if err != nil {
+		t.Fatalf("NewKeyPair failed: %s", err)
+	}
+
+	keyRing := &VerificationKeyRing{
+		Keys: []*VerificationKey{verificationKey},
+	}
+
+	expires := time.Now().Add(1 * time.Hour).Truncate(time.Second)
+
+	validationServer := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var request HTTPReceiptValidationRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil || request.Receipt != "valid" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(
+				&HTTPReceiptValidationResponse{
+					SeedAuthorizationID: []byte("purchase-1"),
+					Expires:             expires,
+				})
+		}))
+	defer validationServer.Close()
+
+	for _, validator := range []ReceiptValidator{
+		&TrustedReceiptValidator{Lifetime: 1 * time.Hour},
+		&HTTPReceiptValidator{URL: validationServer.URL},
+	} {
+
+		issuer, err := NewIssuer([]*SigningKey{signingKey}, validator)
+		if err != nil {
+			t.Fatalf("NewIssuer failed: %s", err)
+		}
+
+		results, err := issuer.IssueBatch([]*IssuanceRequest{
+			{AccessType: "access1", Receipt: "valid"},
+			{AccessType: "access2", Receipt: "valid"},
+			{AccessType: "access1", Receipt: ""},
+		})
+		if err != nil {
+			t.Fatalf("IssueBatch failed: %s", err)
+		}
+
+		if len(results) != 3 ||
+			results[0].Error != "" ||
+			results[0].FailureReason != nil ||
+			results[1].Error != ISSUANCE_FAILED_ERROR ||
+			results[1].FailureReason == nil ||
+			results[2].Error != ISSUANCE_FAILED_ERROR ||
+			results[2].FailureReason == nil {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+
+		// The marshaled results, which may be returned to remote callers,
+		// don't include the failure reason.
+
+		marshaledResults, err := json.Marshal(results)
+		if err != nil {
+			t.Fatalf("json.Marshal failed: %s", err)
+		}
+		if bytes.Contains(marshaledResults, []byte("access2")) {
+			t.Fatalf("unexpected failure reason in results: %s", marshaledResults)
+		}
+
+		auth, err := VerifyAuthorization(keyRing, results[0].Authorization)
+		if err != nil {
+			t.Fatalf("VerifyAuthorization failed: %s", err)
+		}
+
+		if string(auth.ID) != string(results[0].AuthorizationID) {
+			t.Fatalf("unexpected authorization ID")
+		}
+
+		if _, ok := validator.(*HTTPReceiptValidator); ok &&
+			!auth.Expires.Equal(expires) {
+			t.Fatalf("unexpected expiry: %s", auth.Expires)
+		}
+	}
+
+	// Test: trusted validator lifetime
+
+	err = ValidateTrustedReceiptValidatorLifetime(0)
+	if err == nil {
+		t.Fatalf("ValidateTrustedReceiptValidatorLifetime unexpected success")
+	}
+
+	err = ValidateTrustedReceiptValidatorLifetime(1 * time.Hour)
+	if err != nil {
+		t.Fatalf("ValidateTrustedReceiptValidatorLifetime failed: %s", err)
+	}
+
+	// Test: duplicate signing keys for an access type
+
+	_, err = NewIssuer(
+		[]*SigningKey{signingKey, signingKey},
+		&TrustedReceiptValidator{Lifetime: 1 * time.Hour})
+	if err == nil {
+		t.Fatalf("NewIssuer unexpected success")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	now := time.Now()
+
+	newKeys := func() (*SigningKey, *VerificationKey) {
+		signingKey, verificationKey, err := NewKeyPair("access1")
+		if err != nil {
+			t.Fatalf("NewKeyPair failed: %s", err)
+		}
+		return signingKey, verificationKey
+	}
+
+	activeSigningKey, activeKey := newKeys()
+	activeKey.NotBefore = now.Add(-1 * time.Hour)
+
+	pendingSigningKey, pendingKey := newKeys()
+	pendingKey.NotBefore = now.Add(1 * time.Hour)
+
+	graceSigningKey, graceKey := newKeys()
+	graceKey.NotAfter = now.Add(-1 * time.Hour)
+	graceKey.GracePeriod = "2h"
+
+	retiredSigningKey, retiredKey := newKeys()
+	retiredKey.NotAfter = now.Add(-1 * time.Hour)
+	retiredKey.GracePeriod = "30m"
+
+	keyRing := &VerificationKeyRing{
+		Keys: []*VerificationKey{activeKey, pendingKey, graceKey, retiredKey},
+	}
+
+	verifier, err := NewVerifier(keyRing)
+	if err != nil {
+		t.Fatalf("NewVerifier failed: %s", err)
+	}
+
+	testCases := []struct {
+		signingKey      *SigningKey
+		expectVerified  bool
+		expectInGrace   bool
+		expectedMetrics KeyMetrics
+	}{
+		{activeSigningKey, true, false, KeyMetrics{Verified: 1}},
+		{pendingSigningKey, false, false, KeyMetrics{Inactive: 1}},
+		{graceSigningKey, true, true, KeyMetrics{Verified: 1, InGracePeriod: 1}},
+		{retiredSigningKey, false, false, KeyMetrics{Inactive: 1}},
+	}
+
+	for i, testCase := range testCases {
+
+		auth, _, err := IssueAuthorization(
+			testCase.signingKey, []byte("1"), now.Add(10*time.Second))
+		if err != nil {
+			t.Fatalf("IssueAuthorization failed: %s", err)
+		}
+
+		verifiedAuth, err := verifier.VerifyAuthorization(auth)
+		if (err == nil) != testCase.expectVerified {
+			t.Fatalf("unexpected verification result %d: %v", i, err)
+		}
+
+		if err == nil && verifiedAuth.InGracePeriod != testCase.expectInGrace {
+			t.Fatalf("unexpected grace period result %d", i)
+		}
+	}
+
+	metrics := verifier.GetMetrics()
+
+	if len(metrics) != len(testCases) {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	for i, testCase := range testCases {
+		keyID := base64.StdEncoding.EncodeToString(testCase.signingKey.ID)
+		if metrics[keyID] != testCase.expectedMetrics {
+			t.Fatalf("unexpected metrics %d: %+v", i, metrics[keyID])
+		}
+	}
+
+	// Metrics are reset after GetMetrics.
+
+	for keyID, keyMetrics := range verifier.GetMetrics() {
+		if keyMetrics != (KeyMetrics{}) {
+			t.Fatalf("unexpected metrics for %s: %+v", keyID, keyMetrics)
+		}
+	}
+
+	// Expired authorizations are counted as expired, even when the key is
+	// also inactive.
+
+	for _, signingKey := range []*SigningKey{activeSigningKey, retiredSigningKey} {
+
+		auth, _, err := IssueAuthorization(
+			signingKey, []byte("1"), now.Add(-1*time.Second))
+		if err != nil {
+			t.Fatalf("IssueAuthorization failed: %s", err)
+		}
+
+		_, err = verifier.VerifyAuthorization(auth)
+		if err == nil {
+			t.Fatalf("VerifyAuthorization unexpected success")
+		}
+	}
+
+	metrics = verifier.GetMetrics()
+
+	for _, signingKey := range []*SigningKey{activeSigningKey, retiredSigningKey} {
+		keyID := base64.StdEncoding.EncodeToString(signingKey.ID)
+		if metrics[keyID] != (KeyMetrics{Expired: 1}) {
+			t.Fatalf("unexpected metrics: %+v", metrics[keyID])
+		}
+	}
+
+	// Test: invalid key periods
+
+	invalidKey := *activeKey
+	invalidKey.NotAfter = invalidKey.NotBefore.Add(-1 * time.Second)
+
+	err = ValidateVerificationKeyRing(
+		&VerificationKeyRing{Keys: []*VerificationKey{&invalidKey}})
+	if err == nil {
+		t.Fatalf("ValidateVerificationKeyRing unexpected success")
+	}
+
+	invalidKey = *graceKey
+	invalidKey.GracePeriod = "invalid"
+
+	err = ValidateVerificationKeyRing(
+		&VerificationKeyRing{Keys: []*VerificationKey{&invalidKey}})
+	if err == nil {
+		t.Fatalf("ValidateVerificationKeyRing unexpected success")
+	}
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package accesscontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+const (
+	MAX_ISSUANCE_BATCH_SIZE              = 1000
+	HTTP_RECEIPT_VALIDATOR_TIMEOUT       = 30 * time.Second
+	HTTP_RECEIPT_VALIDATOR_MAX_RESPONSE  = 65536
+	TRUSTED_RECEIPT_VALIDATOR_MIN_EXPIRY = 1 * time.Minute
+	ISSUANCE_FAILED_ERROR                = "issuance failed"
+)
+
+// ReceiptValidator validates a purchase, subscription, or transaction
+// receipt before an authorization is issued. Implementations check the
+// receipt with the relevant payment provider or other backend.
+//
+// ValidateReceipt returns the seed authorization ID, a value that uniquely
+// identifies the purchase, and the authorization expiry time. See
+// IssueAuthorization.
+type ReceiptValidator interface {
+	ValidateReceipt(accessType, receipt string) ([]byte, time.Time, error)
+}
+
+// TrustedReceiptValidator is a ReceiptValidator that performs no validation.
+// The receipt is used as the seed authorization ID and authorizations
+// expire after Lifetime. TrustedReceiptValidator is for issuing
+// authorizations from receipts that have already been validated, or from
+// trusted input.
+type TrustedReceiptValidator struct {
+	Lifetime time.Duration
+}
+
+// ValidateReceipt implements the ReceiptValidator interface.
+func (v *TrustedReceiptValidator) ValidateReceipt(
+	_, receipt string) ([]byte, time.Time, error) {
+
+	if receipt == "" {
+		return nil, time.Time{}, errors.TraceNew("missing receipt")
+	}
+	err := ValidateTrustedReceiptValidatorLifetime(v.Lifetime)
+	if err != nil {
+		return nil, time.Time{}, errors.Trace(err)
+	}
+	return []byte(receipt), time.Now().Add(v.Lifetime), nil
+}
+
+// HTTPReceiptValidator is a ReceiptValidator that delegates validation to an
+// HTTP service. The validator POSTs a JSON-encoded HTTPReceiptValidationRequest
+// to URL. The service responds with status 200 and a JSON-encoded
+// HTTPReceiptValidationResponse for valid receipts, and with any other
+// status for invalid receipts.
+type HTTPReceiptValidator struct {
+	URL    string
+	Client *http.Client
+}
+
+// HTTPReceiptValidationRequest is the HTTPReceiptValidator request.
+type HTTPReceiptValidationRequest struct {
+	AccessType string
+	Receipt    string
+}
+
+// HTTPReceiptValidationResponse is the HTTPReceiptValidator response.
+type HTTPReceiptValidationResponse struct {
+	SeedAuthorizationID []byte
+	Expires             time.Time
+}
+
+// ValidateReceipt implements the ReceiptValidator interface.
+func (v *HTTPReceiptValidator) ValidateReceipt(
+	accessType, receipt string) ([]byte, time.Time, error) {
+
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: HTTP_RECEIPT_VALIDATOR_TIMEOUT}
+	}
+
+	requestBody, err := json.Marshal(
+		&HTTPReceiptValidationRequest{
+			AccessType: accessType,
+			Receipt:    receipt,
+		})
+	if err != nil {
+		return nil, time.Time{}, errors.Trace(err)
+	}
+
+	response, err := client.Post(
+		v.URL, "application/json", bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, time.Time{}, errors.Trace(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, time.Time{}, errors.Tracef(
+			"receipt validation failed: %d", response.StatusCode)
+	}
+
+	responseBody, err := ioutil.ReadAll(
+		http.MaxBytesReader(nil, response.Body, HTTP_RECEIPT_VALIDATOR_MAX_RESPONSE))
+	if err != nil {
+		return nil, time.Time{}, errors.Trace(err)
+	}
+
+	var validationResponse HTTPReceiptValidationResponse
+	err = json.Unmarshal(responseBody, &validationResponse)
+	if err != nil {
+		return nil, time.Time{}, errors.Trace(err)
+	}
+
+	if len(validationResponse.SeedAuthorizationID) == 0 {
+		return nil, time.Time{}, errors.TraceNew("missing seed authorization ID")
+	}
+
+	return validationResponse.SeedAuthorizationID, validationResponse.Expires, nil
+}
+
+// Issuer issues authorizations for validated receipts. An Issuer holds the
+// signing keys for one or more access types.
+type Issuer struct {
+	signingKeys map[string]*SigningKey
+	validator   ReceiptValidator
+}
+
+// IssuanceRequest is a request to issue an authorization, for the specified
+// access type, backed by the specified receipt.
+type IssuanceRequest struct {
+	AccessType string
+	Receipt    string
+}
+
+// IssuanceResult is the result of an IssuanceRequest. Either Authorization
+// and AuthorizationID are set, or Error is set.
+//
+// Error is the generic ISSUANCE_FAILED_ERROR, as results may be returned to
+// remote callers. The underlying error, which may include internal details,
+// is in FailureReason, which is not marshaled and is for local logging only.
+type IssuanceResult struct {
+	Authorization   string `json:",omitempty"`
+	AuthorizationID []byte `json:",omitempty"`
+	Expires         time.Time
+	Error           string `json:",omitempty"`
+	FailureReason   error  `json:"-"`
+}
+
+// ValidateTrustedReceiptValidatorLifetime checks that lifetime is a valid
+// TrustedReceiptValidator.Lifetime.
+func ValidateTrustedReceiptValidatorLifetime(lifetime time.Duration) error {
+	if lifetime < TRUSTED_RECEIPT_VALIDATOR_MIN_EXPIRY {
+		return errors.Tracef(
+			"invalid lifetime: must be at least %s", TRUSTED_RECEIPT_VALIDATOR_MIN_EXPIRY)
+	}
+	return nil
+}
+
+// NewIssuer creates a new Issuer. There may be at most one signing key per
+// access type.
+func NewIssuer(
+	signingKeys []*SigningKey, validator ReceiptValidator) (*Issuer, error) {
+
+	keys := make(map[string]*SigningKey)
+
+	for _, signingKey := range signingKeys {
+
+		err := ValidateSigningKey(signingKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if _, ok := keys[signingKey.AccessType]; ok {
+			return nil, errors.Tracef(
+				"duplicate signing key for access type: %s", signingKey.AccessType)
+		}
+
+		keys[signingKey.AccessType] = signingKey
+	}
+
+	if validator == nil {
+		return nil, errors.TraceNew("missing validator")
+	}
+
+	return &Issuer{
+		signingKeys: keys,
+		validator:   validator,
+	}, nil
+}
+
+// Issue validates the request receipt and issues an authorization.
+func (issuer *Issuer) Issue(request *IssuanceRequest) (*IssuanceResult, error) {
+
+	signingKey, ok := issuer.signingKeys[request.AccessType]
+	if !ok {
+		return nil, errors.Tracef("unknown access type: %s", request.AccessType)
+	}
+
+	seedAuthorizationID, expires, err := issuer.validator.ValidateReceipt(
+		request.AccessType, request.Receipt)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if !expires.After(time.Now()) {
+		return nil, errors.TraceNew("invalid expiry")
+	}
+
+	authorization, authorizationID, err := IssueAuthorization(
+		signingKey, seedAuthorizationID, expires)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &IssuanceResult{
+		Authorization:   authorization,
+		AuthorizationID: authorizationID,
+		Expires:         expires.UTC(),
+	}, nil
+}
+
+// IssueBatch issues authorizations for a batch of requests. A result is
+// returned for each request, in order; the failure of any single request
+// doesn't fail the batch and is reported in the corresponding result.
+func (issuer *Issuer) IssueBatch(
+	requests []*IssuanceRequest) ([]*IssuanceResult, error) {
+
+	if len(requests) > MAX_ISSUANCE_BATCH_SIZE {
+		return nil, errors.TraceNew("batch too large")
+	}
+
+	results := make([]*IssuanceResult, len(requests))
+
+	for i, request := range requests {
+		result, err := issuer.Issue(request)
+		if err != nil {
+			result = &IssuanceResult{
+				Error:         ISSUANCE_FAILED_ERROR,
+				FailureReason: err,
+			}
+		}
+		results[i] = result
+	}
+
+	return results, nil
+}
@@ -0,0 +1,482 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/accesscontrol"
+)
+
+const (
+	maxRequestBodySize   = 1 << 20
+	httpIOTimeout        = 1 * time.Minute
+	authTokenEnvironment = "ISSUER_AUTH_TOKEN"
+	bearerPrefix         = "Bearer "
+)
+
+func main() {
+
+	var accessType string
+	flag.StringVar(&accessType, "access-type", "", "access type for generated key pair")
+
+	var signingKeyFilenames strs
+	flag.Var(&signingKeyFilenames, "signing-key", "signing key filename; may be repeated, one key per access type")
+
+	var keyRingFilename string
+	flag.StringVar(&keyRingFilename, "key-ring", "", "verification key ring filename; generated verification keys are added")
+
+	var seed string
+	flag.StringVar(&seed, "seed", "", "seed authorization ID, uniquely identifying the backing purchase")
+
+	var lifetime time.Duration
+	flag.DurationVar(&lifetime, "lifetime", 0, "authorization lifetime, used by issue and the trusted validator")
+
+	var inputFilename string
+	flag.StringVar(&inputFilename, "input", "", "input filename; \"-\" for stdin")
+
+	var validator string
+	flag.StringVar(&validator, "validator", "trusted", "receipt validator: \"trusted\" or \"http\"")
+
+	var validatorURL string
+	flag.StringVar(&validatorURL, "validator-url", "", "receipt validation service URL, used by the http validator")
+
+	var listenAddress string
+	flag.StringVar(&listenAddress, "listen", "127.0.0.1:8080", "issuance service listen address")
+
+	var authTokenFilename string
+	flag.StringVar(&authTokenFilename, "auth-token-file", "", "issuance service bearer token filename; serve requires this or ISSUER_AUTH_TOKEN")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage:\n\n"+
+				"%s <flags> generate    generates a signing key pair and adds the verification key to a key ring\n"+
+				"%s <flags> issue       issues a single authorization\n"+
+				"%s <flags> batch       issues authorizations for a batch of receipts\n"+
+				"%s <flags> serve       runs the HTTP issuance service\n"+
+				"%s <flags> revoke      issues a revocation list for authorization IDs\n\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	var command string
+	if len(args) >= 1 {
+		command = args[0]
+	}
+
+	var err error
+	switch command {
+	case "generate":
+		if accessType == "" || len(signingKeyFilenames) != 1 || keyRingFilename == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+		err = generate(accessType, signingKeyFilenames[0], keyRingFilename)
+	case "issue":
+		if len(signingKeyFilenames) != 1 || seed == "" || lifetime <= 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		err = issue(signingKeyFilenames[0], seed, lifetime)
+	case "batch", "serve":
+		if len(signingKeyFilenames) < 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		var issuer *accesscontrol.Issuer
+		issuer, err = makeIssuer(signingKeyFilenames, validator, validatorURL, lifetime)
+		if err == nil {
+			if command == "batch" {
+				err = batch(issuer, inputFilename)
+			} else {
+				var authToken string
+				authToken, err = loadAuthToken(authTokenFilename)
+				if err == nil {
+					err = serve(issuer, listenAddress, authToken)
+				}
+			}
+		}
+	case "revoke":
+		if len(signingKeyFilenames) != 1 || inputFilename == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+		err = revoke(signingKeyFilenames[0], inputFilename)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate(accessType, signingKeyFilename, keyRingFilename string) error {
+
+	if _, err := os.Stat(signingKeyFilename); err == nil {
+		return fmt.Errorf("signing key file already exists: %s", signingKeyFilename)
+	}
+
+	// Add to an existing key ring, when present, so that a single key ring
+	// may be deployed for multiple access types and key rotations.
+
+	var keyRing accesscontrol.VerificationKeyRing
+
+	keyRingJSON, err := ioutil.ReadFile(keyRingFilename)
+	if err == nil {
+		err = json.Unmarshal(keyRingJSON, &keyRing)
+		if err != nil {
+			return fmt.Errorf("unmarshal key ring failed: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("read key ring failed: %s", err)
+	}
+
+	signingKey, verificationKey, err := accesscontrol.NewKeyPair(accessType)
+	if err != nil {
+		return fmt.Errorf("generate key pair failed: %s", err)
+	}
+
+	keyRing.Keys = append(keyRing.Keys, verificationKey)
+
+	err = accesscontrol.ValidateVerificationKeyRing(&keyRing)
+	if err != nil {
+		return fmt.Errorf("validate key ring failed: %s", err)
+	}
+
+	signingKeyJSON, err := json.MarshalIndent(signingKey, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal signing key failed: %s", err)
+	}
+
+	keyRingJSON, err = json.MarshalIndent(keyRing, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal key ring failed: %s", err)
+	}
+
+	err = ioutil.WriteFile(signingKeyFilename, signingKeyJSON, 0600)
+	if err != nil {
+		return fmt.Errorf("write signing key failed: %s", err)
+	}
+
+	err = ioutil.WriteFile(keyRingFilename, keyRingJSON, 0644)
+	if err != nil {
+		return fmt.Errorf("write key ring failed: %s", err)
+	}
+
+	fmt.Printf("key ID:        %s\n\n", base64.StdEncoding.EncodeToString(signingKey.ID))
+
+	return nil
+}
+
+func loadSigningKey(filename string) (*accesscontrol.SigningKey, error) {
+
+	signingKeyJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read signing key failed: %s", err)
+	}
+
+	var signingKey accesscontrol.SigningKey
+	err = json.Unmarshal(signingKeyJSON, &signingKey)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal signing key failed: %s", err)
+	}
+
+	err = accesscontrol.ValidateSigningKey(&signingKey)
+	if err != nil {
+		return nil, fmt.Errorf("validate signing key failed: %s", err)
+	}
+
+	return &signingKey, nil
+}
+
+func issue(signingKeyFilename, seed string, lifetime time.Duration) error {
+
+	signingKey, err := loadSigningKey(signingKeyFilename)
+	if err != nil {
+		return err
+	}
+
+	authorization, authorizationID, err := accesscontrol.IssueAuthorization(
+		signingKey, []byte(seed), time.Now().Add(lifetime))
+	if err != nil {
+		return fmt.Errorf("issue authorization failed: %s", err)
+	}
+
+	fmt.Printf("authorization ID:  %s\nauthorization:     %s\n\n",
+		base64.StdEncoding.EncodeToString(authorizationID), authorization)
+
+	return nil
+}
+
+func makeIssuer(
+	signingKeyFilenames []string,
+	validator string,
+	validatorURL string,
+	lifetime time.Duration) (*accesscontrol.Issuer, error) {
+
+	var signingKeys []*accesscontrol.SigningKey
+	for _, filename := range signingKeyFilenames {
+		signingKey, err := loadSigningKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		signingKeys = append(signingKeys, signingKey)
+	}
+
+	var receiptValidator accesscontrol.ReceiptValidator
+	switch validator {
+	case "trusted":
+		// Check the lifetime now, as otherwise every issuance would fail.
+		err := accesscontrol.ValidateTrustedReceiptValidatorLifetime(lifetime)
+		if err != nil {
+			return nil, fmt.Errorf("validate lifetime failed: %s", err)
+		}
+		receiptValidator = &accesscontrol.TrustedReceiptValidator{Lifetime: lifetime}
+	case "http":
+		if validatorURL == "" {
+			return nil, fmt.Errorf("missing validator URL")
+		}
+		receiptValidator = &accesscontrol.HTTPReceiptValidator{URL: validatorURL}
+	default:
+		return nil, fmt.Errorf("unknown validator: %s", validator)
+	}
+
+	issuer, err := accesscontrol.NewIssuer(signingKeys, receiptValidator)
+	if err != nil {
+		return nil, fmt.Errorf("create issuer failed: %s", err)
+	}
+
+	return issuer, nil
+}
+
+func readInput(inputFilename string) ([]byte, error) {
+	if inputFilename == "" || inputFilename == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(inputFilename)
+}
+
+// batch reads a JSON array of accesscontrol.IssuanceRequest and outputs a
+// JSON array of accesscontrol.IssuanceResult.
+func batch(issuer *accesscontrol.Issuer, inputFilename string) error {
+
+	input, err := readInput(inputFilename)
+	if err != nil {
+		return fmt.Errorf("read input failed: %s", err)
+	}
+
+	var requests []*accesscontrol.IssuanceRequest
+	err = json.Unmarshal(input, &requests)
+	if err != nil {
+		return fmt.Errorf("unmarshal requests failed: %s", err)
+	}
+
+	results, err := issuer.IssueBatch(requests)
+	if err != nil {
+		return fmt.Errorf("issue batch failed: %s", err)
+	}
+
+	for i, result := range results {
+		if result.FailureReason != nil {
+			fmt.Fprintf(os.Stderr, "request %d failed: %s\n", i, result.FailureReason)
+		}
+	}
+
+	output, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal results failed: %s", err)
+	}
+
+	fmt.Printf("%s\n", output)
+
+	return nil
+}
+
+// loadAuthToken returns the issuance service bearer token, from the
+// ISSUER_AUTH_TOKEN environment variable or, when set, the token file. The
+// token isn't accepted as a flag, which would expose it in the process list
+// and shell history.
+func loadAuthToken(authTokenFilename string) (string, error) {
+
+	authToken := os.Getenv(authTokenEnvironment)
+
+	if authTokenFilename != "" {
+		fileContent, err := ioutil.ReadFile(authTokenFilename)
+		if err != nil {
+			return "", fmt.Errorf("read auth token failed: %s", err)
+		}
+		authToken = strings.TrimSpace(string(fileContent))
+	}
+
+	// The service issues valid authorizations for any receipt the validator
+	// accepts, and the default trusted validator accepts every receipt, so
+	// the service must not run without client authentication.
+	if authToken == "" {
+		return "", fmt.Errorf(
+			"serve requires -auth-token-file or %s", authTokenEnvironment)
+	}
+
+	return authToken, nil
+}
+
+// serve runs the issuance service. Clients POST a JSON array of
+// accesscontrol.IssuanceRequest to /issue and receive a JSON array of
+// accesscontrol.IssuanceResult. Requests must include authToken in an
+// "Authorization: Bearer <token>" header.
+//
+// Errors returned to clients are generic; details are logged to stderr.
+//
+// The service doesn't provide TLS and should be run behind a TLS-terminating
+// proxy or on a private network.
+func serve(
+	issuer *accesscontrol.Issuer, listenAddress, authToken string) error {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/issue", func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, bearerPrefix) ||
+			subtle.ConstantTimeCompare(
+				[]byte(authorization[len(bearerPrefix):]), []byte(authToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+		if err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		var requests []*accesscontrol.IssuanceRequest
+		err = json.Unmarshal(body, &requests)
+		if err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		results, err := issuer.IssueBatch(requests)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "issue batch failed: %s\n", err)
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		for i, result := range results {
+			if result.FailureReason != nil {
+				fmt.Fprintf(os.Stderr, "request %d failed: %s\n", i, result.FailureReason)
+			}
+		}
+
+		response, err := json.Marshal(results)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "marshal results failed: %s\n", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(response)
+	})
+
+	server := &http.Server{
+		Addr:         listenAddress,
+		Handler:      mux,
+		ReadTimeout:  httpIOTimeout,
+		WriteTimeout: httpIOTimeout,
+	}
+
+	fmt.Printf("listening on %s\n", listenAddress)
+
+	return server.ListenAndServe()
+}
+
+// revoke reads base64-encoded authorization IDs, one per line, and outputs a
+// signed revocation list. Revocation lists are cumulative; see
+// accesscontrol.RevocationList.
+func revoke(signingKeyFilename, inputFilename string) error {
+
+	signingKey, err := loadSigningKey(signingKeyFilename)
+	if err != nil {
+		return err
+	}
+
+	input, err := readInput(inputFilename)
+	if err != nil {
+		return fmt.Errorf("read input failed: %s", err)
+	}
+
+	var authorizationIDs [][]byte
+	scanner := bufio.NewScanner(strings.NewReader(string(input)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		ID, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return fmt.Errorf("decode authorization ID failed: %s", err)
+		}
+		authorizationIDs = append(authorizationIDs, ID)
+	}
+
+	revocationList, err := accesscontrol.IssueRevocationList(
+		signingKey, authorizationIDs, time.Now())
+	if err != nil {
+		return fmt.Errorf("issue revocation list failed: %s", err)
+	}
+
+	fmt.Printf("%s\n\n", revocationList)
+
+	return nil
+}
+
+type strs []string
+
+func (s *strs) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *strs) Set(strValue string) error {
+	*s = append(*s, strValue)
+	return nil
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package accesscontrol
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+// RevocationList lists authorization IDs, issued with a single signing key,
+// that are revoked before their expiry time. A revocation list is signed
+// with the same signing key as the revoked authorizations.
+//
+// Revocation lists are cumulative: a newer revocation list for the same
+// signing key, as indicated by Issued, replaces any older list, and must
+// include all authorization IDs that remain revoked. Authorization IDs need
+// not be retained in newer lists once the corresponding authorizations have
+// expired.
+//
+// A revocation list is represented in JSON, which is then base64-encoded
+// for transport:
+//
+//	{
+//	  "RevocationList" : {
+//	    "Issued" : <RFC3339-encoded UTC time value>,
+//	    "AuthorizationIDs" : [<authorization ID>, ...]
+//	  },
+//	  "SigningKeyID" : <unique key ID>,
+//	  "Signature" : <Ed25519 digital signature>
+//	}
+type RevocationList struct {
+	Issued           time.Time
+	AuthorizationIDs [][]byte
+	SigningKeyID     []byte `json:"-"`
+}
+
+type signedRevocationList struct {
+	RevocationList json.RawMessage
+	SigningKeyID   []byte
+	Signature      []byte
+}
+
+// IssueRevocationList issues a revocation list, for authorizations issued
+// with the specified signing key, signed with that signing key.
+// authorizationIDs are the authorization IDs returned by IssueAuthorization.
+//
+// The return value is a base64-encoded, serialized JSON representation of
+// the signed revocation list that can be passed to VerifyRevocationList.
+func IssueRevocationList(
+	signingKey *SigningKey,
+	authorizationIDs [][]byte,
+	issued time.Time) (string, error) {
+
+	err := ValidateSigningKey(signingKey)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	for _, ID := range authorizationIDs {
+		if len(ID) != authorizationIDLength {
+			return "", errors.TraceNew("invalid authorization ID")
+		}
+	}
+
+	if authorizationIDs == nil {
+		authorizationIDs = make([][]byte, 0)
+	}
+
+	list := RevocationList{
+		Issued:           issued.UTC(),
+		AuthorizationIDs: authorizationIDs,
+	}
+
+	listJSON, err := json.Marshal(list)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	signature := ed25519.Sign(signingKey.PrivateKey, listJSON)
+
+	signedList := signedRevocationList{
+		RevocationList: listJSON,
+		SigningKeyID:   signingKey.ID,
+		Signature:      signature,
+	}
+
+	signedListJSON, err := json.Marshal(signedList)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signedListJSON), nil
+}
+
+// VerifyRevocationList verifies the signed revocation list and, when
+// verified, returns the embedded RevocationList, with SigningKeyID
+// populated.
+//
+// The key ID in the signed revocation list is used to select the
+// appropriate verification key from the key ring.
+func VerifyRevocationList(
+	keyRing *VerificationKeyRing,
+	encodedSignedRevocationList string) (*RevocationList, error) {
+
+	err := ValidateVerificationKeyRing(keyRing)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	signedListJSON, err := base64.StdEncoding.DecodeString(
+		encodedSignedRevocationList)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var signedList signedRevocationList
+	err = json.Unmarshal(signedListJSON, &signedList)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(signedList.SigningKeyID) != keyIDLength {
+		return nil, errors.TraceNew("invalid key ID length")
+	}
+
+	if len(signedList.Signature) != ed25519.SignatureSize {
+		return nil, errors.TraceNew("invalid signature length")
+	}
+
+	var verificationKey *VerificationKey
+
+	for _, key := range keyRing.Keys {
+		if subtle.ConstantTimeCompare(signedList.SigningKeyID, key.ID) == 1 {
+			verificationKey = key
+		}
+	}
+
+	if verificationKey == nil {
+		return nil, errors.TraceNew("invalid key ID")
+	}
+
+	if !ed25519.Verify(
+		verificationKey.PublicKey, signedList.RevocationList, signedList.Signature) {
+		return nil, errors.TraceNew("invalid signature")
+	}
+
+	var list RevocationList
+
+	err = json.Unmarshal(signedList.RevocationList, &list)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if list.Issued.IsZero() {
+		return nil, errors.TraceNew("invalid issued time")
+	}
+
+	list.SigningKeyID = verificationKey.ID
+
+	return &list, nil
+}
+
+// Revocations is a set of revoked authorizations, keyed by signing key ID
+// and authorization ID, built from verified revocation lists.
+type Revocations struct {
+	revoked map[string]map[string]bool
+}
+
+// NewRevocations verifies the encoded, signed revocation lists and returns
+// the set of revoked authorizations. When multiple lists are signed with
+// the same signing key, only the most recently issued list is used. Any
+// list that fails verification is an error.
+func NewRevocations(
+	keyRing *VerificationKeyRing,
+	encodedSignedRevocationLists []string) (*Revocations, error) {
+
+	lists := make(map[string]*RevocationList)
+
+	for _, encodedList := range encodedSignedRevocationLists {
+
+		list, err := VerifyRevocationList(keyRing, encodedList)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		keyID := string(list.SigningKeyID)
+		if existingList, ok := lists[keyID]; ok &&
+			!list.Issued.After(existingList.Issued) {
+			continue
+		}
+		lists[keyID] = list
+	}
+
+	revoked := make(map[string]map[string]bool)
+
+	for keyID, list := range lists {
+		IDs := make(map[string]bool)
+		for _, ID := range list.AuthorizationIDs {
+			IDs[string(ID)] = true
+		}
+		revoked[keyID] = IDs
+	}
+
+	return &Revocations{revoked: revoked}, nil
+}
+
+// IsRevoked indicates if the verified authorization is revoked. IsRevoked
+// may be called on a nil Revocations, in which case no authorization is
+// revoked.
+func (r *Revocations) IsRevoked(authorization *Authorization) bool {
+	if r == nil {
+		return false
+	}
+	IDs, ok := r.revoked[string(authorization.SigningKeyID)]
+	if !ok {
+		return false
+	}
+	return IDs[string(authorization.ID)]
+}
+
+// Count returns the total number of revoked authorizations.
+func (r *Revocations) Count() int {
+	if r == nil {
+		return 0
+	}
+	count := 0
+	for _, IDs := range r.revoked {
+		count += len(IDs)
+	}
+	return count
+}
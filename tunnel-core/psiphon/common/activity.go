@@ -166,6 +166,64 @@ func (conn *ActivityMonitoredConn) Write(buffer []byte) (int, error) {
 	return n, err
 }
 
+// UpdateReadActivity records n bytes read outside of the conn, such as QUIC
+// datagrams received over the same underlying connection, as read activity.
+// As with Read, the inactivity deadline is extended, the LRU entry is
+// promoted, and activity updaters are called.
+func (conn *ActivityMonitoredConn) UpdateReadActivity(n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	if conn.inactivityTimeout > 0 {
+		err := conn.Conn.SetDeadline(time.Now().Add(conn.inactivityTimeout))
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	lastReadActivityTime := atomic.LoadInt64(&conn.lastReadActivityTime)
+	readActivityTime := int64(monotime.Now())
+
+	atomic.StoreInt64(&conn.lastReadActivityTime, readActivityTime)
+
+	for _, activityUpdater := range conn.activityUpdaters {
+		activityUpdater.UpdateProgress(
+			int64(n), 0, readActivityTime-lastReadActivityTime)
+	}
+
+	if conn.lruEntry != nil {
+		conn.lruEntry.Touch()
+	}
+
+	return nil
+}
+
+// UpdateWriteActivity records n bytes written outside of the conn as write
+// activity, with the same effects as a Write.
+func (conn *ActivityMonitoredConn) UpdateWriteActivity(n int) error {
+	if n <= 0 || !conn.activeOnWrite {
+		return nil
+	}
+
+	if conn.inactivityTimeout > 0 {
+		err := conn.Conn.SetDeadline(time.Now().Add(conn.inactivityTimeout))
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for _, activityUpdater := range conn.activityUpdaters {
+		activityUpdater.UpdateProgress(0, int64(n), 0)
+	}
+
+	if conn.lruEntry != nil {
+		conn.lruEntry.Touch()
+	}
+
+	return nil
+}
+
 // IsClosed implements the Closer iterface. The return value indicates whether
 // the underlying conn has been closed.
 func (conn *ActivityMonitoredConn) IsClosed() bool {
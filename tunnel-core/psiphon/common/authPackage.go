@@ -41,10 +41,42 @@ import (
 // payload, such as list of Psiphon server entries. As it may be downloaded
 // from various sources, it is digitally signed so that the data may be
 // authenticated.
+//
+// A package may be signed by more than one key. The first signature is stored
+// in the legacy SigningPublicKeyDigest and Signature fields, and any further
+// signatures are stored in AdditionalSignatures, which is a JSON-encoded
+// array of AuthenticatedDataPackageSignatures. AdditionalSignatures is a
+// string value, as required by NewAuthenticatedDataPackageReader. Note that
+// older clients reject packages with AdditionalSignatures.
 type AuthenticatedDataPackage struct {
 	Data                   string `json:"data"`
 	SigningPublicKeyDigest []byte `json:"signingPublicKeyDigest"`
 	Signature              []byte `json:"signature"`
+	AdditionalSignatures   []byte `json:"additionalSignatures,omitempty"`
+}
+
+// AuthenticatedDataPackageSignature is a signature of an
+// AuthenticatedDataPackage. SigningPublicKeyDigest, the SHA-256 digest of
+// the signing public key, identifies the signing key.
+type AuthenticatedDataPackageSignature struct {
+	SigningPublicKeyDigest []byte
+	Signature              []byte
+}
+
+// AuthenticatedDataPackageSigningKey is a key pair used to sign an
+// AuthenticatedDataPackage.
+type AuthenticatedDataPackageSigningKey struct {
+	PublicKey  string
+	PrivateKey string
+}
+
+// AuthenticatedDataPackageKeys specifies the trusted public keys used to
+// authenticate an AuthenticatedDataPackage. A package is authenticated when
+// it has valid signatures from at least Threshold distinct trusted keys. A
+// Threshold of 0 is treated as 1, so that any one trusted key suffices.
+type AuthenticatedDataPackageKeys struct {
+	PublicKeys []string
+	Threshold  int
 }
 
 // GenerateAuthenticatedDataPackageKeys generates a key pair
@@ -80,29 +112,72 @@ func sha256sum(data string) []byte {
 func WriteAuthenticatedDataPackage(
 	data string, signingPublicKey, signingPrivateKey string) ([]byte, error) {
 
-	derEncodedPrivateKey, err := base64.StdEncoding.DecodeString(signingPrivateKey)
+	dataPackage, err := WriteMultiSignedAuthenticatedDataPackage(
+		data,
+		[]*AuthenticatedDataPackageSigningKey{
+			{PublicKey: signingPublicKey, PrivateKey: signingPrivateKey}})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(derEncodedPrivateKey)
-	if err != nil {
-		return nil, errors.Trace(err)
+
+	return dataPackage, nil
+}
+
+// WriteMultiSignedAuthenticatedDataPackage creates an
+// AuthenticatedDataPackage containing the specified data and signed by each
+// of the given keys. With a single signing key, the output is identical to
+// WriteAuthenticatedDataPackage.
+func WriteMultiSignedAuthenticatedDataPackage(
+	data string, signingKeys []*AuthenticatedDataPackageSigningKey) ([]byte, error) {
+
+	if len(signingKeys) < 1 {
+		return nil, errors.TraceNew("missing signing key")
 	}
 
-	signature, err := rsa.SignPKCS1v15(
-		rand.Reader,
-		rsaPrivateKey,
-		crypto.SHA256,
-		sha256sum(data))
-	if err != nil {
-		return nil, errors.Trace(err)
+	var signatures []*AuthenticatedDataPackageSignature
+
+	for _, signingKey := range signingKeys {
+
+		derEncodedPrivateKey, err := base64.StdEncoding.DecodeString(signingKey.PrivateKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(derEncodedPrivateKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		signature, err := rsa.SignPKCS1v15(
+			rand.Reader,
+			rsaPrivateKey,
+			crypto.SHA256,
+			sha256sum(data))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		signatures = append(signatures,
+			&AuthenticatedDataPackageSignature{
+				SigningPublicKeyDigest: sha256sum(signingKey.PublicKey),
+				Signature:              signature,
+			})
+	}
+
+	var additionalSignatures []byte
+	if len(signatures) > 1 {
+		var err error
+		additionalSignatures, err = json.Marshal(signatures[1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
 
 	packageJSON, err := json.Marshal(
 		&AuthenticatedDataPackage{
 			Data:                   data,
-			SigningPublicKeyDigest: sha256sum(signingPublicKey),
-			Signature:              signature,
+			SigningPublicKeyDigest: signatures[0].SigningPublicKeyDigest,
+			Signature:              signatures[0].Signature,
+			AdditionalSignatures:   additionalSignatures,
 		})
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -111,6 +186,97 @@ func WriteAuthenticatedDataPackage(
 	return Compress(packageJSON), nil
 }
 
+// verifyAuthenticatedDataPackageSignatures checks that there are valid
+// signatures, over the data digest, from at least the required threshold of
+// distinct trusted keys. Signatures from unknown keys are ignored.
+func verifyAuthenticatedDataPackageSignatures(
+	keys *AuthenticatedDataPackageKeys,
+	dataDigest []byte,
+	signingPublicKeyDigest []byte,
+	signature []byte,
+	additionalSignatures []byte) error {
+
+	if keys == nil || len(keys.PublicKeys) < 1 {
+		return errors.TraceNew("missing signing public key")
+	}
+
+	threshold := keys.Threshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	if threshold > len(keys.PublicKeys) {
+		return errors.TraceNew("invalid signature threshold")
+	}
+
+	signatures := []*AuthenticatedDataPackageSignature{
+		{SigningPublicKeyDigest: signingPublicKeyDigest, Signature: signature}}
+
+	if len(additionalSignatures) > 0 {
+		var decodedSignatures []*AuthenticatedDataPackageSignature
+		err := json.Unmarshal(additionalSignatures, &decodedSignatures)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		signatures = append(signatures, decodedSignatures...)
+	}
+
+	verifiedKeys := make(map[string]bool)
+	foundTrustedKey := false
+
+	for _, signingPublicKey := range keys.PublicKeys {
+
+		if verifiedKeys[signingPublicKey] {
+			continue
+		}
+
+		digest := sha256sum(signingPublicKey)
+
+		for _, signature := range signatures {
+
+			if signature == nil ||
+				!bytes.Equal(signature.SigningPublicKeyDigest, digest) {
+				continue
+			}
+
+			foundTrustedKey = true
+
+			derEncodedPublicKey, err := base64.StdEncoding.DecodeString(signingPublicKey)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			publicKey, err := x509.ParsePKIXPublicKey(derEncodedPublicKey)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+			if !ok {
+				return errors.TraceNew("unexpected signing public key type")
+			}
+
+			err = rsa.VerifyPKCS1v15(
+				rsaPublicKey,
+				crypto.SHA256,
+				dataDigest,
+				signature.Signature)
+			if err == nil {
+				verifiedKeys[signingPublicKey] = true
+				break
+			}
+		}
+	}
+
+	if !foundTrustedKey {
+		return errors.TraceNew("unexpected signing public key digest")
+	}
+
+	if len(verifiedKeys) < threshold {
+		return errors.Tracef(
+			"insufficient valid signatures: %d of %d", len(verifiedKeys), threshold)
+	}
+
+	return nil
+}
+
 // ReadAuthenticatedDataPackage extracts and verifies authenticated
 // data from an AuthenticatedDataPackage. The package must have been
 // signed with the given key.
@@ -119,6 +285,24 @@ func WriteAuthenticatedDataPackage(
 func ReadAuthenticatedDataPackage(
 	dataPackage []byte, isCompressed bool, signingPublicKey string) (string, error) {
 
+	data, err := ReadAuthenticatedDataPackageWithKeys(
+		dataPackage,
+		isCompressed,
+		&AuthenticatedDataPackageKeys{PublicKeys: []string{signingPublicKey}})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return data, nil
+}
+
+// ReadAuthenticatedDataPackageWithKeys is ReadAuthenticatedDataPackage with
+// a set of trusted keys and a signature threshold.
+func ReadAuthenticatedDataPackageWithKeys(
+	dataPackage []byte,
+	isCompressed bool,
+	signingPublicKeys *AuthenticatedDataPackageKeys) (string, error) {
+
 	var packageJSON []byte
 	var err error
 
@@ -137,31 +321,12 @@ func ReadAuthenticatedDataPackage(
 		return "", errors.Trace(err)
 	}
 
-	derEncodedPublicKey, err := base64.StdEncoding.DecodeString(signingPublicKey)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-	publicKey, err := x509.ParsePKIXPublicKey(derEncodedPublicKey)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-	if !ok {
-		return "", errors.TraceNew("unexpected signing public key type")
-	}
-
-	if !bytes.Equal(
-		authenticatedDataPackage.SigningPublicKeyDigest,
-		sha256sum(signingPublicKey)) {
-
-		return "", errors.TraceNew("unexpected signing public key digest")
-	}
-
-	err = rsa.VerifyPKCS1v15(
-		rsaPublicKey,
-		crypto.SHA256,
+	err = verifyAuthenticatedDataPackageSignatures(
+		signingPublicKeys,
 		sha256sum(authenticatedDataPackage.Data),
-		authenticatedDataPackage.Signature)
+		authenticatedDataPackage.SigningPublicKeyDigest,
+		authenticatedDataPackage.Signature,
+		authenticatedDataPackage.AdditionalSignatures)
 	if err != nil {
 		return "", errors.Trace(err)
 	}
@@ -179,6 +344,23 @@ func ReadAuthenticatedDataPackage(
 func NewAuthenticatedDataPackageReader(
 	dataPackage io.ReadSeeker, signingPublicKey string) (io.Reader, error) {
 
+	payload, err := NewAuthenticatedDataPackageReaderWithKeys(
+		dataPackage,
+		&AuthenticatedDataPackageKeys{PublicKeys: []string{signingPublicKey}})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return payload, nil
+}
+
+// NewAuthenticatedDataPackageReaderWithKeys is
+// NewAuthenticatedDataPackageReader with a set of trusted keys and a
+// signature threshold.
+func NewAuthenticatedDataPackageReaderWithKeys(
+	dataPackage io.ReadSeeker,
+	signingPublicKeys *AuthenticatedDataPackageKeys) (io.Reader, error) {
+
 	// The file is streamed in 2 passes. The first pass verifies the package
 	// signature. No payload data should be accepted/processed until the signature
 	// check is complete. The second pass repositions to the data payload and returns
@@ -210,6 +392,7 @@ func NewAuthenticatedDataPackageReader(
 		var jsonData io.Reader
 		var jsonSigningPublicKey []byte
 		var jsonSignature []byte
+		var jsonAdditionalSignatures []byte
 
 		jsonReadBase64Value := func(value io.Reader) ([]byte, error) {
 			base64Value, err := ioutil.ReadAll(value)
@@ -258,6 +441,13 @@ func NewAuthenticatedDataPackageReader(
 					return false, errors.Trace(err)
 				}
 				return true, nil
+
+			case "additionalSignatures":
+				jsonAdditionalSignatures, err = jsonReadBase64Value(value)
+				if err != nil {
+					return false, errors.Trace(err)
+				}
+				return true, nil
 			}
 
 			return false, errors.Tracef("unexpected key '%s'", key)
@@ -281,28 +471,12 @@ func NewAuthenticatedDataPackageReader(
 				return nil, errors.TraceNew("missing expected field")
 			}
 
-			derEncodedPublicKey, err := base64.StdEncoding.DecodeString(signingPublicKey)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			publicKey, err := x509.ParsePKIXPublicKey(derEncodedPublicKey)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-			if !ok {
-				return nil, errors.TraceNew("unexpected signing public key type")
-			}
-
-			if !bytes.Equal(jsonSigningPublicKey, sha256sum(signingPublicKey)) {
-				return nil, errors.TraceNew("unexpected signing public key digest")
-			}
-
-			err = rsa.VerifyPKCS1v15(
-				rsaPublicKey,
-				crypto.SHA256,
+			err = verifyAuthenticatedDataPackageSignatures(
+				signingPublicKeys,
 				hash.Sum(nil),
-				jsonSignature)
+				jsonSigningPublicKey,
+				jsonSignature,
+				jsonAdditionalSignatures)
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
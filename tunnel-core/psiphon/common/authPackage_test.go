@@ -162,6 +162,130 @@ func TestAuthenticatedPackage(t *testing.T) {
 	})
 }
 
+func TestMultiSignedAuthenticatedPackage(t *testing.T) {
+
+	var signingKeys []*AuthenticatedDataPackageSigningKey
+	var signingPublicKeys []string
+
+	for i := 0; i < 3; i++ {
+		publicKey, privateKey, err := GenerateAuthenticatedDataPackageKeys()
+		if err != nil {
+			t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+		}
+		signingKeys = append(signingKeys,
+			&AuthenticatedDataPackageSigningKey{
+				PublicKey:  publicKey,
+				PrivateKey: privateKey,
+			})
+		signingPublicKeys = append(signingPublicKeys, publicKey)
+	}
+
+	expectedContent := "TestMultiSignedAuthenticatedPackage\n"
+
+	// Signed by the first 2 of 3 keys.
+
+	packagePayload, err := WriteMultiSignedAuthenticatedDataPackage(
+		expectedContent, signingKeys[:2])
+	if err != nil {
+		t.Fatalf("WriteMultiSignedAuthenticatedDataPackage failed: %s", err)
+	}
+
+	tempFileName, err := makeTempFile(packagePayload)
+	if err != nil {
+		t.Fatalf("makeTempFile failed: %s", err)
+	}
+	defer os.Remove(tempFileName)
+
+	testCases := []struct {
+		description   string
+		keys          *AuthenticatedDataPackageKeys
+		expectSuccess bool
+	}{
+		{
+			"legacy key",
+			&AuthenticatedDataPackageKeys{PublicKeys: signingPublicKeys[:1]},
+			true,
+		},
+		{
+			"additional signature key",
+			&AuthenticatedDataPackageKeys{PublicKeys: signingPublicKeys[1:2]},
+			true,
+		},
+		{
+			"rotated keys",
+			&AuthenticatedDataPackageKeys{PublicKeys: signingPublicKeys[1:]},
+			true,
+		},
+		{
+			"unsigned key",
+			&AuthenticatedDataPackageKeys{PublicKeys: signingPublicKeys[2:]},
+			false,
+		},
+		{
+			"threshold met",
+			&AuthenticatedDataPackageKeys{PublicKeys: signingPublicKeys, Threshold: 2},
+			true,
+		},
+		{
+			"threshold not met",
+			&AuthenticatedDataPackageKeys{PublicKeys: signingPublicKeys, Threshold: 3},
+			false,
+		},
+		{
+			"duplicate keys do not meet threshold",
+			&AuthenticatedDataPackageKeys{
+				PublicKeys: []string{signingPublicKeys[0], signingPublicKeys[0]},
+				Threshold:  2},
+			false,
+		},
+		{
+			"invalid threshold",
+			&AuthenticatedDataPackageKeys{PublicKeys: signingPublicKeys[:1], Threshold: 2},
+			false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			content, err := ReadAuthenticatedDataPackageWithKeys(
+				packagePayload, true, testCase.keys)
+			if testCase.expectSuccess {
+				if err != nil {
+					t.Fatalf("ReadAuthenticatedDataPackageWithKeys failed: %s", err)
+				}
+				if content != expectedContent {
+					t.Fatalf("unexpected package content: %s", content)
+				}
+			} else if err == nil {
+				t.Fatalf("ReadAuthenticatedDataPackageWithKeys unexpectedly succeeded")
+			}
+
+			file, err := os.Open(tempFileName)
+			if err != nil {
+				t.Fatalf("Open failed: %s", err)
+			}
+			defer file.Close()
+			contentReader, err := NewAuthenticatedDataPackageReaderWithKeys(
+				file, testCase.keys)
+			if testCase.expectSuccess {
+				if err != nil {
+					t.Fatalf("NewAuthenticatedDataPackageReaderWithKeys failed: %s", err)
+				}
+				content, err := ioutil.ReadAll(contentReader)
+				if err != nil {
+					t.Fatalf("ReadAll failed: %s", err)
+				}
+				if string(content) != expectedContent {
+					t.Fatalf("unexpected package content: %s", content)
+				}
+			} else if err == nil {
+				t.Fatalf("NewAuthenticatedDataPackageReaderWithKeys unexpectedly succeeded")
+			}
+		})
+	}
+}
+
 func BenchmarkAuthenticatedPackage(b *testing.B) {
 
 	signingPublicKey, signingPrivateKey, err := GenerateAuthenticatedDataPackageKeys()
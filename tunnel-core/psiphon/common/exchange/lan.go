@@ -0,0 +1,773 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package exchange
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	LAN_OFFER_DEFAULT_TRANSFER_LIMIT        = 5
+	LAN_OFFER_DEFAULT_TRANSFER_LIMIT_PERIOD = 10 * time.Minute
+	LAN_OFFER_DEFAULT_CONFIRM_TIMEOUT       = 30 * time.Second
+	LAN_OFFER_MAX_PAYLOAD_SIZE              = 65536
+	LAN_OFFER_CODE_PREFIX                   = "PSXL1:"
+
+	lanOfferSecretSize          = 16
+	lanOfferNonceSize           = 32
+	lanOfferIOTimeout           = 10 * time.Second
+	lanOfferMDNSResponseBackoff = 1 * time.Second
+	lanOfferDiscoveryInterval   = 1 * time.Second
+	lanOfferServiceNameContext  = "psiphon-exchange-lan-service"
+	lanOfferAuthContext         = "psiphon-exchange-lan-auth"
+	lanOfferPayloadContext      = "psiphon-exchange-lan-payload"
+)
+
+var mDNSGroupAddress = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// The LAN offer allows a client to offer its exchange payload to peers on
+// the same local network. The offering client advertises a service with
+// mDNS and serves the payload over TCP; the receiving client discovers
+// offers with DiscoverLANOffers and fetches a payload with ReceiveLANOffer.
+//
+// Advertising a service on the local network reveals, to any observer on
+// that network, that a Psiphon client is present. To limit this exposure,
+// LAN offers are opt-in and short lived: the app should start an offer only
+// at the user's request, and stop it once the exchange is done.
+//
+// Each offer generates a random secret, which the offering app shares with
+// the receiving user out of band, as the offer code returned by
+// LANOffer.Code; for example, displayed as a QR code. The mDNS service type
+// and the TCP transfer authentication and payload keys are derived from the
+// secret, so the service type differs for each offer and is not a fixed,
+// well-known name, the TCP transfer requires proof of knowledge of the
+// secret before any payload is sent, and the payload is encrypted on the
+// wire. Secrets embedded in the client, such as the
+// exchange obfuscation key, are not used, as a censor may extract them.
+// Note that the random service type itself may still stand out to an
+// observer of the local network.
+//
+// The offering user is asked to confirm each transfer, via
+// LANOfferConfig.ConfirmTransfer, and transfers are rate limited, both in
+// total and per peer.
+
+// LANOfferConfig specifies the parameters for a LAN offer.
+type LANOfferConfig struct {
+
+	// GetPayload returns the exchange payload to offer. GetPayload is invoked
+	// for each confirmed transfer, so the most recent payload is offered.
+	GetPayload func() (string, error)
+
+	// ConfirmTransfer, when set, is invoked for each transfer request and
+	// must return true for the transfer to proceed. ConfirmTransfer is
+	// expected to prompt the user and may block until ctx is done, which
+	// happens after ConfirmTimeout or when the offer is stopped; at that
+	// point, ConfirmTransfer should dismiss any prompt and return promptly,
+	// as Stop waits for it to return.
+	ConfirmTransfer func(ctx context.Context, peerIPAddress string) bool
+
+	// TransferLimit is the maximum number of transfers per
+	// TransferLimitPeriod. Each peer IP address is limited to one transfer
+	// per TransferLimitPeriod. When 0, defaults are used.
+	TransferLimit       int
+	TransferLimitPeriod time.Duration
+
+	// ConfirmTimeout is the maximum time to wait for ConfirmTransfer. When 0,
+	// LAN_OFFER_DEFAULT_CONFIRM_TIMEOUT is used.
+	ConfirmTimeout time.Duration
+}
+
+// LANOffer is a running LAN offer.
+type LANOffer struct {
+	config        *LANOfferConfig
+	secret        []byte
+	ctx           context.Context
+	stopOffer     context.CancelFunc
+	serviceName   string
+	instanceName  string
+	hostName      string
+	listener      *net.TCPListener
+	mDNSConn      *net.UDPConn
+	waitGroup     *sync.WaitGroup
+	transferring  int32
+	mutex         sync.Mutex
+	transferTimes []time.Time
+	peerTimes     map[string]time.Time
+	responseTimes map[string]time.Time
+}
+
+// StartLANOffer starts a LAN offer, advertising the offer with mDNS and
+// listening for transfer requests. The offer code, returned by Code, must
+// be shared with the receiving user. Call Stop to stop the offer.
+func StartLANOffer(config *LANOfferConfig) (*LANOffer, error) {
+	offer, err := startLANOffer(config, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return offer, nil
+}
+
+func startLANOffer(config *LANOfferConfig, enableMDNS bool) (*LANOffer, error) {
+
+	if config.GetPayload == nil {
+		return nil, errors.TraceNew("invalid config")
+	}
+
+	secret, err := common.MakeSecureRandomBytes(lanOfferSecretSize)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	instanceID := hex.EncodeToString(prng.Bytes(8))
+	serviceName := getLANOfferServiceName(secret)
+
+	ctx, stopOffer := context.WithCancel(context.Background())
+
+	offer := &LANOffer{
+		config:        config,
+		secret:        secret,
+		ctx:           ctx,
+		stopOffer:     stopOffer,
+		serviceName:   serviceName,
+		instanceName:  instanceID + "." + serviceName,
+		hostName:      instanceID + ".local.",
+		waitGroup:     new(sync.WaitGroup),
+		peerTimes:     make(map[string]time.Time),
+		responseTimes: make(map[string]time.Time),
+	}
+
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{})
+	if err != nil {
+		stopOffer()
+		return nil, errors.Trace(err)
+	}
+	offer.listener = listener
+
+	if enableMDNS {
+		mDNSConn, err := net.ListenMulticastUDP("udp4", nil, mDNSGroupAddress)
+		if err != nil {
+			listener.Close()
+			stopOffer()
+			return nil, errors.Trace(err)
+		}
+		offer.mDNSConn = mDNSConn
+
+		offer.waitGroup.Add(1)
+		go offer.runMDNSResponder()
+	}
+
+	offer.waitGroup.Add(1)
+	go offer.runTransferListener()
+
+	return offer, nil
+}
+
+// Stop stops the LAN offer and waits for any in-progress transfer to
+// complete or fail. Any pending transfer confirmation is cancelled.
+func (offer *LANOffer) Stop() {
+	offer.stopOffer()
+	offer.listener.Close()
+	if offer.mDNSConn != nil {
+		offer.mDNSConn.Close()
+	}
+	offer.waitGroup.Wait()
+}
+
+// Code returns the offer code, which encodes the offer secret. The receiving
+// user must obtain the code out of band, for example by scanning a QR code
+// displayed by the offering app, and pass it to DiscoverLANOffers and
+// ReceiveLANOffer.
+func (offer *LANOffer) Code() string {
+	return LAN_OFFER_CODE_PREFIX + hex.EncodeToString(offer.secret)
+}
+
+func (offer *LANOffer) port() int {
+	return offer.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (offer *LANOffer) runMDNSResponder() {
+	defer offer.waitGroup.Done()
+
+	buffer := make([]byte, 9000)
+
+	for {
+		n, peerAddr, err := offer.mDNSConn.ReadFromUDP(buffer)
+		if err != nil {
+			// The conn is closed by Stop.
+			return
+		}
+
+		query := new(dns.Msg)
+		err = query.Unpack(buffer[:n])
+		if err != nil || query.Response {
+			continue
+		}
+
+		if !offer.allowMDNSResponse(peerAddr.IP) {
+			continue
+		}
+
+		localIP := getLocalIPAddress(peerAddr.IP)
+		if localIP == nil {
+			continue
+		}
+
+		response := offer.makeMDNSResponse(query, localIP)
+		if response == nil {
+			continue
+		}
+
+		packet, err := response.Pack()
+		if err != nil {
+			continue
+		}
+
+		// Responses are always sent by unicast to the querier. The queries
+		// of interest are sent by DiscoverLANOffers from an ephemeral port,
+		// which requires a unicast response. Not multicasting responses
+		// also avoids advertising the offer to the entire network.
+
+		_, _ = offer.mDNSConn.WriteToUDP(packet, peerAddr)
+	}
+}
+
+func (offer *LANOffer) allowMDNSResponse(peerIP net.IP) bool {
+	offer.mutex.Lock()
+	defer offer.mutex.Unlock()
+
+	now := time.Now()
+	key := peerIP.String()
+	if lastTime, ok := offer.responseTimes[key]; ok &&
+		now.Sub(lastTime) < lanOfferMDNSResponseBackoff {
+		return false
+	}
+	for peer, lastTime := range offer.responseTimes {
+		if now.Sub(lastTime) >= lanOfferMDNSResponseBackoff {
+			delete(offer.responseTimes, peer)
+		}
+	}
+	offer.responseTimes[key] = now
+	return true
+}
+
+// makeMDNSResponse returns a response to the query when the query asks for
+// the offer's service type, or nil otherwise. The response contains a PTR
+// record for the offer instance along with additional SRV and A records
+// specifying the transfer listener address.
+func (offer *LANOffer) makeMDNSResponse(query *dns.Msg, localIP net.IP) *dns.Msg {
+
+	matched := false
+	for _, question := range query.Question {
+		if (question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY) &&
+			dns.CanonicalName(question.Name) == offer.serviceName {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil
+	}
+
+	ttl := uint32(120)
+
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Authoritative = true
+
+	response.Answer = []dns.RR{
+		&dns.PTR{
+			Hdr: dns.RR_Header{
+				Name: offer.serviceName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: offer.instanceName,
+		},
+	}
+
+	response.Extra = []dns.RR{
+		&dns.SRV{
+			Hdr: dns.RR_Header{
+				Name: offer.instanceName, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+			Port:   uint16(offer.port()),
+			Target: offer.hostName,
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{
+				Name: offer.hostName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A: localIP.To4(),
+		},
+	}
+
+	return response
+}
+
+func (offer *LANOffer) runTransferListener() {
+	defer offer.waitGroup.Done()
+
+	for {
+		conn, err := offer.listener.AcceptTCP()
+		if err != nil {
+			// The listener is closed by Stop.
+			return
+		}
+
+		// Only one transfer is handled at a time; concurrent requests are
+		// rejected.
+
+		if !atomic.CompareAndSwapInt32(&offer.transferring, 0, 1) {
+			conn.Close()
+			continue
+		}
+
+		offer.waitGroup.Add(1)
+		go func() {
+			defer offer.waitGroup.Done()
+			defer atomic.StoreInt32(&offer.transferring, 0)
+			defer conn.Close()
+			_ = offer.handleTransfer(conn)
+		}()
+	}
+}
+
+// handleTransfer runs the offer side of the transfer protocol:
+//
+//   - the offer sends a random nonce
+//   - the peer sends HMAC(offer secret, nonce)
+//   - the offer sends a 4-byte big-endian length followed by the payload,
+//     sealed with secretbox using a key derived from the offer secret and the
+//     nonce, or closes the connection when the transfer is rejected
+func (offer *LANOffer) handleTransfer(conn *net.TCPConn) error {
+
+	err := conn.SetDeadline(time.Now().Add(lanOfferIOTimeout))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	nonce, err := common.MakeSecureRandomBytes(lanOfferNonceSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = conn.Write(nonce)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	mac := make([]byte, sha256.Size)
+	_, err = io.ReadFull(conn, mac)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if !hmac.Equal(mac, getLANOfferAuthMAC(offer.secret, nonce)) {
+		return errors.TraceNew("invalid peer authentication")
+	}
+
+	peerIP := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+
+	if !offer.allowTransfer(peerIP) {
+		return errors.TraceNew("transfer rate limit exceeded")
+	}
+
+	if offer.config.ConfirmTransfer != nil {
+		confirmTimeout := offer.config.ConfirmTimeout
+		if confirmTimeout == 0 {
+			confirmTimeout = LAN_OFFER_DEFAULT_CONFIRM_TIMEOUT
+		}
+		if !offer.confirmTransfer(peerIP, confirmTimeout) {
+			return errors.TraceNew("transfer not confirmed")
+		}
+		err = conn.SetDeadline(time.Now().Add(lanOfferIOTimeout))
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	payload, err := offer.config.GetPayload()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(payload) == 0 || len(payload) > LAN_OFFER_MAX_PAYLOAD_SIZE {
+		return errors.TraceNew("invalid payload size")
+	}
+
+	// The payload key is unique to each transfer, as the nonce is random, so
+	// a zero secretbox nonce is used.
+
+	key := getLANOfferPayloadKey(offer.secret, nonce)
+	box := secretbox.Seal(nil, []byte(payload), &[24]byte{}, &key)
+
+	message := make([]byte, 4+len(box))
+	binary.BigEndian.PutUint32(message, uint32(len(box)))
+	copy(message[4:], box)
+
+	_, err = conn.Write(message)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// confirmTransfer invokes ConfirmTransfer with a context that's done after
+// the timeout or when the offer is stopped. The transfer isn't confirmed when
+// the context is done first. The ConfirmTransfer call is tracked by the
+// offer wait group, so Stop waits for it to return.
+func (offer *LANOffer) confirmTransfer(
+	peerIP string, timeout time.Duration) bool {
+
+	ctx, cancelFunc := context.WithTimeout(offer.ctx, timeout)
+	defer cancelFunc()
+
+	confirmed := make(chan bool, 1)
+	offer.waitGroup.Add(1)
+	go func() {
+		defer offer.waitGroup.Done()
+		confirmed <- offer.config.ConfirmTransfer(ctx, peerIP)
+	}()
+
+	select {
+	case ok := <-confirmed:
+		return ok && ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// allowTransfer applies the transfer rate limits. The limits are checked,
+// and a transfer counted, before the user is asked to confirm, so that a
+// peer cannot use repeated requests to spam the user with prompts.
+func (offer *LANOffer) allowTransfer(peerIP string) bool {
+	offer.mutex.Lock()
+	defer offer.mutex.Unlock()
+
+	limit := offer.config.TransferLimit
+	if limit == 0 {
+		limit = LAN_OFFER_DEFAULT_TRANSFER_LIMIT
+	}
+	period := offer.config.TransferLimitPeriod
+	if period == 0 {
+		period = LAN_OFFER_DEFAULT_TRANSFER_LIMIT_PERIOD
+	}
+
+	now := time.Now()
+
+	i := 0
+	for ; i < len(offer.transferTimes); i++ {
+		if now.Sub(offer.transferTimes[i]) < period {
+			break
+		}
+	}
+	offer.transferTimes = offer.transferTimes[i:]
+
+	for peer, lastTime := range offer.peerTimes {
+		if now.Sub(lastTime) >= period {
+			delete(offer.peerTimes, peer)
+		}
+	}
+
+	if len(offer.transferTimes) >= limit {
+		return false
+	}
+	if _, ok := offer.peerTimes[peerIP]; ok {
+		return false
+	}
+
+	offer.transferTimes = append(offer.transferTimes, now)
+	offer.peerTimes[peerIP] = now
+	return true
+}
+
+// DiscoverLANOffers sends mDNS queries for the LAN offer with the specified
+// offer code and returns the transfer addresses of all offers that respond
+// before ctx is done. The returned addresses may be passed to
+// ReceiveLANOffer.
+func DiscoverLANOffers(ctx context.Context, offerCode string) ([]string, error) {
+
+	secret, err := parseLANOfferCode(offerCode)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	addresses, err := discoverLANOffers(ctx, secret, mDNSGroupAddress)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return addresses, nil
+}
+
+func discoverLANOffers(
+	ctx context.Context,
+	secret []byte,
+	queryAddr *net.UDPAddr) ([]string, error) {
+
+	serviceName := getLANOfferServiceName(secret)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion(serviceName, dns.TypePTR)
+	query.RecursionDesired = false
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Periodically resend the query, as multicast delivery is unreliable.
+
+	stopSending := make(chan struct{})
+	sendWaitGroup := new(sync.WaitGroup)
+	sendWaitGroup.Add(1)
+	go func() {
+		defer sendWaitGroup.Done()
+		ticker := time.NewTicker(lanOfferDiscoveryInterval)
+		defer ticker.Stop()
+		for {
+			_, _ = conn.WriteToUDP(packet, queryAddr)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-stopSending:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stopSending)
+		sendWaitGroup.Wait()
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stopSending:
+		}
+	}()
+
+	var addresses []string
+	seen := make(map[string]bool)
+
+	buffer := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, errors.Trace(err)
+		}
+
+		response := new(dns.Msg)
+		err = response.Unpack(buffer[:n])
+		if err != nil || !response.Response {
+			continue
+		}
+
+		for _, address := range getLANOfferAddresses(response, serviceName) {
+			if !seen[address] {
+				seen[address] = true
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses, nil
+}
+
+// getLANOfferAddresses extracts transfer addresses from an mDNS response,
+// following PTR, SRV and A records for the specified service.
+func getLANOfferAddresses(response *dns.Msg, serviceName string) []string {
+
+	records := append(append([]dns.RR{}, response.Answer...), response.Extra...)
+
+	srvs := make(map[string]*dns.SRV)
+	ips := make(map[string]net.IP)
+	for _, record := range records {
+		switch r := record.(type) {
+		case *dns.SRV:
+			srvs[dns.CanonicalName(r.Hdr.Name)] = r
+		case *dns.A:
+			ips[dns.CanonicalName(r.Hdr.Name)] = r.A
+		}
+	}
+
+	var addresses []string
+	for _, record := range records {
+		ptr, ok := record.(*dns.PTR)
+		if !ok || dns.CanonicalName(ptr.Hdr.Name) != serviceName {
+			continue
+		}
+		srv, ok := srvs[dns.CanonicalName(ptr.Ptr)]
+		if !ok {
+			continue
+		}
+		ip, ok := ips[dns.CanonicalName(srv.Target)]
+		if !ok {
+			continue
+		}
+		addresses = append(
+			addresses, net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))))
+	}
+
+	return addresses
+}
+
+// ReceiveLANOffer fetches the exchange payload from the LAN offer, with the
+// specified offer code, at the specified address. The transfer blocks while
+// the offering user confirms the transfer, so ctx should allow for that
+// delay. The returned payload should be passed to the exchange import.
+func ReceiveLANOffer(
+	ctx context.Context, offerCode string, address string) (string, error) {
+
+	secret, err := parseLANOfferCode(offerCode)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp4", address)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer conn.Close()
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stopWatching:
+		}
+	}()
+
+	nonce := make([]byte, lanOfferNonceSize)
+	_, err = io.ReadFull(conn, nonce)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	_, err = conn.Write(getLANOfferAuthMAC(secret, nonce))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var length [4]byte
+	_, err = io.ReadFull(conn, length[:])
+	if err != nil {
+		// The offer closes the connection when the transfer is rejected.
+		return "", errors.Trace(err)
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size <= secretbox.Overhead ||
+		size > LAN_OFFER_MAX_PAYLOAD_SIZE+secretbox.Overhead {
+		return "", errors.TraceNew("invalid payload size")
+	}
+
+	box := make([]byte, size)
+	_, err = io.ReadFull(conn, box)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	key := getLANOfferPayloadKey(secret, nonce)
+	payload, ok := secretbox.Open(nil, box, &[24]byte{}, &key)
+	if !ok {
+		return "", errors.TraceNew("invalid payload")
+	}
+
+	return string(payload), nil
+}
+
+func parseLANOfferCode(offerCode string) ([]byte, error) {
+
+	if !strings.HasPrefix(offerCode, LAN_OFFER_CODE_PREFIX) {
+		return nil, errors.TraceNew("invalid offer code")
+	}
+
+	secret, err := hex.DecodeString(
+		strings.TrimPrefix(offerCode, LAN_OFFER_CODE_PREFIX))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(secret) != lanOfferSecretSize {
+		return nil, errors.TraceNew("invalid offer code")
+	}
+
+	return secret, nil
+}
+
+func getLANOfferServiceName(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(lanOfferServiceNameContext))
+	return fmt.Sprintf("_%s._tcp.local.", hex.EncodeToString(mac.Sum(nil))[:12])
+}
+
+func getLANOfferAuthMAC(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(lanOfferAuthContext))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func getLANOfferPayloadKey(secret, nonce []byte) [32]byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(lanOfferPayloadContext))
+	mac.Write(nonce)
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// getLocalIPAddress returns the local IP address used to reach peerIP,
+// which is the address to advertise to that peer. No packets are sent.
+func getLocalIPAddress(peerIP net.IP) net.IP {
+	conn, err := net.DialUDP(
+		"udp4", nil, &net.UDPAddr{IP: peerIP, Port: mDNSGroupAddress.Port})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package exchange
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+func TestLANOffer(t *testing.T) {
+
+	payload := "exchange-payload"
+
+	var confirmCount int32
+	confirm := true
+
+	// mDNS multicast is not used in this test, as multicast may not be
+	// available in the test environment. The transfer is run over loopback
+	// and mDNS message handling is tested directly.
+
+	offer, err := startLANOffer(
+		&LANOfferConfig{
+			GetPayload: func() (string, error) { return payload, nil },
+			ConfirmTransfer: func(_ context.Context, peerIPAddress string) bool {
+				atomic.AddInt32(&confirmCount, 1)
+				return confirm
+			},
+			TransferLimit:       2,
+			TransferLimitPeriod: time.Minute,
+		},
+		false)
+	if err != nil {
+		t.Fatalf("startLANOffer failed: %s", err)
+	}
+	defer offer.Stop()
+
+	offerCode := offer.Code()
+
+	secret, err := parseLANOfferCode(offerCode)
+	if err != nil {
+		t.Fatalf("parseLANOfferCode failed: %s", err)
+	}
+
+	for _, invalidCode := range []string{
+		"",
+		strings.TrimPrefix(offerCode, LAN_OFFER_CODE_PREFIX),
+		offerCode[:len(offerCode)-2],
+		offerCode + "00",
+		LAN_OFFER_CODE_PREFIX + "invalid",
+	} {
+		_, err := parseLANOfferCode(invalidCode)
+		if err == nil {
+			t.Fatalf("parseLANOfferCode unexpected success: %s", invalidCode)
+		}
+	}
+
+	// Each offer has a distinct secret, service type, and code.
+
+	otherOffer, err := startLANOffer(
+		&LANOfferConfig{GetPayload: func() (string, error) { return payload, nil }},
+		false)
+	if err != nil {
+		t.Fatalf("startLANOffer failed: %s", err)
+	}
+	otherOffer.Stop()
+
+	if otherOffer.Code() == offerCode || otherOffer.serviceName == offer.serviceName {
+		t.Fatalf("unexpected identical offers")
+	}
+
+	// Discovery: the offer must answer queries for its service type only.
+
+	localIP := net.ParseIP("192.168.0.2")
+
+	query := new(dns.Msg)
+	query.SetQuestion(getLANOfferServiceName(secret), dns.TypePTR)
+
+	response := offer.makeMDNSResponse(query, localIP)
+	if response == nil {
+		t.Fatalf("makeMDNSResponse failed")
+	}
+
+	packet, err := response.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %s", err)
+	}
+	response = new(dns.Msg)
+	err = response.Unpack(packet)
+	if err != nil {
+		t.Fatalf("Unpack failed: %s", err)
+	}
+
+	addresses := getLANOfferAddresses(response, getLANOfferServiceName(secret))
+	expectedAddress := fmt.Sprintf("192.168.0.2:%d", offer.port())
+	if len(addresses) != 1 || addresses[0] != expectedAddress {
+		t.Fatalf("unexpected addresses: %v", addresses)
+	}
+
+	query.SetQuestion(otherOffer.serviceName, dns.TypePTR)
+	if offer.makeMDNSResponse(query, localIP) != nil {
+		t.Fatalf("unexpected response for other service")
+	}
+
+	// Transfer.
+
+	address := fmt.Sprintf("127.0.0.1:%d", offer.port())
+
+	receive := func(code string) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return ReceiveLANOffer(ctx, code, address)
+	}
+
+	// An unauthenticated peer must be rejected before the user is prompted.
+
+	_, err = receive(otherOffer.Code())
+	if err == nil || atomic.LoadInt32(&confirmCount) != 0 {
+		t.Fatalf("unexpected transfer with invalid key: %v", err)
+	}
+
+	received, err := receive(offerCode)
+	if err != nil {
+		t.Fatalf("ReceiveLANOffer failed: %s", err)
+	}
+	if received != payload {
+		t.Fatalf("unexpected payload: %s", received)
+	}
+
+	// The same peer is limited to one transfer per period.
+
+	_, err = receive(offerCode)
+	if err == nil || atomic.LoadInt32(&confirmCount) != 1 {
+		t.Fatalf("unexpected transfer from same peer: %v", err)
+	}
+
+	// A transfer not confirmed by the user must fail.
+
+	offer.mutex.Lock()
+	offer.peerTimes = make(map[string]time.Time)
+	offer.mutex.Unlock()
+	confirm = false
+
+	_, err = receive(offerCode)
+	if err == nil || atomic.LoadInt32(&confirmCount) != 2 {
+		t.Fatalf("unexpected unconfirmed transfer: %v", err)
+	}
+
+	// The total transfer limit is exceeded.
+
+	offer.mutex.Lock()
+	offer.peerTimes = make(map[string]time.Time)
+	offer.mutex.Unlock()
+	confirm = true
+
+	_, err = receive(offerCode)
+	if err == nil || atomic.LoadInt32(&confirmCount) != 2 {
+		t.Fatalf("unexpected transfer over limit: %v", err)
+	}
+}
+
+func TestLANOfferPayloadEncryption(t *testing.T) {
+
+	payload := "exchange-payload"
+
+	offer, err := startLANOffer(
+		&LANOfferConfig{GetPayload: func() (string, error) { return payload, nil }},
+		false)
+	if err != nil {
+		t.Fatalf("startLANOffer failed: %s", err)
+	}
+	defer offer.Stop()
+
+	secret, err := parseLANOfferCode(offer.Code())
+	if err != nil {
+		t.Fatalf("parseLANOfferCode failed: %s", err)
+	}
+
+	// Run the receiver side of the transfer protocol directly, to capture
+	// the bytes sent on the wire.
+
+	conn, err := net.DialTimeout(
+		"tcp4", fmt.Sprintf("127.0.0.1:%d", offer.port()), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	nonce := make([]byte, lanOfferNonceSize)
+	_, err = io.ReadFull(conn, nonce)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	_, err = conn.Write(getLANOfferAuthMAC(secret, nonce))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	message, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+
+	if len(message) <= 4 {
+		t.Fatalf("unexpected message size: %d", len(message))
+	}
+
+	// The payload must not appear in the clear, and may be opened only with
+	// the key derived from the offer secret.
+
+	if bytes.Contains(message, []byte(payload)) {
+		t.Fatalf("payload sent in the clear")
+	}
+
+	box := message[4:]
+
+	key := getLANOfferPayloadKey(secret, nonce)
+	opened, ok := secretbox.Open(nil, box, &[24]byte{}, &key)
+	if !ok || string(opened) != payload {
+		t.Fatalf("unexpected sealed payload")
+	}
+
+	otherKey := getLANOfferPayloadKey(prng.Bytes(lanOfferSecretSize), nonce)
+	_, ok = secretbox.Open(nil, box, &[24]byte{}, &otherKey)
+	if ok {
+		t.Fatalf("unexpected open with other key")
+	}
+}
+
+func TestLANOfferConfirmTimeout(t *testing.T) {
+
+	var confirmReturned int32
+
+	offer, err := startLANOffer(
+		&LANOfferConfig{
+			GetPayload: func() (string, error) { return "exchange-payload", nil },
+			ConfirmTransfer: func(ctx context.Context, peerIPAddress string) bool {
+				// Simulate a user who doesn't respond to the prompt.
+				<-ctx.Done()
+				atomic.AddInt32(&confirmReturned, 1)
+				return true
+			},
+			ConfirmTimeout: 100 * time.Millisecond,
+		},
+		false)
+	if err != nil {
+		t.Fatalf("startLANOffer failed: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = ReceiveLANOffer(
+		ctx, offer.Code(), fmt.Sprintf("127.0.0.1:%d", offer.port()))
+	if err == nil {
+		t.Fatalf("unexpected transfer after confirm timeout")
+	}
+
+	// The confirmation is cancelled, and Stop waits for it to return, so no
+	// goroutine remains.
+
+	offer.Stop()
+
+	if atomic.LoadInt32(&confirmReturned) != 1 {
+		t.Fatalf("confirmation not cancelled")
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package exchange implements transports for the client-to-client server
+// entry exchange payload: QR code frames, for camera-to-camera transfer, and
+// LAN offers, for transfer between peers on the same local network.
+package exchange
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+const (
+	QR_FRAME_PREFIX            = "PSX1"
+	QR_FRAME_DEFAULT_DATA_SIZE = 256
+	QR_FRAME_MIN_DATA_SIZE     = 16
+	QR_FRAME_MAX_FRAMES        = 999
+	qrFrameTransferIDSize      = 8
+)
+
+// EncodeQRFrames splits an exchange payload into a sequence of text frames,
+// each small enough to be rendered as a single QR code. The sender displays
+// the frames in a loop, and the receiver scans frames, in any order, until
+// QRFrameAssembler reports that the payload is complete.
+//
+// Each frame has the form:
+//
+//	PSX1:<transfer ID>:<index>/<count>:<CRC32>:<data>
+//
+// The transfer ID is a prefix of the SHA-256 digest of the payload, which
+// identifies the transfer and is used to verify the reassembled payload. The
+// CRC32 checksum covers the frame data and detects scan errors not corrected
+// by the QR code error correction.
+//
+// maxDataSize is the maximum frame data size; when 0,
+// QR_FRAME_DEFAULT_DATA_SIZE is used.
+func EncodeQRFrames(payload string, maxDataSize int) ([]string, error) {
+
+	if maxDataSize == 0 {
+		maxDataSize = QR_FRAME_DEFAULT_DATA_SIZE
+	}
+	if maxDataSize < QR_FRAME_MIN_DATA_SIZE {
+		return nil, errors.TraceNew("invalid frame data size")
+	}
+
+	if len(payload) == 0 {
+		return nil, errors.TraceNew("missing payload")
+	}
+
+	count := (len(payload) + maxDataSize - 1) / maxDataSize
+	if count > QR_FRAME_MAX_FRAMES {
+		return nil, errors.TraceNew("payload too large")
+	}
+
+	transferID := getQRFrameTransferID(payload)
+
+	frames := make([]string, count)
+
+	for i := 0; i < count; i++ {
+
+		end := (i + 1) * maxDataSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		data := payload[i*maxDataSize : end]
+
+		frames[i] = fmt.Sprintf(
+			"%s:%s:%d/%d:%08x:%s",
+			QR_FRAME_PREFIX,
+			transferID,
+			i+1,
+			count,
+			crc32.ChecksumIEEE([]byte(data)),
+			data)
+	}
+
+	return frames, nil
+}
+
+func getQRFrameTransferID(payload string) string {
+	digest := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(digest[:qrFrameTransferIDSize])
+}
+
+// QRFrameAssembler reassembles an exchange payload from frames created by
+// EncodeQRFrames. QRFrameAssembler is safe for concurrent use.
+type QRFrameAssembler struct {
+	mutex      sync.Mutex
+	transferID string
+	frames     []string
+	received   int
+}
+
+// NewQRFrameAssembler creates a new QRFrameAssembler.
+func NewQRFrameAssembler() *QRFrameAssembler {
+	return &QRFrameAssembler{}
+}
+
+// AddFrame adds a scanned frame and returns true when all frames have been
+// received. Duplicate frames are ignored, so the receiver may simply add
+// every frame it scans.
+//
+// When a frame from a different transfer is added, the assembler discards
+// any frames received so far and starts assembling the new transfer. This
+// handles the case where the user switches to scanning a different sender.
+//
+// A frame that's malformed or fails its checksum is rejected with an error;
+// the receiver should continue scanning.
+func (assembler *QRFrameAssembler) AddFrame(frame string) (bool, error) {
+
+	transferID, index, count, data, err := parseQRFrame(frame)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	assembler.mutex.Lock()
+	defer assembler.mutex.Unlock()
+
+	if transferID != assembler.transferID || count != len(assembler.frames) {
+		assembler.transferID = transferID
+		assembler.frames = make([]string, count)
+		assembler.received = 0
+	}
+
+	if assembler.frames[index-1] == "" {
+		assembler.frames[index-1] = data
+		assembler.received += 1
+	}
+
+	return assembler.received == len(assembler.frames), nil
+}
+
+// Progress returns the number of distinct frames received and the total
+// number of frames in the current transfer. Both values are 0 before any
+// frame is added.
+func (assembler *QRFrameAssembler) Progress() (int, int) {
+	assembler.mutex.Lock()
+	defer assembler.mutex.Unlock()
+
+	return assembler.received, len(assembler.frames)
+}
+
+// Payload returns the reassembled payload, once all frames have been
+// received. The payload is verified against the transfer ID.
+func (assembler *QRFrameAssembler) Payload() (string, error) {
+	assembler.mutex.Lock()
+	defer assembler.mutex.Unlock()
+
+	if len(assembler.frames) == 0 ||
+		assembler.received != len(assembler.frames) {
+		return "", errors.TraceNew("incomplete payload")
+	}
+
+	payload := strings.Join(assembler.frames, "")
+
+	if getQRFrameTransferID(payload) != assembler.transferID {
+		return "", errors.TraceNew("invalid payload digest")
+	}
+
+	return payload, nil
+}
+
+func parseQRFrame(frame string) (string, int, int, string, error) {
+
+	fields := strings.SplitN(frame, ":", 5)
+	if len(fields) != 5 || fields[0] != QR_FRAME_PREFIX {
+		return "", 0, 0, "", errors.TraceNew("invalid frame")
+	}
+
+	transferID := fields[1]
+	if len(transferID) != qrFrameTransferIDSize*2 {
+		return "", 0, 0, "", errors.TraceNew("invalid frame transfer ID")
+	}
+
+	position := strings.SplitN(fields[2], "/", 2)
+	if len(position) != 2 {
+		return "", 0, 0, "", errors.TraceNew("invalid frame position")
+	}
+	index, err := strconv.Atoi(position[0])
+	if err != nil {
+		return "", 0, 0, "", errors.Trace(err)
+	}
+	count, err := strconv.Atoi(position[1])
+	if err != nil {
+		return "", 0, 0, "", errors.Trace(err)
+	}
+	if count < 1 || count > QR_FRAME_MAX_FRAMES || index < 1 || index > count {
+		return "", 0, 0, "", errors.TraceNew("invalid frame position")
+	}
+
+	checksum, err := strconv.ParseUint(fields[3], 16, 32)
+	if err != nil {
+		return "", 0, 0, "", errors.Trace(err)
+	}
+
+	data := fields[4]
+	if len(data) == 0 || crc32.ChecksumIEEE([]byte(data)) != uint32(checksum) {
+		return "", 0, 0, "", errors.TraceNew("invalid frame checksum")
+	}
+
+	return transferID, index, count, data, nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package exchange
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+)
+
+func TestQRFrames(t *testing.T) {
+
+	payload := base64.StdEncoding.EncodeToString(prng.Bytes(1500))
+
+	frames, err := EncodeQRFrames(payload, 100)
+	if err != nil {
+		t.Fatalf("EncodeQRFrames failed: %s", err)
+	}
+
+	if len(frames) != (len(payload)+99)/100 {
+		t.Fatalf("unexpected frame count: %d", len(frames))
+	}
+
+	assembler := NewQRFrameAssembler()
+
+	// A corrupt frame must be rejected without affecting the transfer.
+
+	corruptFrame := []byte(frames[0])
+	corruptFrame[len(corruptFrame)-1] ^= 1
+	_, err = assembler.AddFrame(string(corruptFrame))
+	if err == nil {
+		t.Fatalf("AddFrame unexpectedly accepted corrupt frame")
+	}
+
+	// A frame from another transfer is discarded when the transfer changes.
+
+	otherFrames, err := EncodeQRFrames(strings.Repeat("x", 500), 100)
+	if err != nil {
+		t.Fatalf("EncodeQRFrames failed: %s", err)
+	}
+	_, err = assembler.AddFrame(otherFrames[0])
+	if err != nil {
+		t.Fatalf("AddFrame failed: %s", err)
+	}
+
+	// Add frames out of order, with duplicates.
+
+	perm := prng.Perm(len(frames))
+	for i, j := range perm {
+		complete, err := assembler.AddFrame(frames[j])
+		if err != nil {
+			t.Fatalf("AddFrame failed: %s", err)
+		}
+		if i%2 == 0 {
+			_, err = assembler.AddFrame(frames[j])
+			if err != nil {
+				t.Fatalf("AddFrame failed: %s", err)
+			}
+		}
+		received, total := assembler.Progress()
+		if received != i+1 || total != len(frames) {
+			t.Fatalf("unexpected progress: %d/%d", received, total)
+		}
+		if complete != (i == len(perm)-1) {
+			t.Fatalf("unexpected complete: %v", complete)
+		}
+		if !complete {
+			_, err = assembler.Payload()
+			if err == nil {
+				t.Fatalf("Payload unexpectedly succeeded")
+			}
+		}
+	}
+
+	assembledPayload, err := assembler.Payload()
+	if err != nil {
+		t.Fatalf("Payload failed: %s", err)
+	}
+
+	if assembledPayload != payload {
+		t.Fatalf("unexpected payload")
+	}
+
+	_, err = EncodeQRFrames(strings.Repeat("x", QR_FRAME_MAX_FRAMES*16+1), 16)
+	if err == nil {
+		t.Fatalf("EncodeQRFrames unexpectedly succeeded")
+	}
+}
@@ -120,6 +120,13 @@ const (
 //
 // seedHistory and irregularLogger are optional ObfuscatorConfig parameters
 // used only in OBFUSCATION_CONN_MODE_SERVER.
+//
+// probeResponse and onProbeResponse are optional and used only in
+// OBFUSCATION_CONN_MODE_SERVER. When probeResponse is set, a peer that fails
+// the seed message checks receives the configured probe response instead of
+// the default discard behavior. onProbeResponse, when set, is called before
+// the probe response starts, allowing the caller to release resources and
+// cancel timeouts which would otherwise cut the probe response short.
 func NewObfuscatedSSHConn(
 	mode ObfuscatedSSHConnMode,
 	conn net.Conn,
@@ -130,7 +137,9 @@ func NewObfuscatedSSHConn(
 	irregularLogger func(
 		clientIP string,
 		err error,
-		logFields common.LogFields)) (*ObfuscatedSSHConn, error) {
+		logFields common.LogFields),
+	probeResponse *ProbeResponseConfig,
+	onProbeResponse func()) (*ObfuscatedSSHConn, error) {
 
 	var err error
 	var obfuscator *Obfuscator
@@ -152,17 +161,51 @@ func NewObfuscatedSSHConn(
 		writeObfuscate = obfuscator.ObfuscateClientToServer
 		writeState = OBFUSCATION_WRITE_STATE_CLIENT_SEND_SEED_MESSAGE
 	} else {
+		// When a probe response is configured, record the seed message bytes
+		// so they may be forwarded to any decoy service.
+		var clientReader io.Reader = conn
+		var recorder *probeRecorder
+		if probeResponse != nil {
+			recorder = newProbeRecorder(conn)
+			clientReader = recorder
+		}
+
 		// NewServerObfuscator reads a seed message from conn
 		obfuscator, err = NewServerObfuscator(
 			&ObfuscatorConfig{
 				Keyword:         obfuscationKeyword,
 				SeedHistory:     seedHistory,
 				IrregularLogger: irregularLogger,
+				ProbeResponse:   probeResponse,
 			},
 			common.IPAddressFromAddr(conn.RemoteAddr()),
-			conn)
+			clientReader)
 		if err != nil {
 
+			// Only peers that fail the seed message checks receive the probe
+			// response. Other errors, such as network I/O failures, are not a
+			// reliable indicator of a probe.
+			if probeResponse != nil && isSeedMessageCheckError(err) {
+
+				if onProbeResponse != nil {
+					onProbeResponse()
+				}
+
+				// When the recorded bytes are truncated, they can't be
+				// relayed to a decoy service as the stream sent by the peer,
+				// so the default discard behavior is used instead.
+				if recorder.truncated && probeResponse.DecoyAddress != "" {
+					io.Copy(ioutil.Discard, conn)
+					return nil, errors.Trace(err)
+				}
+
+				// Errors are not returned, as the seed message error is
+				// the relevant outcome for the caller.
+				_ = RespondToProbe(probeResponse, conn, recorder.buffer)
+
+				return nil, errors.Trace(err)
+			}
+
 			// Obfuscated SSH protocol spec:
 			// "If these checks fail the server will continue reading and discarding all data
 			// until the client closes the connection without sending anything in response."
@@ -213,6 +256,8 @@ func NewClientObfuscatedSSHConn(
 		obfuscationPaddingPRNGSeed,
 		minPadding, maxPadding,
 		nil,
+		nil,
+		nil,
 		nil)
 }
 
@@ -225,7 +270,9 @@ func NewServerObfuscatedSSHConn(
 	irregularLogger func(
 		clientIP string,
 		err error,
-		logFields common.LogFields)) (*ObfuscatedSSHConn, error) {
+		logFields common.LogFields),
+	probeResponse *ProbeResponseConfig,
+	onProbeResponse func()) (*ObfuscatedSSHConn, error) {
 
 	return NewObfuscatedSSHConn(
 		OBFUSCATION_CONN_MODE_SERVER,
@@ -234,7 +281,9 @@ func NewServerObfuscatedSSHConn(
 		nil,
 		nil, nil,
 		seedHistory,
-		irregularLogger)
+		irregularLogger,
+		probeResponse,
+		onProbeResponse)
 }
 
 // GetDerivedPRNG creates a new PRNG with a seed derived from the
@@ -72,6 +72,13 @@ type ObfuscatorConfig struct {
 	SeedHistory       *SeedHistory
 	StrictHistoryMode bool
 	IrregularLogger   func(clientIP string, err error, logFields common.LogFields)
+
+	// ProbeResponse is an optional parameter used only by server
+	// obfuscators. When set, irregular events for peers that fail the seed
+	// message checks are logged with the probe response type, recording
+	// that the probe is diverted. The probe response itself is performed
+	// by the caller; see NewObfuscatedSSHConn.
+	ProbeResponse *ProbeResponseConfig
 }
 
 // NewClientObfuscator creates a new Obfuscator, staging a seed message to be
@@ -314,14 +321,18 @@ func readSeedMessage(
 		errStr := "duplicate obfuscation seed"
 		if duplicateLogFields != nil {
 			if config.IrregularLogger != nil {
+				logFields := *duplicateLogFields
+				if !ok {
+					logFields = addProbeResponseLogField(config.ProbeResponse, logFields)
+				}
 				config.IrregularLogger(
 					clientIP,
 					errors.BackTraceNew(errBackTrace, errStr),
-					*duplicateLogFields)
+					logFields)
 			}
 		}
 		if !ok {
-			return nil, nil, nil, errors.TraceNew(errStr)
+			return nil, nil, nil, errors.Trace(newSeedMessageCheckError(errStr))
 		}
 	}
 
@@ -370,9 +381,9 @@ func readSeedMessage(
 			config.IrregularLogger(
 				clientIP,
 				errors.BackTraceNew(errBackTrace, errStr),
-				nil)
+				addProbeResponseLogField(config.ProbeResponse, nil))
 		}
-		return nil, nil, nil, errors.TraceNew(errStr)
+		return nil, nil, nil, errors.Trace(newSeedMessageCheckError(errStr))
 	}
 
 	padding := make([]byte, paddingLength)
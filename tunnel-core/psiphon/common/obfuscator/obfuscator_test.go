@@ -191,7 +191,9 @@ func TestObfuscatedSSHConn(t *testing.T) {
 				NewSeedHistory(nil),
 				func(_ string, err error, logFields common.LogFields) {
 					t.Logf("IrregularLogger: %s %+v", err, logFields)
-				})
+				},
+				nil,
+				nil)
 		}
 
 		if err == nil {
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package obfuscator
+
+import (
+	std_errors "errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+const (
+	PROBE_RESPONSE_DECOY          = "decoy"
+	PROBE_RESPONSE_MIMIC          = "mimic"
+	PROBE_RESPONSE_DIAL_TIMEOUT   = 5 * time.Second
+	PROBE_RESPONSE_MAX_BUFFERED   = OBFUSCATE_SEED_LENGTH + 8 + OBFUSCATE_MAX_PADDING
+	PROBE_RESPONSE_LOG_FIELD_NAME = "probe_response"
+)
+
+// ProbeResponseConfig specifies how a server responds to a peer that fails
+// the obfuscator seed message checks, as an active prober will. By default,
+// the server reads and discards all data until the peer disconnects or a
+// handshake timeout is reached, a behavior which may itself be a
+// fingerprint. A ProbeResponseConfig replaces that default with either a
+// decoy service or a mimic of another server's close behavior.
+type ProbeResponseConfig struct {
+
+	// DecoyAddress is a TCP host:port address. When set, all bytes received
+	// from the peer, including the bytes consumed by the seed message
+	// checks, are relayed to the decoy service, and the decoy service's
+	// responses are relayed back to the peer. The peer connection is closed
+	// when the decoy service closes its connection.
+	//
+	// When the decoy service can't be reached, or when the bytes consumed by
+	// the seed message checks exceed PROBE_RESPONSE_MAX_BUFFERED and can't
+	// all be relayed, the default discard behavior is used.
+	DecoyAddress string
+
+	// CloseAfterBytes, CloseAfterIdleMilliseconds, and
+	// CloseAfterMilliseconds are used when DecoyAddress is not set, and
+	// specify when to close the peer connection. Data received from the peer
+	// is discarded. Configure these to match a chosen server, such as a web
+	// server that closes after receiving an invalid request line of a
+	// certain size or after an idle timeout.
+	//
+	// CloseAfterBytes is the number of peer bytes, counting the bytes
+	// consumed by the seed message checks, after which the connection is
+	// closed. CloseAfterIdleMilliseconds is the read idle timeout, and
+	// CloseAfterMilliseconds the total connection lifetime timeout, after
+	// which the connection is closed. Any value may be 0, which disables
+	// the corresponding condition; at least one value must be set.
+	CloseAfterBytes            int
+	CloseAfterIdleMilliseconds int
+	CloseAfterMilliseconds     int
+}
+
+// Validate checks that the ProbeResponseConfig is well-formed.
+func (config *ProbeResponseConfig) Validate() error {
+
+	if config.DecoyAddress != "" {
+
+		if config.CloseAfterBytes != 0 ||
+			config.CloseAfterIdleMilliseconds != 0 ||
+			config.CloseAfterMilliseconds != 0 {
+			return errors.TraceNew("unexpected close values with decoy address")
+		}
+
+		_, _, err := net.SplitHostPort(config.DecoyAddress)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	}
+
+	if config.CloseAfterBytes < 0 ||
+		config.CloseAfterIdleMilliseconds < 0 ||
+		config.CloseAfterMilliseconds < 0 {
+		return errors.TraceNew("invalid close values")
+	}
+
+	if config.CloseAfterBytes == 0 &&
+		config.CloseAfterIdleMilliseconds == 0 &&
+		config.CloseAfterMilliseconds == 0 {
+		return errors.TraceNew("missing close values")
+	}
+
+	return nil
+}
+
+// ResponseType returns PROBE_RESPONSE_DECOY or PROBE_RESPONSE_MIMIC,
+// indicating which response is configured. The value is recorded in
+// irregular tunnel logs for diverted probes.
+func (config *ProbeResponseConfig) ResponseType() string {
+	if config.DecoyAddress != "" {
+		return PROBE_RESPONSE_DECOY
+	}
+	return PROBE_RESPONSE_MIMIC
+}
+
+// RespondToProbe performs the configured probe response on conn. received
+// are the bytes already read from conn, which are forwarded to any decoy
+// service. RespondToProbe blocks until the response is complete, and the
+// caller is responsible for closing conn.
+func RespondToProbe(
+	config *ProbeResponseConfig, conn net.Conn, received []byte) error {
+
+	if config.DecoyAddress != "" {
+
+		decoyConn, err := net.DialTimeout(
+			"tcp", config.DecoyAddress, PROBE_RESPONSE_DIAL_TIMEOUT)
+		if err != nil {
+
+			// Fall back to the default behavior.
+			_, _ = io.Copy(ioutil.Discard, conn)
+
+			return errors.Trace(err)
+		}
+		defer decoyConn.Close()
+
+		_, err = decoyConn.Write(received)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Relay until either the peer or the decoy service closes, then
+		// interrupt the other relay direction.
+
+		var waitGroup sync.WaitGroup
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			_, _ = io.Copy(conn, decoyConn)
+			conn.Close()
+		}()
+
+		_, _ = io.Copy(decoyConn, conn)
+		decoyConn.Close()
+
+		waitGroup.Wait()
+
+		return nil
+	}
+
+	count := len(received)
+
+	var deadline time.Time
+	if config.CloseAfterMilliseconds > 0 {
+		deadline = time.Now().Add(
+			time.Duration(config.CloseAfterMilliseconds) * time.Millisecond)
+	}
+
+	buffer := make([]byte, 4096)
+
+	for config.CloseAfterBytes <= 0 || count < config.CloseAfterBytes {
+
+		readDeadline := deadline
+		if config.CloseAfterIdleMilliseconds > 0 {
+			idleDeadline := time.Now().Add(
+				time.Duration(config.CloseAfterIdleMilliseconds) * time.Millisecond)
+			if readDeadline.IsZero() || idleDeadline.Before(readDeadline) {
+				readDeadline = idleDeadline
+			}
+		}
+
+		err := conn.SetReadDeadline(readDeadline)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		n, err := conn.Read(buffer)
+		count += n
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// seedMessageCheckError is the error returned by NewServerObfuscator when the
+// peer fails the seed message checks, as opposed to, for example, a network
+// I/O failure while reading the seed message.
+type seedMessageCheckError struct {
+	message string
+}
+
+func newSeedMessageCheckError(message string) error {
+	return &seedMessageCheckError{message: message}
+}
+
+func (e *seedMessageCheckError) Error() string {
+	return e.message
+}
+
+// isSeedMessageCheckError indicates whether err, or any error it wraps, is a
+// seedMessageCheckError.
+func isSeedMessageCheckError(err error) bool {
+	var checkErr *seedMessageCheckError
+	return std_errors.As(err, &checkErr)
+}
+
+// probeRecorder records bytes read from the peer while the seed message is
+// checked, so that they may be forwarded to a decoy service.
+//
+// Once a read would exceed PROBE_RESPONSE_MAX_BUFFERED, truncated is set and
+// no further bytes are recorded, so buffer is always a contiguous prefix of
+// the bytes read from the peer.
+type probeRecorder struct {
+	reader    io.Reader
+	buffer    []byte
+	truncated bool
+}
+
+func newProbeRecorder(reader io.Reader) *probeRecorder {
+	return &probeRecorder{reader: reader}
+}
+
+func (r *probeRecorder) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 && !r.truncated {
+		if len(r.buffer)+n <= PROBE_RESPONSE_MAX_BUFFERED {
+			r.buffer = append(r.buffer, p[:n]...)
+		} else {
+			r.truncated = true
+		}
+	}
+	return n, err
+}
+
+// addProbeResponseLogField adds the probe response type to irregular tunnel
+// log fields, recording that the probe was diverted.
+func addProbeResponseLogField(
+	config *ProbeResponseConfig, logFields common.LogFields) common.LogFields {
+
+	if config == nil {
+		return logFields
+	}
+	if logFields == nil {
+		logFields = make(common.LogFields)
+	}
+	logFields[PROBE_RESPONSE_LOG_FIELD_NAME] = config.ResponseType()
+	return logFields
+}
@@ -0,0 +1,308 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package obfuscator
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+)
+
+func TestProbeResponse(t *testing.T) {
+
+	probe := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	// Decoy service echoes its input.
+
+	decoyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer decoyListener.Close()
+
+	go func() {
+		for {
+			conn, err := decoyListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buffer := make([]byte, len(probe))
+				_, err := io.ReadFull(conn, buffer)
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(buffer)
+			}()
+		}
+	}()
+
+	t.Run("decoy", func(t *testing.T) {
+
+		config := &ProbeResponseConfig{
+			DecoyAddress: decoyListener.Addr().String(),
+		}
+
+		response, logFields := runProbeResponse(t, config, probe)
+
+		if !bytes.Equal(response, probe) {
+			t.Fatalf("unexpected response: %s", string(response))
+		}
+
+		if logFields[PROBE_RESPONSE_LOG_FIELD_NAME] != PROBE_RESPONSE_DECOY {
+			t.Fatalf("unexpected log fields: %+v", logFields)
+		}
+	})
+
+	t.Run("mimic", func(t *testing.T) {
+
+		config := &ProbeResponseConfig{
+			CloseAfterIdleMilliseconds: 100,
+		}
+
+		startTime := time.Now()
+
+		response, logFields := runProbeResponse(t, config, probe)
+
+		if len(response) != 0 {
+			t.Fatalf("unexpected response: %s", string(response))
+		}
+
+		if time.Since(startTime) > 5*time.Second {
+			t.Fatalf("unexpected close time")
+		}
+
+		if logFields[PROBE_RESPONSE_LOG_FIELD_NAME] != PROBE_RESPONSE_MIMIC {
+			t.Fatalf("unexpected log fields: %+v", logFields)
+		}
+	})
+
+	t.Run("network error", func(t *testing.T) {
+
+		// A peer that disconnects before sending a complete seed message
+		// doesn't fail the seed message checks, and receives no probe
+		// response.
+
+		config := &ProbeResponseConfig{
+			DecoyAddress: decoyListener.Addr().String(),
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		defer listener.Close()
+
+		probeResponded := int32(0)
+		irregularLogged := int32(0)
+		serverErr := make(chan error, 1)
+
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			defer conn.Close()
+
+			_, err = NewServerObfuscatedSSHConn(
+				conn,
+				prng.HexString(32),
+				NewSeedHistory(nil),
+				func(_ string, _ error, _ common.LogFields) {
+					atomic.StoreInt32(&irregularLogged, 1)
+				},
+				config,
+				func() {
+					atomic.StoreInt32(&probeResponded, 1)
+				})
+			serverErr <- err
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+
+		_, err = conn.Write(probe[:OBFUSCATE_SEED_LENGTH/2])
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		conn.Close()
+
+		err = <-serverErr
+		if err == nil {
+			t.Fatalf("unexpected NewServerObfuscatedSSHConn success")
+		}
+
+		if atomic.LoadInt32(&probeResponded) != 0 {
+			t.Fatalf("unexpected probe response")
+		}
+
+		if atomic.LoadInt32(&irregularLogged) != 0 {
+			t.Fatalf("unexpected irregular log")
+		}
+	})
+
+	t.Run("truncated recording", func(t *testing.T) {
+
+		// A read that exceeds the buffer limit stops all further recording,
+		// including of subsequent, smaller reads.
+
+		first := prng.Bytes(OBFUSCATE_SEED_LENGTH)
+		second := prng.Bytes(PROBE_RESPONSE_MAX_BUFFERED)
+		third := prng.Bytes(1)
+
+		recorder := newProbeRecorder(
+			io.MultiReader(
+				bytes.NewReader(first),
+				bytes.NewReader(second),
+				bytes.NewReader(third)))
+
+		// Each Read returns one whole chunk.
+
+		buffer := make([]byte, 2*PROBE_RESPONSE_MAX_BUFFERED)
+		received := 0
+		for {
+			n, err := recorder.Read(buffer)
+			received += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Read failed: %s", err)
+			}
+		}
+
+		if received != len(first)+len(second)+len(third) {
+			t.Fatalf("unexpected received length: %d", received)
+		}
+
+		if !recorder.truncated {
+			t.Fatalf("expected truncated recording")
+		}
+
+		if !bytes.Equal(recorder.buffer, first) {
+			t.Fatalf("unexpected recorded bytes: %d", len(recorder.buffer))
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+
+		for _, config := range []*ProbeResponseConfig{
+			{},
+			{DecoyAddress: "127.0.0.1"},
+			{DecoyAddress: "127.0.0.1:80", CloseAfterBytes: 1},
+			{CloseAfterBytes: -1},
+		} {
+			if config.Validate() == nil {
+				t.Fatalf("unexpected valid config: %+v", config)
+			}
+		}
+	})
+}
+
+func runProbeResponse(
+	t *testing.T,
+	config *ProbeResponseConfig,
+	probe []byte) ([]byte, common.LogFields) {
+
+	err := config.Validate()
+	if err != nil {
+		t.Fatalf("Validate failed: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	logFieldsChannel := make(chan common.LogFields, 1)
+	probeResponseChannel := make(chan struct{}, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, err = NewServerObfuscatedSSHConn(
+			conn,
+			prng.HexString(32),
+			NewSeedHistory(nil),
+			func(_ string, _ error, logFields common.LogFields) {
+				logFieldsChannel <- logFields
+			},
+			config,
+			func() {
+				probeResponseChannel <- struct{}{}
+			})
+		if err == nil {
+			t.Errorf("unexpected NewServerObfuscatedSSHConn success")
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(probe)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatalf("SetReadDeadline failed: %s", err)
+	}
+
+	// The server closes the connection when the probe response completes.
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+
+	select {
+	case <-probeResponseChannel:
+	default:
+		t.Fatalf("missing probe response callback")
+	}
+
+	var logFields common.LogFields
+	select {
+	case logFields = <-logFieldsChannel:
+	default:
+		t.Fatalf("missing irregular log")
+	}
+
+	return response, logFields
+}
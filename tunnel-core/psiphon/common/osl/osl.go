@@ -1227,6 +1227,63 @@ func (keyShares *KeyShares) reassembleKey(lookup SLOKLookup, unboxKey bool) (boo
 	return true, joinedKey, nil
 }
 
+// KeySharesProgress describes progress towards reassembling the key for
+// a KeyShares tree node. Held is the number of shares for which the key
+// is available: either a stored SLOK, for SLOK shares; or a child node
+// with sufficient shares, for nested key shares. The key for the node
+// may be reassembled when Held is at least Threshold.
+type KeySharesProgress struct {
+	Threshold   int
+	Total       int
+	Held        int
+	HeldSLOKIDs [][]byte             `json:",omitempty"`
+	KeyShares   []*KeySharesProgress `json:",omitempty"`
+}
+
+// IsUnlocked indicates whether there are sufficient shares to reassemble
+// the key.
+func (progress *KeySharesProgress) IsUnlocked() bool {
+	return progress.Held >= progress.Threshold
+}
+
+// GetProgress recursively traverses a KeyShares tree and reports, for
+// each node, how many shares are held against the threshold. Unlike
+// reassembleKey, GetProgress counts all held shares and not only the
+// shares required to meet the threshold. No keys are derived.
+func (keyShares *KeyShares) GetProgress(lookup SLOKLookup) (*KeySharesProgress, error) {
+
+	if (len(keyShares.SLOKIDs) > 0 && len(keyShares.KeyShares) > 0) ||
+		(len(keyShares.SLOKIDs) > 0 && len(keyShares.SLOKIDs) != len(keyShares.BoxedShares)) ||
+		(len(keyShares.KeyShares) > 0 && len(keyShares.KeyShares) != len(keyShares.BoxedShares)) {
+		return nil, errors.TraceNew("unexpected KeyShares format")
+	}
+
+	progress := &KeySharesProgress{
+		Threshold: keyShares.Threshold,
+		Total:     len(keyShares.BoxedShares),
+	}
+
+	for _, slokID := range keyShares.SLOKIDs {
+		if lookup(slokID) != nil {
+			progress.Held += 1
+			progress.HeldSLOKIDs = append(progress.HeldSLOKIDs, slokID)
+		}
+	}
+
+	for _, childKeyShares := range keyShares.KeyShares {
+		childProgress, err := childKeyShares.GetProgress(lookup)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if childProgress.IsUnlocked() {
+			progress.Held += 1
+		}
+		progress.KeyShares = append(progress.KeyShares, childProgress)
+	}
+
+	return progress, nil
+}
+
 // GetOSLRegistryURL returns the URL for an OSL registry. Clients
 // call this when fetching the registry from out-of-band
 // distribution sites.
@@ -1293,14 +1350,15 @@ type RegistryStreamer struct {
 	lookup      SLOKLookup
 }
 
-// NewRegistryStreamer creates a new RegistryStreamer.
+// NewRegistryStreamer creates a new RegistryStreamer. The registry is
+// authenticated using the trusted signingPublicKeys.
 func NewRegistryStreamer(
 	registryFileContent io.ReadSeeker,
-	signingPublicKey string,
+	signingPublicKeys *common.AuthenticatedDataPackageKeys,
 	lookup SLOKLookup) (*RegistryStreamer, error) {
 
-	payloadReader, err := common.NewAuthenticatedDataPackageReader(
-		registryFileContent, signingPublicKey)
+	payloadReader, err := common.NewAuthenticatedDataPackageReaderWithKeys(
+		registryFileContent, signingPublicKeys)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -1355,46 +1413,66 @@ func NewRegistryStreamer(
 func (s *RegistryStreamer) Next() (*OSLFileSpec, error) {
 
 	for {
-		if s.jsonDecoder.More() {
-
-			var fileSpec OSLFileSpec
-			err := s.jsonDecoder.Decode(&fileSpec)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
+		fileSpec, err := s.NextFileSpec()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 
-			ok, _, err := fileSpec.KeyShares.reassembleKey(s.lookup, false)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
+		if fileSpec == nil {
+			return nil, nil
+		}
 
-			if ok {
-				return &fileSpec, nil
-			}
+		ok, _, err := fileSpec.KeyShares.reassembleKey(s.lookup, false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 
-		} else {
+		if ok {
+			return fileSpec, nil
+		}
+	}
+}
 
-			// Expect the end of the FileSpecs array.
-			err := expectJSONDelimiter(s.jsonDecoder, "]")
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
+// NextFileSpec returns the next OSL file spec in the registry,
+// whether or not the client has sufficient SLOKs to decrypt it.
+// NextFileSpec is used to inspect seeding progress; see
+// KeyShares.GetProgress. NextFileSpec returns nil at EOF.
+func (s *RegistryStreamer) NextFileSpec() (*OSLFileSpec, error) {
 
-			// Expect the end of the Registry object.
-			err = expectJSONDelimiter(s.jsonDecoder, "}")
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
+	if s.jsonDecoder.More() {
 
-			// Expect the end of the registry content.
-			_, err = s.jsonDecoder.Token()
-			if err != io.EOF {
-				return nil, errors.Trace(err)
-			}
+		var fileSpec OSLFileSpec
+		err := s.jsonDecoder.Decode(&fileSpec)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 
-			return nil, nil
+		if fileSpec.KeyShares == nil {
+			return nil, errors.TraceNew("missing KeyShares")
 		}
+
+		return &fileSpec, nil
+	}
+
+	// Expect the end of the FileSpecs array.
+	err := expectJSONDelimiter(s.jsonDecoder, "]")
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
+
+	// Expect the end of the Registry object.
+	err = expectJSONDelimiter(s.jsonDecoder, "}")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Expect the end of the registry content.
+	_, err = s.jsonDecoder.Token()
+	if err != io.EOF {
+		return nil, errors.Trace(err)
+	}
+
+	return nil, nil
 }
 
 func expectJSONDelimiter(jsonDecoder *json.Decoder, delimiter string) error {
@@ -1416,12 +1494,13 @@ func expectJSONDelimiter(jsonDecoder *json.Decoder, delimiter string) error {
 	return nil
 }
 
-// NewOSLReader decrypts, authenticates and streams an OSL payload.
+// NewOSLReader decrypts, authenticates and streams an OSL payload. The
+// payload is authenticated using the trusted signingPublicKeys.
 func NewOSLReader(
 	oslFileContent io.ReadSeeker,
 	fileSpec *OSLFileSpec,
 	lookup SLOKLookup,
-	signingPublicKey string) (io.Reader, error) {
+	signingPublicKeys *common.AuthenticatedDataPackageKeys) (io.Reader, error) {
 
 	ok, fileKey, err := fileSpec.KeyShares.reassembleKey(lookup, true)
 	if err != nil {
@@ -1444,9 +1523,9 @@ func NewOSLReader(
 		return nil, errors.Trace(err)
 	}
 
-	return common.NewAuthenticatedDataPackageReader(
+	return common.NewAuthenticatedDataPackageReaderWithKeys(
 		unboxer,
-		signingPublicKey)
+		signingPublicKeys)
 }
 
 // zeroReader reads an unlimited stream of zeroes.
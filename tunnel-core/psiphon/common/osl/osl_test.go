@@ -319,6 +319,10 @@ func TestOSL(t *testing.T) {
 		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
 	}
 
+	signingPublicKeys := &common.AuthenticatedDataPackageKeys{
+		PublicKeys: []string{signingPublicKey},
+	}
+
 	pavedRegistries := make(map[string][]byte)
 	pavedOSLFileContents := make(map[string]map[string][]byte)
 
@@ -600,7 +604,7 @@ func TestOSL(t *testing.T) {
 
 			registryStreamer, err := NewRegistryStreamer(
 				bytes.NewReader(pavedRegistries[testCase.propagationChannelID]),
-				signingPublicKey,
+				signingPublicKeys,
 				lookupSLOKs)
 			if err != nil {
 				t.Fatalf("NewRegistryStreamer failed: %s", err)
@@ -631,7 +635,7 @@ func TestOSL(t *testing.T) {
 					bytes.NewReader(oslFileContents),
 					fileSpec,
 					lookupSLOKs,
-					signingPublicKey)
+					signingPublicKeys)
 				if err != nil {
 					t.Fatalf("NewOSLReader failed: %s", err)
 				}
@@ -655,6 +659,48 @@ func TestOSL(t *testing.T) {
 			if seededOSLCount != testCase.expectedOSLCount {
 				t.Fatalf("expected %d OSLs got %d", testCase.expectedOSLCount, seededOSLCount)
 			}
+
+			// Progress inspection must agree with Next.
+
+			registryStreamer, err = NewRegistryStreamer(
+				bytes.NewReader(pavedRegistries[testCase.propagationChannelID]),
+				signingPublicKeys,
+				lookupSLOKs)
+			if err != nil {
+				t.Fatalf("NewRegistryStreamer failed: %s", err)
+			}
+
+			unlockedOSLCount := 0
+
+			for {
+
+				fileSpec, err := registryStreamer.NextFileSpec()
+				if err != nil {
+					t.Fatalf("NextFileSpec failed: %s", err)
+				}
+
+				if fileSpec == nil {
+					break
+				}
+
+				progress, err := fileSpec.KeyShares.GetProgress(lookupSLOKs)
+				if err != nil {
+					t.Fatalf("GetProgress failed: %s", err)
+				}
+
+				if progress.Total != len(fileSpec.KeyShares.BoxedShares) ||
+					progress.Held > progress.Total {
+					t.Fatalf("unexpected progress: %+v", progress)
+				}
+
+				if progress.IsUnlocked() {
+					unlockedOSLCount += 1
+				}
+			}
+
+			if unlockedOSLCount != testCase.expectedOSLCount {
+				t.Fatalf("expected %d unlocked OSLs got %d", testCase.expectedOSLCount, unlockedOSLCount)
+			}
 		})
 	}
 }
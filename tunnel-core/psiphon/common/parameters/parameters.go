@@ -86,6 +86,7 @@ const (
 	EstablishTunnelPausePeriod                       = "EstablishTunnelPausePeriod"
 	EstablishTunnelPausePeriodJitter                 = "EstablishTunnelPausePeriodJitter"
 	EstablishTunnelServerAffinityGracePeriod         = "EstablishTunnelServerAffinityGracePeriod"
+	MigrateTunnelDrainPeriod                         = "MigrateTunnelDrainPeriod"
 	StaggerConnectionWorkersPeriod                   = "StaggerConnectionWorkersPeriod"
 	StaggerConnectionWorkersJitter                   = "StaggerConnectionWorkersJitter"
 	LimitIntensiveConnectionWorkers                  = "LimitIntensiveConnectionWorkers"
@@ -113,6 +114,9 @@ const (
 	LimitQUICVersions                                = "LimitQUICVersions"
 	DisableFrontingProviderQUICVersions              = "DisableFrontingProviderQUICVersions"
 	QUICDisableClientPathMTUDiscoveryProbability     = "QUICDisableClientPathMTUDiscoveryProbability"
+	PacketTunnelQUICDatagramsProbability             = "PacketTunnelQUICDatagramsProbability"
+	QUICDisableClientMigration                       = "QUICDisableClientMigration"
+	QUICMigrationNetworkIDCheckPeriod                = "QUICMigrationNetworkIDCheckPeriod"
 	FragmentorProbability                            = "FragmentorProbability"
 	FragmentorLimitProtocols                         = "FragmentorLimitProtocols"
 	FragmentorMinTotalBytes                          = "FragmentorMinTotalBytes"
@@ -157,7 +161,16 @@ const (
 	FetchRemoteServerListStalePeriod                 = "FetchRemoteServerListStalePeriod"
 	RemoteServerListSignaturePublicKey               = "RemoteServerListSignaturePublicKey"
 	RemoteServerListURLs                             = "RemoteServerListURLs"
+	RemoteServerListSignaturePublicKeys              = "RemoteServerListSignaturePublicKeys"
+	RemoteServerListSignatureThreshold               = "RemoteServerListSignatureThreshold"
+	ServerEntrySignaturePublicKeys                   = "ServerEntrySignaturePublicKeys"
+	ExchangeQRFrameDataSize                          = "ExchangeQRFrameDataSize"
+	ExchangeLANOfferTransferLimit                    = "ExchangeLANOfferTransferLimit"
+	ExchangeLANOfferTransferLimitPeriod              = "ExchangeLANOfferTransferLimitPeriod"
+	ExchangeLANOfferConfirmTimeout                   = "ExchangeLANOfferConfirmTimeout"
 	ObfuscatedServerListRootURLs                     = "ObfuscatedServerListRootURLs"
+	RemoteServerListDeltaRootURLs                    = "RemoteServerListDeltaRootURLs"
+	RemoteServerListDeltaMaxChainLength              = "RemoteServerListDeltaMaxChainLength"
 	PsiphonAPIRequestTimeout                         = "PsiphonAPIRequestTimeout"
 	PsiphonAPIStatusRequestPeriodMin                 = "PsiphonAPIStatusRequestPeriodMin"
 	PsiphonAPIStatusRequestPeriodMax                 = "PsiphonAPIStatusRequestPeriodMax"
@@ -207,6 +220,7 @@ const (
 	MeekMinLimitRequestPayloadLength                 = "MeekMinLimitRequestPayloadLength"
 	MeekMaxLimitRequestPayloadLength                 = "MeekMaxLimitRequestPayloadLength"
 	MeekRedialTLSProbability                         = "MeekRedialTLSProbability"
+	MeekWebSocketProbability                         = "MeekWebSocketProbability"
 	TransformHostNameProbability                     = "TransformHostNameProbability"
 	PickUserAgentProbability                         = "PickUserAgentProbability"
 	LivenessTestMinUpstreamBytes                     = "LivenessTestMinUpstreamBytes"
@@ -318,6 +332,11 @@ const (
 	DNSResolverIncludeEDNS0Probability               = "DNSResolverIncludeEDNS0Probability"
 	DNSResolverCacheExtensionInitialTTL              = "DNSResolverCacheExtensionInitialTTL"
 	DNSResolverCacheExtensionVerifiedTTL             = "DNSResolverCacheExtensionVerifiedTTL"
+	DNSResolverCacheMaxStoreNetworks                 = "DNSResolverCacheMaxStoreNetworks"
+	DNSResolverCrossCheckProbability                 = "DNSResolverCrossCheckProbability"
+	DNSResolverCrossCheckAwaitTimeout                = "DNSResolverCrossCheckAwaitTimeout"
+	DNSResolverPoisonedIPAddressCIDRs                = "DNSResolverPoisonedIPAddressCIDRs"
+	DNSResolverHTTPSRecordsProbability               = "DNSResolverHTTPSRecordsProbability"
 )
 
 const (
@@ -360,6 +379,7 @@ var defaultParameters = map[string]struct {
 	EstablishTunnelPausePeriod:               {value: 5 * time.Second, minimum: 1 * time.Millisecond},
 	EstablishTunnelPausePeriodJitter:         {value: 0.1, minimum: 0.0},
 	EstablishTunnelServerAffinityGracePeriod: {value: 1 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	MigrateTunnelDrainPeriod:                 {value: 5 * time.Minute, minimum: time.Duration(0)},
 	StaggerConnectionWorkersPeriod:           {value: time.Duration(0), minimum: time.Duration(0)},
 	StaggerConnectionWorkersJitter:           {value: 0.1, minimum: 0.0},
 	LimitIntensiveConnectionWorkers:          {value: 0, minimum: 0},
@@ -399,6 +419,9 @@ var defaultParameters = map[string]struct {
 	LimitQUICVersions:                            {value: protocol.QUICVersions{}},
 	DisableFrontingProviderQUICVersions:          {value: protocol.LabeledQUICVersions{}},
 	QUICDisableClientPathMTUDiscoveryProbability: {value: 0.0, minimum: 0.0},
+	PacketTunnelQUICDatagramsProbability:         {value: 0.0, minimum: 0.0},
+	QUICDisableClientMigration:                   {value: false},
+	QUICMigrationNetworkIDCheckPeriod:            {value: 2 * time.Second, minimum: 100 * time.Millisecond},
 
 	FragmentorProbability:              {value: 0.5, minimum: 0.0},
 	FragmentorLimitProtocols:           {value: protocol.TunnelProtocols{}},
@@ -463,6 +486,18 @@ var defaultParameters = map[string]struct {
 	RemoteServerListURLs:               {value: TransferURLs{}},
 	ObfuscatedServerListRootURLs:       {value: TransferURLs{}},
 
+	RemoteServerListDeltaRootURLs:       {value: TransferURLs{}},
+	RemoteServerListDeltaMaxChainLength: {value: 10, minimum: 1},
+
+	RemoteServerListSignaturePublicKeys: {value: []string{}},
+	RemoteServerListSignatureThreshold:  {value: 1, minimum: 1},
+	ServerEntrySignaturePublicKeys:      {value: []string{}},
+
+	ExchangeQRFrameDataSize:             {value: 256, minimum: 16},
+	ExchangeLANOfferTransferLimit:       {value: 5, minimum: 1},
+	ExchangeLANOfferTransferLimitPeriod: {value: 10 * time.Minute, minimum: 1 * time.Second},
+	ExchangeLANOfferConfirmTimeout:      {value: 30 * time.Second, minimum: 1 * time.Second},
+
 	PsiphonAPIRequestTimeout: {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 
 	PsiphonAPIStatusRequestPeriodMin:      {value: 5 * time.Minute, minimum: 1 * time.Second},
@@ -538,6 +573,7 @@ var defaultParameters = map[string]struct {
 	MeekMinLimitRequestPayloadLength: {value: 65536, minimum: 1},
 	MeekMaxLimitRequestPayloadLength: {value: 65536, minimum: 1},
 	MeekRedialTLSProbability:         {value: 0.0, minimum: 0.0},
+	MeekWebSocketProbability:         {value: 0.0, minimum: 0.0},
 
 	TransformHostNameProbability: {value: 0.5, minimum: 0.0},
 	PickUserAgentProbability:     {value: 0.5, minimum: 0.0},
@@ -672,6 +708,11 @@ var defaultParameters = map[string]struct {
 	DNSResolverIncludeEDNS0Probability:          {value: 0.0, minimum: 0.0},
 	DNSResolverCacheExtensionInitialTTL:         {value: time.Duration(0), minimum: time.Duration(0)},
 	DNSResolverCacheExtensionVerifiedTTL:        {value: time.Duration(0), minimum: time.Duration(0)},
+	DNSResolverCacheMaxStoreNetworks:            {value: 20, minimum: 1},
+	DNSResolverCrossCheckProbability:            {value: 0.0, minimum: 0.0},
+	DNSResolverCrossCheckAwaitTimeout:           {value: 250 * time.Millisecond, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	DNSResolverPoisonedIPAddressCIDRs:           {value: []string{}},
+	DNSResolverHTTPSRecordsProbability:          {value: 0.0, minimum: 0.0},
 }
 
 // IsServerSideOnly indicates if the parameter specified by name is used
@@ -0,0 +1,756 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	tlsRecordTypeHandshake       = 22
+	tlsHandshakeTypeClientHello  = 1
+	tlsMaxClientHelloSessionID   = 32
+	tlsUTLSSessionIDSize         = 32
+	tlsExtensionServerName       = 0
+	tlsExtensionStatusRequest    = 5
+	tlsExtensionSupportedGroups  = 10
+	tlsExtensionECPointFormats   = 11
+	tlsExtensionSignatureAlgs    = 13
+	tlsExtensionALPN             = 16
+	tlsExtensionSCT              = 18
+	tlsExtensionPadding          = 21
+	tlsExtensionExtendedMaster   = 23
+	tlsExtensionCompressCert     = 27
+	tlsExtensionRecordSizeLimit  = 28
+	tlsExtensionSessionTicket    = 35
+	tlsExtensionPreSharedKey     = 41
+	tlsExtensionEarlyData        = 42
+	tlsExtensionSupportedVersion = 43
+	tlsExtensionCookie           = 44
+	tlsExtensionPSKModes         = 45
+	tlsExtensionKeyShare         = 51
+	tlsExtensionNPN              = 13172
+	tlsExtensionChannelID        = 30032
+	tlsExtensionECH              = 0xfe0d
+	tlsExtensionRenegotiation    = 0xff01
+)
+
+// CapturedClientHello is a ClientHello, captured from another TLS client,
+// and an equivalent UTLSSpec, which may be deployed in a CustomTLSProfile.
+type CapturedClientHello struct {
+
+	// Raw is the ClientHello handshake message, without any TLS record
+	// header.
+	Raw []byte
+
+	// ServerName is the SNI server name, if any, in the ClientHello.
+	ServerName string
+
+	// UTLSSpec is the UTLSSpec equivalent to the ClientHello.
+	UTLSSpec *UTLSSpec
+
+	// Unsupported lists, in a human readable form, ClientHello features that
+	// UTLSSpec can't express, or that UTLSSpec can express only as static
+	// data which a real client would vary per connection. When Unsupported
+	// is not empty, ClientHellos produced from UTLSSpec may differ from, or
+	// be distinguishable from, the captured ClientHello.
+	Unsupported []string
+}
+
+// ParseClientHello parses a captured ClientHello and generates an
+// equivalent UTLSSpec. The input may be either a ClientHello handshake
+// message or TLS records containing a ClientHello.
+//
+// ParseClientHello maps extensions to the UTLSExtension types supported by
+// UTLSExtension.GetUTLSExtension. Extensions which have no corresponding
+// type are mapped to Generic extensions, with the captured data. GREASE
+// values in cipher suites, extensions, supported groups, supported
+// versions, and key shares are mapped to utls.GREASE_PLACEHOLDER, so that
+// utls will generate new GREASE values for each ClientHello.
+func ParseClientHello(data []byte) (*CapturedClientHello, error) {
+
+	raw, err := getClientHelloMessage(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	fields, err := parseClientHelloFields(raw)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	capture := &CapturedClientHello{
+		Raw:      raw,
+		UTLSSpec: &UTLSSpec{},
+	}
+
+	spec := capture.UTLSSpec
+
+	unsupported := func(format string, args ...interface{}) {
+		capture.Unsupported = append(capture.Unsupported, fmt.Sprintf(format, args...))
+	}
+
+	// utls always sends a random, 32 byte session ID.
+	if fields.sessionIDLength != tlsUTLSSessionIDSize {
+		unsupported("session ID length: %d", fields.sessionIDLength)
+	}
+
+	for _, cipherSuite := range fields.cipherSuites {
+		if isGREASEValue(cipherSuite) {
+			cipherSuite = utls.GREASE_PLACEHOLDER
+		}
+		spec.CipherSuites = append(spec.CipherSuites, cipherSuite)
+	}
+
+	spec.CompressionMethods = append([]uint8(nil), fields.compressionMethods...)
+
+	haveSupportedVersions := false
+	GREASECount := 0
+
+	for _, extension := range fields.extensions {
+
+		if isGREASEValue(extension.ID) {
+			GREASECount += 1
+			if GREASECount > 2 {
+				unsupported("more than 2 GREASE extensions")
+				continue
+			}
+			spec.Extensions = append(spec.Extensions, &UTLSExtension{Name: "GREASE"})
+			continue
+		}
+
+		if extension.ID == tlsExtensionServerName {
+			serverName, err := parseServerNameExtension(extension.data)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			capture.ServerName = serverName
+		}
+
+		if extension.ID == tlsExtensionSupportedVersion {
+			haveSupportedVersions = true
+		}
+
+		specExtension, note, err := newUTLSExtension(extension.ID, extension.data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if note != "" {
+			unsupported("extension %d: %s", extension.ID, note)
+		}
+		if specExtension != nil {
+			spec.Extensions = append(spec.Extensions, specExtension)
+		}
+	}
+
+	// When there's a supported versions extension, utls derives the
+	// minimum and maximum versions from the extension when TLSVersMin and
+	// TLSVersMax are 0.
+	if !haveSupportedVersions {
+		spec.TLSVersMin = utls.VersionTLS10
+		spec.TLSVersMax = fields.legacyVersion
+	}
+
+	return capture, nil
+}
+
+// Verify checks that a ClientHello produced from the UTLSSpec is identical
+// to the captured ClientHello, excluding the random, the session ID
+// contents, GREASE values, and generated key share public keys, which
+// utls randomizes for each ClientHello.
+func (capture *CapturedClientHello) Verify() error {
+
+	profile := &CustomTLSProfile{
+		Name:     "capture",
+		UTLSSpec: capture.UTLSSpec,
+	}
+
+	spec, err := profile.GetClientHelloSpec()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	conn := utls.UClient(
+		nil,
+		&utls.Config{ServerName: capture.ServerName, InsecureSkipVerify: true},
+		utls.HelloCustom)
+	err = conn.ApplyPreset(spec)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = conn.BuildHandshakeState()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = compareClientHellos(capture.Raw, conn.HandshakeState.Hello.Raw)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// getClientHelloMessage returns the ClientHello handshake message contained
+// in data, which may be a handshake message or one or more TLS records.
+func getClientHelloMessage(data []byte) ([]byte, error) {
+
+	if len(data) > 0 && data[0] == tlsRecordTypeHandshake {
+
+		// A ClientHello may be fragmented across multiple handshake records.
+		var message []byte
+		records := cryptobyte.String(data)
+		for !records.Empty() {
+			var recordType uint8
+			var fragment cryptobyte.String
+			if !records.ReadUint8(&recordType) ||
+				!records.Skip(2) ||
+				!records.ReadUint16LengthPrefixed(&fragment) {
+				return nil, errors.TraceNew("invalid TLS record")
+			}
+			if recordType != tlsRecordTypeHandshake {
+				break
+			}
+			message = append(message, fragment...)
+		}
+		data = message
+	}
+
+	if len(data) < 4 || data[0] != tlsHandshakeTypeClientHello {
+		return nil, errors.TraceNew("not a ClientHello")
+	}
+
+	length := 4 + (int(data[1])<<16 | int(data[2])<<8 | int(data[3]))
+	if len(data) < length {
+		return nil, errors.TraceNew("truncated ClientHello")
+	}
+
+	return append([]byte(nil), data[:length]...), nil
+}
+
+type clientHelloFields struct {
+	legacyVersion      uint16
+	sessionIDLength    int
+	cipherSuites       []uint16
+	compressionMethods []uint8
+	extensions         []clientHelloExtension
+}
+
+type clientHelloExtension struct {
+	ID   uint16
+	data []byte
+}
+
+func parseClientHelloFields(message []byte) (*clientHelloFields, error) {
+
+	fields := &clientHelloFields{}
+
+	s := cryptobyte.String(message)
+
+	var sessionID, cipherSuites, compressionMethods cryptobyte.String
+	if !s.Skip(4) ||
+		!s.ReadUint16(&fields.legacyVersion) ||
+		!s.Skip(32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, errors.TraceNew("invalid ClientHello")
+	}
+
+	if len(sessionID) > tlsMaxClientHelloSessionID {
+		return nil, errors.TraceNew("invalid session ID")
+	}
+	fields.sessionIDLength = len(sessionID)
+
+	for !cipherSuites.Empty() {
+		var cipherSuite uint16
+		if !cipherSuites.ReadUint16(&cipherSuite) {
+			return nil, errors.TraceNew("invalid cipher suites")
+		}
+		fields.cipherSuites = append(fields.cipherSuites, cipherSuite)
+	}
+
+	fields.compressionMethods = append([]uint8(nil), compressionMethods...)
+
+	if s.Empty() {
+		return fields, nil
+	}
+
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
+		return nil, errors.TraceNew("invalid extensions")
+	}
+
+	for !extensions.Empty() {
+		var ID uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&ID) ||
+			!extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.TraceNew("invalid extension")
+		}
+		fields.extensions = append(
+			fields.extensions,
+			clientHelloExtension{ID: ID, data: append([]byte(nil), data...)})
+	}
+
+	return fields, nil
+}
+
+func parseServerNameExtension(data []byte) (string, error) {
+
+	s := cryptobyte.String(data)
+	var serverNames cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&serverNames) {
+		return "", errors.TraceNew("invalid server name extension")
+	}
+	for !serverNames.Empty() {
+		var nameType uint8
+		var serverName cryptobyte.String
+		if !serverNames.ReadUint8(&nameType) ||
+			!serverNames.ReadUint16LengthPrefixed(&serverName) {
+			return "", errors.TraceNew("invalid server name extension")
+		}
+		if nameType == 0 {
+			return string(serverName), nil
+		}
+	}
+	return "", nil
+}
+
+// newUTLSExtension maps a captured extension to a UTLSExtension. When the
+// extension can't be expressed, or can be expressed only as static data, a
+// note explaining the limitation is returned. When the returned
+// UTLSExtension is nil, the extension is omitted.
+func newUTLSExtension(ID uint16, data []byte) (*UTLSExtension, string, error) {
+
+	s := cryptobyte.String(data)
+
+	var name string
+	var extension interface{}
+	var note string
+
+	switch ID {
+
+	case tlsExtensionServerName:
+		name = "SNI"
+
+	case tlsExtensionStatusRequest:
+		// utls sends only an OCSP status request with no responder IDs or
+		// request extensions.
+		if bytes.Equal(data, []byte{1, 0, 0, 0, 0}) {
+			name = "StatusRequest"
+		}
+
+	case tlsExtensionSupportedGroups:
+		values, ok := readUint16List(&s)
+		if ok {
+			curves := []utls.CurveID{}
+			for _, value := range values {
+				if isGREASEValue(value) {
+					value = utls.GREASE_PLACEHOLDER
+				}
+				curves = append(curves, utls.CurveID(value))
+			}
+			name = "SupportedCurves"
+			extension = &utls.SupportedCurvesExtension{Curves: curves}
+		}
+
+	case tlsExtensionECPointFormats:
+		var points cryptobyte.String
+		if s.ReadUint8LengthPrefixed(&points) && s.Empty() {
+			name = "SupportedPoints"
+			extension = &utls.SupportedPointsExtension{
+				SupportedPoints: append([]uint8{}, points...)}
+		}
+
+	case tlsExtensionSignatureAlgs:
+		values, ok := readUint16List(&s)
+		if ok {
+			schemes := []utls.SignatureScheme{}
+			for _, value := range values {
+				schemes = append(schemes, utls.SignatureScheme(value))
+			}
+			name = "SignatureAlgorithms"
+			extension = &utls.SignatureAlgorithmsExtension{
+				SupportedSignatureAlgorithms: schemes}
+		}
+
+	case tlsExtensionALPN:
+		var protocolList cryptobyte.String
+		if s.ReadUint16LengthPrefixed(&protocolList) && s.Empty() {
+			protocols := []string{}
+			ok := true
+			for ok && !protocolList.Empty() {
+				var protocol cryptobyte.String
+				ok = protocolList.ReadUint8LengthPrefixed(&protocol)
+				protocols = append(protocols, string(protocol))
+			}
+			if ok {
+				name = "ALPN"
+				extension = &utls.ALPNExtension{AlpnProtocols: protocols}
+			}
+		}
+
+	case tlsExtensionSCT:
+		if len(data) == 0 {
+			name = "SCT"
+		}
+
+	case tlsExtensionPadding:
+		// The padding length is recalculated for each ClientHello; Verify
+		// will detect when the captured client uses a different padding
+		// scheme.
+		name = "BoringPadding"
+
+	case tlsExtensionExtendedMaster:
+		if len(data) == 0 {
+			name = "ExtendedMasterSecret"
+		}
+
+	case tlsExtensionCompressCert:
+		var methods cryptobyte.String
+		if s.ReadUint8LengthPrefixed(&methods) && s.Empty() {
+			values, ok := readUint16Values(&methods)
+			if ok {
+				algorithms := []utls.CertCompressionAlgo{}
+				for _, value := range values {
+					algorithms = append(algorithms, utls.CertCompressionAlgo(value))
+				}
+				name = "CertCompressionAlgs"
+				extension = &utls.FakeCertCompressionAlgsExtension{Methods: algorithms}
+			}
+		}
+
+	case tlsExtensionRecordSizeLimit:
+		var limit uint16
+		if s.ReadUint16(&limit) && s.Empty() {
+			name = "RecordSizeLimit"
+			extension = &utls.FakeRecordSizeLimitExtension{Limit: limit}
+		}
+
+	case tlsExtensionSessionTicket:
+		name = "SessionTicket"
+		if len(data) > 0 {
+			note = "session ticket omitted"
+		}
+
+	case tlsExtensionPreSharedKey:
+		return nil, "pre-shared key omitted", nil
+
+	case tlsExtensionCookie:
+		return nil, "cookie omitted", nil
+
+	case tlsExtensionEarlyData:
+		note = "early data indication sent without a pre-shared key"
+
+	case tlsExtensionSupportedVersion:
+		var versionList cryptobyte.String
+		if s.ReadUint8LengthPrefixed(&versionList) && s.Empty() {
+			values, ok := readUint16Values(&versionList)
+			if ok {
+				versions := []uint16{}
+				for _, value := range values {
+					if isGREASEValue(value) {
+						value = utls.GREASE_PLACEHOLDER
+					}
+					versions = append(versions, value)
+				}
+				name = "SupportedVersions"
+				extension = &utls.SupportedVersionsExtension{Versions: versions}
+			}
+		}
+
+	case tlsExtensionPSKModes:
+		var modes cryptobyte.String
+		if s.ReadUint8LengthPrefixed(&modes) && s.Empty() {
+			name = "PSKKeyExchangeModes"
+			extension = &utls.PSKKeyExchangeModesExtension{
+				Modes: append([]uint8{}, modes...)}
+		}
+
+	case tlsExtensionKeyShare:
+		var keyShareList cryptobyte.String
+		if s.ReadUint16LengthPrefixed(&keyShareList) && s.Empty() {
+			keyShares := []utls.KeyShare{}
+			ok := true
+			for ok && !keyShareList.Empty() {
+				var group uint16
+				var key cryptobyte.String
+				ok = keyShareList.ReadUint16(&group) &&
+					keyShareList.ReadUint16LengthPrefixed(&key)
+				keyShare := utls.KeyShare{Group: utls.CurveID(group)}
+				if isGREASEValue(group) {
+					keyShare.Group = utls.GREASE_PLACEHOLDER
+					keyShare.Data = append([]byte{}, key...)
+				} else if !isUTLSKeyShareGroup(keyShare.Group) {
+					keyShare.Data = append([]byte{}, key...)
+					note = fmt.Sprintf("key share for group %d replayed as static data", group)
+				}
+				keyShares = append(keyShares, keyShare)
+			}
+			if ok {
+				name = "KeyShare"
+				extension = &utls.KeyShareExtension{KeyShares: keyShares}
+			}
+		}
+
+	case tlsExtensionNPN:
+		if len(data) == 0 {
+			name = "NPN"
+			extension = &utls.NPNExtension{}
+		}
+
+	case tlsExtensionChannelID:
+		if len(data) == 0 {
+			name = "ChannelID"
+		}
+
+	case tlsExtensionRenegotiation:
+		if bytes.Equal(data, []byte{0}) {
+			name = "RenegotiationInfo"
+			extension = &utls.RenegotiationInfoExtension{
+				Renegotiation: utls.RenegotiateOnceAsClient}
+		}
+
+	case tlsExtensionECH:
+		note = "encrypted client hello replayed as static data"
+	}
+
+	// Extensions with no corresponding UTLSExtension type, or with
+	// unexpected data, are sent as Generic extensions with the captured
+	// data.
+	if name == "" {
+		name = "Generic"
+		extension = &utls.GenericExtension{Id: ID, Data: append([]byte{}, data...)}
+	}
+
+	specExtension := &UTLSExtension{Name: name}
+	if extension != nil {
+		var err error
+		specExtension.Data, err = json.Marshal(extension)
+		if err != nil {
+			return nil, "", errors.Trace(err)
+		}
+	}
+
+	return specExtension, note, nil
+}
+
+func readUint16List(s *cryptobyte.String) ([]uint16, bool) {
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() {
+		return nil, false
+	}
+	return readUint16Values(&list)
+}
+
+func readUint16Values(s *cryptobyte.String) ([]uint16, bool) {
+	var values []uint16
+	for !s.Empty() {
+		var value uint16
+		if !s.ReadUint16(&value) {
+			return nil, false
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
+
+// isGREASEValue indicates whether value is one of the GREASE values
+// reserved in RFC 8701.
+func isGREASEValue(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// isUTLSKeyShareGroup indicates whether utls can generate key shares for
+// the specified group.
+func isUTLSKeyShareGroup(group utls.CurveID) bool {
+	switch group {
+	case utls.X25519, utls.CurveP256, utls.CurveP384, utls.CurveP521:
+		return true
+	}
+	return false
+}
+
+// compareClientHellos compares two ClientHello handshake messages, ignoring
+// fields that vary per ClientHello, and returns an error describing the
+// first difference.
+func compareClientHellos(message, otherMessage []byte) error {
+
+	fields, err := parseClientHelloFields(message)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	otherFields, err := parseClientHelloFields(otherMessage)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if fields.legacyVersion != otherFields.legacyVersion {
+		return errors.Tracef(
+			"legacy version: %d != %d", fields.legacyVersion, otherFields.legacyVersion)
+	}
+
+	if fields.sessionIDLength != otherFields.sessionIDLength {
+		return errors.Tracef(
+			"session ID length: %d != %d", fields.sessionIDLength, otherFields.sessionIDLength)
+	}
+
+	normalizeValues := func(values []uint16) []uint16 {
+		normalized := make([]uint16, len(values))
+		for i, value := range values {
+			if isGREASEValue(value) {
+				value = utls.GREASE_PLACEHOLDER
+			}
+			normalized[i] = value
+		}
+		return normalized
+	}
+
+	cipherSuites := normalizeValues(fields.cipherSuites)
+	otherCipherSuites := normalizeValues(otherFields.cipherSuites)
+	if fmt.Sprint(cipherSuites) != fmt.Sprint(otherCipherSuites) {
+		return errors.Tracef(
+			"cipher suites: %v != %v", cipherSuites, otherCipherSuites)
+	}
+
+	if !bytes.Equal(fields.compressionMethods, otherFields.compressionMethods) {
+		return errors.Tracef(
+			"compression methods: %v != %v", fields.compressionMethods, otherFields.compressionMethods)
+	}
+
+	if len(fields.extensions) != len(otherFields.extensions) {
+		return errors.Tracef(
+			"extension count: %d != %d", len(fields.extensions), len(otherFields.extensions))
+	}
+
+	for i := range fields.extensions {
+
+		extension := normalizeClientHelloExtension(fields.extensions[i])
+		otherExtension := normalizeClientHelloExtension(otherFields.extensions[i])
+
+		if extension.ID != otherExtension.ID {
+			return errors.Tracef(
+				"extension %d: type %d != %d", i, extension.ID, otherExtension.ID)
+		}
+
+		if !bytes.Equal(extension.data, otherExtension.data) {
+			return errors.Tracef(
+				"extension %d: type %d data differs", i, extension.ID)
+		}
+	}
+
+	return nil
+}
+
+// normalizeClientHelloExtension replaces GREASE values with
+// utls.GREASE_PLACEHOLDER, and key share public keys for utls supported
+// groups with zeros.
+func normalizeClientHelloExtension(extension clientHelloExtension) clientHelloExtension {
+
+	if isGREASEValue(extension.ID) {
+		extension.ID = utls.GREASE_PLACEHOLDER
+	}
+
+	normalizeValue := func(value uint16) uint16 {
+		if isGREASEValue(value) {
+			return utls.GREASE_PLACEHOLDER
+		}
+		return value
+	}
+
+	s := cryptobyte.String(extension.data)
+	var b cryptobyte.Builder
+
+	switch extension.ID {
+
+	case tlsExtensionSupportedGroups:
+		values, ok := readUint16List(&s)
+		if !ok {
+			return extension
+		}
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, value := range values {
+				b.AddUint16(normalizeValue(value))
+			}
+		})
+
+	case tlsExtensionSupportedVersion:
+		var versionList cryptobyte.String
+		if !s.ReadUint8LengthPrefixed(&versionList) || !s.Empty() {
+			return extension
+		}
+		values, ok := readUint16Values(&versionList)
+		if !ok {
+			return extension
+		}
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, value := range values {
+				b.AddUint16(normalizeValue(value))
+			}
+		})
+
+	case tlsExtensionKeyShare:
+		var keyShareList cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&keyShareList) || !s.Empty() {
+			return extension
+		}
+		var groups []uint16
+		var keys [][]byte
+		for !keyShareList.Empty() {
+			var group uint16
+			var key cryptobyte.String
+			if !keyShareList.ReadUint16(&group) ||
+				!keyShareList.ReadUint16LengthPrefixed(&key) {
+				return extension
+			}
+			if isUTLSKeyShareGroup(utls.CurveID(group)) {
+				key = make([]byte, len(key))
+			}
+			groups = append(groups, normalizeValue(group))
+			keys = append(keys, key)
+		}
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for i := range groups {
+				b.AddUint16(groups[i])
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(keys[i])
+				})
+			}
+		})
+
+	default:
+		return extension
+	}
+
+	data, err := b.Bytes()
+	if err != nil {
+		return extension
+	}
+	extension.data = data
+
+	return extension
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestParseClientHello(t *testing.T) {
+
+	serverName := "www.example.org"
+
+	for _, clientHelloID := range []utls.ClientHelloID{
+		utls.HelloChrome_58,
+		utls.HelloChrome_83,
+		utls.HelloFirefox_65,
+		utls.HelloIOS_12_1,
+	} {
+
+		conn := utls.UClient(
+			nil,
+			&utls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			clientHelloID)
+		err := conn.BuildHandshakeState()
+		if err != nil {
+			t.Fatalf("BuildHandshakeState failed: %s", err)
+		}
+		clientHello := conn.HandshakeState.Hello.Raw
+
+		// Wrap the ClientHello in two TLS records, to exercise reassembly.
+		split := len(clientHello) / 2
+		var records []byte
+		for _, fragment := range [][]byte{clientHello[:split], clientHello[split:]} {
+			records = append(records, 22, 3, 1, byte(len(fragment)>>8), byte(len(fragment)))
+			records = append(records, fragment...)
+		}
+
+		for _, data := range [][]byte{clientHello, records} {
+
+			capture, err := ParseClientHello(data)
+			if err != nil {
+				t.Fatalf("ParseClientHello failed: %s", err)
+			}
+
+			if capture.ServerName != serverName {
+				t.Fatalf("unexpected server name: %s", capture.ServerName)
+			}
+
+			if len(capture.Unsupported) > 0 {
+				t.Fatalf("unexpected unsupported: %v", capture.Unsupported)
+			}
+
+			err = capture.Verify()
+			if err != nil {
+				t.Fatalf("Verify failed for %s: %s", clientHelloID.Str(), err)
+			}
+
+			// The UTLSSpec must be usable as a CustomTLSProfile.
+
+			profilesJSON, err := json.Marshal(CustomTLSProfiles{
+				{Name: "Captured", UTLSSpec: capture.UTLSSpec}})
+			if err != nil {
+				t.Fatalf("Marshal failed: %s", err)
+			}
+
+			var profiles CustomTLSProfiles
+			err = json.Unmarshal(profilesJSON, &profiles)
+			if err != nil {
+				t.Fatalf("Unmarshal failed: %s", err)
+			}
+
+			err = profiles.Validate()
+			if err != nil {
+				t.Fatalf("Validate failed: %s", err)
+			}
+
+			_, err = profiles[0].GetClientHelloSpec()
+			if err != nil {
+				t.Fatalf("GetClientHelloSpec failed: %s", err)
+			}
+		}
+	}
+
+	// Test: unsupported extensions are flagged, and a modified ClientHello
+	// fails verification.
+
+	spec := &utls.ClientHelloSpec{
+		CipherSuites:       []uint16{utls.GREASE_PLACEHOLDER, utls.TLS_AES_128_GCM_SHA256},
+		CompressionMethods: []byte{0},
+		Extensions: []utls.TLSExtension{
+			&utls.UtlsGREASEExtension{},
+			&utls.SNIExtension{},
+			&utls.SupportedVersionsExtension{Versions: []uint16{utls.VersionTLS13, utls.VersionTLS12}},
+			&utls.KeyShareExtension{KeyShares: []utls.KeyShare{{Group: utls.X25519}}},
+			&utls.GenericExtension{Id: 0xfe0d, Data: []byte{1, 2, 3}},
+		},
+	}
+
+	conn := utls.UClient(
+		nil,
+		&utls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		utls.HelloCustom)
+	err := conn.ApplyPreset(spec)
+	if err != nil {
+		t.Fatalf("ApplyPreset failed: %s", err)
+	}
+	err = conn.BuildHandshakeState()
+	if err != nil {
+		t.Fatalf("BuildHandshakeState failed: %s", err)
+	}
+
+	capture, err := ParseClientHello(conn.HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %s", err)
+	}
+
+	if len(capture.Unsupported) != 1 {
+		t.Fatalf("unexpected unsupported: %v", capture.Unsupported)
+	}
+
+	err = capture.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %s", err)
+	}
+
+	capture.UTLSSpec.Extensions = capture.UTLSSpec.Extensions[:len(capture.UTLSSpec.Extensions)-1]
+
+	err = capture.Verify()
+	if err == nil {
+		t.Fatalf("Verify unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+)
+
+func main() {
+
+	var signingKeyPairFilenames stringListFlag
+	flag.Var(
+		&signingKeyPairFilenames, "key",
+		"signing public key pair filename; repeat to sign with multiple keys; the first key authenticates the input lists")
+
+	var previousFilename string
+	flag.StringVar(
+		&previousFilename, "previous", "",
+		"previously published remote server list; when omitted, only the terminal delta is generated")
+
+	var currentFilename string
+	flag.StringVar(&currentFilename, "current", "", "remote server list to be published")
+
+	var destinationDirectory string
+	flag.StringVar(
+		&destinationDirectory, "output", "",
+		"destination directory for output files; when omitted, no files are written (dry run mode)")
+
+	flag.Parse()
+
+	// load key pairs
+
+	if len(signingKeyPairFilenames) == 0 {
+		fmt.Printf("missing signing public key pair file\n")
+		os.Exit(1)
+	}
+
+	var signingKeys []*common.AuthenticatedDataPackageSigningKey
+
+	for _, signingKeyPairFilename := range signingKeyPairFilenames {
+
+		keyPairPEM, err := ioutil.ReadFile(signingKeyPairFilename)
+		if err != nil {
+			fmt.Printf("failed loading signing public key pair file: %s\n", err)
+			os.Exit(1)
+		}
+
+		// Password "none" from psi_ops, as in the OSL paver.
+
+		block, _ := pem.Decode(keyPairPEM)
+		decryptedKeyPairPEM, err := x509.DecryptPEMBlock(block, []byte("none"))
+		if err != nil {
+			fmt.Printf("failed decrypting signing public key pair file: %s\n", err)
+			os.Exit(1)
+		}
+
+		rsaKey, err := x509.ParsePKCS1PrivateKey(decryptedKeyPairPEM)
+		if err != nil {
+			fmt.Printf("failed parsing signing public key pair file: %s\n", err)
+			os.Exit(1)
+		}
+
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+		if err != nil {
+			fmt.Printf("failed marshaling signing public key: %s\n", err)
+			os.Exit(1)
+		}
+
+		privateKeyBytes := x509.MarshalPKCS1PrivateKey(rsaKey)
+
+		signingKeys = append(signingKeys,
+			&common.AuthenticatedDataPackageSigningKey{
+				PublicKey:  base64.StdEncoding.EncodeToString(publicKeyBytes),
+				PrivateKey: base64.StdEncoding.EncodeToString(privateKeyBytes),
+			})
+	}
+
+	// load remote server lists
+
+	readServerList := func(filename string) string {
+		serverListPackage, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Printf("failed loading remote server list file: %s\n", err)
+			os.Exit(1)
+		}
+		payload, err := common.ReadAuthenticatedDataPackage(
+			serverListPackage, true, signingKeys[0].PublicKey)
+		if err != nil {
+			fmt.Printf("failed reading remote server list file: %s\n", err)
+			os.Exit(1)
+		}
+		return payload
+	}
+
+	currentPayload := readServerList(currentFilename)
+
+	// The delta from the previous version replaces the previous version's
+	// terminal delta, and the current version gets a new terminal delta.
+
+	var deltas []*protocol.ServerListDelta
+
+	if previousFilename != "" {
+		delta, err := protocol.MakeServerListDelta(
+			readServerList(previousFilename), currentPayload)
+		if err != nil {
+			fmt.Printf("failed making delta: %s\n", err)
+			os.Exit(1)
+		}
+		if delta.IsTerminal() {
+			fmt.Printf("remote server list is unchanged\n")
+			os.Exit(1)
+		}
+		deltas = append(deltas, delta)
+	}
+
+	terminalDelta, err := protocol.MakeServerListDelta(currentPayload, currentPayload)
+	if err != nil {
+		fmt.Printf("failed making terminal delta: %s\n", err)
+		os.Exit(1)
+	}
+	deltas = append(deltas, terminalDelta)
+
+	for _, delta := range deltas {
+
+		fmt.Printf(
+			"delta %s: to version %s, added server entries: %d, removed server entries: %d\n",
+			delta.FromVersion,
+			delta.ToVersion,
+			len(delta.AddedServerEntries),
+			len(delta.RemovedServerEntryTags))
+
+		if destinationDirectory == "" {
+			continue
+		}
+
+		deltaPackage, err := protocol.WriteServerListDeltaPackage(
+			delta, signingKeys)
+		if err != nil {
+			fmt.Printf("failed writing delta package: %s\n", err)
+			os.Exit(1)
+		}
+
+		err = os.MkdirAll(destinationDirectory, 0755)
+		if err != nil {
+			fmt.Printf("failed creating output directory: %s\n", err)
+			os.Exit(1)
+		}
+
+		filename := filepath.Join(destinationDirectory, delta.FromVersion)
+		err = ioutil.WriteFile(filename, deltaPackage, 0644)
+		if err != nil {
+			fmt.Printf("error writing output file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringListFlag) Set(flagValue string) error {
+	*list = append(*list, flagValue)
+	return nil
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	maxClientHelloSize = 65536
+)
+
+func main() {
+
+	var pcapFilename string
+	flag.StringVar(&pcapFilename, "pcap", "", "pcap or pcapng capture file")
+
+	var rawFilename string
+	flag.StringVar(&rawFilename, "raw", "", "file containing a raw ClientHello, as binary or hex")
+
+	var serverName string
+	flag.StringVar(&serverName, "server-name", "", "select the first pcap ClientHello with this SNI")
+
+	var profileName string
+	flag.StringVar(&profileName, "name", "", "custom TLS profile name")
+
+	var ignoreVerify bool
+	flag.BoolVar(&ignoreVerify, "ignore-verify", false, "output the profile even when verification fails")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage:\n\n"+
+				"%s -pcap <filename> -name <profile name> [-server-name <SNI>]\n"+
+				"%s -raw <filename> -name <profile name>\n\n",
+			os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if (pcapFilename == "") == (rawFilename == "") || profileName == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var clientHello []byte
+	var err error
+	if pcapFilename != "" {
+		clientHello, err = readPcapClientHello(pcapFilename, serverName)
+	} else {
+		clientHello, err = readRawClientHello(rawFilename)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	err = capture(clientHello, profileName, ignoreVerify)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func capture(clientHello []byte, profileName string, ignoreVerify bool) error {
+
+	capture, err := protocol.ParseClientHello(clientHello)
+	if err != nil {
+		return fmt.Errorf("parse ClientHello failed: %s", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "server name: %s\n", capture.ServerName)
+
+	for _, unsupported := range capture.Unsupported {
+		fmt.Fprintf(os.Stderr, "unsupported: %s\n", unsupported)
+	}
+
+	err = capture.Verify()
+	if err != nil {
+		if !ignoreVerify {
+			return fmt.Errorf("verify failed: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "verify failed: %s\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "verify succeeded\n")
+	}
+
+	profiles := protocol.CustomTLSProfiles{
+		{Name: profileName, UTLSSpec: capture.UTLSSpec},
+	}
+
+	err = profiles.Validate()
+	if err != nil {
+		return fmt.Errorf("validate failed: %s", err)
+	}
+
+	profilesJSON, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal failed: %s", err)
+	}
+
+	fmt.Printf("%s\n", profilesJSON)
+
+	return nil
+}
+
+func readRawClientHello(filename string) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read file failed: %s", err)
+	}
+
+	// Accept hex, as copied from Wireshark, with optional whitespace.
+	decoded, err := hex.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err == nil {
+		data = decoded
+	}
+
+	return data, nil
+}
+
+// readPcapClientHello returns the TLS records containing the first
+// ClientHello in the capture file, optionally with the specified SNI.
+//
+// TCP segments are reassembled, in order, from the segment containing the
+// start of the ClientHello record. Out-of-order and retransmitted segments
+// are not handled, and ClientHellos sent over QUIC are not supported.
+func readPcapClientHello(filename, serverName string) ([]byte, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open file failed: %s", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read file failed: %s", err)
+	}
+
+	var source gopacket.PacketDataSource
+	var linkType layers.LinkType
+	if bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		ngReader, err := pcapgo.NewNgReader(reader, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, fmt.Errorf("read pcapng failed: %s", err)
+		}
+		source, linkType = ngReader, ngReader.LinkType()
+	} else {
+		pcapReader, err := pcapgo.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("read pcap failed: %s", err)
+		}
+		source, linkType = pcapReader, pcapReader.LinkType()
+	}
+
+	type stream struct {
+		nextSeq uint32
+		data    []byte
+		done    bool
+	}
+	streams := make(map[string]*stream)
+
+	packetSource := gopacket.NewPacketSource(source, linkType)
+	packetSource.DecodeOptions = gopacket.Lazy
+
+	for {
+		packet, err := packetSource.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Skip packets which fail to decode.
+			continue
+		}
+
+		if packet.NetworkLayer() == nil {
+			continue
+		}
+		tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok || len(tcp.Payload) == 0 {
+			continue
+		}
+
+		streamID := fmt.Sprintf("%s:%d-%d",
+			packet.NetworkLayer().NetworkFlow().String(), tcp.SrcPort, tcp.DstPort)
+
+		s, ok := streams[streamID]
+		if !ok {
+			payload := tcp.Payload
+			if len(payload) < 6 || payload[0] != 22 || payload[1] != 3 || payload[5] != 1 {
+				continue
+			}
+			s = &stream{}
+			streams[streamID] = s
+		} else if s.done || tcp.Seq != s.nextSeq {
+			continue
+		}
+
+		s.data = append(s.data, tcp.Payload...)
+		s.nextSeq = tcp.Seq + uint32(len(tcp.Payload))
+
+		capture, err := protocol.ParseClientHello(s.data)
+		if err != nil {
+			// Await more segments, unless the ClientHello is too large.
+			if len(s.data) > maxClientHelloSize {
+				delete(streams, streamID)
+			}
+			continue
+		}
+
+		s.done = true
+
+		if serverName != "" && capture.ServerName != serverName {
+			continue
+		}
+
+		return s.data, nil
+	}
+
+	return nil, fmt.Errorf("no ClientHello found")
+}
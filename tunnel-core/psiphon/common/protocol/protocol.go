@@ -77,6 +77,11 @@ const (
 	RANDOM_STREAM_CHANNEL_TYPE            = "random@psiphon.ca"
 	TCP_PORT_FORWARD_NO_SPLIT_TUNNEL_TYPE = "direct-tcpip-no-split-tunnel@psiphon.ca"
 
+	// PACKET_TUNNEL_QUIC_DATAGRAMS_EXTRA_DATA is sent as the extra data in a
+	// packet tunnel open channel request to request that packets are
+	// relayed as QUIC datagrams. See tun.DatagramChannelTransport.
+	PACKET_TUNNEL_QUIC_DATAGRAMS_EXTRA_DATA = "quic-datagrams@psiphon.ca"
+
 	// Reject reason codes are returned in SSH open channel responses.
 	//
 	// Values 0xFE000000 to 0xFFFFFFFF are reserved for "PRIVATE USE" (see
@@ -232,6 +237,11 @@ func TunnelProtocolSupportsPassthrough(protocol string) bool {
 		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET
 }
 
+func TunnelProtocolSupportsProbeResponse(protocol string) bool {
+	return protocol == TUNNEL_PROTOCOL_OBFUSCATED_SSH ||
+		protocol == TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH
+}
+
 func TunnelProtocolSupportsUpstreamProxy(protocol string) bool {
 	return !TunnelProtocolUsesQUIC(protocol)
 }
@@ -416,6 +426,10 @@ func QUICVersionIsObfuscated(version string) bool {
 		version == QUIC_VERSION_DECOY_V1
 }
 
+func QUICVersionIsIETF(version string) bool {
+	return common.Contains(SupportedQUICv1Versions, version)
+}
+
 func QUICVersionUsesPathMTUDiscovery(version string) bool {
 	return version != QUIC_VERSION_GQUIC39 &&
 		version != QUIC_VERSION_GQUIC43 &&
@@ -479,6 +493,8 @@ type HandshakeResponse struct {
 	TacticsPayload           json.RawMessage     `json:"tactics_payload"`
 	UpstreamBytesPerSecond   int64               `json:"upstream_bytes_per_second"`
 	DownstreamBytesPerSecond int64               `json:"downstream_bytes_per_second"`
+	Migrate                  bool                `json:"migrate"`
+	MigrateServerEntries     []string            `json:"migrate_server_entries"`
 	Padding                  string              `json:"padding"`
 }
 
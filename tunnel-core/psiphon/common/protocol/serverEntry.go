@@ -279,8 +279,8 @@ const signaturePublicKeyDigestSize = 8
 // signature. Any existing "signature" field will be replaced.
 //
 // The signature incudes a public key ID that is derived from a digest of the
-// public key value. This ID is intended for future use when multiple signing
-// keys may be deployed.
+// public key value. This ID is used by VerifySignatureWithKeys to select the
+// verification key when multiple signing keys are deployed.
 func (fields ServerEntryFields) AddSignature(publicKey, privateKey string) error {
 
 	// Make a copy so that removing unsigned fields will have no side effects
@@ -343,6 +343,25 @@ func (fields ServerEntryFields) VerifySignature(publicKey string) error {
 		return errors.TraceNew("missing public key")
 	}
 
+	err := fields.VerifySignatureWithKeys([]string{publicKey})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// VerifySignatureWithKeys verifies the signature set by AddSignature, using
+// the public key, from the set of trusted public keys, that's identified by
+// the signature public key ID. This allows signing keys to be rotated, with
+// both old and new keys trusted during the transition, and revoked, by
+// removing a key from the trusted set.
+func (fields ServerEntryFields) VerifySignatureWithKeys(publicKeys []string) error {
+
+	if len(publicKeys) == 0 {
+		return errors.TraceNew("missing public key")
+	}
+
 	// Make a copy so that removing unsigned fields will have no side effects
 	copyFields := make(ServerEntryFields)
 	for k, v := range fields {
@@ -375,18 +394,32 @@ func (fields ServerEntryFields) VerifySignature(publicKey string) error {
 		return errors.TraceNew("invalid signature length")
 	}
 
-	decodedPublicKey, err := base64.StdEncoding.DecodeString(publicKey)
-	if err != nil {
-		return errors.Trace(err)
-	}
+	var decodedPublicKey []byte
 
-	publicKeyDigest := sha256.Sum256(decodedPublicKey)
-	expectedPublicKeyID := publicKeyDigest[:signaturePublicKeyDigestSize]
+	for _, publicKey := range publicKeys {
+
+		decodedKey, err := base64.StdEncoding.DecodeString(publicKey)
+		if err != nil {
+			return errors.Trace(err)
+		}
 
-	if !bytes.Equal(expectedPublicKeyID, publicKeyID) {
+		publicKeyDigest := sha256.Sum256(decodedKey)
+		expectedPublicKeyID := publicKeyDigest[:signaturePublicKeyDigestSize]
+
+		if bytes.Equal(expectedPublicKeyID, publicKeyID) {
+			decodedPublicKey = decodedKey
+			break
+		}
+	}
+
+	if decodedPublicKey == nil {
 		return errors.TraceNew("unexpected public key ID")
 	}
 
+	if len(decodedPublicKey) != ed25519.PublicKeySize {
+		return errors.TraceNew("invalid public key length")
+	}
+
 	copyFields.RemoveUnsignedFields()
 
 	delete(copyFields, "signature")
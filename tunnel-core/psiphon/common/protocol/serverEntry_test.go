@@ -272,6 +272,21 @@ func testServerEntryListSignatures(t *testing.T, setExplicitTag bool) {
 		t.Fatalf("VerifySignature unexpectedly succeeded")
 	}
 
+	// Check that the signature public key ID selects the correct key from a
+	// set of trusted keys
+
+	err = serverEntryFields.VerifySignatureWithKeys(
+		[]string{incorrectPublicKey, publicKey})
+	if err != nil {
+		t.Fatalf("VerifySignatureWithKeys failed: %s", err)
+	}
+
+	err = serverEntryFields.VerifySignatureWithKeys(
+		[]string{incorrectPublicKey})
+	if err == nil {
+		t.Fatalf("VerifySignatureWithKeys unexpectedly succeeded")
+	}
+
 	// Check that an expected, non-local field causes verification to fail
 
 	serverEntryFields[prng.HexString(n)] = prng.HexString(n)
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+// Remote server list deltas allow clients to update to the latest version of
+// the common remote server list without downloading the entire list.
+//
+// The version of a remote server list is the hex-encoded SHA-256 digest of
+// the list's authenticated payload. For each published version, a signed
+// ServerListDelta package is stored at the delta root URL, with the version
+// as the file name; see GetServerListDeltaURL.
+//
+// The delta package for the latest version is a terminal delta, with
+// ToVersion equal to FromVersion and no changes. When a new version is
+// published, the previous version's terminal delta is replaced with a delta
+// to the new version, forming a chain that a client may follow from its
+// current version to the latest version. Publishers may delete old deltas;
+// a client that finds a missing link in the chain falls back to downloading
+// the full list.
+
+// ServerListDelta is the payload of a signed remote server list delta
+// package. AddedServerEntries are encoded server entries, in the remote
+// server list format, that are new or changed in ToVersion.
+// RemovedServerEntryTags are the tags of server entries present in
+// FromVersion and absent from ToVersion.
+type ServerListDelta struct {
+	FromVersion            string
+	ToVersion              string
+	AddedServerEntries     []string `json:",omitempty"`
+	RemovedServerEntryTags []string `json:",omitempty"`
+}
+
+// IsTerminal indicates whether the delta is the terminal delta for the
+// latest version of the list.
+func (delta *ServerListDelta) IsTerminal() bool {
+	return delta.FromVersion == delta.ToVersion
+}
+
+// GetServerListVersion returns the version of the remote server list with
+// the specified authenticated payload.
+func GetServerListVersion(payload string) string {
+	digest := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(digest[:])
+}
+
+// ServerListVersionReader wraps a remote server list payload reader and
+// computes the list version as the payload is streamed.
+type ServerListVersionReader struct {
+	reader io.Reader
+	hash   hash.Hash
+}
+
+// NewServerListVersionReader creates a new ServerListVersionReader.
+func NewServerListVersionReader(payload io.Reader) *ServerListVersionReader {
+	hash := sha256.New()
+	return &ServerListVersionReader{
+		reader: io.TeeReader(payload, hash),
+		hash:   hash,
+	}
+}
+
+// Read implements the io.Reader interface.
+func (reader *ServerListVersionReader) Read(p []byte) (int, error) {
+	return reader.reader.Read(p)
+}
+
+// Version returns the list version. Any remaining, unread payload is
+// consumed.
+func (reader *ServerListVersionReader) Version() (string, error) {
+	_, err := io.Copy(ioutil.Discard, reader.reader)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return hex.EncodeToString(reader.hash.Sum(nil)), nil
+}
+
+// MakeServerListDelta computes the delta between two remote server list
+// payloads. Server entries are matched by tag; a server entry without an
+// explicit tag is matched by its derived tag, as generated by clients.
+func MakeServerListDelta(fromPayload, toPayload string) (*ServerListDelta, error) {
+
+	fromServerEntries, err := getServerListTaggedServerEntries(fromPayload)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	toServerEntries, err := getServerListTaggedServerEntries(toPayload)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	delta := &ServerListDelta{
+		FromVersion: GetServerListVersion(fromPayload),
+		ToVersion:   GetServerListVersion(toPayload),
+	}
+
+	for _, tag := range toServerEntries.tags {
+		encodedServerEntry := toServerEntries.encodedServerEntries[tag]
+		if fromServerEntries.encodedServerEntries[tag] != encodedServerEntry {
+			delta.AddedServerEntries = append(
+				delta.AddedServerEntries, encodedServerEntry)
+		}
+	}
+
+	for _, tag := range fromServerEntries.tags {
+		if _, ok := toServerEntries.encodedServerEntries[tag]; !ok {
+			delta.RemovedServerEntryTags = append(
+				delta.RemovedServerEntryTags, tag)
+		}
+	}
+
+	return delta, nil
+}
+
+type taggedServerEntries struct {
+	tags                 []string
+	encodedServerEntries map[string]string
+}
+
+func getServerListTaggedServerEntries(payload string) (*taggedServerEntries, error) {
+
+	serverEntries := &taggedServerEntries{
+		encodedServerEntries: make(map[string]string),
+	}
+
+	for _, encodedServerEntry := range strings.Split(payload, "\n") {
+		if len(encodedServerEntry) == 0 {
+			continue
+		}
+
+		serverEntryFields, err := DecodeServerEntryFields(encodedServerEntry, "", "")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		tag := serverEntryFields.GetTag()
+		if tag == "" {
+			tag = GenerateServerEntryTag(
+				serverEntryFields.GetIPAddress(),
+				serverEntryFields.GetWebServerSecret())
+		}
+
+		if _, ok := serverEntries.encodedServerEntries[tag]; !ok {
+			serverEntries.tags = append(serverEntries.tags, tag)
+		}
+		serverEntries.encodedServerEntries[tag] = encodedServerEntry
+	}
+
+	return serverEntries, nil
+}
+
+// WriteServerListDeltaPackage creates a signed delta package containing the
+// specified delta. The package is an authenticated data package and is
+// signed with each of the specified remote server list signing keys.
+func WriteServerListDeltaPackage(
+	delta *ServerListDelta,
+	signingKeys []*common.AuthenticatedDataPackageSigningKey) ([]byte, error) {
+
+	deltaJSON, err := json.Marshal(delta)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	deltaPackage, err := common.WriteMultiSignedAuthenticatedDataPackage(
+		string(deltaJSON), signingKeys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return deltaPackage, nil
+}
+
+// ReadServerListDeltaPackage authenticates, using the trusted
+// signingPublicKeys, and extracts the delta from a signed delta package.
+func ReadServerListDeltaPackage(
+	deltaPackage []byte,
+	signingPublicKeys *common.AuthenticatedDataPackageKeys) (*ServerListDelta, error) {
+
+	// The delta payload is JSON and contains escaped characters that are not
+	// supported by NewAuthenticatedDataPackageReader, so the package is read
+	// into memory. Deltas are expected to be small.
+
+	deltaJSON, err := common.ReadAuthenticatedDataPackageWithKeys(
+		deltaPackage, true, signingPublicKeys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var delta *ServerListDelta
+	err = json.Unmarshal([]byte(deltaJSON), &delta)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if delta == nil || delta.FromVersion == "" || delta.ToVersion == "" {
+		return nil, errors.TraceNew("invalid delta")
+	}
+
+	if delta.IsTerminal() &&
+		(len(delta.AddedServerEntries) > 0 || len(delta.RemovedServerEntryTags) > 0) {
+		return nil, errors.TraceNew("invalid terminal delta")
+	}
+
+	return delta, nil
+}
+
+// GetServerListDeltaURL returns the URL of the delta package for the
+// specified list version.
+func GetServerListDeltaURL(rootURL, version string) string {
+	u, err := url.Parse(rootURL)
+	if err != nil {
+		return ""
+	}
+	u.Path = path.Join(u.Path, version)
+	return u.String()
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+)
+
+func TestServerListDelta(t *testing.T) {
+
+	makeServerEntry := func(ipAddress, region string) string {
+		return hex.EncodeToString([]byte(fmt.Sprintf(
+			`%s 80 secret certificate {"ipAddress":"%s","webServerPort":"80","webServerSecret":"secret-%s","webServerCertificate":"certificate","region":"%s"}`,
+			ipAddress, ipAddress, ipAddress, region)))
+	}
+
+	getTag := func(encodedServerEntry string) string {
+		serverEntryFields, err := DecodeServerEntryFields(encodedServerEntry, "", "")
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		return GenerateServerEntryTag(
+			serverEntryFields.GetIPAddress(), serverEntryFields.GetWebServerSecret())
+	}
+
+	unchanged := makeServerEntry("192.168.0.1", "CA")
+	removed := makeServerEntry("192.168.0.2", "CA")
+	changedFrom := makeServerEntry("192.168.0.3", "CA")
+	changedTo := makeServerEntry("192.168.0.3", "US")
+	added := makeServerEntry("192.168.0.4", "CA")
+
+	fromPayload := strings.Join([]string{unchanged, removed, changedFrom}, "\n")
+	toPayload := strings.Join([]string{unchanged, changedTo, added}, "\n")
+
+	delta, err := MakeServerListDelta(fromPayload, toPayload)
+	if err != nil {
+		t.Fatalf("MakeServerListDelta failed: %s", err)
+	}
+
+	if delta.FromVersion != GetServerListVersion(fromPayload) ||
+		delta.ToVersion != GetServerListVersion(toPayload) ||
+		delta.IsTerminal() {
+		t.Fatalf("unexpected delta versions: %+v", delta)
+	}
+
+	if !reflect.DeepEqual(delta.AddedServerEntries, []string{changedTo, added}) {
+		t.Fatalf("unexpected added server entries: %+v", delta.AddedServerEntries)
+	}
+
+	if !reflect.DeepEqual(delta.RemovedServerEntryTags, []string{getTag(removed)}) {
+		t.Fatalf("unexpected removed server entry tags: %+v", delta.RemovedServerEntryTags)
+	}
+
+	// Version must consume any unread payload.
+
+	versionReader := NewServerListVersionReader(strings.NewReader(toPayload))
+	_, err = io.CopyN(ioutil.Discard, versionReader, 10)
+	if err != nil {
+		t.Fatalf("CopyN failed: %s", err)
+	}
+	version, err := versionReader.Version()
+	if err != nil || version != delta.ToVersion {
+		t.Fatalf("unexpected version: %s, %v", version, err)
+	}
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	signingKeys := []*common.AuthenticatedDataPackageSigningKey{
+		{PublicKey: signingPublicKey, PrivateKey: signingPrivateKey},
+	}
+
+	signingPublicKeys := &common.AuthenticatedDataPackageKeys{
+		PublicKeys: []string{signingPublicKey},
+	}
+
+	deltaPackage, err := WriteServerListDeltaPackage(
+		delta, signingKeys)
+	if err != nil {
+		t.Fatalf("WriteServerListDeltaPackage failed: %s", err)
+	}
+
+	readDelta, err := ReadServerListDeltaPackage(
+		deltaPackage, signingPublicKeys)
+	if err != nil {
+		t.Fatalf("ReadServerListDeltaPackage failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(delta, readDelta) {
+		t.Fatalf("unexpected delta: %+v", readDelta)
+	}
+
+	terminalDelta, err := MakeServerListDelta(toPayload, toPayload)
+	if err != nil {
+		t.Fatalf("MakeServerListDelta failed: %s", err)
+	}
+
+	if !terminalDelta.IsTerminal() ||
+		len(terminalDelta.AddedServerEntries) > 0 ||
+		len(terminalDelta.RemovedServerEntryTags) > 0 {
+		t.Fatalf("unexpected terminal delta: %+v", terminalDelta)
+	}
+
+	// An invalid terminal delta must be rejected.
+
+	delta.ToVersion = delta.FromVersion
+
+	deltaPackage, err = WriteServerListDeltaPackage(
+		delta, signingKeys)
+	if err != nil {
+		t.Fatalf("WriteServerListDeltaPackage failed: %s", err)
+	}
+
+	_, err = ReadServerListDeltaPackage(
+		deltaPackage, signingPublicKeys)
+	if err == nil {
+		t.Fatalf("ReadServerListDeltaPackage unexpected success")
+	}
+
+	if GetServerListDeltaURL("https://example.org/deltas/", delta.FromVersion) !=
+		"https://example.org/deltas/"+delta.FromVersion {
+		t.Fatalf("unexpected delta URL")
+	}
+}
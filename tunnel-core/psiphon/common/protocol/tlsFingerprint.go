@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// GetClientHelloJA3 returns the JA3 fingerprint, the MD5 hash of the JA3
+// string, for the specified ClientHello handshake message. See
+// https://github.com/salesforce/ja3.
+//
+// JA3 preserves the order of cipher suites and extensions, so clients which
+// randomize the extension order produce many JA3 fingerprints.
+func GetClientHelloJA3(clientHello []byte) (string, error) {
+
+	JA3, err := getClientHelloJA3String(clientHello)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	hash := md5.Sum([]byte(JA3))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func getClientHelloJA3String(clientHello []byte) (string, error) {
+
+	fields, err := parseClientHelloFields(clientHello)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	// GREASE values are omitted from all JA3 lists.
+
+	var cipherSuites, extensions, curves, pointFormats []string
+
+	for _, cipherSuite := range fields.cipherSuites {
+		if !isGREASEValue(cipherSuite) {
+			cipherSuites = append(cipherSuites, strconv.Itoa(int(cipherSuite)))
+		}
+	}
+
+	for _, extension := range fields.extensions {
+
+		if isGREASEValue(extension.ID) {
+			continue
+		}
+		extensions = append(extensions, strconv.Itoa(int(extension.ID)))
+
+		s := cryptobyte.String(extension.data)
+
+		switch extension.ID {
+		case tlsExtensionSupportedGroups:
+			values, ok := readUint16List(&s)
+			if !ok {
+				return "", errors.TraceNew("invalid supported groups")
+			}
+			for _, value := range values {
+				if !isGREASEValue(value) {
+					curves = append(curves, strconv.Itoa(int(value)))
+				}
+			}
+		case tlsExtensionECPointFormats:
+			var formats cryptobyte.String
+			if !s.ReadUint8LengthPrefixed(&formats) {
+				return "", errors.TraceNew("invalid point formats")
+			}
+			for _, format := range formats {
+				pointFormats = append(pointFormats, strconv.Itoa(int(format)))
+			}
+		}
+	}
+
+	return fmt.Sprintf("%d,%s,%s,%s,%s",
+		fields.legacyVersion,
+		strings.Join(cipherSuites, "-"),
+		strings.Join(extensions, "-"),
+		strings.Join(curves, "-"),
+		strings.Join(pointFormats, "-")), nil
+}
+
+// GetClientHelloJA4 returns the JA4 fingerprint for the specified
+// ClientHello handshake message. isQUIC indicates whether the ClientHello
+// was sent over QUIC or over TCP. See
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md.
+//
+// JA4 sorts cipher suites and extensions, so clients which randomize the
+// extension order produce a single JA4 fingerprint.
+func GetClientHelloJA4(clientHello []byte, isQUIC bool) (string, error) {
+
+	fields, err := parseClientHelloFields(clientHello)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	transport := "t"
+	if isQUIC {
+		transport = "q"
+	}
+
+	version := fields.legacyVersion
+	SNI := "i"
+	ALPN := "00"
+	var cipherSuites, extensions, signatureAlgorithms []string
+
+	for _, cipherSuite := range fields.cipherSuites {
+		if !isGREASEValue(cipherSuite) {
+			cipherSuites = append(cipherSuites, fmt.Sprintf("%04x", cipherSuite))
+		}
+	}
+
+	extensionCount := 0
+
+	for _, extension := range fields.extensions {
+
+		if isGREASEValue(extension.ID) {
+			continue
+		}
+		extensionCount += 1
+
+		s := cryptobyte.String(extension.data)
+
+		switch extension.ID {
+
+		case tlsExtensionServerName:
+			SNI = "d"
+
+		case tlsExtensionALPN:
+			var protocolList, protocol cryptobyte.String
+			if s.ReadUint16LengthPrefixed(&protocolList) &&
+				protocolList.ReadUint8LengthPrefixed(&protocol) &&
+				len(protocol) > 0 {
+				ALPN = getJA4ALPN(protocol)
+			}
+
+		case tlsExtensionSupportedVersion:
+			var versionList cryptobyte.String
+			if !s.ReadUint8LengthPrefixed(&versionList) {
+				return "", errors.TraceNew("invalid supported versions")
+			}
+			values, ok := readUint16Values(&versionList)
+			if !ok {
+				return "", errors.TraceNew("invalid supported versions")
+			}
+			version = 0
+			for _, value := range values {
+				if !isGREASEValue(value) && value > version {
+					version = value
+				}
+			}
+
+		case tlsExtensionSignatureAlgs:
+			values, ok := readUint16List(&s)
+			if !ok {
+				return "", errors.TraceNew("invalid signature algorithms")
+			}
+			for _, value := range values {
+				if !isGREASEValue(value) {
+					signatureAlgorithms = append(
+						signatureAlgorithms, fmt.Sprintf("%04x", value))
+				}
+			}
+		}
+
+		// The SNI and ALPN extensions are counted but not hashed.
+		if extension.ID != tlsExtensionServerName && extension.ID != tlsExtensionALPN {
+			extensions = append(extensions, fmt.Sprintf("%04x", extension.ID))
+		}
+	}
+
+	var versionName string
+	switch version {
+	case 0x0304:
+		versionName = "13"
+	case 0x0303:
+		versionName = "12"
+	case 0x0302:
+		versionName = "11"
+	case 0x0301:
+		versionName = "10"
+	case 0x0300:
+		versionName = "s3"
+	default:
+		versionName = "00"
+	}
+
+	count := func(n int) string {
+		if n > 99 {
+			n = 99
+		}
+		return fmt.Sprintf("%02d", n)
+	}
+
+	sort.Strings(cipherSuites)
+	sort.Strings(extensions)
+
+	extensionsAndSignatureAlgorithms := strings.Join(extensions, ",")
+	if len(signatureAlgorithms) > 0 {
+		extensionsAndSignatureAlgorithms += "_" + strings.Join(signatureAlgorithms, ",")
+	}
+
+	return fmt.Sprintf("%s%s%s%s%s%s_%s_%s",
+		transport,
+		versionName,
+		SNI,
+		count(len(cipherSuites)),
+		count(extensionCount),
+		ALPN,
+		getJA4Hash(cipherSuites, strings.Join(cipherSuites, ",")),
+		getJA4Hash(extensions, extensionsAndSignatureAlgorithms)), nil
+}
+
+// getJA4ALPN returns the first and last characters of the first ALPN
+// protocol or, when either is not alphanumeric, the first and last
+// characters of the hex encoding of the protocol.
+func getJA4ALPN(protocol []byte) string {
+
+	isAlphanumeric := func(b byte) bool {
+		return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+	}
+
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+
+	encoded := hex.EncodeToString(protocol)
+	return string([]byte{encoded[0], encoded[len(encoded)-1]})
+}
+
+func getJA4Hash(values []string, input string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(hash[:])[:12]
+}
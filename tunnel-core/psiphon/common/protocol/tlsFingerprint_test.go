@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"regexp"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+func TestClientHelloFingerprints(t *testing.T) {
+
+	makeClientHello := func(extensions []utls.TLSExtension) []byte {
+		conn := utls.UClient(
+			nil,
+			&utls.Config{ServerName: "www.example.org", InsecureSkipVerify: true},
+			utls.HelloCustom)
+		err := conn.ApplyPreset(&utls.ClientHelloSpec{
+			TLSVersMax: utls.VersionTLS13,
+			TLSVersMin: utls.VersionTLS12,
+			CipherSuites: []uint16{
+				utls.GREASE_PLACEHOLDER,
+				utls.TLS_AES_128_GCM_SHA256,
+				utls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			},
+			CompressionMethods: []byte{0},
+			Extensions:         extensions,
+		})
+		if err != nil {
+			t.Fatalf("ApplyPreset failed: %s", err)
+		}
+		err = conn.BuildHandshakeState()
+		if err != nil {
+			t.Fatalf("BuildHandshakeState failed: %s", err)
+		}
+		return conn.HandshakeState.Hello.Raw
+	}
+
+	newExtensions := func() []utls.TLSExtension {
+		return []utls.TLSExtension{
+			&utls.SNIExtension{},
+			&utls.SupportedCurvesExtension{Curves: []utls.CurveID{utls.X25519, utls.CurveP256}},
+			&utls.SupportedPointsExtension{SupportedPoints: []byte{0}},
+			&utls.SignatureAlgorithmsExtension{
+				SupportedSignatureAlgorithms: []utls.SignatureScheme{
+					utls.ECDSAWithP256AndSHA256, utls.PSSWithSHA256}},
+			&utls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+			&utls.SupportedVersionsExtension{Versions: []uint16{utls.VersionTLS13, utls.VersionTLS12}},
+			&utls.KeyShareExtension{KeyShares: []utls.KeyShare{{Group: utls.X25519}}},
+		}
+	}
+
+	clientHello := makeClientHello(newExtensions())
+
+	JA3String, err := getClientHelloJA3String(clientHello)
+	if err != nil {
+		t.Fatalf("getClientHelloJA3String failed: %s", err)
+	}
+
+	expectedJA3String := "771,4865-49195,0-10-11-13-16-43-51,29-23,0"
+	if JA3String != expectedJA3String {
+		t.Fatalf("unexpected JA3 string: %s", JA3String)
+	}
+
+	JA3, err := GetClientHelloJA3(clientHello)
+	if err != nil {
+		t.Fatalf("GetClientHelloJA3 failed: %s", err)
+	}
+
+	if !regexp.MustCompile("^[0-9a-f]{32}$").MatchString(JA3) {
+		t.Fatalf("unexpected JA3: %s", JA3)
+	}
+
+	JA4, err := GetClientHelloJA4(clientHello, false)
+	if err != nil {
+		t.Fatalf("GetClientHelloJA4 failed: %s", err)
+	}
+
+	if !regexp.MustCompile("^t13d0207h2_[0-9a-f]{12}_[0-9a-f]{12}$").MatchString(JA4) {
+		t.Fatalf("unexpected JA4: %s", JA4)
+	}
+
+	JA4QUIC, err := GetClientHelloJA4(clientHello, true)
+	if err != nil {
+		t.Fatalf("GetClientHelloJA4 failed: %s", err)
+	}
+
+	if JA4QUIC != "q"+JA4[1:] {
+		t.Fatalf("unexpected JA4: %s", JA4QUIC)
+	}
+
+	// Test: adding GREASE and shuffling extensions changes JA3 but not JA4.
+
+	extensions := newExtensions()
+	for i, j := 0, len(extensions)-1; i < j; i, j = i+1, j-1 {
+		extensions[i], extensions[j] = extensions[j], extensions[i]
+	}
+	extensions = append([]utls.TLSExtension{&utls.UtlsGREASEExtension{}}, extensions...)
+
+	shuffledClientHello := makeClientHello(extensions)
+
+	shuffledJA3, err := GetClientHelloJA3(shuffledClientHello)
+	if err != nil {
+		t.Fatalf("GetClientHelloJA3 failed: %s", err)
+	}
+
+	if shuffledJA3 == JA3 {
+		t.Fatalf("unexpected JA3: %s", shuffledJA3)
+	}
+
+	shuffledJA4, err := GetClientHelloJA4(shuffledClientHello, false)
+	if err != nil {
+		t.Fatalf("GetClientHelloJA4 failed: %s", err)
+	}
+
+	if shuffledJA4 != JA4 {
+		t.Fatalf("unexpected JA4: %s != %s", shuffledJA4, JA4)
+	}
+}
+
+func TestClientHelloFingerprintKnownAnswers(t *testing.T) {
+
+	// The expected fingerprints are the published examples from the JA3 and
+	// JA4 specifications. Each ClientHello is constructed with the cipher
+	// suites, extensions, and extension values of the corresponding example.
+
+	// JA3: the "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,
+	// 23-24-25,0" example from https://github.com/salesforce/ja3.
+
+	JA3ClientHello := makeTestClientHello(
+		0x0301,
+		[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		[]testExtension{
+			{tlsExtensionServerName, testServerNameData("www.example.org")},
+			{tlsExtensionSupportedGroups, testUint16ListData(23, 24, 25)},
+			{tlsExtensionECPointFormats, []byte{1, 0}},
+		})
+
+	JA3, err := GetClientHelloJA3(JA3ClientHello)
+	if err != nil {
+		t.Fatalf("GetClientHelloJA3 failed: %s", err)
+	}
+
+	expectedJA3 := "ada70206e40642a3e4461f35503241d5"
+	if JA3 != expectedJA3 {
+		t.Fatalf("unexpected JA3: %s", JA3)
+	}
+
+	// JA4: the Chrome "t13d1516h2_8daaf6152771_e5627efa2ab1" example from
+	// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md,
+	// with GREASE values and Chrome's cipher suite and extension order.
+
+	JA4ClientHello := makeTestClientHello(
+		0x0303,
+		[]uint16{
+			0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		[]testExtension{
+			{0x0a0a, nil},
+			{tlsExtensionServerName, testServerNameData("www.example.org")},
+			{tlsExtensionExtendedMaster, nil},
+			{tlsExtensionRenegotiation, []byte{0}},
+			{tlsExtensionSupportedGroups, testUint16ListData(0x1a1a, 0x001d, 0x0017, 0x0018)},
+			{tlsExtensionECPointFormats, []byte{1, 0}},
+			{tlsExtensionSessionTicket, nil},
+			{tlsExtensionALPN, testALPNData("h2", "http/1.1")},
+			{tlsExtensionStatusRequest, []byte{1, 0, 0, 0, 0}},
+			{tlsExtensionSignatureAlgs, testUint16ListData(
+				0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)},
+			{tlsExtensionSCT, nil},
+			{tlsExtensionKeyShare, testKeyShareData(0x001d, make([]byte, 32))},
+			{tlsExtensionPSKModes, []byte{1, 1}},
+			{tlsExtensionSupportedVersion, []byte{6, 0x2a, 0x2a, 0x03, 0x04, 0x03, 0x03}},
+			{tlsExtensionCompressCert, []byte{2, 0, 2}},
+			{0x4469, testALPNData("h2")},
+			{0x3a3a, []byte{0}},
+			{tlsExtensionPadding, make([]byte, 16)},
+		})
+
+	JA4, err := GetClientHelloJA4(JA4ClientHello, false)
+	if err != nil {
+		t.Fatalf("GetClientHelloJA4 failed: %s", err)
+	}
+
+	expectedJA4 := "t13d1516h2_8daaf6152771_e5627efa2ab1"
+	if JA4 != expectedJA4 {
+		t.Fatalf("unexpected JA4: %s", JA4)
+	}
+}
+
+type testExtension struct {
+	ID   uint16
+	data []byte
+}
+
+func makeTestClientHello(
+	legacyVersion uint16, cipherSuites []uint16, extensions []testExtension) []byte {
+
+	var b cryptobyte.Builder
+	b.AddUint8(1)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(legacyVersion)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, cipherSuite := range cipherSuites {
+				b.AddUint16(cipherSuite)
+			}
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(0)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, extension := range extensions {
+				b.AddUint16(extension.ID)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(extension.data)
+				})
+			}
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func testServerNameData(serverName string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(serverName))
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func testUint16ListData(values ...uint16) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, value := range values {
+			b.AddUint16(value)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+func testALPNData(protocols ...string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, protocol := range protocols {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(protocol))
+			})
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+func testKeyShareData(group uint16, keyExchange []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(group)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(keyExchange)
+		})
+	})
+	return b.BytesOrPanic()
+}
@@ -84,6 +84,12 @@ const (
 
 	NONCE_SIZE = 12
 
+	// MAX_PROBE_RESPONSE_BUFFERED_PACKETS is the maximum number of packets,
+	// received before the anti-probing check, that are retained per peer
+	// for forwarding to a probe response decoy.
+
+	MAX_PROBE_RESPONSE_BUFFERED_PACKETS = 8
+
 	RANDOM_STREAM_LIMIT = 1<<38 - 64
 )
 
@@ -116,12 +122,31 @@ type ObfuscatedPacketConn struct {
 	paddingPRNG      *prng.PRNG
 	decoyPacketCount int32
 	decoyBuffer      []byte
+	probeDecoyAddr   *net.UDPAddr
+
+	// hasConnectionID holds a func([]byte) bool that indicates whether a
+	// short header packet is for an existing QUIC connection.
+	hasConnectionID atomic.Value
 }
 
 type peerMode struct {
 	isObfuscated   bool
 	isIETF         bool
 	lastPacketTime time.Time
+	probeVerified  bool
+	probeBuffer    [][]byte
+	probeDecoyConn *net.UDPConn
+}
+
+// resetProbeResponse clears any probe response state, closing any decoy
+// relay.
+func (p *peerMode) resetProbeResponse() {
+	p.probeVerified = false
+	p.probeBuffer = nil
+	if p.probeDecoyConn != nil {
+		p.probeDecoyConn.Close()
+		p.probeDecoyConn = nil
+	}
 }
 
 func (p *peerMode) isStale() bool {
@@ -191,6 +216,7 @@ func NewObfuscatedPacketConn(
 					packetConn.peerModesMutex.Lock()
 					for address, mode := range packetConn.peerModes {
 						if mode.isStale() {
+							mode.resetProbeResponse()
 							delete(packetConn.peerModes, address)
 						}
 					}
@@ -213,6 +239,15 @@ func (conn *ObfuscatedPacketConn) Close() error {
 	}
 
 	if conn.isServer {
+
+		// Interrupt any probe response decoy relays. divertProbe checks
+		// isClosed while holding peerModesMutex, so no new relays will start.
+		conn.peerModesMutex.Lock()
+		for _, mode := range conn.peerModes {
+			mode.resetProbeResponse()
+		}
+		conn.peerModesMutex.Unlock()
+
 		close(conn.stopBroadcast)
 		conn.runWaitGroup.Wait()
 	}
@@ -220,6 +255,137 @@ func (conn *ObfuscatedPacketConn) Close() error {
 	return conn.OOBCapablePacketConn.Close()
 }
 
+// setProbeResponseDecoy enables forwarding the flows of peers that fail the
+// anti-probing check to the specified decoy UDP service. See divertProbe.
+// setProbeResponseDecoy must be called before any packets are read.
+func (conn *ObfuscatedPacketConn) setProbeResponseDecoy(address string) error {
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	conn.probeDecoyAddr = addr
+
+	return nil
+}
+
+// setConnectionIDChecker sets the function that indicates whether the
+// destination connection ID of a short header packet matches an existing
+// QUIC connection. Until set, no short header packet is for an existing
+// connection.
+func (conn *ObfuscatedPacketConn) setConnectionIDChecker(
+	hasConnectionID func([]byte) bool) {
+
+	conn.hasConnectionID.Store(hasConnectionID)
+}
+
+// isExistingConnectionPacket indicates whether p is a short header packet
+// for an existing QUIC connection.
+func (conn *ObfuscatedPacketConn) isExistingConnectionPacket(p []byte) bool {
+	if len(p) == 0 || (p[0]&0x80) != 0 {
+		return false
+	}
+	hasConnectionID, ok := conn.hasConnectionID.Load().(func([]byte) bool)
+	if !ok {
+		return false
+	}
+	return hasConnectionID(p)
+}
+
+// verifiedProbe records that the peer passed the anti-probing check, and
+// stops retaining its packets.
+func (conn *ObfuscatedPacketConn) verifiedProbe(addr net.Addr) {
+
+	if conn.probeDecoyAddr == nil {
+		return
+	}
+
+	conn.peerModesMutex.Lock()
+	defer conn.peerModesMutex.Unlock()
+
+	mode, ok := conn.peerModes[addr.String()]
+	if ok {
+		mode.probeVerified = true
+		mode.probeBuffer = nil
+	}
+}
+
+// divertProbe starts relaying the flow of a peer that failed the
+// anti-probing check to the probe response decoy. The packets retained from
+// the start of the flow are sent to the decoy, as are all subsequent packets
+// received from the peer; packets received from the decoy are sent to the
+// peer, unobfuscated. In this way, an active prober observes the responses
+// of a genuine UDP service, such as an HTTP/3 server.
+//
+// The relay ends when the peer mode is reaped, or when the decoy is idle for
+// SERVER_IDLE_TIMEOUT.
+//
+// Limitation: packets retained from an obfuscated flow are forwarded in
+// their obfuscated form.
+func (conn *ObfuscatedPacketConn) divertProbe(addr net.Addr) error {
+
+	if conn.probeDecoyAddr == nil {
+		return nil
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return errors.TraceNew("unexpected addr type")
+	}
+
+	conn.peerModesMutex.Lock()
+	defer conn.peerModesMutex.Unlock()
+
+	if atomic.LoadInt32(&conn.isClosed) == 1 {
+		return errors.TraceNew("closed")
+	}
+
+	mode, ok := conn.peerModes[addr.String()]
+	if !ok {
+		return errors.TraceNew("unknown peer")
+	}
+
+	if mode.probeDecoyConn != nil {
+		return nil
+	}
+
+	decoyConn, err := net.DialUDP("udp", nil, conn.probeDecoyAddr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, packet := range mode.probeBuffer {
+		_, _ = decoyConn.Write(packet)
+	}
+
+	mode.probeBuffer = nil
+	mode.probeDecoyConn = decoyConn
+
+	conn.runWaitGroup.Add(1)
+	go func() {
+		defer conn.runWaitGroup.Done()
+
+		buffer := make([]byte, MAX_PACKET_SIZE)
+		for {
+			err := decoyConn.SetReadDeadline(time.Now().Add(SERVER_IDLE_TIMEOUT))
+			if err != nil {
+				return
+			}
+			n, err := decoyConn.Read(buffer)
+			if err != nil {
+				return
+			}
+			_, err = conn.OOBCapablePacketConn.WriteTo(buffer[:n], udpAddr)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
 type temporaryNetError struct {
 	err error
 }
@@ -455,6 +621,12 @@ func (conn *ObfuscatedPacketConn) readPacket(
 				// and handled like new flows and the QUIC session will fail. These cases
 				// include the client immediately redialing and switching from
 				// non-obfuscated to obfuscated or switching obfuscated gQUIC<-->IETF.
+				//
+				// A peer that is redialing, and not stale, remains diverted to any
+				// probe response decoy.
+				if mode.isStale() {
+					mode.resetProbeResponse()
+				}
 				mode.isObfuscated = isObfuscated
 				mode.isIETF = isIETF
 				firstFlowPacket = true
@@ -464,6 +636,23 @@ func (conn *ObfuscatedPacketConn) readPacket(
 			}
 			mode.lastPacketTime = lastPacketTime
 
+			// When a probe response decoy is configured, packets from peers
+			// that failed the anti-probing check are relayed to the decoy and
+			// not processed further; and packets from peers that are not
+			// yet verified are retained for any future relay.
+			if mode.probeDecoyConn != nil {
+				decoyConn := mode.probeDecoyConn
+				conn.peerModesMutex.Unlock()
+				_, _ = decoyConn.Write(p[:n])
+				return n, oobn, flags, addr, true, newTemporaryNetError(
+					errors.Tracef("diverted probe packet"))
+			}
+			if conn.probeDecoyAddr != nil &&
+				!mode.probeVerified &&
+				len(mode.probeBuffer) < MAX_PROBE_RESPONSE_BUFFERED_PACKETS {
+				mode.probeBuffer = append(mode.probeBuffer, append([]byte(nil), p[:n]...))
+			}
+
 			isIETF = mode.isIETF
 			conn.peerModesMutex.Unlock()
 
@@ -541,6 +730,12 @@ func (conn *ObfuscatedPacketConn) readPacket(
 
 				// Enforce the MIN_INITIAL_PACKET_SIZE size requirement for new flows.
 				//
+				// The first packet from a client that has migrated an existing
+				// connection to a new address is a short header packet, which
+				// is exempt only when its destination connection ID matches an
+				// existing connection. A connection ID checker is set only
+				// when the server accepts connection migration.
+				//
 				// Limitations:
 				//
 				// - The Initial packet may be sent more than once, but we
@@ -548,7 +743,8 @@ func (conn *ObfuscatedPacketConn) readPacket(
 				// - For session resumption, the first packet may be a
 				//   Handshake packet, not an Initial packet, and can be smaller.
 
-				if isIETF && n < MIN_INITIAL_PACKET_SIZE {
+				if isIETF && n < MIN_INITIAL_PACKET_SIZE &&
+					!conn.isExistingConnectionPacket(p[0:n]) {
 					return n, oobn, flags, addr, true, newTemporaryNetError(errors.Tracef(
 						"unexpected first QUIC packet length: %d", n))
 				}
@@ -71,6 +71,15 @@ const (
 	SERVER_IDLE_TIMEOUT      = 5 * time.Minute
 	CLIENT_IDLE_TIMEOUT      = 30 * time.Second
 	UDP_PACKET_WRITE_TIMEOUT = 1 * time.Second
+
+	// MAX_DATAGRAM_SIZE is the maximum size of a datagram sent with
+	// Conn.SendDatagram. This conservative value ensures that a DATAGRAM
+	// frame fits in a single QUIC packet at the minimum IPv6 packet size,
+	// after deducting obfuscation, QUIC packet header, and AEAD overhead;
+	// quic-go does not fragment DATAGRAM frames.
+	MAX_DATAGRAM_SIZE = 1150
+
+	datagramQueueSize = 128
 )
 
 // Enabled indicates if QUIC functionality is enabled.
@@ -139,12 +148,22 @@ type Listener struct {
 }
 
 // Listen creates a new Listener.
+//
+// When probeResponseDecoyAddress is not blank, the flows of peers that fail
+// the anti-probing check are relayed to the UDP service at that address,
+// instead of receiving no response.
+//
+// When enableActiveMigration is set, IETF QUIC clients may migrate
+// connections to a new address. The server doesn't validate the new path
+// with PATH_CHALLENGE frames.
 func Listen(
 	logger common.Logger,
 	irregularTunnelLogger func(string, error, common.LogFields),
 	address string,
 	obfuscationKey string,
-	enableGQUIC bool) (net.Listener, error) {
+	enableGQUIC bool,
+	enableActiveMigration bool,
+	probeResponseDecoyAddress string) (net.Listener, error) {
 
 	certificate, privateKey, err := common.GenerateWebServerCertificate(
 		values.GetHostName())
@@ -181,6 +200,14 @@ func Listen(
 		return nil, errors.Trace(err)
 	}
 
+	if probeResponseDecoyAddress != "" {
+		err = obfuscatedPacketConn.setProbeResponseDecoy(probeResponseDecoyAddress)
+		if err != nil {
+			obfuscatedPacketConn.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+
 	// QUIC clients must prove knowledge of the obfuscated key via a message
 	// sent in the TLS ClientHello random field, or receive no UDP packets
 	// back from the server. This anti-probing mechanism is implemented using
@@ -188,11 +215,32 @@ func Listen(
 	// mechanisms. The replay history TTL is set to the validity period of
 	// the passthrough message.
 	//
-	// Irregular events are logged for invalid client activity.
+	// Irregular events are logged for invalid client activity. When a probe
+	// response decoy is configured, the peer is diverted to the decoy and
+	// the irregular event records the probe response.
 
 	clientRandomHistory := obfuscator.NewSeedHistory(
 		&obfuscator.SeedHistoryConfig{SeedTTL: obfuscator.TLS_PASSTHROUGH_TIME_PERIOD})
 
+	divertProbe := func(remoteAddr net.Addr, logFields common.LogFields) common.LogFields {
+		if probeResponseDecoyAddress == "" {
+			return logFields
+		}
+		err := obfuscatedPacketConn.divertProbe(remoteAddr)
+		if err != nil {
+			if logger != nil {
+				logger.WithTraceFields(
+					common.LogFields{"error": err}).Warning("divertProbe failed")
+			}
+			return logFields
+		}
+		if logFields == nil {
+			logFields = make(common.LogFields)
+		}
+		logFields[obfuscator.PROBE_RESPONSE_LOG_FIELD_NAME] = obfuscator.PROBE_RESPONSE_DECOY
+		return logFields
+	}
+
 	verifyClientHelloRandom := func(remoteAddr net.Addr, clientHelloRandom []byte) bool {
 
 		ok := obfuscator.VerifyTLSPassthroughMessage(
@@ -201,7 +249,7 @@ func Listen(
 			irregularTunnelLogger(
 				common.IPAddressFromAddr(remoteAddr),
 				errors.TraceNew("invalid client random message"),
-				nil)
+				divertProbe(remoteAddr, nil))
 			return false
 		}
 
@@ -220,7 +268,11 @@ func Listen(
 			irregularTunnelLogger(
 				common.IPAddressFromAddr(remoteAddr),
 				errors.TraceNew("duplicate client random message"),
-				*logFields)
+				divertProbe(remoteAddr, *logFields))
+		}
+
+		if ok {
+			obfuscatedPacketConn.verifiedProbe(remoteAddr)
 		}
 
 		return ok
@@ -239,7 +291,10 @@ func Listen(
 		// pumping read packets though mux channels.
 
 		tlsConfig, ietfQUICConfig := makeIETFConfig(
-			obfuscatedPacketConn, verifyClientHelloRandom, tlsCertificate)
+			obfuscatedPacketConn,
+			verifyClientHelloRandom,
+			tlsCertificate,
+			enableActiveMigration)
 
 		listener, err := ietf_quic.Listen(
 			obfuscatedPacketConn, tlsConfig, ietfQUICConfig)
@@ -248,6 +303,11 @@ func Listen(
 			return nil, errors.Trace(err)
 		}
 
+		if enableActiveMigration {
+			obfuscatedPacketConn.setConnectionIDChecker(
+				listener.HasShortHeaderConnectionID)
+		}
+
 		quicListener = &ietfQUICListener{Listener: listener}
 
 	} else {
@@ -256,7 +316,11 @@ func Listen(
 		// return and caller calls Accept.
 
 		muxListener, err := newMuxListener(
-			logger, verifyClientHelloRandom, obfuscatedPacketConn, tlsCertificate)
+			logger,
+			verifyClientHelloRandom,
+			obfuscatedPacketConn,
+			tlsCertificate,
+			enableActiveMigration)
 		if err != nil {
 			obfuscatedPacketConn.Close()
 			return nil, errors.Trace(err)
@@ -275,7 +339,8 @@ func Listen(
 func makeIETFConfig(
 	conn *ObfuscatedPacketConn,
 	verifyClientHelloRandom func(net.Addr, []byte) bool,
-	tlsCertificate tls.Certificate) (*tls.Config, *ietf_quic.Config) {
+	tlsCertificate tls.Certificate,
+	enableActiveMigration bool) (*tls.Config, *ietf_quic.Config) {
 
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{tlsCertificate},
@@ -305,10 +370,30 @@ func makeIETFConfig(
 		// negotiation packet.
 		DisableVersionNegotiationPackets: true,
 
+		// Datagram support is always enabled for servers, and is used only
+		// when clients also enable datagrams. The server's transport
+		// parameters are encrypted, so this doesn't change the server's
+		// fingerprint.
+		EnableDatagrams: true,
+
 		VerifyClientHelloRandom:       verifyClientHelloRandom,
 		ServerMaxPacketSizeAdjustment: conn.serverMaxPacketSizeAdjustment,
 	}
 
+	// When enabled, client connection migration is accepted. As with
+	// datagrams, this doesn't change the server's fingerprint. A migrated
+	// client has already passed the anti-probing check, so its new address
+	// is marked as verified.
+	//
+	// Limitation: the new path is not validated with PATH_CHALLENGE frames,
+	// so migration is disabled by default.
+	if enableActiveMigration {
+		ietfQUICConfig.ServerEnableActiveMigration = true
+		ietfQUICConfig.ServerMigratedPath = func(_, newAddr net.Addr) {
+			conn.verifiedProbe(newAddr)
+		}
+	}
+
 	return tlsConfig, ietfQUICConfig
 }
 
@@ -326,6 +411,7 @@ func (listener *Listener) Accept() (net.Conn, error) {
 	return &Conn{
 		session:              session,
 		deferredAcceptStream: true,
+		enableDatagrams:      true,
 	}, nil
 }
 
@@ -348,6 +434,11 @@ func (listener *Listener) Close() error {
 //
 // Keep alive and idle timeout functionality in QUIC is disabled as these
 // aspects are expected to be handled at a higher level.
+//
+// enableDatagrams indicates whether to offer QUIC datagram (RFC 9221)
+// support. Datagram support adds a transport parameter to the ClientHello
+// and so is a distinct fingerprint. Use Conn.SupportsDatagrams to check if
+// the server also supports datagrams.
 func Dial(
 	ctx context.Context,
 	packetConn net.PacketConn,
@@ -357,7 +448,8 @@ func Dial(
 	clientHelloSeed *prng.Seed,
 	obfuscationKey string,
 	obfuscationPaddingSeed *prng.Seed,
-	disablePathMTUDiscovery bool) (net.Conn, error) {
+	disablePathMTUDiscovery bool,
+	enableDatagrams bool) (net.Conn, error) {
 
 	if quicVersion == "" {
 		return nil, errors.TraceNew("missing version")
@@ -395,6 +487,21 @@ func Dial(
 		udpConn: udpConn,
 	}
 
+	// Connection migration is supported only for obfuscated IETF QUIC. The
+	// server cannot distinguish between non-obfuscated and obfuscated flows
+	// when the first packet from a new client address is not an Initial
+	// packet; the server assumes such a packet is obfuscated.
+	//
+	// migratablePacketConn is beneath ObfuscatedPacketConn so that the
+	// obfuscation state, including any remaining decoy packets, is retained
+	// across migrations.
+
+	var migratableConn *migratablePacketConn
+	if isObfuscated(quicVersion) && isIETFVersionNumber(versionNumber) {
+		migratableConn = newMigratablePacketConn(packetConn.(*writeTimeoutUDPConn))
+		packetConn = migratableConn
+	}
+
 	maxPacketSizeAdjustment := 0
 
 	if isObfuscated(quicVersion) {
@@ -449,6 +556,7 @@ func Dial(
 		getClientHelloRandom,
 		maxPacketSizeAdjustment,
 		disablePathMTUDiscovery,
+		enableDatagrams,
 		false)
 	if err != nil {
 		packetConn.Close()
@@ -473,9 +581,11 @@ func Dial(
 
 		resultChannel <- dialResult{
 			conn: &Conn{
-				packetConn: packetConn,
-				session:    session,
-				stream:     stream,
+				packetConn:           packetConn,
+				migratablePacketConn: migratableConn,
+				session:              session,
+				stream:               stream,
+				enableDatagrams:      enableDatagrams,
 			},
 		}
 	}()
@@ -589,10 +699,143 @@ func (conn *writeTimeoutUDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, e
 	return conn.udpConn.WriteToUDP(b, addr)
 }
 
+// migratablePacketConn is a packet conn whose underlying UDP socket may be
+// replaced, for client connection migration. From the perspective of the
+// server, a migration is equivalent to a NAT rebinding: the client continues
+// to send packets, with the same connection ID, from a new address.
+//
+// quic-go indexes packet conns by local address, so LocalAddr always
+// returns the address of the original socket. The original socket remains
+// open, but is not read, until Close, so that its port, and the quic-go
+// index, isn't reused while the migrated connection is active.
+//
+// Limitation: quic-go socket options, including the don't fragment and ECN
+// options, are set only on the original socket.
+type migratablePacketConn struct {
+	originalConn *writeTimeoutUDPConn
+
+	mutex       sync.Mutex
+	currentConn *writeTimeoutUDPConn
+	isClosed    bool
+}
+
+func newMigratablePacketConn(conn *writeTimeoutUDPConn) *migratablePacketConn {
+	return &migratablePacketConn{
+		originalConn: conn,
+		currentConn:  conn,
+	}
+}
+
+// migrate replaces the current socket with conn. Any blocked read on the
+// previous socket is interrupted and resumed on conn.
+func (conn *migratablePacketConn) migrate(newConn *writeTimeoutUDPConn) error {
+
+	conn.mutex.Lock()
+	if conn.isClosed {
+		conn.mutex.Unlock()
+		newConn.Close()
+		return errors.TraceNew("closed")
+	}
+	previousConn := conn.currentConn
+	conn.currentConn = newConn
+	conn.mutex.Unlock()
+
+	if previousConn == conn.originalConn {
+		// Interrupt any blocked read without closing the original socket.
+		return errors.Trace(previousConn.SetReadDeadline(time.Now()))
+	}
+
+	return errors.Trace(previousConn.Close())
+}
+
+func (conn *migratablePacketConn) getCurrentConn() *writeTimeoutUDPConn {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.currentConn
+}
+
+// isMigratedFrom indicates whether a read on readConn failed due to a
+// migration, in which case the read should be retried on the current
+// socket.
+func (conn *migratablePacketConn) isMigratedFrom(readConn *writeTimeoutUDPConn) bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return !conn.isClosed && readConn != conn.currentConn
+}
+
+func (conn *migratablePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		readConn := conn.getCurrentConn()
+		n, addr, err := readConn.ReadFrom(b)
+		if err != nil && n <= 0 && conn.isMigratedFrom(readConn) {
+			continue
+		}
+		// Do not wrap any I/O err returned by udpConn
+		return n, addr, err
+	}
+}
+
+func (conn *migratablePacketConn) ReadMsgUDP(b, oob []byte) (int, int, int, *net.UDPAddr, error) {
+	for {
+		readConn := conn.getCurrentConn()
+		n, oobn, flags, addr, err := readConn.ReadMsgUDP(b, oob)
+		if err != nil && n <= 0 && conn.isMigratedFrom(readConn) {
+			continue
+		}
+		// Do not wrap any I/O err returned by udpConn
+		return n, oobn, flags, addr, err
+	}
+}
+
+func (conn *migratablePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// Do not wrap any I/O err returned by udpConn
+	return conn.getCurrentConn().WriteTo(b, addr)
+}
+
+func (conn *migratablePacketConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (int, int, error) {
+	// Do not wrap any I/O err returned by udpConn
+	return conn.getCurrentConn().WriteMsgUDP(b, oob, addr)
+}
+
+func (conn *migratablePacketConn) Close() error {
+
+	conn.mutex.Lock()
+	conn.isClosed = true
+	currentConn := conn.currentConn
+	conn.mutex.Unlock()
+
+	err := currentConn.Close()
+	if currentConn != conn.originalConn {
+		_ = conn.originalConn.Close()
+	}
+	return err
+}
+
+func (conn *migratablePacketConn) LocalAddr() net.Addr {
+	return conn.originalConn.LocalAddr()
+}
+
+func (conn *migratablePacketConn) SetDeadline(t time.Time) error {
+	return conn.getCurrentConn().SetDeadline(t)
+}
+
+func (conn *migratablePacketConn) SetReadDeadline(t time.Time) error {
+	return conn.getCurrentConn().SetReadDeadline(t)
+}
+
+func (conn *migratablePacketConn) SetWriteDeadline(t time.Time) error {
+	return conn.getCurrentConn().SetWriteDeadline(t)
+}
+
+func (conn *migratablePacketConn) SyscallConn() (syscall.RawConn, error) {
+	return conn.getCurrentConn().SyscallConn()
+}
+
 // Conn is a net.Conn and psiphon/common.Closer.
 type Conn struct {
-	packetConn net.PacketConn
-	session    quicSession
+	packetConn           net.PacketConn
+	migratablePacketConn *migratablePacketConn
+	session              quicSession
 
 	deferredAcceptStream bool
 
@@ -603,6 +846,12 @@ type Conn struct {
 	readMutex  sync.Mutex
 	writeMutex sync.Mutex
 
+	enableDatagrams bool
+	datagramsOnce   sync.Once
+	datagrams       chan []byte
+	datagramsDone   chan struct{}
+	datagramsErr    error
+
 	isClosed int32
 }
 
@@ -736,6 +985,143 @@ func (conn *Conn) SetWriteDeadline(t time.Time) error {
 	return conn.stream.SetWriteDeadline(t)
 }
 
+// SupportsDatagrams indicates whether both peers enabled QUIC datagram (RFC
+// 9221) support. Datagrams are not supported for gQUIC.
+func (conn *Conn) SupportsDatagrams() bool {
+	if !conn.enableDatagrams {
+		return false
+	}
+	session, ok := conn.session.(*ietfQUICSession)
+	if !ok {
+		return false
+	}
+
+	// ConnectionState.SupportsDatagrams reflects only the peer's transport
+	// parameters.
+	return session.ConnectionState().SupportsDatagrams
+}
+
+// SupportsMigration indicates whether the client may migrate the connection
+// to a new local socket with Migrate. Migration requires an obfuscated IETF
+// QUIC version and a server that accepts migration.
+func (conn *Conn) SupportsMigration() bool {
+	if conn.migratablePacketConn == nil {
+		return false
+	}
+	session, ok := conn.session.(*ietfQUICSession)
+	if !ok {
+		return false
+	}
+	return session.ConnectionState().SupportsActiveMigration
+}
+
+// Migrate moves the connection to packetConn, a new local UDP socket, such as
+// one created after the client's network changes. packetConn must be
+// suitable for sending to the original server address, and is closed when
+// the Conn is closed.
+//
+// Migrate does not validate the new path; migration fails, and the QUIC
+// connection idles out, when the server doesn't receive packets from the
+// new socket. The caller should promptly send data, such as a keep alive,
+// and treat any timeout as a connection failure.
+func (conn *Conn) Migrate(packetConn net.PacketConn) error {
+
+	if !conn.SupportsMigration() {
+		packetConn.Close()
+		return errors.TraceNew("migration not supported")
+	}
+
+	udpConn, ok := packetConn.(udpConn)
+	if !ok {
+		packetConn.Close()
+		return errors.TraceNew("packetConn must implement net.UDPConn functions")
+	}
+
+	err := conn.migratablePacketConn.migrate(&writeTimeoutUDPConn{udpConn: udpConn})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// MaxDatagramSize returns the maximum size of datagrams that may be sent
+// with SendDatagram.
+func (conn *Conn) MaxDatagramSize() int {
+	return MAX_DATAGRAM_SIZE
+}
+
+// SendDatagram sends an unreliable datagram. The datagram must not be larger
+// than MaxDatagramSize. SendDatagram requires SupportsDatagrams.
+func (conn *Conn) SendDatagram(datagram []byte) error {
+
+	session, ok := conn.session.(*ietfQUICSession)
+	if !ok {
+		return errors.TraceNew("datagrams not supported")
+	}
+
+	if len(datagram) > MAX_DATAGRAM_SIZE {
+		return errors.Tracef("datagram too large: %d", len(datagram))
+	}
+
+	err := session.SendMessage(datagram)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// ReceiveDatagram returns the next received datagram, blocking until a
+// datagram is received, the QUIC session is closed, or ctx is done.
+// ReceiveDatagram requires SupportsDatagrams.
+//
+// Received datagrams are relayed through a single queue per Conn, so
+// ReceiveDatagram callers that are interrupted by ctx do not cause
+// datagrams to be lost. When the queue is full, received datagrams are
+// dropped.
+func (conn *Conn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+
+	session, ok := conn.session.(*ietfQUICSession)
+	if !ok {
+		return nil, errors.TraceNew("datagrams not supported")
+	}
+
+	conn.datagramsOnce.Do(func() {
+		conn.datagrams = make(chan []byte, datagramQueueSize)
+		conn.datagramsDone = make(chan struct{})
+		go conn.relayDatagrams(session)
+	})
+
+	select {
+	case datagram := <-conn.datagrams:
+		return datagram, nil
+	case <-conn.datagramsDone:
+		return nil, conn.datagramsErr
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+func (conn *Conn) relayDatagrams(session *ietfQUICSession) {
+
+	// The underlying quic-go ReceiveMessage cannot be interrupted, so a
+	// single goroutine receives all datagrams until the session is closed.
+
+	for {
+		datagram, err := session.ReceiveMessage()
+		if err != nil {
+			conn.datagramsErr = errors.Trace(err)
+			close(conn.datagramsDone)
+			return
+		}
+		select {
+		case conn.datagrams <- datagram:
+		default:
+		}
+	}
+}
+
 // QUICTransporter implements the psiphon.transporter interface, used in
 // psiphon.MeekConn for HTTP requests, which requires a RoundTripper and
 // CloseIdleConnections.
@@ -871,6 +1257,7 @@ func (t *QUICTransporter) dialQUIC() (retSession quicSession, retErr error) {
 		nil,
 		0,
 		t.disablePathMTUDiscovery,
+		false,
 		true)
 	if err != nil {
 		packetConn.Close()
@@ -998,6 +1385,7 @@ func dialQUIC(
 	getClientHelloRandom func() ([]byte, error),
 	clientMaxPacketSizeAdjustment int,
 	disablePathMTUDiscovery bool,
+	enableDatagrams bool,
 	dialEarly bool) (quicSession, error) {
 
 	if isIETFVersionNumber(versionNumber) {
@@ -1011,6 +1399,7 @@ func dialQUIC(
 			GetClientHelloRandom:          getClientHelloRandom,
 			ClientMaxPacketSizeAdjustment: clientMaxPacketSizeAdjustment,
 			DisablePathMTUDiscovery:       disablePathMTUDiscovery,
+			EnableDatagrams:               enableDatagrams,
 		}
 
 		deadline, ok := ctx.Deadline()
@@ -1188,7 +1577,8 @@ func newMuxListener(
 	logger common.Logger,
 	verifyClientHelloRandom func(net.Addr, []byte) bool,
 	conn *ObfuscatedPacketConn,
-	tlsCertificate tls.Certificate) (*muxListener, error) {
+	tlsCertificate tls.Certificate,
+	enableActiveMigration bool) (*muxListener, error) {
 
 	listener := &muxListener{
 		logger:           logger,
@@ -1207,12 +1597,16 @@ func newMuxListener(
 	listener.ietfQUICConn = newMuxPacketConn(conn.LocalAddr(), listener)
 
 	tlsConfig, ietfQUICConfig := makeIETFConfig(
-		conn, verifyClientHelloRandom, tlsCertificate)
+		conn, verifyClientHelloRandom, tlsCertificate, enableActiveMigration)
 
 	il, err := ietf_quic.Listen(listener.ietfQUICConn, tlsConfig, ietfQUICConfig)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+
+	if enableActiveMigration {
+		conn.setConnectionIDChecker(il.HasShortHeaderConnectionID)
+	}
 	listener.ietfQUICListener = &ietfQUICListener{Listener: il}
 
 	listener.gQUICConn = newMuxPacketConn(conn.LocalAddr(), listener)
@@ -46,7 +46,9 @@ func Listen(
 	_ func(string, error, common.LogFields),
 	_ string,
 	_ string,
-	_ bool) (net.Listener, error) {
+	_ bool,
+	_ bool,
+	_ string) (net.Listener, error) {
 
 	return nil, errors.TraceNew("operation is not enabled")
 }
@@ -60,11 +62,40 @@ func Dial(
 	_ *prng.Seed,
 	_ string,
 	_ *prng.Seed,
+	_ bool,
 	_ bool) (net.Conn, error) {
 
 	return nil, errors.TraceNew("operation is not enabled")
 }
 
+type Conn struct {
+	net.Conn
+}
+
+func (conn *Conn) SupportsDatagrams() bool {
+	return false
+}
+
+func (conn *Conn) MaxDatagramSize() int {
+	return 0
+}
+
+func (conn *Conn) SendDatagram(_ []byte) error {
+	return errors.TraceNew("operation is not enabled")
+}
+
+func (conn *Conn) ReceiveDatagram(_ context.Context) ([]byte, error) {
+	return nil, errors.TraceNew("operation is not enabled")
+}
+
+func (conn *Conn) SupportsMigration() bool {
+	return false
+}
+
+func (conn *Conn) Migrate(_ net.PacketConn) error {
+	return errors.TraceNew("operation is not enabled")
+}
+
 type QUICTransporter struct {
 }
 
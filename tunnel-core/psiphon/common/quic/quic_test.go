@@ -23,6 +23,7 @@
 package quic
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -35,7 +36,9 @@ import (
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/obfuscator"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -45,16 +48,21 @@ func TestQUIC(t *testing.T) {
 			if isGQUIC(quicVersion) && !GQUICEnabled() {
 				t.Skipf("gQUIC is not enabled")
 			}
-			runQUIC(t, quicVersion, GQUICEnabled(), false)
+			runQUIC(t, quicVersion, GQUICEnabled(), false, false)
 		})
 		if isIETF(quicVersion) {
 			t.Run(fmt.Sprintf("%s (invoke anti-probing)", quicVersion), func(t *testing.T) {
-				runQUIC(t, quicVersion, GQUICEnabled(), true)
+				runQUIC(t, quicVersion, GQUICEnabled(), false, true)
 			})
 		}
 		if isIETF(quicVersion) {
 			t.Run(fmt.Sprintf("%s (disable gQUIC)", quicVersion), func(t *testing.T) {
-				runQUIC(t, quicVersion, false, false)
+				runQUIC(t, quicVersion, false, false, false)
+			})
+		}
+		if isIETF(quicVersion) {
+			t.Run(fmt.Sprintf("%s (enable active migration)", quicVersion), func(t *testing.T) {
+				runQUIC(t, quicVersion, GQUICEnabled(), true, false)
 			})
 		}
 	}
@@ -64,6 +72,7 @@ func runQUIC(
 	t *testing.T,
 	quicVersion string,
 	enableGQUIC bool,
+	enableActiveMigration bool,
 	invokeAntiProbing bool) {
 
 	initGoroutines := getGoroutines()
@@ -97,7 +106,9 @@ func runQUIC(
 		irregularTunnelLogger,
 		"127.0.0.1:0",
 		obfuscationKey,
-		enableGQUIC)
+		enableGQUIC,
+		enableActiveMigration,
+		"")
 	if err != nil {
 		t.Fatalf("Listen failed: %s", err)
 	}
@@ -123,6 +134,19 @@ func runQUIC(
 				return errors.Trace(err)
 			}
 
+			if conn.(*Conn).SupportsDatagrams() {
+				serverGroup.Go(func() error {
+					for {
+						datagram, err := conn.(*Conn).ReceiveDatagram(context.Background())
+						if err != nil {
+							// The session is closed.
+							return nil
+						}
+						_ = conn.(*Conn).SendDatagram(datagram)
+					}
+				})
+			}
+
 			serverGroup.Go(func() error {
 				b := make([]byte, 1024)
 				for {
@@ -152,6 +176,8 @@ func runQUIC(
 	for i := 0; i < clients; i++ {
 
 		disablePathMTUDiscovery := i%2 == 0
+		enableDatagrams := i%3 == 0
+		migrate := i%2 == 1
 
 		testGroup.Go(func() error {
 
@@ -197,7 +223,8 @@ func runQUIC(
 				clientHelloSeed,
 				clientObfuscationKey,
 				obfuscationPaddingSeed,
-				disablePathMTUDiscovery)
+				disablePathMTUDiscovery,
+				enableDatagrams)
 
 			if invokeAntiProbing {
 
@@ -224,6 +251,26 @@ func runQUIC(
 			// Cancel should interrupt dialing only
 			cancelFunc()
 
+			expectDatagrams := enableDatagrams && isIETF(quicVersion)
+			if conn.(*Conn).SupportsDatagrams() != expectDatagrams {
+				return errors.Tracef(
+					"unexpected SupportsDatagrams: %v", !expectDatagrams)
+			}
+
+			if expectDatagrams {
+				err := exchangeDatagram(conn.(*Conn))
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			expectMigration := enableActiveMigration &&
+				isObfuscated(quicVersion) && isIETF(quicVersion)
+			if conn.(*Conn).SupportsMigration() != expectMigration {
+				return errors.Tracef(
+					"unexpected SupportsMigration: %v", !expectMigration)
+			}
+
 			var clientGroup errgroup.Group
 
 			clientGroup.Go(func() error {
@@ -245,6 +292,28 @@ func runQUIC(
 
 			clientGroup.Go(func() error {
 				b := make([]byte, bytesToSend)
+
+				// When migrating, the server must send the remaining echoed
+				// bytes to the new socket, as the original socket is no
+				// longer read.
+
+				if migrate && expectMigration {
+					_, err := conn.Write(b[:bytesToSend/2])
+					if err != nil {
+						return errors.Trace(err)
+					}
+					b = b[bytesToSend/2:]
+
+					migratedPacketConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+					if err != nil {
+						return errors.Trace(err)
+					}
+					err = conn.(*Conn).Migrate(migratedPacketConn)
+					if err != nil {
+						return errors.Trace(err)
+					}
+				}
+
 				_, err := conn.Write(b)
 				if err != nil {
 					return errors.Trace(err)
@@ -333,6 +402,167 @@ func runQUIC(
 	}
 }
 
+func TestQUICProbeResponseDecoy(t *testing.T) {
+
+	quicVersion := protocol.QUIC_VERSION_V1
+
+	// The decoy service counts received packets and sends no responses.
+
+	decoyConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer decoyConn.Close()
+
+	decoyReceivedPackets := int32(0)
+
+	go func() {
+		b := make([]byte, MAX_PACKET_SIZE)
+		for {
+			_, _, err := decoyConn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&decoyReceivedPackets, 1)
+		}
+	}()
+
+	irregularTunnelLogFields := make(chan common.LogFields, 16)
+
+	irregularTunnelLogger := func(_ string, _ error, logFields common.LogFields) {
+		select {
+		case irregularTunnelLogFields <- logFields:
+		default:
+		}
+	}
+
+	obfuscationKey := prng.HexString(32)
+
+	listener, err := Listen(
+		nil,
+		irregularTunnelLogger,
+		"127.0.0.1:0",
+		obfuscationKey,
+		false,
+		false,
+		decoyConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dial := func(clientObfuscationKey string) error {
+
+		ctx, cancelFunc := context.WithTimeout(
+			context.Background(), 1*time.Second)
+		defer cancelFunc()
+
+		remoteAddr, err := net.ResolveUDPAddr("udp", serverAddress)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		packetConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		obfuscationPaddingSeed, err := prng.NewSeed()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		conn, err := Dial(
+			ctx,
+			packetConn,
+			remoteAddr,
+			serverAddress,
+			quicVersion,
+			nil,
+			clientObfuscationKey,
+			obfuscationPaddingSeed,
+			false,
+			false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		conn.Close()
+
+		return nil
+	}
+
+	// A client that passes the anti-probing check is not diverted.
+
+	err = dial(obfuscationKey)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	if atomic.LoadInt32(&decoyReceivedPackets) != 0 {
+		t.Fatalf("unexpected decoy packets")
+	}
+
+	// A client that fails the anti-probing check is diverted to the decoy.
+
+	err = dial(prng.HexString(32))
+	if err == nil {
+		t.Fatalf("unexpected dial success with invalid client hello random")
+	}
+
+	if atomic.LoadInt32(&decoyReceivedPackets) == 0 {
+		t.Fatalf("missing decoy packets")
+	}
+
+	select {
+	case logFields := <-irregularTunnelLogFields:
+		if logFields[obfuscator.PROBE_RESPONSE_LOG_FIELD_NAME] != obfuscator.PROBE_RESPONSE_DECOY {
+			t.Fatalf("unexpected log fields: %+v", logFields)
+		}
+	default:
+		t.Fatalf("missing irregular tunnel log")
+	}
+}
+
+func exchangeDatagram(conn *Conn) error {
+
+	// Datagrams are unreliable, so resend until an echo is received.
+
+	datagram := prng.Bytes(conn.MaxDatagramSize())
+
+	for i := 0; i < 10; i++ {
+
+		err := conn.SendDatagram(datagram)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		ctx, cancelFunc := context.WithTimeout(
+			context.Background(), 100*time.Millisecond)
+		echo, err := conn.ReceiveDatagram(ctx)
+		cancelFunc()
+		if err == nil {
+			if !bytes.Equal(echo, datagram) {
+				return errors.TraceNew("unexpected datagram echo")
+			}
+			return nil
+		}
+	}
+
+	return errors.TraceNew("no datagram echo received")
+}
+
 type countReadsConn struct {
 	net.PacketConn
 	readCount int32
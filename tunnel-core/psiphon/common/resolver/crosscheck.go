@@ -0,0 +1,381 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+const (
+	CROSS_CHECK_SOURCE_SYSTEM    = "system"
+	CROSS_CHECK_SOURCE_ALTERNATE = "alternate"
+)
+
+// CrossCheckResult summarizes a cross-check mode ResolveIP, for metrics.
+//
+// In cross-check mode, after the primary resolution, ResolveIP queries
+// additional sources -- the system DNS server and the alternate DNS server,
+// when each is available and was not the primary source -- and compares the
+// answers. A and, when there is an IPv6 route, AAAA records are
+// cross-checked. Each query also awaits, for
+// ResolveParameters.CrossCheckAwaitTimeout, additional responses after its
+// first valid response, to detect injected responses.
+type CrossCheckResult struct {
+
+	// Sources is the number of sources, including the primary source, that
+	// returned an answer.
+	Sources int
+
+	// Mismatch indicates that at least one pair of answers had no IPs in
+	// common. Note that CDNs may legitimately return disjoint answers to
+	// different resolvers, so a mismatch is a signal, not proof, of
+	// poisoning.
+	Mismatch bool
+
+	// Injection indicates that a single query received multiple valid
+	// responses with differing IPs, which is a strong indication of response
+	// injection.
+	Injection bool
+
+	// TTLAnomaly indicates that a single query received multiple valid
+	// responses with the same IPs but differing TTLs.
+	TTLAnomaly bool
+
+	// Poisoned indicates that a response contained a known poisoned IP, as
+	// configured in NetworkConfig.PoisonedIPAddressCIDRs.
+	Poisoned bool
+
+	// Selected is the source of the answer returned by ResolveIP.
+	Selected string
+}
+
+// dnsQueryObservation records injection indicators observed by
+// performDNSQuery. dnsQueryObservation is safe for concurrent use.
+type dnsQueryObservation struct {
+	injection  int32
+	ttlAnomaly int32
+	poisoned   int32
+}
+
+func (o *dnsQueryObservation) setInjection() {
+	if o != nil {
+		atomic.StoreInt32(&o.injection, 1)
+	}
+}
+
+func (o *dnsQueryObservation) setTTLAnomaly() {
+	if o != nil {
+		atomic.StoreInt32(&o.ttlAnomaly, 1)
+	}
+}
+
+func (o *dnsQueryObservation) setPoisoned() {
+	if o != nil {
+		atomic.StoreInt32(&o.poisoned, 1)
+	}
+}
+
+func (o *dnsQueryObservation) isInjection() bool {
+	return atomic.LoadInt32(&o.injection) == 1
+}
+
+func (o *dnsQueryObservation) isTTLAnomaly() bool {
+	return atomic.LoadInt32(&o.ttlAnomaly) == 1
+}
+
+func (o *dnsQueryObservation) isPoisoned() bool {
+	return atomic.LoadInt32(&o.poisoned) == 1
+}
+
+type crossCheckAnswer struct {
+	source      string
+	IPs         []net.IP
+	TTLs        []time.Duration
+	observation *dnsQueryObservation
+}
+
+// crossCheck queries the cross-check sources, compares their answers with
+// the primary answer, and returns the preferred answer along with a
+// CrossCheckResult.
+//
+// The preferred answer is the answer, from any source without injection or
+// poisoning indicators, that agrees with the most other sources, with ties
+// going to the primary answer. When every answer has injection or poisoning
+// indicators, the primary answer is returned.
+func (r *Resolver) crossCheck(
+	ctx context.Context,
+	params *ResolveParameters,
+	hostname string,
+	primary *crossCheckAnswer,
+	systemServers []string,
+	hasIPv6Route bool) (*crossCheckAnswer, *CrossCheckResult) {
+
+	type crossCheckSource struct {
+		name   string
+		server string
+	}
+	var sources []crossCheckSource
+
+	if primary.source != CROSS_CHECK_SOURCE_SYSTEM && len(systemServers) > 0 {
+		sources = append(sources, crossCheckSource{
+			name: CROSS_CHECK_SOURCE_SYSTEM, server: systemServers[0]})
+	}
+	if primary.source != CROSS_CHECK_SOURCE_ALTERNATE && params.AlternateDNSServer != "" {
+		sources = append(sources, crossCheckSource{
+			name: CROSS_CHECK_SOURCE_ALTERNATE, server: params.AlternateDNSServer})
+	}
+
+	questionTypes := []resolverQuestionType{resolverQuestionTypeA, resolverQuestionTypeAAAA}
+	if !hasIPv6Route {
+		questionTypes = questionTypes[:1]
+	}
+
+	requestTimeout := params.RequestTimeout
+	if requestTimeout == 0 {
+		requestTimeout = resolverDefaultRequestTimeout
+	}
+	checkCtx, cancelFunc := context.WithTimeout(ctx, requestTimeout)
+	defer cancelFunc()
+
+	// Each source answer accumulates the IPs from its A and AAAA queries,
+	// which are sent concurrently, and shares one observation across both
+	// queries.
+	var mutex sync.Mutex
+	sourceAnswers := make([]*crossCheckAnswer, len(sources))
+	for i, source := range sources {
+		sourceAnswers[i] = &crossCheckAnswer{
+			source:      source.name,
+			observation: &dnsQueryObservation{},
+		}
+	}
+
+	waitGroup := new(sync.WaitGroup)
+
+	for i, source := range sources {
+		for _, questionType := range questionTypes {
+			waitGroup.Add(1)
+			go func(
+				answer *crossCheckAnswer,
+				source crossCheckSource,
+				questionType resolverQuestionType) {
+
+				defer waitGroup.Done()
+
+				conn, err := r.newResolverConn(r.networkConfig.logWarning, source.server)
+				if err != nil {
+					r.networkConfig.logWarning(errors.Trace(err))
+					return
+				}
+
+				// Close conn when checkCtx is done, to interrupt any blocking
+				// read in performDNSQuery.
+				queryDone := make(chan struct{})
+				defer close(queryDone)
+				go func() {
+					select {
+					case <-checkCtx.Done():
+					case <-queryDone:
+					}
+					conn.Close()
+				}()
+
+				// No protocol transform is applied to cross-check queries.
+				IPs, TTLs, _, err := performDNSQuery(
+					checkCtx,
+					r.networkConfig.logWarning,
+					params,
+					false,
+					r.poisonedIPNets,
+					answer.observation,
+					conn,
+					questionType,
+					hostname)
+				if err != nil {
+					r.networkConfig.logWarning(errors.Trace(err))
+					return
+				}
+
+				mutex.Lock()
+				answer.IPs = append(answer.IPs, IPs...)
+				answer.TTLs = append(answer.TTLs, TTLs...)
+				mutex.Unlock()
+
+			}(sourceAnswers[i], source, questionType)
+		}
+	}
+
+	waitGroup.Wait()
+
+	answers := []*crossCheckAnswer{primary}
+	for _, answer := range sourceAnswers {
+		if len(answer.IPs) > 0 {
+			answers = append(answers, answer)
+		}
+	}
+
+	result := &CrossCheckResult{
+		Sources: len(answers),
+	}
+
+	for i, answer := range answers {
+		if answer.observation.isInjection() {
+			result.Injection = true
+		}
+		if answer.observation.isTTLAnomaly() {
+			result.TTLAnomaly = true
+		}
+		if answer.observation.isPoisoned() {
+			result.Poisoned = true
+		}
+		for _, otherAnswer := range answers[i+1:] {
+			if !answersAgree(answer.IPs, otherAnswer.IPs) {
+				result.Mismatch = true
+			}
+		}
+	}
+
+	selected := primary
+	selectedAgreement := -1
+
+	for _, answer := range answers {
+
+		if answer.observation.isInjection() || answer.observation.isPoisoned() {
+			continue
+		}
+
+		agreement := 0
+		for _, otherAnswer := range answers {
+			if otherAnswer != answer && answersAgree(answer.IPs, otherAnswer.IPs) {
+				agreement += 1
+			}
+		}
+
+		// answers[0] is the primary answer, which wins ties.
+		if agreement > selectedAgreement {
+			selected = answer
+			selectedAgreement = agreement
+		}
+	}
+
+	result.Selected = selected.source
+
+	r.updateMetricCrossCheck(result)
+
+	return selected, result
+}
+
+// answersAgree indicates whether two answers have at least one IP in common
+// for each of IPv4 and IPv6 where both answers include IPs of that family.
+// Answers with no family in common, such as an IPv4-only answer and an
+// IPv6-only answer, don't agree.
+func answersAgree(IPs, otherIPs []net.IP) bool {
+	compared := false
+	for _, isIPv4 := range []bool{true, false} {
+		familyIPs := filterIPFamily(IPs, isIPv4)
+		otherFamilyIPs := filterIPFamily(otherIPs, isIPv4)
+		if len(familyIPs) == 0 || len(otherFamilyIPs) == 0 {
+			continue
+		}
+		if !haveCommonIP(familyIPs, otherFamilyIPs) {
+			return false
+		}
+		compared = true
+	}
+	return compared
+}
+
+func filterIPFamily(IPs []net.IP, isIPv4 bool) []net.IP {
+	var filtered []net.IP
+	for _, IP := range IPs {
+		if (IP.To4() != nil) == isIPv4 {
+			filtered = append(filtered, IP)
+		}
+	}
+	return filtered
+}
+
+func haveCommonIP(IPs, otherIPs []net.IP) bool {
+	for _, IP := range IPs {
+		for _, otherIP := range otherIPs {
+			if IP.Equal(otherIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func haveSameIPs(IPs, otherIPs []net.IP) bool {
+	if len(IPs) != len(otherIPs) {
+		return false
+	}
+	for _, IP := range IPs {
+		found := false
+		for _, otherIP := range otherIPs {
+			if IP.Equal(otherIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func haveSameTTLs(TTLs, otherTTLs []time.Duration) bool {
+	if len(TTLs) != len(otherTTLs) {
+		return false
+	}
+	for i := range TTLs {
+		if TTLs[i] != otherTTLs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func parsePoisonedIPNets(CIDRs []string) ([]*net.IPNet, error) {
+	var IPNets []*net.IPNet
+	for _, CIDR := range CIDRs {
+		_, IPNet, err := net.ParseCIDR(CIDR)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		IPNets = append(IPNets, IPNet)
+	}
+	return IPNets, nil
+}
+
+func isPoisonedIP(IP net.IP, poisonedIPNets []*net.IPNet) bool {
+	for _, IPNet := range poisonedIPNets {
+		if IPNet.Contains(IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -54,6 +54,7 @@ const (
 	resolverDefaultAnswerTTL         = 1 * time.Minute
 	resolverDNSPort                  = "53"
 	udpPacketBufferSize              = 1232
+	bindingUDPPacketBufferSize       = 4096
 )
 
 // NetworkConfig specifies network-level configuration for a Resolver.
@@ -130,6 +131,37 @@ type NetworkConfig struct {
 	// is expected to be more blocking resistent; this approach also assumes
 	// that endpoints such as CDN IPs are typically available on any network.
 	CacheExtensionVerifiedTTL time.Duration
+
+	// LoadVerifiedCacheEntries and StoreVerifiedCacheEntries are optional
+	// callbacks which persist verified cache entries, per network ID, so
+	// that the verified cache entries survive restarts. When the Resolver
+	// changes to a network ID, including when it's created, the verified
+	// cache entries for that network ID are loaded into the cache. When a
+	// cache entry is verified, with VerifyCacheExtension, all unexpired
+	// verified cache entries for the current network ID are stored.
+	//
+	// Persisting verified cache entries allows for resolving previously
+	// verified domains, such as fronting domains, even when the first DNS
+	// query after a cold start is blocked.
+	//
+	// Verified cache entries are loaded and stored only when
+	// CacheExtensionVerifiedTTL is on. Loaded entries retain their original
+	// expiry, with any remaining TTL capped at CacheExtensionVerifiedTTL.
+	LoadVerifiedCacheEntries  func(networkID string) ([]*VerifiedCacheEntry, error)
+	StoreVerifiedCacheEntries func(networkID string, entries []*VerifiedCacheEntry) error
+
+	// PoisonedIPAddressCIDRs is a list of CIDRs containing IPs known to be
+	// used in poisoned DNS responses. As with bogon IPs, response answers
+	// with these IPs are rejected.
+	PoisonedIPAddressCIDRs []string
+}
+
+// VerifiedCacheEntry is a verified cache entry, as loaded and stored by
+// NetworkConfig.LoadVerifiedCacheEntries and StoreVerifiedCacheEntries.
+type VerifiedCacheEntry struct {
+	Hostname string
+	IPs      []net.IP
+	Expiry   time.Time
 }
 
 func (c *NetworkConfig) allowDefaultResolver() bool {
@@ -211,7 +243,24 @@ type ResolveParameters struct {
 	// part of appearing similar to other DNS traffic.
 	IncludeEDNS0 bool
 
+	// CrossCheck enables cross-check mode, in which ResolveIP compares the
+	// answers from multiple sources and checks for injected responses, and
+	// then returns the most trustworthy answer. Cross-check mode adds
+	// latency and DNS traffic. See CrossCheckResult.
+	CrossCheck bool
+
+	// CrossCheckAwaitTimeout specifies how long, in cross-check mode, each
+	// DNS query awaits additional responses after its first valid response.
+	CrossCheckAwaitTimeout time.Duration
+
+	// UseHTTPSRecords indicates that the dialer should also resolve HTTPS
+	// records, with ResolveHTTPS, for the dial domain. ResolveIP ignores
+	// UseHTTPSRecords; the dialer may use the HTTPS records to check for
+	// HTTP/3 support and may fall back to the records' IP hints.
+	UseHTTPSRecords bool
+
 	firstAttemptWithAnswer int32
+	crossCheckResult       atomic.Value
 }
 
 // GetFirstAttemptWithAnswer returns the index of the first request attempt
@@ -231,6 +280,19 @@ func (r *ResolveParameters) setFirstAttemptWithAnswer(attempt int) {
 	atomic.StoreInt32(&r.firstAttemptWithAnswer, int32(attempt))
 }
 
+// GetCrossCheckResult returns the CrossCheckResult for the most recent
+// cross-check mode ResolveIP call using this ResolveParameters, or nil when
+// there is no result. As with GetFirstAttemptWithAnswer, the caller is
+// responsible for synchronizing use of a ResolveParameters instance.
+func (r *ResolveParameters) GetCrossCheckResult() *CrossCheckResult {
+	result, _ := r.crossCheckResult.Load().(*CrossCheckResult)
+	return result
+}
+
+func (r *ResolveParameters) setCrossCheckResult(result *CrossCheckResult) {
+	r.crossCheckResult.Store(result)
+}
+
 // Implementation note: Go's standard net.Resolver supports specifying a
 // custom Dial function. This could be used to implement at least a large
 // subset of the Resolver functionality on top of Go's standard library
@@ -255,6 +317,9 @@ type Resolver struct {
 	systemServers     []string
 	lastServersUpdate time.Time
 	cache             *lrucache.Cache
+	bindingCache      *lrucache.Cache
+	verifiedEntries   map[string]*VerifiedCacheEntry
+	poisonedIPNets    []*net.IPNet
 	metrics           resolverMetrics
 }
 
@@ -271,6 +336,11 @@ type resolverMetrics struct {
 	peakInFlight            int64
 	minRTT                  time.Duration
 	maxRTT                  time.Duration
+	crossChecks             int
+	crossCheckMismatches    int
+	crossCheckInjections    int
+	requestsBinding         int
+	responsesBinding        int
 }
 
 func newResolverMetrics() resolverMetrics {
@@ -285,6 +355,14 @@ func NewResolver(networkConfig *NetworkConfig, networkID string) *Resolver {
 		metrics:       newResolverMetrics(),
 	}
 
+	poisonedIPNets, err := parsePoisonedIPNets(networkConfig.PoisonedIPAddressCIDRs)
+	if err != nil {
+		// Log warning and proceed without poisoned IP checks.
+		networkConfig.logWarning(errors.Trace(err))
+	} else {
+		r.poisonedIPNets = poisonedIPNets
+	}
+
 	// updateNetworkState will initialize the cache and network state,
 	// including system DNS servers.
 	r.updateNetworkState(networkID)
@@ -307,6 +385,8 @@ func (r *Resolver) Stop() {
 	r.hasIPv6Route = false
 	r.systemServers = nil
 	r.cache.Flush()
+	r.bindingCache.Flush()
+	r.verifiedEntries = nil
 	r.metrics = newResolverMetrics()
 }
 
@@ -444,6 +524,15 @@ func (r *Resolver) MakeResolveParameters(
 		params.IncludeEDNS0 = true
 	}
 
+	if p.WeightedCoinFlip(parameters.DNSResolverCrossCheckProbability) {
+		params.CrossCheck = true
+		params.CrossCheckAwaitTimeout = p.Duration(parameters.DNSResolverCrossCheckAwaitTimeout)
+	}
+
+	if p.WeightedCoinFlip(parameters.DNSResolverHTTPSRecordsProbability) {
+		params.UseHTTPSRecords = true
+	}
+
 	return params, nil
 }
 
@@ -634,9 +723,11 @@ func (r *Resolver) ResolveIP(
 	conns := common.NewConns()
 	type answer struct {
 		attempt int
+		server  string
 		IPs     []net.IP
 		TTLs    []time.Duration
 	}
+	observation := &dnsQueryObservation{}
 	var maxAttempts int
 	if params.PreferAlternateDNSServer {
 		maxAttempts = params.AttemptsPerPreferredServer
@@ -767,6 +858,8 @@ func (r *Resolver) ResolveIP(
 					r.networkConfig.logWarning,
 					params,
 					useProtocolTransform,
+					r.poisonedIPNets,
+					observation,
 					conn,
 					questionType,
 					hostname)
@@ -790,7 +883,7 @@ func (r *Resolver) ResolveIP(
 
 				if len(IPs) > 0 {
 					select {
-					case answerChan <- &answer{attempt: attempt, IPs: IPs, TTLs: TTLs}:
+					case answerChan <- &answer{attempt: attempt, server: server, IPs: IPs, TTLs: TTLs}:
 					default:
 					}
 				}
@@ -906,6 +999,38 @@ func (r *Resolver) ResolveIP(
 		return nil, errors.TraceNew("unexpected no IPs")
 	}
 
+	// In cross-check mode, compare the result with answers from other
+	// sources, and use the preferred answer.
+	//
+	// Limitation: when additional answers from different servers were
+	// collected in the await phase, the primary source is attributed to the
+	// server that provided the first answer.
+	if params.CrossCheck {
+
+		source := CROSS_CHECK_SOURCE_SYSTEM
+		if result.server == params.AlternateDNSServer {
+			source = CROSS_CHECK_SOURCE_ALTERNATE
+		}
+
+		selected, crossCheckResult := r.crossCheck(
+			ctx,
+			params,
+			hostname,
+			&crossCheckAnswer{
+				source:      source,
+				IPs:         result.IPs,
+				TTLs:        result.TTLs,
+				observation: observation,
+			},
+			systemServers,
+			hasIPv6Route)
+
+		params.setCrossCheckResult(crossCheckResult)
+
+		result.IPs = selected.IPs
+		result.TTLs = selected.TTLs
+	}
+
 	// Update the cache now, after all results are gathered.
 	r.setCache(hostname, result.IPs, result.TTLs)
 
@@ -915,33 +1040,121 @@ func (r *Resolver) ResolveIP(
 // VerifyCacheExtension extends the TTL for any cached result for the
 // specified hostname to at least NetworkConfig.CacheExtensionVerifiedTTL.
 func (r *Resolver) VerifyCacheExtension(hostname string) {
+
+	networkID, entries, ok := r.verifyCacheExtension(hostname)
+	if !ok || r.networkConfig.StoreVerifiedCacheEntries == nil {
+		return
+	}
+
+	// Store outside of the mutex lock, to not block concurrent ResolveIP
+	// calls.
+	err := r.networkConfig.StoreVerifiedCacheEntries(networkID, entries)
+	if err != nil {
+		r.networkConfig.logWarning(errors.Trace(err))
+	}
+}
+
+func (r *Resolver) verifyCacheExtension(
+	hostname string) (string, []*VerifiedCacheEntry, bool) {
+
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
 	if r.networkConfig.CacheExtensionVerifiedTTL == 0 {
-		return
+		return "", nil, false
 	}
 
 	if net.ParseIP(hostname) != nil {
-		return
+		return "", nil, false
 	}
 
 	entry, expires, ok := r.cache.GetWithExpiration(hostname)
 	if !ok {
-		return
+		return "", nil, false
 	}
 
 	// Change the TTL only if the entry expires and the existing TTL isn't
 	// longer than the extension.
+	now := time.Now()
 	neverExpires := time.Time{}
 	if expires == neverExpires ||
-		expires.After(time.Now().Add(r.networkConfig.CacheExtensionVerifiedTTL)) {
-		return
+		expires.After(now.Add(r.networkConfig.CacheExtensionVerifiedTTL)) {
+		return "", nil, false
 	}
 
 	r.cache.Set(hostname, entry, r.networkConfig.CacheExtensionVerifiedTTL)
 
 	r.metrics.verifiedCacheExtensions += 1
+
+	// Record the verified entry and return a snapshot of all unexpired
+	// verified entries for the current network ID, to be stored.
+
+	if r.verifiedEntries == nil {
+		r.verifiedEntries = make(map[string]*VerifiedCacheEntry)
+	}
+
+	r.verifiedEntries[hostname] = &VerifiedCacheEntry{
+		Hostname: hostname,
+		IPs:      entry.([]net.IP),
+		Expiry:   now.Add(r.networkConfig.CacheExtensionVerifiedTTL),
+	}
+
+	entries := make([]*VerifiedCacheEntry, 0, len(r.verifiedEntries))
+	for verifiedHostname, verifiedEntry := range r.verifiedEntries {
+		if !verifiedEntry.Expiry.After(now) {
+			delete(r.verifiedEntries, verifiedHostname)
+			continue
+		}
+		entries = append(entries, verifiedEntry)
+	}
+
+	return r.networkID, entries, true
+}
+
+// loadVerifiedCacheEntries loads the persisted verified cache entries for
+// the specified network ID into the cache. The caller must lock r.mutex.
+func (r *Resolver) loadVerifiedCacheEntries(networkID string) {
+
+	r.verifiedEntries = make(map[string]*VerifiedCacheEntry)
+
+	if r.networkConfig.CacheExtensionVerifiedTTL == 0 ||
+		r.networkConfig.LoadVerifiedCacheEntries == nil {
+		return
+	}
+
+	entries, err := r.networkConfig.LoadVerifiedCacheEntries(networkID)
+	if err != nil {
+		r.networkConfig.logWarning(errors.Trace(err))
+		return
+	}
+
+	now := time.Now()
+
+	for _, entry := range entries {
+
+		if entry == nil || len(entry.IPs) == 0 || net.ParseIP(entry.Hostname) != nil {
+			continue
+		}
+
+		// Apply the current CacheExtensionVerifiedTTL, which may be shorter
+		// than the TTL in effect when the entry was stored.
+		TTL := entry.Expiry.Sub(now)
+		if TTL > r.networkConfig.CacheExtensionVerifiedTTL {
+			TTL = r.networkConfig.CacheExtensionVerifiedTTL
+			entry.Expiry = now.Add(TTL)
+		}
+		if TTL <= 0 {
+			continue
+		}
+
+		// Don't replace a current cache entry, which may be more recent
+		// than the loaded entry.
+		if _, ok := r.cache.Get(entry.Hostname); !ok {
+			r.cache.Set(entry.Hostname, entry.IPs, TTL)
+		}
+
+		r.verifiedEntries[entry.Hostname] = entry
+	}
 }
 
 // GetMetrics returns a summary of DNS metrics.
@@ -962,6 +1175,23 @@ func (r *Resolver) GetMetrics() string {
 		extend = fmt.Sprintf("| extend %d ", r.metrics.verifiedCacheExtensions)
 	}
 
+	crossCheck := ""
+	if r.metrics.crossChecks > 0 {
+		crossCheck = fmt.Sprintf(
+			" | xcheck %d/%d/%d",
+			r.metrics.crossChecks,
+			r.metrics.crossCheckMismatches,
+			r.metrics.crossCheckInjections)
+	}
+
+	binding := ""
+	if r.metrics.requestsBinding > 0 {
+		binding = fmt.Sprintf(
+			" | svcb %d/%d",
+			r.metrics.requestsBinding,
+			r.metrics.responsesBinding)
+	}
+
 	defaultResolves := ""
 	if r.networkConfig.allowDefaultResolver() {
 		defaultResolves = fmt.Sprintf(
@@ -971,7 +1201,7 @@ func (r *Resolver) GetMetrics() string {
 	// Note that the number of system resolvers is a point-in-time value,
 	// while the others are cumulative.
 
-	return fmt.Sprintf("resolves %d | hit %d %s| req v4/v6 %d/%d | resp %d/%d | peak %d | rtt %s - %s ms. | sys %d%s",
+	return fmt.Sprintf("resolves %d | hit %d %s| req v4/v6 %d/%d | resp %d/%d | peak %d | rtt %s - %s ms. | sys %d%s%s%s",
 		r.metrics.resolves,
 		r.metrics.cacheHits,
 		extend,
@@ -983,7 +1213,9 @@ func (r *Resolver) GetMetrics() string {
 		minRTT,
 		maxRTT,
 		len(r.systemServers),
-		defaultResolves)
+		defaultResolves,
+		crossCheck,
+		binding)
 }
 
 // updateNetworkState updates the system DNS server list, IPv6 state, and the
@@ -1009,6 +1241,10 @@ func (r *Resolver) updateNetworkState(networkID string) {
 			resolverCacheDefaultTTL,
 			resolverCacheReapFrequency,
 			resolverCacheMaxEntries)
+		r.bindingCache = lrucache.NewWithLRU(
+			resolverCacheDefaultTTL,
+			resolverCacheReapFrequency,
+			resolverCacheMaxEntries)
 		updateAll = true
 	}
 
@@ -1115,6 +1351,16 @@ func (r *Resolver) updateNetworkState(networkID string) {
 		r.cache.Flush()
 	}
 
+	// Service binding records are not subject to the cache extension.
+	if flushCache {
+		r.bindingCache.Flush()
+	}
+
+	// Load any persisted verified cache entries for a new network ID.
+	if r.networkID != networkID || r.verifiedEntries == nil {
+		r.loadVerifiedCacheEntries(networkID)
+	}
+
 	// Set r.networkID only after all operations complete without errors; if
 	// r.networkID were set earlier, a subsequent
 	// ResolveIP/updateNetworkState call might proceed as if the network
@@ -1173,6 +1419,24 @@ func (r *Resolver) getCache(hostname string) []net.IP {
 // in rare cases where the port isn't 53.
 func (r *Resolver) newResolverConn(
 	logWarning func(error),
+	serverAddr string) (net.Conn, error) {
+
+	// context.Background is ok in this case as the UDP dial is just a local
+	// syscall to create the socket.
+	conn, err := r.dialResolverConn(
+		context.Background(), logWarning, "udp", serverAddr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+// dialResolverConn is newResolverConn with a specified network, "udp" or
+// "tcp". ctx bounds the TCP connection establishment.
+func (r *Resolver) dialResolverConn(
+	ctx context.Context,
+	logWarning func(error),
+	network string,
 	serverAddr string) (retConn net.Conn, retErr error) {
 
 	defer func() {
@@ -1216,9 +1480,7 @@ func (r *Resolver) newResolverConn(
 		}
 	}
 
-	// context.Background is ok in this case as the UDP dial is just a local
-	// syscall to create the socket.
-	conn, err := dialer.DialContext(context.Background(), "udp", serverAddr)
+	conn, err := dialer.DialContext(ctx, network, serverAddr)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -1271,6 +1533,33 @@ func (r *Resolver) updateMetricDefaultResolver(success bool) {
 	}
 }
 
+func (r *Resolver) updateMetricCrossCheck(result *CrossCheckResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics.crossChecks += 1
+	if result.Mismatch {
+		r.metrics.crossCheckMismatches += 1
+	}
+	if result.Injection {
+		r.metrics.crossCheckInjections += 1
+	}
+}
+
+func (r *Resolver) updateMetricRequestsBinding() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics.requestsBinding += 1
+}
+
+func (r *Resolver) updateMetricResponsesBinding() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics.responsesBinding += 1
+}
+
 func (r *Resolver) updateMetricPeakInFlight(inFlight int64) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -1366,6 +1655,8 @@ func performDNSQuery(
 	logWarning func(error),
 	params *ResolveParameters,
 	useProtocolTransform bool,
+	poisonedIPNets []*net.IPNet,
+	observation *dnsQueryObservation,
 	conn net.Conn,
 	questionType resolverQuestionType,
 	hostname string) ([]net.IP, []time.Duration, time.Duration, error) {
@@ -1419,9 +1710,16 @@ func performDNSQuery(
 	// Send the DNS request
 	dnsConn.WriteMsg(request)
 
+	// In cross-check mode, after the first valid response, continue reading
+	// responses for CrossCheckAwaitTimeout. Additional valid responses with
+	// different IPs indicate injection: an on-path injector races to deliver
+	// its response first, so the last response is used.
+	awaitInjection := params.CrossCheck && params.CrossCheckAwaitTimeout > 0
+	var awaitIPs []net.IP
+	var awaitTTLs []time.Duration
+	var awaitRTT time.Duration
+
 	// Read and process the DNS response
-	var IPs []net.IP
-	var TTLs []time.Duration
 	var lastErr error
 	RTT := time.Duration(-1)
 	for {
@@ -1430,6 +1728,10 @@ func performDNSQuery(
 		// close conn, which will interrupt a blocking dnsConn.ReadMsg.
 		if resolveCtx.Err() != nil {
 
+			if awaitIPs != nil {
+				return awaitIPs, awaitTTLs, awaitRTT, nil
+			}
+
 			// ResolveIP, which calls performDNSQuery, already records the
 			// context error (e.g., context timeout), so instead report
 			// lastErr, when present, as it may contain more useful
@@ -1445,6 +1747,11 @@ func performDNSQuery(
 		// Read a response. RTT is the elapsed time between sending the
 		// request and reading the last received response.
 		response, err := dnsConn.ReadMsg()
+		if awaitIPs != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return awaitIPs, awaitTTLs, awaitRTT, nil
+			}
+		}
 		RTT = time.Since(startTime)
 		if err == nil && response.MsgHdr.Id != request.MsgHdr.Id {
 			err = dns.ErrId
@@ -1497,6 +1804,8 @@ func performDNSQuery(
 		// retry. However, if _any_ valid IP is found, stop reading and
 		// return that result. Again, the validation is only best effort.
 
+		var IPs []net.IP
+		var TTLs []time.Duration
 		checkFailed := false
 		for _, answer := range response.Answer {
 			haveAnswer := false
@@ -1527,6 +1836,13 @@ func performDNSQuery(
 				// Check the next answer
 				continue
 			}
+			if isPoisonedIP(IP, poisonedIPNets) {
+				checkFailed = true
+				observation.setPoisoned()
+				lastErr = errors.TraceNew("invalid IP: IP is poisoned")
+				logWarning(lastErr)
+				continue
+			}
 			IPs = append(IPs, IP)
 			TTLs = append(TTLs, time.Duration(TTLSec)*time.Second)
 		}
@@ -1550,7 +1866,25 @@ func performDNSQuery(
 			continue
 		}
 
-		return IPs, TTLs, RTT, nil
+		if !awaitInjection || len(IPs) == 0 {
+			if awaitIPs != nil {
+				continue
+			}
+			return IPs, TTLs, RTT, nil
+		}
+
+		if awaitIPs == nil {
+			err := dnsConn.SetReadDeadline(time.Now().Add(params.CrossCheckAwaitTimeout))
+			if err != nil {
+				return IPs, TTLs, RTT, nil
+			}
+		} else if !haveSameIPs(awaitIPs, IPs) {
+			observation.setInjection()
+		} else if !haveSameTTLs(awaitTTLs, TTLs) {
+			observation.setTTLAnomaly()
+		}
+
+		awaitIPs, awaitTTLs, awaitRTT = IPs, TTLs, RTT
 	}
 }
 
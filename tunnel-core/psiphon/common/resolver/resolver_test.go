@@ -20,6 +20,7 @@
 package resolver
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net"
@@ -50,6 +51,27 @@ func TestResolver(t *testing.T) {
 	}
 }
 
+func TestVerifiedCacheEntries(t *testing.T) {
+	err := runTestVerifiedCacheEntries()
+	if err != nil {
+		t.Fatalf(errors.Trace(err).Error())
+	}
+}
+
+func TestCrossCheck(t *testing.T) {
+	err := runTestCrossCheck()
+	if err != nil {
+		t.Fatalf(errors.Trace(err).Error())
+	}
+}
+
+func TestServiceBindings(t *testing.T) {
+	err := runTestServiceBindings()
+	if err != nil {
+		t.Fatalf(errors.Trace(err).Error())
+	}
+}
+
 func TestPublicDNSServers(t *testing.T) {
 	IPs, metrics, err := runTestPublicDNSServers()
 	if err != nil {
@@ -628,6 +650,432 @@ func runTestResolver() error {
 	return nil
 }
 
+func runTestVerifiedCacheEntries() error {
+
+	now := time.Now()
+
+	storedEntries := map[string][]*VerifiedCacheEntry{
+		"networkID-1": {
+			{
+				Hostname: "verified.example.com",
+				IPs:      []net.IP{net.ParseIP("192.0.2.1")},
+				Expiry:   now.Add(1 * time.Hour),
+			},
+			{
+				Hostname: "expired.example.com",
+				IPs:      []net.IP{net.ParseIP("192.0.2.2")},
+				Expiry:   now.Add(-1 * time.Hour),
+			},
+			{
+				Hostname: "long.example.com",
+				IPs:      []net.IP{net.ParseIP("192.0.2.3")},
+				Expiry:   now.Add(10 * time.Hour),
+			},
+		},
+		"networkID-2": {
+			{
+				Hostname: "other.example.com",
+				IPs:      []net.IP{net.ParseIP("192.0.2.4")},
+				Expiry:   now.Add(1 * time.Hour),
+			},
+		},
+	}
+
+	storeCount := 0
+
+	networkConfig := &NetworkConfig{
+		GetDNSServers:             func() []string { return []string{"127.0.0.1:1"} },
+		CacheExtensionInitialTTL:  1 * time.Minute,
+		CacheExtensionVerifiedTTL: 2 * time.Hour,
+		LoadVerifiedCacheEntries: func(networkID string) ([]*VerifiedCacheEntry, error) {
+			return storedEntries[networkID], nil
+		},
+		StoreVerifiedCacheEntries: func(networkID string, entries []*VerifiedCacheEntry) error {
+			storedEntries[networkID] = entries
+			storeCount += 1
+			return nil
+		},
+	}
+
+	networkID := "networkID-1"
+
+	resolver := NewResolver(networkConfig, networkID)
+	defer resolver.Stop()
+
+	// Test: loaded, unexpired entries resolve without any DNS query.
+
+	IPs, err := resolver.ResolveIP(
+		context.Background(), networkID, nil, "verified.example.com")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(IPs) != 1 || !IPs[0].Equal(net.ParseIP("192.0.2.1")) {
+		return errors.Tracef("unexpected IPs: %v", IPs)
+	}
+	if resolver.metrics.requestsIPv4 != 0 || resolver.metrics.cacheHits != 1 {
+		return errors.Tracef("unexpected metrics: %+v", resolver.metrics)
+	}
+
+	// Test: expired entries are not loaded.
+
+	_, ok := resolver.cache.Get("expired.example.com")
+	if ok {
+		return errors.TraceNew("unexpected expired entry")
+	}
+
+	// Test: loaded TTLs are capped at CacheExtensionVerifiedTTL.
+
+	_, expiry, ok := resolver.cache.GetWithExpiration("long.example.com")
+	if !ok || expiry.After(time.Now().Add(networkConfig.CacheExtensionVerifiedTTL)) {
+		return errors.TraceNew("unexpected long entry state")
+	}
+
+	// Test: verifying a cache entry stores all unexpired verified entries.
+
+	resolver.setCache("new.example.com", []net.IP{net.ParseIP("192.0.2.5")}, nil)
+
+	resolver.VerifyCacheExtension("new.example.com")
+
+	if storeCount != 1 {
+		return errors.Tracef("unexpected store count: %d", storeCount)
+	}
+	hostnames := make(map[string]bool)
+	for _, entry := range storedEntries[networkID] {
+		hostnames[entry.Hostname] = true
+	}
+	if len(hostnames) != 3 ||
+		!hostnames["verified.example.com"] ||
+		!hostnames["long.example.com"] ||
+		!hostnames["new.example.com"] {
+		return errors.Tracef("unexpected stored entries: %v", hostnames)
+	}
+
+	// Test: entries for a new network ID are loaded on network change.
+
+	networkID = "networkID-2"
+
+	resolver.updateNetworkState(networkID)
+
+	_, ok = resolver.cache.Get("other.example.com")
+	if !ok {
+		return errors.TraceNew("missing network entry")
+	}
+
+	return nil
+}
+
+func runTestCrossCheck() error {
+
+	// injectingServer responds to A requests with an injected response
+	// followed by the genuine response, as an on-path injector would.
+	injectingServer, err := newTestInjectingDNSServer(true, dns.TypeA)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer injectingServer.stop()
+
+	// mismatchServer responds to AAAA requests with only the injected
+	// response.
+	mismatchServer, err := newTestInjectingDNSServer(false, dns.TypeAAAA)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer mismatchServer.stop()
+
+	okServer, err := newTestDNSServer(true, true, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer okServer.stop()
+
+	params := &ResolveParameters{
+		AttemptsPerServer:      1,
+		RequestTimeout:         1 * time.Second,
+		AwaitTimeout:           250 * time.Millisecond,
+		AlternateDNSServer:     okServer.getAddr(),
+		CrossCheck:             true,
+		CrossCheckAwaitTimeout: 250 * time.Millisecond,
+	}
+
+	networkID := "networkID-1"
+
+	resolveIP := func(
+		networkConfig *NetworkConfig) ([]net.IP, *CrossCheckResult, error) {
+
+		resolver := NewResolver(networkConfig, networkID)
+		defer resolver.Stop()
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelFunc()
+
+		IPs, err := resolver.ResolveIP(ctx, networkID, params, exampleDomain)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		return IPs, params.GetCrossCheckResult(), nil
+	}
+
+	checkIPv4 := func(IPs []net.IP, expectedIPv4 string) error {
+		for _, IP := range IPs {
+			if IP.To4() != nil && IP.String() != expectedIPv4 {
+				return errors.Tracef("unexpected IPv4 response: %s", IP)
+			}
+		}
+		return nil
+	}
+
+	// Test: injected response is detected, and the genuine answer is used
+
+	IPs, result, err := resolveIP(&NetworkConfig{
+		GetDNSServers: func() []string { return []string{injectingServer.getAddr()} },
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = checkIPv4(IPs, exampleIPv4)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if result == nil ||
+		result.Sources != 2 ||
+		!result.Injection ||
+		result.Mismatch ||
+		result.Poisoned ||
+		result.Selected != CROSS_CHECK_SOURCE_ALTERNATE {
+		return errors.Tracef("unexpected cross-check result: %+v", result)
+	}
+
+	// Test: poisoned IPs are rejected
+
+	IPs, result, err = resolveIP(&NetworkConfig{
+		GetDNSServers:          func() []string { return []string{injectingServer.getAddr()} },
+		PoisonedIPAddressCIDRs: []string{exampleInjectedIPv4 + "/32"},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = checkIPv4(IPs, exampleIPv4)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if result == nil ||
+		result.Injection ||
+		result.Mismatch ||
+		!result.Poisoned ||
+		result.Selected != CROSS_CHECK_SOURCE_ALTERNATE {
+		return errors.Tracef("unexpected cross-check result: %+v", result)
+	}
+
+	// Test: mismatched AAAA answers are detected
+
+	IPs, result, err = resolveIP(&NetworkConfig{
+		GetDNSServers: func() []string { return []string{mismatchServer.getAddr()} },
+		HasIPv6Route:  func() bool { return true },
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = checkIPv4(IPs, exampleIPv4)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if result == nil ||
+		result.Sources != 2 ||
+		result.Injection ||
+		!result.Mismatch {
+		return errors.Tracef("unexpected cross-check result: %+v", result)
+	}
+
+	return nil
+}
+
+func runTestServiceBindings() error {
+
+	aliasDomain := "alias." + exampleDomain
+	largeDomain := "large." + exampleDomain
+	echConfigList := prng.Bytes(64)
+	largeECHConfigList := prng.Bytes(2 * udpPacketBufferSize)
+	var tcpRequestCount int32
+
+	// server responds to HTTPS requests for exampleDomain with an AliasMode
+	// record for aliasDomain, and to HTTPS requests for aliasDomain with
+	// ServiceMode records. HTTPS requests for largeDomain, over UDP, receive
+	// a truncated response. Requests without EDNS(0) are refused.
+	server, err := newTestHandlerDNSServer(func(w dns.ResponseWriter, r *dns.Msg) {
+
+		if len(r.Question) != 1 {
+			return
+		}
+
+		isTCP := w.RemoteAddr().Network() == "tcp"
+		if isTCP {
+			atomic.AddInt32(&tcpRequestCount, 1)
+		}
+
+		header := dns.RR_Header{
+			Name:   r.Question[0].Name,
+			Rrtype: dns.TypeHTTPS,
+			Class:  dns.ClassINET,
+			Ttl:    exampleTTLSeconds,
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		switch {
+		case r.IsEdns0() == nil:
+			m.SetRcode(r, dns.RcodeRefused)
+		case r.Question[0].Qtype != dns.TypeHTTPS:
+			m.SetRcode(r, dns.RcodeNameError)
+		case r.Question[0].Name == dns.Fqdn(largeDomain) && !isTCP:
+			m.Truncated = true
+		case r.Question[0].Name == dns.Fqdn(largeDomain):
+			m.Answer = []dns.RR{&dns.HTTPS{SVCB: dns.SVCB{
+				Hdr:      header,
+				Priority: 1,
+				Target:   ".",
+				Value: []dns.SVCBKeyValue{
+					&dns.SVCBAlpn{Alpn: []string{"h3"}},
+					&dns.SVCBECHConfig{ECH: largeECHConfigList},
+				},
+			}}}
+		case r.Question[0].Name == dns.Fqdn(exampleDomain):
+			m.Answer = []dns.RR{&dns.HTTPS{SVCB: dns.SVCB{
+				Hdr:    header,
+				Target: dns.Fqdn(aliasDomain),
+			}}}
+		case r.Question[0].Name == dns.Fqdn(aliasDomain):
+			m.Answer = []dns.RR{
+				&dns.HTTPS{SVCB: dns.SVCB{
+					Hdr:      header,
+					Priority: 2,
+					Target:   ".",
+				}},
+				&dns.HTTPS{SVCB: dns.SVCB{
+					Hdr:      header,
+					Priority: 1,
+					Target:   ".",
+					Value: []dns.SVCBKeyValue{
+						&dns.SVCBAlpn{Alpn: []string{"h3", "h2"}},
+						&dns.SVCBPort{Port: 8443},
+						&dns.SVCBIPv4Hint{Hint: []net.IP{
+							net.ParseIP(exampleIPv4).To4(),
+							net.ParseIP("127.0.0.1").To4()}},
+						&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP(exampleIPv6)}},
+						&dns.SVCBECHConfig{ECH: echConfigList},
+					},
+				}},
+				&dns.HTTPS{SVCB: dns.SVCB{
+					Hdr:      header,
+					Priority: 3,
+					Target:   ".",
+					Value: []dns.SVCBKeyValue{
+						&dns.SVCBMandatory{Code: []dns.SVCBKey{dns.SVCB_ALPN, 1000}},
+						&dns.SVCBAlpn{Alpn: []string{"h2"}},
+						&dns.SVCBLocal{KeyCode: 1000, Data: []byte{0}},
+					},
+				}},
+			}
+		default:
+			m.SetRcode(r, dns.RcodeNameError)
+		}
+
+		w.WriteMsg(m)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer server.stop()
+
+	networkConfig := &NetworkConfig{
+		GetDNSServers: func() []string { return []string{server.getAddr()} },
+	}
+
+	networkID := "networkID-1"
+
+	resolver := NewResolver(networkConfig, networkID)
+	defer resolver.Stop()
+
+	params := &ResolveParameters{
+		AttemptsPerServer: 1,
+		RequestTimeout:    1 * time.Second,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	// Test: the alias is followed, records are ordered by priority, and the
+	// record with an unsupported mandatory key is ignored
+
+	bindings, err := resolver.ResolveHTTPS(ctx, networkID, params, exampleDomain)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(bindings) != 2 || bindings[0].Priority != 1 || bindings[1].Priority != 2 {
+		return errors.Tracef("unexpected bindings: %+v", bindings)
+	}
+
+	binding := bindings[0]
+	if binding.Target != aliasDomain ||
+		!binding.SupportsALPN("h3", "http/1.1") ||
+		!binding.SupportsALPN("http/1.1", "http/1.1") ||
+		binding.Port != 8443 ||
+		len(binding.IPv4Hints) != 1 || binding.IPv4Hints[0].String() != exampleIPv4 ||
+		len(binding.IPv6Hints) != 1 || binding.IPv6Hints[0].String() != exampleIPv6 ||
+		len(binding.GetIPHints(false)) != 1 ||
+		!bytes.Equal(binding.ECHConfigList, echConfigList) ||
+		binding.TTL != exampleTTLSeconds*time.Second {
+		return errors.Tracef("unexpected binding: %+v", binding)
+	}
+
+	if bindings[1].SupportsALPN("h3", "http/1.1") {
+		return errors.TraceNew("unexpected ALPN support")
+	}
+
+	// Test: cached response
+
+	requestCount := resolver.metrics.requestsBinding
+
+	_, err = resolver.ResolveHTTPS(ctx, networkID, params, exampleDomain)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resolver.metrics.requestsBinding != requestCount {
+		return errors.TraceNew("unexpected request")
+	}
+
+	// Test: no records
+
+	bindings, err = resolver.ResolveSVCB(ctx, networkID, params, "_8443._foo."+exampleDomain)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(bindings) != 0 {
+		return errors.Tracef("unexpected bindings: %+v", bindings)
+	}
+
+	// Test: a truncated response is retried over TCP
+
+	if atomic.LoadInt32(&tcpRequestCount) != 0 {
+		return errors.TraceNew("unexpected TCP request")
+	}
+
+	bindings, err = resolver.ResolveHTTPS(ctx, networkID, params, largeDomain)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(bindings) != 1 ||
+		!bindings[0].SupportsALPN("h3", "http/1.1") ||
+		!bytes.Equal(bindings[0].ECHConfigList, largeECHConfigList) {
+		return errors.Tracef("unexpected bindings: %+v", bindings)
+	}
+	if atomic.LoadInt32(&tcpRequestCount) != 1 {
+		return errors.TraceNew("unexpected TCP request count")
+	}
+
+	return nil
+}
+
 func runTestPublicDNSServers() ([]net.IP, string, error) {
 
 	networkConfig := &NetworkConfig{
@@ -687,6 +1135,9 @@ const (
 	exampleIPv6       = "2606:2800:220:1:248:1893:25c8:1946"
 	exampleIPv6CIDR   = "2606:2800:220::/48"
 	exampleTTLSeconds = 60
+
+	exampleInjectedIPv4 = "93.184.216.35"
+	exampleInjectedIPv6 = "2606:2800:220:1:248:1893:25c8:1947"
 )
 
 // Set the reserved Z flag
@@ -794,3 +1245,143 @@ func (s *testDNSServer) stop() {
 	s.server.PacketConn.Close()
 	s.server.Shutdown()
 }
+
+type testHandlerDNSServer struct {
+	server    *dns.Server
+	tcpServer *dns.Server
+	addr      string
+}
+
+func newTestHandlerDNSServer(
+	handler func(dns.ResponseWriter, *dns.Msg)) (*testHandlerDNSServer, error) {
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Also listen for TCP requests, on the same port, to handle retries of
+	// truncated responses.
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		udpConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	s := &testHandlerDNSServer{
+		addr: udpConn.LocalAddr().String(),
+	}
+
+	s.server = &dns.Server{
+		PacketConn: udpConn,
+		Handler:    dns.HandlerFunc(handler),
+	}
+
+	s.tcpServer = &dns.Server{
+		Listener: tcpListener,
+		Handler:  dns.HandlerFunc(handler),
+	}
+
+	go s.server.ActivateAndServe()
+	go s.tcpServer.ActivateAndServe()
+
+	return s, nil
+}
+
+func (s *testHandlerDNSServer) getAddr() string {
+	return s.addr
+}
+
+func (s *testHandlerDNSServer) stop() {
+	s.server.PacketConn.Close()
+	s.server.Shutdown()
+	s.tcpServer.Listener.Close()
+	s.tcpServer.Shutdown()
+}
+
+type testInjectingDNSServer struct {
+	sendGenuine bool
+	injectQtype uint16
+	server      *dns.Server
+	addr        string
+}
+
+func newTestInjectingDNSServer(
+	sendGenuine bool, injectQtype uint16) (*testInjectingDNSServer, error) {
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s := &testInjectingDNSServer{
+		sendGenuine: sendGenuine,
+		injectQtype: injectQtype,
+		addr:        udpConn.LocalAddr().String(),
+	}
+
+	s.server = &dns.Server{
+		PacketConn: udpConn,
+		Handler:    s,
+	}
+
+	go s.server.ActivateAndServe()
+
+	return s, nil
+}
+
+func (s *testInjectingDNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+
+	if len(r.Question) != 1 || r.Question[0].Name != dns.Fqdn(exampleDomain) {
+		return
+	}
+
+	reply := func(IP string) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   r.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    exampleTTLSeconds},
+				A: net.ParseIP(IP),
+			}}
+		} else {
+			m.Answer = []dns.RR{&dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   r.Question[0].Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    exampleTTLSeconds},
+				AAAA: net.ParseIP(IP),
+			}}
+		}
+		w.WriteMsg(m)
+	}
+
+	genuineIP, injectedIP := exampleIPv4, exampleInjectedIPv4
+	if r.Question[0].Qtype != dns.TypeA {
+		genuineIP, injectedIP = exampleIPv6, exampleInjectedIPv6
+	}
+
+	if r.Question[0].Qtype != s.injectQtype {
+		reply(genuineIP)
+		return
+	}
+
+	reply(injectedIP)
+	if s.sendGenuine {
+		reply(genuineIP)
+	}
+}
+
+func (s *testInjectingDNSServer) getAddr() string {
+	return s.addr
+}
+
+func (s *testInjectingDNSServer) stop() {
+	s.server.PacketConn.Close()
+	s.server.Shutdown()
+}
@@ -0,0 +1,567 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+const (
+	resolverMaxAliasDepth = 4
+)
+
+// ServiceBinding is a parsed HTTPS or SVCB record, as specified in
+// draft-ietf-dnsop-svcb-https.
+//
+// Service bindings allow a client to learn, before connecting, the
+// protocols supported by a service endpoint, such as HTTP/3; the ECH
+// configuration for the endpoint; and IP address hints, which may be used
+// when A and AAAA records are unavailable or poisoned.
+type ServiceBinding struct {
+
+	// Priority is the SvcPriority of the record. Records are returned in
+	// priority order, lowest first. Priority 0 indicates an AliasMode record;
+	// AliasMode records are followed by ResolveHTTPS and ResolveSVCB and are
+	// only returned when the alias chain could not be followed.
+	Priority uint16
+
+	// Target is the TargetName, without the trailing dot. For ServiceMode
+	// records with a TargetName of ".", Target is set to the queried name.
+	Target string
+
+	// ALPN is the list of supported ALPN protocol IDs.
+	ALPN []string
+
+	// NoDefaultALPN indicates that the default ALPN protocol for the scheme
+	// is not supported and only the protocols in ALPN are supported.
+	NoDefaultALPN bool
+
+	// Port is the alternative port, or 0 when the record specifies no port.
+	Port int
+
+	// IPv4Hints and IPv6Hints are the ipv4hint and ipv6hint IPs. Bogon IPs
+	// and IPs in NetworkConfig.PoisonedIPAddressCIDRs are omitted.
+	IPv4Hints []net.IP
+	IPv6Hints []net.IP
+
+	// ECHConfigList is the ECHConfigList, or nil when the record specifies
+	// no ECH configuration.
+	ECHConfigList []byte
+
+	// TTL is the record TTL.
+	TTL time.Duration
+}
+
+// IsAlias indicates whether the record is an AliasMode record.
+func (b *ServiceBinding) IsAlias() bool {
+	return b.Priority == 0
+}
+
+// SupportsALPN indicates whether the service binding supports the specified
+// ALPN protocol ID. defaultALPN is the default protocol for the scheme,
+// "http/1.1" for HTTPS records, which is supported unless NoDefaultALPN is
+// set.
+func (b *ServiceBinding) SupportsALPN(protocol, defaultALPN string) bool {
+	if protocol == defaultALPN && !b.NoDefaultALPN {
+		return true
+	}
+	for _, ALPN := range b.ALPN {
+		if ALPN == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// GetIPHints returns all IPv4 and IPv6 hints. IPv6 hints are omitted when
+// hasIPv6Route is false.
+func (b *ServiceBinding) GetIPHints(hasIPv6Route bool) []net.IP {
+	IPs := append([]net.IP(nil), b.IPv4Hints...)
+	if hasIPv6Route {
+		IPs = append(IPs, b.IPv6Hints...)
+	}
+	return IPs
+}
+
+// ResolveHTTPS resolves the HTTPS records for the specified hostname.
+// ResolveHTTPS returns an empty list, and no error, when the hostname has no
+// HTTPS records.
+//
+// ResolveHTTPS uses the same DNS servers, cache lifetime, and
+// ResolveParameters attempt and timeout values as ResolveIP, with the
+// following limitations:
+//
+//   - The standard library resolver does not support HTTPS records, so there
+//     must be a system DNS server or an AlternateDNSServer.
+//   - Protocol transforms and cross-check mode are not applied.
+//   - Servers are attempted sequentially.
+//
+// Requests always include EDNS(0), and truncated responses, for records too
+// large for UDP, are retried over TCP.
+//
+// Plaintext DNS responses may be injected or modified on path, so, as with
+// A and AAAA records, results such as ECH configurations are not
+// authenticated.
+func (r *Resolver) ResolveHTTPS(
+	ctx context.Context,
+	networkID string,
+	params *ResolveParameters,
+	hostname string) ([]*ServiceBinding, error) {
+
+	bindings, err := r.resolveBindings(ctx, networkID, params, hostname, dns.TypeHTTPS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return bindings, nil
+}
+
+// ResolveSVCB resolves the SVCB records for the specified name. Per
+// draft-ietf-dnsop-svcb-https, the name is typically prefixed with port and
+// scheme labels; for example, "_8443._foo.api.example.com". ResolveSVCB is
+// otherwise the same as ResolveHTTPS.
+func (r *Resolver) ResolveSVCB(
+	ctx context.Context,
+	networkID string,
+	params *ResolveParameters,
+	name string) ([]*ServiceBinding, error) {
+
+	bindings, err := r.resolveBindings(ctx, networkID, params, name, dns.TypeSVCB)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return bindings, nil
+}
+
+func (r *Resolver) resolveBindings(
+	ctx context.Context,
+	networkID string,
+	params *ResolveParameters,
+	name string,
+	questionType uint16) ([]*ServiceBinding, error) {
+
+	if net.ParseIP(name) != nil {
+		return nil, errors.TraceNew("unexpected IP address")
+	}
+
+	r.updateNetworkState(networkID)
+
+	if params == nil {
+		params = &ResolveParameters{
+			AttemptsPerServer:          resolverDefaultAttemptsPerServer,
+			AttemptsPerPreferredServer: resolverDefaultAttemptsPerServer,
+			RequestTimeout:             resolverDefaultRequestTimeout,
+		}
+	}
+
+	cacheKey := fmt.Sprintf("%s %s", dns.TypeToString[questionType], name)
+	bindings, ok := r.getBindingCache(cacheKey)
+	if ok {
+		return bindings, nil
+	}
+
+	_, systemServers := r.getNetworkState()
+
+	// Server selection is the same as in ResolveIP.
+	var servers []string
+	if params.AlternateDNSServer != "" &&
+		(len(systemServers) == 0 || params.PreferAlternateDNSServer) {
+		servers = []string{params.AlternateDNSServer}
+	}
+	servers = append(servers, systemServers...)
+	if len(servers) == 0 {
+		return nil, errors.TraceNew("no DNS servers")
+	}
+
+	bindings = nil
+	target := name
+	for depth := 0; ; depth++ {
+
+		targetBindings, err := r.queryBindings(ctx, params, servers, target, questionType)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// Follow an AliasMode record, which, when present, should be the
+		// only record. When the alias chain is too long, or loops back to
+		// the original name, return the AliasMode record.
+		if len(targetBindings) > 0 &&
+			targetBindings[0].IsAlias() &&
+			depth < resolverMaxAliasDepth &&
+			targetBindings[0].Target != name {
+
+			target = targetBindings[0].Target
+			bindings = targetBindings
+			continue
+		}
+
+		if len(targetBindings) > 0 || bindings == nil {
+			bindings = targetBindings
+		}
+		break
+	}
+
+	r.setBindingCache(cacheKey, bindings)
+
+	return bindings, nil
+}
+
+func (r *Resolver) queryBindings(
+	ctx context.Context,
+	params *ResolveParameters,
+	servers []string,
+	name string,
+	questionType uint16) ([]*ServiceBinding, error) {
+
+	var lastErr error
+
+	for i, server := range servers {
+
+		attempts := params.AttemptsPerServer
+		if i == 0 && params.PreferAlternateDNSServer {
+			attempts = params.AttemptsPerPreferredServer
+		}
+
+		for attempt := 0; attempt < attempts; attempt++ {
+
+			if ctx.Err() != nil {
+				if lastErr == nil {
+					lastErr = errors.Trace(ctx.Err())
+				}
+				return nil, errors.Trace(lastErr)
+			}
+
+			bindings, err := r.queryBindingsAttempt(ctx, params, server, name, questionType)
+			if err == nil {
+				return bindings, nil
+			}
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = errors.TraceNew("no attempts")
+	}
+	return nil, errors.Trace(lastErr)
+}
+
+func (r *Resolver) queryBindingsAttempt(
+	ctx context.Context,
+	params *ResolveParameters,
+	server string,
+	name string,
+	questionType uint16) ([]*ServiceBinding, error) {
+
+	requestCtx := ctx
+	if params.RequestTimeout > 0 {
+		var cancelFunc context.CancelFunc
+		requestCtx, cancelFunc = context.WithTimeout(ctx, params.RequestTimeout)
+		defer cancelFunc()
+	}
+
+	// HTTPS records, in particular those with ECH configs, may exceed the
+	// EDNS(0) UDP payload size. In that case, the server responds with a
+	// truncated response, and the request is retried over TCP, within the
+	// same request timeout.
+
+	bindings, truncated, err := r.queryBindingsConn(
+		requestCtx, params, "udp", server, name, questionType)
+	if err == nil && truncated {
+		bindings, truncated, err = r.queryBindingsConn(
+			requestCtx, params, "tcp", server, name, questionType)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if truncated {
+		return nil, errors.TraceNew("truncated response")
+	}
+
+	return bindings, nil
+}
+
+func (r *Resolver) queryBindingsConn(
+	requestCtx context.Context,
+	params *ResolveParameters,
+	network string,
+	server string,
+	name string,
+	questionType uint16) ([]*ServiceBinding, bool, error) {
+
+	conn, err := r.dialResolverConn(
+		requestCtx, r.networkConfig.logWarning, network, server)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	// Close conn when requestCtx is done, to interrupt any blocking read in
+	// performBindingQuery.
+	queryDone := make(chan struct{})
+	defer close(queryDone)
+	go func() {
+		select {
+		case <-requestCtx.Done():
+		case <-queryDone:
+		}
+		conn.Close()
+	}()
+
+	r.updateMetricRequestsBinding()
+
+	bindings, truncated, RTT, err := performBindingQuery(
+		requestCtx,
+		r.networkConfig.logWarning,
+		r.poisonedIPNets,
+		conn,
+		questionType,
+		name)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	r.updateMetricResponsesBinding()
+	r.updateMetricRTT(RTT)
+
+	return bindings, truncated, nil
+}
+
+func (r *Resolver) setBindingCache(cacheKey string, bindings []*ServiceBinding) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// As in setCache, the shortest TTL is used. A negative result, with no
+	// records, is cached for the default TTL.
+	TTL := resolverDefaultAnswerTTL
+	for _, binding := range bindings {
+		if binding.TTL > 0 && binding.TTL < TTL {
+			TTL = binding.TTL
+		}
+	}
+
+	r.bindingCache.Set(cacheKey, bindings, TTL)
+}
+
+func (r *Resolver) getBindingCache(cacheKey string) ([]*ServiceBinding, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.bindingCache.Get(cacheKey)
+	if !ok {
+		return nil, false
+	}
+	r.metrics.cacheHits += 1
+	return entry.([]*ServiceBinding), true
+}
+
+func performBindingQuery(
+	requestCtx context.Context,
+	logWarning func(error),
+	poisonedIPNets []*net.IPNet,
+	conn net.Conn,
+	questionType uint16,
+	name string) ([]*ServiceBinding, bool, time.Duration, error) {
+
+	// When conn is not a net.PacketConn, miekg/dns uses the TCP message
+	// length prefix.
+	_, isPacketConn := conn.(net.PacketConn)
+
+	dnsConn := &dns.Conn{
+		Conn:    conn,
+		UDPSize: bindingUDPPacketBufferSize,
+	}
+	defer dnsConn.Close()
+
+	// Unlike ResolveIP requests, where EDNS(0) is included only when
+	// ResolveParameters.IncludeEDNS0 is set, binding requests always include
+	// EDNS(0) and advertise a larger UDP payload size, to accommodate large
+	// records and avoid a TCP retry.
+	request := &dns.Msg{MsgHdr: dns.MsgHdr{RecursionDesired: true}}
+	request.SetQuestion(dns.Fqdn(name), questionType)
+	request.SetEdns0(bindingUDPPacketBufferSize, false)
+
+	startTime := time.Now()
+
+	dnsConn.WriteMsg(request)
+
+	var lastErr error
+	for {
+
+		// As in performDNSQuery, the caller closes conn when requestCtx is
+		// done, which will interrupt a blocking dnsConn.ReadMsg.
+		if requestCtx.Err() != nil {
+			err := lastErr
+			if err == nil {
+				err = errors.Trace(requestCtx.Err())
+			}
+			return nil, false, -1, err
+		}
+
+		response, err := dnsConn.ReadMsg()
+		RTT := time.Since(startTime)
+		if err == nil && response.MsgHdr.Id != request.MsgHdr.Id {
+			err = dns.ErrId
+		}
+		if err != nil {
+			if !isPacketConn {
+				// A TCP stream can't be resynchronized after a read error.
+				return nil, false, -1, errors.Tracef("invalid response: %v", err)
+			}
+			if requestCtx.Err() == nil {
+				lastErr = errors.Tracef("invalid response: %v", err)
+				logWarning(lastErr)
+			}
+			continue
+		}
+
+		// NXDOMAIN is a valid, negative response. Other unexpected RCodes
+		// lead to a read retry, as in performDNSQuery.
+		if response.MsgHdr.Rcode == dns.RcodeNameError {
+			return []*ServiceBinding{}, false, RTT, nil
+		}
+		if response.MsgHdr.Rcode != dns.RcodeSuccess {
+			errMsg, ok := dns.RcodeToString[response.MsgHdr.Rcode]
+			if !ok {
+				errMsg = fmt.Sprintf("Rcode: %d", response.MsgHdr.Rcode)
+			}
+			lastErr = errors.Tracef("unexpected RCode: %v", errMsg)
+			logWarning(lastErr)
+			if !isPacketConn {
+				return nil, false, -1, lastErr
+			}
+			continue
+		}
+
+		if response.MsgHdr.Truncated {
+			return nil, true, RTT, nil
+		}
+
+		bindings := []*ServiceBinding{}
+		for _, answer := range response.Answer {
+			var record *dns.SVCB
+			switch rr := answer.(type) {
+			case *dns.HTTPS:
+				if questionType == dns.TypeHTTPS {
+					record = &rr.SVCB
+				}
+			case *dns.SVCB:
+				if questionType == dns.TypeSVCB {
+					record = rr
+				}
+			}
+			if record == nil {
+				continue
+			}
+			binding, err := newServiceBinding(record, name, poisonedIPNets)
+			if err != nil {
+				logWarning(errors.Trace(err))
+				continue
+			}
+			bindings = append(bindings, binding)
+		}
+
+		sort.SliceStable(bindings, func(i, j int) bool {
+			return bindings[i].Priority < bindings[j].Priority
+		})
+
+		return bindings, false, RTT, nil
+	}
+}
+
+// newServiceBinding converts a parsed SVCB record to a ServiceBinding.
+// Records which may not be used, including records with unsupported
+// mandatory keys, return an error.
+func newServiceBinding(
+	record *dns.SVCB,
+	name string,
+	poisonedIPNets []*net.IPNet) (*ServiceBinding, error) {
+
+	binding := &ServiceBinding{
+		Priority: record.Priority,
+		Target:   strings.TrimSuffix(record.Target, "."),
+		TTL:      time.Duration(record.Hdr.Ttl) * time.Second,
+	}
+
+	if binding.Target == "" {
+		if binding.IsAlias() {
+			// An AliasMode TargetName of "." indicates that the service is
+			// not available.
+			return nil, errors.TraceNew("service not available")
+		}
+		binding.Target = strings.TrimSuffix(name, ".")
+	}
+
+	checkHint := func(IP net.IP) bool {
+		return !common.IsBogon(IP) && !isPoisonedIP(IP, poisonedIPNets)
+	}
+
+	var mandatory []dns.SVCBKey
+
+	for _, keyValue := range record.Value {
+		switch value := keyValue.(type) {
+		case *dns.SVCBMandatory:
+			mandatory = value.Code
+		case *dns.SVCBAlpn:
+			binding.ALPN = append([]string(nil), value.Alpn...)
+		case *dns.SVCBNoDefaultAlpn:
+			binding.NoDefaultALPN = true
+		case *dns.SVCBPort:
+			binding.Port = int(value.Port)
+		case *dns.SVCBIPv4Hint:
+			for _, IP := range value.Hint {
+				if checkHint(IP) {
+					binding.IPv4Hints = append(binding.IPv4Hints, IP)
+				}
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, IP := range value.Hint {
+				if checkHint(IP) {
+					binding.IPv6Hints = append(binding.IPv6Hints, IP)
+				}
+			}
+		case *dns.SVCBECHConfig:
+			binding.ECHConfigList = append([]byte(nil), value.ECH...)
+		}
+	}
+
+	// Per draft-ietf-dnsop-svcb-https, clients must ignore records with
+	// mandatory keys they don't support.
+	for _, key := range mandatory {
+		switch key {
+		case dns.SVCB_ALPN,
+			dns.SVCB_NO_DEFAULT_ALPN,
+			dns.SVCB_PORT,
+			dns.SVCB_IPV4HINT,
+			dns.SVCB_ECHCONFIG,
+			dns.SVCB_IPV6HINT:
+		default:
+			return nil, errors.Tracef("unsupported mandatory key: %s", key.String())
+		}
+	}
+
+	return binding, nil
+}
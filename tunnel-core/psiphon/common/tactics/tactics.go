@@ -118,6 +118,15 @@ session. This allows for experimenting with provisional tactics; and obtaining
 non-tactic sample metrics in situations which would otherwise always use a
 tactic.
 
+Tactics may also specify experiments, for A/B testing parameter values. Each
+experiment has a list of weighted arms, and each arm specifies parameter
+values which are applied on top of the tactics parameters. A client is
+assigned to one arm of each experiment, deterministically, using a random
+install seed that is stored by the client and never sent to the server. The
+client reports its assigned arms through the "tactics_experiment_arms" common
+metrics API parameter, allowing the outcomes of each arm, including tunnel
+establishment success rates and durations, to be compared.
+
 Speed test data is used in filtered tactics for selection of parameters such as
 timeouts.
 
@@ -163,6 +172,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
@@ -189,6 +200,7 @@ const (
 	SPEED_TEST_SAMPLES_PARAMETER_NAME  = "speed_test_samples"
 	APPLIED_TACTICS_TAG_PARAMETER_NAME = "applied_tactics_tag"
 	STORED_TACTICS_TAG_PARAMETER_NAME  = "stored_tactics_tag"
+	EXPERIMENT_ARMS_PARAMETER_NAME     = "tactics_experiment_arms"
 	TACTICS_METRIC_EVENT_NAME          = "tactics"
 	NEW_TACTICS_TAG_LOG_FIELD_NAME     = "new_tactics_tag"
 	IS_TACTICS_REQUEST_LOG_FIELD_NAME  = "is_tactics_request"
@@ -250,8 +262,13 @@ type Server struct {
 	// condition (vs., say, checking for a zero-value Server).
 	loaded bool
 
-	filterGeoIPScope   int
-	filterRegionScopes map[string]int
+	// configTag is the hash of the loaded DefaultTactics and
+	// FilteredTactics. See GetConfigTag.
+	configTag string
+
+	filterGeoIPScope     int
+	filterRegionScopes   map[string]int
+	filterTimeBoundaries []time.Time
 
 	logger                common.Logger
 	logFieldFormatter     common.APIParameterLogFieldFormatter
@@ -292,6 +309,28 @@ type Filter struct {
 	// client speed test samples must satisfy.
 	SpeedTestRTTMilliseconds *Range
 
+	// NetworkTypes specifies a list of network types, one of which the
+	// client's current network type, the "network_type" API parameter, must
+	// match. Network type values include "WIFI", "MOBILE", "WIRED", and
+	// "UNKNOWN".
+	NetworkTypes []string
+
+	// ClientFeatures specifies a list of client features, one of which must
+	// be reported by the client in the "client_features" API parameter.
+	ClientFeatures []string
+
+	// ClientVersion specifies a VersionRange that the client version, the
+	// "client_version" API parameter, must satisfy.
+	ClientVersion *VersionRange
+
+	// TimeWindows specifies a list of time windows, one of which the current
+	// time, on the server, must fall within.
+	//
+	// Clients retain tactics until the tactics TTL expires, so a client may
+	// continue to apply time window tactics for up to the TTL after the
+	// window ends.
+	TimeWindows []TimeWindow
+
 	regionLookup map[string]bool
 	ispLookup    map[string]bool
 	asnLookup    map[string]bool
@@ -318,6 +357,36 @@ type Range struct {
 	AtMost *int
 }
 
+// VersionRange is a filter field which specifies that a client version is
+// within specified upper and lower bounds, inclusive. At least one bound must
+// be specified.
+//
+// Versions are compared semantically: a version is a list of "."-separated
+// non-negative integers, compared component by component, with missing
+// components treated as 0. For example, "2.10" is greater than "2.9", and
+// "168" is greater than "99".
+type VersionRange struct {
+
+	// AtLeast specifies a lower bound for the client version.
+	AtLeast string
+
+	// AtMost specifies an upper bound for the client version.
+	AtMost string
+}
+
+// TimeWindow is a filter field which specifies a time range. At least one
+// bound must be specified.
+type TimeWindow struct {
+
+	// Start specifies the beginning of the window, inclusive. When omitted,
+	// the window has no lower bound.
+	Start time.Time
+
+	// End specifies the end of the window, exclusive. When omitted, the window
+	// has no upper bound.
+	End time.Time
+}
+
 // Payload is the data to be returned to the client in response to a
 // tactics request or in the handshake response.
 type Payload struct {
@@ -371,6 +440,45 @@ type Tactics struct {
 	// be a subset of parameter.ClientParameter values and follow
 	// the corresponding data type and minimum value constraints.
 	Parameters map[string]interface{}
+
+	// Experiments specify A/B experiments. The client is assigned to
+	// one arm of each experiment, and the arm parameters are applied
+	// on top of Parameters.
+	//
+	// When merging, an experiment replaces any existing experiment
+	// with the same ID.
+	Experiments []*Experiment `json:",omitempty"`
+}
+
+// Experiment is an A/B experiment, with a set of arms, each of which
+// specifies alternative parameter values.
+type Experiment struct {
+
+	// ID identifies the experiment. IDs must not contain ':'.
+	ID string
+
+	// Arms is the list of experiment arms. There must be at least one
+	// arm.
+	Arms []*ExperimentArm
+}
+
+// ExperimentArm is an experiment arm.
+type ExperimentArm struct {
+
+	// ID identifies the arm within its experiment. IDs must not
+	// contain ':'.
+	ID string
+
+	// Weight is the relative weight of the arm. The probability that
+	// a client is assigned to the arm is Weight divided by the sum of
+	// all arm weights in the experiment.
+	Weight int
+
+	// Parameters specify client parameters to override when the client
+	// is assigned to the arm. As with Tactics.Parameters, these must be
+	// valid client parameters. Server-side only parameters are not
+	// permitted, as the server does not know the client's arm.
+	Parameters map[string]interface{}
 }
 
 // Note: the SpeedTestSample json tags are selected to minimize marshaled
@@ -471,6 +579,13 @@ func NewServer(
 			server.DefaultTactics = newServer.DefaultTactics
 			server.FilteredTactics = newServer.FilteredTactics
 
+			configTag, err := makeConfigTag(
+				&server.DefaultTactics, server.FilteredTactics)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			server.configTag = configTag
+
 			server.initLookups()
 
 			server.loaded = true
@@ -486,6 +601,31 @@ func NewServer(
 	return server, nil
 }
 
+// GetConfigTag returns a tag that identifies the currently loaded tactics
+// configuration, including all filtered tactics. The tag changes whenever a
+// reload changes any tactics, and may be used to discard state, such as
+// persisted replay parameters, derived from previous tactics. The tag is ""
+// when no tactics configuration is loaded.
+func (server *Server) GetConfigTag() string {
+	server.ReloadableFile.RLock()
+	defer server.ReloadableFile.RUnlock()
+
+	return server.configTag
+}
+
+func makeConfigTag(defaultTactics *Tactics, filteredTactics interface{}) (string, error) {
+	marshaledTactics, err := json.Marshal(
+		[]interface{}{defaultTactics, filteredTactics})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	// MD5 hash is used solely as a data checksum and not for any security purpose.
+	digest := md5.Sum(marshaledTactics)
+
+	return hex.EncodeToString(digest[:]), nil
+}
+
 // Validate checks for correct tactics configuration values.
 func (server *Server) Validate() error {
 
@@ -565,6 +705,59 @@ func (server *Server) Validate() error {
 			return errors.Trace(err)
 		}
 
+		experimentIDs := make(map[string]bool)
+
+		for _, experiment := range tactics.Experiments {
+
+			if experiment == nil ||
+				experiment.ID == "" ||
+				strings.Contains(experiment.ID, ":") ||
+				experimentIDs[experiment.ID] {
+
+				return errors.TraceNew("invalid experiment ID")
+			}
+			experimentIDs[experiment.ID] = true
+
+			if len(experiment.Arms) == 0 {
+				return errors.Tracef(
+					"missing experiment arms: %s", experiment.ID)
+			}
+
+			armIDs := make(map[string]bool)
+
+			for _, arm := range experiment.Arms {
+
+				if arm == nil ||
+					arm.ID == "" ||
+					strings.Contains(arm.ID, ":") ||
+					armIDs[arm.ID] {
+
+					return errors.Tracef(
+						"invalid experiment arm ID: %s", experiment.ID)
+				}
+				armIDs[arm.ID] = true
+
+				if arm.Weight <= 0 {
+					return errors.Tracef(
+						"invalid experiment arm weight: %s:%s", experiment.ID, arm.ID)
+				}
+
+				for name := range arm.Parameters {
+					if parameters.IsServerSideOnly(name) {
+						return errors.Tracef(
+							"invalid experiment arm parameter: %s:%s: %s",
+							experiment.ID, arm.ID, name)
+					}
+				}
+
+				_, err = params.Set(
+					"", false, append(applyParameters, arm.Parameters)...)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+
 		return nil
 	}
 
@@ -587,6 +780,47 @@ func (server *Server) Validate() error {
 		return nil
 	}
 
+	validateVersionRange := func(r *VersionRange) error {
+		if r == nil {
+			return nil
+		}
+
+		if r.AtLeast == "" && r.AtMost == "" {
+			return errors.TraceNew("invalid version range")
+		}
+
+		for _, version := range []string{r.AtLeast, r.AtMost} {
+			if version == "" {
+				continue
+			}
+			_, err := parseVersion(version)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if r.AtLeast != "" && r.AtMost != "" {
+			c, _ := compareVersions(r.AtLeast, r.AtMost)
+			if c > 0 {
+				return errors.TraceNew("invalid version range")
+			}
+		}
+
+		return nil
+	}
+
+	validateTimeWindows := func(windows []TimeWindow) error {
+		for _, window := range windows {
+			if (window.Start.IsZero() && window.End.IsZero()) ||
+				(!window.Start.IsZero() && !window.End.IsZero() &&
+					!window.Start.Before(window.End)) {
+
+				return errors.TraceNew("invalid time window")
+			}
+		}
+		return nil
+	}
+
 	err := validateTactics(&server.DefaultTactics, nil)
 	if err != nil {
 		return errors.Tracef("invalid default tactics: %s", err)
@@ -600,6 +834,14 @@ func (server *Server) Validate() error {
 			err = validateRange(filteredTactics.Filter.SpeedTestRTTMilliseconds)
 		}
 
+		if err == nil {
+			err = validateVersionRange(filteredTactics.Filter.ClientVersion)
+		}
+
+		if err == nil {
+			err = validateTimeWindows(filteredTactics.Filter.TimeWindows)
+		}
+
 		// TODO: validate Filter.APIParameters names are valid?
 
 		if err != nil {
@@ -620,9 +862,19 @@ func (server *Server) initLookups() {
 
 	server.filterGeoIPScope = 0
 	server.filterRegionScopes = make(map[string]int)
+	server.filterTimeBoundaries = nil
 
 	for _, filteredTactics := range server.FilteredTactics {
 
+		for _, window := range filteredTactics.Filter.TimeWindows {
+			for _, boundary := range []time.Time{window.Start, window.End} {
+				if !boundary.IsZero() {
+					server.filterTimeBoundaries = append(
+						server.filterTimeBoundaries, boundary)
+				}
+			}
+		}
+
 		if len(filteredTactics.Filter.Regions) >= stringLookupThreshold {
 			filteredTactics.Filter.regionLookup = make(map[string]bool)
 			for _, region := range filteredTactics.Filter.Regions {
@@ -706,6 +958,10 @@ func (server *Server) initLookups() {
 		// TODO: add lookups for APIParameters?
 		// Not expected to be long lists of values.
 	}
+
+	sort.Slice(server.filterTimeBoundaries, func(i, j int) bool {
+		return server.filterTimeBoundaries[i].Before(server.filterTimeBoundaries[j])
+	})
 }
 
 // GetFilterGeoIPScope returns which GeoIP fields are relevent to tactics
@@ -728,6 +984,21 @@ func (server *Server) GetFilterGeoIPScope(geoIPData common.GeoIPData) int {
 	return scope
 }
 
+// GetFilterTimeScope returns a value that identifies the period, between
+// consecutive tactics filter time window boundaries, containing the specified
+// time. The result of filtering by TimeWindows is the same for all times with
+// the same time scope, so the time scope may be used, along with the GeoIP
+// scope, as a cache key for filtered tactics.
+func (server *Server) GetFilterTimeScope(now time.Time) int {
+
+	server.ReloadableFile.RLock()
+	defer server.ReloadableFile.RUnlock()
+
+	return sort.Search(len(server.filterTimeBoundaries), func(i int) bool {
+		return server.filterTimeBoundaries[i].After(now)
+	})
+}
+
 // GetTacticsPayload assembles and returns a tactics payload for a client with
 // the specified GeoIP, API parameter, and speed test attributes.
 //
@@ -839,6 +1110,64 @@ func (server *Server) GetTactics(
 	geoIPData common.GeoIPData,
 	apiParams common.APIParameters) (*Tactics, error) {
 
+	return server.getTactics(includeServerSideOnly, geoIPData, apiParams, nil)
+}
+
+// FilterResult reports the outcome of checking one FilteredTactics entry
+// against client attributes. When Matched is false, Mismatch names the
+// first Filter field that the client attributes did not satisfy.
+type FilterResult struct {
+	Index    int
+	Filter   Filter
+	Matched  bool
+	Mismatch string
+}
+
+// ExplainTactics is GetTacticsWithTag with the addition of a FilterResult for
+// each FilteredTactics entry, in order. ExplainTactics is intended for
+// offline tools which inspect tactics configurations; it is not optimized
+// for use in the request path.
+func (server *Server) ExplainTactics(
+	includeServerSideOnly bool,
+	geoIPData common.GeoIPData,
+	apiParams common.APIParameters) (*Tactics, string, []FilterResult, error) {
+
+	var results []FilterResult
+
+	tactics, err := server.getTactics(
+		includeServerSideOnly,
+		geoIPData,
+		apiParams,
+		func(index int, filter *Filter, mismatch string) {
+			results = append(results, FilterResult{
+				Index:    index,
+				Filter:   *filter,
+				Matched:  mismatch == "",
+				Mismatch: mismatch,
+			})
+		})
+	if err != nil {
+		return nil, "", nil, errors.Trace(err)
+	}
+
+	if tactics == nil {
+		return nil, "", results, nil
+	}
+
+	_, tag, err := marshalTactics(tactics)
+	if err != nil {
+		return nil, "", nil, errors.Trace(err)
+	}
+
+	return tactics, tag, results, nil
+}
+
+func (server *Server) getTactics(
+	includeServerSideOnly bool,
+	geoIPData common.GeoIPData,
+	apiParams common.APIParameters,
+	explain func(int, *Filter, string)) (*Tactics, error) {
+
 	server.ReloadableFile.RLock()
 	defer server.ReloadableFile.RUnlock()
 
@@ -851,114 +1180,242 @@ func (server *Server) GetTactics(
 
 	var aggregatedValues map[string]int
 
-	for _, filteredTactics := range server.FilteredTactics {
+	now := time.Now()
 
-		if len(filteredTactics.Filter.Regions) > 0 {
-			if filteredTactics.Filter.regionLookup != nil {
-				if !filteredTactics.Filter.regionLookup[geoIPData.Country] {
-					continue
-				}
-			} else {
-				if !common.Contains(filteredTactics.Filter.Regions, geoIPData.Country) {
-					continue
-				}
-			}
+	for i, filteredTactics := range server.FilteredTactics {
+
+		mismatch := filteredTactics.Filter.check(
+			geoIPData, apiParams, now, &aggregatedValues)
+
+		if explain != nil {
+			explain(i, &filteredTactics.Filter, mismatch)
 		}
 
-		if len(filteredTactics.Filter.ISPs) > 0 {
-			if filteredTactics.Filter.ispLookup != nil {
-				if !filteredTactics.Filter.ispLookup[geoIPData.ISP] {
-					continue
-				}
-			} else {
-				if !common.Contains(filteredTactics.Filter.ISPs, geoIPData.ISP) {
-					continue
-				}
-			}
+		if mismatch != "" {
+			continue
 		}
 
-		if len(filteredTactics.Filter.ASNs) > 0 {
-			if filteredTactics.Filter.asnLookup != nil {
-				if !filteredTactics.Filter.asnLookup[geoIPData.ASN] {
-					continue
-				}
-			} else {
-				if !common.Contains(filteredTactics.Filter.ASNs, geoIPData.ASN) {
-					continue
-				}
+		tactics.merge(includeServerSideOnly, &filteredTactics.Tactics)
+
+		// Continue to apply more matches. Last matching tactics has priority for any field.
+	}
+
+	return tactics, nil
+}
+
+// check returns "" when the client attributes satisfy the filter, or else
+// the name of the first filter field that isn't satisfied. The returned
+// values are constant strings, so check doesn't allocate in the common case.
+func (filter *Filter) check(
+	geoIPData common.GeoIPData,
+	apiParams common.APIParameters,
+	now time.Time,
+	aggregatedValues *map[string]int) string {
+
+	if len(filter.Regions) > 0 {
+		if filter.regionLookup != nil {
+			if !filter.regionLookup[geoIPData.Country] {
+				return "Regions"
+			}
+		} else {
+			if !common.Contains(filter.Regions, geoIPData.Country) {
+				return "Regions"
 			}
 		}
+	}
 
-		if len(filteredTactics.Filter.Cities) > 0 {
-			if filteredTactics.Filter.cityLookup != nil {
-				if !filteredTactics.Filter.cityLookup[geoIPData.City] {
-					continue
-				}
-			} else {
-				if !common.Contains(filteredTactics.Filter.Cities, geoIPData.City) {
-					continue
-				}
+	if len(filter.ISPs) > 0 {
+		if filter.ispLookup != nil {
+			if !filter.ispLookup[geoIPData.ISP] {
+				return "ISPs"
+			}
+		} else {
+			if !common.Contains(filter.ISPs, geoIPData.ISP) {
+				return "ISPs"
 			}
 		}
+	}
 
-		if filteredTactics.Filter.APIParameters != nil {
-			mismatch := false
-			for name, values := range filteredTactics.Filter.APIParameters {
-				clientValue, err := getStringRequestParam(apiParams, name)
-				if err != nil || !common.ContainsWildcard(values, clientValue) {
-					mismatch = true
-					break
-				}
+	if len(filter.ASNs) > 0 {
+		if filter.asnLookup != nil {
+			if !filter.asnLookup[geoIPData.ASN] {
+				return "ASNs"
 			}
-			if mismatch {
-				continue
+		} else {
+			if !common.Contains(filter.ASNs, geoIPData.ASN) {
+				return "ASNs"
 			}
 		}
+	}
 
-		if filteredTactics.Filter.SpeedTestRTTMilliseconds != nil {
-
-			var speedTestSamples []SpeedTestSample
-			err := getJSONRequestParam(apiParams, SPEED_TEST_SAMPLES_PARAMETER_NAME, &speedTestSamples)
-			if err != nil {
-				// TODO: log speed test parameter errors?
-				// This API param is not explicitly validated elsewhere.
-				continue
+	if len(filter.Cities) > 0 {
+		if filter.cityLookup != nil {
+			if !filter.cityLookup[geoIPData.City] {
+				return "Cities"
 			}
-
-			// As there must be at least one Range bound, there must be data to aggregate.
-			if len(speedTestSamples) == 0 {
-				continue
+		} else {
+			if !common.Contains(filter.Cities, geoIPData.City) {
+				return "Cities"
 			}
+		}
+	}
 
-			if aggregatedValues == nil {
-				aggregatedValues = make(map[string]int)
+	if filter.APIParameters != nil {
+		for name, values := range filter.APIParameters {
+			clientValue, err := getStringRequestParam(apiParams, name)
+			if err != nil || !common.ContainsWildcard(values, clientValue) {
+				return "APIParameters"
 			}
+		}
+	}
 
-			// Note: here we could filter out outliers such as samples that are unusually old
-			// or client/endPoint region pair too distant.
+	if len(filter.NetworkTypes) > 0 {
+		networkType, err := getStringRequestParam(apiParams, "network_type")
+		if err != nil || !common.Contains(filter.NetworkTypes, networkType) {
+			return "NetworkTypes"
+		}
+	}
 
-			// aggregate may mutate (sort) the speedTestSamples slice.
-			value := aggregate(
-				filteredTactics.Filter.SpeedTestRTTMilliseconds.Aggregation,
-				speedTestSamples,
-				aggregatedValues)
+	if len(filter.ClientFeatures) > 0 {
+		clientFeatures, err := getStringArrayRequestParam(apiParams, "client_features")
+		if err != nil || !common.ContainsAny(filter.ClientFeatures, clientFeatures) {
+			return "ClientFeatures"
+		}
+	}
 
-			if filteredTactics.Filter.SpeedTestRTTMilliseconds.AtLeast != nil &&
-				value < *filteredTactics.Filter.SpeedTestRTTMilliseconds.AtLeast {
-				continue
-			}
-			if filteredTactics.Filter.SpeedTestRTTMilliseconds.AtMost != nil &&
-				value > *filteredTactics.Filter.SpeedTestRTTMilliseconds.AtMost {
-				continue
+	if filter.ClientVersion != nil {
+		clientVersion, err := getStringRequestParam(apiParams, "client_version")
+		if err != nil || !filter.ClientVersion.contains(clientVersion) {
+			return "ClientVersion"
+		}
+	}
+
+	if len(filter.TimeWindows) > 0 {
+		inWindow := false
+		for _, window := range filter.TimeWindows {
+			if window.contains(now) {
+				inWindow = true
+				break
 			}
 		}
+		if !inWindow {
+			return "TimeWindows"
+		}
+	}
 
-		tactics.merge(includeServerSideOnly, &filteredTactics.Tactics)
+	if filter.SpeedTestRTTMilliseconds != nil {
 
-		// Continue to apply more matches. Last matching tactics has priority for any field.
+		var speedTestSamples []SpeedTestSample
+		err := getJSONRequestParam(apiParams, SPEED_TEST_SAMPLES_PARAMETER_NAME, &speedTestSamples)
+		if err != nil {
+			// TODO: log speed test parameter errors?
+			// This API param is not explicitly validated elsewhere.
+			return "SpeedTestRTTMilliseconds"
+		}
+
+		// As there must be at least one Range bound, there must be data to aggregate.
+		if len(speedTestSamples) == 0 {
+			return "SpeedTestRTTMilliseconds"
+		}
+
+		if *aggregatedValues == nil {
+			*aggregatedValues = make(map[string]int)
+		}
+
+		// Note: here we could filter out outliers such as samples that are unusually old
+		// or client/endPoint region pair too distant.
+
+		// aggregate may mutate (sort) the speedTestSamples slice.
+		value := aggregate(
+			filter.SpeedTestRTTMilliseconds.Aggregation,
+			speedTestSamples,
+			*aggregatedValues)
+
+		if filter.SpeedTestRTTMilliseconds.AtLeast != nil &&
+			value < *filter.SpeedTestRTTMilliseconds.AtLeast {
+			return "SpeedTestRTTMilliseconds"
+		}
+		if filter.SpeedTestRTTMilliseconds.AtMost != nil &&
+			value > *filter.SpeedTestRTTMilliseconds.AtMost {
+			return "SpeedTestRTTMilliseconds"
+		}
 	}
 
-	return tactics, nil
+	return ""
+}
+
+// contains indicates if the version is within the range. Invalid versions are
+// not within any range.
+func (r *VersionRange) contains(version string) bool {
+	if r.AtLeast != "" {
+		c, err := compareVersions(version, r.AtLeast)
+		if err != nil || c < 0 {
+			return false
+		}
+	}
+	if r.AtMost != "" {
+		c, err := compareVersions(version, r.AtMost)
+		if err != nil || c > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseVersion parses a "."-separated version string.
+func parseVersion(version string) ([]int, error) {
+	if version == "" {
+		return nil, errors.TraceNew("invalid version")
+	}
+	fields := strings.Split(version, ".")
+	components := make([]int, len(fields))
+	for i, field := range fields {
+		component, err := strconv.Atoi(field)
+		if err != nil || component < 0 {
+			return nil, errors.Tracef("invalid version: %s", version)
+		}
+		components[i] = component
+	}
+	return components, nil
+}
+
+// compareVersions returns -1, 0, or 1 when version a is less than, equal to,
+// or greater than version b.
+func compareVersions(a, b string) (int, error) {
+	componentsA, err := parseVersion(a)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	componentsB, err := parseVersion(b)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	for i := 0; i < len(componentsA) || i < len(componentsB); i++ {
+		var componentA, componentB int
+		if i < len(componentsA) {
+			componentA = componentsA[i]
+		}
+		if i < len(componentsB) {
+			componentB = componentsB[i]
+		}
+		if componentA < componentB {
+			return -1, nil
+		} else if componentA > componentB {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// contains indicates if the time is within the window.
+func (w *TimeWindow) contains(t time.Time) bool {
+	if !w.Start.IsZero() && t.Before(w.Start) {
+		return false
+	}
+	if !w.End.IsZero() && !t.Before(w.End) {
+		return false
+	}
+	return true
 }
 
 // TODO: refactor this copy of psiphon/server.getStringRequestParam into common?
@@ -973,6 +1430,32 @@ func getStringRequestParam(apiParams common.APIParameters, name string) (string,
 	return value, nil
 }
 
+func getStringArrayRequestParam(apiParams common.APIParameters, name string) ([]string, error) {
+	if apiParams[name] == nil {
+		return nil, errors.Tracef("missing param: %s", name)
+	}
+
+	// Array parameters are []string when set by the client, and []interface{}
+	// when unmarshaled from a JSON request by the server.
+
+	switch value := apiParams[name].(type) {
+	case []string:
+		return value, nil
+	case []interface{}:
+		values := make([]string, len(value))
+		for i, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.Tracef("invalid param: %s", name)
+			}
+			values[i] = s
+		}
+		return values, nil
+	}
+
+	return nil, errors.Tracef("invalid param: %s", name)
+}
+
 func getJSONRequestParam(apiParams common.APIParameters, name string, value interface{}) error {
 	if apiParams[name] == nil {
 		return errors.Tracef("missing param: %s", name)
@@ -1081,6 +1564,12 @@ func (t *Tactics) clone(includeServerSideOnly bool) *Tactics {
 		Probability: t.Probability,
 	}
 
+	// Note: as with parameter values, there is no deep copy of
+	// experiments.
+	if t.Experiments != nil {
+		u.Experiments = append([]*Experiment(nil), t.Experiments...)
+	}
+
 	// Note: there is no deep copy of parameter values; the the returned
 	// Tactics shares memory with the original and it individual parameters
 	// should not be modified.
@@ -1119,6 +1608,97 @@ func (t *Tactics) merge(includeServerSideOnly bool, u *Tactics) {
 			}
 		}
 	}
+
+	for _, experiment := range u.Experiments {
+		replaced := false
+		for i, existing := range t.Experiments {
+			if existing.ID == experiment.ID {
+				t.Experiments[i] = experiment
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			t.Experiments = append(t.Experiments, experiment)
+		}
+	}
+}
+
+// GetExperimentParameters returns the tactics parameters with the parameters
+// of each assigned experiment arm applied, along with the list of assigned
+// arms, each in the form "<experiment ID>:<arm ID>". When there are no
+// experiments, Parameters is returned as-is.
+//
+// Arms are assigned deterministically using installSeed, which the client
+// generates once and stores locally, and the experiment ID. So the client
+// remains in the same arm across sessions and tactics updates as long as the
+// experiment arms and weights are unchanged, and arm assignments are
+// independent across experiments. installSeed is not sent to the server, and
+// the assigned arms are not, alone, a persistent client identifier.
+func (t *Tactics) GetExperimentParameters(
+	installSeed *prng.Seed) (map[string]interface{}, []string, error) {
+
+	if len(t.Experiments) == 0 {
+		return t.Parameters, nil, nil
+	}
+
+	if installSeed == nil {
+		return nil, nil, errors.TraceNew("missing install seed")
+	}
+
+	// Note: there is no deep copy of parameter values; the returned
+	// parameters share memory with the tactics and individual parameter
+	// values should not be modified.
+	applyParameters := make(map[string]interface{})
+	for k, v := range t.Parameters {
+		applyParameters[k] = v
+	}
+
+	var arms []string
+
+	for _, experiment := range t.Experiments {
+
+		arm, err := experiment.selectArm(installSeed)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		for k, v := range arm.Parameters {
+			applyParameters[k] = v
+		}
+
+		arms = append(arms, fmt.Sprintf("%s:%s", experiment.ID, arm.ID))
+	}
+
+	return applyParameters, arms, nil
+}
+
+// selectArm deterministically selects an arm using a PRNG seeded with
+// installSeed salted with the experiment ID.
+func (e *Experiment) selectArm(installSeed *prng.Seed) (*ExperimentArm, error) {
+
+	totalWeight := 0
+	for _, arm := range e.Arms {
+		totalWeight += arm.Weight
+	}
+	if totalWeight <= 0 {
+		return nil, errors.Tracef("invalid experiment weights: %s", e.ID)
+	}
+
+	PRNG, err := prng.NewPRNGWithSaltedSeed(installSeed, e.ID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	n := PRNG.Intn(totalWeight)
+	for _, arm := range e.Arms {
+		if n < arm.Weight {
+			return arm, nil
+		}
+		n -= arm.Weight
+	}
+
+	return nil, errors.TraceNew("unexpected arm selection failure")
 }
 
 // HandleEndPoint routes the request to either handleSpeedTestRequest
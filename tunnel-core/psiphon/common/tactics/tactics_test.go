@@ -34,6 +34,7 @@ import (
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/parameters"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/stacktrace"
 )
@@ -1072,6 +1073,440 @@ func TestTacticsFilterGeoIPScope(t *testing.T) {
 	}
 }
 
+func TestTacticsFilters(t *testing.T) {
+
+	encodedRequestPublicKey, encodedRequestPrivateKey, encodedObfuscatedKey, err := GenerateKeys()
+	if err != nil {
+		t.Fatalf("GenerateKeys failed: %s", err)
+	}
+
+	now := time.Now().UTC()
+	windowStart := now.Add(-1 * time.Hour).Format(time.RFC3339)
+	windowEnd := now.Add(1 * time.Hour).Format(time.RFC3339)
+	futureWindowStart := now.Add(2 * time.Hour).Format(time.RFC3339)
+
+	tacticsConfigTemplate := fmt.Sprintf(`
+    {
+      "RequestPublicKey" : "%s",
+      "RequestPrivateKey" : "%s",
+      "RequestObfuscatedKey" : "%s",
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0
+      },
+      "FilteredTactics" : [
+        %%s
+      ]
+    }
+    `, encodedRequestPublicKey, encodedRequestPrivateKey, encodedObfuscatedKey)
+
+	file, err := ioutil.TempFile("", "tactics.config")
+	if err != nil {
+		t.Fatalf("TempFile create failed: %s", err)
+	}
+	file.Close()
+
+	configFileName := file.Name()
+	defer os.Remove(configFileName)
+
+	writeConfig := func(filteredTactics string) {
+		err := ioutil.WriteFile(
+			configFileName,
+			[]byte(fmt.Sprintf(tacticsConfigTemplate, filteredTactics)),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	// Test: invalid filters fail validation
+
+	invalidFilters := []string{
+		`{"Filter" : {"ClientVersion" : {}}}`,
+		`{"Filter" : {"ClientVersion" : {"AtLeast" : "1.a"}}}`,
+		`{"Filter" : {"ClientVersion" : {"AtLeast" : "2", "AtMost" : "1.9"}}}`,
+		`{"Filter" : {"TimeWindows" : [{}]}}`,
+		fmt.Sprintf(`{"Filter" : {"TimeWindows" : [{"Start" : "%s", "End" : "%s"}]}}`,
+			windowEnd, windowStart),
+	}
+
+	for _, invalidFilter := range invalidFilters {
+		writeConfig(invalidFilter)
+		_, err := NewServer(nil, nil, nil, configFileName)
+		if err == nil {
+			t.Fatalf("NewServer unexpected success: %s", invalidFilter)
+		}
+	}
+
+	// Test: each filter field selects tactics
+
+	writeConfig(fmt.Sprintf(`
+        {
+          "Filter" : {
+            "ISPs" : ["I1"],
+            "NetworkTypes" : ["WIFI"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "ConnectionWorkerPoolSize" : 1
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "ISPs" : ["I1"],
+            "NetworkTypes" : ["MOBILE"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "ConnectionWorkerPoolSize" : 2
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "ClientFeatures" : ["F1", "F2"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "LimitTunnelProtocols" : ["OSSH"]
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "ClientVersion" : {"AtLeast" : "9", "AtMost" : "10.2"}
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "TunnelConnectTimeout" : "1s"
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "TimeWindows" : [
+              {"Start" : "%s"},
+              {"Start" : "%s", "End" : "%s"}
+            ]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "EstablishTunnelPausePeriod" : "1s"
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "TimeWindows" : [{"End" : "%s"}]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "EstablishTunnelTimeout" : "1s"
+            }
+          }
+        }
+	`, futureWindowStart, windowStart, windowEnd, windowStart))
+
+	server, err := NewServer(nil, nil, nil, configFileName)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	testCases := []struct {
+		description        string
+		apiParams          common.APIParameters
+		expectedParameters []string
+	}{
+		{
+			"WiFi network",
+			common.APIParameters{"network_type": "WIFI"},
+			[]string{"ConnectionWorkerPoolSize=1"},
+		},
+		{
+			"mobile network",
+			common.APIParameters{"network_type": "MOBILE"},
+			[]string{"ConnectionWorkerPoolSize=2"},
+		},
+		{
+			"unknown network",
+			common.APIParameters{"network_type": "UNKNOWN"},
+			nil,
+		},
+		{
+			"client features",
+			common.APIParameters{"client_features": []string{"F0", "F2"}},
+			[]string{"LimitTunnelProtocols"},
+		},
+		{
+			"unmarshaled client features",
+			common.APIParameters{"client_features": []interface{}{"F1"}},
+			[]string{"LimitTunnelProtocols"},
+		},
+		{
+			"no matching client features",
+			common.APIParameters{"client_features": []string{"F0"}},
+			nil,
+		},
+		{
+			"client version in range",
+			common.APIParameters{"client_version": "10"},
+			[]string{"TunnelConnectTimeout"},
+		},
+		{
+			"client version at upper bound",
+			common.APIParameters{"client_version": "10.2.0"},
+			[]string{"TunnelConnectTimeout"},
+		},
+		{
+			"client version above range",
+			common.APIParameters{"client_version": "10.10"},
+			nil,
+		},
+		{
+			"client version below range",
+			common.APIParameters{"client_version": "8"},
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			tactics, err := server.GetTactics(
+				true, common.GeoIPData{ISP: "I1"}, testCase.apiParams)
+			if err != nil {
+				t.Fatalf("GetTactics failed: %s", err)
+			}
+
+			// The first time window filter matches and the second does not.
+			expectedParameters := append(
+				[]string{"EstablishTunnelPausePeriod"},
+				testCase.expectedParameters...)
+
+			if len(tactics.Parameters) != len(expectedParameters) {
+				t.Fatalf("unexpected parameters: %v", tactics.Parameters)
+			}
+
+			for _, expected := range expectedParameters {
+				name := expected
+				value := ""
+				if strings.Contains(expected, "=") {
+					fields := strings.SplitN(expected, "=", 2)
+					name, value = fields[0], fields[1]
+				}
+				v, ok := tactics.Parameters[name]
+				if !ok || (value != "" && fmt.Sprintf("%v", v) != value) {
+					t.Fatalf("unexpected parameters: %v", tactics.Parameters)
+				}
+			}
+		})
+	}
+
+	// Test: time scope changes at each time window boundary
+
+	scope := server.GetFilterTimeScope(now)
+	if server.GetFilterTimeScope(now.Add(30*time.Minute)) != scope {
+		t.Fatalf("unexpected time scope change")
+	}
+	if server.GetFilterTimeScope(now.Add(90*time.Minute)) == scope {
+		t.Fatalf("unexpected time scope")
+	}
+	if server.GetFilterTimeScope(now.Add(-90*time.Minute)) == scope {
+		t.Fatalf("unexpected time scope")
+	}
+}
+
+func TestTacticsExperiments(t *testing.T) {
+
+	encodedRequestPublicKey, encodedRequestPrivateKey, encodedObfuscatedKey, err := GenerateKeys()
+	if err != nil {
+		t.Fatalf("GenerateKeys failed: %s", err)
+	}
+
+	tacticsConfigTemplate := fmt.Sprintf(`
+    {
+      "RequestPublicKey" : "%s",
+      "RequestPrivateKey" : "%s",
+      "RequestObfuscatedKey" : "%s",
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "ConnectionWorkerPoolSize" : 1
+        },
+        "Experiments" : [
+          {
+            "ID" : "E1",
+            "Arms" : [
+              {
+                "ID" : "A1",
+                "Weight" : 1,
+                "Parameters" : {
+                  "ConnectionWorkerPoolSize" : 2
+                }
+              },
+              {
+                "ID" : "A2",
+                "Weight" : 3,
+                "Parameters" : {
+                  "ConnectionWorkerPoolSize" : 3
+                }
+              }
+            ]
+          },
+          {
+            "ID" : "E2",
+            "Arms" : [
+              {
+                "ID" : "A1",
+                "Weight" : 1
+              }
+            ]
+          }
+        ]
+      },
+      "FilteredTactics" : [
+        {
+          "Filter" : {
+            "Regions": ["R1"]
+          },
+          "Tactics" : {
+            "Experiments" : [
+              %%s
+            ]
+          }
+        }
+      ]
+    }
+    `, encodedRequestPublicKey, encodedRequestPrivateKey, encodedObfuscatedKey)
+
+	file, err := ioutil.TempFile("", "tactics.config")
+	if err != nil {
+		t.Fatalf("TempFile create failed: %s", err)
+	}
+	file.Close()
+
+	configFileName := file.Name()
+	defer os.Remove(configFileName)
+
+	writeConfig := func(filteredExperiment string) {
+		err := ioutil.WriteFile(
+			configFileName,
+			[]byte(fmt.Sprintf(tacticsConfigTemplate, filteredExperiment)),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	// Test: invalid experiments fail validation
+
+	invalidExperiments := []string{
+		`{"ID" : "E3", "Arms" : []}`,
+		`{"ID" : "E3", "Arms" : [{"ID" : "A1", "Weight" : 0}]}`,
+		`{"ID" : "E3", "Arms" : [{"ID" : "A:1", "Weight" : 1}]}`,
+		`{"ID" : "E3", "Arms" : [{"ID" : "A1", "Weight" : 1}, {"ID" : "A1", "Weight" : 1}]}`,
+		`{"ID" : "E3", "Arms" : [{"ID" : "A1", "Weight" : 1, "Parameters" : {"ConnectionWorkerPoolSize" : -1}}]}`,
+		`{"ID" : "E3", "Arms" : [{"ID" : "A1", "Weight" : 1, "Parameters" : {"ServerReplayPacketManipulation" : true}}]}`,
+	}
+
+	for _, invalidExperiment := range invalidExperiments {
+		writeConfig(invalidExperiment)
+		_, err := NewServer(nil, nil, nil, configFileName)
+		if err == nil {
+			t.Fatalf("NewServer unexpected success: %s", invalidExperiment)
+		}
+	}
+
+	// Test: filtered experiments replace experiments with the same ID
+
+	writeConfig(`{"ID" : "E2", "Arms" : [{"ID" : "A2", "Weight" : 1}]}`)
+
+	server, err := NewServer(nil, nil, nil, configFileName)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	tactics, err := server.GetTactics(
+		false, common.GeoIPData{Country: "R1"}, make(common.APIParameters))
+	if err != nil {
+		t.Fatalf("GetTactics failed: %s", err)
+	}
+
+	if len(tactics.Experiments) != 2 ||
+		tactics.Experiments[1].ID != "E2" ||
+		tactics.Experiments[1].Arms[0].ID != "A2" {
+		t.Fatalf("unexpected experiments")
+	}
+
+	if len(server.DefaultTactics.Experiments) != 2 ||
+		server.DefaultTactics.Experiments[1].Arms[0].ID != "A1" {
+		t.Fatalf("unexpected default experiments")
+	}
+
+	// Test: arm assignment is deterministic and follows arm weights
+
+	tactics, err = server.GetTactics(
+		false, common.GeoIPData{Country: "R0"}, make(common.APIParameters))
+	if err != nil {
+		t.Fatalf("GetTactics failed: %s", err)
+	}
+
+	_, _, err = tactics.GetExperimentParameters(nil)
+	if err == nil {
+		t.Fatalf("GetExperimentParameters unexpected success")
+	}
+
+	armCounts := make(map[string]int)
+	trials := 10000
+
+	for i := 0; i < trials; i++ {
+
+		installSeed, err := prng.NewSeed()
+		if err != nil {
+			t.Fatalf("NewSeed failed: %s", err)
+		}
+
+		applyParameters, arms, err := tactics.GetExperimentParameters(installSeed)
+		if err != nil {
+			t.Fatalf("GetExperimentParameters failed: %s", err)
+		}
+
+		if len(arms) != 2 || arms[1] != "E2:A1" {
+			t.Fatalf("unexpected arms: %v", arms)
+		}
+
+		expectedPoolSize := 2
+		if arms[0] == "E1:A2" {
+			expectedPoolSize = 3
+		}
+		if applyParameters["ConnectionWorkerPoolSize"] != float64(expectedPoolSize) {
+			t.Fatalf("unexpected parameters: %v", applyParameters)
+		}
+
+		_, repeatArms, err := tactics.GetExperimentParameters(installSeed)
+		if err != nil {
+			t.Fatalf("GetExperimentParameters failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(arms, repeatArms) {
+			t.Fatalf("unexpected arms: %v, %v", arms, repeatArms)
+		}
+
+		armCounts[arms[0]] += 1
+	}
+
+	if tactics.Parameters["ConnectionWorkerPoolSize"] != float64(1) {
+		t.Fatalf("unexpected tactics parameters modification")
+	}
+
+	ratio := float64(armCounts["E1:A2"]) / float64(trials)
+	if ratio < 0.7 || ratio > 0.8 {
+		t.Fatalf("unexpected arm distribution: %v", armCounts)
+	}
+}
+
 type testStorer struct {
 	tacticsRecords         map[string][]byte
 	speedTestSampleRecords map[string][]byte
@@ -71,6 +71,7 @@ type ThrottledConn struct {
 	writeUnthrottledBytes int64
 	writeBytesPerSecond   int64
 	closeAfterExhausted   int32
+	rateLimiterLock       sync.Mutex
 	readLock              sync.Mutex
 	readRateLimiter       *ratelimit.Bucket
 	readDelayTimer        *time.Timer
@@ -158,22 +159,8 @@ func (conn *ThrottledConn) Read(buffer []byte) (int, error) {
 		return 0, errors.TraceNew("throttled conn exhausted")
 	}
 
-	rate := atomic.SwapInt64(&conn.readBytesPerSecond, -1)
-
-	if rate != -1 {
-		// SetLimits has been called and a new rate limiter
-		// must be initialized. When no limit is specified,
-		// the reader/writer is simply the base conn.
-		// No state is retained from the previous rate limiter,
-		// so a pending I/O throttle sleep may be skipped when
-		// the old and new rate are similar.
-		if rate == 0 {
-			conn.readRateLimiter = nil
-		} else {
-			conn.readRateLimiter =
-				ratelimit.NewBucketWithRate(float64(rate), rate)
-		}
-	}
+	readRateLimiter := conn.getRateLimiter(
+		&conn.readBytesPerSecond, &conn.readRateLimiter)
 
 	n, err := conn.Conn.Read(buffer)
 
@@ -184,8 +171,8 @@ func (conn *ThrottledConn) Read(buffer []byte) (int, error) {
 	// The readDelayTimer is always expired/stopped and drained after this code
 	// block and is ready to be Reset on the next call.
 
-	if n >= 0 && conn.readRateLimiter != nil {
-		sleepDuration := conn.readRateLimiter.Take(int64(n))
+	if n >= 0 && readRateLimiter != nil {
+		sleepDuration := readRateLimiter.Take(int64(n))
 		if sleepDuration > 0 {
 			if conn.readDelayTimer == nil {
 				conn.readDelayTimer = time.NewTimer(sleepDuration)
@@ -229,19 +216,11 @@ func (conn *ThrottledConn) Write(buffer []byte) (int, error) {
 		return 0, errors.TraceNew("throttled conn exhausted")
 	}
 
-	rate := atomic.SwapInt64(&conn.writeBytesPerSecond, -1)
-
-	if rate != -1 {
-		if rate == 0 {
-			conn.writeRateLimiter = nil
-		} else {
-			conn.writeRateLimiter =
-				ratelimit.NewBucketWithRate(float64(rate), rate)
-		}
-	}
+	writeRateLimiter := conn.getRateLimiter(
+		&conn.writeBytesPerSecond, &conn.writeRateLimiter)
 
-	if len(buffer) >= 0 && conn.writeRateLimiter != nil {
-		sleepDuration := conn.writeRateLimiter.Take(int64(len(buffer)))
+	if len(buffer) >= 0 && writeRateLimiter != nil {
+		sleepDuration := writeRateLimiter.Take(int64(len(buffer)))
 		if sleepDuration > 0 {
 			if conn.writeDelayTimer == nil {
 				conn.writeDelayTimer = time.NewTimer(sleepDuration)
@@ -263,6 +242,93 @@ func (conn *ThrottledConn) Write(buffer []byte) (int, error) {
 	return n, errors.Trace(err)
 }
 
+// ThrottleRead applies the read rate limits to n bytes read outside of the
+// conn, such as QUIC datagrams received over the same underlying connection,
+// blocking as required. The bytes count toward the same unthrottled count
+// and rate limit as Read. ThrottleRead may be called concurrently with Read.
+func (conn *ThrottledConn) ThrottleRead(n int) error {
+	return errors.Trace(
+		conn.throttle(
+			n,
+			&conn.readUnthrottledBytes,
+			conn.getRateLimiter(&conn.readBytesPerSecond, &conn.readRateLimiter)))
+}
+
+// ThrottleWrite applies the write rate limits to n bytes to be written
+// outside of the conn, blocking as required. ThrottleWrite may be called
+// concurrently with Write.
+func (conn *ThrottledConn) ThrottleWrite(n int) error {
+	return errors.Trace(
+		conn.throttle(
+			n,
+			&conn.writeUnthrottledBytes,
+			conn.getRateLimiter(&conn.writeBytesPerSecond, &conn.writeRateLimiter)))
+}
+
+func (conn *ThrottledConn) throttle(
+	n int, unthrottledBytes *int64, rateLimiter *ratelimit.Bucket) error {
+
+	select {
+	case <-conn.stopBroadcast:
+		return errors.TraceNew("throttled conn closed")
+	default:
+	}
+
+	if atomic.LoadInt64(unthrottledBytes) > 0 {
+		atomic.AddInt64(unthrottledBytes, -int64(n))
+		return nil
+	}
+
+	if atomic.LoadInt32(&conn.closeAfterExhausted) == 1 {
+		conn.Conn.Close()
+		return errors.TraceNew("throttled conn exhausted")
+	}
+
+	if rateLimiter == nil {
+		return nil
+	}
+
+	sleepDuration := rateLimiter.Take(int64(n))
+	if sleepDuration > 0 {
+		timer := time.NewTimer(sleepDuration)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-conn.stopBroadcast:
+			return errors.TraceNew("throttled conn closed")
+		}
+	}
+
+	return nil
+}
+
+// getRateLimiter returns the current rate limiter, first initializing a new
+// rate limiter when SetLimits has been called. When no limit is specified,
+// the returned rate limiter is nil. No state is retained from the previous
+// rate limiter, so a pending I/O throttle sleep may be skipped when the old
+// and new rate are similar.
+//
+// rateLimiterLock allows Read and ThrottleRead, and Write and ThrottleWrite,
+// to share a rate limiter.
+func (conn *ThrottledConn) getRateLimiter(
+	bytesPerSecond *int64, rateLimiter **ratelimit.Bucket) *ratelimit.Bucket {
+
+	conn.rateLimiterLock.Lock()
+	defer conn.rateLimiterLock.Unlock()
+
+	rate := atomic.SwapInt64(bytesPerSecond, -1)
+
+	if rate != -1 {
+		if rate == 0 {
+			*rateLimiter = nil
+		} else {
+			*rateLimiter = ratelimit.NewBucketWithRate(float64(rate), rate)
+		}
+	}
+
+	return *rateLimiter
+}
+
 func (conn *ThrottledConn) Close() error {
 
 	// Ensure close channel only called once.
@@ -245,6 +245,72 @@ func TestThrottledConnClose(t *testing.T) {
 	}
 }
 
+func TestThrottledConnOutOfBand(t *testing.T) {
+
+	rateLimits := RateLimits{
+		ReadBytesPerSecond:  1000,
+		WriteBytesPerSecond: 1000,
+	}
+
+	throttledConn := NewThrottledConn(&testConn{}, rateLimits)
+
+	// Out-of-band I/O and conn I/O share the same rate limit, so the
+	// out-of-band I/O, which exhausts the rate limiter capacity, delays the
+	// following conn I/O.
+
+	n := 500
+	b := make([]byte, n)
+	minElapsed := time.Duration(n) * time.Second / 1000 / 2
+
+	now := time.Now()
+	err := throttledConn.ThrottleRead(1000)
+	if err != nil {
+		t.Fatalf("ThrottleRead failed: %s", err)
+	}
+	_, err = throttledConn.Read(b)
+	elapsed := time.Since(now)
+	if err != nil || elapsed < minElapsed {
+		t.Errorf("unexpected unthrottled read: %s, %v", elapsed, err)
+	}
+
+	now = time.Now()
+	err = throttledConn.ThrottleWrite(1000)
+	if err != nil {
+		t.Fatalf("ThrottleWrite failed: %s", err)
+	}
+	_, err = throttledConn.Write(b)
+	elapsed = time.Since(now)
+	if err != nil || elapsed < minElapsed {
+		t.Errorf("unexpected unthrottled write: %s, %v", elapsed, err)
+	}
+
+	throttledConn.Close()
+
+	err = throttledConn.ThrottleRead(1)
+	if err == nil {
+		t.Errorf("unexpected ThrottleRead success after close")
+	}
+
+	// Out-of-band I/O counts toward the unthrottled bytes.
+
+	throttledConn = NewThrottledConn(
+		&testConn{},
+		RateLimits{
+			ReadUnthrottledBytes: 100,
+			CloseAfterExhausted:  true,
+		})
+
+	err = throttledConn.ThrottleRead(100)
+	if err != nil {
+		t.Fatalf("ThrottleRead failed: %s", err)
+	}
+
+	err = throttledConn.ThrottleRead(1)
+	if err == nil {
+		t.Errorf("unexpected ThrottleRead success after exhausted")
+	}
+}
+
 type testConn struct {
 }
 
@@ -0,0 +1,585 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// DatagramTransport is an unreliable, message-oriented transport, such as
+// QUIC datagrams (RFC 9221). quic.Conn implements DatagramTransport.
+type DatagramTransport interface {
+
+	// MaxDatagramSize is the maximum size of a datagram that may be sent
+	// with SendDatagram.
+	MaxDatagramSize() int
+
+	// SendDatagram sends one datagram, which may be lost.
+	SendDatagram(datagram []byte) error
+
+	// ReceiveDatagram blocks until a datagram is received, the transport
+	// fails, or ctx is done.
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// DatagramChannelTransport is a Channel transport that relays packets as
+// unreliable datagrams, avoiding the head-of-line blocking that occurs when
+// tunneled flows, such as TCP, run over a reliable transport. Each datagram
+// contains exactly one packet, with the same length header framing used by
+// Channel.
+//
+// Packets which don't fit in a datagram, and all packets sent before
+// datagrams are confirmed by the peer, are sent over the reliable
+// transport, which remains the fallback. Packets are received over both the
+// reliable transport and datagrams.
+//
+// Both peers must agree to use datagrams. The initiating peer, the client,
+// requests datagrams out-of-band, when opening the reliable transport, and
+// calls NewDatagramChannelTransport with confirm false. The server accepts
+// by calling NewDatagramChannelTransport with confirm true, which sends a
+// zero length frame over the reliable transport, followed by a random key
+// for each direction. The zero length frame, which is never a valid packet,
+// confirms datagrams and enables the client to send packets as datagrams.
+//
+// The datagram transport, such as QUIC with an obfuscation key that may be
+// known to an adversary and without server certificate verification, is not
+// trusted. Each datagram is encrypted and authenticated, using
+// ChaCha20-Poly1305 with the keys received over the reliable transport, and
+// replayed datagrams are dropped. When the reliable transport is an SSH
+// channel, the keys are bound to the SSH session, so datagrams have the same
+// confidentiality and integrity as packets sent over the channel.
+type DatagramChannelTransport struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	sendNonce    uint64
+	keys         atomic.Value
+	transport    io.ReadWriteCloser
+	datagrams    DatagramTransport
+	runContext   context.Context
+	stopRunning  context.CancelFunc
+	workers      *sync.WaitGroup
+	packets      chan []byte
+	readBuffer   []byte
+	replayWindow datagramReplayWindow
+	readErrMutex sync.Mutex
+	readErr      error
+}
+
+type datagramKeys struct {
+	send    cipher.AEAD
+	receive cipher.AEAD
+}
+
+const (
+	datagramChannelPacketQueueSize = 64
+	datagramNonceSize              = 8
+	datagramOverhead               = datagramNonceSize + chacha20poly1305.Overhead
+	datagramConfirmationKeysSize   = 2 * chacha20poly1305.KeySize
+)
+
+// NewDatagramChannelTransport initializes a new DatagramChannelTransport,
+// which relays packets over transport and datagrams. When confirm is
+// true, a datagram confirmation is sent to the peer and datagrams are
+// used immediately.
+func NewDatagramChannelTransport(
+	transport io.ReadWriteCloser,
+	datagrams DatagramTransport,
+	confirm bool) (*DatagramChannelTransport, error) {
+
+	var keys *datagramKeys
+
+	if confirm {
+
+		confirmation := make([]byte, channelHeaderSize+datagramConfirmationKeysSize)
+
+		keyMaterial, err := common.MakeSecureRandomBytes(datagramConfirmationKeysSize)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		copy(confirmation[channelHeaderSize:], keyMaterial)
+
+		keys, err = newDatagramKeys(keyMaterial, false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		_, err = transport.Write(confirmation)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	runContext, stopRunning := context.WithCancel(context.Background())
+
+	t := &DatagramChannelTransport{
+		transport:   transport,
+		datagrams:   datagrams,
+		runContext:  runContext,
+		stopRunning: stopRunning,
+		workers:     new(sync.WaitGroup),
+		packets:     make(chan []byte, datagramChannelPacketQueueSize),
+	}
+
+	if keys != nil {
+		t.keys.Store(keys)
+	}
+
+	t.workers.Add(2)
+	go t.relayTransportPackets()
+	go t.relayDatagramPackets()
+
+	return t, nil
+}
+
+// newDatagramKeys initializes the send and receive AEADs from the key
+// material sent in a datagram confirmation. The first key is used for
+// datagrams sent by the client and the second key is used for datagrams
+// sent by the server.
+func newDatagramKeys(keyMaterial []byte, isClient bool) (*datagramKeys, error) {
+
+	clientKey := keyMaterial[:chacha20poly1305.KeySize]
+	serverKey := keyMaterial[chacha20poly1305.KeySize:]
+
+	sendKey, receiveKey := serverKey, clientKey
+	if isClient {
+		sendKey, receiveKey = clientKey, serverKey
+	}
+
+	send, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	receive, err := chacha20poly1305.New(receiveKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &datagramKeys{send: send, receive: receive}, nil
+}
+
+func (t *DatagramChannelTransport) getKeys() *datagramKeys {
+	keys, _ := t.keys.Load().(*datagramKeys)
+	return keys
+}
+
+// IsSendingDatagrams indicates whether datagrams are confirmed and packets
+// are being sent as datagrams.
+func (t *DatagramChannelTransport) IsSendingDatagrams() bool {
+	return t.getKeys() != nil
+}
+
+// Read implements the io.Reader interface. Read returns framed packets
+// received over either the reliable transport or datagrams. Concurrent
+// calls to Read are not supported.
+func (t *DatagramChannelTransport) Read(b []byte) (int, error) {
+
+	if len(t.readBuffer) == 0 {
+		select {
+		case t.readBuffer = <-t.packets:
+		case <-t.runContext.Done():
+			return 0, t.getReadErr()
+		}
+	}
+
+	n := copy(b, t.readBuffer)
+	t.readBuffer = t.readBuffer[n:]
+
+	return n, nil
+}
+
+// Write implements the io.Writer interface. The input must consist of one
+// or more complete, framed packets, as written by Channel.WritePacket and
+// Channel.WriteFramedPackets. Each packet is sent as a datagram, when
+// datagrams are confirmed and the packet fits; all other packets are
+// written to the reliable transport, in order. Concurrent calls to Write
+// are not supported.
+func (t *DatagramChannelTransport) Write(b []byte) (int, error) {
+
+	keys := t.getKeys()
+
+	if keys == nil {
+		_, err := t.transport.Write(b)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		return len(b), nil
+	}
+
+	maxDatagramSize := t.datagrams.MaxDatagramSize()
+
+	// Consecutive packets that are not sent as datagrams are coalesced into
+	// a single reliable transport write.
+
+	reliableStart := -1
+	writeReliable := func(end int) error {
+		if reliableStart == -1 {
+			return nil
+		}
+		_, err := t.transport.Write(b[reliableStart:end])
+		reliableStart = -1
+		return errors.Trace(err)
+	}
+
+	offset := 0
+	for offset < len(b) {
+
+		if len(b)-offset < channelHeaderSize {
+			return 0, errors.TraceNew("invalid packet framing")
+		}
+		size := channelHeaderSize + int(binary.BigEndian.Uint16(b[offset:]))
+		if offset+size > len(b) {
+			return 0, errors.TraceNew("invalid packet framing")
+		}
+
+		// When SendDatagram fails, fall back to the reliable transport. If
+		// the underlying session has failed, the reliable transport write
+		// will also fail.
+
+		sentDatagram := false
+		if size+datagramOverhead <= maxDatagramSize {
+			datagram, ok := t.sealDatagram(keys, b[offset:offset+size])
+			if ok {
+				sentDatagram = t.datagrams.SendDatagram(datagram) == nil
+			}
+		}
+
+		if sentDatagram {
+			err := writeReliable(offset)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+		} else if reliableStart == -1 {
+			reliableStart = offset
+		}
+
+		offset += size
+	}
+
+	err := writeReliable(len(b))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return len(b), nil
+}
+
+// sealDatagram encrypts and authenticates a framed packet. The datagram
+// consists of an 8-byte nonce, which is a per-direction counter starting at
+// 1, followed by the sealed packet. sealDatagram returns false when the
+// nonce space is exhausted.
+func (t *DatagramChannelTransport) sealDatagram(
+	keys *datagramKeys, packet []byte) ([]byte, bool) {
+
+	nonce := atomic.AddUint64(&t.sendNonce, 1)
+	if nonce == math.MaxUint64 {
+		atomic.StoreUint64(&t.sendNonce, math.MaxUint64-1)
+		return nil, false
+	}
+
+	datagram := make([]byte, datagramNonceSize, datagramOverhead+len(packet))
+	binary.BigEndian.PutUint64(datagram, nonce)
+
+	var AEADNonce [chacha20poly1305.NonceSize]byte
+	copy(AEADNonce[chacha20poly1305.NonceSize-datagramNonceSize:], datagram)
+
+	return keys.send.Seal(datagram, AEADNonce[:], packet, nil), true
+}
+
+// openDatagram authenticates and decrypts a datagram, returning false for
+// invalid and replayed datagrams. openDatagram is called only from
+// relayDatagramPackets.
+func (t *DatagramChannelTransport) openDatagram(
+	keys *datagramKeys, datagram []byte) ([]byte, bool) {
+
+	if len(datagram) < datagramOverhead {
+		return nil, false
+	}
+
+	nonce := binary.BigEndian.Uint64(datagram)
+
+	var AEADNonce [chacha20poly1305.NonceSize]byte
+	copy(AEADNonce[chacha20poly1305.NonceSize-datagramNonceSize:], datagram)
+
+	packet, err := keys.receive.Open(
+		nil, AEADNonce[:], datagram[datagramNonceSize:], nil)
+	if err != nil {
+		return nil, false
+	}
+
+	// The replay window is updated only after the datagram is authenticated.
+	if !t.replayWindow.check(nonce) {
+		return nil, false
+	}
+
+	return packet, true
+}
+
+// Close implements the io.Closer interface. Close interrupts any blocking
+// Read and closes the reliable transport. The datagram transport is not
+// closed.
+func (t *DatagramChannelTransport) Close() error {
+	t.stopRunning()
+	err := t.transport.Close()
+	t.workers.Wait()
+	return err
+}
+
+func (t *DatagramChannelTransport) relayTransportPackets() {
+
+	defer t.workers.Done()
+
+	for {
+
+		header := make([]byte, channelHeaderSize)
+		_, err := io.ReadFull(t.transport, header)
+		if err != nil {
+			t.setReadErr(err)
+			return
+		}
+
+		size := int(binary.BigEndian.Uint16(header))
+
+		if size == 0 {
+
+			// Datagram confirmation. Only the client receives a
+			// confirmation, and only once.
+
+			keyMaterial := make([]byte, datagramConfirmationKeysSize)
+			_, err := io.ReadFull(t.transport, keyMaterial)
+			if err != nil {
+				t.setReadErr(err)
+				return
+			}
+
+			if t.getKeys() != nil {
+				t.setReadErr(errors.TraceNew("unexpected datagram confirmation"))
+				return
+			}
+
+			keys, err := newDatagramKeys(keyMaterial, true)
+			if err != nil {
+				t.setReadErr(err)
+				return
+			}
+			t.keys.Store(keys)
+
+			continue
+		}
+
+		packet := make([]byte, channelHeaderSize+size)
+		copy(packet, header)
+		_, err = io.ReadFull(t.transport, packet[channelHeaderSize:])
+		if err != nil {
+			t.setReadErr(err)
+			return
+		}
+
+		select {
+		case t.packets <- packet:
+		case <-t.runContext.Done():
+			return
+		}
+	}
+}
+
+func (t *DatagramChannelTransport) relayDatagramPackets() {
+
+	defer t.workers.Done()
+
+	for {
+
+		datagram, err := t.datagrams.ReceiveDatagram(t.runContext)
+		if err != nil {
+			t.setReadErr(err)
+			return
+		}
+
+		// Silently drop datagrams received before the confirmation keys are
+		// available, and invalid, replayed, and malformed datagrams.
+		// Malformed datagrams include zero length frames, which are valid
+		// only over the reliable transport.
+
+		keys := t.getKeys()
+		if keys == nil {
+			continue
+		}
+
+		packet, ok := t.openDatagram(keys, datagram)
+		if !ok {
+			continue
+		}
+
+		if len(packet) <= channelHeaderSize ||
+			int(binary.BigEndian.Uint16(packet)) != len(packet)-channelHeaderSize {
+			continue
+		}
+
+		select {
+		case t.packets <- packet:
+		case <-t.runContext.Done():
+			return
+		}
+	}
+}
+
+func (t *DatagramChannelTransport) setReadErr(err error) {
+	t.readErrMutex.Lock()
+	if t.readErr == nil && t.runContext.Err() == nil {
+		t.readErr = errors.Trace(err)
+	}
+	t.readErrMutex.Unlock()
+
+	// A failure of either the reliable transport or datagrams stops the
+	// transport.
+	t.stopRunning()
+}
+
+func (t *DatagramChannelTransport) getReadErr() error {
+	t.readErrMutex.Lock()
+	defer t.readErrMutex.Unlock()
+	if t.readErr == nil {
+		return errors.Trace(io.EOF)
+	}
+	return t.readErr
+}
+
+// datagramReplayWindow is a sliding window replay filter, as in IPsec
+// (RFC 4303, Section 3.4.3). Datagram nonces more than 64 behind the
+// highest received nonce are rejected, as are nonces already received.
+type datagramReplayWindow struct {
+	highest uint64
+	bitmap  uint64
+}
+
+func (w *datagramReplayWindow) check(nonce uint64) bool {
+
+	if nonce == 0 {
+		return false
+	}
+
+	if nonce > w.highest {
+		shift := nonce - w.highest
+		if shift >= 64 {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.highest = nonce
+		return true
+	}
+
+	offset := w.highest - nonce
+	if offset >= 64 {
+		return false
+	}
+
+	bit := uint64(1) << offset
+	if w.bitmap&bit != 0 {
+		return false
+	}
+	w.bitmap |= bit
+
+	return true
+}
+
+// NewMonitoredDatagramTransport wraps a DatagramTransport, applying the
+// activity monitoring of activityConn and the rate limits of throttledConn
+// to each datagram sent and received. When activityConn and throttledConn
+// wrap the reliable transport underlying the datagrams, such as an SSH
+// connection, datagrams count towards the same inactivity timeout and rate
+// limits as the reliable transport. activityConn and throttledConn may be
+// nil.
+func NewMonitoredDatagramTransport(
+	datagrams DatagramTransport,
+	activityConn *common.ActivityMonitoredConn,
+	throttledConn *common.ThrottledConn) DatagramTransport {
+
+	return &monitoredDatagramTransport{
+		DatagramTransport: datagrams,
+		activityConn:      activityConn,
+		throttledConn:     throttledConn,
+	}
+}
+
+type monitoredDatagramTransport struct {
+	DatagramTransport
+	activityConn  *common.ActivityMonitoredConn
+	throttledConn *common.ThrottledConn
+}
+
+func (t *monitoredDatagramTransport) SendDatagram(datagram []byte) error {
+
+	if t.throttledConn != nil {
+		err := t.throttledConn.ThrottleWrite(len(datagram))
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	err := t.DatagramTransport.SendDatagram(datagram)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if t.activityConn != nil {
+		err := t.activityConn.UpdateWriteActivity(len(datagram))
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (t *monitoredDatagramTransport) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+
+	datagram, err := t.DatagramTransport.ReceiveDatagram(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if t.activityConn != nil {
+		err := t.activityConn.UpdateReadActivity(len(datagram))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if t.throttledConn != nil {
+		err := t.throttledConn.ThrottleRead(len(datagram))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return datagram, nil
+}
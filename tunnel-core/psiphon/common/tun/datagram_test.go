@@ -0,0 +1,264 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+)
+
+func TestDatagramReplayWindow(t *testing.T) {
+
+	var window datagramReplayWindow
+
+	for _, testCase := range []struct {
+		nonce    uint64
+		expected bool
+	}{
+		{0, false},
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{2, false},
+		{100, true},
+		{36, false},
+		{37, true},
+		{37, false},
+		{99, true},
+		{200, true},
+		{100, false},
+	} {
+		if window.check(testCase.nonce) != testCase.expected {
+			t.Fatalf("unexpected check result for nonce %d", testCase.nonce)
+		}
+	}
+}
+
+func TestDatagramChannelTransport(t *testing.T) {
+
+	MTU := DEFAULT_MTU
+	maxDatagramSize := 1150
+
+	clientConn, serverConn := net.Pipe()
+	clientDatagrams, serverDatagrams := newTestDatagramTransportPair(maxDatagramSize)
+
+	// The client transport must be running before the server sends its
+	// confirmation, as net.Pipe writes block until read.
+
+	clientTransport, err := NewDatagramChannelTransport(clientConn, clientDatagrams, false)
+	if err != nil {
+		t.Fatalf("NewDatagramChannelTransport failed: %s", err)
+	}
+	defer clientTransport.Close()
+
+	serverTransport, err := NewDatagramChannelTransport(serverConn, serverDatagrams, true)
+	if err != nil {
+		t.Fatalf("NewDatagramChannelTransport failed: %s", err)
+	}
+	defer serverTransport.Close()
+
+	if !serverTransport.IsSendingDatagrams() {
+		t.Fatalf("unexpected server IsSendingDatagrams")
+	}
+
+	// Await the confirmation, which is received asynchronously.
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !clientTransport.IsSendingDatagrams() {
+		if time.Now().After(deadline) {
+			t.Fatalf("datagram confirmation not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	clientChannel := NewChannel(clientTransport, MTU)
+	serverChannel := NewChannel(serverTransport, MTU)
+
+	// Small packets are sent as datagrams and large packets are sent over
+	// the reliable transport. Framed packet batches mix both.
+
+	maxDatagramPacketSize := maxDatagramSize - datagramOverhead - channelHeaderSize
+
+	packets := [][]byte{
+		prng.Bytes(100),
+		prng.Bytes(maxDatagramPacketSize),
+		prng.Bytes(maxDatagramPacketSize + 1),
+		prng.Bytes(MTU),
+		prng.Bytes(1),
+	}
+
+	for _, channels := range [][2]*Channel{
+		{clientChannel, serverChannel},
+		{serverChannel, clientChannel}} {
+
+		sender, receiver := channels[0], channels[1]
+
+		go func() {
+			for _, packet := range packets {
+				_ = sender.WritePacket(packet)
+			}
+
+			var framedPackets []byte
+			for _, packet := range packets {
+				framedPackets = append(framedPackets, byte(len(packet)>>8), byte(len(packet)))
+				framedPackets = append(framedPackets, packet...)
+			}
+			_ = sender.WriteFramedPackets(framedPackets)
+		}()
+
+		// Packets may be reordered between the two paths, so match
+		// received packets against the sent set.
+
+		for i := 0; i < 2*len(packets); i++ {
+			packet, err := receiver.ReadPacket()
+			if err != nil {
+				t.Fatalf("ReadPacket failed: %s", err)
+			}
+			found := false
+			for _, sentPacket := range packets {
+				if bytes.Equal(packet, sentPacket) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatalf("unexpected packet")
+			}
+		}
+	}
+
+	// 3 packets fit in a datagram; each is sent twice, in each direction.
+
+	expectedDatagrams := int64(2 * 2 * 3)
+	sentDatagrams := atomic.LoadInt64(&clientDatagrams.sent) +
+		atomic.LoadInt64(&serverDatagrams.sent)
+	if sentDatagrams != expectedDatagrams {
+		t.Fatalf("unexpected datagram count: %d", sentDatagrams)
+	}
+
+	// Datagrams are encrypted, and tampered and replayed datagrams are
+	// dropped.
+
+	packet := prng.Bytes(100)
+	err = clientChannel.WritePacket(packet)
+	if err != nil {
+		t.Fatalf("WritePacket failed: %s", err)
+	}
+
+	receivedPacket, err := serverChannel.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %s", err)
+	}
+	if !bytes.Equal(receivedPacket, packet) {
+		t.Fatalf("unexpected packet")
+	}
+
+	datagram := clientDatagrams.getLastSent()
+	if bytes.Contains(datagram, packet) {
+		t.Fatalf("unexpected plaintext datagram")
+	}
+
+	tamperedDatagram := append([]byte(nil), datagram...)
+	tamperedDatagram[len(tamperedDatagram)-1] ^= 1
+
+	plaintextDatagram := append([]byte{0, byte(len(packet))}, packet...)
+
+	for _, injectedDatagram := range [][]byte{
+		datagram, tamperedDatagram, plaintextDatagram} {
+
+		serverDatagrams.receive <- injectedDatagram
+	}
+
+	nextPacket := prng.Bytes(100)
+	err = clientChannel.WritePacket(nextPacket)
+	if err != nil {
+		t.Fatalf("WritePacket failed: %s", err)
+	}
+
+	receivedPacket, err = serverChannel.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %s", err)
+	}
+	if !bytes.Equal(receivedPacket, nextPacket) {
+		t.Fatalf("unexpected injected packet")
+	}
+
+	// Closing the reliable transport interrupts reads.
+
+	clientTransport.Close()
+
+	_, err = serverChannel.ReadPacket()
+	if err == nil {
+		t.Fatalf("unexpected ReadPacket success")
+	}
+}
+
+type testDatagramTransport struct {
+	sent            int64
+	lastSent        atomic.Value
+	maxDatagramSize int
+	send            chan []byte
+	receive         chan []byte
+}
+
+func newTestDatagramTransportPair(
+	maxDatagramSize int) (*testDatagramTransport, *testDatagramTransport) {
+
+	a := make(chan []byte, 32)
+	b := make(chan []byte, 32)
+	return &testDatagramTransport{maxDatagramSize: maxDatagramSize, send: a, receive: b},
+		&testDatagramTransport{maxDatagramSize: maxDatagramSize, send: b, receive: a}
+}
+
+func (t *testDatagramTransport) MaxDatagramSize() int {
+	return t.maxDatagramSize
+}
+
+func (t *testDatagramTransport) SendDatagram(datagram []byte) error {
+	if len(datagram) > t.maxDatagramSize {
+		return errors.New("datagram too large")
+	}
+	t.send <- append([]byte(nil), datagram...)
+	t.lastSent.Store(append([]byte(nil), datagram...))
+	atomic.AddInt64(&t.sent, 1)
+	return nil
+}
+
+func (t *testDatagramTransport) getLastSent() []byte {
+	datagram, _ := t.lastSent.Load().([]byte)
+	return datagram
+}
+
+func (t *testDatagramTransport) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case datagram := <-t.receive:
+		return datagram, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
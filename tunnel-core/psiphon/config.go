@@ -74,6 +74,46 @@ type Config struct {
 	// be deleted, moved or overwritten.
 	DataRootDirectory string
 
+	// DataStoreEncryptionKey is a base64-encoded, 32-byte key which, when
+	// set, is used to encrypt all datastore records at rest. An existing
+	// plaintext datastore is encrypted when opened.
+	DataStoreEncryptionKey string
+
+	// DataStoreEncryptionPreviousKeys is a list of base64-encoded, previously
+	// used datastore encryption keys. When the datastore is encrypted with
+	// one of these keys, it is re-encrypted with DataStoreEncryptionKey, or
+	// decrypted when DataStoreEncryptionKey is not set. This supports key
+	// rotation and disabling encryption.
+	DataStoreEncryptionPreviousKeys []string
+
+	// DataStoreEncryptionKeyProvider, when set, overrides
+	// DataStoreEncryptionKey and DataStoreEncryptionPreviousKeys and is
+	// called to obtain the keys each time the datastore is opened. This
+	// allows keys to be stored in a platform key store.
+	DataStoreEncryptionKeyProvider DataStoreEncryptionKeyProvider `json:"-"`
+
+	// DataStoreBackend selects the datastore backend. Valid values are
+	// DATASTORE_BACKEND_DISK, the default, which uses the on-disk datastore
+	// backend selected at build time, and DATASTORE_BACKEND_MEMORY, which
+	// keeps all datastore records in memory, for ephemeral runs and tests.
+	//
+	// Each Config that specifies DATASTORE_BACKEND_MEMORY has its own
+	// in-memory datastore, so concurrently running Controllers may each
+	// select a backend; all Configs that specify the on-disk backend share
+	// the on-disk datastore.
+	DataStoreBackend string
+
+	// DataStoreMemorySeedFromDisk specifies that, when DataStoreBackend is
+	// DATASTORE_BACKEND_MEMORY, the in-memory datastore is initialized with
+	// the records in the on-disk datastore in the data directory.
+	DataStoreMemorySeedFromDisk bool
+
+	// DataStoreMemorySnapshotToDisk specifies that, when DataStoreBackend is
+	// DATASTORE_BACKEND_MEMORY, the records in the in-memory datastore are
+	// written to the on-disk datastore in the data directory, replacing its
+	// records, when the in-memory datastore is closed.
+	DataStoreMemorySnapshotToDisk bool
+
 	// UseNoticeFiles configures notice files for writing. If set, homepages
 	// will be written to a file created at config.GetHomePageFilename()
 	// and notices will be written to a file created at
@@ -353,7 +393,8 @@ type Config struct {
 	// RemoteServerListSignaturePublicKey specifies a public key that's used
 	// to authenticate the remote server list payload. This value is supplied
 	// by and depends on the Psiphon Network, and is typically embedded in the
-	// client binary.
+	// client binary. The RemoteServerListSignaturePublicKeys parameter, when
+	// set by tactics, replaces this key.
 	RemoteServerListSignaturePublicKey string
 
 	// DisableRemoteServerListFetcher disables fetching remote server lists.
@@ -373,6 +414,17 @@ type Config struct {
 	// OnlyAfterAttempts = 0.
 	ObfuscatedServerListRootURLs parameters.TransferURLs
 
+	// RemoteServerListDeltaRootURLs is a list of URLs which specify root
+	// locations from which to fetch common remote server list delta
+	// packages. When set, the client first attempts to update to the latest
+	// remote server list version by following the chain of deltas from its
+	// current version, and falls back to downloading the full list from
+	// RemoteServerListURLs. See protocol.ServerListDelta. This value is
+	// supplied by and depends on the Psiphon Network. All URLs must point to
+	// the same entities with the same ETags. At least one TransferURL must
+	// have OnlyAfterAttempts = 0.
+	RemoteServerListDeltaRootURLs parameters.TransferURLs
+
 	// UpgradeDownloadURLs is list of URLs which specify locations from which
 	// to download a host client upgrade file, when one is available. The core
 	// tunnel controller provides a resumable download facility which
@@ -496,7 +548,9 @@ type Config struct {
 	// ServerEntrySignaturePublicKey is a base64-encoded, ed25519 public
 	// key value used to verify individual server entry signatures. This value
 	// is supplied by and depends on the Psiphon Network, and is typically
-	// embedded in the client binary.
+	// embedded in the client binary. The ServerEntrySignaturePublicKeys
+	// parameter, when set by tactics, replaces this key; see
+	// GetServerEntrySignaturePublicKeys.
 	ServerEntrySignaturePublicKey string
 
 	// ExchangeObfuscationKey is a base64-encoded, NaCl secretbox key used to
@@ -783,6 +837,12 @@ type Config struct {
 	// QUICDisablePathMTUDiscoveryProbability is for testing purposes.
 	QUICDisablePathMTUDiscoveryProbability *float64
 
+	// PacketTunnelQUICDatagramsProbability is for testing purposes.
+	PacketTunnelQUICDatagramsProbability *float64
+
+	// MeekWebSocketProbability is for testing purposes.
+	MeekWebSocketProbability *float64
+
 	// DNSResolverAttemptsPerServer and other DNSResolver fields are for
 	// testing purposes.
 	DNSResolverAttemptsPerServer                     *int
@@ -800,6 +860,10 @@ type Config struct {
 	DNSResolverIncludeEDNS0Probability               *float64
 	DNSResolverCacheExtensionInitialTTLMilliseconds  *int
 	DNSResolverCacheExtensionVerifiedTTLMilliseconds *int
+	DNSResolverCrossCheckProbability                 *float64
+	DNSResolverCrossCheckAwaitTimeoutMilliseconds    *int
+	DNSResolverPoisonedIPAddressCIDRs                []string
+	DNSResolverHTTPSRecordsProbability               *float64
 
 	// params is the active parameters.Parameters with defaults, config values,
 	// and, optionally, tactics applied.
@@ -810,9 +874,10 @@ type Config struct {
 
 	dialParametersHash []byte
 
-	dynamicConfigMutex sync.Mutex
-	sponsorID          string
-	authorizations     []string
+	dynamicConfigMutex    sync.Mutex
+	sponsorID             string
+	authorizations        []string
+	tacticsExperimentArms []string
 
 	deviceBinder    DeviceBinder
 	networkIDGetter NetworkIDGetter
@@ -822,6 +887,9 @@ type Config struct {
 	resolverMutex sync.Mutex
 	resolver      *resolver.Resolver
 
+	dataStoreMutex sync.Mutex
+	dataStore      *dataStore
+
 	committed bool
 
 	loadTimestamp string
@@ -1092,6 +1160,19 @@ func (config *Config) Commit(migrateFromLegacyFields bool) error {
 		return errors.TraceNew("invalid TargetApiProtocol")
 	}
 
+	_, err = decodeDataStoreEncryptionKeys(
+		config.DataStoreEncryptionKey, config.DataStoreEncryptionPreviousKeys)
+	if err != nil {
+		return errors.Tracef("invalid datastore encryption key: %s", err)
+	}
+
+	if !common.Contains(
+		[]string{"", DATASTORE_BACKEND_DISK, DATASTORE_BACKEND_MEMORY},
+		config.DataStoreBackend) {
+
+		return errors.TraceNew("invalid DataStoreBackend")
+	}
+
 	if !config.DisableRemoteServerListFetcher {
 
 		if config.RemoteServerListURLs != nil {
@@ -1105,6 +1186,12 @@ func (config *Config) Commit(migrateFromLegacyFields bool) error {
 				return errors.TraceNew("missing RemoteServerListSignaturePublicKey")
 			}
 		}
+
+		if config.RemoteServerListDeltaRootURLs != nil {
+			if config.RemoteServerListSignaturePublicKey == "" {
+				return errors.TraceNew("missing RemoteServerListSignaturePublicKey")
+			}
+		}
 	}
 
 	if config.UpgradeDownloadURLs != nil {
@@ -1378,6 +1465,22 @@ func (config *Config) GetAuthorizations() []string {
 	return config.authorizations
 }
 
+// SetTacticsExperimentArms sets the tactics experiment arms the client is
+// assigned to, as applied in the current parameters.
+func (config *Config) SetTacticsExperimentArms(arms []string) {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	config.tacticsExperimentArms = arms
+}
+
+// GetTacticsExperimentArms returns the current tactics experiment arms.
+// The caller must not modify the returned slice.
+func (config *Config) GetTacticsExperimentArms() []string {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	return config.tacticsExperimentArms
+}
+
 // GetPsiphonDataDirectory returns the directory under which all persistent
 // files should be stored. This directory is created under
 // config.DataRootDirectory. The motivation for an additional directory is that
@@ -1412,6 +1515,29 @@ func (config *Config) GetDataStoreDirectory() string {
 	return filepath.Join(config.GetPsiphonDataDirectory(), "datastore")
 }
 
+// GetServerEntrySignaturePublicKeys returns the trusted server entry signing
+// keys. The ServerEntrySignaturePublicKeys parameter, which may be set by
+// tactics in order to rotate or revoke signing keys, takes precedence over
+// ServerEntrySignaturePublicKey. Returns nil when no key is configured.
+//
+// When rotating keys, the new key must be distributed before server entries
+// signed with it are published, as server entries that fail verification
+// are deleted.
+func (config *Config) GetServerEntrySignaturePublicKeys() []string {
+
+	publicKeys := config.GetParameters().Get().Strings(
+		parameters.ServerEntrySignaturePublicKeys)
+	if len(publicKeys) > 0 {
+		return publicKeys
+	}
+
+	if config.ServerEntrySignaturePublicKey != "" {
+		return []string{config.ServerEntrySignaturePublicKey}
+	}
+
+	return nil
+}
+
 // GetObfuscatedServerListDownloadDirectory returns the directory in which
 // obfuscated remote server list downloads will be stored. Created in
 // Config.Commit().
@@ -1426,6 +1552,14 @@ func (config *Config) GetRemoteServerListDownloadFilename() string {
 	return filepath.Join(config.GetPsiphonDataDirectory(), "remote_server_list")
 }
 
+// GetRemoteServerListDeltaDownloadFilename returns the filename where remote
+// server list delta downloads will be stored. Data is stored in co-located
+// files (RemoteServerListDeltaDownloadFilename.part*) to allow for resumable
+// downloading.
+func (config *Config) GetRemoteServerListDeltaDownloadFilename() string {
+	return filepath.Join(config.GetPsiphonDataDirectory(), "remote_server_list_delta")
+}
+
 // GetUpgradeDownloadFilename specifies the filename where upgrade downloads
 // will be stored. This filename is valid when UpgradeDownloadURLs
 // (or UpgradeDownloadUrl) is specified. Data is stored in co-located files
@@ -1554,6 +1688,11 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 			applyParameters[parameters.ObfuscatedServerListRootURLs] = config.ObfuscatedServerListRootURLs
 		}
 
+		if config.RemoteServerListDeltaRootURLs != nil {
+			applyParameters[parameters.RemoteServerListSignaturePublicKey] = config.RemoteServerListSignaturePublicKey
+			applyParameters[parameters.RemoteServerListDeltaRootURLs] = config.RemoteServerListDeltaRootURLs
+		}
+
 	}
 
 	if config.UpgradeDownloadURLs != nil {
@@ -1815,6 +1954,14 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.QUICDisableClientPathMTUDiscoveryProbability] = *config.QUICDisablePathMTUDiscoveryProbability
 	}
 
+	if config.PacketTunnelQUICDatagramsProbability != nil {
+		applyParameters[parameters.PacketTunnelQUICDatagramsProbability] = *config.PacketTunnelQUICDatagramsProbability
+	}
+
+	if config.MeekWebSocketProbability != nil {
+		applyParameters[parameters.MeekWebSocketProbability] = *config.MeekWebSocketProbability
+	}
+
 	if config.DNSResolverAttemptsPerServer != nil {
 		applyParameters[parameters.DNSResolverAttemptsPerServer] = *config.DNSResolverAttemptsPerServer
 	}
@@ -1875,6 +2022,22 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.DNSResolverCacheExtensionVerifiedTTL] = fmt.Sprintf("%dms", *config.DNSResolverCacheExtensionVerifiedTTLMilliseconds)
 	}
 
+	if config.DNSResolverCrossCheckProbability != nil {
+		applyParameters[parameters.DNSResolverCrossCheckProbability] = *config.DNSResolverCrossCheckProbability
+	}
+
+	if config.DNSResolverCrossCheckAwaitTimeoutMilliseconds != nil {
+		applyParameters[parameters.DNSResolverCrossCheckAwaitTimeout] = fmt.Sprintf("%dms", *config.DNSResolverCrossCheckAwaitTimeoutMilliseconds)
+	}
+
+	if config.DNSResolverPoisonedIPAddressCIDRs != nil {
+		applyParameters[parameters.DNSResolverPoisonedIPAddressCIDRs] = config.DNSResolverPoisonedIPAddressCIDRs
+	}
+
+	if config.DNSResolverHTTPSRecordsProbability != nil {
+		applyParameters[parameters.DNSResolverHTTPSRecordsProbability] = *config.DNSResolverHTTPSRecordsProbability
+	}
+
 	// When adding new config dial parameters that may override tactics, also
 	// update setDialParametersHash.
 
@@ -2210,6 +2373,16 @@ func (config *Config) setDialParametersHash() {
 		binary.Write(hash, binary.LittleEndian, *config.QUICDisablePathMTUDiscoveryProbability)
 	}
 
+	if config.PacketTunnelQUICDatagramsProbability != nil {
+		hash.Write([]byte("PacketTunnelQUICDatagramsProbability"))
+		binary.Write(hash, binary.LittleEndian, *config.PacketTunnelQUICDatagramsProbability)
+	}
+
+	if config.MeekWebSocketProbability != nil {
+		hash.Write([]byte("MeekWebSocketProbability"))
+		binary.Write(hash, binary.LittleEndian, *config.MeekWebSocketProbability)
+	}
+
 	if config.DNSResolverAttemptsPerServer != nil {
 		hash.Write([]byte("DNSResolverAttemptsPerServer"))
 		binary.Write(hash, binary.LittleEndian, int64(*config.DNSResolverAttemptsPerServer))
@@ -2283,6 +2456,28 @@ func (config *Config) setDialParametersHash() {
 		binary.Write(hash, binary.LittleEndian, int64(*config.DNSResolverCacheExtensionVerifiedTTLMilliseconds))
 	}
 
+	if config.DNSResolverCrossCheckProbability != nil {
+		hash.Write([]byte("DNSResolverCrossCheckProbability"))
+		binary.Write(hash, binary.LittleEndian, *config.DNSResolverCrossCheckProbability)
+	}
+
+	if config.DNSResolverCrossCheckAwaitTimeoutMilliseconds != nil {
+		hash.Write([]byte("DNSResolverCrossCheckAwaitTimeoutMilliseconds"))
+		binary.Write(hash, binary.LittleEndian, int64(*config.DNSResolverCrossCheckAwaitTimeoutMilliseconds))
+	}
+
+	if config.DNSResolverPoisonedIPAddressCIDRs != nil {
+		hash.Write([]byte("DNSResolverPoisonedIPAddressCIDRs"))
+		for _, CIDR := range config.DNSResolverPoisonedIPAddressCIDRs {
+			hash.Write([]byte(CIDR))
+		}
+	}
+
+	if config.DNSResolverHTTPSRecordsProbability != nil {
+		hash.Write([]byte("DNSResolverHTTPSRecordsProbability"))
+		binary.Write(hash, binary.LittleEndian, *config.DNSResolverHTTPSRecordsProbability)
+	}
+
 	config.dialParametersHash = hash.Sum(nil)
 }
 
@@ -35,6 +35,7 @@ import (
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/exchange"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/parameters"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
@@ -82,6 +83,8 @@ type Controller struct {
 	signalReportServerEntries               chan *serverEntriesReportRequest
 	signalReportConnected                   chan struct{}
 	signalRestartEstablishing               chan struct{}
+	signalMigrateTunnelDrained              chan *Tunnel
+	migratingTunnel                         *Tunnel
 	serverAffinityDoneBroadcast             chan struct{}
 	packetTunnelClient                      *tun.Client
 	packetTunnelTransport                   *PacketTunnelTransport
@@ -149,6 +152,10 @@ func NewController(config *Config) (controller *Controller, err error) {
 		// signalRestartEstablishing has a buffer of 1 to ensure sending the
 		// signal doesn't block and receiving won't miss a signal.
 		signalRestartEstablishing: make(chan struct{}, 1),
+
+		// signalMigrateTunnelDrained has a buffer of 1 as it's sent from a
+		// timer callback that must not block.
+		signalMigrateTunnelDrained: make(chan *Tunnel, 1),
 	}
 
 	// Initialize untunneledDialConfig, used by untunneled dials including
@@ -388,6 +395,38 @@ func (controller *Controller) ImportExchangePayload(payload string) bool {
 	return true
 }
 
+// ExportExchangePayloadQRFrames creates an exchange payload split into QR
+// code frames. See the comment for psiphon.ExportExchangePayloadQRFrames for
+// more details.
+func (controller *Controller) ExportExchangePayloadQRFrames() []string {
+	return ExportExchangePayloadQRFrames(controller.config)
+}
+
+// StartExchangeLANOffer starts offering exchange payloads on the local
+// network. See the comment for psiphon.StartExchangeLANOffer for more
+// details.
+func (controller *Controller) StartExchangeLANOffer(
+	confirmTransfer func(ctx context.Context, peerIPAddress string) bool) (*exchange.LANOffer, error) {
+
+	return StartExchangeLANOffer(controller.config, confirmTransfer)
+}
+
+// DiscoverExchangeLANOffers discovers exchange LAN offers, with the specified
+// offer code, on the local network.
+func (controller *Controller) DiscoverExchangeLANOffers(
+	ctx context.Context, offerCode string) ([]string, error) {
+
+	return DiscoverExchangeLANOffers(ctx, offerCode)
+}
+
+// ReceiveExchangeLANOffer fetches an exchange payload from a LAN offer. The
+// payload should be imported with ImportExchangePayload.
+func (controller *Controller) ReceiveExchangeLANOffer(
+	ctx context.Context, offerCode, address string) (string, error) {
+
+	return ReceiveExchangeLANOffer(ctx, offerCode, address)
+}
+
 // remoteServerListFetcher fetches an out-of-band list of server entries
 // for more tunnel candidates. It fetches when signalled, with retries
 // on failure.
@@ -664,7 +703,7 @@ loop:
 
 		startTime := time.Now()
 
-		response.err = ScanServerEntries(callback)
+		response.err = ScanServerEntries(controller.config, callback)
 
 		// Report this duration in CandidateServers as an indication of datastore
 		// performance.
@@ -886,8 +925,17 @@ loop:
 				controller.startEstablishing()
 			}
 
+		case drainedTunnel := <-controller.signalMigrateTunnelDrained:
+
+			controller.drainMigratingTunnel(drainedTunnel)
+
+			if !controller.isFullyEstablished() {
+				controller.startEstablishing()
+			}
+
 		case failedTunnel := <-controller.failedTunnels:
 			NoticeWarning("tunnel failed: %s", failedTunnel.dialParams.ServerEntry.GetDiagnosticID())
+			controller.endMigration(failedTunnel)
 			controller.terminateTunnel(failedTunnel)
 
 			// Clear the reference to this tunnel before calling startEstablishing,
@@ -1024,6 +1072,28 @@ loop:
 				controller.stopEstablishing()
 			}
 
+			// When the server is loaded and asks the client to migrate, establish
+			// an additional tunnel to an alternative server. While migrating, new
+			// port forwards use the other tunnels, and, once the pool is again
+			// full, the migrating tunnel is retained for a drain period, allowing
+			// existing port forwards to complete, and then closed.
+			//
+			// Only one tunnel migrates at a time. Any migrate request from the
+			// alternative server, received while migrating, is ignored.
+
+			if connectedTunnel.serverContext != nil &&
+				connectedTunnel.serverContext.migrate &&
+				controller.startMigration(connectedTunnel) {
+
+				controller.promoteMigrateServerEntry(connectedTunnel)
+
+				controller.startEstablishing()
+
+			} else if controller.isMigrating() && controller.isFullyEstablished() {
+
+				controller.scheduleMigrateTunnelDrain()
+			}
+
 		case <-controller.runCtx.Done():
 			break loop
 		}
@@ -1084,13 +1154,121 @@ func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 	tunnel.Close(true)
 }
 
+// startMigration marks the tunnel as migrating, extending the pool of active
+// tunnels by one to make room for a replacement tunnel. Returns false when
+// another tunnel is already migrating.
+func (controller *Controller) startMigration(tunnel *Tunnel) bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if controller.migratingTunnel != nil {
+		return false
+	}
+	controller.migratingTunnel = tunnel
+	return true
+}
+
+// endMigration clears the migration state when the specified tunnel is the
+// migrating tunnel. Returns true when the migration state was cleared.
+func (controller *Controller) endMigration(tunnel *Tunnel) bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if controller.migratingTunnel != tunnel {
+		return false
+	}
+	controller.migratingTunnel = nil
+	return true
+}
+
+// isMigrating indicates if a tunnel is migrating.
+func (controller *Controller) isMigrating() bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	return controller.migratingTunnel != nil
+}
+
+func (controller *Controller) getMigratingTunnel() *Tunnel {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	return controller.migratingTunnel
+}
+
+// promoteMigrateServerEntry promotes an alternative server entry provided by
+// the loaded server of the migrating tunnel so that it's the server affinity
+// candidate. The migrating tunnel's server is excluded from candidates as
+// it's an active tunnel.
+func (controller *Controller) promoteMigrateServerEntry(tunnel *Tunnel) {
+
+	NoticeInfo("migrate tunnel: %s",
+		tunnel.dialParams.ServerEntry.GetDiagnosticID())
+
+	migrateServerEntryIPs := tunnel.serverContext.migrateServerEntryIPs
+	if len(migrateServerEntryIPs) > 0 &&
+		controller.config.TargetServerEntry == "" {
+
+		err := PromoteServerEntry(
+			controller.config,
+			migrateServerEntryIPs[prng.Intn(len(migrateServerEntryIPs))])
+		if err != nil {
+			NoticeWarning("PromoteServerEntry failed: %v", errors.Trace(err))
+		}
+	}
+}
+
+// scheduleMigrateTunnelDrain signals runTunnels to drain the migrating
+// tunnel after MigrateTunnelDrainPeriod. scheduleMigrateTunnelDrain is
+// called once the replacement tunnel is established and the pool is full.
+func (controller *Controller) scheduleMigrateTunnelDrain() {
+
+	migratingTunnel := controller.getMigratingTunnel()
+	if migratingTunnel == nil {
+		return
+	}
+
+	drainPeriod := controller.config.GetParameters().Get().Duration(
+		parameters.MigrateTunnelDrainPeriod)
+
+	time.AfterFunc(drainPeriod, func() {
+		select {
+		case controller.signalMigrateTunnelDrained <- migratingTunnel:
+		default:
+		}
+	})
+}
+
+// drainMigratingTunnel is called when the drain period for a migrating
+// tunnel has elapsed. Port forwards still using the migrating tunnel are
+// now interrupted. When the migrating tunnel has already failed, there's
+// nothing to do.
+func (controller *Controller) drainMigratingTunnel(tunnel *Tunnel) {
+
+	if !controller.endMigration(tunnel) {
+		return
+	}
+
+	NoticeInfo("migrated tunnel drained: %s",
+		tunnel.dialParams.ServerEntry.GetDiagnosticID())
+
+	controller.terminateTunnel(tunnel)
+}
+
+// getPoolSize returns the target number of active tunnels, which includes an
+// additional slot while a tunnel is migrating. The caller must lock
+// tunnelMutex.
+func (controller *Controller) getPoolSize() int {
+	poolSize := controller.tunnelPoolSize
+	if controller.migratingTunnel != nil {
+		poolSize += 1
+	}
+	return poolSize
+}
+
 // registerTunnel adds the connected tunnel to the pool of active tunnels
 // which are candidates for port forwarding. Returns true if the pool has an
 // empty slot and false if the pool is full (caller should discard the tunnel).
 func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	if len(controller.tunnels) >= controller.tunnelPoolSize {
+	if len(controller.tunnels) >= controller.getPoolSize() {
 		return false
 	}
 	// Perform a final check just in case we've established
@@ -1131,7 +1309,7 @@ func (controller *Controller) hasEstablishedOnce() bool {
 func (controller *Controller) isFullyEstablished() bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	return len(controller.tunnels) >= controller.tunnelPoolSize
+	return len(controller.tunnels) >= controller.getPoolSize()
 }
 
 // numTunnels returns the number of active and outstanding tunnels.
@@ -1141,7 +1319,7 @@ func (controller *Controller) numTunnels() (int, int) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
 	active := len(controller.tunnels)
-	outstanding := controller.tunnelPoolSize - len(controller.tunnels)
+	outstanding := controller.getPoolSize() - len(controller.tunnels)
 	return active, outstanding
 }
 
@@ -1192,7 +1370,8 @@ func (controller *Controller) terminateAllTunnels() {
 }
 
 // getNextActiveTunnel returns the next tunnel from the pool of active
-// tunnels. Currently, tunnel selection order is simple round-robin.
+// tunnels. Currently, tunnel selection order is simple round-robin. Any
+// migrating tunnel is skipped, unless it's the only active tunnel.
 func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
@@ -1202,6 +1381,11 @@ func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
 	tunnel = controller.tunnels[controller.nextTunnel]
 	controller.nextTunnel =
 		(controller.nextTunnel + 1) % len(controller.tunnels)
+	if tunnel == controller.migratingTunnel && len(controller.tunnels) > 1 {
+		tunnel = controller.tunnels[controller.nextTunnel]
+		controller.nextTunnel =
+			(controller.nextTunnel + 1) % len(controller.tunnels)
+	}
 	return tunnel
 }
 
@@ -1820,7 +2004,7 @@ func (controller *Controller) stopEstablishing() {
 	// Record datastore metrics after establishment, the phase which generates
 	// the bulk of all datastore transactions: iterating over server entries,
 	// storing new server entries, etc.
-	emitDatastoreMetrics()
+	emitDatastoreMetrics(controller.config)
 
 	// Similarly, establishment generates the bulk of domain resolves.
 	emitDNSMetrics(controller.resolver)
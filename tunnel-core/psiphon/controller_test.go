@@ -598,9 +598,9 @@ func controllerRun(t *testing.T, runConfig *controllerRunConfig) {
 	if err != nil {
 		t.Fatalf("error initializing datastore: %s", err)
 	}
-	defer CloseDataStore()
+	defer CloseDataStore(config)
 
-	serverEntryCount := CountServerEntries()
+	serverEntryCount := CountServerEntries(config)
 
 	if runConfig.expectNoServerEntries && serverEntryCount > 0 {
 		// TODO: replace expectNoServerEntries with resetServerEntries
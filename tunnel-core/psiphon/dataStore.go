@@ -26,6 +26,8 @@ import (
 	"io"
 	"math"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +37,7 @@ import (
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/parameters"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/resolver"
 )
 
 var (
@@ -49,27 +52,156 @@ var (
 	datastoreTacticsBucket                      = []byte("tactics")
 	datastoreSpeedTestSamplesBucket             = []byte("speedTestSamples")
 	datastoreDialParametersBucket               = []byte("dialParameters")
+	datastoreOSLServerEntryCountsBucket         = []byte("OSLServerEntryCounts")
+	datastoreResolverCacheBucket                = []byte("resolverCache")
 	datastoreLastConnectedKey                   = "lastConnected"
+	datastoreTacticsExperimentSeedKey           = "tacticsExperimentSeed"
+	datastoreRemoteServerListVersionKey         = "remoteServerListVersion"
 	datastoreLastServerEntryFilterKey           = []byte("lastServerEntryFilter")
 	datastoreAffinityServerEntryIDKey           = []byte("affinityServerEntryID")
 	datastorePersistentStatTypeRemoteServerList = string(datastoreRemoteServerListStatsBucket)
 	datastorePersistentStatTypeFailedTunnel     = string(datastoreFailedTunnelStatsBucket)
 	datastoreServerEntryFetchGCThreshold        = 10
 
-	datastoreReferenceCountMutex sync.RWMutex
-	datastoreReferenceCount      int64
-	datastoreMutex               sync.RWMutex
-	activeDatastoreDB            *datastoreDB
+	// datastoreBuckets lists all buckets that store datastore records.
+	datastoreBuckets = [][]byte{
+		datastoreServerEntriesBucket,
+		datastoreServerEntryTagsBucket,
+		datastoreServerEntryTombstoneTagsBucket,
+		datastoreUrlETagsBucket,
+		datastoreKeyValueBucket,
+		datastoreRemoteServerListStatsBucket,
+		datastoreFailedTunnelStatsBucket,
+		datastoreSLOKsBucket,
+		datastoreTacticsBucket,
+		datastoreSpeedTestSamplesBucket,
+		datastoreDialParametersBucket,
+		datastoreOSLServerEntryCountsBucket,
+		datastoreResolverCacheBucket,
+	}
+
+	// diskDataStore is the on-disk datastore. The on-disk datastore files
+	// may be opened only once, so all Configs that select the on-disk
+	// backend share this datastore.
+	diskDataStore = newDataStore(diskDatastoreBackend{})
+)
+
+const (
+	DATASTORE_BACKEND_DISK   = "disk"
+	DATASTORE_BACKEND_MEMORY = "memory"
 )
 
-// OpenDataStore opens and initializes the singleton datastore instance.
+// datastoreBackend opens datastoreDB instances. The on-disk backend
+// implementation, bolt, badger, or files, is selected at build time; the
+// backend used by a particular Config, on-disk or in-memory, is selected at
+// run time via Config.DataStoreBackend.
+type datastoreBackend interface {
+	openDB(config *Config, retryAndReset bool) (datastoreDB, error)
+}
+
+// datastoreDB, datastoreTx, datastoreBucket, and datastoreCursor are the
+// datastore interface implemented by each backend.
+//
+// As with the original bolt interface, value slices are only valid within a
+// transaction, and must be copied if retained.
+
+type datastoreDB interface {
+	view(fn func(tx datastoreTx) error) error
+	update(fn func(tx datastoreTx) error) error
+	close() error
+	getDataStoreMetrics() string
+	backup(filename string) error
+}
+
+type datastoreTx interface {
+	bucket(name []byte) datastoreBucket
+	clearBucket(name []byte) error
+}
+
+type datastoreBucket interface {
+	get(key []byte) []byte
+	put(key, value []byte) error
+	delete(key []byte) error
+	cursor() datastoreCursor
+}
+
+type datastoreCursor interface {
+	firstKey() []byte
+	nextKey() []byte
+	first() ([]byte, []byte)
+	next() ([]byte, []byte)
+	close()
+}
+
+// diskDatastoreBackend is the on-disk datastore backend, selected by build
+// tags.
+type diskDatastoreBackend struct {
+}
+
+func (diskDatastoreBackend) openDB(
+	config *Config, retryAndReset bool) (datastoreDB, error) {
+
+	encryptionKeys, err := config.getDataStoreEncryptionKeys()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	db, err := datastoreOpenDB(
+		config.GetDataStoreDirectory(), retryAndReset, encryptionKeys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return db, nil
+}
+
+// dataStore is a reference counted datastore handle, which opens a
+// datastoreDB using its backend on first use and closes it when the last
+// reference is released.
+//
+// Each Config resolves to a dataStore, via Config.getDataStore, and all
+// datastore functions operate on the dataStore for the specified Config. A
+// Config that selects the in-memory backend has its own dataStore, so each
+// Controller may select a backend independently; for example, concurrently
+// running Controllers may use the on-disk datastore and distinct in-memory
+// datastores.
+type dataStore struct {
+	backend             datastoreBackend
+	referenceCountMutex sync.RWMutex
+	referenceCount      int64
+	mutex               sync.RWMutex
+	db                  datastoreDB
+}
+
+func newDataStore(backend datastoreBackend) *dataStore {
+	return &dataStore{backend: backend}
+}
+
+// getDataStore returns the datastore selected by the config.
+func (config *Config) getDataStore() *dataStore {
+
+	config.dataStoreMutex.Lock()
+	defer config.dataStoreMutex.Unlock()
+
+	if config.dataStore == nil {
+		if config.DataStoreBackend == DATASTORE_BACKEND_MEMORY {
+			config.dataStore = newDataStore(memoryDatastoreBackend{})
+		} else {
+			config.dataStore = diskDataStore
+		}
+	}
+
+	return config.dataStore
+}
+
+// OpenDataStore opens and initializes the datastore selected by the config.
 //
 // Nested Open/CloseDataStore calls are supported: OpenDataStore will succeed
 // when called when the datastore is initialized. Every call to OpenDataStore
-// must be paired with a corresponding call to CloseDataStore to ensure the
-// datastore is closed.
+// must be paired with a corresponding call to CloseDataStore, with the same
+// config, to ensure the datastore is closed.
 func OpenDataStore(config *Config) error {
-	return openDataStore(config, true)
+	return config.getDataStore().open(config, true)
 }
 
 // OpenDataStoreWithoutRetry performs an OpenDataStore but does not retry or
@@ -77,131 +209,136 @@ func OpenDataStore(config *Config) error {
 // OpenDataStoreWithoutRetry when the datastore is expected to be locked by
 // another process and faster failure is preferred.
 func OpenDataStoreWithoutRetry(config *Config) error {
-	return openDataStore(config, false)
+	return config.getDataStore().open(config, false)
 }
 
-func openDataStore(config *Config, retryAndReset bool) error {
+func (store *dataStore) open(config *Config, retryAndReset bool) error {
 
-	// The datastoreReferenceCountMutex/datastoreMutex mutex pair allow for:
+	// The referenceCountMutex/mutex mutex pair allow for:
 	//
 	// _Nested_ OpenDataStore/CloseDataStore calls to not block when a
 	// datastoreView is in progress (for example, a GetDialParameters call while
 	// a slow ScanServerEntries is running). In this case the nested
-	// OpenDataStore/CloseDataStore calls will lock only
-	// datastoreReferenceCountMutex and not datastoreMutex.
+	// OpenDataStore/CloseDataStore calls will lock only referenceCountMutex
+	// and not mutex.
 	//
-	// Synchronized access, for OpenDataStore/CloseDataStore, to
-	// activeDatastoreDB based on a consistent view of datastoreReferenceCount
-	// via locking first datastoreReferenceCount and then datastoreMutex while
-	// holding datastoreReferenceCount.
+	// Synchronized access, for OpenDataStore/CloseDataStore, to db based on a
+	// consistent view of referenceCount via locking first
+	// referenceCountMutex and then mutex while holding referenceCountMutex.
 	//
-	// Concurrent access, for datastoreView/datastoreUpdate, to activeDatastoreDB
-	// via datastoreMutex read locks.
+	// Concurrent access, for datastoreView/datastoreUpdate, to db via mutex
+	// read locks.
 	//
-	// Exclusive access, for OpenDataStore/CloseDataStore, to activeDatastoreDB,
-	// with no running datastoreView/datastoreUpdate, by aquiring a
-	// datastoreMutex write lock.
+	// Exclusive access, for OpenDataStore/CloseDataStore, to db, with no
+	// running datastoreView/datastoreUpdate, by aquiring a mutex write lock.
 
-	datastoreReferenceCountMutex.Lock()
+	store.referenceCountMutex.Lock()
 
-	if datastoreReferenceCount < 0 || datastoreReferenceCount == math.MaxInt64 {
-		datastoreReferenceCountMutex.Unlock()
+	if store.referenceCount < 0 || store.referenceCount == math.MaxInt64 {
+		store.referenceCountMutex.Unlock()
 		return errors.Tracef(
-			"invalid datastore reference count: %d", datastoreReferenceCount)
+			"invalid datastore reference count: %d", store.referenceCount)
 	}
 
-	if datastoreReferenceCount > 0 {
+	if store.referenceCount > 0 {
 
 		// For this sanity check, we need only the read-only lock; and must use the
 		// read-only lock to allow concurrent datastoreView calls.
 
-		datastoreMutex.RLock()
-		isNil := activeDatastoreDB == nil
-		datastoreMutex.RUnlock()
+		store.mutex.RLock()
+		isNil := store.db == nil
+		store.mutex.RUnlock()
 		if isNil {
+			store.referenceCountMutex.Unlock()
 			return errors.TraceNew("datastore unexpectedly closed")
 		}
 
 		// Add a reference to the open datastore.
 
-		datastoreReferenceCount += 1
-		datastoreReferenceCountMutex.Unlock()
+		store.referenceCount += 1
+		store.referenceCountMutex.Unlock()
 		return nil
 	}
 
-	// Only lock datastoreMutex now that it's necessary.
-	// datastoreReferenceCountMutex remains locked.
-	datastoreMutex.Lock()
+	// Only lock mutex now that it's necessary. referenceCountMutex remains
+	// locked.
+	store.mutex.Lock()
 
-	if activeDatastoreDB != nil {
-		datastoreMutex.Unlock()
-		datastoreReferenceCountMutex.Unlock()
+	if store.db != nil {
+		store.mutex.Unlock()
+		store.referenceCountMutex.Unlock()
 		return errors.TraceNew("datastore unexpectedly open")
 	}
 
-	// datastoreReferenceCount is 0, so open the datastore.
+	// referenceCount is 0, so open the datastore.
 
-	newDB, err := datastoreOpenDB(
-		config.GetDataStoreDirectory(), retryAndReset)
+	newDB, err := store.backend.openDB(config, retryAndReset)
 	if err != nil {
-		datastoreMutex.Unlock()
-		datastoreReferenceCountMutex.Unlock()
+		store.mutex.Unlock()
+		store.referenceCountMutex.Unlock()
 		return errors.Trace(err)
 	}
 
-	datastoreReferenceCount = 1
-	activeDatastoreDB = newDB
-	datastoreMutex.Unlock()
-	datastoreReferenceCountMutex.Unlock()
+	store.referenceCount = 1
+	store.db = newDB
+	store.mutex.Unlock()
+	store.referenceCountMutex.Unlock()
 
-	_ = resetAllPersistentStatsToUnreported()
+	_ = resetAllPersistentStatsToUnreported(config)
 
 	return nil
 }
 
-// CloseDataStore closes the singleton datastore instance, if open.
-func CloseDataStore() {
+// CloseDataStore closes the datastore selected by the config, if open.
+func CloseDataStore(config *Config) {
+	config.getDataStore().close()
+}
+
+func (store *dataStore) close() {
 
-	datastoreReferenceCountMutex.Lock()
-	defer datastoreReferenceCountMutex.Unlock()
+	store.referenceCountMutex.Lock()
+	defer store.referenceCountMutex.Unlock()
 
-	if datastoreReferenceCount <= 0 {
+	if store.referenceCount <= 0 {
 		NoticeWarning(
-			"invalid datastore reference count: %d", datastoreReferenceCount)
+			"invalid datastore reference count: %d", store.referenceCount)
 		return
 	}
-	datastoreReferenceCount -= 1
-	if datastoreReferenceCount > 0 {
+	store.referenceCount -= 1
+	if store.referenceCount > 0 {
 		return
 	}
 
-	// Only lock datastoreMutex now that it's necessary.
-	// datastoreReferenceCountMutex remains locked.
-	datastoreMutex.Lock()
-	defer datastoreMutex.Unlock()
+	// Only lock mutex now that it's necessary. referenceCountMutex remains
+	// locked.
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
-	if activeDatastoreDB == nil {
+	if store.db == nil {
 		return
 	}
 
-	err := activeDatastoreDB.close()
+	err := store.db.close()
 	if err != nil {
 		NoticeWarning("failed to close datastore: %s", errors.Trace(err))
 	}
 
-	activeDatastoreDB = nil
+	store.db = nil
 }
 
 // GetDataStoreMetrics returns a string logging datastore metrics.
-func GetDataStoreMetrics() string {
-	datastoreMutex.RLock()
-	defer datastoreMutex.RUnlock()
+func GetDataStoreMetrics(config *Config) string {
+
+	store := config.getDataStore()
 
-	if activeDatastoreDB == nil {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if store.db == nil {
 		return ""
 	}
 
-	return activeDatastoreDB.getDataStoreMetrics()
+	return store.db.getDataStoreMetrics()
 }
 
 // datastoreView runs a read-only transaction, making datastore buckets and
@@ -209,16 +346,18 @@ func GetDataStoreMetrics() string {
 //
 // Bucket value slices are only valid for the duration of the transaction and
 // _must_ not be referenced directly outside the transaction.
-func datastoreView(fn func(tx *datastoreTx) error) error {
+func datastoreView(config *Config, fn func(tx datastoreTx) error) error {
+
+	store := config.getDataStore()
 
-	datastoreMutex.RLock()
-	defer datastoreMutex.RUnlock()
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 
-	if activeDatastoreDB == nil {
+	if store.db == nil {
 		return errors.TraceNew("datastore not open")
 	}
 
-	err := activeDatastoreDB.view(fn)
+	err := store.db.view(fn)
 	if err != nil {
 		err = errors.Trace(err)
 	}
@@ -230,16 +369,18 @@ func datastoreView(fn func(tx *datastoreTx) error) error {
 //
 // Bucket value slices are only valid for the duration of the transaction and
 // _must_ not be referenced directly outside the transaction.
-func datastoreUpdate(fn func(tx *datastoreTx) error) error {
+func datastoreUpdate(config *Config, fn func(tx datastoreTx) error) error {
 
-	datastoreMutex.RLock()
-	defer datastoreMutex.RUnlock()
+	store := config.getDataStore()
 
-	if activeDatastoreDB == nil {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if store.db == nil {
 		return errors.TraceNew("database not open")
 	}
 
-	err := activeDatastoreDB.update(fn)
+	err := store.db.update(fn)
 	if err != nil {
 		err = errors.Trace(err)
 	}
@@ -254,7 +395,7 @@ func datastoreUpdate(fn func(tx *datastoreTx) error) error {
 //
 // If the server entry data is malformed, an alert notice is issued and
 // the entry is skipped; no error is returned.
-func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExists bool) error {
+func StoreServerEntry(config *Config, serverEntryFields protocol.ServerEntryFields, replaceIfExists bool) error {
 
 	// TODO: call serverEntryFields.VerifySignature. At this time, we do not do
 	// this as not all server entries have an individual signature field. All
@@ -277,7 +418,7 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 	// values (e.g., many servers support all protocols), performance
 	// is expected to be acceptable.
 
-	err = datastoreUpdate(func(tx *datastoreTx) error {
+	err = datastoreUpdate(config, func(tx datastoreTx) error {
 
 		serverEntries := tx.bucket(datastoreServerEntriesBucket)
 		serverEntryTags := tx.bucket(datastoreServerEntryTagsBucket)
@@ -367,7 +508,7 @@ func StoreServerEntries(
 	replaceIfExists bool) error {
 
 	for _, serverEntryFields := range serverEntries {
-		err := StoreServerEntry(serverEntryFields, replaceIfExists)
+		err := StoreServerEntry(config, serverEntryFields, replaceIfExists)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -386,43 +527,65 @@ func StreamingStoreServerEntries(
 	serverEntries *protocol.StreamingServerEntryDecoder,
 	replaceIfExists bool) error {
 
+	_, err := streamingStoreServerEntries(
+		ctx, config, serverEntries, replaceIfExists, nil)
+	return errors.Trace(err)
+}
+
+// streamingStoreServerEntries is StreamingStoreServerEntries with the
+// addition of returning the number of server entries stored. When
+// serverEntryTags is not nil, the tag of each server entry stored is added to
+// serverEntryTags.
+func streamingStoreServerEntries(
+	ctx context.Context,
+	config *Config,
+	serverEntries *protocol.StreamingServerEntryDecoder,
+	replaceIfExists bool,
+	serverEntryTags map[string]bool) (int, error) {
+
 	// Note: both StreamingServerEntryDecoder.Next and StoreServerEntry
 	// allocate temporary memory buffers for hex/JSON decoding/encoding,
 	// so this isn't true constant-memory streaming (it depends on garbage
 	// collection).
 
+	count := 0
 	n := 0
 	for {
 
 		select {
 		case <-ctx.Done():
-			return errors.Trace(ctx.Err())
+			return count, errors.Trace(ctx.Err())
 		default:
 		}
 
 		serverEntry, err := serverEntries.Next()
 		if err != nil {
-			return errors.Trace(err)
+			return count, errors.Trace(err)
 		}
 
 		if serverEntry == nil {
 			// No more server entries
-			return nil
+			return count, nil
 		}
 
-		err = StoreServerEntry(serverEntry, replaceIfExists)
+		err = StoreServerEntry(config, serverEntry, replaceIfExists)
 		if err != nil {
-			return errors.Trace(err)
+			return count, errors.Trace(err)
+		}
+
+		// StoreServerEntry sets the tag when the server entry has none.
+		if serverEntryTags != nil {
+			serverEntryTags[serverEntry.GetTag()] = true
 		}
 
+		count += 1
+
 		n += 1
 		if n == datastoreServerEntryFetchGCThreshold {
 			DoGarbageCollection()
 			n = 0
 		}
 	}
-
-	return nil
 }
 
 // ImportEmbeddedServerEntries loads, decodes, and stores a list of server
@@ -472,7 +635,7 @@ func ImportEmbeddedServerEntries(
 // PromoteServerEntry sets the server affinity server entry ID to the
 // specified server entry IP address.
 func PromoteServerEntry(config *Config, ipAddress string) error {
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 
 		serverEntryID := []byte(ipAddress)
 
@@ -519,8 +682,8 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 
 // DeleteServerEntryAffinity clears server affinity if set to the specified
 // server.
-func DeleteServerEntryAffinity(ipAddress string) error {
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+func DeleteServerEntryAffinity(config *Config, ipAddress string) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 
 		serverEntryID := []byte(ipAddress)
 
@@ -565,7 +728,7 @@ func hasServerEntryFilterChanged(config *Config) (bool, error) {
 	}
 
 	changed := false
-	err = datastoreView(func(tx *datastoreTx) error {
+	err = datastoreView(config, func(tx datastoreTx) error {
 
 		bucket := tx.bucket(datastoreKeyValueBucket)
 		previousFilter := bucket.get(datastoreLastServerEntryFilterKey)
@@ -739,7 +902,7 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 		if err != nil {
 			return errors.Trace(err)
 		}
-		defer CloseDataStore()
+		defer CloseDataStore(iterator.config)
 	}
 
 	// BoltDB implementation note:
@@ -758,7 +921,7 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 
 	var serverEntryIDs [][]byte
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(iterator.config, func(tx datastoreTx) error {
 
 		bucket := tx.bucket(datastoreKeyValueBucket)
 
@@ -889,9 +1052,11 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
-		defer CloseDataStore()
+		defer CloseDataStore(iterator.config)
 	}
 
+	serverEntrySignaturePublicKeys := iterator.config.GetServerEntrySignaturePublicKeys()
+
 	// There are no region/protocol indexes for the server entries bucket.
 	// Loop until we have the next server entry that matches the iterator
 	// filter requirements.
@@ -907,7 +1072,7 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		serverEntry = nil
 		doDeleteServerEntry := false
 
-		err = datastoreView(func(tx *datastoreTx) error {
+		err = datastoreView(iterator.config, func(tx datastoreTx) error {
 			serverEntries := tx.bucket(datastoreServerEntriesBucket)
 			value := serverEntries.get(serverEntryID)
 			if value == nil {
@@ -924,7 +1089,7 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 			// example. A delete is triggered also in the case where the server entry
 			// record fails to unmarshal.
 
-			if iterator.config.ServerEntrySignaturePublicKey != "" {
+			if len(serverEntrySignaturePublicKeys) > 0 {
 
 				var serverEntryFields protocol.ServerEntryFields
 				err = json.Unmarshal(value, &serverEntryFields)
@@ -939,8 +1104,8 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 				}
 
 				if serverEntryFields.HasSignature() {
-					err = serverEntryFields.VerifySignature(
-						iterator.config.ServerEntrySignaturePublicKey)
+					err = serverEntryFields.VerifySignatureWithKeys(
+						serverEntrySignaturePublicKeys)
 					if err != nil {
 						doDeleteServerEntry = true
 						NoticeWarning(
@@ -998,7 +1163,7 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 			serverEntry.Tag = protocol.GenerateServerEntryTag(
 				serverEntry.IpAddress, serverEntry.WebServerSecret)
 
-			err = datastoreUpdate(func(tx *datastoreTx) error {
+			err = datastoreUpdate(iterator.config, func(tx datastoreTx) error {
 
 				serverEntries := tx.bucket(datastoreServerEntriesBucket)
 				serverEntryTags := tx.bucket(datastoreServerEntryTagsBucket)
@@ -1116,7 +1281,7 @@ func pruneServerEntry(config *Config, serverEntryTag string) error {
 	minimumAgeForPruning := config.GetParameters().Get().Duration(
 		parameters.ServerEntryMinimumAgeForPruning)
 
-	return datastoreUpdate(func(tx *datastoreTx) error {
+	return datastoreUpdate(config, func(tx datastoreTx) error {
 
 		serverEntries := tx.bucket(datastoreServerEntriesBucket)
 		serverEntryTags := tx.bucket(datastoreServerEntryTagsBucket)
@@ -1216,7 +1381,7 @@ func DeleteServerEntry(config *Config, ipAddress string) {
 
 func deleteServerEntry(config *Config, serverEntryID []byte) error {
 
-	return datastoreUpdate(func(tx *datastoreTx) error {
+	return datastoreUpdate(config, func(tx datastoreTx) error {
 
 		serverEntries := tx.bucket(datastoreServerEntriesBucket)
 		serverEntryTags := tx.bucket(datastoreServerEntryTagsBucket)
@@ -1252,9 +1417,9 @@ func deleteServerEntry(config *Config, serverEntryID []byte) error {
 func deleteServerEntryHelper(
 	config *Config,
 	serverEntryID []byte,
-	serverEntries *datastoreBucket,
-	keyValues *datastoreBucket,
-	dialParameters *datastoreBucket) error {
+	serverEntries datastoreBucket,
+	keyValues datastoreBucket,
+	dialParameters datastoreBucket) error {
 
 	err := serverEntries.delete(serverEntryID)
 	if err != nil {
@@ -1273,23 +1438,165 @@ func deleteServerEntryHelper(
 		}
 	}
 
-	// TODO: expose boltdb Seek functionality to skip to first matching record.
+	// Dial parameters key has serverID as a prefix; see makeDialParametersKey.
+	//
+	// The whole bucket is scanned, as matching keys are not necessarily
+	// adjacent: when datastore encryption is enabled, keys are stored
+	// encrypted and the cursor order is not the plaintext key order. Matching
+	// keys are collected and deleted after the scan, as deleting while
+	// iterating may cause the cursor to skip records.
+	var deleteKeys [][]byte
 	cursor := dialParameters.cursor()
-	defer cursor.close()
-	foundFirstMatch := false
-	for key, _ := cursor.first(); key != nil; key, _ = cursor.next() {
-		// Dial parameters key has serverID as a prefix; see makeDialParametersKey.
+	for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
 		if bytes.HasPrefix(key, serverEntryID) {
-			foundFirstMatch = true
-			err := dialParameters.delete(key)
+			deleteKeys = append(deleteKeys, append([]byte(nil), key...))
+		}
+	}
+	cursor.close()
+
+	for _, key := range deleteKeys {
+		err := dialParameters.delete(key)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// deleteRemoteServerListEntries deletes the server entries, along with
+// associated data, corresponding to the specified server entry tags. Unlike
+// pruneServerEntry, there is no age check and no tombstones are set, as the
+// tags are supplied by an authenticated remote server list delta. Unknown
+// tags are ignored.
+//
+// Only server entries most recently stored from the common remote server list
+// are deleted. A server entry that's also distributed by another source, such
+// as an OSL or the embedded list, and was last stored from that source, is
+// retained; removal from the common remote server list doesn't imply that the
+// server entry is no longer valid.
+func deleteRemoteServerListEntries(config *Config, serverEntryTags []string) error {
+
+	return datastoreUpdate(config, func(tx datastoreTx) error {
+
+		for _, serverEntryTag := range serverEntryTags {
+			err := deleteRemoteServerListEntry(config, tx, serverEntryTag)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// pruneRemoteServerListEntries deletes all server entries most recently
+// stored from the common remote server list that are not in
+// keepServerEntryTags, the tags of the latest full list. This ensures that
+// importing a full list results in the same set of server entries as
+// applying the deltas from the previous version; see
+// deleteRemoteServerListEntries.
+func pruneRemoteServerListEntries(
+	config *Config, keepServerEntryTags map[string]bool) (int, error) {
+
+	count := 0
+
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
+
+		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+
+		var pruneServerEntryTags []string
+
+		cursor := serverEntries.cursor()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+
+			var serverEntry *protocol.ServerEntry
+			err := json.Unmarshal(value, &serverEntry)
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				NoticeWarning("pruneRemoteServerListEntries: %s", errors.Trace(err))
+				continue
+			}
+
+			if serverEntry.LocalSource == protocol.SERVER_ENTRY_SOURCE_REMOTE &&
+				!keepServerEntryTags[serverEntry.Tag] {
+
+				pruneServerEntryTags = append(pruneServerEntryTags, serverEntry.Tag)
+			}
+		}
+		cursor.close()
+
+		for _, serverEntryTag := range pruneServerEntryTags {
+			err := deleteRemoteServerListEntry(config, tx, serverEntryTag)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		count = len(pruneServerEntryTags)
+
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return count, nil
+}
+
+func deleteRemoteServerListEntry(
+	config *Config, tx datastoreTx, serverEntryTag string) error {
+
+	serverEntries := tx.bucket(datastoreServerEntriesBucket)
+	tags := tx.bucket(datastoreServerEntryTagsBucket)
+	keyValues := tx.bucket(datastoreKeyValueBucket)
+	dialParameters := tx.bucket(datastoreDialParametersBucket)
+
+	serverEntryTagBytes := []byte(serverEntryTag)
+
+	serverEntryID := tags.get(serverEntryTagBytes)
+	if serverEntryID == nil {
+		return nil
+	}
+
+	// As in pruneServerEntry, only delete the server entry record when its
+	// tag matches; otherwise the server entry record is associated with
+	// another tag, in the server IP recycle case, and only the stale tag
+	// record is deleted.
+
+	serverEntryJson := serverEntries.get(serverEntryID)
+	if serverEntryJson != nil {
+
+		var serverEntry *protocol.ServerEntry
+		err := json.Unmarshal(serverEntryJson, &serverEntry)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if serverEntry.Tag == serverEntryTag {
+
+			if serverEntry.LocalSource != protocol.SERVER_ENTRY_SOURCE_REMOTE {
+				return nil
+			}
+
+			err = deleteServerEntryHelper(
+				config,
+				serverEntryID,
+				serverEntries,
+				keyValues,
+				dialParameters)
 			if err != nil {
 				return errors.Trace(err)
 			}
-		} else if foundFirstMatch {
-			break
 		}
 	}
 
+	err := tags.delete(serverEntryTagBytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
 	return nil
 }
 
@@ -1301,7 +1608,7 @@ func deleteServerEntryHelper(
 // and/or very large server lists. Callers should avoid blocking on
 // ScanServerEntries where possible; and use the canel option to interrupt
 // scans that are no longer required.
-func ScanServerEntries(callback func(*protocol.ServerEntry) bool) error {
+func ScanServerEntries(config *Config, callback func(*protocol.ServerEntry) bool) error {
 
 	// TODO: this operation can be sped up (by a factor of ~2x, in one test
 	// scenario) by using a faster JSON implementation
@@ -1321,7 +1628,7 @@ func ScanServerEntries(callback func(*protocol.ServerEntry) bool) error {
 	// transaction overhead. Other operations such as ServerEntryIterator
 	// amortize the cost of JSON unmarshalling over many other operations.
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 
 		bucket := tx.bucket(datastoreServerEntriesBucket)
 		cursor := bucket.cursor()
@@ -1363,11 +1670,11 @@ func ScanServerEntries(callback func(*protocol.ServerEntry) bool) error {
 // HasServerEntries returns a bool indicating if the data store contains at
 // least one server entry. This is a faster operation than CountServerEntries.
 // On failure, HasServerEntries returns false.
-func HasServerEntries() bool {
+func HasServerEntries(config *Config) bool {
 
 	hasServerEntries := false
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreServerEntriesBucket)
 		cursor := bucket.cursor()
 		key, _ := cursor.first()
@@ -1386,11 +1693,11 @@ func HasServerEntries() bool {
 
 // CountServerEntries returns a count of stored server entries. On failure,
 // CountServerEntries returns 0.
-func CountServerEntries() int {
+func CountServerEntries(config *Config) int {
 
 	count := 0
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreServerEntriesBucket)
 		cursor := bucket.cursor()
 		for key, _ := cursor.first(); key != nil; key, _ = cursor.next() {
@@ -1411,9 +1718,9 @@ func CountServerEntries() int {
 // SetUrlETag stores an ETag for the specfied URL.
 // Note: input URL is treated as a string, and is not
 // encoded or decoded or otherwise canonicalized.
-func SetUrlETag(url, etag string) error {
+func SetUrlETag(config *Config, url, etag string) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreUrlETagsBucket)
 		err := bucket.put([]byte(url), []byte(etag))
 		if err != nil {
@@ -1430,11 +1737,11 @@ func SetUrlETag(url, etag string) error {
 
 // GetUrlETag retrieves a previously stored an ETag for the
 // specfied URL. If not found, it returns an empty string value.
-func GetUrlETag(url string) (string, error) {
+func GetUrlETag(config *Config, url string) (string, error) {
 
 	var etag string
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreUrlETagsBucket)
 		etag = string(bucket.get([]byte(url)))
 		return nil
@@ -1447,9 +1754,9 @@ func GetUrlETag(url string) (string, error) {
 }
 
 // SetKeyValue stores a key/value pair.
-func SetKeyValue(key, value string) error {
+func SetKeyValue(config *Config, key, value string) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreKeyValueBucket)
 		err := bucket.put([]byte(key), []byte(value))
 		if err != nil {
@@ -1466,11 +1773,11 @@ func SetKeyValue(key, value string) error {
 
 // GetKeyValue retrieves the value for a given key. If not found,
 // it returns an empty string value.
-func GetKeyValue(key string) (string, error) {
+func GetKeyValue(config *Config, key string) (string, error) {
 
 	var value string
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreKeyValueBucket)
 		value = string(bucket.get([]byte(key)))
 		return nil
@@ -1482,6 +1789,136 @@ func GetKeyValue(key string) (string, error) {
 	return value, nil
 }
 
+// storeVerifiedDNSCacheEntries stores the verified DNS cache entries for the
+// specified network ID, replacing any previously stored entries.
+//
+// Records for other network IDs are pruned when all of their entries have
+// expired. In addition, only up to DNSResolverCacheMaxStoreNetworks network
+// IDs are retained; when this limit is exceeded, the records for other
+// network IDs with the earliest expiring entries are deleted.
+func storeVerifiedDNSCacheEntries(
+	config *Config,
+	networkID string,
+	entries []*resolver.VerifiedCacheEntry) error {
+
+	maxStoreNetworks := config.GetParameters().Get().Int(
+		parameters.DNSResolverCacheMaxStoreNetworks)
+
+	var value []byte
+	if len(entries) > 0 {
+		var err error
+		value, err = json.Marshal(entries)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
+		bucket := tx.bucket(datastoreResolverCacheBucket)
+		var err error
+		if value == nil {
+			err = bucket.delete([]byte(networkID))
+		} else {
+			err = bucket.put([]byte(networkID), value)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Find the latest expiry for each other network ID record.
+
+		type networkRecord struct {
+			networkID []byte
+			expiry    time.Time
+		}
+
+		var records []networkRecord
+
+		cursor := bucket.cursor()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			if string(key) == networkID {
+				continue
+			}
+			var recordEntries []*resolver.VerifiedCacheEntry
+			err := json.Unmarshal(value, &recordEntries)
+			if err != nil {
+				// Corrupt records are deleted, as expired records.
+				recordEntries = nil
+			}
+			record := networkRecord{networkID: append([]byte(nil), key...)}
+			for _, entry := range recordEntries {
+				if entry != nil && entry.Expiry.After(record.expiry) {
+					record.expiry = entry.Expiry
+				}
+			}
+			records = append(records, record)
+		}
+		cursor.close()
+
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].expiry.Before(records[j].expiry)
+		})
+
+		// Delete expired records and then, when there are still too many
+		// records, the earliest expiring records. The record for the
+		// current network ID counts towards the limit.
+
+		maxOtherRecords := maxStoreNetworks
+		if value != nil {
+			maxOtherRecords -= 1
+		}
+
+		now := time.Now()
+
+		for i, record := range records {
+			if record.expiry.After(now) && len(records)-i <= maxOtherRecords {
+				break
+			}
+			err := bucket.delete(record.networkID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// loadVerifiedDNSCacheEntries loads the verified DNS cache entries stored
+// for the specified network ID. Expired entries are returned; the resolver
+// applies its TTL policy when loading.
+func loadVerifiedDNSCacheEntries(
+	config *Config, networkID string) ([]*resolver.VerifiedCacheEntry, error) {
+
+	var entries []*resolver.VerifiedCacheEntry
+
+	err := datastoreView(config, func(tx datastoreTx) error {
+		bucket := tx.bucket(datastoreResolverCacheBucket)
+		value := bucket.get([]byte(networkID))
+		if value == nil {
+			return nil
+		}
+		err := json.Unmarshal(value, &entries)
+		if err != nil {
+			// Don't fail the resolver on a corrupt record.
+			NoticeWarning(
+				"loadVerifiedDNSCacheEntries: %s", errors.Trace(err))
+			entries = nil
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return entries, nil
+}
+
 // Persistent stat records in the persistentStatStateUnreported
 // state are available for take out.
 //
@@ -1520,7 +1957,7 @@ func StorePersistentStat(config *Config, statType string, stat []byte) error {
 	maxStoreRecords := config.GetParameters().Get().Int(
 		parameters.PersistentStatsMaxStoreRecords)
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 		bucket := tx.bucket([]byte(statType))
 
 		count := 0
@@ -1555,11 +1992,11 @@ func StorePersistentStat(config *Config, statType string, stat []byte) error {
 
 // CountUnreportedPersistentStats returns the number of persistent
 // stat records in StateUnreported.
-func CountUnreportedPersistentStats() int {
+func CountUnreportedPersistentStats(config *Config) int {
 
 	unreported := 0
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
@@ -1596,7 +2033,7 @@ func TakeOutUnreportedPersistentStats(config *Config) (map[string][][]byte, erro
 	maxSendBytes := config.GetParameters().Get().Int(
 		parameters.PersistentStatsMaxSendBytes)
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 
 		sendBytes := 0
 
@@ -1658,9 +2095,9 @@ func TakeOutUnreportedPersistentStats(config *Config) (map[string][][]byte, erro
 
 // PutBackUnreportedPersistentStats restores a list of persistent
 // stat records to StateUnreported.
-func PutBackUnreportedPersistentStats(stats map[string][][]byte) error {
+func PutBackUnreportedPersistentStats(config *Config, stats map[string][][]byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
@@ -1685,9 +2122,9 @@ func PutBackUnreportedPersistentStats(stats map[string][][]byte) error {
 
 // ClearReportedPersistentStats deletes a list of persistent
 // stat records that were successfully reported.
-func ClearReportedPersistentStats(stats map[string][][]byte) error {
+func ClearReportedPersistentStats(config *Config, stats map[string][][]byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
@@ -1714,9 +2151,9 @@ func ClearReportedPersistentStats(stats map[string][][]byte) error {
 // records to StateUnreported. This reset is called when the
 // datastore is initialized at start up, as we do not know if
 // persistent records in StateReporting were reported or not.
-func resetAllPersistentStatsToUnreported() error {
+func resetAllPersistentStatsToUnreported(config *Config) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
@@ -1750,11 +2187,11 @@ func resetAllPersistentStatsToUnreported() error {
 }
 
 // CountSLOKs returns the total number of SLOK records.
-func CountSLOKs() int {
+func CountSLOKs(config *Config) int {
 
 	count := 0
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreSLOKsBucket)
 		cursor := bucket.cursor()
 		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
@@ -1773,9 +2210,9 @@ func CountSLOKs() int {
 }
 
 // DeleteSLOKs deletes all SLOK records.
-func DeleteSLOKs() error {
+func DeleteSLOKs(config *Config) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 		return tx.clearBucket(datastoreSLOKsBucket)
 	})
 
@@ -1788,11 +2225,11 @@ func DeleteSLOKs() error {
 
 // SetSLOK stores a SLOK key, referenced by its ID. The bool
 // return value indicates whether the SLOK was already stored.
-func SetSLOK(id, slok []byte) (bool, error) {
+func SetSLOK(config *Config, id, slok []byte) (bool, error) {
 
 	var duplicate bool
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreSLOKsBucket)
 		duplicate = bucket.get(id) != nil
 		err := bucket.put(id, slok)
@@ -1811,11 +2248,11 @@ func SetSLOK(id, slok []byte) (bool, error) {
 
 // GetSLOK returns a SLOK key for the specified ID. The return
 // value is nil if the SLOK is not found.
-func GetSLOK(id []byte) ([]byte, error) {
+func GetSLOK(config *Config, id []byte) ([]byte, error) {
 
 	var slok []byte
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(datastoreSLOKsBucket)
 		value := bucket.get(id)
 		if value != nil {
@@ -1833,6 +2270,71 @@ func GetSLOK(id []byte) ([]byte, error) {
 	return slok, nil
 }
 
+// GetSLOKIDs returns the IDs of all stored SLOKs.
+func GetSLOKIDs(config *Config) ([][]byte, error) {
+
+	var IDs [][]byte
+
+	err := datastoreView(config, func(tx datastoreTx) error {
+		bucket := tx.bucket(datastoreSLOKsBucket)
+		cursor := bucket.cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			// Must make a copy as slice is only valid within transaction.
+			ID := make([]byte, len(key))
+			copy(ID, key)
+			IDs = append(IDs, ID)
+		}
+		cursor.close()
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return IDs, nil
+}
+
+// SetOSLServerEntryCount records the number of server entries imported from
+// the OSL specified by its ID.
+func SetOSLServerEntryCount(config *Config, oslID []byte, count int) error {
+	return setBucketValue(
+		config,
+		datastoreOSLServerEntryCountsBucket, oslID, []byte(strconv.Itoa(count)))
+}
+
+// GetOSLServerEntryCount returns the number of server entries imported from
+// the OSL specified by its ID. The bool return value is false when the OSL
+// has not been imported.
+func GetOSLServerEntryCount(config *Config, oslID []byte) (int, bool, error) {
+
+	var count int
+	var ok bool
+
+	err := getBucketValue(
+		config,
+		datastoreOSLServerEntryCountsBucket,
+		oslID,
+		func(value []byte) error {
+			if value == nil {
+				return nil
+			}
+			var err error
+			count, err = strconv.Atoi(string(value))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ok = true
+			return nil
+		})
+
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+
+	return count, ok, nil
+}
+
 func makeDialParametersKey(serverIPAddress, networkID []byte) []byte {
 	// TODO: structured key?
 	return append(append([]byte(nil), serverIPAddress...), networkID...)
@@ -1840,7 +2342,7 @@ func makeDialParametersKey(serverIPAddress, networkID []byte) []byte {
 
 // SetDialParameters stores dial parameters associated with the specified
 // server/network ID.
-func SetDialParameters(serverIPAddress, networkID string, dialParams *DialParameters) error {
+func SetDialParameters(config *Config, serverIPAddress, networkID string, dialParams *DialParameters) error {
 
 	key := makeDialParametersKey([]byte(serverIPAddress), []byte(networkID))
 
@@ -1849,7 +2351,7 @@ func SetDialParameters(serverIPAddress, networkID string, dialParams *DialParame
 		return errors.Trace(err)
 	}
 
-	return setBucketValue(datastoreDialParametersBucket, key, data)
+	return setBucketValue(config, datastoreDialParametersBucket, key, data)
 }
 
 // GetDialParameters fetches any dial parameters associated with the specified
@@ -1863,13 +2365,14 @@ func GetDialParameters(
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	defer CloseDataStore()
+	defer CloseDataStore(config)
 
 	key := makeDialParametersKey([]byte(serverIPAddress), []byte(networkID))
 
 	var dialParams *DialParameters
 
 	err = getBucketValue(
+		config,
 		datastoreDialParametersBucket,
 		key,
 		func(value []byte) error {
@@ -1898,11 +2401,11 @@ func GetDialParameters(
 
 // DeleteDialParameters clears any dial parameters associated with the
 // specified server/network ID.
-func DeleteDialParameters(serverIPAddress, networkID string) error {
+func DeleteDialParameters(config *Config, serverIPAddress, networkID string) error {
 
 	key := makeDialParametersKey([]byte(serverIPAddress), []byte(networkID))
 
-	return deleteBucketValue(datastoreDialParametersBucket, key)
+	return deleteBucketValue(config, datastoreDialParametersBucket, key)
 }
 
 // TacticsStorer implements tactics.Storer.
@@ -1947,8 +2450,8 @@ func (t *TacticsStorer) SetTacticsRecord(networkID string, record []byte) error
 	if err != nil {
 		return errors.Trace(err)
 	}
-	defer CloseDataStore()
-	err = setBucketValue(datastoreTacticsBucket, []byte(networkID), record)
+	defer CloseDataStore(t.config)
+	err = setBucketValue(t.config, datastoreTacticsBucket, []byte(networkID), record)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -1960,8 +2463,8 @@ func (t *TacticsStorer) GetTacticsRecord(networkID string) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	defer CloseDataStore()
-	value, err := copyBucketValue(datastoreTacticsBucket, []byte(networkID))
+	defer CloseDataStore(t.config)
+	value, err := copyBucketValue(t.config, datastoreTacticsBucket, []byte(networkID))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -1973,8 +2476,8 @@ func (t *TacticsStorer) SetSpeedTestSamplesRecord(networkID string, record []byt
 	if err != nil {
 		return errors.Trace(err)
 	}
-	defer CloseDataStore()
-	err = setBucketValue(datastoreSpeedTestSamplesBucket, []byte(networkID), record)
+	defer CloseDataStore(t.config)
+	err = setBucketValue(t.config, datastoreSpeedTestSamplesBucket, []byte(networkID), record)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -1986,8 +2489,8 @@ func (t *TacticsStorer) GetSpeedTestSamplesRecord(networkID string) ([]byte, err
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	defer CloseDataStore()
-	value, err := copyBucketValue(datastoreSpeedTestSamplesBucket, []byte(networkID))
+	defer CloseDataStore(t.config)
+	value, err := copyBucketValue(t.config, datastoreSpeedTestSamplesBucket, []byte(networkID))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -2005,12 +2508,12 @@ func GetTacticsStorer(config *Config) *TacticsStorer {
 // DialParameter output may be nil when a server entry is found but has no
 // dial parameters.
 func GetAffinityServerEntryAndDialParameters(
-	networkID string) (protocol.ServerEntryFields, *DialParameters, error) {
+	config *Config, networkID string) (protocol.ServerEntryFields, *DialParameters, error) {
 
 	var serverEntryFields protocol.ServerEntryFields
 	var dialParams *DialParameters
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 
 		keyValues := tx.bucket(datastoreKeyValueBucket)
 		serverEntries := tx.bucket(datastoreServerEntriesBucket)
@@ -2054,9 +2557,9 @@ func GetAffinityServerEntryAndDialParameters(
 	return serverEntryFields, dialParams, nil
 }
 
-func setBucketValue(bucket, key, value []byte) error {
+func setBucketValue(config *Config, bucket, key, value []byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(bucket)
 		err := bucket.put(key, value)
 		if err != nil {
@@ -2072,9 +2575,9 @@ func setBucketValue(bucket, key, value []byte) error {
 	return nil
 }
 
-func getBucketValue(bucket, key []byte, valueCallback func([]byte) error) error {
+func getBucketValue(config *Config, bucket, key []byte, valueCallback func([]byte) error) error {
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(bucket)
 		value := bucket.get(key)
 		return valueCallback(value)
@@ -2087,9 +2590,9 @@ func getBucketValue(bucket, key []byte, valueCallback func([]byte) error) error
 	return nil
 }
 
-func deleteBucketValue(bucket, key []byte) error {
+func deleteBucketValue(config *Config, bucket, key []byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(config, func(tx datastoreTx) error {
 		bucket := tx.bucket(bucket)
 		return bucket.delete(key)
 	})
@@ -2101,9 +2604,9 @@ func deleteBucketValue(bucket, key []byte) error {
 	return nil
 }
 
-func copyBucketValue(bucket, key []byte) ([]byte, error) {
+func copyBucketValue(config *Config, bucket, key []byte) ([]byte, error) {
 	var valueCopy []byte
-	err := getBucketValue(bucket, key, func(value []byte) error {
+	err := getBucketValue(config, bucket, key, func(value []byte) error {
 		if value != nil {
 			// Must make a copy as slice is only valid within transaction.
 			valueCopy = make([]byte, len(value))
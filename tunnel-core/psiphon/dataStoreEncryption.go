@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Datastore encryption protects the datastore at rest. When enabled, every
+// bucket key and value is encrypted, in all datastore backends, so that the
+// datastore files do not reveal stored server entries, dial parameters,
+// tactics, SLOKs, or other records.
+//
+// Keys are encrypted deterministically, so that records may still be looked
+// up by key: the secretbox nonce is an HMAC of the plaintext key. Values are
+// encrypted with a random nonce and with a per-record secretbox key derived
+// from the plaintext bucket key, which binds each value to its key.
+// Bucket names, the number of records, and record sizes are not hidden.
+//
+// The ID of the key used to encrypt the datastore is recorded, in
+// plaintext, in a dedicated bucket. When the datastore is opened:
+//
+// - a plaintext datastore, with no recorded key ID, is migrated to the
+//   current key, if any;
+// - a datastore encrypted with a previous key is migrated to the current
+//   key, or back to plaintext when there is no current key;
+// - a datastore encrypted with an unknown key cannot be read, and opening
+//   fails; as with a corrupt datastore, the retry and reset logic in
+//   datastoreOpenDB will then reset the datastore.
+//
+// Migration rewrites all records within a single update transaction. For
+// the files backend, transactions are not atomic, and an interrupted
+// migration may leave the datastore unreadable, in which case it will also
+// be reset. For the bolt backend, records overwritten by migration may
+// remain in free pages of the datastore file until reused; CompactDataStore
+// rewrites the file without free pages.
+
+// DataStoreEncryptionKeyProvider defines the interface to an external
+// provider of datastore encryption keys, such as a platform key store.
+// GetDataStoreEncryptionKeys returns the current base64-encoded key, which
+// may be "" to disable encryption, and any previous base64-encoded keys,
+// which are used only to read and migrate an existing datastore.
+type DataStoreEncryptionKeyProvider interface {
+	GetDataStoreEncryptionKeys() (string, []string, error)
+}
+
+const (
+	DATASTORE_ENCRYPTION_KEY_SIZE = 32
+
+	datastoreEncryptionKeyIDSize = 8
+)
+
+var (
+	datastoreEncryptionBucket = []byte("encryption")
+	datastoreEncryptionKeyID  = []byte("keyID")
+)
+
+type datastoreEncryptionKeys struct {
+	current  *datastoreEncryption
+	previous []*datastoreEncryption
+}
+
+type datastoreEncryption struct {
+	keyID         string
+	keySecretKey  [32]byte
+	keyNonceKey   []byte
+	valueKeyBasis []byte
+}
+
+// getDataStoreEncryptionKeys returns the configured datastore encryption
+// keys, or nil when encryption is not configured.
+func (config *Config) getDataStoreEncryptionKeys() (*datastoreEncryptionKeys, error) {
+
+	currentKey := config.DataStoreEncryptionKey
+	previousKeys := config.DataStoreEncryptionPreviousKeys
+
+	if config.DataStoreEncryptionKeyProvider != nil {
+		var err error
+		currentKey, previousKeys, err =
+			config.DataStoreEncryptionKeyProvider.GetDataStoreEncryptionKeys()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if currentKey == "" && len(previousKeys) == 0 {
+		return nil, nil
+	}
+
+	keys, err := decodeDataStoreEncryptionKeys(currentKey, previousKeys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return keys, nil
+}
+
+func decodeDataStoreEncryptionKeys(
+	currentKey string, previousKeys []string) (*datastoreEncryptionKeys, error) {
+
+	keys := &datastoreEncryptionKeys{}
+
+	if currentKey != "" {
+		encryption, err := newDatastoreEncryption(currentKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		keys.current = encryption
+	}
+
+	for _, previousKey := range previousKeys {
+		encryption, err := newDatastoreEncryption(previousKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		keys.previous = append(keys.previous, encryption)
+	}
+
+	return keys, nil
+}
+
+func newDatastoreEncryption(encodedKey string) (*datastoreEncryption, error) {
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(key) != DATASTORE_ENCRYPTION_KEY_SIZE {
+		return nil, errors.TraceNew("invalid datastore encryption key size")
+	}
+
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+
+	encryption := &datastoreEncryption{
+		keyID:         hex.EncodeToString(derive("datastore-key-id")[:datastoreEncryptionKeyIDSize]),
+		keyNonceKey:   derive("datastore-key-nonce"),
+		valueKeyBasis: derive("datastore-value"),
+	}
+	copy(encryption.keySecretKey[:], derive("datastore-key"))
+
+	return encryption, nil
+}
+
+// The following methods may be called with a nil datastoreEncryption, in
+// which case keys and values are passed through unmodified.
+
+func (e *datastoreEncryption) encryptKey(key []byte) []byte {
+	if e == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, e.keyNonceKey)
+	mac.Write(key)
+	var nonce [24]byte
+	copy(nonce[:], mac.Sum(nil))
+	return secretbox.Seal(nonce[:], key, &nonce, &e.keySecretKey)
+}
+
+func (e *datastoreEncryption) decryptKey(key []byte) ([]byte, error) {
+	if e == nil {
+		return key, nil
+	}
+	if len(key) < 24 {
+		return nil, errors.TraceNew("invalid encrypted key")
+	}
+	var nonce [24]byte
+	copy(nonce[:], key[:24])
+	plaintextKey, ok := secretbox.Open(nil, key[24:], &nonce, &e.keySecretKey)
+	if !ok {
+		return nil, errors.TraceNew("key decryption failed")
+	}
+	return plaintextKey, nil
+}
+
+func (e *datastoreEncryption) getValueKey(key []byte) *[32]byte {
+	mac := hmac.New(sha256.New, e.valueKeyBasis)
+	mac.Write(key)
+	var valueKey [32]byte
+	copy(valueKey[:], mac.Sum(nil))
+	return &valueKey
+}
+
+func (e *datastoreEncryption) encryptValue(key, value []byte) []byte {
+	if e == nil {
+		return value
+	}
+	var nonce [24]byte
+	copy(nonce[:], prng.Bytes(24))
+	return secretbox.Seal(nonce[:], value, &nonce, e.getValueKey(key))
+}
+
+func (e *datastoreEncryption) decryptValue(key, value []byte) ([]byte, error) {
+	if e == nil || value == nil {
+		return value, nil
+	}
+	if len(value) < 24+secretbox.Overhead {
+		return nil, errors.TraceNew("invalid encrypted value")
+	}
+	var nonce [24]byte
+	copy(nonce[:], value[:24])
+	plaintextValue, ok := secretbox.Open(
+		make([]byte, 0, len(value)-24-secretbox.Overhead),
+		value[24:],
+		&nonce,
+		e.getValueKey(key))
+	if !ok {
+		return nil, errors.TraceNew("value decryption failed")
+	}
+	return plaintextValue, nil
+}
+
+// decryptCursorKey decrypts a key returned by a cursor. Records that fail
+// to decrypt are skipped, using nextKey, and a diagnostic is logged; the
+// original datastore interface does not return errors from cursors.
+func (e *datastoreEncryption) decryptCursorKey(
+	key []byte, nextKey func() []byte) []byte {
+
+	for ; key != nil; key = nextKey() {
+		plaintextKey, err := e.decryptKey(key)
+		if err == nil {
+			return plaintextKey
+		}
+		NoticeWarning("cursor decrypt failed: %s", errors.Trace(err))
+	}
+	return nil
+}
+
+// decryptCursorRecord decrypts a key and value returned by a cursor.
+// Records that fail to decrypt are skipped, using next.
+func (e *datastoreEncryption) decryptCursorRecord(
+	key, value []byte, next func() ([]byte, []byte)) ([]byte, []byte) {
+
+	for ; key != nil; key, value = next() {
+		plaintextKey, err := e.decryptKey(key)
+		if err == nil {
+			var plaintextValue []byte
+			plaintextValue, err = e.decryptValue(plaintextKey, value)
+			if err == nil {
+				return plaintextKey, plaintextValue
+			}
+		}
+		NoticeWarning("cursor decrypt failed: %s", errors.Trace(err))
+	}
+	return nil, nil
+}
+
+// initDatastoreEncryption checks the encryption state of a newly opened
+// datastore, migrates the datastore to the current key as required, and
+// returns the datastoreEncryption to use for all subsequent operations.
+//
+// db must not yet be configured with a datastoreEncryption, so that its
+// transactions access raw, stored keys and values.
+func initDatastoreEncryption(
+	db datastoreDB, keys *datastoreEncryptionKeys) (*datastoreEncryption, error) {
+
+	var current *datastoreEncryption
+	if keys != nil {
+		current = keys.current
+	}
+
+	err := db.update(func(tx datastoreTx) error {
+
+		var from *datastoreEncryption
+
+		storedKeyID := tx.bucket(datastoreEncryptionBucket).get(datastoreEncryptionKeyID)
+		if storedKeyID != nil {
+
+			if current != nil && string(storedKeyID) == current.keyID {
+				return nil
+			}
+
+			if keys != nil {
+				for _, previous := range keys.previous {
+					if string(storedKeyID) == previous.keyID {
+						from = previous
+						break
+					}
+				}
+			}
+
+			if from == nil {
+				return errors.TraceNew("unknown datastore encryption key")
+			}
+
+		} else if current == nil {
+
+			// Plaintext datastore and encryption is not configured.
+			return nil
+		}
+
+		NoticeInfo("migrating datastore encryption")
+
+		for _, name := range datastoreBuckets {
+
+			type record struct {
+				key   []byte
+				value []byte
+			}
+			var records []record
+
+			bucket := tx.bucket(name)
+			cursor := bucket.cursor()
+			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+
+				plaintextKey, err := from.decryptKey(key)
+				if err != nil {
+					cursor.close()
+					return errors.Trace(err)
+				}
+				plaintextValue, err := from.decryptValue(plaintextKey, value)
+				if err != nil {
+					cursor.close()
+					return errors.Trace(err)
+				}
+
+				records = append(records, record{
+					key:   append([]byte(nil), plaintextKey...),
+					value: append([]byte(nil), plaintextValue...),
+				})
+			}
+			cursor.close()
+
+			err := tx.clearBucket(name)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			bucket = tx.bucket(name)
+			for _, r := range records {
+				err := bucket.put(
+					current.encryptKey(r.key),
+					current.encryptValue(r.key, r.value))
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+
+		var err error
+		encryptionBucket := tx.bucket(datastoreEncryptionBucket)
+		if current != nil {
+			err = encryptionBucket.put(datastoreEncryptionKeyID, []byte(current.keyID))
+		} else {
+			err = encryptionBucket.delete(datastoreEncryptionKeyID)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return current, nil
+}
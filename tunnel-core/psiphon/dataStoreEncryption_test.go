@@ -0,0 +1,282 @@
+//go:build !PSIPHON_USE_BADGER_DB && !PSIPHON_USE_FILES_DB
+// +build !PSIPHON_USE_BADGER_DB,!PSIPHON_USE_FILES_DB
+
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+)
+
+func TestDataStoreEncryption(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-encryption-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`
+
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	clientConfig.DataRootDirectory = testDataDirName
+
+	err = clientConfig.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	newKey := func() string {
+		return base64.StdEncoding.EncodeToString(
+			prng.Bytes(DATASTORE_ENCRYPTION_KEY_SIZE))
+	}
+
+	testKey := "test-key-" + prng.HexString(8)
+	testValue := "test-value-" + prng.HexString(8)
+
+	datastoreFilename := filepath.Join(
+		clientConfig.GetDataStoreDirectory(), "psiphon.boltdb")
+
+	openDataStore := func(currentKey string, previousKeys []string, reset bool) {
+		clientConfig.DataStoreEncryptionKey = currentKey
+		clientConfig.DataStoreEncryptionPreviousKeys = previousKeys
+		if reset {
+			err = OpenDataStore(clientConfig)
+		} else {
+			err = OpenDataStoreWithoutRetry(clientConfig)
+		}
+		if err != nil {
+			t.Fatalf("OpenDataStore failed: %s", err)
+		}
+	}
+
+	checkValue := func(expectedValue string) {
+		value, err := GetKeyValue(clientConfig, testKey)
+		if err != nil {
+			t.Fatalf("GetKeyValue failed: %s", err)
+		}
+		if value != expectedValue {
+			t.Fatalf("unexpected value: %s", value)
+		}
+	}
+
+	checkRawFile := func(expectPlaintext bool) {
+		err := CompactDataStore(clientConfig)
+		if err != nil {
+			t.Fatalf("CompactDataStore failed: %s", err)
+		}
+		data, err := ioutil.ReadFile(datastoreFilename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if bytes.Contains(data, []byte(testKey)) != expectPlaintext ||
+			bytes.Contains(data, []byte(testValue)) != expectPlaintext {
+			t.Fatalf("unexpected datastore file plaintext")
+		}
+	}
+
+	// Populate a plaintext datastore.
+
+	openDataStore("", nil, false)
+	err = SetKeyValue(clientConfig, testKey, testValue)
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	CloseDataStore(clientConfig)
+	checkRawFile(true)
+
+	// Migrate the plaintext datastore to an encryption key.
+
+	key1 := newKey()
+	openDataStore(key1, nil, false)
+	checkValue(testValue)
+	CloseDataStore(clientConfig)
+	checkRawFile(false)
+
+	// Rotate to a new key.
+
+	key2 := newKey()
+	openDataStore(key2, []string{key1}, false)
+	checkValue(testValue)
+	CloseDataStore(clientConfig)
+
+	// The previous key alone can no longer open the datastore.
+
+	clientConfig.DataStoreEncryptionKey = key1
+	clientConfig.DataStoreEncryptionPreviousKeys = nil
+	err = OpenDataStoreWithoutRetry(clientConfig)
+	if err == nil {
+		CloseDataStore(clientConfig)
+		t.Fatalf("OpenDataStoreWithoutRetry unexpectedly succeeded")
+	}
+
+	// Decrypt back to plaintext.
+
+	openDataStore("", []string{key2}, false)
+	checkValue(testValue)
+	CloseDataStore(clientConfig)
+	checkRawFile(true)
+
+	// Encrypt with a new key, then open with an unknown key, which resets
+	// the datastore.
+
+	key3 := newKey()
+	openDataStore(key3, nil, false)
+	checkValue(testValue)
+	CloseDataStore(clientConfig)
+
+	openDataStore(newKey(), nil, true)
+	checkValue("")
+	err = SetKeyValue(clientConfig, testKey, testValue)
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	checkValue(testValue)
+	CloseDataStore(clientConfig)
+
+	// Invalid keys are rejected by Commit.
+
+	clientConfig.DataStoreEncryptionKey = "invalid"
+	clientConfig.DataStoreEncryptionPreviousKeys = nil
+	err = clientConfig.Commit(false)
+	if err == nil {
+		t.Fatalf("Commit unexpectedly succeeded")
+	}
+}
+
+func TestDataStoreEncryptionDeleteServerEntry(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-encryption-delete-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`
+
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	clientConfig.DataRootDirectory = testDataDirName
+	clientConfig.DataStoreEncryptionKey = base64.StdEncoding.EncodeToString(
+		prng.Bytes(DATASTORE_ENCRYPTION_KEY_SIZE))
+
+	err = clientConfig.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore(clientConfig)
+
+	// With encryption, dial parameters keys for the same server are not
+	// adjacent in cursor order. Store dial parameters for two network IDs
+	// for each of several servers, interleaved with other servers' records,
+	// so that the deleted records are very unlikely to all be adjacent.
+
+	serverIPAddresses := []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}
+	networkIDs := []string{"WIFI-1", "MOBILE-2"}
+	otherServerIPAddress := "10.0.0.1"
+
+	for _, serverIPAddress := range serverIPAddresses {
+		for _, networkID := range networkIDs {
+			err = SetDialParameters(clientConfig, serverIPAddress, networkID, &DialParameters{})
+			if err != nil {
+				t.Fatalf("SetDialParameters failed: %s", err)
+			}
+		}
+	}
+	for i := 0; i < 20; i++ {
+		err = SetDialParameters(
+			clientConfig,
+			otherServerIPAddress, fmt.Sprintf("WIFI-%d", i), &DialParameters{})
+		if err != nil {
+			t.Fatalf("SetDialParameters failed: %s", err)
+		}
+	}
+
+	hasDialParameters := func(serverIPAddress, networkID string) bool {
+		found := false
+		err := getBucketValue(
+			clientConfig,
+			datastoreDialParametersBucket,
+			makeDialParametersKey([]byte(serverIPAddress), []byte(networkID)),
+			func(value []byte) error {
+				found = value != nil
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("getBucketValue failed: %s", err)
+		}
+		return found
+	}
+
+	for _, serverIPAddress := range serverIPAddresses {
+		err = deleteServerEntry(clientConfig, []byte(serverIPAddress))
+		if err != nil {
+			t.Fatalf("deleteServerEntry failed: %s", err)
+		}
+	}
+
+	for _, serverIPAddress := range serverIPAddresses {
+		for _, networkID := range networkIDs {
+			if hasDialParameters(serverIPAddress, networkID) {
+				t.Fatalf(
+					"dial parameters not deleted: %s %s", serverIPAddress, networkID)
+			}
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		if !hasDialParameters(otherServerIPAddress, fmt.Sprintf("WIFI-%d", i)) {
+			t.Fatalf("unexpected dial parameters deleted")
+		}
+	}
+}
@@ -0,0 +1,349 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+)
+
+// The functions in this file support offline inspection and maintenance of
+// the datastore, for debugging and support purposes. They are not used in
+// the normal operation of the client.
+
+// ExportServerEntries writes stored server entries to writer as an encoded
+// server entry list, one encoded server entry per line, which may be
+// imported with ImportServerEntries. Only server entries for which
+// filter returns true are exported; when filter is nil, all server entries
+// are exported. The return value is the number of server entries exported.
+//
+// Server entries are exported with all stored fields, including any
+// signature, so exported, signed server entries remain verifiable.
+func ExportServerEntries(
+	config *Config,
+	writer io.Writer, filter func(*protocol.ServerEntry) bool) (int, error) {
+
+	count := 0
+
+	err := scanDatastoreBucket(
+		config,
+		datastoreServerEntriesBucket,
+		func(_, value []byte) error {
+
+			if filter != nil {
+				var serverEntry *protocol.ServerEntry
+				err := json.Unmarshal(value, &serverEntry)
+				if err != nil {
+					NoticeWarning("ExportServerEntries: %s", errors.Trace(err))
+					return nil
+				}
+				if !filter(serverEntry) {
+					return nil
+				}
+			}
+
+			var serverEntryFields protocol.ServerEntryFields
+			err := json.Unmarshal(value, &serverEntryFields)
+			if err != nil {
+				NoticeWarning("ExportServerEntries: %s", errors.Trace(err))
+				return nil
+			}
+
+			encodedServerEntry, err := protocol.EncodeServerEntryFields(serverEntryFields)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = io.WriteString(writer, encodedServerEntry+"\n")
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			count += 1
+			return nil
+		})
+	if err != nil {
+		return count, errors.Trace(err)
+	}
+
+	return count, nil
+}
+
+// ImportServerEntries reads an encoded server entry list, as written by
+// ExportServerEntries, from reader and stores the server entries. The return
+// value is the number of server entries read, including any existing server
+// entries that weren't replaced.
+//
+// Unlike ImportEmbeddedServerEntries, which marks every server entry as
+// embedded, each server entry retains its exported local source and
+// timestamp, so that source-specific handling, such as common remote server
+// list pruning, continues to apply after a round trip. Server entries without
+// a local source, such as entries from an embedded server entry list, are
+// marked as embedded.
+//
+// When replaceIfExists is true, existing server entries are replaced.
+// Otherwise, as with other imports, an existing server entry is replaced only
+// by a server entry with a newer configuration version.
+func ImportServerEntries(
+	ctx context.Context,
+	config *Config,
+	reader io.Reader,
+	replaceIfExists bool) (int, error) {
+
+	// With a blank timestamp and source, the decoder retains the exported
+	// local timestamp and source fields.
+	decoder := protocol.NewStreamingServerEntryDecoder(reader, "", "")
+
+	timestamp := common.TruncateTimestampToHour(common.GetCurrentTimestamp())
+
+	count := 0
+	for {
+
+		select {
+		case <-ctx.Done():
+			return count, errors.Trace(ctx.Err())
+		default:
+		}
+
+		serverEntryFields, err := decoder.Next()
+		if err != nil {
+			return count, errors.Trace(err)
+		}
+		if serverEntryFields == nil {
+			return count, nil
+		}
+
+		if serverEntryFields.GetLocalSource() == "" {
+			serverEntryFields.SetLocalSource(protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+			serverEntryFields.SetLocalTimestamp(timestamp)
+		}
+
+		err = StoreServerEntry(config, serverEntryFields, replaceIfExists)
+		if err != nil {
+			return count, errors.Trace(err)
+		}
+
+		count += 1
+	}
+}
+
+// ScanDialParameters iterates over all stored dial parameters records and
+// passes each, as JSON, to callback along with the record's server IP
+// address and network ID. If callback returns false, the iteration is
+// stopped.
+//
+// Dial parameters records are keyed by the concatenation of the server IP
+// address and network ID. The key is split using the longest matching IP
+// address of the stored server entries; for a record with no corresponding
+// server entry, serverIPAddress is "" and networkID is the entire key. The
+// split is ambiguous when a network ID begins with a digit, which is not the
+// case for typical network IDs such as "WIFI-<BSSID>".
+func ScanDialParameters(
+	config *Config,
+	callback func(serverIPAddress, networkID string, record []byte) bool) error {
+
+	err := datastoreView(config, func(tx datastoreTx) error {
+
+		var serverIPAddresses [][]byte
+
+		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+		cursor := serverEntries.cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			serverIPAddresses = append(serverIPAddresses, append([]byte(nil), key...))
+		}
+		cursor.close()
+
+		dialParameters := tx.bucket(datastoreDialParametersBucket)
+		cursor = dialParameters.cursor()
+		defer cursor.close()
+
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+
+			var serverIPAddress []byte
+			for _, IPAddress := range serverIPAddresses {
+				if len(IPAddress) > len(serverIPAddress) && bytes.HasPrefix(key, IPAddress) {
+					serverIPAddress = IPAddress
+				}
+			}
+
+			if !callback(
+				string(serverIPAddress),
+				string(key[len(serverIPAddress):]),
+				append([]byte(nil), value...)) {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// ScanTacticsRecords iterates over all stored tactics records and passes
+// each, along with its network ID, to callback. If callback returns false,
+// the iteration is stopped.
+func ScanTacticsRecords(
+	config *Config, callback func(networkID string, record []byte) bool) error {
+
+	return scanDatastoreBucketRecords(config, datastoreTacticsBucket, callback)
+}
+
+// ScanKeyValues iterates over all stored key/value records, passing each to
+// callback. If callback returns false, the iteration is stopped. Some
+// values, such as the affinity server entry ID, are binary.
+func ScanKeyValues(
+	config *Config, callback func(key string, value []byte) bool) error {
+
+	return scanDatastoreBucketRecords(config, datastoreKeyValueBucket, callback)
+}
+
+// ScanPersistentStats iterates over all stored persistent stats and passes
+// each, along with its stat type and whether the stat is currently being
+// reported, to callback. If callback returns false, the iteration is
+// stopped.
+func ScanPersistentStats(
+	config *Config,
+	callback func(statType string, stat []byte, reporting bool) bool) error {
+
+	for _, statType := range persistentStatTypes {
+		stop := false
+		err := scanDatastoreBucketRecords(
+			config,
+			[]byte(statType),
+			func(stat string, state []byte) bool {
+				if !callback(
+					statType,
+					[]byte(stat),
+					bytes.Equal(state, persistentStatStateReporting)) {
+					stop = true
+					return false
+				}
+				return true
+			})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if stop {
+			break
+		}
+	}
+
+	return nil
+}
+
+// BackupDataStore writes a consistent copy of the open datastore to the
+// specified file. The backup may be restored by replacing the datastore
+// file while the datastore is closed.
+func BackupDataStore(config *Config, filename string) error {
+
+	store := config.getDataStore()
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if store.db == nil {
+		return errors.TraceNew("datastore not open")
+	}
+
+	err := store.db.backup(filename)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// CompactDataStore rewrites the on-disk datastore to reclaim unused space.
+// The on-disk datastore must not be open in this process, and should not be
+// open in any other process.
+func CompactDataStore(config *Config) error {
+
+	diskDataStore.referenceCountMutex.Lock()
+	defer diskDataStore.referenceCountMutex.Unlock()
+
+	diskDataStore.mutex.Lock()
+	defer diskDataStore.mutex.Unlock()
+
+	if diskDataStore.db != nil {
+		return errors.TraceNew("datastore is open")
+	}
+
+	err := datastoreCompactDB(config.GetDataStoreDirectory())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func scanDatastoreBucketRecords(
+	config *Config,
+	bucket []byte, callback func(key string, value []byte) bool) error {
+
+	errStop := errors.TraceNew("stop")
+
+	err := scanDatastoreBucket(config, bucket, func(key, value []byte) error {
+		if !callback(string(key), append([]byte(nil), value...)) {
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// scanDatastoreBucket invokes callback for each record in the specified
+// bucket. The key and value slices are only valid for the duration of the
+// callback. An error returned by callback stops the scan and is returned.
+func scanDatastoreBucket(
+	config *Config, bucket []byte, callback func(key, value []byte) error) error {
+
+	var callbackErr error
+
+	err := datastoreView(config, func(tx datastoreTx) error {
+		cursor := tx.bucket(bucket).cursor()
+		defer cursor.close()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			callbackErr = callback(key, value)
+			if callbackErr != nil {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return callbackErr
+}
@@ -0,0 +1,300 @@
+//go:build !PSIPHON_USE_BADGER_DB && !PSIPHON_USE_FILES_DB
+// +build !PSIPHON_USE_BADGER_DB,!PSIPHON_USE_FILES_DB
+
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+)
+
+func TestDataStoreInspect(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-inspect-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`
+
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	clientConfig.DataRootDirectory = testDataDirName
+
+	err = clientConfig.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	serverEntryCount := 20
+
+	sources := []string{
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED,
+		protocol.SERVER_ENTRY_SOURCE_REMOTE,
+		protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+	}
+
+	expectedSources := make(map[string]string)
+
+	for i := 0; i < serverEntryCount; i++ {
+
+		region := "US"
+		if i%2 == 0 {
+			region = "CA"
+		}
+
+		n := 16
+		fields := make(protocol.ServerEntryFields)
+		fields["ipAddress"] = fmt.Sprintf("127.0.0.%d", i+1)
+		fields["sshPort"] = 2222
+		fields["sshUsername"] = prng.HexString(n)
+		fields["sshPassword"] = prng.HexString(n)
+		fields["sshHostKey"] = prng.HexString(n)
+		fields["capabilities"] = []string{"SSH", "ssh-api-requests"}
+		fields["region"] = region
+		fields["configurationVersion"] = 1
+
+		source := sources[i%len(sources)]
+		if region == "CA" {
+			expectedSources[fields.GetIPAddress()] = source
+		}
+
+		fields.SetLocalSource(source)
+		fields.SetLocalTimestamp(
+			common.TruncateTimestampToHour(common.GetCurrentTimestamp()))
+
+		err = StoreServerEntry(clientConfig, fields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	// Dial parameters keys are split into server IP address and network ID,
+	// including when the server IP address is a prefix of another.
+
+	err = SetDialParameters(clientConfig, "127.0.0.1", "WIFI-1", &DialParameters{})
+	if err != nil {
+		t.Fatalf("SetDialParameters failed: %s", err)
+	}
+
+	dialParametersCount := 0
+	err = ScanDialParameters(clientConfig, func(serverIPAddress, networkID string, _ []byte) bool {
+		if serverIPAddress != "127.0.0.1" || networkID != "WIFI-1" {
+			t.Fatalf("unexpected dial parameters key: %s, %s", serverIPAddress, networkID)
+		}
+		dialParametersCount += 1
+		return true
+	})
+	if err != nil || dialParametersCount != 1 {
+		t.Fatalf("ScanDialParameters failed: %d, %v", dialParametersCount, err)
+	}
+
+	var exported bytes.Buffer
+	count, err := ExportServerEntries(
+		clientConfig,
+		&exported,
+		func(serverEntry *protocol.ServerEntry) bool {
+			return serverEntry.Region == "CA"
+		})
+	if err != nil || count != serverEntryCount/2 {
+		t.Fatalf("ExportServerEntries failed: %d, %v", count, err)
+	}
+
+	backupFilename := filepath.Join(testDataDirName, "backup.boltdb")
+	err = BackupDataStore(clientConfig, backupFilename)
+	if err != nil {
+		t.Fatalf("BackupDataStore failed: %s", err)
+	}
+
+	err = CompactDataStore(clientConfig)
+	if err == nil {
+		t.Fatalf("CompactDataStore unexpectedly succeeded while open")
+	}
+
+	CloseDataStore(clientConfig)
+
+	err = CompactDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("CompactDataStore failed: %s", err)
+	}
+
+	// Restore the backup into a fresh data directory and import the
+	// exported server entries into a clean datastore.
+
+	for _, restore := range []bool{true, false} {
+
+		restoreDataDirName := filepath.Join(testDataDirName, fmt.Sprintf("restore-%v", restore))
+		err := os.Mkdir(restoreDataDirName, 0700)
+		if err != nil {
+			t.Fatalf("Mkdir failed: %s", err)
+		}
+
+		restoreConfig, err := LoadConfig([]byte(clientConfigJSON))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		restoreConfig.DataRootDirectory = restoreDataDirName
+		err = restoreConfig.Commit(false)
+		if err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+
+		expectedCount := serverEntryCount / 2
+
+		if restore {
+			backup, err := ioutil.ReadFile(backupFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+			err = ioutil.WriteFile(
+				filepath.Join(restoreConfig.GetDataStoreDirectory(), "psiphon.boltdb"), backup, 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+			expectedCount = serverEntryCount
+		}
+
+		err = OpenDataStore(restoreConfig)
+		if err != nil {
+			t.Fatalf("OpenDataStore failed: %s", err)
+		}
+
+		if !restore {
+			testImportServerEntries(
+				t, restoreConfig, exported.String(), expectedCount, expectedSources)
+		}
+
+		count := CountServerEntries(restoreConfig)
+
+		CloseDataStore(restoreConfig)
+
+		if count != expectedCount {
+			t.Fatalf("unexpected server entry count: %d", count)
+		}
+	}
+}
+
+// testImportServerEntries imports an exported server entry list into an
+// empty datastore, and checks that each server entry retains its source and
+// that existing server entries are replaced only when specified.
+func testImportServerEntries(
+	t *testing.T,
+	config *Config,
+	exported string,
+	expectedCount int,
+	expectedSources map[string]string) {
+
+	importServerEntries := func(replaceIfExists bool) {
+		count, err := ImportServerEntries(
+			context.Background(), config, strings.NewReader(exported), replaceIfExists)
+		if err != nil {
+			t.Fatalf("ImportServerEntries failed: %s", err)
+		}
+		if count != expectedCount {
+			t.Fatalf("unexpected import count: %d", count)
+		}
+	}
+
+	getServerEntries := func() map[string]*protocol.ServerEntry {
+		serverEntries := make(map[string]*protocol.ServerEntry)
+		err := ScanServerEntries(config, func(serverEntry *protocol.ServerEntry) bool {
+			serverEntries[serverEntry.IpAddress] = serverEntry
+			return true
+		})
+		if err != nil {
+			t.Fatalf("ScanServerEntries failed: %s", err)
+		}
+		return serverEntries
+	}
+
+	importServerEntries(false)
+
+	serverEntries := getServerEntries()
+	if len(serverEntries) != len(expectedSources) {
+		t.Fatalf("unexpected server entry count: %d", len(serverEntries))
+	}
+	for IPAddress, source := range expectedSources {
+		serverEntry, ok := serverEntries[IPAddress]
+		if !ok || serverEntry.LocalSource != source || serverEntry.LocalTimestamp == "" {
+			t.Fatalf("unexpected server entry for %s: %+v", IPAddress, serverEntry)
+		}
+	}
+
+	// Modify a stored server entry, with the same configuration version.
+	// Importing without replace retains the modified server entry, and
+	// importing with replace restores the exported server entry.
+
+	encodedServerEntry := strings.Split(strings.TrimSpace(exported), "\n")[0]
+	serverEntryFields, err := protocol.DecodeServerEntryFields(encodedServerEntry, "", "")
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	IPAddress := serverEntryFields.GetIPAddress()
+
+	serverEntryFields["region"] = "XX"
+	serverEntryFields.SetLocalSource(protocol.SERVER_ENTRY_SOURCE_TARGET)
+	err = StoreServerEntry(config, serverEntryFields, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	importServerEntries(false)
+
+	serverEntry := getServerEntries()[IPAddress]
+	if serverEntry.Region != "XX" ||
+		serverEntry.LocalSource != protocol.SERVER_ENTRY_SOURCE_TARGET {
+		t.Fatalf("unexpected replaced server entry: %+v", serverEntry)
+	}
+
+	importServerEntries(true)
+
+	serverEntry = getServerEntries()[IPAddress]
+	if serverEntry.Region != "CA" ||
+		serverEntry.LocalSource != expectedSources[IPAddress] {
+		t.Fatalf("unexpected server entry: %+v", serverEntry)
+	}
+}
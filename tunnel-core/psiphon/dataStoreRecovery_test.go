@@ -168,7 +168,7 @@ func TestBoltResiliency(t *testing.T) {
 			fields.SetLocalTimestamp(
 				common.TruncateTimestampToHour(common.GetCurrentTimestamp()))
 
-			err = StoreServerEntry(fields, true)
+			err = StoreServerEntry(clientConfig, fields, true)
 			if err != nil {
 				t.Fatalf("StoreServerEntry failed: %s", err)
 			}
@@ -229,7 +229,7 @@ func TestBoltResiliency(t *testing.T) {
 
 	stopController()
 
-	CloseDataStore()
+	CloseDataStore(clientConfig)
 
 	drainNoticeChannels()
 
@@ -248,7 +248,7 @@ func TestBoltResiliency(t *testing.T) {
 	<-noticeResetDatastore
 
 	if !canTruncateOpenDataStore {
-		CloseDataStore()
+		CloseDataStore(clientConfig)
 		return
 	}
 
@@ -272,7 +272,7 @@ func TestBoltResiliency(t *testing.T) {
 
 	stopController()
 
-	CloseDataStore()
+	CloseDataStore(clientConfig)
 
 	drainNoticeChannels()
 
@@ -295,5 +295,5 @@ func TestBoltResiliency(t *testing.T) {
 
 	stopController()
 
-	CloseDataStore()
+	CloseDataStore(clientConfig)
 }
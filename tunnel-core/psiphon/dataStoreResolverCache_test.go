@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/parameters"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/resolver"
+)
+
+func TestStoreVerifiedDNSCacheEntries(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-resolver-cache-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`
+
+	config, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataRootDirectory = testDataDirName
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	maxStoreNetworks := 3
+
+	err = config.SetParameters("", false, map[string]interface{}{
+		parameters.DNSResolverCacheMaxStoreNetworks: maxStoreNetworks,
+	})
+	if err != nil {
+		t.Fatalf("SetParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore(config)
+
+	now := time.Now()
+
+	store := func(networkID string, expiry time.Time) {
+		err := storeVerifiedDNSCacheEntries(
+			config,
+			networkID,
+			[]*resolver.VerifiedCacheEntry{
+				{
+					Hostname: "example.com",
+					IPs:      []net.IP{net.ParseIP("192.0.2.1")},
+					Expiry:   expiry,
+				},
+			})
+		if err != nil {
+			t.Fatalf("storeVerifiedDNSCacheEntries failed: %s", err)
+		}
+	}
+
+	isStored := func(networkID string) bool {
+		entries, err := loadVerifiedDNSCacheEntries(config, networkID)
+		if err != nil {
+			t.Fatalf("loadVerifiedDNSCacheEntries failed: %s", err)
+		}
+		return len(entries) > 0
+	}
+
+	// Records for other network IDs are pruned once expired.
+
+	store("EXPIRED", now.Add(-time.Minute))
+	store("NETWORK-0", now.Add(time.Hour))
+
+	if isStored("EXPIRED") || !isStored("NETWORK-0") {
+		t.Fatalf("unexpected expired record state")
+	}
+
+	// Only up to the maximum number of network IDs are retained, and the
+	// earliest expiring records are deleted first.
+
+	for i := 1; i <= maxStoreNetworks; i++ {
+		store(fmt.Sprintf("NETWORK-%d", i), now.Add(time.Duration(i+1)*time.Hour))
+	}
+
+	if isStored("NETWORK-0") {
+		t.Fatalf("unexpected retained record")
+	}
+
+	for i := 1; i <= maxStoreNetworks; i++ {
+		if !isStored(fmt.Sprintf("NETWORK-%d", i)) {
+			t.Fatalf("missing record %d", i)
+		}
+	}
+
+	// The current network ID record is retained even when it expires first.
+
+	store("NETWORK-LATEST", now.Add(time.Minute))
+
+	if !isStored("NETWORK-LATEST") || isStored("NETWORK-1") {
+		t.Fatalf("unexpected current record state")
+	}
+}
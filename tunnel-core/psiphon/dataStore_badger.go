@@ -35,26 +35,31 @@ const (
 	DATA_STORE_DIRECTORY = "psiphon.badgerdb"
 )
 
-type datastoreDB struct {
-	badgerDB *badger.DB
+type badgerDatastoreDB struct {
+	badgerDB   *badger.DB
+	encryption *datastoreEncryption
 }
 
-type datastoreTx struct {
+type badgerDatastoreTx struct {
+	db       *badgerDatastoreDB
 	badgerTx *badger.Txn
 }
 
-type datastoreBucket struct {
+type badgerDatastoreBucket struct {
 	name []byte
-	tx   *datastoreTx
+	tx   *badgerDatastoreTx
 }
 
-type datastoreCursor struct {
+type badgerDatastoreCursor struct {
 	badgerIterator *badger.Iterator
 	prefix         []byte
+	encryption     *datastoreEncryption
 }
 
 func datastoreOpenDB(
-	rootDataDirectory string, _ bool) (*datastoreDB, error) {
+	rootDataDirectory string,
+	_ bool,
+	encryptionKeys *datastoreEncryptionKeys) (datastoreDB, error) {
 
 	dbDirectory := filepath.Join(rootDataDirectory, "psiphon.badgerdb")
 
@@ -88,22 +93,39 @@ func datastoreOpenDB(
 		}
 	}
 
-	return &datastoreDB{badgerDB: db}, nil
+	newDB := &badgerDatastoreDB{badgerDB: db}
+
+	encryption, err := initDatastoreEncryption(newDB, encryptionKeys)
+	if err != nil {
+		db.Close()
+		return nil, errors.Trace(err)
+	}
+	newDB.encryption = encryption
+
+	return newDB, nil
 }
 
-func (db *datastoreDB) close() error {
+func (db *badgerDatastoreDB) close() error {
 	return db.badgerDB.Close()
 }
 
-func (db *datastoreDB) getDataStoreMetrics() string {
+func (db *badgerDatastoreDB) getDataStoreMetrics() string {
 	// TODO: report metrics
 	return ""
 }
 
-func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
+func (db *badgerDatastoreDB) backup(_ string) error {
+	return errors.TraceNew("not supported")
+}
+
+func datastoreCompactDB(_ string) error {
+	return errors.TraceNew("not supported")
+}
+
+func (db *badgerDatastoreDB) view(fn func(tx datastoreTx) error) error {
 	return db.badgerDB.View(
 		func(tx *badger.Txn) error {
-			err := fn(&datastoreTx{badgerTx: tx})
+			err := fn(&badgerDatastoreTx{db: db, badgerTx: tx})
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -111,10 +133,10 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 		})
 }
 
-func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
+func (db *badgerDatastoreDB) update(fn func(tx datastoreTx) error) error {
 	return db.badgerDB.Update(
 		func(tx *badger.Txn) error {
-			err := fn(&datastoreTx{badgerTx: tx})
+			err := fn(&badgerDatastoreTx{db: db, badgerTx: tx})
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -122,18 +144,19 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
 		})
 }
 
-func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
-	return &datastoreBucket{
+func (tx *badgerDatastoreTx) bucket(name []byte) datastoreBucket {
+	return &badgerDatastoreBucket{
 		name: name,
 		tx:   tx,
 	}
 }
 
-func (tx *datastoreTx) clearBucket(name []byte) error {
-	b := tx.bucket(name)
-	c := b.cursor()
-	for key := c.firstKey(); key != nil; key = c.nextKey() {
-		err := tx.badgerTx.Delete(key)
+func (tx *badgerDatastoreTx) clearBucket(name []byte) error {
+	b := &badgerDatastoreBucket{name: name, tx: tx}
+	c := b.badgerCursor()
+	defer c.close()
+	for key := c.seekKey(); key != nil; key = c.advanceKey() {
+		err := tx.badgerTx.Delete(append(append([]byte(nil), name...), key...))
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -141,8 +164,9 @@ func (tx *datastoreTx) clearBucket(name []byte) error {
 	return nil
 }
 
-func (b *datastoreBucket) get(key []byte) []byte {
-	keyWithPrefix := append(b.name, key...)
+func (b *badgerDatastoreBucket) get(key []byte) []byte {
+	encryption := b.tx.db.encryption
+	keyWithPrefix := append(b.name, encryption.encryptKey(key)...)
 	item, err := b.tx.badgerTx.Get(keyWithPrefix)
 	if err != nil {
 		if err != badger.ErrKeyNotFound {
@@ -159,20 +183,26 @@ func (b *datastoreBucket) get(key []byte) []byte {
 			string(keyWithPrefix), errors.Trace(err))
 		return nil
 	}
+	value, err = encryption.decryptValue(key, value)
+	if err != nil {
+		NoticeWarning("get failed: %s", errors.Trace(err))
+		return nil
+	}
 	return value
 }
 
-func (b *datastoreBucket) put(key, value []byte) error {
-	keyWithPrefix := append(b.name, key...)
-	err := b.tx.badgerTx.Set(keyWithPrefix, value)
+func (b *badgerDatastoreBucket) put(key, value []byte) error {
+	encryption := b.tx.db.encryption
+	keyWithPrefix := append(b.name, encryption.encryptKey(key)...)
+	err := b.tx.badgerTx.Set(keyWithPrefix, encryption.encryptValue(key, value))
 	if err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-func (b *datastoreBucket) delete(key []byte) error {
-	keyWithPrefix := append(b.name, key...)
+func (b *badgerDatastoreBucket) delete(key []byte) error {
+	keyWithPrefix := append(b.name, b.tx.db.encryption.encryptKey(key)...)
 	err := b.tx.badgerTx.Delete(keyWithPrefix)
 	if err != nil {
 		return errors.Trace(err)
@@ -180,19 +210,31 @@ func (b *datastoreBucket) delete(key []byte) error {
 	return nil
 }
 
-func (b *datastoreBucket) cursor() *datastoreCursor {
+func (b *badgerDatastoreBucket) cursor() datastoreCursor {
+	return b.badgerCursor()
+}
+
+func (b *badgerDatastoreBucket) badgerCursor() *badgerDatastoreCursor {
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchValues = false
 	iterator := b.tx.badgerTx.NewIterator(opts)
-	return &datastoreCursor{badgerIterator: iterator, prefix: b.name}
+	return &badgerDatastoreCursor{
+		badgerIterator: iterator,
+		prefix:         b.name,
+		encryption:     b.tx.db.encryption,
+	}
+}
+
+func (c *badgerDatastoreCursor) firstKey() []byte {
+	return c.encryption.decryptCursorKey(c.seekKey(), c.advanceKey)
 }
 
-func (c *datastoreCursor) firstKey() []byte {
+func (c *badgerDatastoreCursor) seekKey() []byte {
 	c.badgerIterator.Seek(c.prefix)
 	return c.currentKey()
 }
 
-func (c *datastoreCursor) currentKey() []byte {
+func (c *badgerDatastoreCursor) currentKey() []byte {
 	if !c.badgerIterator.ValidForPrefix(c.prefix) {
 		return nil
 	}
@@ -200,17 +242,22 @@ func (c *datastoreCursor) currentKey() []byte {
 	return item.Key()[len(c.prefix):]
 }
 
-func (c *datastoreCursor) nextKey() []byte {
+func (c *badgerDatastoreCursor) nextKey() []byte {
+	return c.encryption.decryptCursorKey(c.advanceKey(), c.advanceKey)
+}
+
+func (c *badgerDatastoreCursor) advanceKey() []byte {
 	c.badgerIterator.Next()
 	return c.currentKey()
 }
 
-func (c *datastoreCursor) first() ([]byte, []byte) {
+func (c *badgerDatastoreCursor) first() ([]byte, []byte) {
 	c.badgerIterator.Seek(c.prefix)
-	return c.current()
+	key, value := c.current()
+	return c.encryption.decryptCursorRecord(key, value, c.advanceRecord)
 }
 
-func (c *datastoreCursor) current() ([]byte, []byte) {
+func (c *badgerDatastoreCursor) current() ([]byte, []byte) {
 	if !c.badgerIterator.ValidForPrefix(c.prefix) {
 		return nil, nil
 	}
@@ -222,11 +269,16 @@ func (c *datastoreCursor) current() ([]byte, []byte) {
 	return item.Key()[len(c.prefix):], value
 }
 
-func (c *datastoreCursor) next() ([]byte, []byte) {
+func (c *badgerDatastoreCursor) next() ([]byte, []byte) {
+	key, value := c.advanceRecord()
+	return c.encryption.decryptCursorRecord(key, value, c.advanceRecord)
+}
+
+func (c *badgerDatastoreCursor) advanceRecord() ([]byte, []byte) {
 	c.badgerIterator.Next()
 	return c.current()
 }
 
-func (c *datastoreCursor) close() {
+func (c *badgerDatastoreCursor) close() {
 	c.badgerIterator.Close()
 }
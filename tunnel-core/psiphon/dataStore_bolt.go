@@ -40,31 +40,34 @@ const (
 	OPEN_DB_RETRIES = 2
 )
 
-type datastoreDB struct {
-	boltDB   *bolt.DB
-	filename string
-	isFailed int32
+type boltDatastoreDB struct {
+	boltDB     *bolt.DB
+	filename   string
+	isFailed   int32
+	encryption *datastoreEncryption
 }
 
-type datastoreTx struct {
-	db     *datastoreDB
+type boltDatastoreTx struct {
+	db     *boltDatastoreDB
 	boltTx *bolt.Tx
 }
 
-type datastoreBucket struct {
-	db         *datastoreDB
+type boltDatastoreBucket struct {
+	db         *boltDatastoreDB
 	boltBucket *bolt.Bucket
 }
 
-type datastoreCursor struct {
-	db         *datastoreDB
+type boltDatastoreCursor struct {
+	db         *boltDatastoreDB
 	boltCursor *bolt.Cursor
 }
 
 func datastoreOpenDB(
-	rootDataDirectory string, retryAndReset bool) (*datastoreDB, error) {
+	rootDataDirectory string,
+	retryAndReset bool,
+	encryptionKeys *datastoreEncryptionKeys) (datastoreDB, error) {
 
-	var db *datastoreDB
+	var db *boltDatastoreDB
 	var err error
 
 	attempts := 1
@@ -76,7 +79,7 @@ func datastoreOpenDB(
 
 	for attempt := 0; attempt < attempts; attempt++ {
 
-		db, err = tryDatastoreOpenDB(rootDataDirectory, reset)
+		db, err = tryDatastoreOpenDB(rootDataDirectory, reset, encryptionKeys)
 		if err == nil {
 			break
 		}
@@ -94,12 +97,17 @@ func datastoreOpenDB(
 
 		reset = !std_errors.Is(err, bolt.ErrTimeout)
 	}
+	if err != nil {
+		return nil, err
+	}
 
-	return db, err
+	return db, nil
 }
 
 func tryDatastoreOpenDB(
-	rootDataDirectory string, reset bool) (retdb *datastoreDB, reterr error) {
+	rootDataDirectory string,
+	reset bool,
+	encryptionKeys *datastoreEncryptionKeys) (retdb *boltDatastoreDB, reterr error) {
 
 	// Testing indicates that the bolt Check function can raise SIGSEGV due to
 	// invalid mmap buffer accesses in cases such as opening a valid but
@@ -157,19 +165,8 @@ func tryDatastoreOpenDB(
 	}
 
 	err = newDB.Update(func(tx *bolt.Tx) error {
-		requiredBuckets := [][]byte{
-			datastoreServerEntriesBucket,
-			datastoreServerEntryTagsBucket,
-			datastoreServerEntryTombstoneTagsBucket,
-			datastoreUrlETagsBucket,
-			datastoreKeyValueBucket,
-			datastoreRemoteServerListStatsBucket,
-			datastoreFailedTunnelStatsBucket,
-			datastoreSLOKsBucket,
-			datastoreTacticsBucket,
-			datastoreSpeedTestSamplesBucket,
-			datastoreDialParametersBucket,
-		}
+		requiredBuckets := append(
+			[][]byte{datastoreEncryptionBucket}, datastoreBuckets...)
 		for _, bucket := range requiredBuckets {
 			_, err := tx.CreateBucketIfNotExists(bucket)
 			if err != nil {
@@ -206,24 +203,36 @@ func tryDatastoreOpenDB(
 		return nil, errors.Trace(err)
 	}
 
-	return &datastoreDB{
+	db := &boltDatastoreDB{
 		boltDB:   newDB,
 		filename: filename,
-	}, nil
+	}
+
+	// A datastore that cannot be decrypted is treated as corrupt, and will be
+	// reset on retry.
+
+	encryption, err := initDatastoreEncryption(db, encryptionKeys)
+	if err != nil {
+		newDB.Close()
+		return nil, errors.Trace(err)
+	}
+	db.encryption = encryption
+
+	return db, nil
 }
 
 var errDatastoreFailed = std_errors.New("datastore has failed")
 
-func (db *datastoreDB) isDatastoreFailed() bool {
+func (db *boltDatastoreDB) isDatastoreFailed() bool {
 	return atomic.LoadInt32(&db.isFailed) == 1
 }
 
-func (db *datastoreDB) setDatastoreFailed(r interface{}) {
+func (db *boltDatastoreDB) setDatastoreFailed(r interface{}) {
 	atomic.StoreInt32(&db.isFailed, 1)
 	NoticeWarning("Datastore failed: %s", errors.Tracef("panic: %v", r))
 }
 
-func (db *datastoreDB) close() error {
+func (db *boltDatastoreDB) close() error {
 
 	// Limitation: there is no panic recover in this case. We assume boltDB.Close
 	// does not make  mmap accesses and prefer to not continue with the datastore
@@ -234,7 +243,7 @@ func (db *datastoreDB) close() error {
 	return db.boltDB.Close()
 }
 
-func (db *datastoreDB) getDataStoreMetrics() string {
+func (db *boltDatastoreDB) getDataStoreMetrics() string {
 	fileSize := int64(0)
 	fileInfo, err := os.Stat(db.filename)
 	if err == nil {
@@ -250,7 +259,87 @@ func (db *datastoreDB) getDataStoreMetrics() string {
 		stats.TxStats.WriteTime)
 }
 
-func (db *datastoreDB) view(fn func(tx *datastoreTx) error) (reterr error) {
+func (db *boltDatastoreDB) backup(filename string) error {
+
+	// CopyFile writes a consistent snapshot of the database from within a
+	// read transaction, so the datastore remains available for concurrent
+	// reads and writes while the backup is written.
+
+	err := db.boltDB.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(filename, 0600)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// datastoreCompactDB rewrites the datastore file, copying all buckets into a
+// fresh file that replaces the original. Bolt does not return free pages to
+// the file system, so this reclaims space after, for example, a large
+// number of server entries have been pruned. The datastore must be closed.
+func datastoreCompactDB(rootDataDirectory string) (retErr error) {
+
+	filename := filepath.Join(rootDataDirectory, "psiphon.boltdb")
+	compactFilename := filename + ".compact"
+
+	srcDB, err := bolt.Open(
+		filename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer srcDB.Close()
+
+	os.Remove(compactFilename)
+
+	dstDB, err := bolt.Open(compactFilename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if dstDB != nil {
+			dstDB.Close()
+		}
+		if retErr != nil {
+			os.Remove(compactFilename)
+		}
+	}()
+
+	err = srcDB.View(func(srcTx *bolt.Tx) error {
+		return srcTx.ForEach(func(name []byte, srcBucket *bolt.Bucket) error {
+			return dstDB.Update(func(dstTx *bolt.Tx) error {
+				dstBucket, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				// Keys are copied in order, so pages may be filled completely.
+				dstBucket.FillPercent = 1.0
+				return srcBucket.ForEach(func(key, value []byte) error {
+					return dstBucket.Put(key, value)
+				})
+			})
+		})
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = dstDB.Close()
+	dstDB = nil
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = os.Rename(compactFilename, filename)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (db *boltDatastoreDB) view(fn func(tx datastoreTx) error) (reterr error) {
 
 	// Any bolt function that performs mmap buffer accesses can raise SIGBUS due
 	// to underlying storage changes, such as a truncation of the datastore file
@@ -258,9 +347,9 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) (reterr error) {
 	//
 	// To handle this, we temporarily set SetPanicOnFault in order to treat the
 	// fault as a panic, recover any panic to avoid crashing the process, and
-	// putting this datastoreDB instance into a failed state. All subsequent
-	// calls to this datastoreDBinstance or its related datastoreTx and
-	// datastoreBucket instances will fail.
+	// putting this boltDatastoreDB instance into a failed state. All subsequent
+	// calls to this datastoreDBinstance or its related boltDatastoreTx and
+	// boltDatastoreBucket instances will fail.
 
 	// Begin recovery preamble
 	if db.isDatastoreFailed() {
@@ -278,7 +367,7 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) (reterr error) {
 
 	return db.boltDB.View(
 		func(tx *bolt.Tx) error {
-			err := fn(&datastoreTx{db: db, boltTx: tx})
+			err := fn(&boltDatastoreTx{db: db, boltTx: tx})
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -286,7 +375,7 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) (reterr error) {
 		})
 }
 
-func (db *datastoreDB) update(fn func(tx *datastoreTx) error) (reterr error) {
+func (db *boltDatastoreDB) update(fn func(tx datastoreTx) error) (reterr error) {
 
 	// Begin recovery preamble
 	if db.isDatastoreFailed() {
@@ -304,7 +393,7 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) (reterr error) {
 
 	return db.boltDB.Update(
 		func(tx *bolt.Tx) error {
-			err := fn(&datastoreTx{db: db, boltTx: tx})
+			err := fn(&boltDatastoreTx{db: db, boltTx: tx})
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -312,26 +401,26 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) (reterr error) {
 		})
 }
 
-func (tx *datastoreTx) bucket(name []byte) (retbucket *datastoreBucket) {
+func (tx *boltDatastoreTx) bucket(name []byte) (retbucket datastoreBucket) {
 
 	// Begin recovery preamble
 	if tx.db.isDatastoreFailed() {
-		return &datastoreBucket{db: tx.db, boltBucket: nil}
+		return &boltDatastoreBucket{db: tx.db, boltBucket: nil}
 	}
 	panicOnFault := debug.SetPanicOnFault(true)
 	defer debug.SetPanicOnFault(panicOnFault)
 	defer func() {
 		if r := recover(); r != nil {
 			tx.db.setDatastoreFailed(r)
-			retbucket = &datastoreBucket{db: tx.db, boltBucket: nil}
+			retbucket = &boltDatastoreBucket{db: tx.db, boltBucket: nil}
 		}
 	}()
 	// End recovery preamble
 
-	return &datastoreBucket{db: tx.db, boltBucket: tx.boltTx.Bucket(name)}
+	return &boltDatastoreBucket{db: tx.db, boltBucket: tx.boltTx.Bucket(name)}
 }
 
-func (tx *datastoreTx) clearBucket(name []byte) (reterr error) {
+func (tx *boltDatastoreTx) clearBucket(name []byte) (reterr error) {
 
 	// Begin recovery preamble
 	if tx.db.isDatastoreFailed() {
@@ -358,7 +447,7 @@ func (tx *datastoreTx) clearBucket(name []byte) (reterr error) {
 	return nil
 }
 
-func (b *datastoreBucket) get(key []byte) (retvalue []byte) {
+func (b *boltDatastoreBucket) get(key []byte) (retvalue []byte) {
 
 	// Begin recovery preamble
 	if b.db.isDatastoreFailed() {
@@ -374,10 +463,18 @@ func (b *datastoreBucket) get(key []byte) (retvalue []byte) {
 	}()
 	// End recovery preamble
 
-	return b.boltBucket.Get(key)
+	value, err := b.db.encryption.decryptValue(
+		key, b.boltBucket.Get(b.db.encryption.encryptKey(key)))
+	if err != nil {
+		// The original datastore interface does not return an error from Get,
+		// so emit notice.
+		NoticeWarning("get failed: %s", errors.Trace(err))
+		return nil
+	}
+	return value
 }
 
-func (b *datastoreBucket) put(key, value []byte) (reterr error) {
+func (b *boltDatastoreBucket) put(key, value []byte) (reterr error) {
 
 	// Begin recovery preamble
 	if b.db.isDatastoreFailed() {
@@ -393,14 +490,15 @@ func (b *datastoreBucket) put(key, value []byte) (reterr error) {
 	}()
 	// End recovery preamble
 
-	err := b.boltBucket.Put(key, value)
+	err := b.boltBucket.Put(
+		b.db.encryption.encryptKey(key), b.db.encryption.encryptValue(key, value))
 	if err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-func (b *datastoreBucket) delete(key []byte) (reterr error) {
+func (b *boltDatastoreBucket) delete(key []byte) (reterr error) {
 
 	// Begin recovery preamble
 	if b.db.isDatastoreFailed() {
@@ -416,33 +514,33 @@ func (b *datastoreBucket) delete(key []byte) (reterr error) {
 	}()
 	// End recovery preamble
 
-	err := b.boltBucket.Delete(key)
+	err := b.boltBucket.Delete(b.db.encryption.encryptKey(key))
 	if err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-func (b *datastoreBucket) cursor() (retcursor datastoreCursor) {
+func (b *boltDatastoreBucket) cursor() (retcursor datastoreCursor) {
 
 	// Begin recovery preamble
 	if b.db.isDatastoreFailed() {
-		return datastoreCursor{db: b.db, boltCursor: nil}
+		return &boltDatastoreCursor{db: b.db, boltCursor: nil}
 	}
 	panicOnFault := debug.SetPanicOnFault(true)
 	defer debug.SetPanicOnFault(panicOnFault)
 	defer func() {
 		if r := recover(); r != nil {
 			b.db.setDatastoreFailed(r)
-			retcursor = datastoreCursor{db: b.db, boltCursor: nil}
+			retcursor = &boltDatastoreCursor{db: b.db, boltCursor: nil}
 		}
 	}()
 	// End recovery preamble
 
-	return datastoreCursor{db: b.db, boltCursor: b.boltBucket.Cursor()}
+	return &boltDatastoreCursor{db: b.db, boltCursor: b.boltBucket.Cursor()}
 }
 
-func (c *datastoreCursor) firstKey() (retkey []byte) {
+func (c *boltDatastoreCursor) firstKey() (retkey []byte) {
 
 	// Begin recovery preamble
 	if c.db.isDatastoreFailed() {
@@ -459,10 +557,10 @@ func (c *datastoreCursor) firstKey() (retkey []byte) {
 	// End recovery preamble
 
 	key, _ := c.boltCursor.First()
-	return key
+	return c.db.encryption.decryptCursorKey(key, c.nextBoltKey)
 }
 
-func (c *datastoreCursor) nextKey() (retkey []byte) {
+func (c *boltDatastoreCursor) nextKey() (retkey []byte) {
 
 	// Begin recovery preamble
 	if c.db.isDatastoreFailed() {
@@ -478,11 +576,16 @@ func (c *datastoreCursor) nextKey() (retkey []byte) {
 	}()
 	// End recovery preamble
 
+	key, _ := c.boltCursor.Next()
+	return c.db.encryption.decryptCursorKey(key, c.nextBoltKey)
+}
+
+func (c *boltDatastoreCursor) nextBoltKey() []byte {
 	key, _ := c.boltCursor.Next()
 	return key
 }
 
-func (c *datastoreCursor) first() (retkey, retvalue []byte) {
+func (c *boltDatastoreCursor) first() (retkey, retvalue []byte) {
 
 	// Begin recovery preamble
 	if c.db.isDatastoreFailed() {
@@ -499,10 +602,11 @@ func (c *datastoreCursor) first() (retkey, retvalue []byte) {
 	}()
 	// End recovery preamble
 
-	return c.boltCursor.First()
+	key, value := c.boltCursor.First()
+	return c.db.encryption.decryptCursorRecord(key, value, c.boltCursor.Next)
 }
 
-func (c *datastoreCursor) next() (retkey, retvalue []byte) {
+func (c *boltDatastoreCursor) next() (retkey, retvalue []byte) {
 
 	// Begin recovery preamble
 	if c.db.isDatastoreFailed() {
@@ -519,9 +623,10 @@ func (c *datastoreCursor) next() (retkey, retvalue []byte) {
 	}()
 	// End recovery preamble
 
-	return c.boltCursor.Next()
+	key, value := c.boltCursor.Next()
+	return c.db.encryption.decryptCursorRecord(key, value, c.boltCursor.Next)
 }
 
-func (c *datastoreCursor) close() {
+func (c *boltDatastoreCursor) close() {
 	// BoltDB doesn't close cursors.
 }
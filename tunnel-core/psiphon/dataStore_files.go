@@ -35,7 +35,7 @@ import (
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
 )
 
-// datastoreDB is a simple filesystem-backed key/value store that implements
+// filesDatastoreDB is a simple filesystem-backed key/value store that implements
 // the datastore interface.
 //
 // The current implementation is intended only for experimentation.
@@ -51,33 +51,36 @@ import (
 // As with the original datastore interface, value slices are only valid
 // within a transaction; for cursors, there's a further limitation that the
 // value slices are only valid until the next iteration.
-type datastoreDB struct {
+type filesDatastoreDB struct {
 	dataDirectory string
 	bufferPool    sync.Pool
 	lock          sync.RWMutex
 	closed        bool
+	encryption    *datastoreEncryption
 }
 
-type datastoreTx struct {
-	db        *datastoreDB
+type filesDatastoreTx struct {
+	db        *filesDatastoreDB
 	canUpdate bool
 	buffers   []*bytes.Buffer
 }
 
-type datastoreBucket struct {
+type filesDatastoreBucket struct {
 	bucketDirectory string
-	tx              *datastoreTx
+	tx              *filesDatastoreTx
 }
 
-type datastoreCursor struct {
-	bucket     *datastoreBucket
+type filesDatastoreCursor struct {
+	bucket     *filesDatastoreBucket
 	fileInfos  []os.FileInfo
 	index      int
 	lastBuffer *bytes.Buffer
 }
 
 func datastoreOpenDB(
-	rootDataDirectory string, _ bool) (*datastoreDB, error) {
+	rootDataDirectory string,
+	_ bool,
+	encryptionKeys *datastoreEncryptionKeys) (datastoreDB, error) {
 
 	dataDirectory := filepath.Join(rootDataDirectory, "psiphon.filesdb")
 	err := os.MkdirAll(dataDirectory, 0700)
@@ -85,26 +88,34 @@ func datastoreOpenDB(
 		return nil, errors.Trace(err)
 	}
 
-	return &datastoreDB{
+	db := &filesDatastoreDB{
 		dataDirectory: dataDirectory,
 		bufferPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
 			},
 		},
-	}, nil
+	}
+
+	encryption, err := initDatastoreEncryption(db, encryptionKeys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	db.encryption = encryption
+
+	return db, nil
 }
 
-func (db *datastoreDB) getBuffer() *bytes.Buffer {
+func (db *filesDatastoreDB) getBuffer() *bytes.Buffer {
 	return db.bufferPool.Get().(*bytes.Buffer)
 }
 
-func (db *datastoreDB) putBuffer(buffer *bytes.Buffer) {
+func (db *filesDatastoreDB) putBuffer(buffer *bytes.Buffer) {
 	buffer.Truncate(0)
 	db.bufferPool.Put(buffer)
 }
 
-func (db *datastoreDB) readBuffer(filename string) (*bytes.Buffer, error) {
+func (db *filesDatastoreDB) readBuffer(filename string) (*bytes.Buffer, error) {
 	// Complete any partial put commit.
 	err := datastoreApplyCommit(filename)
 	if err != nil {
@@ -126,7 +137,7 @@ func (db *datastoreDB) readBuffer(filename string) (*bytes.Buffer, error) {
 	return buffer, nil
 }
 
-func (db *datastoreDB) close() error {
+func (db *filesDatastoreDB) close() error {
 	// close will await any active view and update transactions via this lock.
 	db.lock.Lock()
 	defer db.lock.Unlock()
@@ -134,18 +145,26 @@ func (db *datastoreDB) close() error {
 	return nil
 }
 
-func (db *datastoreDB) getDataStoreMetrics() string {
+func (db *filesDatastoreDB) getDataStoreMetrics() string {
 	// TODO: report metrics
 	return ""
 }
 
-func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
+func (db *filesDatastoreDB) backup(_ string) error {
+	return errors.TraceNew("not supported")
+}
+
+func datastoreCompactDB(_ string) error {
+	return errors.TraceNew("not supported")
+}
+
+func (db *filesDatastoreDB) view(fn func(tx datastoreTx) error) error {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 	if db.closed {
 		return errors.TraceNew("closed")
 	}
-	tx := &datastoreTx{db: db}
+	tx := &filesDatastoreTx{db: db}
 	defer tx.releaseBuffers()
 	err := fn(tx)
 	if err != nil {
@@ -154,13 +173,13 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 	return nil
 }
 
-func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
+func (db *filesDatastoreDB) update(fn func(tx datastoreTx) error) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 	if db.closed {
 		return errors.TraceNew("closed")
 	}
-	tx := &datastoreTx{db: db, canUpdate: true}
+	tx := &filesDatastoreTx{db: db, canUpdate: true}
 	defer tx.releaseBuffers()
 	err := fn(tx)
 	if err != nil {
@@ -169,7 +188,7 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
 	return nil
 }
 
-func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
+func (tx *filesDatastoreTx) bucket(name []byte) datastoreBucket {
 	bucketDirectory := filepath.Join(tx.db.dataDirectory, hex.EncodeToString(name))
 	err := os.MkdirAll(bucketDirectory, 0700)
 	if err != nil {
@@ -177,15 +196,15 @@ func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
 		// so emit notice, and return zero-value bucket for which all
 		// operations will fail.
 		NoticeWarning("bucket failed: %s", errors.Trace(err))
-		return &datastoreBucket{}
+		return &filesDatastoreBucket{}
 	}
-	return &datastoreBucket{
+	return &filesDatastoreBucket{
 		bucketDirectory: bucketDirectory,
 		tx:              tx,
 	}
 }
 
-func (tx *datastoreTx) clearBucket(name []byte) error {
+func (tx *filesDatastoreTx) clearBucket(name []byte) error {
 	bucketDirectory := filepath.Join(tx.db.dataDirectory, hex.EncodeToString(name))
 	err := os.RemoveAll(bucketDirectory)
 	if err != nil {
@@ -194,18 +213,20 @@ func (tx *datastoreTx) clearBucket(name []byte) error {
 	return nil
 }
 
-func (tx *datastoreTx) releaseBuffers() {
+func (tx *filesDatastoreTx) releaseBuffers() {
 	for _, buffer := range tx.buffers {
 		tx.db.putBuffer(buffer)
 	}
 	tx.buffers = nil
 }
 
-func (b *datastoreBucket) get(key []byte) []byte {
+func (b *filesDatastoreBucket) get(key []byte) []byte {
 	if b.tx == nil {
 		return nil
 	}
-	filename := filepath.Join(b.bucketDirectory, hex.EncodeToString(key))
+	encryption := b.tx.db.encryption
+	filename := filepath.Join(
+		b.bucketDirectory, hex.EncodeToString(encryption.encryptKey(key)))
 	valueBuffer, err := b.tx.db.readBuffer(filename)
 	if err != nil {
 		// The original datastore interface does not return an error from Get,
@@ -216,11 +237,20 @@ func (b *datastoreBucket) get(key []byte) []byte {
 	if valueBuffer == nil {
 		return nil
 	}
+	if encryption != nil {
+		defer b.tx.db.putBuffer(valueBuffer)
+		value, err := encryption.decryptValue(key, valueBuffer.Bytes())
+		if err != nil {
+			NoticeWarning("get failed: %s", errors.Trace(err))
+			return nil
+		}
+		return value
+	}
 	b.tx.buffers = append(b.tx.buffers, valueBuffer)
 	return valueBuffer.Bytes()
 }
 
-func (b *datastoreBucket) put(key, value []byte) error {
+func (b *filesDatastoreBucket) put(key, value []byte) error {
 	if b.tx == nil {
 		return errors.TraceNew("bucket not found")
 	}
@@ -228,7 +258,10 @@ func (b *datastoreBucket) put(key, value []byte) error {
 		return errors.TraceNew("non-update transaction")
 	}
 
-	filename := filepath.Join(b.bucketDirectory, hex.EncodeToString(key))
+	encryption := b.tx.db.encryption
+	value = encryption.encryptValue(key, value)
+	filename := filepath.Join(
+		b.bucketDirectory, hex.EncodeToString(encryption.encryptKey(key)))
 
 	// Complete any partial put commit.
 	err := datastoreApplyCommit(filename)
@@ -269,11 +302,12 @@ func datastoreApplyCommit(filename string) error {
 	return nil
 }
 
-func (b *datastoreBucket) delete(key []byte) error {
+func (b *filesDatastoreBucket) delete(key []byte) error {
 	if b.tx == nil {
 		return errors.TraceNew("bucket not found")
 	}
-	filename := filepath.Join(b.bucketDirectory, hex.EncodeToString(key))
+	filename := filepath.Join(
+		b.bucketDirectory, hex.EncodeToString(b.tx.db.encryption.encryptKey(key)))
 	filenames := []string{filename + ".put", filename + ".commit", filename}
 	for _, filename := range filenames {
 		err := os.Remove(filename)
@@ -284,25 +318,25 @@ func (b *datastoreBucket) delete(key []byte) error {
 	return nil
 }
 
-func (b *datastoreBucket) cursor() *datastoreCursor {
+func (b *filesDatastoreBucket) cursor() datastoreCursor {
 	if b.tx == nil {
 		// The original datastore interface does not return an error from
 		// Cursor, so emit notice, and return zero-value cursor for which all
 		// operations will fail.
-		return &datastoreCursor{}
+		return &filesDatastoreCursor{}
 	}
 	fileInfos, err := ioutil.ReadDir(b.bucketDirectory)
 	if err != nil {
 		NoticeWarning("cursor failed: %s", errors.Trace(err))
-		return &datastoreCursor{}
+		return &filesDatastoreCursor{}
 	}
-	return &datastoreCursor{
+	return &filesDatastoreCursor{
 		bucket:    b,
 		fileInfos: fileInfos,
 	}
 }
 
-func (c *datastoreCursor) advance() {
+func (c *filesDatastoreCursor) advance() {
 	if c.bucket == nil {
 		return
 	}
@@ -318,15 +352,16 @@ func (c *datastoreCursor) advance() {
 	}
 }
 
-func (c *datastoreCursor) firstKey() []byte {
+func (c *filesDatastoreCursor) firstKey() []byte {
 	if c.bucket == nil {
 		return nil
 	}
 	c.index = 0
-	return c.currentKey()
+	return c.bucket.tx.db.encryption.decryptCursorKey(
+		c.currentKey(), c.advanceKey)
 }
 
-func (c *datastoreCursor) currentKey() []byte {
+func (c *filesDatastoreCursor) currentKey() []byte {
 	if c.bucket == nil {
 		return nil
 	}
@@ -346,23 +381,30 @@ func (c *datastoreCursor) currentKey() []byte {
 	return key
 }
 
-func (c *datastoreCursor) nextKey() []byte {
+func (c *filesDatastoreCursor) nextKey() []byte {
 	if c.bucket == nil {
 		return nil
 	}
+	return c.bucket.tx.db.encryption.decryptCursorKey(
+		c.advanceKey(), c.advanceKey)
+}
+
+func (c *filesDatastoreCursor) advanceKey() []byte {
 	c.advance()
 	return c.currentKey()
 }
 
-func (c *datastoreCursor) first() ([]byte, []byte) {
+func (c *filesDatastoreCursor) first() ([]byte, []byte) {
 	if c.bucket == nil {
 		return nil, nil
 	}
 	c.index = 0
-	return c.current()
+	key, value := c.current()
+	return c.bucket.tx.db.encryption.decryptCursorRecord(
+		key, value, c.advanceRecord)
 }
 
-func (c *datastoreCursor) current() ([]byte, []byte) {
+func (c *filesDatastoreCursor) current() ([]byte, []byte) {
 	key := c.currentKey()
 	if key == nil {
 		return nil, nil
@@ -386,15 +428,21 @@ func (c *datastoreCursor) current() ([]byte, []byte) {
 	return key, valueBuffer.Bytes()
 }
 
-func (c *datastoreCursor) next() ([]byte, []byte) {
+func (c *filesDatastoreCursor) next() ([]byte, []byte) {
 	if c.bucket == nil {
 		return nil, nil
 	}
+	key, value := c.advanceRecord()
+	return c.bucket.tx.db.encryption.decryptCursorRecord(
+		key, value, c.advanceRecord)
+}
+
+func (c *filesDatastoreCursor) advanceRecord() ([]byte, []byte) {
 	c.advance()
 	return c.current()
 }
 
-func (c *datastoreCursor) close() {
+func (c *filesDatastoreCursor) close() {
 	if c.lastBuffer != nil {
 		c.bucket.tx.db.putBuffer(c.lastBuffer)
 		c.lastBuffer = nil
@@ -0,0 +1,360 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+// memoryDatastoreBackend is a datastore backend that keeps all records in
+// memory, for ephemeral runs and tests. Unlike the on-disk backends, it's
+// selected at run time, with Config.DataStoreBackend, and is available in
+// all builds.
+//
+// The in-memory datastore may be seeded from the on-disk datastore in the
+// data directory, when opened, and snapshotted to the on-disk datastore,
+// when closed. Seeding and snapshotting each briefly open the on-disk
+// datastore, using the configured datastore encryption keys. The on-disk
+// datastore is not otherwise accessed, and is not locked while the
+// in-memory datastore is open. As seeding and snapshotting open the on-disk
+// datastore files directly, they should not be used while the on-disk
+// datastore is open for another Config in the same process.
+//
+// Update transactions are atomic: when the update function returns an
+// error, all changes made in the transaction are rolled back. Update
+// transactions are exclusive, and view transactions may run concurrently.
+type memoryDatastoreBackend struct {
+}
+
+type memoryDatastoreDB struct {
+	mutex    sync.RWMutex
+	buckets  map[string]map[string][]byte
+	closed   bool
+	snapshot func(db *memoryDatastoreDB) error
+}
+
+type memoryDatastoreTx struct {
+	db        *memoryDatastoreDB
+	canUpdate bool
+	undo      []func()
+}
+
+type memoryDatastoreBucket struct {
+	tx   *memoryDatastoreTx
+	name string
+}
+
+type memoryDatastoreCursor struct {
+	bucket *memoryDatastoreBucket
+	keys   []string
+	index  int
+}
+
+func (memoryDatastoreBackend) openDB(
+	config *Config, retryAndReset bool) (datastoreDB, error) {
+
+	db := &memoryDatastoreDB{
+		buckets: make(map[string]map[string][]byte),
+	}
+
+	if config.DataStoreMemorySeedFromDisk {
+		err := db.seedFromDisk(config, retryAndReset)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if config.DataStoreMemorySnapshotToDisk {
+		db.snapshot = func(db *memoryDatastoreDB) error {
+			return db.snapshotToDisk(config, retryAndReset)
+		}
+	}
+
+	return db, nil
+}
+
+func (db *memoryDatastoreDB) seedFromDisk(config *Config, retryAndReset bool) error {
+
+	diskDB, err := diskDatastoreBackend{}.openDB(config, retryAndReset)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer diskDB.close()
+
+	count := 0
+
+	err = diskDB.view(func(tx datastoreTx) error {
+		for _, name := range datastoreBuckets {
+			records := make(map[string][]byte)
+			cursor := tx.bucket(name).cursor()
+			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+				records[string(key)] = append([]byte{}, value...)
+			}
+			cursor.close()
+			db.buckets[string(name)] = records
+			count += len(records)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	NoticeInfo("seeded memory datastore: %d records", count)
+
+	return nil
+}
+
+func (db *memoryDatastoreDB) snapshotToDisk(config *Config, retryAndReset bool) error {
+
+	diskDB, err := diskDatastoreBackend{}.openDB(config, retryAndReset)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer diskDB.close()
+
+	count := 0
+
+	err = diskDB.update(func(tx datastoreTx) error {
+		for _, name := range datastoreBuckets {
+			err := tx.clearBucket(name)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			bucket := tx.bucket(name)
+			for key, value := range db.buckets[string(name)] {
+				err := bucket.put([]byte(key), value)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+			count += len(db.buckets[string(name)])
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	NoticeInfo("snapshotted memory datastore: %d records", count)
+
+	return nil
+}
+
+func (db *memoryDatastoreDB) close() error {
+	// close will await any active view and update transactions via this lock.
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	var err error
+	if db.snapshot != nil {
+		err = db.snapshot(db)
+	}
+
+	db.buckets = nil
+
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (db *memoryDatastoreDB) getDataStoreMetrics() string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	count := 0
+	for _, records := range db.buckets {
+		count += len(records)
+	}
+	return fmt.Sprintf("memory datastore: %d records", count)
+}
+
+func (db *memoryDatastoreDB) backup(_ string) error {
+	return errors.TraceNew("not supported")
+}
+
+func (db *memoryDatastoreDB) view(fn func(tx datastoreTx) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		return errors.TraceNew("closed")
+	}
+	err := fn(&memoryDatastoreTx{db: db})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (db *memoryDatastoreDB) update(fn func(tx datastoreTx) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return errors.TraceNew("closed")
+	}
+	tx := &memoryDatastoreTx{db: db, canUpdate: true}
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (tx *memoryDatastoreTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+}
+
+func (tx *memoryDatastoreTx) bucket(name []byte) datastoreBucket {
+	return &memoryDatastoreBucket{tx: tx, name: string(name)}
+}
+
+func (tx *memoryDatastoreTx) clearBucket(name []byte) error {
+	if !tx.canUpdate {
+		return errors.TraceNew("non-update transaction")
+	}
+	bucketName := string(name)
+	records, ok := tx.db.buckets[bucketName]
+	if !ok {
+		return nil
+	}
+	delete(tx.db.buckets, bucketName)
+	tx.undo = append(tx.undo, func() {
+		tx.db.buckets[bucketName] = records
+	})
+	return nil
+}
+
+func (b *memoryDatastoreBucket) get(key []byte) []byte {
+	return b.tx.db.buckets[b.name][string(key)]
+}
+
+func (b *memoryDatastoreBucket) put(key, value []byte) error {
+	if !b.tx.canUpdate {
+		return errors.TraceNew("non-update transaction")
+	}
+
+	records, ok := b.tx.db.buckets[b.name]
+	if !ok {
+		records = make(map[string][]byte)
+		b.tx.db.buckets[b.name] = records
+		b.tx.undo = append(b.tx.undo, func() {
+			delete(b.tx.db.buckets, b.name)
+		})
+	}
+
+	recordKey := string(key)
+	previousValue, exists := records[recordKey]
+	b.tx.undo = append(b.tx.undo, func() {
+		if exists {
+			records[recordKey] = previousValue
+		} else {
+			delete(records, recordKey)
+		}
+	})
+
+	// The caller may reuse the value buffer after put returns.
+	records[recordKey] = append([]byte{}, value...)
+
+	return nil
+}
+
+func (b *memoryDatastoreBucket) delete(key []byte) error {
+	if !b.tx.canUpdate {
+		return errors.TraceNew("non-update transaction")
+	}
+
+	records := b.tx.db.buckets[b.name]
+	recordKey := string(key)
+	previousValue, exists := records[recordKey]
+	if !exists {
+		return nil
+	}
+	delete(records, recordKey)
+	b.tx.undo = append(b.tx.undo, func() {
+		records[recordKey] = previousValue
+	})
+
+	return nil
+}
+
+func (b *memoryDatastoreBucket) cursor() datastoreCursor {
+
+	// As with bolt, the cursor iterates over keys in sorted order. The keys
+	// are captured when the cursor is created, so records may be deleted
+	// while iterating in an update transaction.
+
+	records := b.tx.db.buckets[b.name]
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return &memoryDatastoreCursor{bucket: b, keys: keys}
+}
+
+func (c *memoryDatastoreCursor) firstKey() []byte {
+	key, _ := c.first()
+	return key
+}
+
+func (c *memoryDatastoreCursor) nextKey() []byte {
+	key, _ := c.next()
+	return key
+}
+
+func (c *memoryDatastoreCursor) first() ([]byte, []byte) {
+	c.index = 0
+	return c.current()
+}
+
+func (c *memoryDatastoreCursor) next() ([]byte, []byte) {
+	c.index += 1
+	return c.current()
+}
+
+func (c *memoryDatastoreCursor) current() ([]byte, []byte) {
+	records := c.bucket.tx.db.buckets[c.bucket.name]
+	for ; c.index < len(c.keys); c.index++ {
+		key := c.keys[c.index]
+		value, ok := records[key]
+		if ok {
+			return []byte(key), value
+		}
+	}
+	return nil, nil
+}
+
+func (c *memoryDatastoreCursor) close() {
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+func TestMemoryDataStore(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-memory-datastore-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	loadConfig := func(backend string) *Config {
+
+		clientConfigJSON := fmt.Sprintf(`
+        {
+            "ClientPlatform" : "",
+            "ClientVersion" : "0",
+            "SponsorId" : "0",
+            "PropagationChannelId" : "0",
+            "DataStoreBackend" : "%s"
+        }`, backend)
+
+		clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+
+		clientConfig.DataRootDirectory = testDataDirName
+
+		err = clientConfig.Commit(false)
+		if err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+
+		return clientConfig
+	}
+
+	clientConfig := loadConfig(DATASTORE_BACKEND_MEMORY)
+	diskConfig := loadConfig(DATASTORE_BACKEND_DISK)
+
+	checkValue := func(config *Config, key, expectedValue string) {
+		value, err := GetKeyValue(config, key)
+		if err != nil {
+			t.Fatalf("GetKeyValue failed: %s", err)
+		}
+		if value != expectedValue {
+			t.Fatalf("unexpected value for %s: %s", key, value)
+		}
+	}
+
+	setValue := func(config *Config, key, value string) {
+		err := SetKeyValue(config, key, value)
+		if err != nil {
+			t.Fatalf("SetKeyValue failed: %s", err)
+		}
+	}
+
+	deleteValue := func(config *Config, key string) {
+		err := datastoreUpdate(config, func(tx datastoreTx) error {
+			return tx.bucket(datastoreKeyValueBucket).delete([]byte(key))
+		})
+		if err != nil {
+			t.Fatalf("datastoreUpdate failed: %s", err)
+		}
+	}
+
+	openDataStore := func(config *Config) {
+		err := OpenDataStore(config)
+		if err != nil {
+			t.Fatalf("OpenDataStore failed: %s", err)
+		}
+	}
+
+	// Basic operations.
+
+	openDataStore(clientConfig)
+
+	setValue(clientConfig, "key1", "value1")
+	setValue(clientConfig, "key2", "value2")
+	checkValue(clientConfig, "key1", "value1")
+
+	deleteValue(clientConfig, "key2")
+	checkValue(clientConfig, "key2", "")
+
+	// A failed update is rolled back.
+
+	err = datastoreUpdate(clientConfig, func(tx datastoreTx) error {
+		bucket := tx.bucket(datastoreKeyValueBucket)
+		err := bucket.put([]byte("key1"), []byte("updated"))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = bucket.put([]byte("key3"), []byte("value3"))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = tx.clearBucket(datastoreKeyValueBucket)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return errors.TraceNew("rollback")
+	})
+	if err == nil {
+		t.Fatalf("datastoreUpdate unexpectedly succeeded")
+	}
+	checkValue(clientConfig, "key1", "value1")
+	checkValue(clientConfig, "key3", "")
+
+	// Each Config, as used by a Controller, selects its own backend: the
+	// on-disk datastore and distinct in-memory datastores may be open
+	// concurrently, and records are not shared between them.
+
+	otherClientConfig := loadConfig(DATASTORE_BACKEND_MEMORY)
+
+	openDataStore(diskConfig)
+	openDataStore(otherClientConfig)
+
+	checkValue(diskConfig, "key1", "")
+	checkValue(otherClientConfig, "key1", "")
+
+	setValue(diskConfig, "key1", "disk1")
+	setValue(otherClientConfig, "key1", "other1")
+
+	checkValue(clientConfig, "key1", "value1")
+	checkValue(diskConfig, "key1", "disk1")
+	checkValue(otherClientConfig, "key1", "other1")
+
+	CloseDataStore(otherClientConfig)
+	CloseDataStore(diskConfig)
+
+	// Closing one datastore doesn't affect another.
+
+	checkValue(clientConfig, "key1", "value1")
+
+	_, err = GetKeyValue(otherClientConfig, "key1")
+	if err == nil {
+		t.Fatalf("GetKeyValue unexpectedly succeeded")
+	}
+
+	CloseDataStore(clientConfig)
+
+	// Records are not retained once closed.
+
+	openDataStore(clientConfig)
+	checkValue(clientConfig, "key1", "")
+	CloseDataStore(clientConfig)
+
+	// Populate the on-disk datastore.
+
+	openDataStore(diskConfig)
+	setValue(diskConfig, "key1", "disk1")
+	setValue(diskConfig, "key2", "disk2")
+	CloseDataStore(diskConfig)
+
+	// Seed from the on-disk datastore, without snapshotting.
+
+	clientConfig.DataStoreMemorySeedFromDisk = true
+
+	openDataStore(clientConfig)
+	checkValue(clientConfig, "key1", "disk1")
+	checkValue(clientConfig, "key2", "disk2")
+	setValue(clientConfig, "key1", "memory1")
+	CloseDataStore(clientConfig)
+
+	openDataStore(diskConfig)
+	checkValue(diskConfig, "key1", "disk1")
+	CloseDataStore(diskConfig)
+
+	// Seed from and snapshot to the on-disk datastore.
+
+	clientConfig.DataStoreMemorySnapshotToDisk = true
+
+	openDataStore(clientConfig)
+	setValue(clientConfig, "key1", "memory1")
+	deleteValue(clientConfig, "key2")
+	CloseDataStore(clientConfig)
+
+	openDataStore(diskConfig)
+	checkValue(diskConfig, "key1", "memory1")
+	checkValue(diskConfig, "key2", "")
+	CloseDataStore(diskConfig)
+}
@@ -102,6 +102,7 @@ type DialParameters struct {
 	MeekHostHeader            string
 	MeekObfuscatorPaddingSeed *prng.Seed
 	MeekTLSPaddingSize        int
+	MeekUseWebSocket          bool
 	MeekResolvedIPAddress     atomic.Value `json:"-"`
 
 	SelectedUserAgent bool
@@ -118,6 +119,7 @@ type DialParameters struct {
 	QUICClientHelloSeed         *prng.Seed
 	ObfuscatedQUICPaddingSeed   *prng.Seed
 	QUICDisablePathMTUDiscovery bool
+	QUICEnableDatagrams         bool
 
 	ConjureCachedRegistrationTTL        time.Duration
 	ConjureAPIRegistration              bool
@@ -141,6 +143,7 @@ type DialParameters struct {
 
 	resolver          *resolver.Resolver `json:"-"`
 	ResolveParameters *resolver.ResolveParameters
+	usedHTTPSIPHints  int32
 
 	dialConfig *DialConfig `json:"-"`
 	meekConfig *MeekConfig `json:"-"`
@@ -252,7 +255,7 @@ func MakeDialParameters(
 		// In these cases, existing dial parameters are expired or no longer
 		// match the config state and so are cleared to avoid rechecking them.
 
-		err = DeleteDialParameters(serverEntry.IpAddress, networkID)
+		err = DeleteDialParameters(config, serverEntry.IpAddress, networkID)
 		if err != nil {
 			NoticeWarning("DeleteDialParameters failed: %s", err)
 		}
@@ -645,6 +648,17 @@ func MakeDialParameters(
 		}
 	}
 
+	// WebSocket support depends on the CDN or any other intermediary in the
+	// meek path, so the selection is replayed along with the fronting
+	// parameters. WebSockets are not used with HTTP/2 over QUIC.
+
+	if (!isReplay || !replayFronting) &&
+		protocol.TunnelProtocolUsesMeek(dialParams.TunnelProtocol) &&
+		!protocol.TunnelProtocolUsesFrontedMeekQUIC(dialParams.TunnelProtocol) {
+
+		dialParams.MeekUseWebSocket = p.WeightedCoinFlip(parameters.MeekWebSocketProbability)
+	}
+
 	if !isReplay || !replayHostname {
 
 		if protocol.TunnelProtocolUsesMeekHTTPS(dialParams.TunnelProtocol) ||
@@ -694,6 +708,16 @@ func MakeDialParameters(
 		dialParams.QUICDisablePathMTUDiscovery =
 			protocol.QUICVersionUsesPathMTUDiscovery(dialParams.QUICVersion) &&
 				p.WeightedCoinFlip(parameters.QUICDisableClientPathMTUDiscoveryProbability)
+
+		// QUIC datagrams are used only to relay packet tunnel packets, and
+		// are not supported by gQUIC or by meek. As enabling datagrams
+		// changes the ClientHello, the selection is replayed along with the
+		// QUIC version.
+		dialParams.QUICEnableDatagrams =
+			config.PacketTunnelTunFileDescriptor > 0 &&
+				!isFronted &&
+				protocol.QUICVersionIsIETF(dialParams.QUICVersion) &&
+				p.WeightedCoinFlip(parameters.PacketTunnelQUICDatagramsProbability)
 	}
 
 	if (!isReplay || !replayObfuscatedQUIC) &&
@@ -902,6 +926,15 @@ func MakeDialParameters(
 	// almost immediately, instead of incurring the overhead of calling
 	// GetNetworkID again.
 	resolveIP := func(ctx context.Context, hostname string) ([]net.IP, error) {
+		if dialParams.ResolveParameters != nil &&
+			dialParams.ResolveParameters.UseHTTPSRecords {
+
+			IPs, err := dialParams.resolveIPWithHTTPSRecords(ctx, networkID, hostname)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			return IPs, nil
+		}
 		IPs, err := dialParams.resolver.ResolveIP(
 			ctx,
 			networkID,
@@ -942,6 +975,7 @@ func MakeDialParameters(
 			QUICClientHelloSeed:           dialParams.QUICClientHelloSeed,
 			QUICDisablePathMTUDiscovery:   dialParams.QUICDisablePathMTUDiscovery,
 			UseHTTPS:                      usingTLS,
+			UseWebSocket:                  dialParams.MeekUseWebSocket,
 			TLSProfile:                    dialParams.TLSProfile,
 			LegacyPassthrough:             serverEntry.ProtocolUsesLegacyPassthrough(dialParams.TunnelProtocol),
 			NoDefaultTLSSessionID:         dialParams.NoDefaultTLSSessionID,
@@ -980,6 +1014,101 @@ func MakeDialParameters(
 	return dialParams, nil
 }
 
+// resolveIPWithHTTPSRecords resolves the HTTPS records for hostname, the
+// fronting domain, concurrently with ResolveIP, and applies the records to
+// the dial:
+//
+// - For fronted meek QUIC, when the front has HTTPS records and none
+//   advertise HTTP/3, the dial fails immediately instead of awaiting a QUIC
+//   handshake timeout.
+//
+// - When ResolveIP fails, for example when all A and AAAA answers are
+//   poisoned, the IP hints from HTTPS records are used instead.
+//
+// Failing to resolve HTTPS records doesn't fail the dial, as many domains
+// have no HTTPS records.
+func (dialParams *DialParameters) resolveIPWithHTTPSRecords(
+	ctx context.Context,
+	networkID string,
+	hostname string) ([]net.IP, error) {
+
+	isQUIC := protocol.TunnelProtocolUsesFrontedMeekQUIC(dialParams.TunnelProtocol)
+
+	bindingsChan := make(chan []*resolver.ServiceBinding, 1)
+	go func() {
+		bindings, err := dialParams.resolver.ResolveHTTPS(
+			ctx, networkID, dialParams.ResolveParameters, hostname)
+		if err != nil {
+			NoticeWarning("ResolveHTTPS: %v", errors.Trace(err))
+		}
+		bindingsChan <- bindings
+	}()
+
+	IPs, err := dialParams.resolver.ResolveIP(
+		ctx, networkID, dialParams.ResolveParameters, hostname)
+
+	// For QUIC, always await the HTTPS records to check for HTTP/3 support.
+	// Otherwise, the records are needed only when ResolveIP fails, and
+	// ResolveHTTPS is left to complete and populate the resolver cache.
+	if err == nil && !isQUIC {
+		return IPs, nil
+	}
+
+	var bindings []*resolver.ServiceBinding
+	select {
+	case bindings = <-bindingsChan:
+	case <-ctx.Done():
+	}
+
+	// The default ALPN for HTTPS records is "http/1.1". AliasMode records,
+	// returned when an alias chain isn't fully followed, carry no service
+	// parameters and are skipped.
+	hasServiceBindings := false
+	hasUsableServiceBindings := false
+	var hintIPs []net.IP
+	var IPv6HintIPs []net.IP
+	for _, binding := range bindings {
+		if binding.IsAlias() {
+			continue
+		}
+		hasServiceBindings = true
+		var usable bool
+		if isQUIC {
+			usable = binding.SupportsALPN("h3", "http/1.1")
+		} else {
+			usable = binding.SupportsALPN("http/1.1", "http/1.1") ||
+				binding.SupportsALPN("h2", "http/1.1")
+		}
+		if !usable {
+			continue
+		}
+		hasUsableServiceBindings = true
+		hintIPs = append(hintIPs, binding.IPv4Hints...)
+		IPv6HintIPs = append(IPv6HintIPs, binding.IPv6Hints...)
+	}
+
+	if isQUIC && hasServiceBindings && !hasUsableServiceBindings {
+		return nil, errors.TraceNew("HTTPS records indicate no HTTP/3 support")
+	}
+
+	if err == nil {
+		return IPs, nil
+	}
+
+	// IPv6 hints are used only when there are no IPv4 hints, as the network
+	// may not have an IPv6 route.
+	if len(hintIPs) == 0 {
+		hintIPs = IPv6HintIPs
+	}
+	if len(hintIPs) == 0 {
+		return nil, errors.Trace(err)
+	}
+
+	atomic.StoreInt32(&dialParams.usedHTTPSIPHints, 1)
+
+	return hintIPs, nil
+}
+
 func (dialParams *DialParameters) GetDialConfig() *DialConfig {
 	return dialParams.dialConfig
 }
@@ -1004,10 +1133,13 @@ func (dialParams *DialParameters) GetNetworkType() string {
 	if strings.HasPrefix(dialParams.NetworkID, "MOBILE") {
 		return "MOBILE"
 	}
+	if strings.HasPrefix(dialParams.NetworkID, "WIRED") {
+		return "WIRED"
+	}
 	return "UNKNOWN"
 }
 
-func (dialParams *DialParameters) Succeeded() {
+func (dialParams *DialParameters) Succeeded(config *Config) {
 
 	// When TTL is 0, don't store dial parameters.
 	if dialParams.LastUsedTimestamp.IsZero() {
@@ -1015,7 +1147,7 @@ func (dialParams *DialParameters) Succeeded() {
 	}
 
 	NoticeInfo("Set dial parameters for %s", dialParams.ServerEntry.GetDiagnosticID())
-	err := SetDialParameters(dialParams.ServerEntry.IpAddress, dialParams.NetworkID, dialParams)
+	err := SetDialParameters(config, dialParams.ServerEntry.IpAddress, dialParams.NetworkID, dialParams)
 	if err != nil {
 		NoticeWarning("SetDialParameters failed: %s", err)
 	}
@@ -1040,7 +1172,7 @@ func (dialParams *DialParameters) Failed(config *Config) {
 			parameters.ReplayRetainFailedProbability) {
 
 		NoticeInfo("Delete dial parameters for %s", dialParams.ServerEntry.GetDiagnosticID())
-		err := DeleteDialParameters(dialParams.ServerEntry.IpAddress, dialParams.NetworkID)
+		err := DeleteDialParameters(config, dialParams.ServerEntry.IpAddress, dialParams.NetworkID)
 		if err != nil {
 			NoticeWarning("DeleteDialParameters failed: %s", err)
 		}
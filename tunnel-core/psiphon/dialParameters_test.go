@@ -21,18 +21,22 @@ package psiphon
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/parameters"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/resolver"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/values"
 )
 
@@ -102,7 +106,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 	if err != nil {
 		t.Fatalf("error initializing client datastore: %s", err)
 	}
-	defer CloseDataStore()
+	defer CloseDataStore(clientConfig)
 
 	serverEntries := makeMockServerEntries(tunnelProtocol, frontingProviderID, 100)
 
@@ -251,7 +255,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	// Test: no replay after network ID changes
 
-	dialParams.Succeeded()
+	dialParams.Succeeded(clientConfig)
 
 	testNetworkID = prng.HexString(8)
 
@@ -270,7 +274,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	// Test: replay after dial reported to succeed, and replay fields match previous dial parameters
 
-	dialParams.Succeeded()
+	dialParams.Succeeded(clientConfig)
 
 	replayDialParams, err := MakeDialParameters(clientConfig, nil, canReplay, selectProtocol, serverEntries[0], false, 0, 0)
 	if err != nil {
@@ -375,7 +379,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	// Test: no replay after dial parameters expired
 
-	dialParams.Succeeded()
+	dialParams.Succeeded(clientConfig)
 
 	time.Sleep(1 * time.Second)
 
@@ -390,7 +394,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	// Test: no replay after server entry changes
 
-	dialParams.Succeeded()
+	dialParams.Succeeded(clientConfig)
 
 	serverEntries[0].ConfigurationVersion += 1
 
@@ -423,7 +427,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
 
-	dialParams.Succeeded()
+	dialParams.Succeeded(clientConfig)
 
 	replayDialParams, err = MakeDialParameters(clientConfig, nil, canReplay, selectProtocol, serverEntries[0], false, 0, 0)
 	if err != nil {
@@ -495,7 +499,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 			t.Fatalf("json.Unmarshal failed: %s", err)
 		}
 
-		err = StoreServerEntry(serverEntryFields, false)
+		err = StoreServerEntry(clientConfig, serverEntryFields, false)
 		if err != nil {
 			t.Fatalf("StoreServerEntry failed: %s", err)
 		}
@@ -507,7 +511,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 				t.Fatalf("MakeDialParameters failed: %s", err)
 			}
 
-			dialParams.Succeeded()
+			dialParams.Succeeded(clientConfig)
 		}
 	}
 
@@ -702,3 +706,136 @@ func makeMockServerEntries(
 
 	return serverEntries
 }
+
+func TestResolveIPWithHTTPSRecords(t *testing.T) {
+
+	poisonedIP := "1.2.3.4"
+	hintIP := "93.184.216.34"
+	h3IP := "93.184.216.35"
+
+	h2Domain := "h2.example.com"
+	h3Domain := "h3.example.com"
+
+	// The DNS server responds to A requests for h2Domain with a poisoned IP,
+	// and to A requests for h3Domain with a valid IP. The HTTPS record for
+	// h2Domain advertises only "h2" and has an IPv4 hint; the HTTPS record
+	// for h3Domain advertises "h3".
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %s", err)
+	}
+
+	server := &dns.Server{
+		PacketConn: udpConn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+
+			if len(r.Question) != 1 {
+				return
+			}
+			question := r.Question[0]
+			header := dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: question.Qtype,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			}
+
+			m := new(dns.Msg)
+			m.SetReply(r)
+
+			switch {
+			case question.Qtype == dns.TypeA && question.Name == dns.Fqdn(h2Domain):
+				m.Answer = []dns.RR{&dns.A{Hdr: header, A: net.ParseIP(poisonedIP)}}
+			case question.Qtype == dns.TypeA && question.Name == dns.Fqdn(h3Domain):
+				m.Answer = []dns.RR{&dns.A{Hdr: header, A: net.ParseIP(h3IP)}}
+			case question.Qtype == dns.TypeHTTPS && question.Name == dns.Fqdn(h2Domain):
+				m.Answer = []dns.RR{&dns.HTTPS{SVCB: dns.SVCB{
+					Hdr:      header,
+					Priority: 1,
+					Target:   ".",
+					Value: []dns.SVCBKeyValue{
+						&dns.SVCBAlpn{Alpn: []string{"h2"}},
+						&dns.SVCBNoDefaultAlpn{},
+						&dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP(hintIP).To4()}},
+					},
+				}}}
+			case question.Qtype == dns.TypeHTTPS && question.Name == dns.Fqdn(h3Domain):
+				m.Answer = []dns.RR{&dns.HTTPS{SVCB: dns.SVCB{
+					Hdr:      header,
+					Priority: 1,
+					Target:   ".",
+					Value: []dns.SVCBKeyValue{
+						&dns.SVCBAlpn{Alpn: []string{"h3", "h2"}},
+					},
+				}}}
+			}
+
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer func() {
+		udpConn.Close()
+		server.Shutdown()
+	}()
+
+	networkID := "networkID-1"
+
+	dnsResolver := resolver.NewResolver(
+		&resolver.NetworkConfig{
+			GetDNSServers:          func() []string { return []string{udpConn.LocalAddr().String()} },
+			PoisonedIPAddressCIDRs: []string{poisonedIP + "/32"},
+		},
+		networkID)
+	defer dnsResolver.Stop()
+
+	resolveIP := func(tunnelProtocol, hostname string) ([]net.IP, bool, error) {
+
+		dialParams := &DialParameters{
+			TunnelProtocol: tunnelProtocol,
+			resolver:       dnsResolver,
+			ResolveParameters: &resolver.ResolveParameters{
+				AttemptsPerServer:          1,
+				AttemptsPerPreferredServer: 1,
+				RequestTimeout:             1 * time.Second,
+				UseHTTPSRecords:            true,
+			},
+		}
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelFunc()
+
+		IPs, err := dialParams.resolveIPWithHTTPSRecords(ctx, networkID, hostname)
+		return IPs, dialParams.usedHTTPSIPHints == 1, err
+	}
+
+	// When A resolution fails due to poisoning, the HTTPS record IP hints are
+	// used.
+
+	IPs, usedHints, err := resolveIP(protocol.TUNNEL_PROTOCOL_FRONTED_MEEK, h2Domain)
+	if err != nil {
+		t.Fatalf("resolveIPWithHTTPSRecords failed: %s", err)
+	}
+	if len(IPs) != 1 || IPs[0].String() != hintIP || !usedHints {
+		t.Fatalf("unexpected IPs: %v, %v", IPs, usedHints)
+	}
+
+	// QUIC fails immediately when the HTTPS records don't advertise HTTP/3.
+
+	_, _, err = resolveIP(protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_QUIC_OBFUSCATED_SSH, h2Domain)
+	if err == nil {
+		t.Fatalf("resolveIPWithHTTPSRecords unexpectedly succeeded")
+	}
+
+	// QUIC proceeds with the A records when the HTTPS records advertise
+	// HTTP/3.
+
+	IPs, usedHints, err = resolveIP(protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_QUIC_OBFUSCATED_SSH, h3Domain)
+	if err != nil {
+		t.Fatalf("resolveIPWithHTTPSRecords failed: %s", err)
+	}
+	if len(IPs) != 1 || IPs[0].String() != h3IP || usedHints {
+		t.Fatalf("unexpected IPs: %v, %v", IPs, usedHints)
+	}
+}
@@ -20,11 +20,14 @@
 package psiphon
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/exchange"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/parameters"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
 	"golang.org/x/crypto/nacl/secretbox"
 )
@@ -40,7 +43,8 @@ import (
 //
 // Only signed server entries will be exchanged. The signature is created by
 // the Psiphon Network and may be verified using the
-// ServerEntrySignaturePublicKey embedded in clients. This signture defends
+// ServerEntrySignaturePublicKey embedded in clients, or with any of the
+// ServerEntrySignaturePublicKeys set by tactics. This signture defends
 // against attacks by rogue clients and man-in-the-middle operatives which
 // could otherwise cause the importer to receive phony server entry values.
 //
@@ -105,6 +109,88 @@ func ImportExchangePayload(config *Config, encodedPayload string) bool {
 	return true
 }
 
+// ExportExchangePayloadQRFrames creates an exchange payload, as
+// ExportExchangePayload does, and splits it into frames for display as a
+// sequence of QR codes. The receiver reassembles the payload from scanned
+// frames using an exchange.QRFrameAssembler.
+//
+// The return value is nil when the export failed, in which case a
+// diagnostic notice has been logged.
+func ExportExchangePayloadQRFrames(config *Config) []string {
+	payload, err := exportExchangePayload(config)
+	if err == nil {
+		var frames []string
+		frames, err = exchange.EncodeQRFrames(
+			payload,
+			config.GetParameters().Get().Int(parameters.ExchangeQRFrameDataSize))
+		if err == nil {
+			return frames
+		}
+	}
+	NoticeWarning("ExportExchangePayloadQRFrames failed: %s", errors.Trace(err))
+	return nil
+}
+
+// StartExchangeLANOffer starts offering exchange payloads to peers on the
+// local network. A fresh payload is exported for each transfer. Each
+// transfer request is first passed to confirmTransfer, which should prompt
+// the user and return true to allow the transfer. The offer code, from
+// LANOffer.Code, must be shown to the receiving user, who passes it to
+// DiscoverExchangeLANOffers and ReceiveExchangeLANOffer. See the comment in
+// exchange.LANOffer for privacy considerations: the offer should be started
+// only at the user's request, and stopped once the exchange is done.
+func StartExchangeLANOffer(
+	config *Config,
+	confirmTransfer func(ctx context.Context, peerIPAddress string) bool) (*exchange.LANOffer, error) {
+
+	p := config.GetParameters().Get()
+
+	offer, err := exchange.StartLANOffer(
+		&exchange.LANOfferConfig{
+			GetPayload: func() (string, error) {
+				return exportExchangePayload(config)
+			},
+			ConfirmTransfer:     confirmTransfer,
+			TransferLimit:       p.Int(parameters.ExchangeLANOfferTransferLimit),
+			TransferLimitPeriod: p.Duration(parameters.ExchangeLANOfferTransferLimitPeriod),
+			ConfirmTimeout:      p.Duration(parameters.ExchangeLANOfferConfirmTimeout),
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return offer, nil
+}
+
+// DiscoverExchangeLANOffers returns the addresses of exchange LAN offers,
+// with the specified offer code, that respond to discovery before ctx is
+// done.
+func DiscoverExchangeLANOffers(
+	ctx context.Context, offerCode string) ([]string, error) {
+
+	addresses, err := exchange.DiscoverLANOffers(ctx, offerCode)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return addresses, nil
+}
+
+// ReceiveExchangeLANOffer fetches an exchange payload from the LAN offer,
+// with the specified offer code, at the specified address. The payload is
+// not imported; the caller should pass the payload to ImportExchangePayload,
+// after any confirmation from the receiving user.
+func ReceiveExchangeLANOffer(
+	ctx context.Context, offerCode, address string) (string, error) {
+
+	payload, err := exchange.ReceiveLANOffer(ctx, offerCode, address)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return payload, nil
+}
+
 type exchangePayload struct {
 	ServerEntryFields       protocol.ServerEntryFields
 	ExchangedDialParameters *ExchangedDialParameters
@@ -120,7 +206,7 @@ func exportExchangePayload(config *Config) (string, error) {
 	}
 
 	serverEntryFields, dialParams, err :=
-		GetAffinityServerEntryAndDialParameters(networkID)
+		GetAffinityServerEntryAndDialParameters(config, networkID)
 	if err != nil {
 		return "", errors.Trace(err)
 	}
@@ -207,8 +293,8 @@ func importExchangePayload(config *Config, encodedPayload string) error {
 	// imported.
 	payload.ServerEntryFields.RemoveUnsignedFields()
 
-	err = payload.ServerEntryFields.VerifySignature(
-		config.ServerEntrySignaturePublicKey)
+	err = payload.ServerEntryFields.VerifySignatureWithKeys(
+		config.GetServerEntrySignaturePublicKeys())
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -226,7 +312,7 @@ func importExchangePayload(config *Config, encodedPayload string) error {
 	//
 	// TODO: refactor existing code to allow reuse in a single transaction?
 
-	err = StoreServerEntry(payload.ServerEntryFields, true)
+	err = StoreServerEntry(config, payload.ServerEntryFields, true)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -258,6 +344,7 @@ func importExchangePayload(config *Config, encodedPayload string) error {
 				serverEntry)
 
 			err = SetDialParameters(
+				config,
 				payload.ServerEntryFields.GetIPAddress(),
 				networkID,
 				dialParams)
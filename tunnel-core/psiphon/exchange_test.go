@@ -96,7 +96,7 @@ func TestServerEntryExchange(t *testing.T) {
 	if err != nil {
 		t.Fatalf("OpenDataStore failed: %s", err)
 	}
-	defer CloseDataStore()
+	defer CloseDataStore(config)
 
 	// Generate server entries to test different cases
 	//
@@ -158,7 +158,7 @@ func TestServerEntryExchange(t *testing.T) {
 		fields.SetLocalTimestamp(
 			common.TruncateTimestampToHour(common.GetCurrentTimestamp()))
 
-		err = StoreServerEntry(fields, true)
+		err = StoreServerEntry(config, fields, true)
 		if err != nil {
 			t.Fatalf("StoreServerEntry failed: %s", err)
 		}
@@ -196,7 +196,7 @@ func TestServerEntryExchange(t *testing.T) {
 				t.Fatalf("MakeDialParameters failed: %s", err)
 			}
 
-			err = SetDialParameters(serverEntry.IpAddress, networkID, dialParams)
+			err = SetDialParameters(config, serverEntry.IpAddress, networkID, dialParams)
 			if err != nil {
 				t.Fatalf("SetDialParameters failed: %s", err)
 			}
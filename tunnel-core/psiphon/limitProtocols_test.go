@@ -133,9 +133,9 @@ func TestLimitTunnelProtocols(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error initializing client datastore: %s", err)
 	}
-	defer CloseDataStore()
+	defer CloseDataStore(clientConfig)
 
-	if CountServerEntries() > 0 {
+	if CountServerEntries(clientConfig) > 0 {
 		t.Fatalf("unexpected server entries")
 	}
 
@@ -171,7 +171,7 @@ func TestLimitTunnelProtocols(t *testing.T) {
 
 		serverEntryFields["ipAddress"] = fmt.Sprintf("0.1.%d.%d", (i>>8)&0xFF, i&0xFF)
 
-		err = StoreServerEntry(serverEntryFields, true)
+		err = StoreServerEntry(clientConfig, serverEntryFields, true)
 		if err != nil {
 			t.Fatalf("error storing server entry: %s", err)
 		}
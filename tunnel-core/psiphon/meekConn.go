@@ -20,6 +20,7 @@
 package psiphon
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/rand"
@@ -47,6 +48,7 @@ import (
 	"github.com/ooni/psiphon/tunnel-core/psiphon/upstreamproxy"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
 )
 
 // MeekConn is based on meek-client.go from Tor:
@@ -125,6 +127,13 @@ type MeekConfig struct {
 	// UseHTTPS indicates whether to use HTTPS (true) or HTTP (false).
 	UseHTTPS bool
 
+	// UseWebSocket indicates whether to attempt to upgrade to a WebSocket,
+	// which relays the net.Conn flow in binary WebSocket frames instead of
+	// in polling HTTP requests and responses. When the upgrade fails,
+	// MeekConn falls back to polling. UseWebSocket applies only to
+	// MeekModeRelay and is ignored when UseQUIC is set.
+	UseWebSocket bool
+
 	// TLSProfile specifies the value for CustomTLSConfig.TLSProfile for all
 	// underlying TLS connections created by this meek connection.
 	TLSProfile string
@@ -214,6 +223,8 @@ type MeekConn struct {
 	cookieSize                int
 	tlsPadding                int
 	limitRequestPayloadLength int
+	tlsJA3                    string
+	tlsJA4                    string
 	redialTLSProbability      float64
 	cachedTLSDialer           *cachedTLSDialer
 	transport                 transporter
@@ -230,6 +241,8 @@ type MeekConn struct {
 	clientTunnelProtocol          string
 
 	// For MeekModeRelay
+	webSocketConn           net.Conn
+	resumeFallbackResponse  bool
 	fullReceiveBufferLength int
 	readPayloadChunkLength  int
 	emptyReceiveBuffer      chan *bytes.Buffer
@@ -341,6 +354,7 @@ func DialMeek(
 		transport         transporter
 		additionalHeaders http.Header
 		proxyUrl          func(*http.Request) (*url.URL, error)
+		webSocketDialer   common.Dialer
 	)
 
 	if meekConfig.UseQUIC {
@@ -431,6 +445,18 @@ func DialMeek(
 		}
 		tlsConfig.EnableClientSessionCache()
 
+		// Record the fingerprints of the first, pre-dialed TLS connection for
+		// metrics. Subsequent redials may differ, for example due to session
+		// resumption.
+		tlsConfig.ClientHelloFingerprintCallback = func(JA3, JA4 string) {
+			meek.mutex.Lock()
+			defer meek.mutex.Unlock()
+			if meek.tlsJA3 == "" {
+				meek.tlsJA3 = JA3
+				meek.tlsJA4 = JA4
+			}
+		}
+
 		if meekConfig.UseObfuscatedSessionTickets {
 			tlsConfig.ObfuscatedSessionTicketKey = meekConfig.MeekObfuscatedKey
 		}
@@ -500,6 +526,10 @@ func DialMeek(
 
 		cachedTLSDialer = newCachedTLSDialer(preConn, tlsDialer)
 
+		// A WebSocket upgrade requires HTTP/1.1. When attempted, the upgrade
+		// uses the pre-dialed connection; if the upgrade then fails, the
+		// polling transport will dial a new TLS connection.
+
 		if IsTLSConnUsingHTTP2(preConn) {
 			NoticeInfo("negotiated HTTP/2 for %s", meekConfig.DiagnosticID)
 			transport = &http2.Transport{
@@ -513,6 +543,9 @@ func DialMeek(
 					return cachedTLSDialer.dial(network, addr)
 				},
 			}
+			webSocketDialer = func(_ context.Context, network, addr string) (net.Conn, error) {
+				return cachedTLSDialer.dial(network, addr)
+			}
 		}
 
 	} else {
@@ -574,6 +607,11 @@ func DialMeek(
 			dialer = func(ctx context.Context, network, _ string) (net.Conn, error) {
 				return baseDialer(ctx, network, meekConfig.DialAddress)
 			}
+
+			// WebSocket upgrades are not attempted in the http.Transport
+			// proxying case above, where the request line is rendered for
+			// the proxy.
+			webSocketDialer = dialer
 		}
 
 		httpTransport := &http.Transport{
@@ -630,13 +668,36 @@ func DialMeek(
 	meek.cachedTLSDialer = cachedTLSDialer
 	meek.transport = transport
 
+	// Attempt the WebSocket upgrade before any polling starts. Failure to
+	// upgrade, including when the CDN or other intermediary doesn't support
+	// WebSockets, is not fatal; the MeekConn falls back to polling, using
+	// any session ID set by the failed upgrade response, or otherwise the
+	// same meek cookie.
+	if meek.mode == MeekModeRelay && meekConfig.UseWebSocket && !meekConfig.UseQUIC {
+		if webSocketDialer == nil {
+			NoticeInfo("WebSocket unavailable for %s", meekConfig.DiagnosticID)
+		} else {
+			webSocketConn, err := meek.dialWebSocket(ctx, webSocketDialer, meekConfig.UseHTTPS)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, errors.Trace(err)
+				}
+				NoticeWarning("WebSocket upgrade failed for %s: %s",
+					meekConfig.DiagnosticID, errors.Trace(err))
+			} else {
+				meek.webSocketConn = webSocketConn
+			}
+		}
+	}
+
 	// stopRunning and cachedTLSDialer will now be closed in meek.Close()
 	cleanupStopRunning = false
 	cleanupCachedTLSDialer = false
 
 	// Allocate relay resources, including buffers and running the relay
-	// go routine, only when running in relay mode.
-	if meek.mode == MeekModeRelay {
+	// go routine, only when running in relay mode and not relaying over a
+	// WebSocket.
+	if meek.mode == MeekModeRelay && meek.webSocketConn == nil {
 
 		// The main loop of a MeekConn is run in the relay() goroutine.
 		// A MeekConn implements net.Conn concurrency semantics:
@@ -759,6 +820,9 @@ func (meek *MeekConn) Close() (err error) {
 		if meek.cachedTLSDialer != nil {
 			meek.cachedTLSDialer.close()
 		}
+		if meek.webSocketConn != nil {
+			meek.webSocketConn.Close()
+		}
 
 		// stopRunning interrupts HTTP requests in progress by closing the context
 		// associated with the request. In the case of h2quic.RoundTripper, testing
@@ -802,7 +866,16 @@ func (meek *MeekConn) GetMetrics() common.LogFields {
 		logFields["meek_cookie_size"] = meek.cookieSize
 		logFields["meek_tls_padding"] = meek.tlsPadding
 		logFields["meek_limit_request"] = meek.limitRequestPayloadLength
+		if meek.webSocketConn != nil {
+			logFields["meek_websocket"] = 1
+		}
 	}
+	meek.mutex.Lock()
+	if meek.tlsJA3 != "" {
+		logFields["tls_ja3"] = meek.tlsJA3
+		logFields["tls_ja4"] = meek.tlsJA4
+	}
+	meek.mutex.Unlock()
 	return logFields
 }
 
@@ -914,6 +987,13 @@ func (meek *MeekConn) Read(buffer []byte) (n int, err error) {
 	if meek.IsClosed() {
 		return 0, errors.TraceNew("meek connection is closed")
 	}
+	if meek.webSocketConn != nil {
+		n, err := meek.webSocketConn.Read(buffer)
+		if err != nil {
+			return n, errors.Trace(err)
+		}
+		return n, nil
+	}
 	// Block until there is received data to consume
 	var receiveBuffer *bytes.Buffer
 	select {
@@ -936,6 +1016,9 @@ func (meek *MeekConn) Write(buffer []byte) (n int, err error) {
 	if meek.IsClosed() {
 		return 0, errors.TraceNew("meek connection is closed")
 	}
+	if meek.webSocketConn != nil {
+		return meek.writeWebSocket(buffer)
+	}
 	// Repeats until all n bytes are written
 	n = len(buffer)
 	for len(buffer) > 0 {
@@ -1289,6 +1372,14 @@ func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 
 	receivedPayloadSize := int64(0)
 
+	// The first polling request after a failed WebSocket upgrade, which the
+	// server handled as a polling request, is sent as a retry, so that the
+	// server resends any response payload it sent with the failed upgrade
+	// response.
+
+	resumeFallbackResponse := meek.resumeFallbackResponse
+	meek.resumeFallbackResponse = false
+
 	for try := 0; ; try++ {
 
 		// Omit the request payload when retrying after receiving a
@@ -1332,7 +1423,7 @@ func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 		// When retrying, add a Range header to indicate how much
 		// of the response was already received.
 
-		if try > 0 {
+		if try > 0 || resumeFallbackResponse {
 			expectedStatusCode = http.StatusPartialContent
 			request.Header.Set("Range", fmt.Sprintf("bytes=%d-", receivedPayloadSize))
 		}
@@ -1471,6 +1562,154 @@ func (meek *MeekConn) addAdditionalHeaders(request *http.Request) {
 	}
 }
 
+// dialWebSocket dials a new connection and performs a WebSocket upgrade
+// using the same URL, Host header, additional headers, and meek cookie as
+// relay requests. The server handles the upgrade request as a new meek
+// session and relays the session flow in binary WebSocket frames.
+//
+// The server may respond with a Set-Cookie session ID, as it does for
+// polling requests. As a WebSocket session ends when the WebSocket
+// connection is closed, the session ID is not used when the upgrade
+// succeeds. When the upgrade fails because an intermediary stripped the
+// Upgrade header, the server handles the request as the first polling
+// request of a new session; in this case, the session ID is used for the
+// polling fallback, and the server doesn't create a second session.
+func (meek *MeekConn) dialWebSocket(
+	ctx context.Context, dialer common.Dialer, useHTTPS bool) (net.Conn, error) {
+
+	ctx, cancelFunc := context.WithTimeout(
+		ctx, meek.getCustomParameters().Duration(parameters.MeekRoundTripTimeout))
+	defer cancelFunc()
+
+	host := meek.url.Host
+	header := make(http.Header)
+	for name, value := range meek.additionalHeaders {
+		if name == "Host" {
+			if len(value) > 0 {
+				host = value[0]
+			}
+		} else {
+			header[name] = value
+		}
+	}
+	header.Set("Cookie", meek.cookie.String())
+
+	scheme, originScheme := "ws", "http"
+	if useHTTPS {
+		scheme, originScheme = "wss", "https"
+	}
+
+	config := &websocket.Config{
+		Location: &url.URL{Scheme: scheme, Host: host, Path: meek.url.Path},
+		Origin:   &url.URL{Scheme: originScheme, Host: host},
+		Version:  websocket.ProtocolVersionHybi13,
+		Header:   header,
+	}
+
+	// As DialAddr is set in the CustomTLSConfig, or the dialer otherwise
+	// ignores the address, no address is required here.
+	conn, err := dialer(ctx, "tcp", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// websocket.NewClient doesn't take a context, so the handshake is
+	// interrupted by closing conn.
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	// websocket.NewClient doesn't return the HTTP response when the upgrade
+	// fails, so the response is recorded as it's read.
+	handshakeConn := &webSocketHandshakeConn{Conn: conn, recording: true}
+
+	webSocketConn, err := websocket.NewClient(config, handshakeConn)
+	close(handshakeDone)
+	handshakeConn.recording = false
+	if err != nil {
+		conn.Close()
+		if ctx.Err() == nil {
+			meek.setFallbackSessionID(handshakeConn.recorded.Bytes())
+		}
+		return nil, errors.Trace(err)
+	}
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, errors.Trace(ctx.Err())
+	}
+
+	webSocketConn.PayloadType = websocket.BinaryFrame
+
+	return webSocketConn, nil
+}
+
+// setFallbackSessionID sets the meek cookie to the session ID in the failed
+// WebSocket upgrade response, when present.
+func (meek *MeekConn) setFallbackSessionID(recordedResponse []byte) {
+
+	response, err := http.ReadResponse(
+		bufio.NewReader(bytes.NewReader(recordedResponse)), nil)
+	if err != nil || response.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+
+	for _, c := range response.Cookies() {
+		if meek.cookie.Name == c.Name {
+			meek.cookie.Value = c.Value
+			meek.resumeFallbackResponse = true
+			break
+		}
+	}
+}
+
+// webSocketHandshakeConn records the data read from a connection during a
+// WebSocket handshake, up to maxWebSocketHandshakeResponseSize bytes.
+type webSocketHandshakeConn struct {
+	net.Conn
+	recording bool
+	recorded  bytes.Buffer
+}
+
+const maxWebSocketHandshakeResponseSize = 65536
+
+func (conn *webSocketHandshakeConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if conn.recording && n > 0 {
+		if remaining := maxWebSocketHandshakeResponseSize - conn.recorded.Len(); remaining > 0 {
+			if remaining > n {
+				remaining = n
+			}
+			conn.recorded.Write(buffer[:remaining])
+		}
+	}
+	// Do not wrap any I/O err returned by Conn
+	return n, err
+}
+
+// writeWebSocket writes buffer to the WebSocket connection. Each WebSocket
+// frame carries no more than limitRequestPayloadLength bytes, which also
+// applies the relay request traffic shaping to WebSocket frames.
+func (meek *MeekConn) writeWebSocket(buffer []byte) (int, error) {
+	n := 0
+	for n < len(buffer) {
+		end := n + meek.limitRequestPayloadLength
+		if end > len(buffer) {
+			end = len(buffer)
+		}
+		written, err := meek.webSocketConn.Write(buffer[n:end])
+		n += written
+		if err != nil {
+			return n, errors.Trace(err)
+		}
+	}
+	return n, nil
+}
+
 // readPayload reads the HTTP response in chunks, making the read buffer available
 // to MeekConn.Read() calls after each chunk; the intention is to allow bytes to
 // flow back to the reader as soon as possible instead of buffering the entire payload.
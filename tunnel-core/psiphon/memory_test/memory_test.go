@@ -133,7 +133,7 @@ func runMemoryTest(t *testing.T, testMode int) {
 	if err != nil {
 		t.Fatalf("error initializing datastore: %s", err)
 	}
-	defer psiphon.CloseDataStore()
+	defer psiphon.CloseDataStore(config)
 
 	var controller *psiphon.Controller
 	var controllerCtx context.Context
@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/parameters"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+)
+
+func TestMigrateTunnel(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-migrate-tunnel-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	var noticesMutex sync.Mutex
+	var infoMessages []string
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil {
+				return
+			}
+			if noticeType == "Info" {
+				noticesMutex.Lock()
+				infoMessages = append(infoMessages, payload["message"].(string))
+				noticesMutex.Unlock()
+			}
+		}))
+	defer SetNoticeWriter(ioutil.Discard)
+
+	countInfoMessages := func(prefix string) int {
+		noticesMutex.Lock()
+		defer noticesMutex.Unlock()
+		count := 0
+		for _, message := range infoMessages {
+			if strings.HasPrefix(message, prefix) {
+				count += 1
+			}
+		}
+		return count
+	}
+
+	publicKey, privateKey, err := protocol.NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	otherPublicKey, otherPrivateKey, err := protocol.NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	configJSON := fmt.Sprintf(`
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "ServerEntrySignaturePublicKey" : "%s"
+    }`, publicKey)
+
+	config, err := LoadConfig([]byte(configJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataRootDirectory = testDataDirName
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	applyParameters := map[string]interface{}{
+		parameters.MigrateTunnelDrainPeriod: "10ms",
+	}
+
+	err = config.SetParameters("", false, applyParameters)
+	if err != nil {
+		t.Fatalf("SetParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore(config)
+
+	makeEncodedServerEntry := func(
+		IPAddress, publicKey, privateKey string) string {
+
+		n := 16
+		fields := make(protocol.ServerEntryFields)
+		fields["ipAddress"] = IPAddress
+		fields["sshPort"] = 22
+		fields["sshUsername"] = prng.HexString(n)
+		fields["sshPassword"] = prng.HexString(n)
+		fields["sshHostKey"] = prng.HexString(n)
+		fields["sshObfuscatedPort"] = 23
+		fields["sshObfuscatedKey"] = prng.HexString(n)
+		fields["capabilities"] = []string{"SSH", "OSSH", "ssh-api-requests"}
+		fields["region"] = "US"
+		fields["configurationVersion"] = 1
+		if publicKey != "" {
+			err := fields.AddSignature(publicKey, privateKey)
+			if err != nil {
+				t.Fatalf("AddSignature failed: %s", err)
+			}
+		}
+		encodedServerEntry, err := protocol.EncodeServerEntryFields(fields)
+		if err != nil {
+			t.Fatalf("EncodeServerEntryFields failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	loadedIPAddress := "192.0.2.1"
+	alternativeIPAddress := "192.0.2.2"
+
+	// Only signed, verified alternative server entries, other than the
+	// loaded server's own, are used.
+
+	handshakeResponse := protocol.HandshakeResponse{
+		ServerTimestamp: common.GetCurrentTimestamp(),
+		Migrate:         true,
+		MigrateServerEntries: []string{
+			makeEncodedServerEntry(alternativeIPAddress, publicKey, privateKey),
+			makeEncodedServerEntry("192.0.2.3", "", ""),
+			makeEncodedServerEntry("192.0.2.4", otherPublicKey, otherPrivateKey),
+			makeEncodedServerEntry(loadedIPAddress, publicKey, privateKey),
+		},
+	}
+
+	migrateServerEntryIPs, err := storeMigrateServerEntries(
+		config, handshakeResponse, loadedIPAddress)
+	if err != nil {
+		t.Fatalf("storeMigrateServerEntries failed: %s", err)
+	}
+
+	if len(migrateServerEntryIPs) != 1 ||
+		migrateServerEntryIPs[0] != alternativeIPAddress {
+
+		t.Fatalf("unexpected migrate server entry IPs: %v", migrateServerEntryIPs)
+	}
+
+	if CountServerEntries(config) != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries(config))
+	}
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+
+	// Closed tunnels are used so that terminating a tunnel doesn't perform
+	// any network operations.
+
+	makeTunnel := func(IPAddress string, serverContext *ServerContext) *Tunnel {
+		return &Tunnel{
+			config: config,
+			dialParams: &DialParameters{
+				ServerEntry: &protocol.ServerEntry{IpAddress: IPAddress},
+			},
+			serverContext: serverContext,
+			mutex:         new(sync.Mutex),
+			isClosed:      true,
+		}
+	}
+
+	loadedTunnel := makeTunnel(
+		loadedIPAddress,
+		&ServerContext{
+			migrate:               true,
+			migrateServerEntryIPs: migrateServerEntryIPs,
+		})
+
+	if !controller.registerTunnel(loadedTunnel) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if !controller.isFullyEstablished() {
+		t.Fatalf("unexpected pool state")
+	}
+
+	// The loaded server asks the client to migrate. The pool is extended by
+	// one, so the client reconnects to an alternative server.
+
+	if !controller.startMigration(loadedTunnel) {
+		t.Fatalf("startMigration failed")
+	}
+
+	controller.promoteMigrateServerEntry(loadedTunnel)
+
+	if countInfoMessages("migrate tunnel") != 1 {
+		t.Fatalf("missing migrate tunnel notice")
+	}
+
+	active, outstanding := controller.numTunnels()
+	if active != 1 || outstanding != 1 {
+		t.Fatalf("unexpected tunnel counts: %d, %d", active, outstanding)
+	}
+
+	// The migrating tunnel remains in use while it's the only active tunnel.
+
+	if controller.getNextActiveTunnel() != loadedTunnel {
+		t.Fatalf("unexpected next active tunnel")
+	}
+
+	alternativeTunnel := makeTunnel(alternativeIPAddress, nil)
+
+	if !controller.registerTunnel(alternativeTunnel) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if !controller.isFullyEstablished() {
+		t.Fatalf("unexpected pool state")
+	}
+
+	// New port forwards use the alternative tunnel.
+
+	for i := 0; i < 4; i++ {
+		if controller.getNextActiveTunnel() != alternativeTunnel {
+			t.Fatalf("unexpected next active tunnel")
+		}
+	}
+
+	// Only one tunnel migrates at a time.
+
+	if controller.startMigration(alternativeTunnel) {
+		t.Fatalf("unexpected startMigration success")
+	}
+
+	// After the drain period, the migrating tunnel is closed.
+
+	controller.scheduleMigrateTunnelDrain()
+
+	var drainedTunnel *Tunnel
+	select {
+	case drainedTunnel = <-controller.signalMigrateTunnelDrained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing drain signal")
+	}
+
+	if drainedTunnel != loadedTunnel {
+		t.Fatalf("unexpected drained tunnel")
+	}
+
+	controller.drainMigratingTunnel(drainedTunnel)
+
+	if countInfoMessages("migrated tunnel drained") != 1 {
+		t.Fatalf("missing migrated tunnel drained notice")
+	}
+
+	if controller.isMigrating() {
+		t.Fatalf("unexpected migrating state")
+	}
+
+	active, outstanding = controller.numTunnels()
+	if active != 1 || outstanding != 0 {
+		t.Fatalf("unexpected tunnel counts: %d, %d", active, outstanding)
+	}
+
+	if controller.getNextActiveTunnel() != alternativeTunnel {
+		t.Fatalf("unexpected next active tunnel")
+	}
+
+	// When a migrating tunnel fails before it's drained, the failure ends the
+	// migration, and the subsequent drain signal is ignored.
+
+	if !controller.startMigration(alternativeTunnel) {
+		t.Fatalf("startMigration failed")
+	}
+
+	controller.endMigration(alternativeTunnel)
+	controller.terminateTunnel(alternativeTunnel)
+
+	controller.drainMigratingTunnel(alternativeTunnel)
+
+	if countInfoMessages("migrated tunnel drained") != 1 {
+		t.Fatalf("unexpected migrated tunnel drained notice")
+	}
+
+	active, outstanding = controller.numTunnels()
+	if active != 0 || outstanding != 1 {
+		t.Fatalf("unexpected tunnel counts: %d, %d", active, outstanding)
+	}
+}
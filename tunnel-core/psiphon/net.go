@@ -169,12 +169,17 @@ type HasIPv6RouteGetter interface {
 // network.
 //
 // The identifier is a string that should indicate the network type and
-// identity; for example "WIFI-<BSSID>" or "MOBILE-<MCC/MNC>". As this network
-// ID is personally identifying, it is only used locally in the client to
-// determine network context and is not sent to the Psiphon server. The
-// identifer will be logged in diagnostics messages; in this case only the
-// substring before the first "-" is logged, so all PII must appear after the
-// first "-".
+// identity; for example "WIFI-<BSSID>", "MOBILE-<MCC/MNC>", or
+// "WIRED-<identifier>" for Ethernet and other wired networks. The "WIFI",
+// "MOBILE", and "WIRED" type prefixes are used to derive the network type
+// reported in metrics and matched by tactics filters; IDs with any other
+// prefix are reported as "UNKNOWN".
+//
+// As this network ID is personally identifying, it is only used locally in
+// the client to determine network context and is not sent to the Psiphon
+// server. The identifer will be logged in diagnostics messages; in this case
+// only the substring before the first "-" is logged, so all PII must appear
+// after the first "-".
 //
 // NetworkIDGetter.GetNetworkID should always return an identifier value, as
 // logic that uses GetNetworkID, including tactics, is intended to proceed
@@ -334,6 +339,15 @@ func NewResolver(config *Config, useBindToDevice bool) *resolver.Resolver {
 		LogHostnames:              config.EmitDiagnosticNetworkParameters,
 		CacheExtensionInitialTTL:  p.Duration(parameters.DNSResolverCacheExtensionInitialTTL),
 		CacheExtensionVerifiedTTL: p.Duration(parameters.DNSResolverCacheExtensionVerifiedTTL),
+		LoadVerifiedCacheEntries: func(
+			networkID string) ([]*resolver.VerifiedCacheEntry, error) {
+			return loadVerifiedDNSCacheEntries(config, networkID)
+		},
+		StoreVerifiedCacheEntries: func(
+			networkID string, entries []*resolver.VerifiedCacheEntry) error {
+			return storeVerifiedDNSCacheEntries(config, networkID, entries)
+		},
+		PoisonedIPAddressCIDRs: p.Strings(parameters.DNSResolverPoisonedIPAddressCIDRs),
 	}
 
 	if config.DNSServerGetter != nil {
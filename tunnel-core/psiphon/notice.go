@@ -507,6 +507,10 @@ func noticeWithDialParameters(noticeType string, dialParams *DialParameters, pos
 			args = append(args, "meekTransformedHostName", dialParams.MeekTransformedHostName)
 		}
 
+		if dialParams.MeekUseWebSocket {
+			args = append(args, "meekUseWebSocket", dialParams.MeekUseWebSocket)
+		}
+
 		if dialParams.SelectedUserAgent {
 			args = append(args, "userAgent", dialParams.UserAgent)
 		}
@@ -544,6 +548,10 @@ func noticeWithDialParameters(noticeType string, dialParams *DialParameters, pos
 			args = append(args, "QUICDisableClientPathMTUDiscovery", dialParams.QUICDisablePathMTUDiscovery)
 		}
 
+		if dialParams.QUICEnableDatagrams {
+			args = append(args, "QUICEnableDatagrams", dialParams.QUICEnableDatagrams)
+		}
+
 		if dialParams.DialDuration > 0 {
 			args = append(args, "dialDuration", dialParams.DialDuration)
 		}
@@ -577,6 +585,11 @@ func noticeWithDialParameters(noticeType string, dialParams *DialParameters, pos
 
 				if postDial {
 					args = append(args, "DNSAttempt", dialParams.ResolveParameters.GetFirstAttemptWithAnswer())
+
+					crossCheckResult := dialParams.ResolveParameters.GetCrossCheckResult()
+					if crossCheckResult != nil {
+						args = append(args, "DNSCrossCheck", *crossCheckResult)
+					}
 				}
 			}
 		}
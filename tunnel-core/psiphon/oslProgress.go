@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/hex"
+	"os"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/osl"
+)
+
+// OSLProgress reports the client's progress towards unlocking the OSLs in
+// its locally cached OSL registry. OSLProgress is intended for debugging OSL
+// seeding and distribution.
+type OSLProgress struct {
+
+	// SLOKs lists all stored SLOKs.
+	SLOKs []*SLOKProgress
+
+	// RegistryAvailable is false when there is no locally cached OSL
+	// registry; in this case, OSLs is empty.
+	RegistryAvailable bool
+
+	// OSLs lists the OSLs in the registry for which the client holds at
+	// least one SLOK, or all OSLs in the registry when requested.
+	OSLs []*OSLFileProgress
+}
+
+// SLOKProgress describes a stored SLOK and the OSLs, in the locally cached
+// OSL registry, that reference it. A SLOK that is referenced by no OSL may
+// have been seeded for a different propagation channel ID or may be outside
+// the range of OSLs in the registry.
+type SLOKProgress struct {
+	ID     string
+	OSLIDs []string
+}
+
+// OSLFileProgress describes the progress towards unlocking a single OSL.
+// KeyShares reports the number of key shares held against the threshold for
+// each level of the OSL key split.
+//
+// ServerEntryCount is the number of server entries imported from the OSL,
+// and Imported is false when the OSL has not been downloaded and imported.
+// An unlocked OSL is imported on the next obfuscated server list fetch.
+type OSLFileProgress struct {
+	ID        string
+	Unlocked  bool
+	KeyShares *osl.KeySharesProgress
+
+	// Imported is based on the server entry count recorded when the OSL is
+	// imported. Clients didn't record this count in earlier versions, so an
+	// OSL imported by an earlier version reports Imported false until it's
+	// downloaded and imported again, which happens only when the OSL file
+	// changes.
+	Imported         bool
+	ServerEntryCount int
+}
+
+// GetOSLProgress returns the client's OSL progress, from the stored SLOKs
+// and the locally cached OSL registry. No network requests are made. When
+// includeUnseeded is set, OSLs for which no SLOKs are held are included.
+//
+// The datastore must be open when GetOSLProgress is called.
+func GetOSLProgress(config *Config, includeUnseeded bool) (*OSLProgress, error) {
+
+	slokIDs, err := GetSLOKIDs(config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	progress := &OSLProgress{}
+
+	sloks := make(map[string]*SLOKProgress)
+
+	for _, slokID := range slokIDs {
+		slok := &SLOKProgress{ID: hex.EncodeToString(slokID)}
+		progress.SLOKs = append(progress.SLOKs, slok)
+		sloks[string(slokID)] = slok
+	}
+
+	// Unlike FetchObfuscatedServerLists, only SLOK IDs are looked up; the
+	// returned non-nil value is a placeholder and not the SLOK key.
+
+	lookupSLOKs := func(slokID []byte) []byte {
+		if _, ok := sloks[string(slokID)]; ok {
+			return slokID
+		}
+		return nil
+	}
+
+	registryFilename := osl.GetOSLRegistryFilename(
+		config.GetObfuscatedServerListDownloadDirectory()) + ".cached"
+
+	registryFile, err := os.Open(registryFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return progress, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	defer registryFile.Close()
+
+	p := config.GetParameters().Get()
+	publicKeys := getRemoteServerListSignaturePublicKeys(p, false)
+	p.Close()
+
+	registryStreamer, err := osl.NewRegistryStreamer(
+		registryFile, publicKeys, lookupSLOKs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	progress.RegistryAvailable = true
+
+	for {
+
+		fileSpec, err := registryStreamer.NextFileSpec()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if fileSpec == nil {
+			break
+		}
+
+		keySharesProgress, err := fileSpec.KeyShares.GetProgress(lookupSLOKs)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		oslID := hex.EncodeToString(fileSpec.ID)
+
+		heldSLOKIDs := getHeldSLOKIDs(keySharesProgress)
+
+		for _, slokID := range heldSLOKIDs {
+			slok := sloks[string(slokID)]
+			if len(slok.OSLIDs) == 0 || slok.OSLIDs[len(slok.OSLIDs)-1] != oslID {
+				slok.OSLIDs = append(slok.OSLIDs, oslID)
+			}
+		}
+
+		if len(heldSLOKIDs) == 0 && !includeUnseeded {
+			continue
+		}
+
+		serverEntryCount, imported, err := GetOSLServerEntryCount(config, fileSpec.ID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		progress.OSLs = append(
+			progress.OSLs,
+			&OSLFileProgress{
+				ID:               oslID,
+				Unlocked:         keySharesProgress.IsUnlocked(),
+				KeyShares:        keySharesProgress,
+				Imported:         imported,
+				ServerEntryCount: serverEntryCount,
+			})
+	}
+
+	return progress, nil
+}
+
+func getHeldSLOKIDs(progress *osl.KeySharesProgress) [][]byte {
+	heldSLOKIDs := append([][]byte(nil), progress.HeldSLOKIDs...)
+	for _, childProgress := range progress.KeyShares {
+		heldSLOKIDs = append(heldSLOKIDs, getHeldSLOKIDs(childProgress)...)
+	}
+	return heldSLOKIDs
+}
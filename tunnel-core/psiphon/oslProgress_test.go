@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/osl"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+)
+
+func TestGetOSLProgress(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-osl-progress-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	// The first scheme requires two SLOKs to unlock each OSL, so a single
+	// seeded SLOK leaves its OSL locked. The second scheme requires one SLOK
+	// to unlock each OSL.
+
+	oslConfigJSONTemplate := `
+    {
+      "Schemes" : [
+        {
+          "Epoch" : "%[1]s",
+          "Regions" : [],
+          "PropagationChannelIDs" : ["%[2]s"],
+          "MasterKey" : "vwab2WY3eNyMBpyFVPtsivMxF4MOpNHM/T7rHJIXctg=",
+          "SeedSpecs" : [
+            {
+              "ID" : "KuP2V6gLcROIFzb/27fUVu4SxtEfm2omUoISlrWv1mA=",
+              "UpstreamSubnets" : ["0.0.0.0/0"],
+              "Targets" :
+              {
+                  "BytesRead" : 1,
+                  "BytesWritten" : 1,
+                  "PortForwardDurationNanoseconds" : 1
+              }
+            }
+          ],
+          "SeedSpecThreshold" : 1,
+          "SeedPeriodNanoseconds" : %[3]d,
+          "SeedPeriodKeySplits": [
+            {
+              "Total": 2,
+              "Threshold": 2
+            }
+          ]
+        },
+        {
+          "Epoch" : "%[1]s",
+          "Regions" : [],
+          "PropagationChannelIDs" : ["%[2]s"],
+          "MasterKey" : "HDc/mvd7e+lKDJD0fMpJW66YJ/VW4iqDRjeclEsMnro=",
+          "SeedSpecs" : [
+            {
+              "ID" : "/M0vsT0IjzmI0MvTI9IYe8OVyeQGeaPZN2xGxfLw/UQ=",
+              "UpstreamSubnets" : ["0.0.0.0/0"],
+              "Targets" :
+              {
+                  "BytesRead" : 1,
+                  "BytesWritten" : 1,
+                  "PortForwardDurationNanoseconds" : 1
+              }
+            }
+          ],
+          "SeedSpecThreshold" : 1,
+          "SeedPeriodNanoseconds" : %[3]d,
+          "SeedPeriodKeySplits": [
+            {
+              "Total": 1,
+              "Threshold": 1
+            }
+          ]
+        }
+      ]
+    }`
+
+	seedPeriod := time.Hour
+	epoch := time.Now().UTC().Truncate(2 * seedPeriod)
+	epochStr := epoch.Format(time.RFC3339Nano)
+
+	propagationChannelID := prng.HexString(8)
+
+	oslConfig, err := osl.LoadConfig([]byte(fmt.Sprintf(
+		oslConfigJSONTemplate, epochStr, propagationChannelID, seedPeriod)))
+	if err != nil {
+		t.Fatalf("error loading OSL config: %s", err)
+	}
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("error generating package keys: %s", err)
+	}
+
+	// Pave 2 OSLs for the first scheme and 3 OSLs for the second scheme. The
+	// current seed period falls in the first OSL of the first scheme and in
+	// one of the first 2 OSLs of the second scheme.
+
+	paveFiles, err := oslConfig.Pave(
+		time.Time{},
+		epoch.Add(2*seedPeriod),
+		propagationChannelID,
+		signingPublicKey,
+		signingPrivateKey,
+		map[string][]string{},
+		nil,
+		nil,
+		nil)
+	if err != nil {
+		t.Fatalf("error paving OSL files: %s", err)
+	}
+
+	var registryPackage []byte
+	for _, paveFile := range paveFiles {
+		if paveFile.Name == osl.REGISTRY_FILENAME {
+			registryPackage = paveFile.Contents
+		}
+	}
+	if registryPackage == nil {
+		t.Fatalf("missing OSL registry")
+	}
+
+	expectedOSLCount := 5
+
+	// The root URL is not fetched; it's required for the signature public
+	// key to be applied.
+
+	configJSON := fmt.Sprintf(`
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "ObfuscatedServerListRootURLs" : [{"URL" : "%s"}],
+        "RemoteServerListSignaturePublicKey" : "%s"
+    }`,
+		base64.StdEncoding.EncodeToString([]byte("http://127.0.0.1/osl")),
+		signingPublicKey)
+
+	config, err := LoadConfig([]byte(configJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataRootDirectory = testDataDirName
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore(config)
+
+	// Seed one SLOK for each scheme, and store an additional SLOK that is
+	// referenced by no OSL in the registry.
+
+	seedState := oslConfig.NewClientSeedState("", propagationChannelID, nil)
+	seedPortForward := seedState.NewClientSeedPortForward(net.ParseIP("0.0.0.0"))
+	seedPortForward.UpdateProgress(1, 1, 1)
+	payload := seedState.GetSeedPayload()
+	if len(payload.SLOKs) != 2 {
+		t.Fatalf("expected 2 SLOKs, got %d", len(payload.SLOKs))
+	}
+
+	seededSLOKIDs := make(map[string]bool)
+	for _, slok := range payload.SLOKs {
+		_, err = SetSLOK(config, slok.ID, slok.Key)
+		if err != nil {
+			t.Fatalf("SetSLOK failed: %s", err)
+		}
+		seededSLOKIDs[hex.EncodeToString(slok.ID)] = true
+	}
+
+	unreferencedSLOKID := prng.Bytes(32)
+	_, err = SetSLOK(config, unreferencedSLOKID, prng.Bytes(32))
+	if err != nil {
+		t.Fatalf("SetSLOK failed: %s", err)
+	}
+
+	// Without a cached registry, only the SLOKs are reported.
+
+	progress, err := GetOSLProgress(config, true)
+	if err != nil {
+		t.Fatalf("GetOSLProgress failed: %s", err)
+	}
+
+	if progress.RegistryAvailable || len(progress.OSLs) != 0 {
+		t.Fatalf("unexpected OSL progress without registry")
+	}
+
+	if len(progress.SLOKs) != 3 {
+		t.Fatalf("unexpected SLOK count: %d", len(progress.SLOKs))
+	}
+
+	for _, slok := range progress.SLOKs {
+		if len(slok.OSLIDs) != 0 {
+			t.Fatalf("unexpected SLOK OSL IDs without registry")
+		}
+	}
+
+	downloadDirectory := config.GetObfuscatedServerListDownloadDirectory()
+
+	err = os.MkdirAll(downloadDirectory, 0700)
+	if err != nil {
+		t.Fatalf("MkdirAll failed: %s", err)
+	}
+
+	err = ioutil.WriteFile(
+		filepath.Join(downloadDirectory, osl.REGISTRY_FILENAME+".cached"),
+		registryPackage,
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	// Check that each seeded SLOK is attributed to exactly one OSL, that
+	// OSL reports the SLOK as held, and the unreferenced SLOK is attributed
+	// to no OSL.
+
+	checkProgress := func(progress *OSLProgress) map[string]*OSLFileProgress {
+
+		if !progress.RegistryAvailable {
+			t.Fatalf("unexpected unavailable registry")
+		}
+
+		if len(progress.SLOKs) != 3 {
+			t.Fatalf("unexpected SLOK count: %d", len(progress.SLOKs))
+		}
+
+		OSLs := make(map[string]*OSLFileProgress)
+		for _, oslProgress := range progress.OSLs {
+			OSLs[oslProgress.ID] = oslProgress
+		}
+
+		for _, slok := range progress.SLOKs {
+
+			if !seededSLOKIDs[slok.ID] {
+				if slok.ID != hex.EncodeToString(unreferencedSLOKID) {
+					t.Fatalf("unexpected SLOK ID: %s", slok.ID)
+				}
+				if len(slok.OSLIDs) != 0 {
+					t.Fatalf("unexpected unreferenced SLOK OSL IDs: %v", slok.OSLIDs)
+				}
+				continue
+			}
+
+			if len(slok.OSLIDs) != 1 {
+				t.Fatalf("unexpected seeded SLOK OSL IDs: %v", slok.OSLIDs)
+			}
+
+			oslProgress, ok := OSLs[slok.OSLIDs[0]]
+			if !ok {
+				t.Fatalf("missing OSL progress: %s", slok.OSLIDs[0])
+			}
+
+			slokID, _ := hex.DecodeString(slok.ID)
+			heldSLOKIDs := getHeldSLOKIDs(oslProgress.KeyShares)
+			if len(heldSLOKIDs) != 1 || !bytes.Equal(heldSLOKIDs[0], slokID) {
+				t.Fatalf("unexpected held SLOK IDs: %v", heldSLOKIDs)
+			}
+		}
+
+		return OSLs
+	}
+
+	progress, err = GetOSLProgress(config, false)
+	if err != nil {
+		t.Fatalf("GetOSLProgress failed: %s", err)
+	}
+
+	OSLs := checkProgress(progress)
+
+	if len(OSLs) != 2 {
+		t.Fatalf("unexpected seeded OSL count: %d", len(OSLs))
+	}
+
+	var unlockedOSL, lockedOSL *OSLFileProgress
+	for _, oslProgress := range OSLs {
+		if oslProgress.Unlocked {
+			unlockedOSL = oslProgress
+		} else {
+			lockedOSL = oslProgress
+		}
+		if oslProgress.Imported || oslProgress.ServerEntryCount != 0 {
+			t.Fatalf("unexpected imported OSL: %s", oslProgress.ID)
+		}
+	}
+
+	if unlockedOSL == nil || lockedOSL == nil {
+		t.Fatalf("expected one unlocked and one locked OSL")
+	}
+
+	// The locked OSL holds 1 of the 2 seed period key shares required to
+	// unlock.
+
+	keyShares := lockedOSL.KeyShares
+	if keyShares.Held != 1 || keyShares.Threshold != 2 || keyShares.Total != 2 {
+		t.Fatalf("unexpected locked OSL key shares: %+v", keyShares)
+	}
+
+	// Record a server entry count for the unlocked OSL, as is done when an
+	// OSL is imported.
+
+	unlockedOSLID, _ := hex.DecodeString(unlockedOSL.ID)
+	err = SetOSLServerEntryCount(config, unlockedOSLID, 3)
+	if err != nil {
+		t.Fatalf("SetOSLServerEntryCount failed: %s", err)
+	}
+
+	progress, err = GetOSLProgress(config, true)
+	if err != nil {
+		t.Fatalf("GetOSLProgress failed: %s", err)
+	}
+
+	OSLs = checkProgress(progress)
+
+	if len(OSLs) != expectedOSLCount {
+		t.Fatalf("unexpected OSL count: %d", len(OSLs))
+	}
+
+	for _, oslProgress := range OSLs {
+
+		switch oslProgress.ID {
+		case unlockedOSL.ID:
+			if !oslProgress.Unlocked ||
+				!oslProgress.Imported ||
+				oslProgress.ServerEntryCount != 3 {
+				t.Fatalf("unexpected imported OSL progress: %+v", oslProgress)
+			}
+		case lockedOSL.ID:
+			if oslProgress.Unlocked || oslProgress.Imported {
+				t.Fatalf("unexpected locked OSL progress: %+v", oslProgress)
+			}
+		default:
+			if oslProgress.Unlocked ||
+				oslProgress.Imported ||
+				len(getHeldSLOKIDs(oslProgress.KeyShares)) != 0 {
+				t.Fatalf("unexpected unseeded OSL progress: %+v", oslProgress)
+			}
+		}
+	}
+}
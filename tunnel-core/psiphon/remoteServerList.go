@@ -23,8 +23,10 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -39,12 +41,17 @@ type RemoteServerListFetcher func(
 	ctx context.Context, config *Config, attempt int, tunnel *Tunnel, untunneledDialConfig *DialConfig) error
 
 // FetchCommonRemoteServerList downloads the common remote server list from
-// config.RemoteServerListURLs. It validates its digital signature using the
-// public key config.RemoteServerListSignaturePublicKey and parses the
-// data field into ServerEntry records.
+// config.RemoteServerListURLs. It validates its digital signatures using the
+// trusted remote server list signing keys, as returned by
+// getRemoteServerListSignaturePublicKeys, and parses the data field into
+// ServerEntry records.
 // config.GetRemoteServerListDownloadFilename() is the location to store the
 // download. As the download is resumed after failure, this filename must
 // be unique and persistent.
+//
+// When RemoteServerListDeltaRootURLs is configured, FetchCommonRemoteServerList
+// first attempts to update to the latest list version using deltas, and only
+// downloads the full list when that fails. See fetchRemoteServerListDeltas.
 func FetchCommonRemoteServerList(
 	ctx context.Context,
 	config *Config,
@@ -55,11 +62,33 @@ func FetchCommonRemoteServerList(
 	NoticeInfo("fetching common remote server list")
 
 	p := config.GetParameters().Get()
-	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	publicKeys := getRemoteServerListSignaturePublicKeys(p, true)
 	urls := p.TransferURLs(parameters.RemoteServerListURLs)
+	deltaURLs := p.TransferURLs(parameters.RemoteServerListDeltaRootURLs)
+	maxDeltaChainLength := p.Int(parameters.RemoteServerListDeltaMaxChainLength)
 	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
 	p.Close()
 
+	if len(deltaURLs) > 0 {
+
+		upToDate, err := fetchRemoteServerListDeltas(
+			ctx,
+			config,
+			attempt,
+			tunnel,
+			untunneledDialConfig,
+			downloadTimeout,
+			deltaURLs,
+			maxDeltaChainLength,
+			publicKeys)
+		if err != nil {
+			NoticeWarning("failed to fetch remote server list deltas: %s", errors.Trace(err))
+			// Fall back to downloading the full list.
+		} else if upToDate {
+			return nil
+		}
+	}
+
 	downloadURL := urls.Select(attempt)
 	canonicalURL := urls.CanonicalURL()
 
@@ -95,8 +124,8 @@ func FetchCommonRemoteServerList(
 	}
 	defer file.Close()
 
-	serverListPayloadReader, err := common.NewAuthenticatedDataPackageReader(
-		file, publicKey)
+	serverListPayloadReader, err := common.NewAuthenticatedDataPackageReaderWithKeys(
+		file, publicKeys)
 	if err != nil {
 		return errors.Tracef("failed to read remote server list: %s", errors.Trace(err))
 	}
@@ -104,21 +133,65 @@ func FetchCommonRemoteServerList(
 	// NewAuthenticatedDataPackageReader authenticates the file before returning.
 	authenticatedDownload = true
 
-	err = StreamingStoreServerEntries(
+	// The list version is computed as the payload is streamed and is the
+	// starting point for subsequent delta updates.
+	versionReader := protocol.NewServerListVersionReader(serverListPayloadReader)
+
+	// Server entry tags are collected only for delta mode pruning.
+	var serverEntryTags map[string]bool
+	if len(deltaURLs) > 0 {
+		serverEntryTags = make(map[string]bool)
+	}
+
+	_, err = streamingStoreServerEntries(
 		ctx,
 		config,
 		protocol.NewStreamingServerEntryDecoder(
-			serverListPayloadReader,
+			versionReader,
 			common.GetCurrentTimestamp(),
 			protocol.SERVER_ENTRY_SOURCE_REMOTE),
-		true)
+		true,
+		serverEntryTags)
 	if err != nil {
 		return errors.Tracef("failed to store common remote server list: %s", errors.Trace(err))
 	}
 
+	// In delta mode, remove server entries dropped from the list, as a delta
+	// update would. The list version is only recorded when the stored server
+	// entries match the full list, so that subsequent deltas are applied to
+	// the same set of server entries the publisher used to compute them.
+	//
+	// Without deltas, server entries dropped from the list are retained, as
+	// they may still be usable, and no version is recorded. When deltas are
+	// later enabled, the first fetch then downloads and prunes to the full
+	// list.
+
+	version := ""
+	if len(deltaURLs) > 0 {
+		var prunedCount int
+		prunedCount, err = pruneRemoteServerListEntries(config, serverEntryTags)
+		if err == nil {
+			if prunedCount > 0 {
+				NoticeInfo("pruned %d common remote server list entries", prunedCount)
+			}
+			version, err = versionReader.Version()
+		}
+		if err != nil {
+			NoticeWarning("failed to update common remote server list: %s", errors.Trace(err))
+			// This fetch is still reported as a success. Clearing the version
+			// ensures that the next delta update falls back to the full list.
+			version = ""
+		}
+	}
+
+	err = SetKeyValue(config, datastoreRemoteServerListVersionKey, version)
+	if err != nil {
+		NoticeWarning("failed to set common remote server list version: %s", errors.Trace(err))
+	}
+
 	// Now that the server entries are successfully imported, store the response
 	// ETag so we won't re-download this same data again.
-	err = SetUrlETag(canonicalURL, newETag)
+	err = SetUrlETag(config, canonicalURL, newETag)
 	if err != nil {
 		NoticeWarning("failed to set ETag for common remote server list: %s", errors.Trace(err))
 		// This fetch is still reported as a success, even if we can't store the etag
@@ -127,6 +200,201 @@ func FetchCommonRemoteServerList(
 	return nil
 }
 
+// fetchRemoteServerListDeltas attempts to update the stored common remote
+// server list to the latest version by following the chain of delta packages
+// starting from the current version, which is the version of the last full
+// list or delta imported. The return value indicates whether the stored list
+// is now the latest version. When there's no current version, false is
+// returned and the caller should download the full list. Any error,
+// including a missing delta, indicates a broken chain and the caller should
+// also download the full list.
+//
+// The stored list version advances as each delta is applied, so a chain
+// that's partially applied before a failure is resumed from the last applied
+// delta.
+func fetchRemoteServerListDeltas(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadTimeout time.Duration,
+	urls parameters.TransferURLs,
+	maxChainLength int,
+	publicKeys *common.AuthenticatedDataPackageKeys) (bool, error) {
+
+	version, err := GetKeyValue(config, datastoreRemoteServerListVersionKey)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if version == "" {
+		return false, nil
+	}
+
+	rootURL := urls.Select(attempt)
+	canonicalRootURL := urls.CanonicalURL()
+
+	for i := 0; i < maxChainLength; i++ {
+
+		downloadURL := protocol.GetServerListDeltaURL(rootURL.URL, version)
+		canonicalURL := protocol.GetServerListDeltaURL(canonicalRootURL, version)
+
+		newETag, delta, err := downloadRemoteServerListDelta(
+			ctx,
+			config,
+			tunnel,
+			untunneledDialConfig,
+			downloadTimeout,
+			downloadURL,
+			canonicalURL,
+			rootURL.SkipVerify,
+			publicKeys)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+
+		// When the resource is unchanged, the current version's delta is still
+		// the terminal delta that was previously downloaded.
+		if newETag == "" {
+			return true, nil
+		}
+
+		if delta.FromVersion != version {
+			return false, errors.TraceNew("unexpected delta version")
+		}
+
+		if delta.IsTerminal() {
+
+			// Store the ETag of the terminal delta so that, until a new version
+			// is published, subsequent fetches don't re-download the delta.
+			err = SetUrlETag(config, canonicalURL, newETag)
+			if err != nil {
+				NoticeWarning("failed to set ETag for remote server list delta: %s", errors.Trace(err))
+				// This fetch is still reported as a success, even if we can't store the ETag
+			}
+
+			return true, nil
+		}
+
+		err = deleteRemoteServerListEntries(config, delta.RemovedServerEntryTags)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+
+		err = StreamingStoreServerEntries(
+			ctx,
+			config,
+			protocol.NewStreamingServerEntryDecoder(
+				strings.NewReader(strings.Join(delta.AddedServerEntries, "\n")),
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_REMOTE),
+			true)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+
+		err = SetKeyValue(config, datastoreRemoteServerListVersionKey, delta.ToVersion)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+
+		// The previous version's delta will not be fetched again, so discard
+		// any stored ETag.
+		_ = SetUrlETag(config, canonicalURL, "")
+
+		NoticeInfo(
+			"applied remote server list delta: %d added, %d removed",
+			len(delta.AddedServerEntries), len(delta.RemovedServerEntryTags))
+
+		version = delta.ToVersion
+	}
+
+	return false, errors.TraceNew("delta chain exceeds maximum length")
+}
+
+// downloadRemoteServerListDelta downloads and authenticates the delta
+// package at the specified URL. When the resource is unchanged, blank is
+// returned for the ETag, and the returned delta is nil.
+func downloadRemoteServerListDelta(
+	ctx context.Context,
+	config *Config,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadTimeout time.Duration,
+	downloadURL string,
+	canonicalURL string,
+	skipVerify bool,
+	publicKeys *common.AuthenticatedDataPackageKeys) (string, *protocol.ServerListDelta, error) {
+
+	downloadFilename := config.GetRemoteServerListDeltaDownloadFilename()
+
+	newETag, downloadStatRecorder, err := downloadRemoteServerListFile(
+		ctx,
+		config,
+		tunnel,
+		untunneledDialConfig,
+		downloadTimeout,
+		downloadURL,
+		canonicalURL,
+		skipVerify,
+		"",
+		downloadFilename)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	authenticatedDownload := false
+	if downloadStatRecorder != nil {
+		defer func() { downloadStatRecorder(authenticatedDownload) }()
+	}
+
+	if newETag == "" {
+		return "", nil, nil
+	}
+
+	deltaPackage, err := ioutil.ReadFile(downloadFilename)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	delta, err := protocol.ReadServerListDeltaPackage(deltaPackage, publicKeys)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	authenticatedDownload = true
+
+	return newETag, delta, nil
+}
+
+// getRemoteServerListSignaturePublicKeys returns the trusted remote server
+// list signing keys. The RemoteServerListSignaturePublicKeys parameter, which
+// may be set by tactics in order to rotate or revoke signing keys, takes
+// precedence over the single RemoteServerListSignaturePublicKey. When
+// applyThreshold is set, the RemoteServerListSignatureThreshold number of
+// trusted keys must have signed a package; otherwise, any one trusted key
+// suffices.
+func getRemoteServerListSignaturePublicKeys(
+	p parameters.ParametersAccessor,
+	applyThreshold bool) *common.AuthenticatedDataPackageKeys {
+
+	publicKeys := p.Strings(parameters.RemoteServerListSignaturePublicKeys)
+	if len(publicKeys) == 0 {
+		publicKeys = []string{p.String(parameters.RemoteServerListSignaturePublicKey)}
+	}
+
+	threshold := 1
+	if applyThreshold {
+		threshold = p.Int(parameters.RemoteServerListSignatureThreshold)
+	}
+
+	return &common.AuthenticatedDataPackageKeys{
+		PublicKeys: publicKeys,
+		Threshold:  threshold,
+	}
+}
+
 // FetchObfuscatedServerLists downloads the obfuscated remote server lists
 // from config.ObfuscatedServerListRootURLs.
 // It first downloads the OSL registry, and then downloads each seeded OSL
@@ -134,7 +402,8 @@ func FetchCommonRemoteServerList(
 // to skip both an unchanged registry or unchanged OSL files, and when an
 // individual download fails, the fetch proceeds if it can.
 // Authenticated package digital signatures are validated using the
-// public key config.RemoteServerListSignaturePublicKey.
+// trusted remote server list signing keys; the signature threshold is not
+// applied to OSLs.
 // config.GetObfuscatedServerListDownloadDirectory() is the location to store
 // the downloaded files. As  downloads are resumed after failure, this directory
 // must be unique and persistent.
@@ -148,7 +417,7 @@ func FetchObfuscatedServerLists(
 	NoticeInfo("fetching obfuscated remote server lists")
 
 	p := config.GetParameters().Get()
-	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	publicKeys := getRemoteServerListSignaturePublicKeys(p, false)
 	urls := p.TransferURLs(parameters.ObfuscatedServerListRootURLs)
 	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
 	p.Close()
@@ -165,7 +434,7 @@ func FetchObfuscatedServerLists(
 	// the registry, so clear the ETag to ensure that always happens.
 	_, err := os.Stat(cachedFilename)
 	if os.IsNotExist(err) {
-		SetUrlETag(canonicalURL, "")
+		SetUrlETag(config, canonicalURL, "")
 	}
 
 	// failed is set if any operation fails and should trigger a retry. When the OSL registry
@@ -214,7 +483,7 @@ func FetchObfuscatedServerLists(
 
 	lookupSLOKs := func(slokID []byte) []byte {
 		// Lookup SLOKs in local datastore
-		key, err := GetSLOK(slokID)
+		key, err := GetSLOK(config, slokID)
 		if err != nil && atomic.CompareAndSwapInt32(&emittedGetSLOKAlert, 0, 1) {
 			NoticeWarning("GetSLOK failed: %s", err)
 		}
@@ -229,7 +498,7 @@ func FetchObfuscatedServerLists(
 
 	registryStreamer, err := osl.NewRegistryStreamer(
 		registryFile,
-		publicKey,
+		publicKeys,
 		lookupSLOKs)
 	if err != nil {
 		// TODO: delete file? redownload if corrupt?
@@ -268,7 +537,7 @@ func FetchObfuscatedServerLists(
 			rootURL.URL,
 			canonicalRootURL,
 			rootURL.SkipVerify,
-			publicKey,
+			publicKeys,
 			lookupSLOKs,
 			oslFileSpec) {
 
@@ -296,7 +565,7 @@ func FetchObfuscatedServerLists(
 			// This fetch is still reported as a success, even if we can't update the cache
 		}
 
-		err = SetUrlETag(canonicalURL, newETag)
+		err = SetUrlETag(config, canonicalURL, newETag)
 		if err != nil {
 			NoticeWarning("failed to set ETag for obfuscated server list registry: %s", errors.Trace(err))
 			// This fetch is still reported as a success, even if we can't store the ETag
@@ -322,7 +591,7 @@ func downloadOSLFileSpec(
 	rootURL string,
 	canonicalRootURL string,
 	skipVerify bool,
-	publicKey string,
+	publicKeys *common.AuthenticatedDataPackageKeys,
 	lookupSLOKs func(slokID []byte) []byte,
 	oslFileSpec *osl.OSLFileSpec) bool {
 
@@ -375,7 +644,7 @@ func downloadOSLFileSpec(
 		file,
 		oslFileSpec,
 		lookupSLOKs,
-		publicKey)
+		publicKeys)
 	if err != nil {
 		NoticeWarning("failed to read obfuscated server list file (%s): %s", hexID, errors.Trace(err))
 		return false
@@ -384,22 +653,30 @@ func downloadOSLFileSpec(
 	// NewOSLReader authenticates the file before returning.
 	authenticatedDownload = true
 
-	err = StreamingStoreServerEntries(
+	serverEntryCount, err := streamingStoreServerEntries(
 		ctx,
 		config,
 		protocol.NewStreamingServerEntryDecoder(
 			serverListPayloadReader,
 			common.GetCurrentTimestamp(),
 			protocol.SERVER_ENTRY_SOURCE_OBFUSCATED),
-		true)
+		true,
+		nil)
 	if err != nil {
 		NoticeWarning("failed to store obfuscated server list file (%s): %s", hexID, errors.Trace(err))
 		return false
 	}
 
+	// Record the server entry count for GetOSLProgress.
+	err = SetOSLServerEntryCount(config, oslFileSpec.ID, serverEntryCount)
+	if err != nil {
+		NoticeWarning("failed to set server entry count for obfuscated server list file (%s): %s", hexID, errors.Trace(err))
+		// This fetch is still reported as a success
+	}
+
 	// Now that the server entries are successfully imported, store the response
 	// ETag so we won't re-download this same data again.
-	err = SetUrlETag(canonicalURL, newETag)
+	err = SetUrlETag(config, canonicalURL, newETag)
 	if err != nil {
 		NoticeWarning("failed to set ETag for obfuscated server list file (%s): %s", hexID, errors.Trace(err))
 		// This fetch is still reported as a success, even if we can't store the ETag
@@ -434,7 +711,7 @@ func downloadRemoteServerListFile(
 
 	// All download URLs with the same canonicalURL
 	// must have the same entity and ETag.
-	lastETag, err := GetUrlETag(canonicalURL)
+	lastETag, err := GetUrlETag(config, canonicalURL)
 	if err != nil {
 		return "", nil, errors.Trace(err)
 	}
@@ -30,10 +30,13 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -44,6 +47,7 @@ import (
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/osl"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/server"
 )
 
@@ -223,9 +227,9 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
 	if err != nil {
 		t.Fatalf("error initializing client datastore: %s", err)
 	}
-	defer CloseDataStore()
+	defer CloseDataStore(&config)
 
-	if CountServerEntries() > 0 {
+	if CountServerEntries(&config) > 0 {
 		t.Fatalf("unexpected server entries")
 	}
 
@@ -237,7 +241,7 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
 		t.Fatalf("expected 1 SLOKs, got %d", len(payload.SLOKs))
 	}
 
-	SetSLOK(payload.SLOKs[0].ID, payload.SLOKs[0].Key)
+	SetSLOK(&config, payload.SLOKs[0].ID, payload.SLOKs[0].Key)
 
 	//
 	// run mock remote server list host
@@ -475,10 +479,388 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
 	for _, paveFile := range paveFiles {
 		u, _ := url.Parse(obfuscatedServerListRootURLs[0])
 		u.Path = path.Join(u.Path, paveFile.Name)
-		etag, _ := GetUrlETag(u.String())
+		etag, _ := GetUrlETag(clientConfig, u.String())
 		md5sum := md5.Sum(paveFile.Contents)
 		if etag != fmt.Sprintf("\"%s\"", hex.EncodeToString(md5sum[:])) {
 			t.Fatalf("unexpected ETag for %s", u)
 		}
 	}
 }
+
+func TestCommonRemoteServerListDeltas(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-remote-server-list-delta-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("error generating package keys: %s", err)
+	}
+
+	signingKeys := []*common.AuthenticatedDataPackageSigningKey{
+		{PublicKey: signingPublicKey, PrivateKey: signingPrivateKey}}
+
+	//
+	// run mock remote server list host
+	//
+
+	var filesMutex sync.Mutex
+	files := make(map[string][]byte)
+	var fullListRequestCount int32
+
+	setFile := func(name string, contents []byte) {
+		filesMutex.Lock()
+		defer filesMutex.Unlock()
+		if contents == nil {
+			delete(files, name)
+		} else {
+			files[name] = contents
+		}
+	}
+
+	httpServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			filesMutex.Lock()
+			contents, ok := files[req.URL.Path]
+			filesMutex.Unlock()
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			if req.URL.Path == "/list" {
+				atomic.AddInt32(&fullListRequestCount, 1)
+			}
+			md5sum := md5.Sum(contents)
+			w.Header().Add("Content-Type", "application/octet-stream")
+			w.Header().Add("ETag", fmt.Sprintf("\"%s\"", hex.EncodeToString(md5sum[:])))
+			http.ServeContent(w, req, req.URL.Path, time.Time{}, bytes.NewReader(contents))
+		}))
+	defer httpServer.Close()
+
+	encodeURL := func(URL string) string {
+		return base64.StdEncoding.EncodeToString([]byte(URL))
+	}
+
+	configJSON := fmt.Sprintf(`
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "RemoteServerListURLs" : [{"URL" : "%s"}],
+        "RemoteServerListDeltaRootURLs" : [{"URL" : "%s"}],
+        "RemoteServerListSignaturePublicKey" : "%s"
+    }`,
+		encodeURL(httpServer.URL+"/list"),
+		encodeURL(httpServer.URL+"/deltas"),
+		signingPublicKey)
+
+	config, err := LoadConfig([]byte(configJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataRootDirectory = testDataDirName
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore(config)
+
+	untunneledDialConfig := &DialConfig{
+		ResolveIP: func(_ context.Context, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP(host)}, nil
+		},
+	}
+
+	//
+	// publish list versions
+	//
+
+	makeServerEntry := func(IPAddress, region string) string {
+		fields := make(protocol.ServerEntryFields)
+		fields["ipAddress"] = IPAddress
+		fields["webServerPort"] = "80"
+		fields["webServerSecret"] = "secret-" + IPAddress
+		fields["region"] = region
+		encodedServerEntry, err := protocol.EncodeServerEntryFields(fields)
+		if err != nil {
+			t.Fatalf("EncodeServerEntryFields failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	a := makeServerEntry("192.0.2.1", "CA")
+	b := makeServerEntry("192.0.2.2", "CA")
+	cFrom := makeServerEntry("192.0.2.3", "CA")
+	cTo := makeServerEntry("192.0.2.3", "US")
+	d := makeServerEntry("192.0.2.4", "CA")
+	e := makeServerEntry("192.0.2.5", "CA")
+	f := makeServerEntry("192.0.2.6", "CA")
+
+	payloads := []string{
+		strings.Join([]string{a, b, cFrom, d}, "\n"),
+		strings.Join([]string{a, cTo, e}, "\n"),
+		strings.Join([]string{a, f}, "\n"),
+	}
+
+	var versions []string
+	for _, payload := range payloads {
+		versions = append(versions, protocol.GetServerListVersion(payload))
+	}
+
+	publishFullList := func(payload string) {
+		listPackage, err := common.WriteAuthenticatedDataPackage(
+			payload, signingPublicKey, signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		setFile("/list", listPackage)
+	}
+
+	publishDelta := func(version string, delta *protocol.ServerListDelta) {
+		if delta == nil {
+			setFile("/deltas/"+version, nil)
+			return
+		}
+		deltaPackage, err := protocol.WriteServerListDeltaPackage(delta, signingKeys)
+		if err != nil {
+			t.Fatalf("WriteServerListDeltaPackage failed: %s", err)
+		}
+		setFile("/deltas/"+version, deltaPackage)
+	}
+
+	makeDelta := func(from, to int) *protocol.ServerListDelta {
+		delta, err := protocol.MakeServerListDelta(payloads[from], payloads[to])
+		if err != nil {
+			t.Fatalf("MakeServerListDelta failed: %s", err)
+		}
+		return delta
+	}
+
+	fetch := func() {
+		err := FetchCommonRemoteServerList(
+			context.Background(), config, 0, nil, untunneledDialConfig)
+		if err != nil {
+			t.Fatalf("FetchCommonRemoteServerList failed: %s", err)
+		}
+	}
+
+	getServerEntries := func() map[string]string {
+		serverEntries := make(map[string]string)
+		err := ScanServerEntries(config, func(serverEntry *protocol.ServerEntry) bool {
+			serverEntries[serverEntry.IpAddress] =
+				serverEntry.Region + "/" + serverEntry.LocalSource
+			return true
+		})
+		if err != nil {
+			t.Fatalf("ScanServerEntries failed: %s", err)
+		}
+		return serverEntries
+	}
+
+	checkVersion := func(expectedVersion string) {
+		version, err := GetKeyValue(config, datastoreRemoteServerListVersionKey)
+		if err != nil {
+			t.Fatalf("GetKeyValue failed: %s", err)
+		}
+		if version != expectedVersion {
+			t.Fatalf("unexpected version: %s", version)
+		}
+	}
+
+	checkFullListRequestCount := func(expectedCount int32) {
+		count := atomic.LoadInt32(&fullListRequestCount)
+		if count != expectedCount {
+			t.Fatalf("unexpected full list request count: %d", count)
+		}
+	}
+
+	remote := "/" + protocol.SERVER_ENTRY_SOURCE_REMOTE
+	obfuscated := "/" + protocol.SERVER_ENTRY_SOURCE_OBFUSCATED
+
+	// Without a current version, the full list is downloaded.
+
+	publishFullList(payloads[0])
+	publishDelta(versions[0], makeDelta(0, 0))
+
+	fetch()
+
+	checkFullListRequestCount(1)
+	checkVersion(versions[0])
+
+	expectedServerEntries := map[string]string{
+		"192.0.2.1": "CA" + remote,
+		"192.0.2.2": "CA" + remote,
+		"192.0.2.3": "CA" + remote,
+		"192.0.2.4": "CA" + remote,
+	}
+	if !reflect.DeepEqual(getServerEntries(), expectedServerEntries) {
+		t.Fatalf("unexpected server entries: %v", getServerEntries())
+	}
+
+	// The terminal delta indicates the list is up to date.
+
+	fetch()
+
+	checkFullListRequestCount(1)
+
+	// A server entry most recently stored from another source isn't deleted
+	// when it's removed from the common remote server list.
+
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		d, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_OBFUSCATED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	err = StoreServerEntry(config, serverEntryFields, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	// A delta chain is followed to the latest version.
+
+	publishFullList(payloads[1])
+	publishDelta(versions[0], makeDelta(0, 1))
+	publishDelta(versions[1], makeDelta(1, 1))
+
+	fetch()
+
+	checkFullListRequestCount(1)
+	checkVersion(versions[1])
+
+	expectedServerEntries = map[string]string{
+		"192.0.2.1": "CA" + remote,
+		"192.0.2.3": "US" + remote,
+		"192.0.2.4": "CA" + obfuscated,
+		"192.0.2.5": "CA" + remote,
+	}
+	if !reflect.DeepEqual(getServerEntries(), expectedServerEntries) {
+		t.Fatalf("unexpected server entries: %v", getServerEntries())
+	}
+
+	// Importing the same version as a full list results in the same server
+	// entries as applying the delta. Restore the removed server entry and
+	// clear the version to force a full list download.
+
+	serverEntryFields, err = protocol.DecodeServerEntryFields(
+		b, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	err = StoreServerEntry(config, serverEntryFields, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	err = SetKeyValue(config, datastoreRemoteServerListVersionKey, "")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+
+	fetch()
+
+	checkFullListRequestCount(2)
+	checkVersion(versions[1])
+
+	if !reflect.DeepEqual(getServerEntries(), expectedServerEntries) {
+		t.Fatalf("unexpected server entries: %v", getServerEntries())
+	}
+
+	// A delta with a base version that doesn't match the current version
+	// breaks the chain, and the full list is downloaded.
+
+	publishFullList(payloads[2])
+	publishDelta(versions[1], makeDelta(0, 2))
+	publishDelta(versions[2], makeDelta(2, 2))
+
+	fetch()
+
+	checkFullListRequestCount(3)
+	checkVersion(versions[2])
+
+	expectedServerEntries = map[string]string{
+		"192.0.2.1": "CA" + remote,
+		"192.0.2.4": "CA" + obfuscated,
+		"192.0.2.6": "CA" + remote,
+	}
+	if !reflect.DeepEqual(getServerEntries(), expectedServerEntries) {
+		t.Fatalf("unexpected server entries: %v", getServerEntries())
+	}
+
+	// A missing delta also breaks the chain. The full list is unchanged, so
+	// no server entries change.
+
+	publishDelta(versions[2], nil)
+
+	fetch()
+
+	checkFullListRequestCount(4)
+	checkVersion(versions[2])
+
+	if !reflect.DeepEqual(getServerEntries(), expectedServerEntries) {
+		t.Fatalf("unexpected server entries: %v", getServerEntries())
+	}
+
+	// A client that doesn't use deltas retains server entries dropped from
+	// the full list, and records no version.
+
+	nonDeltaConfig, err := LoadConfig([]byte(fmt.Sprintf(`
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "RemoteServerListURLs" : [{"URL" : "%s"}],
+        "RemoteServerListSignaturePublicKey" : "%s"
+    }`,
+		encodeURL(httpServer.URL+"/list"),
+		signingPublicKey)))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	nonDeltaConfig.DataRootDirectory = testDataDirName
+
+	err = nonDeltaConfig.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(nonDeltaConfig)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore(nonDeltaConfig)
+
+	publishFullList(payloads[0])
+
+	err = FetchCommonRemoteServerList(
+		context.Background(), nonDeltaConfig, 0, nil, untunneledDialConfig)
+	if err != nil {
+		t.Fatalf("FetchCommonRemoteServerList failed: %s", err)
+	}
+
+	checkFullListRequestCount(5)
+	checkVersion("")
+
+	expectedServerEntries = map[string]string{
+		"192.0.2.1": "CA" + remote,
+		"192.0.2.2": "CA" + remote,
+		"192.0.2.3": "CA" + remote,
+		"192.0.2.4": "CA" + remote,
+		"192.0.2.6": "CA" + remote,
+	}
+	if !reflect.DeepEqual(getServerEntries(), expectedServerEntries) {
+		t.Fatalf("unexpected server entries: %v", getServerEntries())
+	}
+}
@@ -36,6 +36,7 @@ import (
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/fragmentor"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tactics"
 )
@@ -47,6 +48,8 @@ const (
 	CLIENT_PLATFORM_ANDROID = "Android"
 	CLIENT_PLATFORM_WINDOWS = "Windows"
 	CLIENT_PLATFORM_IOS     = "iOS"
+
+	STEERING_MAX_SERVER_ENTRIES = 3
 )
 
 // sshAPIRequestHandler routes Psiphon API requests transported as
@@ -346,6 +349,33 @@ func handshakeAPIRequestHandler(
 			calculateDiscoveryValue(support.Config.DiscoveryValueHMACKey, clientIP))
 	}
 
+	// When the server is loaded, ask the client to migrate. A random
+	// selection of the configured SteeringServerEntries are sent as the
+	// alternatives the client will prefer. When no SteeringServerEntries are
+	// configured, the client prefers the discovery server entries, and may
+	// still migrate to any other server entry it has when discovery is
+	// disabled or there are no discovery server entries.
+	//
+	// The client retains its tunnel to this server while it establishes its
+	// replacement, so existing port forwards aren't interrupted.
+	migrate := false
+	var migrateServerEntries []string
+	if support.Config.SteeringEstablishedClientThreshold > 0 &&
+		support.TunnelServer.GetEstablishedClientCount() >=
+			support.Config.SteeringEstablishedClientThreshold {
+
+		migrate = true
+
+		steeringServerEntries := support.Config.SteeringServerEntries
+		for _, i := range prng.Perm(len(steeringServerEntries)) {
+			if len(migrateServerEntries) >= STEERING_MAX_SERVER_ENTRIES {
+				break
+			}
+			migrateServerEntries = append(
+				migrateServerEntries, steeringServerEntries[i])
+		}
+	}
+
 	// When the client indicates that it used an unsigned server entry for this
 	// connection, return a signed copy of the server entry for the client to
 	// upgrade to. See also: comment in psiphon.doHandshakeRequest.
@@ -382,6 +412,8 @@ func handshakeAPIRequestHandler(
 		TacticsPayload:           marshaledTacticsPayload,
 		UpstreamBytesPerSecond:   handshakeStateInfo.upstreamBytesPerSecond,
 		DownstreamBytesPerSecond: handshakeStateInfo.downstreamBytesPerSecond,
+		Migrate:                  migrate,
+		MigrateServerEntries:     migrateServerEntries,
 		Padding:                  strings.Repeat(" ", pad_response),
 	}
 
@@ -862,6 +894,7 @@ var baseParams = []requestParamSpec{
 	{"client_features", isAnyString, requestParamOptional | requestParamArray},
 	{"client_build_rev", isHexDigits, requestParamOptional},
 	{"device_region", isAnyString, requestParamOptional},
+	{tactics.EXPERIMENT_ARMS_PARAMETER_NAME, isAnyString, requestParamOptional | requestParamArray},
 }
 
 // baseSessionParams adds to baseParams the required session_id parameter. For
@@ -889,6 +922,8 @@ var baseDialParams = []requestParamSpec{
 	{"user_agent", isAnyString, requestParamOptional},
 	{"tls_profile", isAnyString, requestParamOptional},
 	{"tls_version", isAnyString, requestParamOptional},
+	{"tls_ja3", isHexDigits, requestParamOptional},
+	{"tls_ja4", isAnyString, requestParamOptional},
 	{"server_entry_region", isRegionCode, requestParamOptional},
 	{"server_entry_source", isServerEntrySource, requestParamOptional},
 	{"server_entry_timestamp", isISO8601Date, requestParamOptional},
@@ -897,6 +932,7 @@ var baseDialParams = []requestParamSpec{
 	{"quic_version", isAnyString, requestParamOptional},
 	{"quic_dial_sni_address", isAnyString, requestParamOptional},
 	{"quic_disable_client_path_mtu_discovery", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
+	{"quic_enable_datagrams", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
 	{"upstream_bytes_fragmented", isIntString, requestParamOptional | requestParamLogStringAsInt},
 	{"upstream_min_bytes_written", isIntString, requestParamOptional | requestParamLogStringAsInt},
 	{"upstream_max_bytes_written", isIntString, requestParamOptional | requestParamLogStringAsInt},
@@ -913,6 +949,7 @@ var baseDialParams = []requestParamSpec{
 	{"meek_cookie_size", isIntString, requestParamOptional | requestParamLogStringAsInt},
 	{"meek_limit_request", isIntString, requestParamOptional | requestParamLogStringAsInt},
 	{"meek_tls_padding", isIntString, requestParamOptional | requestParamLogStringAsInt},
+	{"meek_websocket", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
 	{"network_latency_multiplier", isFloatString, requestParamOptional | requestParamLogStringAsFloat},
 	{"client_bpf", isAnyString, requestParamOptional},
 	{"network_type", isAnyString, requestParamOptional},
@@ -925,6 +962,14 @@ var baseDialParams = []requestParamSpec{
 	{"dns_preferred", isAnyString, requestParamOptional},
 	{"dns_transform", isAnyString, requestParamOptional},
 	{"dns_attempt", isIntString, requestParamOptional | requestParamLogStringAsInt},
+	{"dns_cross_check_sources", isIntString, requestParamOptional | requestParamLogStringAsInt},
+	{"dns_cross_check_mismatch", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
+	{"dns_cross_check_injection", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
+	{"dns_cross_check_ttl_anomaly", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
+	{"dns_cross_check_poisoned", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
+	{"dns_cross_check_selected", isAnyString, requestParamOptional},
+	{"dns_https", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
+	{"dns_https_ip_hints", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
 }
 
 // baseSessionAndDialParams adds baseDialParams to baseSessionParams.
@@ -39,6 +39,7 @@ import (
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/accesscontrol"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/crypto/ssh"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/obfuscator"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/osl"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tactics"
@@ -168,6 +169,19 @@ type Config struct {
 	// "UNFRONTED-MEEK-HTTPS-OSSH", "UNFRONTED-MEEK-SESSION-TICKET-OSSH".
 	TunnelProtocolPassthroughAddresses map[string]string
 
+	// TunnelProtocolProbeResponses specifies probe responses to be used for
+	// tunnel protocols configured in TunnelProtocolPorts. A probe response is
+	// a probing defense which replaces the default behavior, reading and
+	// discarding all data, when a client fails anti-probing tests. The probe
+	// response either relays all network traffic to a decoy service or
+	// mimics the close and timeout behavior of a chosen server. See
+	// obfuscator.ProbeResponseConfig.
+	//
+	// TunnelProtocolProbeResponses is supported for: "OSSH", "QUIC-OSSH".
+	// For "QUIC-OSSH", only DecoyAddress is supported, and the decoy service
+	// is expected to be a UDP service, such as an HTTP/3 server.
+	TunnelProtocolProbeResponses map[string]*obfuscator.ProbeResponseConfig
+
 	// LegacyPassthrough indicates whether to expect legacy passthrough messages
 	// from clients attempting to connect. This should be set for existing/legacy
 	// passthrough servers only.
@@ -179,6 +193,12 @@ type Config struct {
 	// as the legacy gQUIC stack will respond to probing packets.
 	EnableGQUIC bool
 
+	// EnableQUICActiveMigration indicates whether to accept IETF QUIC-OSSH
+	// client connection migration, which allows clients to move an
+	// established tunnel to a new network. The server does not validate
+	// migrated paths with PATH_CHALLENGE frames.
+	EnableQUICActiveMigration bool
+
 	// SSHPrivateKey is the SSH host key. The same key is used for
 	// all protocols, run by this server instance, which use SSH.
 	SSHPrivateKey string
@@ -296,6 +316,28 @@ type Config struct {
 	// is 0.
 	MeekCachedResponsePoolBufferCount int
 
+	// MeekSessionRelayPeers, when set, enables meek session relaying among
+	// multiple psiphond instances, such as meek fronting origins behind a
+	// CDN or load balancer which doesn't maintain session stickiness. When
+	// an instance receives a request for a meek session owned by another
+	// instance, the request is relayed to the owner. See
+	// StaticPeerMeekSessionRouter.
+	//
+	// MeekSessionRelayPeers maps peer IDs, including this instance's
+	// MeekSessionRelayPeerID, to relay listener addresses. Each instance
+	// listens for relayed requests on its own address. All peers must be
+	// configured with the same MeekSessionRelayPeers and MeekSessionRelayKey.
+	MeekSessionRelayPeers map[string]string
+
+	// MeekSessionRelayPeerID is the ID of this instance in
+	// MeekSessionRelayPeers.
+	MeekSessionRelayPeerID string
+
+	// MeekSessionRelayKey is the base64 encoded 32 byte key shared by all
+	// MeekSessionRelayPeers, used to assign session ownership and to
+	// authenticate relayed requests.
+	MeekSessionRelayKey string
+
 	// UDPInterceptUdpgwServerAddress specifies the network address of
 	// a udpgw server which clients may be port forwarding to. When
 	// specified, these TCP port forwards are intercepted and handled
@@ -401,17 +443,51 @@ type Config struct {
 	// time the threshold is met. Disabled when < 0.
 	StopEstablishTunnelsEstablishedClientThreshold *int
 
+	// SteeringEstablishedClientThreshold is the established client count at
+	// or above which the server considers itself loaded and, in handshake
+	// responses, asks clients to migrate to alternative servers. Migrating
+	// clients establish a tunnel to an alternative server, taken from the
+	// SteeringServerEntries, or else the discovery server entries, returned
+	// in the same handshake response, and move new port forwards to it,
+	// shedding load gracefully. The default, 0, disables steering.
+	SteeringEstablishedClientThreshold int
+
+	// SteeringServerEntries is a list of encoded, signed server entries for
+	// alternative servers, such as servers with spare capacity in the same
+	// region. When the server asks a client to migrate, up to
+	// STEERING_MAX_SERVER_ENTRIES, selected at random, are sent to the client
+	// in the handshake response.
+	SteeringServerEntries []string
+
 	// AccessControlVerificationKeyRing is the access control authorization
 	// verification key ring used to verify signed authorizations presented
 	// by clients. Verified, active (unexpired) access control types will be
 	// available for matching in the TrafficRulesFilter for the client via
-	// AuthorizedAccessTypes. All other authorizations are ignored.
+	// AuthorizedAccessTypes. All other authorizations are ignored. Keys may
+	// specify an active period and grace period, to support key rotation;
+	// per-key verification counts are logged in server_load.
 	AccessControlVerificationKeyRing accesscontrol.VerificationKeyRing
 
+	// AccessControlRevocationListsFilename is the path of a file containing a
+	// JSON array of signed access control revocation lists, as issued by
+	// accesscontrol.IssueRevocationList. Revocation lists are verified with
+	// AccessControlVerificationKeyRing. Revoked authorizations are rejected
+	// in the handshake and, when the file is reloaded, revoked from
+	// established clients. When blank, no authorizations are revoked.
+	AccessControlRevocationListsFilename string
+
 	// TacticsConfigFilename is the path of a file containing a JSON-encoded
 	// tactics server configuration.
 	TacticsConfigFilename string
 
+	// ReplayCacheFilename is the path of a file in which the replay cache is
+	// persisted across restarts. When set, the replay cache is loaded from
+	// the file on startup, and saved to the file periodically and on
+	// shutdown. Entries retain their remaining TTL, and entries saved under
+	// different tactics are dropped on load. When blank, the replay cache is
+	// not persisted.
+	ReplayCacheFilename string
+
 	// BlocklistFilename is the path of a file containing a CSV-encoded
 	// blocklist configuration. See NewBlocklist for more file format
 	// documentation.
@@ -603,6 +679,33 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		}
 	}
 
+	if len(config.MeekSessionRelayPeers) > 0 {
+		if _, ok := config.MeekSessionRelayPeers[config.MeekSessionRelayPeerID]; !ok {
+			return nil, errors.TraceNew("MeekSessionRelayPeerID missing from MeekSessionRelayPeers")
+		}
+		key, err := base64.StdEncoding.DecodeString(config.MeekSessionRelayKey)
+		if err != nil || len(key) != MEEK_SESSION_RELAY_KEY_LENGTH {
+			return nil, errors.TraceNew("invalid MeekSessionRelayKey")
+		}
+	}
+
+	for tunnelProtocol, probeResponse := range config.TunnelProtocolProbeResponses {
+		if !protocol.TunnelProtocolSupportsProbeResponse(tunnelProtocol) {
+			return nil, errors.Tracef("Probe response unsupported tunnel protocol: %s", tunnelProtocol)
+		}
+		if probeResponse == nil {
+			return nil, errors.Tracef("Tunnel protocol %s probe response missing", tunnelProtocol)
+		}
+		if err := probeResponse.Validate(); err != nil {
+			return nil, errors.Tracef(
+				"Tunnel protocol %s probe response invalid: %s", tunnelProtocol, err)
+		}
+		if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) && probeResponse.DecoyAddress == "" {
+			return nil, errors.Tracef(
+				"Tunnel protocol %s probe response requires DecoyAddress", tunnelProtocol)
+		}
+	}
+
 	config.sshBeginHandshakeTimeout = SSH_BEGIN_HANDSHAKE_TIMEOUT
 	if config.SSHBeginHandshakeTimeoutMilliseconds != nil {
 		config.sshBeginHandshakeTimeout = time.Duration(*config.SSHBeginHandshakeTimeoutMilliseconds) * time.Millisecond
@@ -653,6 +756,20 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		config.stopEstablishTunnelsEstablishedClientThreshold = *config.StopEstablishTunnelsEstablishedClientThreshold
 	}
 
+	if config.SteeringEstablishedClientThreshold < 0 {
+		return nil, errors.TraceNew("SteeringEstablishedClientThreshold is invalid")
+	}
+
+	for _, encodedServerEntry := range config.SteeringServerEntries {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(encodedServerEntry, "", "")
+		if err != nil {
+			return nil, errors.Tracef("SteeringServerEntries is invalid: %s", err)
+		}
+		if !serverEntryFields.HasSignature() {
+			return nil, errors.TraceNew("SteeringServerEntries has unsigned server entry")
+		}
+	}
+
 	err = accesscontrol.ValidateVerificationKeyRing(&config.AccessControlVerificationKeyRing)
 	if err != nil {
 		return nil, errors.Tracef(
@@ -51,6 +51,7 @@ import (
 	lrucache "github.com/cognusion/go-cache-lru"
 	"github.com/juju/ratelimit"
 	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/websocket"
 )
 
 // MeekServer is based on meek-server.go from Tor and Psiphon:
@@ -212,6 +213,12 @@ func NewMeekServer(
 		rateLimitSignalGC:               make(chan struct{}, 1),
 	}
 
+	if support.MeekSessionRouter != nil {
+		support.MeekSessionRouter.RegisterHandler(
+			listenerTunnelProtocol,
+			http.HandlerFunc(meekServer.serveRelayedHTTP))
+	}
+
 	if useTLS {
 		tlsConfig, err := meekServer.makeMeekTLSConfig(
 			isFronted, useObfuscatedSessionTickets)
@@ -318,6 +325,18 @@ func (server *MeekServer) Run() error {
 // contains upstream traffic and the response will contain downstream
 // traffic.
 func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	server.serveHTTP(responseWriter, request, false)
+}
+
+// serveRelayedHTTP handles meek client HTTP requests relayed by another
+// psiphond instance via the MeekSessionRouter. Relayed requests are only
+// valid for existing sessions owned by this server.
+func (server *MeekServer) serveRelayedHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	server.serveHTTP(responseWriter, request, true)
+}
+
+func (server *MeekServer) serveHTTP(
+	responseWriter http.ResponseWriter, request *http.Request, isRelayed bool) {
 
 	// Note: no longer requiring that the request method is POST
 
@@ -349,6 +368,15 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 		}
 	}
 
+	// When a session router is configured, a request for a session owned by
+	// another psiphond instance is relayed to the owner.
+
+	if !isRelayed && server.isRemoteSession(meekCookie.Value) {
+		server.support.MeekSessionRouter.RelayRequest(
+			server.listenerTunnelProtocol, meekCookie.Value, responseWriter, request)
+		return
+	}
+
 	// A valid meek cookie indicates which class of request this is:
 	//
 	// 1. A new meek session. Create a new session ID and proceed with
@@ -364,7 +392,7 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 		underlyingConn,
 		endPoint,
 		endPointGeoIPData,
-		err := server.getSessionOrEndpoint(request, meekCookie)
+		err := server.getSessionOrEndpoint(request, meekCookie, isRelayed)
 
 	if err != nil {
 		// Debug since session cookie errors commonly occur during
@@ -388,8 +416,25 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 		return
 	}
 
+	// WebSocket relay mode.
+
+	if isWebSocketUpgrade(request) {
+		server.serveWebSocket(
+			responseWriter, request, meekCookie, sessionID, session, underlyingConn)
+		return
+	}
+
 	// Tunnel relay mode.
 
+	// A WebSocket session doesn't accept polling requests. Reject these,
+	// including duplicate or retried requests for a session that's been
+	// upgraded, immediately, without waiting on the session lock.
+
+	if atomic.LoadInt32(&session.isWebSocket) == 1 {
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
 	// Ensure that there's only one concurrent request handler per client
 	// session. Depending on the nature of a network disruption, it can
 	// happen that a client detects a failure and retries while the server
@@ -433,7 +478,12 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 	// discard this request. The session is no longer valid, and the final call
 	// to session.cachedResponse.Reset may have already occured, so any further
 	// session.cachedResponse access may deplete resources (fail to refill the pool).
-	if atomic.LoadInt64(&session.requestCount) > requestNumber || session.deleted {
+	//
+	// If the session was upgraded to a WebSocket session while this request
+	// was waiting, discard this request.
+	if atomic.LoadInt64(&session.requestCount) > requestNumber ||
+		session.deleted ||
+		atomic.LoadInt32(&session.isWebSocket) == 1 {
 		common.TerminateHTTPConnection(responseWriter, request)
 		return
 	}
@@ -580,6 +630,129 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 	}
 }
 
+// isWebSocketUpgrade indicates whether the request is a WebSocket upgrade
+// request.
+func isWebSocketUpgrade(request *http.Request) bool {
+	if request.Method != http.MethodGet ||
+		!strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range request.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket handles a meek client WebSocket upgrade request. The
+// upgrade request carries the same obfuscated meek cookie as an initial
+// polling request, and the session has been created, subject to the same
+// checks, by getSessionOrEndpoint. The upgrade response sets the session ID
+// cookie, as the first polling response does.
+//
+// The session flow is relayed in binary WebSocket frames for the lifetime
+// of the WebSocket connection, and the session is deleted when the
+// WebSocket connection closes. Since a WebSocket session cannot be resumed,
+// a client whose WebSocket connection fails must establish a new tunnel.
+//
+// session.lock is held only while the session is marked as a WebSocket
+// session, not for the lifetime of the WebSocket connection. Any subsequent
+// polling or upgrade request for the session is rejected immediately.
+func (server *MeekServer) serveWebSocket(
+	responseWriter http.ResponseWriter,
+	request *http.Request,
+	meekCookie *http.Cookie,
+	sessionID string,
+	session *meekSession,
+	underlyingConn net.Conn) {
+
+	if atomic.LoadInt32(&session.isWebSocket) == 1 {
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	atomic.AddInt64(&session.requestCount, 1)
+
+	session.lock.Lock()
+
+	// Only a new session may be upgraded. Upgrading an existing polling
+	// session could lose any cached response not yet received by the
+	// client.
+	if session.sessionIDSent ||
+		session.deleted ||
+		atomic.LoadInt32(&session.isWebSocket) == 1 {
+
+		session.lock.Unlock()
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	if _, ok := responseWriter.(http.Hijacker); !ok {
+		session.delete(true)
+		session.lock.Unlock()
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	if session.underlyingConn != underlyingConn {
+		atomic.AddInt64(&session.metricUnderlyingConnCount, 1)
+		session.underlyingConn = underlyingConn
+	}
+
+	header := make(http.Header)
+	if session.meekProtocolVersion >= MEEK_PROTOCOL_VERSION_2 {
+		header.Add(
+			"Set-Cookie",
+			(&http.Cookie{Name: meekCookie.Name, Value: sessionID}).String())
+	}
+	session.sessionIDSent = true
+
+	atomic.StoreInt32(&session.isWebSocket, 1)
+
+	session.lock.Unlock()
+
+	// Handshake is nil, so the Origin header is not checked.
+	webSocketServer := websocket.Server{
+		Config: websocket.Config{Header: header},
+		Handler: func(webSocketConn *websocket.Conn) {
+
+			webSocketConn.PayloadType = websocket.BinaryFrame
+			webSocketConn.MaxPayloadBytes = MEEK_MAX_REQUEST_PAYLOAD_LENGTH
+
+			// The http.Server timeouts remain set on the hijacked conn and
+			// are replaced by per-frame deadlines. In place of the polling
+			// session staleness check, upstream frames are subject to the
+			// SSH connection read deadline, which a meekConn doesn't
+			// otherwise enforce.
+
+			err := session.clientConn.relayWebSocket(
+				webSocketConn, SSH_CONNECTION_READ_DEADLINE, server.httpClientIOTimeout)
+			if err != nil {
+				// Debug since errors such as "i/o timeout" occur during normal operation;
+				// also, golang network error messages may contain client IP.
+				log.WithTraceFields(LogFields{"error": err}).Debug("relay WebSocket failed")
+			}
+		},
+	}
+
+	webSocketServer.ServeHTTP(responseWriter, request)
+
+	// The WebSocket handler returns, and the hijacked conn is closed, when the
+	// WebSocket connection fails or the client conn is closed; also when the
+	// upgrade handshake fails. As WebSocket sessions are not subject to the
+	// staleness check, the session is deleted and removed from the sessions
+	// map here.
+
+	session.delete(false)
+
+	server.sessionsLock.Lock()
+	delete(server.sessions, sessionID)
+	server.sessionsLock.Unlock()
+}
+
 func checkRangeHeader(request *http.Request) (int, bool) {
 	rangeHeader := request.Header.Get("Range")
 	if rangeHeader == "" {
@@ -612,7 +785,9 @@ func checkRangeHeader(request *http.Request) (int, bool) {
 // mode; or the endpoint is returned when the meek cookie indicates endpoint
 // mode.
 func (server *MeekServer) getSessionOrEndpoint(
-	request *http.Request, meekCookie *http.Cookie) (string, *meekSession, net.Conn, string, *GeoIPData, error) {
+	request *http.Request,
+	meekCookie *http.Cookie,
+	isRelayed bool) (string, *meekSession, net.Conn, string, *GeoIPData, error) {
 
 	underlyingConn := request.Context().Value(meekNetConnContextKey).(net.Conn)
 
@@ -629,6 +804,14 @@ func (server *MeekServer) getSessionOrEndpoint(
 		return existingSessionID, session, underlyingConn, "", nil, nil
 	}
 
+	// Relayed requests may not create new sessions or access endpoints. The
+	// remote address of a relayed request is the relaying peer, not the
+	// client.
+
+	if isRelayed {
+		return "", nil, nil, "", nil, errors.TraceNew("unknown relayed session")
+	}
+
 	// Determine the client remote address, which is used for geolocation
 	// stats, rate limiting, anti-probing, discovery, and tactics selection
 	// logic.
@@ -823,7 +1006,7 @@ func (server *MeekServer) getSessionOrEndpoint(
 	// causes the v1 client connection to hang/timeout.
 	sessionID := meekCookie.Value
 	if clientSessionData.MeekProtocolVersion >= MEEK_PROTOCOL_VERSION_2 {
-		sessionID, err = makeMeekSessionID()
+		sessionID, err = server.makeSessionID()
 		if err != nil {
 			return "", nil, nil, "", nil, errors.Trace(err)
 		}
@@ -840,6 +1023,42 @@ func (server *MeekServer) getSessionOrEndpoint(
 	return sessionID, session, underlyingConn, "", nil, nil
 }
 
+// isRemoteSession indicates whether the meek cookie value is a session ID
+// for a session owned by another psiphond instance. Only session IDs created
+// by makeSessionID, which are distinguished from meek cookies by length, are
+// routed; and a session in the local sessions map is always handled locally.
+func (server *MeekServer) isRemoteSession(cookieValue string) bool {
+
+	if server.support.MeekSessionRouter == nil ||
+		len(cookieValue) > base64.RawStdEncoding.EncodedLen(MEEK_MAX_SESSION_ID_LENGTH) {
+		return false
+	}
+
+	server.sessionsLock.RLock()
+	_, ok := server.sessions[cookieValue]
+	server.sessionsLock.RUnlock()
+
+	return !ok && !server.support.MeekSessionRouter.IsLocalSession(cookieValue)
+}
+
+// makeSessionID creates a new session ID. When a session router is
+// configured, the session ID is one owned by this server.
+func (server *MeekServer) makeSessionID() (string, error) {
+
+	for {
+		sessionID, err := makeMeekSessionID()
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+
+		if server.support.MeekSessionRouter == nil ||
+			server.support.MeekSessionRouter.IsLocalSession(sessionID) {
+
+			return sessionID, nil
+		}
+	}
+}
+
 func (server *MeekServer) rateLimit(
 	clientIP string, geoIPData GeoIPData, tunnelProtocol string) bool {
 
@@ -1271,6 +1490,7 @@ type meekSession struct {
 	metricPeakCachedResponseHitSize  int64
 	metricCachedResponseMissPosition int64
 	metricUnderlyingConnCount        int64
+	isWebSocket                      int32
 	lock                             sync.Mutex
 	deleted                          bool
 	underlyingConn                   net.Conn
@@ -1290,6 +1510,11 @@ func (session *meekSession) expired() bool {
 		// the session to MeekServer.sessions.
 		return false
 	}
+	if atomic.LoadInt32(&session.isWebSocket) == 1 {
+		// WebSocket sessions are deleted when the WebSocket connection
+		// closes, and are not subject to the staleness check.
+		return false
+	}
 	lastActivity := monotime.Time(atomic.LoadInt64(&session.lastActivity))
 	return monotime.Since(lastActivity) >
 		session.clientConn.meekServer.maxSessionStaleness
@@ -1650,6 +1875,72 @@ func (conn *meekConn) pumpWrites(
 	}
 }
 
+// relayWebSocket relays the meekConn flow over a WebSocket connection:
+// upstream binary frames are made available to Read() calls, and Write()
+// calls are relayed in downstream binary frames. relayWebSocket blocks until
+// the WebSocket connection fails, no upstream frame is received within
+// readTimeout, a downstream frame isn't sent within writeTimeout, or the
+// meekConn is closed.
+//
+// The caller must close webSocketConn, which stops the upstream relay.
+//
+// Note: channel scheme assumes relayWebSocket is not called concurrently
+// with pumpReads or pumpWrites
+func (conn *meekConn) relayWebSocket(
+	webSocketConn *websocket.Conn, readTimeout, writeTimeout time.Duration) error {
+
+	upstreamErr := make(chan error, 1)
+
+	go func() {
+		for {
+			_ = webSocketConn.SetReadDeadline(time.Now().Add(readTimeout))
+
+			var payload []byte
+			err := websocket.Message.Receive(webSocketConn, &payload)
+			if err != nil {
+				upstreamErr <- errors.Trace(err)
+				return
+			}
+
+			// Use either an empty or partial buffer, as in pumpReads. Unlike
+			// pumpReads, there are no client retries and no duplicate
+			// payload check.
+
+			var readBuffer *bytes.Buffer
+			select {
+			case readBuffer = <-conn.emptyReadBuffer:
+			case readBuffer = <-conn.partialReadBuffer:
+			case <-conn.closeBroadcast:
+				return
+			}
+			readBuffer.Write(payload)
+			conn.replaceReadBuffer(readBuffer)
+		}
+	}()
+
+	for {
+		select {
+		case buffer := <-conn.nextWriteBuffer:
+			_ = webSocketConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := webSocketConn.Write(buffer)
+			// Assumes that writeResult won't block.
+			conn.writeResult <- err
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+		case err := <-upstreamErr:
+			return err
+
+		case <-conn.meekServer.stopBroadcast:
+			return nil
+
+		case <-conn.closeBroadcast:
+			return errors.Trace(errMeekConnectionHasClosed)
+		}
+	}
+}
+
 // Write writes the buffer to the meekConn. It blocks until the
 // entire buffer is written to or the meekConn closes. Under the
 // hood, it waits for sufficient pumpWrites calls to consume the
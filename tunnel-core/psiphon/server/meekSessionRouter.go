@@ -0,0 +1,444 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/obfuscator"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+)
+
+const (
+	MEEK_SESSION_RELAY_AUTH_HEADER     = "Psiphon-Meek-Relay-Auth"
+	MEEK_SESSION_RELAY_PROTOCOL_HEADER = "Psiphon-Meek-Relay-Protocol"
+	MEEK_SESSION_RELAY_MAX_CLOCK_SKEW  = 30 * time.Second
+	MEEK_SESSION_RELAY_DIAL_TIMEOUT    = 5 * time.Second
+	MEEK_SESSION_RELAY_KEY_LENGTH      = 32
+	MEEK_SESSION_RELAY_NONCE_LENGTH    = 16
+)
+
+// MeekSessionRouter is a pluggable session routing layer which allows
+// multiple psiphond instances to serve the same meek sessions. This supports
+// horizontally scaling meek fronting origins behind a CDN or load balancer
+// that doesn't maintain session stickiness.
+//
+// Each meek session is owned by the instance which created it. When an
+// instance receives a request for a session it doesn't own, the request is
+// relayed to the owner, which handles the request and whose response is
+// relayed back to the client.
+//
+// MeekSessionRouter implementations must be safe for concurrent use.
+type MeekSessionRouter interface {
+
+	// IsLocalSession indicates whether this instance owns the specified
+	// session ID. MeekServer creates only session IDs for which
+	// IsLocalSession returns true.
+	IsLocalSession(sessionID string) bool
+
+	// RelayRequest relays the meek request to the owner of the specified
+	// session ID and writes the owner's response. tunnelProtocol identifies
+	// the meek listener which received the request. RelayRequest is
+	// responsible for terminating the client connection on failure.
+	RelayRequest(
+		tunnelProtocol string,
+		sessionID string,
+		responseWriter http.ResponseWriter,
+		request *http.Request)
+
+	// RegisterHandler registers the handler for requests, relayed from other
+	// instances, for the meek listener with the specified tunnel protocol.
+	RegisterHandler(tunnelProtocol string, handler http.Handler)
+
+	// Run runs the router until stopBroadcast is signaled.
+	Run(stopBroadcast <-chan struct{}) error
+}
+
+// StaticPeerMeekSessionRouter is a MeekSessionRouter backend that uses a
+// static list of peer instances. Session ownership is determined by a keyed
+// hash of the session ID, so no shared state is required beyond the peer
+// list and key. All peers must be configured with the same peer list and
+// key; changing the peer list remaps the ownership of existing sessions,
+// which will be lost.
+//
+// Relayed requests are sent over plain HTTP, authenticated by an HMAC of the
+// request session ID, tunnel protocol, body, a timestamp, and a random
+// nonce. Each nonce is accepted only once within the timestamp validity
+// period, so captured relayed requests can't be replayed. The request and
+// response payloads are not encrypted by the relay channel; meek payloads
+// carry an encrypted SSH stream.
+type StaticPeerMeekSessionRouter struct {
+	peerID        string
+	peerIDs       []string
+	peerAddresses map[string]string
+	key           []byte
+	proxies       map[string]*httputil.ReverseProxy
+	handlersMutex sync.Mutex
+	handlers      map[string]http.Handler
+	nonceHistory  *obfuscator.SeedHistory
+}
+
+// NewStaticPeerMeekSessionRouter creates a new StaticPeerMeekSessionRouter.
+// peerAddresses maps each peer ID, including peerID, the ID of this
+// instance, to its relay listener address. key is the shared, base64 encoded
+// relay key.
+func NewStaticPeerMeekSessionRouter(
+	peerID string,
+	peerAddresses map[string]string,
+	key string) (*StaticPeerMeekSessionRouter, error) {
+
+	if _, ok := peerAddresses[peerID]; !ok {
+		return nil, errors.TraceNew("peer ID not in peer addresses")
+	}
+
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(decodedKey) != MEEK_SESSION_RELAY_KEY_LENGTH {
+		return nil, errors.TraceNew("invalid key length")
+	}
+
+	router := &StaticPeerMeekSessionRouter{
+		peerID:        peerID,
+		peerAddresses: peerAddresses,
+		key:           decodedKey,
+		proxies:       make(map[string]*httputil.ReverseProxy),
+		handlers:      make(map[string]http.Handler),
+
+		// A nonce must be retained for as long as its timestamp is valid:
+		// MEEK_SESSION_RELAY_MAX_CLOCK_SKEW on either side of the time of
+		// receipt.
+		nonceHistory: obfuscator.NewSeedHistory(
+			&obfuscator.SeedHistoryConfig{
+				SeedTTL: 2 * MEEK_SESSION_RELAY_MAX_CLOCK_SKEW,
+			}),
+	}
+
+	for ID, address := range peerAddresses {
+
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		router.peerIDs = append(router.peerIDs, ID)
+
+		if ID != peerID {
+			router.proxies[ID] = router.makeProxy(address)
+		}
+	}
+
+	// Peer ownership is determined by index, so all peers must use the same
+	// order.
+	sort.Strings(router.peerIDs)
+
+	return router, nil
+}
+
+func (router *StaticPeerMeekSessionRouter) makeProxy(
+	address string) *httputil.ReverseProxy {
+
+	dialer := &net.Dialer{Timeout: MEEK_SESSION_RELAY_DIAL_TIMEOUT}
+
+	return &httputil.ReverseProxy{
+		Director: func(request *http.Request) {
+			request.URL.Scheme = "http"
+			request.URL.Host = address
+		},
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: 64,
+			IdleConnTimeout:     MEEK_DEFAULT_MAX_SESSION_STALENESS,
+		},
+
+		// Stream response payloads without buffering.
+		FlushInterval: -1,
+
+		ErrorHandler: func(
+			responseWriter http.ResponseWriter, request *http.Request, err error) {
+
+			log.WithTraceFields(LogFields{"error": err}).Debug("meek session relay failed")
+			common.TerminateHTTPConnection(responseWriter, request)
+		},
+	}
+}
+
+// getOwner returns the peer ID of the owner of the session ID.
+func (router *StaticPeerMeekSessionRouter) getOwner(sessionID string) string {
+	mac := hmac.New(sha256.New, router.key)
+	mac.Write([]byte("meek-session-owner"))
+	mac.Write([]byte(sessionID))
+	index := binary.BigEndian.Uint64(mac.Sum(nil)) % uint64(len(router.peerIDs))
+	return router.peerIDs[index]
+}
+
+// IsLocalSession implements the MeekSessionRouter interface.
+func (router *StaticPeerMeekSessionRouter) IsLocalSession(sessionID string) bool {
+	return router.getOwner(sessionID) == router.peerID
+}
+
+// RelayRequest implements the MeekSessionRouter interface.
+func (router *StaticPeerMeekSessionRouter) RelayRequest(
+	tunnelProtocol string,
+	sessionID string,
+	responseWriter http.ResponseWriter,
+	request *http.Request) {
+
+	proxy, ok := router.proxies[router.getOwner(sessionID)]
+	if !ok {
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	// The request body is authenticated, so it's read in full before
+	// relaying. Meek request payloads are limited to
+	// MEEK_MAX_REQUEST_PAYLOAD_LENGTH.
+
+	body, err := readRelayRequestBody(request)
+	if err != nil {
+		log.WithTraceFields(LogFields{"error": err}).Debug("read relay request failed")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	request.Header.Set(MEEK_SESSION_RELAY_PROTOCOL_HEADER, tunnelProtocol)
+	request.Header.Set(
+		MEEK_SESSION_RELAY_AUTH_HEADER,
+		router.makeAuth(
+			time.Now(),
+			prng.Bytes(MEEK_SESSION_RELAY_NONCE_LENGTH),
+			tunnelProtocol,
+			sessionID,
+			body))
+
+	proxy.ServeHTTP(responseWriter, request)
+}
+
+// readRelayRequestBody reads the entire request body, which must not exceed
+// MEEK_MAX_REQUEST_PAYLOAD_LENGTH, and replaces request.Body with a reader
+// of the buffered body.
+func readRelayRequestBody(request *http.Request) ([]byte, error) {
+
+	if request.Body == nil {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(request.Body, MEEK_MAX_REQUEST_PAYLOAD_LENGTH+1))
+	request.Body.Close()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(body) > MEEK_MAX_REQUEST_PAYLOAD_LENGTH {
+		return nil, errors.TraceNew("request body too large")
+	}
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request.ContentLength = int64(len(body))
+
+	return body, nil
+}
+
+func (router *StaticPeerMeekSessionRouter) makeAuth(
+	timestamp time.Time,
+	nonce []byte,
+	tunnelProtocol string,
+	sessionID string,
+	body []byte) string {
+
+	var timestampBytes [8]byte
+	binary.BigEndian.PutUint64(timestampBytes[:], uint64(timestamp.Unix()))
+
+	var lengthBytes [8]byte
+
+	mac := hmac.New(sha256.New, router.key)
+	mac.Write([]byte("meek-session-relay"))
+	mac.Write(timestampBytes[:])
+	mac.Write(nonce)
+	mac.Write([]byte(tunnelProtocol))
+	mac.Write([]byte{0})
+	mac.Write([]byte(sessionID))
+	mac.Write([]byte{0})
+	binary.BigEndian.PutUint64(lengthBytes[:], uint64(len(body)))
+	mac.Write(lengthBytes[:])
+	mac.Write(body)
+
+	auth := append(timestampBytes[:], nonce...)
+	auth = append(auth, mac.Sum(nil)...)
+
+	return base64.RawStdEncoding.EncodeToString(auth)
+}
+
+// verifyAuth checks the relay request authentication, and returns the
+// request nonce when valid. The caller must check that the nonce has not
+// been used before.
+func (router *StaticPeerMeekSessionRouter) verifyAuth(
+	auth string,
+	tunnelProtocol string,
+	sessionID string,
+	body []byte) ([]byte, bool) {
+
+	authBytes, err := base64.RawStdEncoding.DecodeString(auth)
+	if err != nil ||
+		len(authBytes) != 8+MEEK_SESSION_RELAY_NONCE_LENGTH+sha256.Size {
+		return nil, false
+	}
+
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(authBytes[0:8])), 0)
+	skew := time.Since(timestamp)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > MEEK_SESSION_RELAY_MAX_CLOCK_SKEW {
+		return nil, false
+	}
+
+	nonce := authBytes[8 : 8+MEEK_SESSION_RELAY_NONCE_LENGTH]
+
+	expectedAuth := router.makeAuth(timestamp, nonce, tunnelProtocol, sessionID, body)
+
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(expectedAuth)) != 1 {
+		return nil, false
+	}
+
+	return nonce, true
+}
+
+// RegisterHandler implements the MeekSessionRouter interface.
+func (router *StaticPeerMeekSessionRouter) RegisterHandler(
+	tunnelProtocol string, handler http.Handler) {
+
+	router.handlersMutex.Lock()
+	defer router.handlersMutex.Unlock()
+
+	router.handlers[tunnelProtocol] = handler
+}
+
+// ServeHTTP handles requests relayed from other peers.
+func (router *StaticPeerMeekSessionRouter) ServeHTTP(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	var sessionID string
+	for _, c := range request.Cookies() {
+		sessionID = c.Value
+		break
+	}
+
+	tunnelProtocol := request.Header.Get(MEEK_SESSION_RELAY_PROTOCOL_HEADER)
+
+	body, err := readRelayRequestBody(request)
+	if err != nil {
+		log.WithTraceFields(LogFields{"error": err}).Debug("read relayed request failed")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	nonce, ok := router.verifyAuth(
+		request.Header.Get(MEEK_SESSION_RELAY_AUTH_HEADER), tunnelProtocol, sessionID, body)
+	if !ok {
+		log.WithTrace().Warning("invalid meek session relay request")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	// Strict mode rejects any duplicate nonce, regardless of the relaying
+	// peer address.
+
+	ok, _ = router.nonceHistory.AddNew(
+		true,
+		common.IPAddressFromAddr(
+			request.Context().Value(meekNetConnContextKey).(net.Conn).RemoteAddr()),
+		"meek-relay-nonce",
+		nonce)
+	if !ok {
+		log.WithTrace().Warning("replayed meek session relay request")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	request.Header.Del(MEEK_SESSION_RELAY_AUTH_HEADER)
+	request.Header.Del(MEEK_SESSION_RELAY_PROTOCOL_HEADER)
+
+	router.handlersMutex.Lock()
+	handler, ok := router.handlers[tunnelProtocol]
+	router.handlersMutex.Unlock()
+
+	if !ok {
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	handler.ServeHTTP(responseWriter, request)
+}
+
+// Run implements the MeekSessionRouter interface. Run serves the relay
+// listener, at this peer's address, for requests relayed from other peers.
+func (router *StaticPeerMeekSessionRouter) Run(stopBroadcast <-chan struct{}) error {
+
+	listener, err := net.Listen("tcp", router.peerAddresses[router.peerID])
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// As in MeekServer, the underlying net.Conn is made available to the
+	// request handler via the request context.
+	//
+	// The relayed request I/O timeouts include the peer relay hop, so the
+	// relay listener doesn't impose shorter timeouts than MeekServer.
+
+	server := &http.Server{
+		ReadTimeout:  MEEK_DEFAULT_HTTP_CLIENT_IO_TIMEOUT,
+		WriteTimeout: MEEK_DEFAULT_HTTP_CLIENT_IO_TIMEOUT,
+		Handler:      router,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, meekNetConnContextKey, conn)
+		},
+	}
+
+	errorChannel := make(chan error, 1)
+	go func() {
+		errorChannel <- server.Serve(listener)
+	}()
+
+	select {
+	case <-stopBroadcast:
+		server.Close()
+		<-errorChannel
+		return nil
+	case err := <-errorChannel:
+		return errors.Trace(err)
+	}
+}
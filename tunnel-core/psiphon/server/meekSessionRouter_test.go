@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
+)
+
+func TestStaticPeerMeekSessionRouter(t *testing.T) {
+
+	key := base64.StdEncoding.EncodeToString(prng.Bytes(MEEK_SESSION_RELAY_KEY_LENGTH))
+
+	peerAddresses := make(map[string]string)
+	for _, peerID := range []string{"peer-1", "peer-2"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		peerAddresses[peerID] = listener.Addr().String()
+		listener.Close()
+	}
+
+	routers := make(map[string]*StaticPeerMeekSessionRouter)
+	stopBroadcast := make(chan struct{})
+	defer close(stopBroadcast)
+
+	tunnelProtocol := protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK
+
+	for peerID := range peerAddresses {
+
+		router, err := NewStaticPeerMeekSessionRouter(peerID, peerAddresses, key)
+		if err != nil {
+			t.Fatalf("NewStaticPeerMeekSessionRouter failed: %s", err)
+		}
+		routers[peerID] = router
+
+		ownerID := peerID
+		router.RegisterHandler(
+			tunnelProtocol,
+			http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+				cookie, _ := request.Cookie("meek")
+				_, _ = responseWriter.Write([]byte(fmt.Sprintf("%s %s", ownerID, cookie.Value)))
+			}))
+
+		go func() {
+			_ = router.Run(stopBroadcast)
+		}()
+	}
+
+	// Wait for the relay listeners to start.
+	for _, address := range peerAddresses {
+		for i := 0; ; i++ {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if i > 100 {
+				t.Fatalf("relay listener not started: %s", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Session ownership must be consistent across peers, and all peers must
+	// own some sessions.
+
+	ownedCount := make(map[string]int)
+
+	for i := 0; i < 100; i++ {
+		sessionID, err := makeMeekSessionID()
+		if err != nil {
+			t.Fatalf("makeMeekSessionID failed: %s", err)
+		}
+		ownerCount := 0
+		for peerID, router := range routers {
+			if router.IsLocalSession(sessionID) {
+				ownedCount[peerID] += 1
+				ownerCount += 1
+			}
+		}
+		if ownerCount != 1 {
+			t.Fatalf("unexpected owner count: %d", ownerCount)
+		}
+	}
+
+	if len(ownedCount) != len(routers) {
+		t.Fatalf("unexpected owned counts: %+v", ownedCount)
+	}
+
+	// Requests received by peer-1 for sessions owned by peer-2 are relayed.
+
+	relayServer := httptest.NewServer(
+		http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			cookie, _ := request.Cookie("meek")
+			if routers["peer-1"].IsLocalSession(cookie.Value) {
+				t.Errorf("unexpected local session")
+			}
+			routers["peer-1"].RelayRequest(
+				tunnelProtocol, cookie.Value, responseWriter, request)
+		}))
+	defer relayServer.Close()
+
+	var sessionID string
+	for {
+		sessionID, _ = makeMeekSessionID()
+		if routers["peer-2"].IsLocalSession(sessionID) {
+			break
+		}
+	}
+
+	request, _ := http.NewRequest("POST", relayServer.URL, nil)
+	request.AddCookie(&http.Cookie{Name: "meek", Value: sessionID})
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("relayed request failed: %s", err)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+
+	expectedBody := fmt.Sprintf("peer-2 %s", sessionID)
+	if string(body) != expectedBody {
+		t.Fatalf("unexpected relayed response: %s", string(body))
+	}
+
+	// Directly relayed requests are accepted only with a valid, unused
+	// authentication.
+
+	sendDirect := func(auth string, body []byte) bool {
+		request, _ := http.NewRequest(
+			"POST", "http://"+peerAddresses["peer-2"], bytes.NewReader(body))
+		request.AddCookie(&http.Cookie{Name: "meek", Value: sessionID})
+		request.Header.Set(MEEK_SESSION_RELAY_PROTOCOL_HEADER, tunnelProtocol)
+		request.Header.Set(MEEK_SESSION_RELAY_AUTH_HEADER, auth)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return false
+		}
+		body, _ = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return string(body) == expectedBody
+	}
+
+	payload := prng.Bytes(1024)
+
+	auth := routers["peer-1"].makeAuth(
+		time.Now(),
+		prng.Bytes(MEEK_SESSION_RELAY_NONCE_LENGTH),
+		tunnelProtocol,
+		sessionID,
+		payload)
+
+	// The body is authenticated.
+
+	if sendDirect(auth, prng.Bytes(1024)) {
+		t.Fatalf("unexpected modified body request success")
+	}
+
+	if !sendDirect(auth, payload) {
+		t.Fatalf("authenticated request failed")
+	}
+
+	// A replayed request is rejected.
+
+	if sendDirect(auth, payload) {
+		t.Fatalf("unexpected replayed request success")
+	}
+
+	// An expired request is rejected.
+
+	auth = routers["peer-1"].makeAuth(
+		time.Now().Add(-2*MEEK_SESSION_RELAY_MAX_CLOCK_SKEW),
+		prng.Bytes(MEEK_SESSION_RELAY_NONCE_LENGTH),
+		tunnelProtocol,
+		sessionID,
+		payload)
+
+	if sendDirect(auth, payload) {
+		t.Fatalf("unexpected expired request success")
+	}
+}
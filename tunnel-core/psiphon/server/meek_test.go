@@ -25,9 +25,11 @@ import (
 	crypto_rand "crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
@@ -407,6 +409,305 @@ func (interruptor *fileDescriptorInterruptor) BindToDevice(fileDescriptor int) (
 	return "", nil
 }
 
+func TestMeekWebSocket(t *testing.T) {
+	runTestMeekWebSocket(t, false)
+}
+
+func TestMeekWebSocketFallback(t *testing.T) {
+	runTestMeekWebSocket(t, true)
+}
+
+func runTestMeekWebSocket(t *testing.T, stripUpgrade bool) {
+
+	upstreamData := make([]byte, 1*MB)
+	_, _ = rand.Read(upstreamData)
+
+	downstreamData := make([]byte, 1*MB)
+	_, _ = rand.Read(downstreamData)
+
+	// Run meek server
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey := prng.HexString(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+	}
+	mockSupport.GeoIPService, _ = NewGeoIPService([]string{})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	// The upstream and downstream flows are independent, as an echo may
+	// deadlock when polling: the server doesn't write a response until the
+	// request body is consumed.
+	//
+	// In the fallback case, the server handles the failed upgrade request as
+	// the first polling request of the session, and the client reuses that
+	// session; so, in both cases, exactly one session is created. The
+	// downstream data sent in the failed upgrade response must be resent to
+	// the client in its first polling response.
+
+	relayWaitGroup := new(sync.WaitGroup)
+	upstreamResult := make(chan error, 1)
+	var sessionCount int32
+
+	clientHandler := func(_ string, conn net.Conn) {
+		atomic.AddInt32(&sessionCount, 1)
+		relayWaitGroup.Add(2)
+		go func() {
+			defer relayWaitGroup.Done()
+			received := make([]byte, len(upstreamData))
+			_, err := io.ReadFull(conn, received)
+			if err == nil && !bytes.Equal(received, upstreamData) {
+				err = fmt.Errorf("unexpected upstream data")
+			}
+			upstreamResult <- err
+		}()
+		go func() {
+			defer relayWaitGroup.Done()
+			_, _ = conn.Write(downstreamData)
+		}()
+	}
+
+	stopBroadcast := make(chan struct{})
+
+	server, err := NewMeekServer(
+		mockSupport,
+		listener,
+		"",
+		0,
+		false,
+		false,
+		false,
+		clientHandler,
+		stopBroadcast)
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	serverWaitGroup := new(sync.WaitGroup)
+
+	serverWaitGroup.Add(1)
+	go func() {
+		defer serverWaitGroup.Done()
+		err := server.Run()
+		select {
+		case <-stopBroadcast:
+			return
+		default:
+		}
+		if err != nil {
+			t.Errorf("MeekServer.Run failed: %s", err)
+		}
+	}()
+
+	// Run a TCP forwarder, in place of a CDN, in front of the meek server.
+	// When stripUpgrade is set, the forwarder garbles the Upgrade header in
+	// the first request, so the meek server handles the upgrade request as
+	// a polling request, as when a CDN doesn't support WebSockets.
+
+	forwarderListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer forwarderListener.Close()
+
+	var garbledUpgrade int32
+
+	go func() {
+		for {
+			conn, err := forwarderListener.Accept()
+			if err != nil {
+				return
+			}
+			serverConn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				_, _ = io.Copy(conn, serverConn)
+				conn.Close()
+			}()
+			go func() {
+				defer serverConn.Close()
+				buffer := make([]byte, 65536)
+				n, err := conn.Read(buffer)
+				if err != nil {
+					return
+				}
+				request := buffer[:n]
+				if stripUpgrade && atomic.CompareAndSwapInt32(&garbledUpgrade, 0, 1) {
+					request = bytes.Replace(
+						request, []byte("Upgrade: websocket"), []byte("Upgrade: xebsocket"), 1)
+				}
+				_, err = serverConn.Write(request)
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(serverConn, conn)
+			}()
+		}
+	}()
+
+	// Run meek client
+
+	dialConfig := &psiphon.DialConfig{
+		ResolveIP: func(_ context.Context, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP(host)}, nil
+		},
+	}
+
+	params, err := parameters.NewParameters(nil)
+	if err != nil {
+		t.Fatalf("NewParameters failed: %s", err)
+	}
+
+	meekObfuscatorPaddingSeed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("prng.NewSeed failed: %s", err)
+	}
+
+	meekConfig := &psiphon.MeekConfig{
+		Parameters:                    params,
+		Mode:                          psiphon.MeekModeRelay,
+		DialAddress:                   forwarderListener.Addr().String(),
+		UseWebSocket:                  true,
+		HostHeader:                    "example.com",
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+		MeekObfuscatorPaddingSeed:     meekObfuscatorPaddingSeed,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, dialConfig)
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+
+	_, usingWebSocket := clientConn.GetMetrics()["meek_websocket"]
+	if usingWebSocket == stripUpgrade {
+		t.Fatalf("unexpected WebSocket state: %v", usingWebSocket)
+	}
+
+	// A polling request for a WebSocket session must be rejected
+	// immediately, and not wait for the WebSocket connection to close.
+
+	if !stripUpgrade {
+
+		var sessionID string
+		server.sessionsLock.RLock()
+		for ID := range server.sessions {
+			sessionID = ID
+		}
+		server.sessionsLock.RUnlock()
+
+		request, err := http.NewRequest(
+			"POST", fmt.Sprintf("http://%s/", listener.Addr().String()), nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest failed: %s", err)
+		}
+		request.AddCookie(&http.Cookie{Name: "A", Value: sessionID})
+
+		httpClient := &http.Client{Timeout: 5 * time.Second}
+		response, err := httpClient.Do(request)
+		if err != nil {
+			t.Fatalf("polling request failed: %s", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound {
+			t.Fatalf("unexpected polling response: %d", response.StatusCode)
+		}
+	}
+
+	// Relay data through meek
+
+	sendErr := make(chan error, 1)
+	go func() {
+		for sent := 0; sent < len(upstreamData); {
+			writeLen := min(1+rand.Intn(128*KB), len(upstreamData)-sent)
+			_, err := clientConn.Write(upstreamData[sent : sent+writeLen])
+			if err != nil {
+				sendErr <- err
+				return
+			}
+			sent += writeLen
+		}
+		sendErr <- nil
+	}()
+
+	received := make([]byte, len(downstreamData))
+	_, err = io.ReadFull(clientConn, received)
+	if err != nil {
+		t.Fatalf("io.ReadFull failed: %s", err)
+	}
+
+	err = <-sendErr
+	if err != nil {
+		t.Fatalf("clientConn.Write failed: %s", err)
+	}
+
+	if !bytes.Equal(received, downstreamData) {
+		t.Fatalf("unexpected downstream data")
+	}
+
+	err = <-upstreamResult
+	if err != nil {
+		t.Fatalf("relay upstream failed: %s", err)
+	}
+
+	if atomic.LoadInt32(&sessionCount) != 1 {
+		t.Fatalf("unexpected session count: %d", atomic.LoadInt32(&sessionCount))
+	}
+
+	// Graceful shutdown
+
+	clientConn.Close()
+
+	if !stripUpgrade {
+
+		// Closing the WebSocket connection deletes the server session.
+
+		relayWaitGroup.Wait()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			server.sessionsLock.RLock()
+			sessionCount := len(server.sessions)
+			server.sessionsLock.RUnlock()
+			if sessionCount == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected session count: %d", sessionCount)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	listener.Close()
+	close(stopBroadcast)
+
+	// This wait will hang if shutdown is broken, and the test will ultimately panic
+	serverWaitGroup.Wait()
+}
+
 func TestMeekRateLimiter(t *testing.T) {
 	runTestMeekAccessControl(t, true, false)
 	runTestMeekAccessControl(t, false, false)
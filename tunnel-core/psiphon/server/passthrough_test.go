@@ -163,7 +163,7 @@ func testPassthrough(t *testing.T, legacy bool) {
 	if err != nil {
 		t.Fatalf("error initializing client datastore: %s", err)
 	}
-	defer psiphon.CloseDataStore()
+	defer psiphon.CloseDataStore(clientConfig)
 
 	controller, err := psiphon.NewController(clientConfig)
 	if err != nil {
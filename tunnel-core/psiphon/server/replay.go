@@ -20,7 +20,10 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sync"
 	"time"
 
@@ -33,6 +36,7 @@ import (
 const (
 	REPLAY_CACHE_MAX_ENTRIES      = 100000
 	REPLAY_CACHE_CLEANUP_INTERVAL = 1 * time.Minute
+	REPLAY_CACHE_SAVE_INTERVAL    = 5 * time.Minute
 )
 
 // ReplayCache is a cache of recently used and successful network obfuscation
@@ -52,6 +56,7 @@ type ReplayCache struct {
 	support    *SupportServices
 	cacheMutex sync.Mutex
 	cache      *lrucache.Cache
+	tacticsTag string
 	metrics    *replayCacheMetrics
 }
 
@@ -74,6 +79,13 @@ type replayParameters struct {
 
 // NewReplayCache creates a new ReplayCache.
 func NewReplayCache(support *SupportServices) *ReplayCache {
+	// The tactics tag identifies the tactics used to set entries, and is
+	// recorded in the file written by Save and checked by Load.
+	tacticsTag := ""
+	if support != nil && support.TacticsServer != nil {
+		tacticsTag = support.TacticsServer.GetConfigTag()
+	}
+
 	// Cache TTL may vary based on tactics filtering, so each cache.Add must set
 	// the entry TTL.
 	return &ReplayCache{
@@ -82,19 +94,23 @@ func NewReplayCache(support *SupportServices) *ReplayCache {
 			lrucache.NoExpiration,
 			REPLAY_CACHE_CLEANUP_INTERVAL,
 			REPLAY_CACHE_MAX_ENTRIES),
-		metrics: &replayCacheMetrics{},
+		tacticsTag: tacticsTag,
+		metrics:    &replayCacheMetrics{},
 	}
 }
 
 // Flush clears all entries in the ReplayCache. Flush should be called when
 // tactics hot reload and change to clear any cached replay parameters that
-// may be based on stale tactics.
-func (r *ReplayCache) Flush() {
+// may be based on stale tactics. tacticsTag identifies the new tactics, as
+// returned by tactics.Server.GetConfigTag, and is recorded in subsequent
+// Save files.
+func (r *ReplayCache) Flush(tacticsTag string) {
 
 	r.cacheMutex.Lock()
 	defer r.cacheMutex.Unlock()
 
 	r.cache.Flush()
+	r.tacticsTag = tacticsTag
 }
 
 // GetMetrics returns a snapshop of current ReplayCache event counters and
@@ -365,6 +381,203 @@ func (r *ReplayCache) FailedReplayParameters(
 	}
 }
 
+// replayCacheFile is the persistent form of a ReplayCache. TacticsTag
+// identifies the tactics used to set the entries.
+type replayCacheFile struct {
+	TacticsTag string
+	Entries    []*replayCacheFileEntry
+}
+
+// replayCacheFileEntry is the persistent form of a ReplayCache entry.
+// Expiry is an absolute time, so that the remaining TTL of the entry is
+// preserved across restarts.
+type replayCacheFileEntry struct {
+	Key                        string
+	Expiry                     time.Time
+	ReplayPacketManipulation   bool
+	PacketManipulationSpecName string
+	ReplayFragmentor           bool
+	FragmentorSeed             *prng.Seed
+	FailedCount                int
+}
+
+// Save writes all unexpired ReplayCache entries to the specified file. The
+// file is replaced atomically.
+func (r *ReplayCache) Save(filename string) error {
+
+	r.cacheMutex.Lock()
+	tacticsTag := r.tacticsTag
+	items := r.cache.Items()
+	entries := make([]*replayCacheFileEntry, 0, len(items))
+	for key, item := range items {
+		if item.Expired() {
+			continue
+		}
+		parameters, ok := item.Object.(*replayParameters)
+		if !ok {
+			continue
+		}
+		entries = append(entries, &replayCacheFileEntry{
+			Key:                        key,
+			Expiry:                     time.Unix(0, item.Expiration).UTC(),
+			ReplayPacketManipulation:   parameters.replayPacketManipulation,
+			PacketManipulationSpecName: parameters.packetManipulationSpecName,
+			ReplayFragmentor:           parameters.replayFragmentor,
+			FragmentorSeed:             parameters.fragmentorSeed,
+			FailedCount:                parameters.failedCount,
+		})
+	}
+	r.cacheMutex.Unlock()
+
+	return errors.Trace(writeReplayCacheFile(
+		filename, &replayCacheFile{TacticsTag: tacticsTag, Entries: entries}))
+}
+
+// Load adds the unexpired entries in the specified file, as written by Save,
+// to the ReplayCache, with their remaining TTLs. Existing entries with the
+// same key are replaced. Load returns the number of entries added. A
+// missing file is not an error.
+//
+// As with Flush, entries set using different tactics are not used: when the
+// file's tactics tag doesn't match the current tactics, all entries in the
+// file are dropped and Load returns 0.
+func (r *ReplayCache) Load(filename string) (int, error) {
+
+	file, err := readReplayCacheFile(filename)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	if file.TacticsTag != r.tacticsTag {
+		if len(file.Entries) > 0 {
+			log.WithTraceFields(LogFields{"count": len(file.Entries)}).Info(
+				"dropped replay cache entries with stale tactics")
+		}
+		return 0, nil
+	}
+
+	count := 0
+	for _, entry := range file.Entries {
+		TTL := time.Until(entry.Expiry)
+		if TTL <= 0 {
+			continue
+		}
+		r.cache.Set(
+			entry.Key,
+			&replayParameters{
+				replayPacketManipulation:   entry.ReplayPacketManipulation,
+				packetManipulationSpecName: entry.PacketManipulationSpecName,
+				replayFragmentor:           entry.ReplayFragmentor,
+				fragmentorSeed:             entry.FragmentorSeed,
+				failedCount:                entry.FailedCount,
+			},
+			TTL)
+		count += 1
+	}
+
+	return count, nil
+}
+
+// MergeReplayCacheFile adds the unexpired entries in the input replay cache
+// file to the output replay cache file, creating the output file if it
+// doesn't exist. When both files contain an entry with the same key, the
+// entry with the later expiry is retained. Expired entries are dropped from
+// the output file. MergeReplayCacheFile returns the number of entries in the
+// output file.
+//
+// MergeReplayCacheFile is used to export the replay cache of one server and
+// import it to seed another server, which must use the same tactics. The
+// output file must not be the ReplayCacheFilename of a running server, which
+// will overwrite the file. Files with entries from different tactics may not
+// be merged.
+func MergeReplayCacheFile(inputFilename, outputFilename string) (int, error) {
+
+	inputFile, err := readReplayCacheFile(inputFilename)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	outputFile, err := readReplayCacheFile(outputFilename)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if len(outputFile.Entries) > 0 &&
+		outputFile.TacticsTag != inputFile.TacticsTag {
+		return 0, errors.TraceNew("tactics tag mismatch")
+	}
+
+	now := time.Now()
+	mergedEntries := make(map[string]*replayCacheFileEntry)
+	for _, entry := range append(outputFile.Entries, inputFile.Entries...) {
+		if !entry.Expiry.After(now) {
+			continue
+		}
+		existingEntry, ok := mergedEntries[entry.Key]
+		if !ok || entry.Expiry.After(existingEntry.Expiry) {
+			mergedEntries[entry.Key] = entry
+		}
+	}
+
+	entries := make([]*replayCacheFileEntry, 0, len(mergedEntries))
+	for _, entry := range mergedEntries {
+		entries = append(entries, entry)
+	}
+
+	err = writeReplayCacheFile(
+		outputFilename,
+		&replayCacheFile{TacticsTag: inputFile.TacticsTag, Entries: entries})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return len(entries), nil
+}
+
+func readReplayCacheFile(filename string) (*replayCacheFile, error) {
+
+	fileContent, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &replayCacheFile{}, nil
+		}
+		return nil, errors.Trace(err)
+	}
+
+	var file replayCacheFile
+	err = json.Unmarshal(fileContent, &file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &file, nil
+}
+
+func writeReplayCacheFile(filename string, file *replayCacheFile) error {
+
+	fileContent, err := json.Marshal(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tempFilename := filename + ".tmp"
+
+	err = ioutil.WriteFile(tempFilename, fileContent, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = os.Rename(tempFilename, filename)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
 func (r *ReplayCache) makeKey(
 	tunnelProtocol string, geoIPData GeoIPData) string {
 	return fmt.Sprintf(
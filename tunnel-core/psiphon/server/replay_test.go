@@ -32,6 +32,7 @@ import (
 	"time"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/prng"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/protocol"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tactics"
 )
@@ -301,7 +302,7 @@ func runServerReplayClient(
 	if err != nil {
 		t.Fatalf("error initializing client datastore: %s", err)
 	}
-	defer psiphon.CloseDataStore()
+	defer psiphon.CloseDataStore(clientConfig)
 
 	controller, err := psiphon.NewController(clientConfig)
 	if err != nil {
@@ -345,3 +346,136 @@ func runServerReplayClient(
 	cancelFunc()
 	controllerWaitGroup.Wait()
 }
+
+func TestReplayCachePersistence(t *testing.T) {
+
+	replayCache := NewReplayCache(nil)
+
+	geoIPData := GeoIPData{Country: "R1", ASN: "1"}
+
+	fragmentorSeed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("NewSeed failed: %s", err)
+	}
+
+	replayCache.cache.Add(
+		replayCache.makeKey(protocol.TUNNEL_PROTOCOL_SSH, geoIPData),
+		&replayParameters{
+			replayFragmentor: true,
+			fragmentorSeed:   fragmentorSeed,
+		},
+		1*time.Hour)
+
+	replayCache.cache.Add(
+		replayCache.makeKey(protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, geoIPData),
+		&replayParameters{
+			replayPacketManipulation:   true,
+			packetManipulationSpecName: "spec",
+		},
+		1*time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+
+	filename := filepath.Join(testDataDirName, "replay_cache")
+	exportFilename := filepath.Join(testDataDirName, "replay_cache_export")
+
+	err = replayCache.Save(filename)
+	if err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	count, err := MergeReplayCacheFile(filename, exportFilename)
+	if err != nil {
+		t.Fatalf("MergeReplayCacheFile failed: %s", err)
+	}
+	if count != 1 {
+		t.Fatalf("unexpected merged count: %d", count)
+	}
+
+	loadedReplayCache := NewReplayCache(nil)
+
+	count, err = loadedReplayCache.Load(exportFilename)
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	if count != 1 {
+		t.Fatalf("unexpected loaded count: %d", count)
+	}
+
+	seed, ok := loadedReplayCache.GetReplayFragmentor(protocol.TUNNEL_PROTOCOL_SSH, geoIPData)
+	if !ok || *seed != *fragmentorSeed {
+		t.Fatalf("unexpected replay fragmentor")
+	}
+
+	_, ok = loadedReplayCache.GetReplayPacketManipulation(
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, geoIPData)
+	if ok {
+		t.Fatalf("unexpected replay packet manipulation")
+	}
+
+	_, expiry, ok := loadedReplayCache.cache.GetWithExpiration(
+		loadedReplayCache.makeKey(protocol.TUNNEL_PROTOCOL_SSH, geoIPData))
+	if !ok || time.Until(expiry) > 1*time.Hour || time.Until(expiry) < 59*time.Minute {
+		t.Fatalf("unexpected replay expiry: %s", expiry)
+	}
+
+	// A missing file is not an error.
+
+	count, err = loadedReplayCache.Load(filepath.Join(testDataDirName, "missing_replay_cache"))
+	if err != nil || count != 0 {
+		t.Fatalf("unexpected missing file result: %d, %v", count, err)
+	}
+
+	// When tactics change between save and load, all entries are dropped.
+
+	changedReplayCache := NewReplayCache(nil)
+	changedReplayCache.Flush("changed-tactics-tag")
+
+	count, err = changedReplayCache.Load(exportFilename)
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	if count != 0 {
+		t.Fatalf("unexpected loaded count: %d", count)
+	}
+
+	_, ok = changedReplayCache.GetReplayFragmentor(protocol.TUNNEL_PROTOCOL_SSH, geoIPData)
+	if ok {
+		t.Fatalf("unexpected replay fragmentor")
+	}
+
+	// Saves after a tactics change record the new tactics, and files with
+	// different tactics may not be merged.
+
+	changedFilename := filepath.Join(testDataDirName, "replay_cache_changed")
+
+	changedReplayCache.cache.Add(
+		changedReplayCache.makeKey(protocol.TUNNEL_PROTOCOL_SSH, geoIPData),
+		&replayParameters{
+			replayFragmentor: true,
+			fragmentorSeed:   fragmentorSeed,
+		},
+		1*time.Hour)
+
+	err = changedReplayCache.Save(changedFilename)
+	if err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	_, err = MergeReplayCacheFile(changedFilename, exportFilename)
+	if err == nil {
+		t.Fatalf("MergeReplayCacheFile unexpectedly succeeded")
+	}
+
+	count, err = loadedReplayCache.Load(changedFilename)
+	if err != nil || count != 0 {
+		t.Fatalf("unexpected stale file result: %d, %v", count, err)
+	}
+
+	loadedReplayCache.Flush("changed-tactics-tag")
+
+	count, err = loadedReplayCache.Load(changedFilename)
+	if err != nil || count != 1 {
+		t.Fatalf("unexpected changed file result: %d, %v", count, err)
+	}
+}
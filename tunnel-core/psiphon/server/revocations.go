@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/accesscontrol"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+)
+
+// AuthorizationRevocations is the set of revoked access control
+// authorizations, loaded from signed revocation lists.
+//
+// The Reload function supports hot reloading of revocation lists while the
+// server is running. Any revocation list that fails verification fails the
+// entire reload, and the previous revocations remain in effect.
+type AuthorizationRevocations struct {
+	common.ReloadableFile
+	revocations atomic.Value
+}
+
+// NewAuthorizationRevocations creates a new AuthorizationRevocations.
+//
+// The input file is a JSON array of encoded, signed revocation lists, as
+// issued by accesscontrol.IssueRevocationList. Revocation lists are verified
+// using keyRing. When filename is blank, no authorizations are revoked.
+func NewAuthorizationRevocations(
+	filename string,
+	keyRing *accesscontrol.VerificationKeyRing) (*AuthorizationRevocations, error) {
+
+	revocations := &AuthorizationRevocations{}
+
+	revocations.ReloadableFile = common.NewReloadableFile(
+		filename,
+		true,
+		func(fileContent []byte, _ time.Time) error {
+
+			var encodedRevocationLists []string
+			err := json.Unmarshal(fileContent, &encodedRevocationLists)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			newRevocations, err := accesscontrol.NewRevocations(
+				keyRing, encodedRevocationLists)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			revocations.revocations.Store(newRevocations)
+
+			return nil
+		})
+
+	_, err := revocations.Reload()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return revocations, nil
+}
+
+// IsRevoked indicates if the verified authorization is revoked. IsRevoked
+// may be called concurrently.
+func (r *AuthorizationRevocations) IsRevoked(
+	authorization *accesscontrol.Authorization) bool {
+
+	// As revocations is an atomic.Value, it's not necessary to call
+	// ReloadableFile.RLock/ReloadableFile.RUnlock in this case.
+
+	revocations, _ := r.revocations.Load().(*accesscontrol.Revocations)
+
+	return revocations.IsRevoked(authorization)
+}
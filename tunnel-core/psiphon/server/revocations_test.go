@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/accesscontrol"
+)
+
+func TestAuthorizationRevocations(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-revocations-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	filename := filepath.Join(testDataDirName, "revocations.json")
+
+	signingKey, verificationKey, err := accesscontrol.NewKeyPair("access")
+	if err != nil {
+		t.Fatalf("NewKeyPair failed: %s", err)
+	}
+
+	keyRing := &accesscontrol.VerificationKeyRing{
+		Keys: []*accesscontrol.VerificationKey{verificationKey},
+	}
+
+	auth, ID, err := accesscontrol.IssueAuthorization(
+		signingKey, []byte("1"), time.Now().Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("IssueAuthorization failed: %s", err)
+	}
+
+	verifiedAuth, err := accesscontrol.VerifyAuthorization(keyRing, auth)
+	if err != nil {
+		t.Fatalf("VerifyAuthorization failed: %s", err)
+	}
+
+	writeRevocationLists := func(lists []string) {
+		content, err := json.Marshal(lists)
+		if err != nil {
+			t.Fatalf("Marshal failed: %s", err)
+		}
+		err = ioutil.WriteFile(filename, content, 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	issueRevocationList := func(IDs [][]byte) string {
+		list, err := accesscontrol.IssueRevocationList(signingKey, IDs, time.Now())
+		if err != nil {
+			t.Fatalf("IssueRevocationList failed: %s", err)
+		}
+		return list
+	}
+
+	// No revocations when not configured.
+
+	revocations, err := NewAuthorizationRevocations("", keyRing)
+	if err != nil {
+		t.Fatalf("NewAuthorizationRevocations failed: %s", err)
+	}
+
+	if revocations.IsRevoked(verifiedAuth) {
+		t.Fatalf("unexpected revoked authorization")
+	}
+
+	writeRevocationLists([]string{issueRevocationList(nil)})
+
+	revocations, err = NewAuthorizationRevocations(filename, keyRing)
+	if err != nil {
+		t.Fatalf("NewAuthorizationRevocations failed: %s", err)
+	}
+
+	if revocations.IsRevoked(verifiedAuth) {
+		t.Fatalf("unexpected revoked authorization")
+	}
+
+	// Hot reload a revocation list that revokes the authorization.
+
+	writeRevocationLists([]string{issueRevocationList([][]byte{ID})})
+
+	reloaded, err := revocations.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("Reload failed: %v, %v", reloaded, err)
+	}
+
+	if !revocations.IsRevoked(verifiedAuth) {
+		t.Fatalf("unexpected unrevoked authorization")
+	}
+
+	// A failed reload retains the previous revocations.
+
+	writeRevocationLists([]string{"invalid"})
+
+	_, err = revocations.Reload()
+	if err == nil {
+		t.Fatalf("Reload unexpected success")
+	}
+
+	if !revocations.IsRevoked(verifiedAuth) {
+		t.Fatalf("unexpected unrevoked authorization")
+	}
+}
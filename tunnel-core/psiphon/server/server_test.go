@@ -1206,18 +1206,19 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	if err != nil {
 		t.Fatalf("error initializing client datastore: %s", err)
 	}
-	defer psiphon.CloseDataStore()
+	defer psiphon.CloseDataStore(clientConfig)
 
 	// Test unique user counting cases.
 	var expectUniqueUser bool
 	switch serverRuns % 3 {
 	case 0:
 		// Mock no last_connected.
-		psiphon.SetKeyValue("lastConnected", "")
+		psiphon.SetKeyValue(clientConfig, "lastConnected", "")
 		expectUniqueUser = true
 	case 1:
 		// Mock previous day last_connected.
 		psiphon.SetKeyValue(
+			clientConfig,
 			"lastConnected",
 			time.Now().UTC().AddDate(0, 0, -1).Truncate(1*time.Hour).Format(time.RFC3339))
 		expectUniqueUser = true
@@ -1227,7 +1228,7 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	}
 
 	// Clear SLOKs from previous test runs.
-	psiphon.DeleteSLOKs()
+	psiphon.DeleteSLOKs(clientConfig)
 
 	// Store prune server entry test server entries and failed tunnel records.
 	storePruneServerEntriesTest(
@@ -1439,7 +1440,7 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 
 		waitOnNotification(t, slokSeeded, timeoutSignal, "SLOK seeded timeout exceeded")
 
-		numSLOKs := psiphon.CountSLOKs()
+		numSLOKs := psiphon.CountSLOKs(clientConfig)
 		if numSLOKs != expectedNumSLOKs {
 			t.Fatalf("unexpected number of SLOKs: %d", numSLOKs)
 		}
@@ -2918,14 +2919,6 @@ func storePruneServerEntriesTest(
 		return
 	}
 
-	for _, testCase := range pruneServerEntryTestCases {
-
-		err := psiphon.StoreServerEntry(testCase.ServerEntryFields, true)
-		if err != nil {
-			t.Fatalf("StoreServerEntry failed: %s", err)
-		}
-	}
-
 	clientConfig := &psiphon.Config{
 		SponsorId:            "0",
 		PropagationChannelId: "0",
@@ -2951,6 +2944,14 @@ func storePruneServerEntriesTest(
 		t.Fatalf("SetParameters failed: %s", err)
 	}
 
+	for _, testCase := range pruneServerEntryTestCases {
+
+		err := psiphon.StoreServerEntry(clientConfig, testCase.ServerEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
 	verifyTestCasesStored := make(verifyTestCasesStoredLookup)
 	for _, testCase := range pruneServerEntryTestCases {
 		verifyTestCasesStored.mustBeStored(testCase.IPAddress)
@@ -3050,7 +3051,7 @@ func checkPruneServerEntriesTest(
 
 	for _, testCase := range pruneServerEntryTestCases {
 
-		err := psiphon.StoreServerEntry(testCase.ServerEntryFields, true)
+		err := psiphon.StoreServerEntry(clientConfig, testCase.ServerEntryFields, true)
 		if err != nil {
 			t.Fatalf("StoreServerEntry failed: %s", err)
 		}
@@ -3084,7 +3085,7 @@ func checkPruneServerEntriesTest(
 
 		testCase.ServerEntryFields.SetLocalSource(protocol.SERVER_ENTRY_SOURCE_REMOTE)
 
-		err := psiphon.StoreServerEntry(testCase.ServerEntryFields, true)
+		err := psiphon.StoreServerEntry(clientConfig, testCase.ServerEntryFields, true)
 		if err != nil {
 			t.Fatalf("StoreServerEntry failed: %s", err)
 		}
@@ -35,6 +35,7 @@ import (
 	"time"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/accesscontrol"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/buildinfo"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/osl"
@@ -191,6 +192,31 @@ func RunServices(configJSON []byte) (retErr error) {
 		}()
 	}
 
+	if config.ReplayCacheFilename != "" {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			ticker := time.NewTicker(REPLAY_CACHE_SAVE_INTERVAL)
+			defer ticker.Stop()
+			for {
+				stop := false
+				select {
+				case <-shutdownBroadcast:
+					stop = true
+				case <-ticker.C:
+				}
+				err := support.ReplayCache.Save(config.ReplayCacheFilename)
+				if err != nil {
+					log.WithTraceFields(LogFields{"error": errors.Trace(err)}).Warning(
+						"failed to save replay cache")
+				}
+				if stop {
+					return
+				}
+			}
+		}()
+	}
+
 	if config.RunWebServer() {
 		waitGroup.Add(1)
 		go func() {
@@ -203,6 +229,18 @@ func RunServices(configJSON []byte) (retErr error) {
 		}()
 	}
 
+	if support.MeekSessionRouter != nil {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			err := support.MeekSessionRouter.Run(shutdownBroadcast)
+			select {
+			case errorChannel <- err:
+			default:
+			}
+		}()
+	}
+
 	// The tunnel server is always run; it launches multiple
 	// listeners, depending on which tunnel protocols are enabled.
 	waitGroup.Add(1)
@@ -403,6 +441,24 @@ func logServerLoad(support *SupportServices) {
 
 		log.LogRawFieldsWithTimestamp(serverLoad)
 	}
+
+	// Log authorization verification counts for each verification key,
+	// including unused keys, so that operators can see when a rotated key is
+	// no longer used or a retired key is still presented.
+
+	for keyID, keyMetrics := range support.AuthorizationVerifier.GetMetrics() {
+
+		log.LogRawFieldsWithTimestamp(
+			LogFields{
+				"event_name":                          "server_load",
+				"authorization_key_id":                keyID,
+				"authorization_verified_count":        keyMetrics.Verified,
+				"authorization_in_grace_period_count": keyMetrics.InGracePeriod,
+				"authorization_expired_count":         keyMetrics.Expired,
+				"authorization_key_inactive_count":    keyMetrics.Inactive,
+				"authorization_rejected_count":        keyMetrics.Rejected,
+			})
+	}
 }
 
 func logIrregularTunnel(
@@ -441,9 +497,12 @@ type SupportServices struct {
 	PacketTunnelServer           *tun.Server
 	TacticsServer                *tactics.Server
 	Blocklist                    *Blocklist
+	AuthorizationVerifier        *accesscontrol.Verifier
+	AuthorizationRevocations     *AuthorizationRevocations
 	PacketManipulator            *packetman.Manipulator
 	ReplayCache                  *ReplayCache
 	ServerTacticsParametersCache *ServerTacticsParametersCache
+	MeekSessionRouter            MeekSessionRouter
 }
 
 // NewSupportServices initializes a new SupportServices.
@@ -479,6 +538,19 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		return nil, errors.Trace(err)
 	}
 
+	authorizationVerifier, err := accesscontrol.NewVerifier(
+		&config.AccessControlVerificationKeyRing)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	authorizationRevocations, err := NewAuthorizationRevocations(
+		config.AccessControlRevocationListsFilename,
+		&config.AccessControlVerificationKeyRing)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	tacticsServer, err := tactics.NewServer(
 		CommonLogger(log),
 		getTacticsAPIParameterLogFieldFormatter(),
@@ -497,18 +569,44 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		DNSResolver:     dnsResolver,
 		TacticsServer:   tacticsServer,
 		Blocklist:       blocklist,
+
+		AuthorizationVerifier:    authorizationVerifier,
+		AuthorizationRevocations: authorizationRevocations,
+	}
+
+	if len(config.MeekSessionRelayPeers) > 0 {
+		support.MeekSessionRouter, err = NewStaticPeerMeekSessionRouter(
+			config.MeekSessionRelayPeerID,
+			config.MeekSessionRelayPeers,
+			config.MeekSessionRelayKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
 
 	support.ReplayCache = NewReplayCache(support)
 
+	if config.ReplayCacheFilename != "" {
+
+		// A corrupt or unreadable replay cache file doesn't prevent startup;
+		// the replay cache will be repopulated as tunnels succeed.
+		count, err := support.ReplayCache.Load(config.ReplayCacheFilename)
+		if err != nil {
+			log.WithTraceFields(LogFields{"error": errors.Trace(err)}).Warning(
+				"failed to load replay cache")
+		} else {
+			log.WithTraceFields(LogFields{"count": count}).Info("loaded replay cache")
+		}
+	}
+
 	support.ServerTacticsParametersCache =
 		NewServerTacticsParametersCache(support)
 
 	return support, nil
 }
 
-// Reload reinitializes traffic rules, psinet database, and geo IP database
-// components. If any component fails to reload, an error is logged and
+// Reload reinitializes traffic rules, psinet database, geo IP database, and
+// authorization revocations components. If any component fails to reload, an error is logged and
 // Reload proceeds, using the previous state of the component.
 func (support *SupportServices) Reload() {
 
@@ -518,7 +616,8 @@ func (support *SupportServices) Reload() {
 			support.OSLConfig,
 			support.PsinetDatabase,
 			support.TacticsServer,
-			support.Blocklist},
+			support.Blocklist,
+			support.AuthorizationRevocations},
 		support.GeoIPService.Reloaders()...)
 
 	// Note: established clients aren't notified when tactics change after a
@@ -528,7 +627,7 @@ func (support *SupportServices) Reload() {
 	reloadTactics := func() {
 
 		// Don't use stale tactics.
-		support.ReplayCache.Flush()
+		support.ReplayCache.Flush(support.TacticsServer.GetConfigTag())
 		support.ServerTacticsParametersCache.Flush()
 
 		if support.Config.RunPacketManipulator {
@@ -548,6 +647,10 @@ func (support *SupportServices) Reload() {
 		support.TrafficRulesSet: func() { support.TunnelServer.ResetAllClientTrafficRules() },
 		support.OSLConfig:       func() { support.TunnelServer.ResetAllClientOSLConfigs() },
 		support.TacticsServer:   reloadTactics,
+
+		support.AuthorizationRevocations: func() {
+			support.TunnelServer.RevokeAllClientRevokedAuthorizations()
+		},
 	}
 
 	for _, reloader := range reloaders {
@@ -152,7 +152,7 @@ func TestDuplicateSessionID(t *testing.T) {
 	if err != nil {
 		t.Fatalf("OpenDataStore failed: %s", err)
 	}
-	defer psiphon.CloseDataStore()
+	defer psiphon.CloseDataStore(clientConfig)
 
 	serverEntry, err := protocol.DecodeServerEntry(
 		string(encodedServerEntry),
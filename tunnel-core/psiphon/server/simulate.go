@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tactics"
+)
+
+// SimulatedClient describes a synthetic client for Simulate. The client's
+// GeoIP attributes are resolved from ClientIP, when set, and then any of
+// Region, City, ISP, and ASN that are set override the resolved values.
+type SimulatedClient struct {
+	ClientIP string
+	Region   string
+	City     string
+	ISP      string
+	ASN      string
+
+	TunnelProtocol string
+
+	// SubsequentTunnelInSession simulates a client that has already
+	// established a tunnel in the same session, which affects
+	// UnthrottleFirstTunnelOnly.
+	SubsequentTunnelInSession bool
+
+	// PreHandshake simulates a client that has connected but not yet
+	// completed the API handshake. Filters which require handshake state
+	// will not match.
+	PreHandshake bool
+
+	APIProtocol            string
+	HandshakeParameters    common.APIParameters
+	ActiveAuthorizationIDs []string
+	AuthorizedAccessTypes  []string
+	AuthorizationsRevoked  bool
+	SpeedTestSamples       []tactics.SpeedTestSample
+}
+
+// SimulationResult is the outcome of Simulate.
+//
+// TrafficRules are the rules the client would be assigned after its
+// handshake, and TrafficRulesFilters records, for each filtered rule, whether
+// it matched or, when not, which filter field failed to match.
+//
+// Tactics and TacticsTag are the tactics payload the client would receive in
+// its handshake response, and TacticsFilters explains each filtered tactics
+// as for traffic rules. ServerTactics and ServerTacticsTag are the tactics,
+// including server-side only parameters, that the server would apply for
+// the client's GeoIP attributes.
+type SimulationResult struct {
+	GeoIPData           GeoIPData
+	TrafficRules        TrafficRules
+	TrafficRulesFilters []TrafficRulesFilterResult
+	Tactics             *tactics.Tactics
+	TacticsTag          string
+	TacticsFilters      []tactics.FilterResult
+	ServerTactics       *tactics.Tactics
+	ServerTacticsTag    string
+}
+
+// Simulate loads the specified traffic rules, tactics, and GeoIP database
+// files and resolves the traffic rules and tactics for the synthetic client.
+// Simulate is intended for offline validation of configuration changes,
+// complementing TrafficRulesSet.Validate and tactics.Server.Validate which
+// check only syntax. No services are started.
+//
+// The tactics and GeoIP database filenames may be blank, in which case no
+// tactics are resolved and ClientIP is not used.
+func Simulate(
+	trafficRulesFilename string,
+	tacticsFilename string,
+	geoIPDatabaseFilenames []string,
+	client *SimulatedClient) (*SimulationResult, error) {
+
+	trafficRulesSet, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	geoIPData := NewGeoIPData()
+
+	if client.ClientIP != "" && len(geoIPDatabaseFilenames) > 0 {
+
+		geoIPService, err := NewGeoIPService(geoIPDatabaseFilenames)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		geoIPData = geoIPService.Lookup(client.ClientIP)
+	}
+
+	if client.Region != "" {
+		geoIPData.Country = client.Region
+	}
+	if client.City != "" {
+		geoIPData.City = client.City
+	}
+	if client.ISP != "" {
+		geoIPData.ISP = client.ISP
+	}
+	if client.ASN != "" {
+		geoIPData.ASN = client.ASN
+	}
+
+	apiParams := make(common.APIParameters)
+	for name, value := range client.HandshakeParameters {
+		apiParams[name] = value
+	}
+	if len(client.SpeedTestSamples) > 0 {
+		apiParams[tactics.SPEED_TEST_SAMPLES_PARAMETER_NAME] = client.SpeedTestSamples
+	}
+
+	state := handshakeState{
+		completed:              !client.PreHandshake,
+		apiProtocol:            client.APIProtocol,
+		apiParams:              apiParams,
+		activeAuthorizationIDs: client.ActiveAuthorizationIDs,
+		authorizedAccessTypes:  client.AuthorizedAccessTypes,
+		authorizationsRevoked:  client.AuthorizationsRevoked,
+	}
+
+	result := &SimulationResult{
+		GeoIPData: geoIPData,
+	}
+
+	result.TrafficRules = trafficRulesSet.getTrafficRules(
+		!client.SubsequentTunnelInSession,
+		client.TunnelProtocol,
+		geoIPData,
+		state,
+		func(index int, filter *TrafficRulesFilter, mismatch string) {
+			result.TrafficRulesFilters = append(
+				result.TrafficRulesFilters,
+				TrafficRulesFilterResult{
+					Index:    index,
+					Filter:   *filter,
+					Checked:  true,
+					Matched:  mismatch == "",
+					Mismatch: mismatch,
+				})
+		})
+
+	for i := len(result.TrafficRulesFilters); i < len(trafficRulesSet.FilteredRules); i++ {
+		result.TrafficRulesFilters = append(
+			result.TrafficRulesFilters,
+			TrafficRulesFilterResult{
+				Index:  i,
+				Filter: trafficRulesSet.FilteredRules[i].Filter,
+			})
+	}
+
+	if tacticsFilename == "" {
+		return result, nil
+	}
+
+	// The tactics API parameter validator is omitted, as the tactics
+	// request handler, which invokes it, isn't used here.
+	tacticsServer, err := tactics.NewServer(
+		CommonLogger(log),
+		getTacticsAPIParameterLogFieldFormatter(),
+		nil,
+		tacticsFilename)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result.Tactics, result.TacticsTag, result.TacticsFilters, err =
+		tacticsServer.ExplainTactics(
+			false, common.GeoIPData(geoIPData), apiParams)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// As in ServerTacticsParametersCache.Get, server-side tactics are
+	// selected using only the client GeoIP attributes.
+	result.ServerTactics, result.ServerTacticsTag, _, err =
+		tacticsServer.ExplainTactics(
+			true, common.GeoIPData(geoIPData), make(common.APIParameters))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2022, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tactics"
+)
+
+func TestSimulate(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+      "DefaultRules" : {
+        "RateLimits" : {
+          "ReadBytesPerSecond" : 1000
+        }
+      },
+      "FilteredRules" : [
+        {
+          "Filter" : {
+            "Regions" : ["R1"]
+          },
+          "Rules" : {
+            "RateLimits" : {
+              "ReadBytesPerSecond" : 2000
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "Regions" : ["R2"],
+            "HandshakeParameters" : {
+              "client_platform" : ["Android*"]
+            }
+          },
+          "Rules" : {
+            "RateLimits" : {
+              "ReadBytesPerSecond" : 3000
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "Regions" : ["R2"]
+          },
+          "Rules" : {
+            "RateLimits" : {
+              "ReadBytesPerSecond" : 4000
+            }
+          }
+        }
+      ]
+    }
+    `
+
+	tacticsConfigJSONFormat := `
+    {
+      "RequestPublicKey" : "%s",
+      "RequestPrivateKey" : "%s",
+      "RequestObfuscatedKey" : "%s",
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "ConnectionWorkerPoolSize" : 1
+        }
+      },
+      "FilteredTactics" : [
+        {
+          "Filter" : {
+            "Regions" : ["R2"],
+            "SpeedTestRTTMilliseconds" : {
+              "Aggregation" : "Median",
+              "AtLeast" : 1000
+            }
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "ConnectionWorkerPoolSize" : 2
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "Regions" : ["R2"],
+            "ISPs" : ["I2"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "ConnectionWorkerPoolSize" : 3
+            }
+          }
+        }
+      ]
+    }
+    `
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "simulate_traffic_rules.json")
+
+	err := ioutil.WriteFile(trafficRulesFilename, []byte(trafficRulesJSON), 0600)
+	if err != nil {
+		t.Fatalf("error paving traffic rules file: %s", err)
+	}
+
+	tacticsRequestPublicKey, tacticsRequestPrivateKey, tacticsRequestObfuscatedKey, err :=
+		tactics.GenerateKeys()
+	if err != nil {
+		t.Fatalf("error generating tactics keys: %s", err)
+	}
+
+	tacticsConfigJSON := fmt.Sprintf(
+		tacticsConfigJSONFormat,
+		tacticsRequestPublicKey, tacticsRequestPrivateKey, tacticsRequestObfuscatedKey)
+
+	tacticsConfigFilename := filepath.Join(testDataDirName, "simulate_tactics_config.json")
+
+	err = ioutil.WriteFile(tacticsConfigFilename, []byte(tacticsConfigJSON), 0600)
+	if err != nil {
+		t.Fatalf("error paving tactics config file: %s", err)
+	}
+
+	client := &SimulatedClient{
+		Region:              "R2",
+		ISP:                 "I2",
+		TunnelProtocol:      "OSSH",
+		APIProtocol:         "ssh",
+		HandshakeParameters: map[string]interface{}{"client_platform": "Windows"},
+		SpeedTestSamples:    []tactics.SpeedTestSample{{RTTMilliseconds: 100}},
+	}
+
+	result, err := Simulate(
+		trafficRulesFilename, tacticsConfigFilename, nil, client)
+	if err != nil {
+		t.Fatalf("Simulate failed: %s", err)
+	}
+
+	if result.GeoIPData.Country != "R2" || result.GeoIPData.ISP != "I2" {
+		t.Fatalf("unexpected GeoIP data: %+v", result.GeoIPData)
+	}
+
+	if *result.TrafficRules.RateLimits.ReadBytesPerSecond != 4000 {
+		t.Fatalf("unexpected traffic rules: %d",
+			*result.TrafficRules.RateLimits.ReadBytesPerSecond)
+	}
+
+	expectedTrafficRulesMismatches := []string{"Regions", "HandshakeParameters", ""}
+
+	if len(result.TrafficRulesFilters) != len(expectedTrafficRulesMismatches) {
+		t.Fatalf("unexpected traffic rules filter results: %+v", result.TrafficRulesFilters)
+	}
+
+	for i, mismatch := range expectedTrafficRulesMismatches {
+		filterResult := result.TrafficRulesFilters[i]
+		if !filterResult.Checked ||
+			filterResult.Matched != (mismatch == "") ||
+			filterResult.Mismatch != mismatch {
+			t.Fatalf("unexpected traffic rules filter result %d: %+v", i, filterResult)
+		}
+	}
+
+	if result.Tactics == nil || result.TacticsTag == "" ||
+		result.Tactics.Parameters["ConnectionWorkerPoolSize"] != float64(3) {
+		t.Fatalf("unexpected tactics: %+v", result.Tactics)
+	}
+
+	expectedTacticsMismatches := []string{"SpeedTestRTTMilliseconds", ""}
+
+	if len(result.TacticsFilters) != len(expectedTacticsMismatches) {
+		t.Fatalf("unexpected tactics filter results: %+v", result.TacticsFilters)
+	}
+
+	for i, mismatch := range expectedTacticsMismatches {
+		filterResult := result.TacticsFilters[i]
+		if filterResult.Matched != (mismatch == "") ||
+			filterResult.Mismatch != mismatch {
+			t.Fatalf("unexpected tactics filter result %d: %+v", i, filterResult)
+		}
+	}
+
+	// The first matching traffic rules filter is selected and subsequent
+	// filters aren't checked.
+
+	client.HandshakeParameters["client_platform"] = "Android_10"
+
+	result, err = Simulate(
+		trafficRulesFilename, tacticsConfigFilename, nil, client)
+	if err != nil {
+		t.Fatalf("Simulate failed: %s", err)
+	}
+
+	if *result.TrafficRules.RateLimits.ReadBytesPerSecond != 3000 {
+		t.Fatalf("unexpected traffic rules: %d",
+			*result.TrafficRules.RateLimits.ReadBytesPerSecond)
+	}
+
+	if len(result.TrafficRulesFilters) != 3 ||
+		!result.TrafficRulesFilters[1].Matched ||
+		result.TrafficRulesFilters[2].Checked {
+		t.Fatalf("unexpected traffic rules filter results: %+v", result.TrafficRulesFilters)
+	}
+}
@@ -22,6 +22,7 @@ package server
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/errors"
@@ -43,7 +44,8 @@ const (
 //
 // There is no TTL for cache entries as the cached filtered tactics remain
 // valid until the tactics config changes; Flush must be called on tactics
-// config hot reloads.
+// config hot reloads. Tactics filtered by time windows are distinguished by
+// including the filter time scope in the cache key.
 type ServerTacticsParametersCache struct {
 	support             *SupportServices
 	mutex               sync.Mutex
@@ -247,5 +249,7 @@ func (c *ServerTacticsParametersCache) makeKey(geoIPData GeoIPData) string {
 		city = geoIPData.City
 	}
 
-	return fmt.Sprintf("%s-%s-%s-%s", region, ISP, ASN, city)
+	timeScope := c.support.TacticsServer.GetFilterTimeScope(time.Now())
+
+	return fmt.Sprintf("%s-%s-%s-%s-%d", region, ISP, ASN, city, timeScope)
 }
@@ -521,6 +521,30 @@ func (set *TrafficRulesSet) GetTrafficRules(
 	geoIPData GeoIPData,
 	state handshakeState) TrafficRules {
 
+	return set.getTrafficRules(
+		isFirstTunnelInSession, tunnelProtocol, geoIPData, state, nil)
+}
+
+// TrafficRulesFilterResult reports the outcome of checking one FilteredRules
+// entry against client attributes. When Matched is false, Mismatch names
+// the first TrafficRulesFilter field that the client attributes did not
+// satisfy. Since only the first matching filter is applied, Checked is
+// false for all entries following the selected filter.
+type TrafficRulesFilterResult struct {
+	Index    int
+	Filter   TrafficRulesFilter
+	Checked  bool
+	Matched  bool
+	Mismatch string
+}
+
+func (set *TrafficRulesSet) getTrafficRules(
+	isFirstTunnelInSession bool,
+	tunnelProtocol string,
+	geoIPData GeoIPData,
+	state handshakeState,
+	explain func(int, *TrafficRulesFilter, string)) TrafficRules {
+
 	set.ReloadableFile.RLock()
 	defer set.ReloadableFile.RUnlock()
 
@@ -617,141 +641,18 @@ func (set *TrafficRulesSet) GetTrafficRules(
 	}
 
 	// TODO: faster lookup?
-	for _, filteredRules := range set.FilteredRules {
+	for i, filteredRules := range set.FilteredRules {
 
 		log.WithTraceFields(LogFields{"filter": filteredRules.Filter}).Debug("filter check")
 
-		if len(filteredRules.Filter.TunnelProtocols) > 0 {
-			if !common.Contains(filteredRules.Filter.TunnelProtocols, tunnelProtocol) {
-				continue
-			}
-		}
-
-		if len(filteredRules.Filter.Regions) > 0 {
-			if filteredRules.Filter.regionLookup != nil {
-				if !filteredRules.Filter.regionLookup[geoIPData.Country] {
-					continue
-				}
-			} else {
-				if !common.Contains(filteredRules.Filter.Regions, geoIPData.Country) {
-					continue
-				}
-			}
-		}
-
-		if len(filteredRules.Filter.ISPs) > 0 {
-			if filteredRules.Filter.ispLookup != nil {
-				if !filteredRules.Filter.ispLookup[geoIPData.ISP] {
-					continue
-				}
-			} else {
-				if !common.Contains(filteredRules.Filter.ISPs, geoIPData.ISP) {
-					continue
-				}
-			}
-		}
-
-		if len(filteredRules.Filter.ASNs) > 0 {
-			if filteredRules.Filter.asnLookup != nil {
-				if !filteredRules.Filter.asnLookup[geoIPData.ASN] {
-					continue
-				}
-			} else {
-				if !common.Contains(filteredRules.Filter.ASNs, geoIPData.ASN) {
-					continue
-				}
-			}
-		}
-
-		if len(filteredRules.Filter.Cities) > 0 {
-			if filteredRules.Filter.cityLookup != nil {
-				if !filteredRules.Filter.cityLookup[geoIPData.City] {
-					continue
-				}
-			} else {
-				if !common.Contains(filteredRules.Filter.Cities, geoIPData.City) {
-					continue
-				}
-			}
-		}
-
-		if filteredRules.Filter.APIProtocol != "" {
-			if !state.completed {
-				continue
-			}
-			if state.apiProtocol != filteredRules.Filter.APIProtocol {
-				continue
-			}
-		}
+		mismatch := filteredRules.Filter.check(tunnelProtocol, geoIPData, state)
 
-		if filteredRules.Filter.HandshakeParameters != nil {
-			if !state.completed {
-				continue
-			}
-
-			mismatch := false
-			for name, values := range filteredRules.Filter.HandshakeParameters {
-				clientValue, err := getStringRequestParam(state.apiParams, name)
-				if err != nil || !common.ContainsWildcard(values, clientValue) {
-					mismatch = true
-					break
-				}
-			}
-			if mismatch {
-				continue
-			}
+		if explain != nil {
+			explain(i, &filteredRules.Filter, mismatch)
 		}
 
-		if filteredRules.Filter.AuthorizationsRevoked {
-			if !state.completed {
-				continue
-			}
-
-			if !state.authorizationsRevoked {
-				continue
-			}
-
-		} else {
-			if len(filteredRules.Filter.ActiveAuthorizationIDs) > 0 {
-				if !state.completed {
-					continue
-				}
-
-				if state.authorizationsRevoked {
-					continue
-				}
-
-				if filteredRules.Filter.activeAuthorizationIDLookup != nil {
-					found := false
-					for _, ID := range state.activeAuthorizationIDs {
-						if filteredRules.Filter.activeAuthorizationIDLookup[ID] {
-							found = true
-							break
-						}
-					}
-					if !found {
-						continue
-					}
-				} else {
-					if !common.ContainsAny(filteredRules.Filter.ActiveAuthorizationIDs, state.activeAuthorizationIDs) {
-						continue
-					}
-				}
-
-			}
-			if len(filteredRules.Filter.AuthorizedAccessTypes) > 0 {
-				if !state.completed {
-					continue
-				}
-
-				if state.authorizationsRevoked {
-					continue
-				}
-
-				if !common.ContainsAny(filteredRules.Filter.AuthorizedAccessTypes, state.authorizedAccessTypes) {
-					continue
-				}
-			}
+		if mismatch != "" {
+			continue
 		}
 
 		log.WithTraceFields(LogFields{"filter": filteredRules.Filter}).Debug("filter match")
@@ -851,6 +752,145 @@ func (set *TrafficRulesSet) GetTrafficRules(
 	return trafficRules
 }
 
+// check returns "" when the client attributes satisfy the filter, or else
+// the name of the first filter field that isn't satisfied. The returned
+// values are constant strings, so check doesn't allocate in the common case.
+func (filter *TrafficRulesFilter) check(
+	tunnelProtocol string,
+	geoIPData GeoIPData,
+	state handshakeState) string {
+
+	if len(filter.TunnelProtocols) > 0 {
+		if !common.Contains(filter.TunnelProtocols, tunnelProtocol) {
+			return "TunnelProtocols"
+		}
+	}
+
+	if len(filter.Regions) > 0 {
+		if filter.regionLookup != nil {
+			if !filter.regionLookup[geoIPData.Country] {
+				return "Regions"
+			}
+		} else {
+			if !common.Contains(filter.Regions, geoIPData.Country) {
+				return "Regions"
+			}
+		}
+	}
+
+	if len(filter.ISPs) > 0 {
+		if filter.ispLookup != nil {
+			if !filter.ispLookup[geoIPData.ISP] {
+				return "ISPs"
+			}
+		} else {
+			if !common.Contains(filter.ISPs, geoIPData.ISP) {
+				return "ISPs"
+			}
+		}
+	}
+
+	if len(filter.ASNs) > 0 {
+		if filter.asnLookup != nil {
+			if !filter.asnLookup[geoIPData.ASN] {
+				return "ASNs"
+			}
+		} else {
+			if !common.Contains(filter.ASNs, geoIPData.ASN) {
+				return "ASNs"
+			}
+		}
+	}
+
+	if len(filter.Cities) > 0 {
+		if filter.cityLookup != nil {
+			if !filter.cityLookup[geoIPData.City] {
+				return "Cities"
+			}
+		} else {
+			if !common.Contains(filter.Cities, geoIPData.City) {
+				return "Cities"
+			}
+		}
+	}
+
+	if filter.APIProtocol != "" {
+		if !state.completed {
+			return "APIProtocol"
+		}
+		if state.apiProtocol != filter.APIProtocol {
+			return "APIProtocol"
+		}
+	}
+
+	if filter.HandshakeParameters != nil {
+		if !state.completed {
+			return "HandshakeParameters"
+		}
+
+		for name, values := range filter.HandshakeParameters {
+			clientValue, err := getStringRequestParam(state.apiParams, name)
+			if err != nil || !common.ContainsWildcard(values, clientValue) {
+				return "HandshakeParameters"
+			}
+		}
+	}
+
+	if filter.AuthorizationsRevoked {
+		if !state.completed {
+			return "AuthorizationsRevoked"
+		}
+
+		if !state.authorizationsRevoked {
+			return "AuthorizationsRevoked"
+		}
+
+	} else {
+		if len(filter.ActiveAuthorizationIDs) > 0 {
+			if !state.completed {
+				return "ActiveAuthorizationIDs"
+			}
+
+			if state.authorizationsRevoked {
+				return "ActiveAuthorizationIDs"
+			}
+
+			if filter.activeAuthorizationIDLookup != nil {
+				found := false
+				for _, ID := range state.activeAuthorizationIDs {
+					if filter.activeAuthorizationIDLookup[ID] {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return "ActiveAuthorizationIDs"
+				}
+			} else {
+				if !common.ContainsAny(filter.ActiveAuthorizationIDs, state.activeAuthorizationIDs) {
+					return "ActiveAuthorizationIDs"
+				}
+			}
+
+		}
+		if len(filter.AuthorizedAccessTypes) > 0 {
+			if !state.completed {
+				return "AuthorizedAccessTypes"
+			}
+
+			if state.authorizationsRevoked {
+				return "AuthorizedAccessTypes"
+			}
+
+			if !common.ContainsAny(filter.AuthorizedAccessTypes, state.authorizedAccessTypes) {
+				return "AuthorizedAccessTypes"
+			}
+		}
+	}
+
+	return ""
+}
+
 func (rules *TrafficRules) AllowTCPPort(remoteIP net.IP, port int) bool {
 
 	if rules.DisallowTCPPorts.Lookup(port) {
@@ -163,6 +163,10 @@ func (server *TunnelServer) Run() error {
 		} else if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
 
 			logTunnelProtocol := tunnelProtocol
+			probeResponseDecoyAddress := ""
+			if probeResponse, ok := support.Config.TunnelProtocolProbeResponses[tunnelProtocol]; ok {
+				probeResponseDecoyAddress = probeResponse.DecoyAddress
+			}
 			listener, err = quic.Listen(
 				CommonLogger(log),
 				func(clientAddress string, err error, logFields common.LogFields) {
@@ -172,7 +176,9 @@ func (server *TunnelServer) Run() error {
 				},
 				localAddress,
 				support.Config.ObfuscatedSSHKey,
-				support.Config.EnableGQUIC)
+				support.Config.EnableGQUIC,
+				support.Config.EnableQUICActiveMigration,
+				probeResponseDecoyAddress)
 
 		} else if protocol.TunnelProtocolUsesRefractionNetworking(tunnelProtocol) {
 
@@ -291,6 +297,14 @@ func (server *TunnelServer) ResetAllClientOSLConfigs() {
 	server.sshServer.resetAllClientOSLConfigs()
 }
 
+// RevokeAllClientRevokedAuthorizations checks the authorizations of all
+// established clients against the current authorization revocations. Clients
+// with a revoked authorization have their authorizations revoked, and new
+// traffic rules selected, as filtered by the revoked state.
+func (server *TunnelServer) RevokeAllClientRevokedAuthorizations() {
+	server.sshServer.revokeAllClientRevokedAuthorizations()
+}
+
 // SetClientHandshakeState sets the handshake state -- that it completed and
 // what parameters were passed -- in sshClient. This state is used for allowing
 // port forwards and for future traffic rule selection. SetClientHandshakeState
@@ -1080,6 +1094,24 @@ func (sshServer *sshServer) resetAllClientTrafficRules() {
 	}
 }
 
+func (sshServer *sshServer) revokeAllClientRevokedAuthorizations() {
+
+	sshServer.clientsMutex.Lock()
+	clients := make(map[string]*sshClient)
+	for sessionID, client := range sshServer.clients {
+		clients[sessionID] = client
+	}
+	sshServer.clientsMutex.Unlock()
+
+	for sessionID, client := range clients {
+		if client.hasRevokedAuthorization() {
+			log.WithTraceFields(
+				LogFields{"sessionID": sessionID}).Info("revoking client authorizations")
+			sshServer.revokeClientAuthorizations(sessionID)
+		}
+	}
+}
+
 func (sshServer *sshServer) resetAllClientOSLConfigs() {
 
 	// Flush cached seed state. This has the same effect
@@ -1351,8 +1383,13 @@ func (sshServer *sshServer) handleClient(
 			return
 		}
 
+		// onSSHHandshakeFinished may be called more than once, as it's also
+		// invoked when a probe response begins; see sshClient.run.
+		var releaseOnce sync.Once
 		onSSHHandshakeFinished = func() {
-			sshServer.concurrentSSHHandshakes.Release(1)
+			releaseOnce.Do(func() {
+				sshServer.concurrentSSHHandshakes.Release(1)
+			})
 		}
 	}
 
@@ -1418,6 +1455,7 @@ type sshClient struct {
 	totalUdpgwChannelCount               int
 	packetTunnelChannel                  ssh.Channel
 	totalPacketTunnelChannelCount        int
+	packetTunnelDatagrams                tun.DatagramTransport
 	trafficRules                         TrafficRules
 	tcpTrafficState                      trafficState
 	udpTrafficState                      trafficState
@@ -1557,6 +1595,7 @@ type handshakeState struct {
 	activeAuthorizationIDs  []string
 	authorizedAccessTypes   []string
 	authorizationsRevoked   bool
+	verifiedAuthorizations  []*accesscontrol.Authorization
 	domainBytesChecksum     []byte
 	establishedTunnelsCount int
 	splitTunnelLookup       *splitTunnelLookup
@@ -1762,6 +1801,18 @@ func (sshClient *sshClient) run(
 	throttledConn := common.NewThrottledConn(conn, sshClient.rateLimits())
 	conn = throttledConn
 
+	// QUIC datagrams, when supported by the client, may be used to relay
+	// packet tunnel packets. Datagrams bypass the conn layers, so datagrams
+	// are explicitly counted as activityConn activity, extending the
+	// inactivity deadline, and are subject to the throttledConn rate limits.
+	//
+	// Limitation: datagrams are not included in burst monitoring.
+
+	if quicConn, ok := baseConn.(*quic.Conn); ok && quicConn.SupportsDatagrams() {
+		sshClient.packetTunnelDatagrams = tun.NewMonitoredDatagramTransport(
+			quicConn, activityConn, throttledConn)
+	}
+
 	// Replay of server-side parameters is set or extended after a new tunnel
 	// meets duration and bytes transferred targets. Set a timer now that expires
 	// shortly after the target duration. When the timer fires, check the time of
@@ -1868,6 +1919,26 @@ func (sshClient *sshClient) run(
 		})
 	}
 
+	// A probe response, when configured, replaces the default OSSH anti-probing
+	// behavior. As a probe response may legitimately run longer than the SSH
+	// handshake timeout, the timeout is cancelled and the handshake semaphore
+	// is released when the probe response begins. The probe response remains
+	// subject to the activityConn inactivity timeout and shutdown.
+	var probeResponse *obfuscator.ProbeResponseConfig
+	var onProbeResponse func()
+	if sshClient.sshListener.tunnelProtocol == protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+		probeResponse = sshClient.sshServer.support.Config.TunnelProtocolProbeResponses[sshClient.sshListener.tunnelProtocol]
+		releaseHandshake := onSSHHandshakeFinished
+		onProbeResponse = func() {
+			if sshHandshakeAfterFunc != nil {
+				sshHandshakeAfterFunc.Stop()
+			}
+			if releaseHandshake != nil {
+				releaseHandshake()
+			}
+		}
+	}
+
 	go func(baseConn, conn net.Conn) {
 		sshServerConfig := &ssh.ServerConfig{
 			PasswordCallback: sshClient.passwordCallback,
@@ -1919,7 +1990,9 @@ func (sshClient *sshClient) run(
 						clientIP,
 						errors.Trace(err),
 						LogFields(logFields))
-				})
+				},
+				probeResponse,
+				onProbeResponse)
 
 			if err != nil {
 				err = errors.Trace(err)
@@ -2663,6 +2736,28 @@ func (sshClient *sshClient) handleNewPacketTunnelChannel(
 
 	sshClient.setPacketTunnelChannel(packetTunnelChannel)
 
+	// When requested by the client, and supported by the underlying tunnel
+	// protocol, relay packets as QUIC datagrams. The datagram keys are sent
+	// over packetTunnelChannel, so datagrams are encrypted and authenticated
+	// with keys bound to this SSH session.
+
+	var packetTunnelTransport io.ReadWriteCloser = packetTunnelChannel
+
+	if string(newChannel.ExtraData()) == protocol.PACKET_TUNNEL_QUIC_DATAGRAMS_EXTRA_DATA &&
+		sshClient.packetTunnelDatagrams != nil {
+
+		packetTunnelTransport, err = tun.NewDatagramChannelTransport(
+			packetTunnelChannel, sshClient.packetTunnelDatagrams, true)
+		if err != nil {
+			if !isExpectedTunnelIOError(err) {
+				log.WithTraceFields(LogFields{"error": err}).Warning("new datagram transport failed")
+			}
+			packetTunnelChannel.Close()
+			sshClient.setPacketTunnelChannel(nil)
+			return
+		}
+	}
+
 	// PacketTunnelServer will run the client's packet tunnel. If necessary, ClientConnected
 	// will stop packet tunnel workers for any previous packet tunnel channel.
 
@@ -2713,7 +2808,7 @@ func (sshClient *sshClient) handleNewPacketTunnelChannel(
 
 	err = sshClient.sshServer.support.PacketTunnelServer.ClientConnected(
 		sshClient.sessionID,
-		packetTunnelChannel,
+		packetTunnelTransport,
 		checkAllowedTCPPortFunc,
 		checkAllowedUDPPortFunc,
 		checkAllowedDomainFunc,
@@ -3258,6 +3353,7 @@ func (sshClient *sshClient) setHandshakeState(
 	// protocol/logs don't need to handle 'null' values.
 	authorizationIDs := make([]string, 0)
 	authorizedAccessTypes := make([]string, 0)
+	var verifiedAuthorizations []*accesscontrol.Authorization
 	var stopTime time.Time
 
 	for i, authorization := range authorizations {
@@ -3268,8 +3364,7 @@ func (sshClient *sshClient) setHandshakeState(
 			break
 		}
 
-		verifiedAuthorization, err := accesscontrol.VerifyAuthorization(
-			&sshClient.sshServer.support.Config.AccessControlVerificationKeyRing,
+		verifiedAuthorization, err := sshClient.sshServer.support.AuthorizationVerifier.VerifyAuthorization(
 			authorization)
 
 		if err != nil {
@@ -3280,6 +3375,12 @@ func (sshClient *sshClient) setHandshakeState(
 
 		authorizationID := base64.StdEncoding.EncodeToString(verifiedAuthorization.ID)
 
+		if sshClient.sshServer.support.AuthorizationRevocations.IsRevoked(verifiedAuthorization) {
+			log.WithTraceFields(
+				LogFields{"authorizationID": authorizationID}).Warning("revoked authorization")
+			continue
+		}
+
 		if common.Contains(authorizedAccessTypes, verifiedAuthorization.AccessType) {
 			log.WithTraceFields(
 				LogFields{"accessType": verifiedAuthorization.AccessType}).Warning("duplicate authorization access type")
@@ -3288,6 +3389,7 @@ func (sshClient *sshClient) setHandshakeState(
 
 		authorizationIDs = append(authorizationIDs, authorizationID)
 		authorizedAccessTypes = append(authorizedAccessTypes, verifiedAuthorization.AccessType)
+		verifiedAuthorizations = append(verifiedAuthorizations, verifiedAuthorization)
 
 		if stopTime.IsZero() || stopTime.After(verifiedAuthorization.Expires) {
 			stopTime = verifiedAuthorization.Expires
@@ -3344,6 +3446,7 @@ func (sshClient *sshClient) setHandshakeState(
 
 		sshClient.handshakeState.activeAuthorizationIDs = authorizationIDs
 		sshClient.handshakeState.authorizedAccessTypes = authorizedAccessTypes
+		sshClient.handshakeState.verifiedAuthorizations = verifiedAuthorizations
 
 		// On exit, sshClient.runTunnel will call releaseAuthorizations, which
 		// will release the authorization IDs so the client can reconnect and
@@ -3427,6 +3530,26 @@ func (sshClient *sshClient) getHandshaked() (bool, bool) {
 	return completed, exhausted
 }
 
+// hasRevokedAuthorization indicates if any of the client's active
+// authorizations is in the current authorization revocations. Returns false
+// when the client's authorizations are already revoked.
+func (sshClient *sshClient) hasRevokedAuthorization() bool {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	if sshClient.handshakeState.authorizationsRevoked {
+		return false
+	}
+
+	for _, authorization := range sshClient.handshakeState.verifiedAuthorizations {
+		if sshClient.sshServer.support.AuthorizationRevocations.IsRevoked(authorization) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (sshClient *sshClient) getDisableDiscovery() bool {
 	sshClient.Lock()
 	defer sshClient.Unlock()
@@ -33,6 +33,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
@@ -58,6 +59,8 @@ type ServerContext struct {
 	clientUpgradeVersion     string
 	serverHandshakeTimestamp string
 	paddingPRNG              *prng.PRNG
+	migrate                  bool
+	migrateServerEntryIPs    []string
 }
 
 // MakeSessionId creates a new session ID. The same session ID is used across
@@ -258,6 +261,7 @@ func (serverContext *ServerContext) doHandshakeRequest(
 	}
 
 	var serverEntries []protocol.ServerEntryFields
+	var migrateServerEntryIPs []string
 
 	// Store discovered server entries
 	// We use the server's time, as it's available here, for the server entry
@@ -293,6 +297,11 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		}
 
 		serverEntries = append(serverEntries, serverEntryFields)
+
+		if serverEntryFields.GetIPAddress() != serverContext.tunnel.dialParams.ServerEntry.IpAddress {
+			migrateServerEntryIPs = append(
+				migrateServerEntryIPs, serverEntryFields.GetIPAddress())
+		}
 	}
 
 	err = StoreServerEntries(
@@ -303,6 +312,29 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return errors.Trace(err)
 	}
 
+	// When the server is loaded and asks the client to migrate, the
+	// alternative server entries sent by the server, or else the discovered
+	// server entries, are the preferred alternatives. The Controller
+	// establishes a tunnel to an alternative server and then drains this
+	// tunnel.
+	serverContext.migrate = handshakeResponse.Migrate
+	if serverContext.migrate {
+
+		alternativeServerEntryIPs, err := storeMigrateServerEntries(
+			serverContext.tunnel.config,
+			handshakeResponse,
+			serverContext.tunnel.dialParams.ServerEntry.IpAddress)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(alternativeServerEntryIPs) > 0 {
+			migrateServerEntryIPs = alternativeServerEntryIPs
+		}
+
+		serverContext.migrateServerEntryIPs = migrateServerEntryIPs
+	}
+
 	NoticeHomepages(handshakeResponse.Homepages)
 
 	serverContext.clientUpgradeVersion = handshakeResponse.UpgradeClientVersion
@@ -367,8 +399,7 @@ func (serverContext *ServerContext) doHandshakeRequest(
 			if tacticsRecord != nil &&
 				prng.FlipWeightedCoin(tacticsRecord.Tactics.Probability) {
 
-				err := serverContext.tunnel.config.SetParameters(
-					tacticsRecord.Tag, true, tacticsRecord.Tactics.Parameters)
+				err := applyTactics(serverContext.tunnel.config, tacticsRecord)
 				if err != nil {
 					NoticeInfo("apply handshake tactics failed: %s", err)
 				}
@@ -382,6 +413,72 @@ func (serverContext *ServerContext) doHandshakeRequest(
 	return nil
 }
 
+// storeMigrateServerEntries stores the alternative server entries sent by a
+// loaded server that asks the client to migrate, and returns their IP
+// addresses, excluding the loaded server's own IP address.
+//
+// Alternative server entries must be signed. When server entry signature
+// public keys are configured, the signatures are verified, and any entry
+// that fails verification is skipped.
+func storeMigrateServerEntries(
+	config *Config,
+	handshakeResponse protocol.HandshakeResponse,
+	excludeIPAddress string) ([]string, error) {
+
+	if len(handshakeResponse.MigrateServerEntries) == 0 {
+		return nil, nil
+	}
+
+	serverEntrySignaturePublicKeys := config.GetServerEntrySignaturePublicKeys()
+
+	var serverEntries []protocol.ServerEntryFields
+	var serverEntryIPs []string
+
+	for _, encodedServerEntry := range handshakeResponse.MigrateServerEntries {
+
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry,
+			common.TruncateTimestampToHour(handshakeResponse.ServerTimestamp),
+			protocol.SERVER_ENTRY_SOURCE_DISCOVERY)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if !serverEntryFields.HasSignature() {
+			NoticeWarning("unsigned migrate server entry")
+			continue
+		}
+
+		if len(serverEntrySignaturePublicKeys) > 0 {
+			err = serverEntryFields.VerifySignatureWithKeys(serverEntrySignaturePublicKeys)
+			if err != nil {
+				NoticeWarning("invalid migrate server entry signature: %s", err)
+				continue
+			}
+		}
+
+		err = protocol.ValidateServerEntryFields(serverEntryFields)
+		if err != nil {
+			NoticeWarning("invalid migrate server entry: %s", err)
+			continue
+		}
+
+		if serverEntryFields.GetIPAddress() == excludeIPAddress {
+			continue
+		}
+
+		serverEntries = append(serverEntries, serverEntryFields)
+		serverEntryIPs = append(serverEntryIPs, serverEntryFields.GetIPAddress())
+	}
+
+	err := StoreServerEntries(config, serverEntries, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return serverEntryIPs, nil
+}
+
 // DoConnectedRequest performs the "connected" API request. This request is
 // used for statistics, including unique user counting; reporting the full
 // tunnel establishment duration including the handshake request; and updated
@@ -423,7 +520,7 @@ func (serverContext *ServerContext) DoConnectedRequest() error {
 	params := serverContext.getBaseAPIParameters(
 		baseParametersOnlyUpstreamFragmentorDialParameters)
 
-	lastConnected, err := getLastConnected()
+	lastConnected, err := getLastConnected(serverContext.tunnel.config)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -466,6 +563,7 @@ func (serverContext *ServerContext) DoConnectedRequest() error {
 	}
 
 	err = SetKeyValue(
+		serverContext.tunnel.config,
 		datastoreLastConnectedKey, connectedResponse.ConnectedTimestamp)
 	if err != nil {
 		return errors.Trace(err)
@@ -474,8 +572,8 @@ func (serverContext *ServerContext) DoConnectedRequest() error {
 	return nil
 }
 
-func getLastConnected() (string, error) {
-	lastConnected, err := GetKeyValue(datastoreLastConnectedKey)
+func getLastConnected(config *Config) (string, error) {
+	lastConnected, err := GetKeyValue(config, datastoreLastConnectedKey)
 	if err != nil {
 		return "", errors.Trace(err)
 	}
@@ -540,12 +638,12 @@ func (serverContext *ServerContext) DoStatusRequest(tunnel *Tunnel) error {
 		// Resend the transfer stats and tunnel stats later
 		// Note: potential duplicate reports if the server received and processed
 		// the request but the client failed to receive the response.
-		putBackStatusRequestPayload(statusPayloadInfo)
+		putBackStatusRequestPayload(serverContext.tunnel.config, statusPayloadInfo)
 
 		return errors.Trace(err)
 	}
 
-	confirmStatusRequestPayload(statusPayloadInfo)
+	confirmStatusRequestPayload(serverContext.tunnel.config, statusPayloadInfo)
 
 	var statusResponse protocol.StatusResponse
 	err = json.Unmarshal(response, &statusResponse)
@@ -619,7 +717,7 @@ func makeStatusRequestPayload(
 	if err != nil {
 
 		// Send the transfer stats and tunnel stats later
-		putBackStatusRequestPayload(payloadInfo)
+		putBackStatusRequestPayload(config, payloadInfo)
 
 		return nil, nil, errors.Trace(err)
 	}
@@ -627,10 +725,12 @@ func makeStatusRequestPayload(
 	return jsonPayload, payloadInfo, nil
 }
 
-func putBackStatusRequestPayload(payloadInfo *statusRequestPayloadInfo) {
+func putBackStatusRequestPayload(
+	config *Config, payloadInfo *statusRequestPayloadInfo) {
+
 	transferstats.PutBackStatsForServer(
 		payloadInfo.serverId, payloadInfo.transferStats)
-	err := PutBackUnreportedPersistentStats(payloadInfo.persistentStats)
+	err := PutBackUnreportedPersistentStats(config, payloadInfo.persistentStats)
 	if err != nil {
 		// These persistent stats records won't be resent until after a
 		// datastore re-initialization.
@@ -639,8 +739,10 @@ func putBackStatusRequestPayload(payloadInfo *statusRequestPayloadInfo) {
 	}
 }
 
-func confirmStatusRequestPayload(payloadInfo *statusRequestPayloadInfo) {
-	err := ClearReportedPersistentStats(payloadInfo.persistentStats)
+func confirmStatusRequestPayload(
+	config *Config, payloadInfo *statusRequestPayloadInfo) {
+
+	err := ClearReportedPersistentStats(config, payloadInfo.persistentStats)
 	if err != nil {
 		// These persistent stats records may be resent.
 		NoticeWarning(
@@ -745,7 +847,7 @@ func RecordFailedTunnelStat(
 		return nil
 	}
 
-	lastConnected, err := getLastConnected()
+	lastConnected, err := getLastConnected(config)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -917,6 +1019,11 @@ func getBaseAPIParameters(
 		params["device_region"] = config.DeviceRegion
 	}
 
+	tacticsExperimentArms := config.GetTacticsExperimentArms()
+	if len(tacticsExperimentArms) > 0 {
+		params[tactics.EXPERIMENT_ARMS_PARAMETER_NAME] = tacticsExperimentArms
+	}
+
 	if filter == baseParametersAll {
 
 		params["relay_protocol"] = dialParams.TunnelProtocol
@@ -1017,6 +1124,10 @@ func getBaseAPIParameters(
 			params["quic_disable_client_path_mtu_discovery"] = "1"
 		}
 
+		if dialParams.QUICEnableDatagrams {
+			params["quic_enable_datagrams"] = "1"
+		}
+
 		isReplay := "0"
 		if dialParams.IsReplay {
 			isReplay = "1"
@@ -1089,6 +1200,37 @@ func getBaseAPIParameters(
 
 				params["dns_attempt"] = strconv.Itoa(
 					dialParams.ResolveParameters.GetFirstAttemptWithAnswer())
+
+				// In cross-check mode, report the cross-check outcome, which
+				// indicates suspected DNS poisoning.
+
+				crossCheckResult := dialParams.ResolveParameters.GetCrossCheckResult()
+				if crossCheckResult != nil {
+					params["dns_cross_check_sources"] = strconv.Itoa(crossCheckResult.Sources)
+					if crossCheckResult.Mismatch {
+						params["dns_cross_check_mismatch"] = "1"
+					}
+					if crossCheckResult.Injection {
+						params["dns_cross_check_injection"] = "1"
+					}
+					if crossCheckResult.TTLAnomaly {
+						params["dns_cross_check_ttl_anomaly"] = "1"
+					}
+					if crossCheckResult.Poisoned {
+						params["dns_cross_check_poisoned"] = "1"
+					}
+					params["dns_cross_check_selected"] = crossCheckResult.Selected
+				}
+
+				// Report when HTTPS records were resolved and when their IP
+				// hints were used in place of the A and AAAA records.
+
+				if dialParams.ResolveParameters.UseHTTPSRecords {
+					params["dns_https"] = "1"
+					if atomic.LoadInt32(&dialParams.usedHTTPSIPHints) == 1 {
+						params["dns_https_ip_hints"] = "1"
+					}
+				}
 			}
 		}
 
@@ -1237,13 +1379,13 @@ func HandleOSLRequest(
 	}
 
 	if oslRequest.ClearLocalSLOKs {
-		DeleteSLOKs()
+		DeleteSLOKs(tunnel.config)
 	}
 
 	seededNewSLOK := false
 
 	for _, slok := range oslRequest.SeedPayload.SLOKs {
-		duplicate, err := SetSLOK(slok.ID, slok.Key)
+		duplicate, err := SetSLOK(tunnel.config, slok.ID, slok.Key)
 		if err != nil {
 			// TODO: return error to trigger retry?
 			NoticeWarning("SetSLOK failed: %s", errors.Trace(err))
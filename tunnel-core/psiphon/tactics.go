@@ -21,6 +21,8 @@ package psiphon
 
 import (
 	"context"
+	"encoding/hex"
+	"strings"
 	"time"
 
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common"
@@ -166,8 +168,7 @@ func GetTactics(ctx context.Context, config *Config) {
 	if tacticsRecord != nil &&
 		prng.FlipWeightedCoin(tacticsRecord.Tactics.Probability) {
 
-		err := config.SetParameters(
-			tacticsRecord.Tag, true, tacticsRecord.Tactics.Parameters)
+		err := applyTactics(config, tacticsRecord)
 		if err != nil {
 			NoticeWarning("apply tactics failed: %s", err)
 
@@ -186,6 +187,75 @@ func GetTactics(ctx context.Context, config *Config) {
 	emitMemoryMetrics()
 }
 
+// applyTactics applies the tactics parameters to config, along with the
+// parameters for any assigned tactics experiment arms. The assigned arms are
+// recorded in config for reporting in API requests and stats.
+func applyTactics(config *Config, tacticsRecord *tactics.Record) error {
+
+	var installSeed *prng.Seed
+	if len(tacticsRecord.Tactics.Experiments) > 0 {
+		var err error
+		installSeed, err = getTacticsExperimentInstallSeed(config)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	applyParameters, arms, err :=
+		tacticsRecord.Tactics.GetExperimentParameters(installSeed)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = config.SetParameters(tacticsRecord.Tag, true, applyParameters)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	config.SetTacticsExperimentArms(arms)
+
+	if len(arms) > 0 {
+		NoticeInfo("applied tactics experiment arms: %s", strings.Join(arms, ", "))
+	}
+
+	return nil
+}
+
+// getTacticsExperimentInstallSeed returns the install seed used to assign
+// tactics experiment arms, creating and storing a new seed when there is none.
+// The seed is never sent to the server.
+func getTacticsExperimentInstallSeed(config *Config) (*prng.Seed, error) {
+
+	value, err := GetKeyValue(config, datastoreTacticsExperimentSeedKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if value != "" {
+		seedBytes, err := hex.DecodeString(value)
+		if err == nil && len(seedBytes) == prng.SEED_LENGTH {
+			var seed prng.Seed
+			copy(seed[:], seedBytes)
+			return &seed, nil
+		}
+		NoticeWarning("invalid tactics experiment install seed")
+	}
+
+	seed, err := prng.NewSeed()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = SetKeyValue(
+		config,
+		datastoreTacticsExperimentSeedKey, hex.EncodeToString(seed[:]))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return seed, nil
+}
+
 // fetchTactics performs a tactics request using the specified server entry.
 // fetchTactics will return nil/nil when the candidate server entry is
 // skipped.
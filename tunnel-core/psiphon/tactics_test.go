@@ -112,7 +112,7 @@ func TestStandAloneGetTactics(t *testing.T) {
 
 	// Close the datastore to exercise the OpenDatastore/CloseDatastore
 	// operations in GetTactics.
-	CloseDataStore()
+	CloseDataStore(config)
 
 	GetTactics(ctx, config)
 
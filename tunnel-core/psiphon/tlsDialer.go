@@ -167,6 +167,11 @@ type CustomTLSConfig struct {
 	// obfuscator.MakeTLSPassthroughMessage.
 	PassthroughMessage []byte
 
+	// ClientHelloFingerprintCallback, when set, is called with the JA3 and
+	// JA4 fingerprints of the ClientHello that is sent in the TLS handshake.
+	// The callback is not invoked when the fingerprints cannot be computed.
+	ClientHelloFingerprintCallback func(JA3, JA4 string)
+
 	clientSessionCache utls.ClientSessionCache
 }
 
@@ -566,6 +571,18 @@ func CustomTLSDial(
 		}
 	}
 
+	// Fingerprint the final ClientHello, after any modifications above, so
+	// that the reported values match what is actually sent on the wire.
+
+	if config.ClientHelloFingerprintCallback != nil {
+		clientHello := conn.HandshakeState.Hello.Raw
+		JA3, errJA3 := protocol.GetClientHelloJA3(clientHello)
+		JA4, errJA4 := protocol.GetClientHelloJA4(clientHello, false)
+		if errJA3 == nil && errJA4 == nil {
+			config.ClientHelloFingerprintCallback(JA3, JA4)
+		}
+	}
+
 	// Perform the TLS Handshake.
 
 	resultChannel := make(chan error)
@@ -45,6 +45,7 @@ import (
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/quic"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/refraction"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tactics"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tun"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/transferstats"
 )
 
@@ -90,6 +91,8 @@ type Tunnel struct {
 	serverContext                  *ServerContext
 	monitoringStartTime            time.Time
 	conn                           *common.BurstMonitoredConn
+	packetTunnelDatagrams          tun.DatagramTransport
+	migratableQUICConn             *quic.Conn
 	sshClient                      *ssh.Client
 	sshServerRequests              <-chan *ssh.Request
 	operateWaitGroup               *sync.WaitGroup
@@ -152,15 +155,17 @@ func ConnectTunnel(
 
 	// The tunnel is now connected
 	return &Tunnel{
-		mutex:               new(sync.Mutex),
-		config:              config,
-		dialParams:          dialParams,
-		livenessTestMetrics: dialResult.livenessTestMetrics,
-		extraFailureAction:  dialResult.extraFailureAction,
-		monitoringStartTime: dialResult.monitoringStartTime,
-		conn:                dialResult.monitoredConn,
-		sshClient:           dialResult.sshClient,
-		sshServerRequests:   dialResult.sshRequests,
+		mutex:                 new(sync.Mutex),
+		config:                config,
+		dialParams:            dialParams,
+		livenessTestMetrics:   dialResult.livenessTestMetrics,
+		extraFailureAction:    dialResult.extraFailureAction,
+		monitoringStartTime:   dialResult.monitoringStartTime,
+		conn:                  dialResult.monitoredConn,
+		packetTunnelDatagrams: dialResult.packetTunnelDatagrams,
+		migratableQUICConn:    dialResult.migratableQUICConn,
+		sshClient:             dialResult.sshClient,
+		sshServerRequests:     dialResult.sshRequests,
 		// A buffer allows at least one signal to be sent even when the receiver is
 		// not listening. Senders should not block.
 		signalPortForwardFailure:   make(chan struct{}, 1),
@@ -456,7 +461,7 @@ func (tunnel *Tunnel) DialTCPChannel(
 		channelType = protocol.TCP_PORT_FORWARD_NO_SPLIT_TUNNEL_TYPE
 	}
 
-	channel, err := tunnel.dialChannel(channelType, remoteAddr)
+	channel, err := tunnel.dialChannel(channelType, remoteAddr, nil)
 	if err != nil {
 		if isSplitTunnelRejectReason(err) {
 			return nil, true, nil
@@ -479,7 +484,17 @@ func (tunnel *Tunnel) DialTCPChannel(
 
 func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
 
-	channel, err := tunnel.dialChannel(protocol.PACKET_TUNNEL_CHANNEL_TYPE, "")
+	// When QUIC datagrams are available, request that packets are relayed as
+	// datagrams. Packets are sent over the channel until the server
+	// confirms; servers that don't support datagrams ignore the request.
+
+	var extraData []byte
+	if tunnel.packetTunnelDatagrams != nil {
+		extraData = []byte(protocol.PACKET_TUNNEL_QUIC_DATAGRAMS_EXTRA_DATA)
+	}
+
+	channel, err := tunnel.dialChannel(
+		protocol.PACKET_TUNNEL_CHANNEL_TYPE, "", extraData)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -491,7 +506,17 @@ func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
 
 	NoticeInfo("DialPacketTunnelChannel: established channel")
 
-	conn := newChannelConn(sshChannel)
+	var conn net.Conn = newChannelConn(sshChannel)
+
+	if tunnel.packetTunnelDatagrams != nil {
+		transport, err := tun.NewDatagramChannelTransport(
+			sshChannel, tunnel.packetTunnelDatagrams, false)
+		if err != nil {
+			sshChannel.Close()
+			return nil, errors.Trace(err)
+		}
+		conn = newDatagramChannelConn(sshChannel, transport)
+	}
 
 	// wrapWithTransferStats will track bytes transferred for the
 	// packet tunnel. It will count packet overhead (TCP/UDP/IP headers).
@@ -505,7 +530,8 @@ func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
 	return tunnel.wrapWithTransferStats(conn), nil
 }
 
-func (tunnel *Tunnel) dialChannel(channelType, remoteAddr string) (interface{}, error) {
+func (tunnel *Tunnel) dialChannel(
+	channelType, remoteAddr string, extraData []byte) (interface{}, error) {
 
 	if !tunnel.IsActivated() {
 		return nil, errors.TraceNew("tunnel is not activated")
@@ -548,7 +574,7 @@ func (tunnel *Tunnel) dialChannel(channelType, remoteAddr string) (interface{},
 		default:
 			var sshRequests <-chan *ssh.Request
 			result.channel, sshRequests, result.err =
-				tunnel.sshClient.OpenChannel(channelType, nil)
+				tunnel.sshClient.OpenChannel(channelType, extraData)
 			if result.err == nil {
 				go ssh.DiscardRequests(sshRequests)
 			}
@@ -651,13 +677,15 @@ func (conn *TunneledConn) Close() error {
 }
 
 type dialResult struct {
-	dialConn            net.Conn
-	monitoringStartTime time.Time
-	monitoredConn       *common.BurstMonitoredConn
-	sshClient           *ssh.Client
-	sshRequests         <-chan *ssh.Request
-	livenessTestMetrics *livenessTestMetrics
-	extraFailureAction  func()
+	dialConn              net.Conn
+	monitoringStartTime   time.Time
+	monitoredConn         *common.BurstMonitoredConn
+	packetTunnelDatagrams tun.DatagramTransport
+	migratableQUICConn    *quic.Conn
+	sshClient             *ssh.Client
+	sshRequests           <-chan *ssh.Request
+	livenessTestMetrics   *livenessTestMetrics
+	extraFailureAction    func()
 }
 
 // dialTunnel is a helper that builds the transport layers and establishes the
@@ -772,7 +800,8 @@ func dialTunnel(
 			dialParams.QUICClientHelloSeed,
 			dialParams.ServerEntry.SshObfuscatedKey,
 			dialParams.ObfuscatedQUICPaddingSeed,
-			dialParams.QUICDisablePathMTUDiscovery)
+			dialParams.QUICDisablePathMTUDiscovery,
+			dialParams.QUICEnableDatagrams)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -1200,14 +1229,37 @@ func dialTunnel(
 	// but should not be used to perform I/O as that would interfere with SSH
 	// (and also bypasses throttling).
 
+	// QUIC datagrams, when negotiated, may be used to relay packet tunnel
+	// packets. Datagrams bypass the conn layers, so datagrams are explicitly
+	// subject to the throttledConn rate limits.
+
+	var packetTunnelDatagrams tun.DatagramTransport
+	if quicConn, ok := dialConn.(*quic.Conn); ok && quicConn.SupportsDatagrams() {
+		packetTunnelDatagrams = tun.NewMonitoredDatagramTransport(
+			quicConn, nil, throttledConn)
+	}
+
+	// QUIC connections may be migrated to a new local socket when the
+	// client's network changes. See Tunnel.migrateQUICConn.
+
+	var migratableQUICConn *quic.Conn
+	if quicConn, ok := dialConn.(*quic.Conn); ok &&
+		quicConn.SupportsMigration() &&
+		!p.Bool(parameters.QUICDisableClientMigration) {
+
+		migratableQUICConn = quicConn
+	}
+
 	return &dialResult{
-			dialConn:            dialConn,
-			monitoringStartTime: monitoringStartTime,
-			monitoredConn:       monitoredConn,
-			sshClient:           result.sshClient,
-			sshRequests:         result.sshRequests,
-			livenessTestMetrics: result.livenessTestMetrics,
-			extraFailureAction:  extraFailureAction,
+			dialConn:              dialConn,
+			monitoringStartTime:   monitoringStartTime,
+			monitoredConn:         monitoredConn,
+			packetTunnelDatagrams: packetTunnelDatagrams,
+			migratableQUICConn:    migratableQUICConn,
+			sshClient:             result.sshClient,
+			sshRequests:           result.sshRequests,
+			livenessTestMetrics:   result.livenessTestMetrics,
+			extraFailureAction:    extraFailureAction,
 		},
 		nil
 }
@@ -1380,7 +1432,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 	// Schedule an almost-immediate status request to deliver any unreported
 	// persistent stats.
-	unreported := CountUnreportedPersistentStats()
+	unreported := CountUnreportedPersistentStats(tunnel.config)
 	if unreported > 0 {
 		NoticeInfo("Unreported persistent stats: %d", unreported)
 		p := tunnel.getCustomParameters()
@@ -1461,6 +1513,20 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		}
 	}()
 
+	// When the tunnel's QUIC connection supports migration, periodically
+	// check for network changes and, on a change, migrate the connection to
+	// the new network instead of failing the tunnel.
+
+	var networkIDCheckTicker <-chan time.Time
+	var lastNetworkID string
+	if tunnel.migratableQUICConn != nil {
+		p := tunnel.getCustomParameters()
+		ticker := time.NewTicker(p.Duration(parameters.QUICMigrationNetworkIDCheckPeriod))
+		defer ticker.Stop()
+		networkIDCheckTicker = ticker.C
+		lastNetworkID = tunnel.config.GetNetworkID()
+	}
+
 	shutdown := false
 	var err error
 	for !shutdown && err == nil {
@@ -1512,7 +1578,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 				bytesDown >= int64(replayTargetDownstreamBytes) &&
 				time.Since(tunnel.establishedTime) >= replayTargetTunnelDuration {
 
-				tunnel.dialParams.Succeeded()
+				tunnel.dialParams.Succeeded(tunnel.config)
 				setDialParamsSucceeded = true
 			}
 
@@ -1568,6 +1634,33 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 			}
 
+		case <-networkIDCheckTicker:
+			networkID := tunnel.config.GetNetworkID()
+			if networkID == lastNetworkID {
+				break
+			}
+			lastNetworkID = networkID
+
+			// When migration fails, the tunnel fails and a new tunnel is
+			// established. Migration doesn't validate the new path, so probe
+			// with an SSH keep alive; if the probe fails, the tunnel also
+			// fails.
+
+			err = tunnel.migrateQUICConn()
+			if err != nil {
+				break
+			}
+
+			NoticeInfo("migrated tunnel %s to network %s",
+				tunnel.dialParams.ServerEntry.GetDiagnosticID(), networkID)
+
+			p := tunnel.getCustomParameters()
+			timeout := p.Duration(parameters.SSHKeepAliveProbeTimeout)
+			select {
+			case signalProbeSshKeepAlive <- timeout:
+			default:
+			}
+
 		case err = <-sshKeepAliveError:
 
 		case serverRequest := <-tunnel.sshServerRequests:
@@ -1635,6 +1728,40 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	}
 }
 
+// migrateQUICConn moves the tunnel's QUIC connection to a new UDP socket,
+// created using the current network and the tunnel's dial configuration.
+func (tunnel *Tunnel) migrateQUICConn() error {
+
+	ctx, cancelFunc := context.WithTimeout(
+		tunnel.operateCtx,
+		tunnel.getCustomParameters().Duration(parameters.SSHKeepAliveProbeTimeout))
+	defer cancelFunc()
+
+	packetConn, remoteAddr, err := NewUDPConn(
+		ctx,
+		tunnel.dialParams.DirectDialAddress,
+		tunnel.dialParams.GetDialConfig())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The migrated connection must continue to send to the original server
+	// address. The address may differ when, for example, the new network
+	// uses a different IPv6 synthesis prefix.
+
+	if remoteAddr.String() != tunnel.migratableQUICConn.RemoteAddr().String() {
+		packetConn.Close()
+		return errors.TraceNew("server address changed")
+	}
+
+	err = tunnel.migratableQUICConn.Migrate(packetConn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
 // sendSshKeepAlive is a helper which sends a keepalive@openssh.com request
 // on the specified SSH connections and returns true of the request succeeds
 // within a specified timeout. If the request fails, the associated conn is
@@ -1806,12 +1933,12 @@ loop:
 
 			if resetOnFailure {
 				NoticeInfo("Delete dial parameters for %s", tunnel.dialParams.ServerEntry.GetDiagnosticID())
-				err := DeleteDialParameters(tunnel.dialParams.ServerEntry.IpAddress, tunnel.dialParams.NetworkID)
+				err := DeleteDialParameters(tunnel.config, tunnel.dialParams.ServerEntry.IpAddress, tunnel.dialParams.NetworkID)
 				if err != nil {
 					NoticeWarning("DeleteDialParameters failed: %s", err)
 				}
 				NoticeInfo("Delete server affinity for %s", tunnel.dialParams.ServerEntry.GetDiagnosticID())
-				err = DeleteServerEntryAffinity(tunnel.dialParams.ServerEntry.IpAddress)
+				err = DeleteServerEntryAffinity(tunnel.config, tunnel.dialParams.ServerEntry.IpAddress)
 				if err != nil {
 					NoticeWarning("DeleteServerEntryAffinity failed: %s", err)
 				}
@@ -219,7 +219,7 @@ func attemptConnectionsWithUserAgent(
 	if err != nil {
 		t.Fatalf("error initializing client datastore: %s", err)
 	}
-	defer CloseDataStore()
+	defer CloseDataStore(clientConfig)
 
 	SetNoticeWriter(NewNoticeReceiver(
 		func(notice []byte) {
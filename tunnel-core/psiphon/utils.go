@@ -38,6 +38,7 @@ import (
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/refraction"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/resolver"
 	"github.com/ooni/psiphon/tunnel-core/psiphon/common/stacktrace"
+	"github.com/ooni/psiphon/tunnel-core/psiphon/common/tun"
 )
 
 // MakePsiphonUserAgent constructs a User-Agent value to use for web service
@@ -174,6 +175,35 @@ func (conn *channelConn) SetWriteDeadline(_ time.Time) error {
 	return errors.TraceNew("unsupported")
 }
 
+// datagramChannelConn is a channelConn that relays packet tunnel packets
+// using a tun.DatagramChannelTransport layered on the SSH.Channel.
+type datagramChannelConn struct {
+	*channelConn
+	transport *tun.DatagramChannelTransport
+}
+
+func newDatagramChannelConn(
+	channel ssh.Channel,
+	transport *tun.DatagramChannelTransport) *datagramChannelConn {
+
+	return &datagramChannelConn{
+		channelConn: newChannelConn(channel),
+		transport:   transport,
+	}
+}
+
+func (conn *datagramChannelConn) Read(b []byte) (int, error) {
+	return conn.transport.Read(b)
+}
+
+func (conn *datagramChannelConn) Write(b []byte) (int, error) {
+	return conn.transport.Write(b)
+}
+
+func (conn *datagramChannelConn) Close() error {
+	return conn.transport.Close()
+}
+
 func emitMemoryMetrics() {
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
@@ -188,8 +218,8 @@ func emitMemoryMetrics() {
 		common.FormatByteCount(memStats.TotalAlloc))
 }
 
-func emitDatastoreMetrics() {
-	NoticeInfo("Datastore metrics at %s: %s", stacktrace.GetParentFunctionName(), GetDataStoreMetrics())
+func emitDatastoreMetrics(config *Config) {
+	NoticeInfo("Datastore metrics at %s: %s", stacktrace.GetParentFunctionName(), GetDataStoreMetrics(config))
 }
 
 func emitDNSMetrics(resolver *resolver.Resolver) {